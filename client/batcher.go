@@ -0,0 +1,198 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+const (
+	// DefaultBatchMaxCalls is the number of pending calls at which a
+	// Batcher flushes if BatcherOptions.MaxCalls is not set.
+	DefaultBatchMaxCalls = 128
+	// DefaultBatchMaxBytes is the size in bytes of pending calls at
+	// which a Batcher flushes if BatcherOptions.MaxBytes is not set.
+	DefaultBatchMaxBytes = 1 << 20
+	// DefaultBatchMaxDelay is the longest a call waits in a Batcher
+	// before it's flushed if BatcherOptions.MaxDelay is not set.
+	DefaultBatchMaxDelay = 10 * time.Millisecond
+)
+
+// BatcherOptions are the flush policy of a Batcher: pending calls are
+// flushed as soon as any of the limits is reached. Unset limits take
+// the default values.
+type BatcherOptions struct {
+	MaxCalls int           // Number of pending calls
+	MaxBytes int           // Encoded size of the arguments of pending calls
+	MaxDelay time.Duration // Time since the oldest pending call was added
+}
+
+// A Batcher accumulates independent writes, such as the Puts of an
+// ingestion workload, and sends them to the database in batches
+// instead of issuing one call per write. The writes of a batch are
+// not atomic and are executed in the order added. Each write's
+// outcome is reported to its caller on its own: if a write of a batch
+// fails, those before it have been executed and those after it are
+// sent again in the next batch.
+//
+// Unlike KV, a Batcher is thread safe, so that many goroutines may
+// share it. It must not be used with a transactional KV.
+type Batcher struct {
+	kv   *KV
+	opts BatcherOptions
+
+	flushMu sync.Mutex // Serializes flushes, as KV is not thread safe; held before mu
+
+	mu      sync.Mutex // Protects the fields below
+	pending []*batchedCall
+	bytes   int
+	timer   *time.Timer // Flushes after MaxDelay; nil if nothing is pending
+	closed  bool
+}
+
+// A batchedCall is a call pending in a Batcher along with the channel
+// on which its outcome is reported.
+type batchedCall struct {
+	Call
+	done chan error
+}
+
+// NewBatcher returns a Batcher sending writes through kv with the
+// flush policy of opts.
+func (kv *KV) NewBatcher(opts BatcherOptions) *Batcher {
+	if opts.MaxCalls <= 0 {
+		opts.MaxCalls = DefaultBatchMaxCalls
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultBatchMaxBytes
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = DefaultBatchMaxDelay
+	}
+	return &Batcher{kv: kv, opts: opts}
+}
+
+// Add queues a write, specified like a call to KV.Call, and returns a
+// channel on which its error, or nil, is sent once it's been executed.
+// reply is valid once the outcome has been received. Only methods
+// writing keys, such as Put, may be added. If adding the write reaches
+// the batch size limits, the pending writes are flushed before Add
+// returns, so that callers adding faster than the database accepts
+// writes are slowed down.
+func (b *Batcher) Add(method string, args proto.Request, reply proto.Response) <-chan error {
+	call := &batchedCall{
+		Call: Call{Method: method, Args: args, Reply: reply},
+		done: make(chan error, 1),
+	}
+	if !proto.IsTransactional(method) {
+		call.done <- util.Errorf("method %s can't be batched; only independent writes can", method)
+		return call.done
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		call.done <- util.Errorf("batcher is closed")
+		return call.done
+	}
+	b.pending = append(b.pending, call)
+	b.bytes += gogoproto.Size(args)
+	if len(b.pending) < b.opts.MaxCalls && b.bytes < b.opts.MaxBytes {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.opts.MaxDelay, func() { b.Flush() })
+		}
+		b.mu.Unlock()
+		return call.done
+	}
+	b.mu.Unlock()
+	b.Flush()
+	return call.done
+}
+
+// Flush sends all pending writes and returns once their outcomes have
+// been reported.
+func (b *Batcher) Flush() {
+	// Pending calls are taken while flushes are serialized, so that
+	// batches are sent in the order their calls were added.
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	calls := b.takePending()
+	b.mu.Unlock()
+	b.send(calls)
+}
+
+// Close flushes the pending writes. Writes added afterwards fail.
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.Flush()
+}
+
+// takePending removes and returns the pending calls, stopping the
+// flush timer. b.mu must be held.
+func (b *Batcher) takePending() []*batchedCall {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	calls := b.pending
+	b.pending, b.bytes = nil, 0
+	return calls
+}
+
+// send sends calls in a batch and reports their outcomes. The calls
+// of a batch are executed in order up to the first which fails; the
+// remaining calls are sent again. If the batch fails as a whole, all
+// of its calls fail with its error. b.flushMu must be held.
+func (b *Batcher) send(calls []*batchedCall) {
+	for len(calls) > 0 {
+		for _, call := range calls {
+			call.Reply.Reset()
+			b.kv.Prepare(call.Method, call.Args, call.Reply)
+		}
+		err := b.kv.Flush()
+		if err == nil {
+			for _, call := range calls {
+				call.done <- nil
+			}
+			return
+		}
+		failed := -1
+		for i, call := range calls {
+			if call.Reply.Header().GoError() != nil {
+				failed = i
+				break
+			}
+		}
+		if failed < 0 {
+			for _, call := range calls {
+				call.done <- err
+			}
+			return
+		}
+		for _, call := range calls[:failed] {
+			call.done <- nil
+		}
+		calls[failed].done <- calls[failed].Reply.Header().GoError()
+		calls = calls[failed+1:]
+	}
+}
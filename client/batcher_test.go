@@ -0,0 +1,156 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// batchTestSender executes Puts, failing those to the key "fail",
+// and batches of Puts, which stop at the first failure like batches
+// executed by the server. It records the number of calls per send.
+type batchTestSender struct {
+	mu    sync.Mutex
+	sends []int
+}
+
+func (bs *batchTestSender) put(args proto.Request, reply proto.Response) {
+	reply.Reset()
+	if args.Header().Key.Equal(proto.Key("fail")) {
+		reply.Header().SetGoError(util.Errorf("put failed"))
+	}
+}
+
+func (bs *batchTestSender) Send(call *Call) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if call.Method != proto.Batch {
+		bs.sends = append(bs.sends, 1)
+		bs.put(call.Args, call.Reply)
+		return
+	}
+	bArgs, bReply := call.Args.(*proto.BatchRequest), call.Reply.(*proto.BatchResponse)
+	bs.sends = append(bs.sends, len(bArgs.Requests))
+	for _, req := range bArgs.Requests {
+		reply := &proto.PutResponse{}
+		bs.put(req.GetValue().(proto.Request), reply)
+		bReply.Add(reply)
+		if reply.Error != nil {
+			bReply.Error = reply.Error
+			return
+		}
+	}
+}
+
+func (bs *batchTestSender) Close() {}
+
+func (bs *batchTestSender) sendCounts() []int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return append([]int(nil), bs.sends...)
+}
+
+func batchTestPut(key string) proto.Request {
+	return &proto.PutRequest{
+		RequestHeader: proto.RequestHeader{Key: proto.Key(key)},
+		Value:         proto.Value{Bytes: []byte("value")},
+	}
+}
+
+// waitBatched waits for the outcome of a batched call.
+func waitBatched(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for batched call")
+	}
+	return nil
+}
+
+// TestBatcherFlushPolicies verifies that a Batcher flushes once the
+// call count or size limits are reached or the oldest call has waited
+// for the maximum delay.
+func TestBatcherFlushPolicies(t *testing.T) {
+	sender := &batchTestSender{}
+	b := NewKV(sender, nil).NewBatcher(BatcherOptions{MaxCalls: 3, MaxDelay: time.Hour})
+	var dones []<-chan error
+	for _, key := range []string{"a", "b", "c"} {
+		dones = append(dones, b.Add(proto.Put, batchTestPut(key), &proto.PutResponse{}))
+	}
+	for _, done := range dones {
+		if err := waitBatched(t, done); err != nil {
+			t.Error(err)
+		}
+	}
+	if counts := sender.sendCounts(); len(counts) != 1 || counts[0] != 3 {
+		t.Errorf("expected a single batch of 3 calls; got %v", counts)
+	}
+
+	sender = &batchTestSender{}
+	b = NewKV(sender, nil).NewBatcher(BatcherOptions{MaxBytes: 1, MaxDelay: time.Hour})
+	if err := waitBatched(t, b.Add(proto.Put, batchTestPut("a"), &proto.PutResponse{})); err != nil {
+		t.Error(err)
+	}
+
+	sender = &batchTestSender{}
+	b = NewKV(sender, nil).NewBatcher(BatcherOptions{MaxDelay: time.Millisecond})
+	first := b.Add(proto.Put, batchTestPut("a"), &proto.PutResponse{})
+	second := b.Add(proto.Put, batchTestPut("b"), &proto.PutResponse{})
+	if err := waitBatched(t, first); err != nil {
+		t.Error(err)
+	}
+	if err := waitBatched(t, second); err != nil {
+		t.Error(err)
+	}
+	if counts := sender.sendCounts(); len(counts) != 1 || counts[0] != 2 {
+		t.Errorf("expected a single batch of 2 calls after the delay; got %v", counts)
+	}
+}
+
+// TestBatcherCallErrors verifies that each batched call's outcome is
+// reported on its own, that calls after a failed call of a batch are
+// sent again, and that only writes may be batched.
+func TestBatcherCallErrors(t *testing.T) {
+	sender := &batchTestSender{}
+	b := NewKV(sender, nil).NewBatcher(BatcherOptions{MaxDelay: time.Hour})
+	var dones []<-chan error
+	for _, key := range []string{"a", "fail", "b", "c"} {
+		dones = append(dones, b.Add(proto.Put, batchTestPut(key), &proto.PutResponse{}))
+	}
+	b.Flush()
+	for i, done := range dones {
+		if err := waitBatched(t, done); (err != nil) != (i == 1) {
+			t.Errorf("%d: unexpected outcome %v", i, err)
+		}
+	}
+	if counts := sender.sendCounts(); len(counts) != 2 || counts[0] != 4 || counts[1] != 2 {
+		t.Errorf("expected a batch of 4 calls and one of the 2 after the failure; got %v", counts)
+	}
+
+	if err := waitBatched(t, b.Add(proto.Get, &proto.GetRequest{}, &proto.GetResponse{})); err == nil {
+		t.Error("expected error batching a read")
+	}
+	b.Close()
+	if err := waitBatched(t, b.Add(proto.Put, batchTestPut("a"), &proto.PutResponse{})); err == nil {
+		t.Error("expected error adding to a closed batcher")
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/encoding"
+	"github.com/cockroachdb/cockroach/util/log"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// DefaultValueChunkSize is the size in bytes of the chunks in which
+// PutChunked writes values if no chunk size is specified.
+const DefaultValueChunkSize = 1 << 20
+
+// chunkKeyInfix separates the key of a chunked value from the ID and
+// index which identify each of its chunks.
+var chunkKeyInfix = []byte("\x00chunk-")
+
+// chunkChecksumTable is the CRC32 table used to checksum chunked
+// values.
+var chunkChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkPrefix returns the prefix of the keys of the chunks of the
+// value written to key with the specified ID.
+func chunkPrefix(key proto.Key, id []byte) proto.Key {
+	prefix := make(proto.Key, 0, len(key)+len(chunkKeyInfix)+len(id))
+	return append(append(append(prefix, key...), chunkKeyInfix...), id...)
+}
+
+// chunkKey returns the key of the i'th chunk of the value written to
+// key with the specified ID.
+func chunkKey(key proto.Key, id []byte, i int32) proto.Key {
+	return encoding.EncodeUint32(chunkPrefix(key, id), uint32(i))
+}
+
+// PutChunked writes the value read from r to key in chunks of
+// chunkSize bytes, so that values of any size may be stored without a
+// single command carrying more than a chunk. If chunkSize is not
+// positive, DefaultValueChunkSize is used.
+//
+// The chunks are written first, at keys unique to this write. The
+// value then becomes visible atomically when the proto.ChunkedValue
+// describing the chunks is written to key, after which the chunks of
+// the chunked value it replaces, if any, are deleted. If the value at
+// key is changed concurrently, the chunks written are deleted and a
+// proto.ConditionFailedError is returned. Use NewChunkedReader to
+// read the value. The chunks are stored at keys formed by appending a
+// zero byte and their ID to key, so scans spanning key return them.
+func (kv *KV) PutChunked(key proto.Key, r io.Reader, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultValueChunkSize
+	}
+	prev, err := kv.getInternal(key)
+	if err != nil {
+		return err
+	}
+
+	cv := &proto.ChunkedValue{ID: []byte(uuid.NewRandom())}
+	crc := crc32.New(chunkChecksumTable)
+	for done := false; !done; {
+		chunk := make([]byte, chunkSize)
+		n, err := io.ReadFull(r, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			done = true
+		} else if err != nil {
+			kv.deleteChunks(key, cv.ID)
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		crc.Write(chunk[:n])
+		if err := kv.putInternal(chunkKey(key, cv.ID, cv.Chunks), proto.Value{Bytes: chunk[:n]}); err != nil {
+			kv.deleteChunks(key, cv.ID)
+			return err
+		}
+		cv.Chunks++
+		cv.Size += int64(n)
+	}
+	cv.Checksum = crc.Sum32()
+
+	// Write the chunked value, provided the value it replaces is
+	// unchanged.
+	data, err := gogoproto.Marshal(cv)
+	if err != nil {
+		kv.deleteChunks(key, cv.ID)
+		return err
+	}
+	args := &proto.ConditionalPutRequest{
+		RequestHeader: proto.RequestHeader{Key: key},
+		Value:         proto.Value{Bytes: data},
+	}
+	args.Value.InitChecksum(key)
+	if prev != nil {
+		args.ExpValue = &proto.Value{Bytes: prev.Bytes}
+	}
+	if err := kv.Call(proto.ConditionalPut, args, &proto.ConditionalPutResponse{}); err != nil {
+		kv.deleteChunks(key, cv.ID)
+		return err
+	}
+
+	// Delete the chunks of the replaced value. Readers of the replaced
+	// value read at an earlier timestamp and so still find them.
+	if prev != nil {
+		old := &proto.ChunkedValue{}
+		if err := gogoproto.Unmarshal(prev.Bytes, old); err == nil && len(old.ID) > 0 {
+			if err := kv.deleteChunks(key, old.ID); err != nil {
+				log.Warningf("unable to delete chunks of value replaced at key %q: %s", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteChunks deletes the chunks of the value written to key with
+// the specified ID.
+func (kv *KV) deleteChunks(key proto.Key, id []byte) error {
+	prefix := chunkPrefix(key, id)
+	return kv.Call(proto.DeleteRange, &proto.DeleteRangeRequest{
+		RequestHeader: proto.RequestHeader{Key: prefix, EndKey: prefix.PrefixEnd()},
+	}, &proto.DeleteRangeResponse{})
+}
+
+// A ChunkedReader streams a value written with PutChunked, reading
+// each chunk only once the preceding chunk has been consumed. The
+// checksum of the value is verified once it has been read in full.
+//
+// Outside of a transaction, all chunks are read at the timestamp at
+// which the value was first read, so that the value is read
+// consistently even if it's concurrently replaced. Like KV, a
+// ChunkedReader is not thread safe.
+type ChunkedReader struct {
+	kv        *KV
+	key       proto.Key
+	value     proto.ChunkedValue
+	timestamp proto.Timestamp
+	next      int32  // Index of the next chunk to read
+	buf       []byte // Unread bytes of the current chunk
+	crc       hash.Hash32
+}
+
+// NewChunkedReader returns a ChunkedReader streaming the value written
+// to key with PutChunked. Returns false if there is no value at key.
+func (kv *KV) NewChunkedReader(key proto.Key) (*ChunkedReader, bool, error) {
+	reply := &proto.GetResponse{}
+	if err := kv.Call(proto.Get, &proto.GetRequest{
+		RequestHeader: proto.RequestHeader{Key: key},
+	}, reply); err != nil {
+		return nil, false, err
+	}
+	if reply.Value == nil {
+		return nil, false, nil
+	}
+	if err := reply.Value.Verify(key); err != nil {
+		return nil, false, err
+	}
+	cr := &ChunkedReader{
+		kv:  kv,
+		key: key,
+		crc: crc32.New(chunkChecksumTable),
+	}
+	if err := gogoproto.Unmarshal(reply.Value.Bytes, &cr.value); err != nil || len(cr.value.ID) == 0 {
+		return nil, false, util.Errorf("value at key %q is not a chunked value", key)
+	}
+	// Pin non-transactional reads to the timestamp of the first read.
+	if _, ok := kv.sender.(*txnSender); !ok {
+		cr.timestamp = reply.Timestamp
+	}
+	return cr, true, nil
+}
+
+// Size returns the size of the value in bytes.
+func (cr *ChunkedReader) Size() int64 {
+	return cr.value.Size
+}
+
+// Read implements io.Reader.
+func (cr *ChunkedReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.next == cr.value.Chunks {
+			if cr.crc.Sum32() != cr.value.Checksum {
+				return 0, util.Errorf("checksum mismatch reading chunked value at key %q", cr.key)
+			}
+			return 0, io.EOF
+		}
+		if err := cr.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// fetch reads the next chunk of the value.
+func (cr *ChunkedReader) fetch() error {
+	key := chunkKey(cr.key, cr.value.ID, cr.next)
+	reply := &proto.GetResponse{}
+	if err := cr.kv.Call(proto.Get, &proto.GetRequest{
+		RequestHeader: proto.RequestHeader{Key: key, Timestamp: cr.timestamp},
+	}, reply); err != nil {
+		return err
+	}
+	if reply.Value == nil {
+		return util.Errorf("chunk %d of value at key %q is missing", cr.next, cr.key)
+	}
+	if err := reply.Value.Verify(key); err != nil {
+		return err
+	}
+	cr.buf = reply.Value.Bytes
+	cr.crc.Write(cr.buf)
+	cr.next++
+	return nil
+}
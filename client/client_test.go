@@ -24,6 +24,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"reflect"
 	"sync"
@@ -295,6 +297,65 @@ func TestKVClientGetAndPutProto(t *testing.T) {
 	}
 }
 
+// TestKVClientChunkedValues verifies that values written in chunks
+// are read back in full, that replacing a value deletes the chunks
+// of the value replaced and that a value being read while replaced
+// is still read in full.
+func TestKVClientChunkedValues(t *testing.T) {
+	s := server.StartTestServer(t)
+	defer s.Stop()
+	kvClient := createTestClient(s.HTTPAddr)
+	kvClient.User = storage.UserRoot
+
+	key := proto.Key("chunked")
+	value := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := kvClient.PutChunked(key, bytes.NewReader(value), 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	cr, ok, err := kvClient.NewChunkedReader(key)
+	if !ok || err != nil {
+		t.Fatalf("unable to read chunked value ok? %t: %s", ok, err)
+	}
+	if cr.Size() != int64(len(value)) {
+		t.Errorf("expected size %d; got %d", len(value), cr.Size())
+	}
+
+	// Replace the value while it's being read.
+	buf := make([]byte, 100)
+	if _, err := io.ReadFull(cr, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvClient.PutChunked(key, bytes.NewReader([]byte("replaced")), 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read := append(buf, rest...); !bytes.Equal(read, value) {
+		t.Errorf("expected value of %d bytes; got %d bytes", len(value), len(read))
+	}
+
+	cr, ok, err = kvClient.NewChunkedReader(key)
+	if !ok || err != nil {
+		t.Fatalf("unable to read chunked value ok? %t: %s", ok, err)
+	}
+	if read, err := ioutil.ReadAll(cr); err != nil || string(read) != "replaced" {
+		t.Errorf("expected replaced value; got %q: %v", read, err)
+	}
+
+	// Only the chunk of the replacing value remains.
+	reply := &proto.ScanResponse{}
+	if err := kvClient.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{Key: key.Next(), EndKey: key.PrefixEnd()},
+	}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Rows) != 1 {
+		t.Errorf("expected a single chunk to remain; got %d", len(reply.Rows))
+	}
+}
+
 // TestKVClientGetAndPutGob verifies gets and puts of Go objects using the
 // KV client's convenience methods.
 func TestKVClientGetAndPutGob(t *testing.T) {
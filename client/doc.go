@@ -115,5 +115,48 @@ Transactions should endeavor to write using KV.Prepare calls. This
 allows writes to the same range to be batched together. In cases where
 the entire transaction affects only a single range, transactions can
 commit in a single round trip.
+
+Wire Contract
+
+Non-Go clients talk to the same endpoint as HTTPSender. Every API call
+is an HTTP POST to
+
+  http://<host:port>/kv/db/<Method>
+
+where <Method> is one of the public method names in proto/api.go
+(e.g. "Get", "Put", "Scan", "EndTransaction"). The request body is
+the serialized request message (e.g. GetRequest) and the response body
+is the serialized response message (e.g. GetResponse). The messages
+are defined in proto/api.proto, proto/data.proto and
+proto/errors.proto; these files are the stable wire contract. Fields
+are only ever added, never renumbered or removed.
+
+The body encoding is selected by the Content-Type header and the
+response encoding by the Accept header:
+
+  application/x-protobuf  serialized protocol buffers (preferred)
+  application/json        JSON using the snake_case proto field names
+
+A 200 response always carries a response message. Errors from the
+database are returned inside ResponseHeader.error, which holds exactly
+one of the typed errors in proto/errors.proto. Non-200 responses are
+transport errors: 429, 503 and 504 should be retried with backoff
+using the same ClientCmdID so that mutations are applied at most once.
+
+Transactions are driven entirely by the client. The first request sets
+RequestHeader.txn with only name and isolation filled in; every
+subsequent request sends back the Transaction from the most recent
+ResponseHeader.txn. The transaction is finished with EndTransaction.
+Clients must restart the transaction body on:
+
+  read_within_uncertainty_interval  restart immediately
+  transaction_retry                 restart immediately
+  transaction_aborted               back off, then restart with a new txn
+  transaction_push                  back off, then restart
+
+Reference clients implementing this contract, including the retry
+loop above, live in client/python and client/java. Language bindings
+for the messages are generated from the .proto files with
+"make -C proto python java".
 */
 package client
@@ -0,0 +1,402 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// An Operation is a single key-value operation as observed by a
+// client. Supported methods are Get, Put, ConditionalPut, Increment
+// and Delete.
+type Operation struct {
+	Method    string
+	Key       proto.Key
+	Value     *proto.Value // Written value; or value read by Get (nil if none)
+	ExpValue  *proto.Value // Expected value for ConditionalPut
+	Increment int64        // Increment amount
+	NewValue  int64        // Result of Increment
+	Failed    bool         // ConditionalPut condition or Increment type failure
+}
+
+// String formats the operation for debugging.
+func (op Operation) String() string {
+	switch op.Method {
+	case proto.Get:
+		return fmt.Sprintf("Get(%q)=%s", op.Key, valueString(op.Value))
+	case proto.Put:
+		return fmt.Sprintf("Put(%q, %s)", op.Key, valueString(op.Value))
+	case proto.ConditionalPut:
+		return fmt.Sprintf("CPut(%q, %s, %s) failed=%t", op.Key, valueString(op.Value),
+			valueString(op.ExpValue), op.Failed)
+	case proto.Increment:
+		return fmt.Sprintf("Inc(%q, %d)=%d failed=%t", op.Key, op.Increment, op.NewValue, op.Failed)
+	}
+	return fmt.Sprintf("%s(%q)", op.Method, op.Key)
+}
+
+func valueString(v *proto.Value) string {
+	switch {
+	case v == nil:
+		return "nil"
+	}
+	if i, err := v.GetInt(); err == nil {
+		return fmt.Sprintf("%d", i)
+	}
+	return fmt.Sprintf("%q", v.Bytes)
+}
+
+// A HistoryEntry is a group of operations which took effect
+// atomically (a single call or a committed transaction) between the
+// Invoke and Return logical times. Indeterminate entries are those
+// for which the client did not learn the outcome (e.g. the response
+// was lost); they may or may not have taken effect and have no
+// meaningful return time.
+type HistoryEntry struct {
+	ClientID      int
+	Ops           []Operation
+	Invoke        int64
+	Return        int64
+	Indeterminate bool
+}
+
+// A History records the invocation and completion of operations
+// issued by concurrent clients, for offline verification of
+// linearizability and serializability. It is safe for concurrent use.
+type History struct {
+	mu      sync.Mutex
+	tick    int64
+	entries []*HistoryEntry
+}
+
+// Invoke returns the logical time at which an operation is invoked.
+func (h *History) Invoke() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tick++
+	return h.tick
+}
+
+// Complete records an entry invoked at the specified logical time
+// which has just completed. Entries with an empty ops slice are
+// ignored.
+func (h *History) Complete(clientID int, invoke int64, ops []Operation, indeterminate bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tick++
+	if len(ops) == 0 {
+		return
+	}
+	e := &HistoryEntry{
+		ClientID:      clientID,
+		Ops:           ops,
+		Invoke:        invoke,
+		Return:        h.tick,
+		Indeterminate: indeterminate,
+	}
+	if indeterminate {
+		e.Return = math.MaxInt64
+	}
+	h.entries = append(h.entries, e)
+}
+
+// Entries returns the recorded entries.
+func (h *History) Entries() []*HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*HistoryEntry(nil), h.entries...)
+}
+
+// A HistorySender wraps a KVSender and records each non-transactional
+// Get, Put, ConditionalPut, Increment and Delete call to a
+// History. Other calls, including batches, are passed through
+// unrecorded.
+type HistorySender struct {
+	wrapped  KVSender
+	history  *History
+	clientID int
+}
+
+// NewHistorySender returns a sender which records calls by the
+// specified client to history before passing them to wrapped.
+func NewHistorySender(wrapped KVSender, history *History, clientID int) *HistorySender {
+	return &HistorySender{wrapped: wrapped, history: history, clientID: clientID}
+}
+
+// Send implements the KVSender interface.
+func (hs *HistorySender) Send(call *Call) {
+	switch call.Method {
+	case proto.Get, proto.Put, proto.ConditionalPut, proto.Increment, proto.Delete:
+	default:
+		hs.wrapped.Send(call)
+		return
+	}
+	if call.Args.Header().Txn != nil {
+		hs.wrapped.Send(call)
+		return
+	}
+	invoke := hs.history.Invoke()
+	hs.wrapped.Send(call)
+	op, ok, indeterminate := OperationFromCall(call)
+	if !ok {
+		// The call failed without effect.
+		hs.history.Complete(hs.clientID, invoke, nil, false)
+		return
+	}
+	hs.history.Complete(hs.clientID, invoke, []Operation{op}, indeterminate)
+}
+
+// Close implements the KVSender interface.
+func (hs *HistorySender) Close() {
+	hs.wrapped.Close()
+}
+
+// OperationFromCall converts a completed call into an Operation. ok
+// is false if the call failed in a way which cannot have affected
+// the database (i.e. a failed read). indeterminate is true for writes
+// which returned an error other than a failed condition, as they may
+// or may not have been applied.
+func OperationFromCall(call *Call) (op Operation, ok, indeterminate bool) {
+	op = Operation{Method: call.Method, Key: call.Args.Header().Key}
+	err := call.Reply.Header().GoError()
+	_, condFailed := err.(*proto.ConditionFailedError)
+	switch args := call.Args.(type) {
+	case *proto.GetRequest:
+		if err != nil {
+			return op, false, false
+		}
+		op.Value = call.Reply.(*proto.GetResponse).Value
+	case *proto.PutRequest:
+		op.Value = &args.Value
+	case *proto.ConditionalPutRequest:
+		op.Value, op.ExpValue, op.Failed = &args.Value, args.ExpValue, condFailed
+		if condFailed {
+			return op, true, false
+		}
+	case *proto.IncrementRequest:
+		op.Increment = args.Increment
+		if err == nil {
+			op.NewValue = call.Reply.(*proto.IncrementResponse).NewValue
+		}
+	case *proto.DeleteRequest:
+	default:
+		return op, false, false
+	}
+	return op, true, err != nil
+}
+
+// registerState maps keys to values for the sequential model of the
+// key-value store.
+type registerState map[string]*proto.Value
+
+func valuesEqual(a, b *proto.Value) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ai, aErr := a.GetInt()
+	bi, bErr := b.GetInt()
+	if (aErr == nil) != (bErr == nil) {
+		return false
+	}
+	if aErr == nil {
+		return ai == bi
+	}
+	return bytes.Equal(a.Bytes, b.Bytes)
+}
+
+// apply applies ops in order to a copy of the state, returning the
+// new state and whether the ops' observed results are consistent with
+// the state. Results of indeterminate entries are not checked.
+func (s registerState) apply(ops []Operation, checkResults bool) (registerState, bool) {
+	ns := registerState{}
+	for k, v := range s {
+		ns[k] = v
+	}
+	for _, op := range ops {
+		key := string(op.Key)
+		cur := ns[key]
+		switch op.Method {
+		case proto.Get:
+			if checkResults && !valuesEqual(cur, op.Value) {
+				return nil, false
+			}
+		case proto.Put:
+			ns[key] = op.Value
+		case proto.Delete:
+			delete(ns, key)
+		case proto.ConditionalPut:
+			match := valuesEqual(cur, op.ExpValue)
+			if checkResults && match == op.Failed {
+				return nil, false
+			}
+			if match {
+				ns[key] = op.Value
+			}
+		case proto.Increment:
+			var curValue int64
+			if cur != nil {
+				var err error
+				if curValue, err = cur.GetInt(); err != nil {
+					if checkResults && !op.Failed {
+						return nil, false
+					}
+					continue
+				}
+			}
+			newValue := curValue + op.Increment
+			if checkResults && (op.Failed || newValue != op.NewValue) {
+				return nil, false
+			}
+			ns[key] = &proto.Value{}
+			ns[key].SetInt(newValue)
+		}
+	}
+	return ns, true
+}
+
+// String returns a canonical encoding of the state for memoization.
+func (s registerState) String() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%q=%s;", k, valueString(s[k]))
+	}
+	return buf.String()
+}
+
+// historyChecker searches for a sequential ordering of history
+// entries consistent with the results each client observed.
+type historyChecker struct {
+	entries  []*HistoryEntry
+	realTime bool
+	visited  map[string]struct{}
+}
+
+// check performs a depth-first search over orderings of entries,
+// memoizing (applied entries, state) pairs which have already been
+// explored. If realTime is true, an entry may only be ordered before
+// another if it was invoked before that entry returned.
+func (hc *historyChecker) check(done []bool, remaining int, state registerState) bool {
+	if remaining == 0 {
+		return true
+	}
+	memoKey := fmt.Sprintf("%v|%s", done, state)
+	if _, ok := hc.visited[memoKey]; ok {
+		return false
+	}
+	hc.visited[memoKey] = struct{}{}
+
+	minReturn := int64(math.MaxInt64)
+	if hc.realTime {
+		for i, e := range hc.entries {
+			if !done[i] && e.Return < minReturn {
+				minReturn = e.Return
+			}
+		}
+	}
+	for i, e := range hc.entries {
+		if done[i] || (hc.realTime && e.Invoke > minReturn) {
+			continue
+		}
+		newState, ok := state.apply(e.Ops, !e.Indeterminate)
+		if !ok {
+			continue
+		}
+		done[i] = true
+		left := remaining
+		if !e.Indeterminate {
+			left--
+		}
+		if hc.check(done, left, newState) {
+			return true
+		}
+		done[i] = false
+	}
+	return false
+}
+
+// checkHistory verifies that entries can be ordered sequentially such
+// that every determinate entry observes results consistent with the
+// preceding entries. Indeterminate entries may be included anywhere
+// in the order or omitted.
+func checkHistory(entries []*HistoryEntry, realTime bool) error {
+	remaining := 0
+	for _, e := range entries {
+		if !e.Indeterminate {
+			remaining++
+		}
+	}
+	hc := &historyChecker{
+		entries:  entries,
+		realTime: realTime,
+		visited:  map[string]struct{}{},
+	}
+	if !hc.check(make([]bool, len(entries)), remaining, registerState{}) {
+		return util.Errorf("no valid ordering of history:\n%s", historyString(entries))
+	}
+	return nil
+}
+
+func historyString(entries []*HistoryEntry) string {
+	var lines []string
+	for _, e := range entries {
+		ret := "?"
+		if !e.Indeterminate {
+			ret = fmt.Sprintf("%d", e.Return)
+		}
+		lines = append(lines, fmt.Sprintf("  client %d [%d, %s]: %v", e.ClientID, e.Invoke, ret, e.Ops))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CheckLinearizable verifies that a history of single-operation
+// entries is linearizable. As linearizability is a local property,
+// entries are checked independently for each key.
+func CheckLinearizable(entries []*HistoryEntry) error {
+	byKey := map[string][]*HistoryEntry{}
+	for _, e := range entries {
+		if len(e.Ops) != 1 {
+			return util.Errorf("linearizability checks require single-operation entries: %v", e.Ops)
+		}
+		key := string(e.Ops[0].Key)
+		byKey[key] = append(byKey[key], e)
+	}
+	for key, keyEntries := range byKey {
+		if err := checkHistory(keyEntries, true); err != nil {
+			return util.Errorf("key %q is not linearizable: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// CheckSerializable verifies that a history of transactions is
+// serializable; if strict is true, the serial order must also respect
+// the real-time order of non-overlapping transactions.
+func CheckSerializable(entries []*HistoryEntry, strict bool) error {
+	return checkHistory(entries, strict)
+}
@@ -0,0 +1,147 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+func bytesValue(s string) *proto.Value {
+	return &proto.Value{Bytes: []byte(s)}
+}
+
+func getOp(key, value string) Operation {
+	op := Operation{Method: proto.Get, Key: proto.Key(key)}
+	if value != "" {
+		op.Value = bytesValue(value)
+	}
+	return op
+}
+
+func putOp(key, value string) Operation {
+	return Operation{Method: proto.Put, Key: proto.Key(key), Value: bytesValue(value)}
+}
+
+func entry(invoke, ret int64, ops ...Operation) *HistoryEntry {
+	e := &HistoryEntry{Ops: ops, Invoke: invoke, Return: ret}
+	if ret == 0 {
+		e.Indeterminate = true
+		e.Return = math.MaxInt64
+	}
+	return e
+}
+
+// TestCheckLinearizable verifies linearizable and non-linearizable
+// register histories, including indeterminate writes.
+func TestCheckLinearizable(t *testing.T) {
+	testCases := []struct {
+		entries []*HistoryEntry
+		expOK   bool
+	}{
+		// Sequential put then get.
+		{[]*HistoryEntry{entry(1, 2, putOp("a", "1")), entry(3, 4, getOp("a", "1"))}, true},
+		// Stale read after put completed.
+		{[]*HistoryEntry{entry(1, 2, putOp("a", "1")), entry(3, 4, getOp("a", ""))}, false},
+		// Concurrent put and get may see either value.
+		{[]*HistoryEntry{entry(1, 4, putOp("a", "1")), entry(2, 3, getOp("a", ""))}, true},
+		{[]*HistoryEntry{entry(1, 4, putOp("a", "1")), entry(2, 3, getOp("a", "1"))}, true},
+		// Reads going back in time are not linearizable.
+		{[]*HistoryEntry{
+			entry(1, 10, putOp("a", "1")),
+			entry(2, 3, getOp("a", "1")),
+			entry(4, 5, getOp("a", "")),
+		}, false},
+		// Indeterminate put may be observed or not.
+		{[]*HistoryEntry{entry(1, 0, putOp("a", "1")), entry(3, 4, getOp("a", "1"))}, true},
+		{[]*HistoryEntry{entry(1, 0, putOp("a", "1")), entry(3, 4, getOp("a", ""))}, true},
+		// Value never written.
+		{[]*HistoryEntry{entry(1, 2, putOp("a", "1")), entry(3, 4, getOp("a", "2"))}, false},
+		// Keys are independent.
+		{[]*HistoryEntry{entry(1, 2, putOp("a", "1")), entry(3, 4, getOp("b", ""))}, true},
+		// Conditional put failure must be consistent.
+		{[]*HistoryEntry{
+			entry(1, 2, putOp("a", "1")),
+			entry(3, 4, Operation{Method: proto.ConditionalPut, Key: proto.Key("a"),
+				Value: bytesValue("2"), ExpValue: bytesValue("1"), Failed: true}),
+		}, false},
+	}
+	for i, test := range testCases {
+		err := CheckLinearizable(test.entries)
+		if (err == nil) != test.expOK {
+			t.Errorf("%d: expected ok=%t; got %v", i, test.expOK, err)
+		}
+	}
+}
+
+// TestCheckSerializable verifies the detection of a write skew
+// anomaly and the difference between strict and plain serializability.
+func TestCheckSerializable(t *testing.T) {
+	// Both transactions read the initial (empty) values of a and b and
+	// write the other key: write skew is not serializable.
+	skew := []*HistoryEntry{
+		entry(1, 4, getOp("a", ""), getOp("b", ""), putOp("a", "1")),
+		entry(2, 3, getOp("a", ""), getOp("b", ""), putOp("b", "1")),
+	}
+	if err := CheckSerializable(skew, false); err == nil {
+		t.Error("expected write skew to be detected")
+	}
+
+	// A transaction which does not observe an earlier, completed
+	// transaction's write is serializable, but not strictly so.
+	stale := []*HistoryEntry{
+		entry(1, 2, putOp("a", "1")),
+		entry(3, 4, getOp("a", "")),
+	}
+	if err := CheckSerializable(stale, false); err != nil {
+		t.Errorf("expected serializable history: %s", err)
+	}
+	if err := CheckSerializable(stale, true); err == nil {
+		t.Error("expected history not to be strictly serializable")
+	}
+}
+
+// TestHistorySender verifies that calls are recorded with results.
+func TestHistorySender(t *testing.T) {
+	h := &History{}
+	values := map[string][]byte{}
+	sender := newTestSender(func(call *Call) {
+		switch args := call.Args.(type) {
+		case *proto.PutRequest:
+			values[string(args.Key)] = args.Value.Bytes
+		case *proto.GetRequest:
+			if v, ok := values[string(args.Key)]; ok {
+				call.Reply.(*proto.GetResponse).Value = &proto.Value{Bytes: v}
+			}
+		}
+	})
+	kv := NewKV(NewHistorySender(sender, h, 1), nil)
+	if err := kv.Call(proto.Put, proto.PutArgs(proto.Key("a"), []byte("1")), &proto.PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Call(proto.Get, proto.GetArgs(proto.Key("a")), &proto.GetResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	entries := h.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries; got %d", len(entries))
+	}
+	if err := CheckLinearizable(entries); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package org.cockroachdb.client;
+
+import com.google.protobuf.Message;
+
+import java.io.IOException;
+import java.io.InputStream;
+import java.io.OutputStream;
+import java.net.HttpURLConnection;
+import java.net.URL;
+
+/**
+ * HTTPSender posts protobuf-encoded calls to the /kv/db/ endpoint of a
+ * Cockroach node. Transport failures and 429/503/504 responses are
+ * retried with exponential backoff, resending the identical request
+ * (and therefore the same client command ID) so mutations are applied
+ * at most once. It is the Java analog of client.HTTPSender.
+ */
+public class HTTPSender implements KV.Sender {
+  public static final String KV_DB_ENDPOINT = "/kv/db/";
+  private static final String PROTO_CONTENT_TYPE = "application/x-protobuf";
+
+  private final String server;
+  private final long maxBackoffMillis;
+
+  public HTTPSender(String server) {
+    this(server, 5000);
+  }
+
+  public HTTPSender(String server, long maxBackoffMillis) {
+    this.server = server;
+    this.maxBackoffMillis = maxBackoffMillis;
+  }
+
+  @Override
+  @SuppressWarnings("unchecked")
+  public <T extends Message> T send(String method, Message args, T replyPrototype)
+      throws IOException {
+    URL url = new URL("http://" + server + KV_DB_ENDPOINT + method);
+    byte[] body = args.toByteArray();
+    long backoffMillis = 50;
+    while (true) {
+      HttpURLConnection conn = null;
+      try {
+        conn = (HttpURLConnection) url.openConnection();
+        conn.setRequestMethod("POST");
+        conn.setDoOutput(true);
+        conn.setRequestProperty("Content-Type", PROTO_CONTENT_TYPE);
+        conn.setRequestProperty("Accept", PROTO_CONTENT_TYPE);
+        OutputStream out = conn.getOutputStream();
+        out.write(body);
+        out.close();
+        int code = conn.getResponseCode();
+        if (code == 200) {
+          InputStream in = conn.getInputStream();
+          try {
+            return (T) replyPrototype.newBuilderForType().mergeFrom(in).build();
+          } finally {
+            in.close();
+          }
+        }
+        if (code != 429 && code != 503 && code != 504) {
+          throw new IOException("HTTP " + code + ": " + conn.getResponseMessage());
+        }
+      } catch (java.net.ConnectException e) {
+        // Retry below.
+      } catch (java.net.SocketTimeoutException e) {
+        // Retry below.
+      } finally {
+        if (conn != null) {
+          conn.disconnect();
+        }
+      }
+      try {
+        Thread.sleep(backoffMillis);
+      } catch (InterruptedException e) {
+        throw new IOException("interrupted while retrying " + method, e);
+      }
+      backoffMillis = Math.min(backoffMillis * 2, maxBackoffMillis);
+    }
+  }
+}
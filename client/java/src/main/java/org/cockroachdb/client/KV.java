@@ -0,0 +1,260 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package org.cockroachdb.client;
+
+import com.google.protobuf.ByteString;
+import com.google.protobuf.Descriptors.FieldDescriptor;
+import com.google.protobuf.Message;
+
+import java.io.IOException;
+import java.util.Map;
+import java.util.Random;
+
+import proto.Api;
+import proto.Data;
+import proto.Errors;
+
+/**
+ * KV provides synchronous access to the Cockroach key-value API. It is
+ * the Java analog of the Go client.KV; see the "Wire Contract" section
+ * of client/doc.go for the protocol it implements.
+ *
+ * A KV instance is not thread safe.
+ */
+public class KV {
+  /** Sender delivers a single call to the database. */
+  public interface Sender {
+    <T extends Message> T send(String method, Message args, T replyPrototype) throws IOException;
+  }
+
+  /** Retryable is the body of a transaction; it may run more than once. */
+  public interface Retryable {
+    void run(KV txn) throws Exception;
+  }
+
+  /** DBException carries the typed error from ResponseHeader.error. */
+  public static class DBException extends Exception {
+    private final String name;
+    private final Message detail;
+
+    DBException(String name, Message detail) {
+      super(name + ": " + detail);
+      this.name = name;
+      this.detail = detail;
+    }
+
+    /** Returns the field name of the proto Error union which was set. */
+    public String getName() {
+      return name;
+    }
+
+    /** Returns the typed error message. */
+    public Message getDetail() {
+      return detail;
+    }
+  }
+
+  private static final Random random = new Random();
+
+  private final Sender sender;
+  private final String user;
+
+  public KV(Sender sender, String user) {
+    this.sender = sender;
+    this.user = user;
+  }
+
+  /**
+   * Call sends args to method and returns the reply, throwing a
+   * DBException if the reply header carries an error.
+   */
+  public <T extends Message> T call(String method, Api.RequestHeader.Builder header,
+      Message.Builder args, T replyPrototype) throws IOException, DBException {
+    if (!header.hasUser()) {
+      header.setUser(user);
+    }
+    if (isWrite(method)) {
+      header.setCmdId(Api.ClientCmdID.newBuilder()
+          .setWallTime(System.currentTimeMillis() * 1000000L)
+          .setRandom(random.nextLong() & Long.MAX_VALUE));
+    }
+    setField(args, "header", header.build());
+    T reply = sender.send(method, args.build(), replyPrototype);
+    DBException err = replyError(reply);
+    if (err != null) {
+      throw err;
+    }
+    return reply;
+  }
+
+  /** Get returns the value at key, or null if no value exists. */
+  public byte[] get(byte[] key) throws IOException, DBException {
+    Api.GetResponse reply = call("Get", header(key), Api.GetRequest.newBuilder(),
+        Api.GetResponse.getDefaultInstance());
+    return reply.hasValue() ? reply.getValue().getBytes().toByteArray() : null;
+  }
+
+  /** Put sets the value at key. */
+  public void put(byte[] key, byte[] value) throws IOException, DBException {
+    call("Put", header(key), Api.PutRequest.newBuilder()
+        .setValue(Data.Value.newBuilder().setBytes(ByteString.copyFrom(value))),
+        Api.PutResponse.getDefaultInstance());
+  }
+
+  /** Increment adds inc to the integer at key and returns the new value. */
+  public long increment(byte[] key, long inc) throws IOException, DBException {
+    return call("Increment", header(key), Api.IncrementRequest.newBuilder().setIncrement(inc),
+        Api.IncrementResponse.getDefaultInstance()).getNewValue();
+  }
+
+  /** Delete removes the value at key. */
+  public void delete(byte[] key) throws IOException, DBException {
+    call("Delete", header(key), Api.DeleteRequest.newBuilder(),
+        Api.DeleteResponse.getDefaultInstance());
+  }
+
+  /** Scan returns up to maxResults rows from [start, end). */
+  public java.util.List<Data.KeyValue> scan(byte[] start, byte[] end, long maxResults)
+      throws IOException, DBException {
+    Api.RequestHeader.Builder h = header(start).setEndKey(ByteString.copyFrom(end));
+    return call("Scan", h, Api.ScanRequest.newBuilder().setMaxResults(maxResults),
+        Api.ScanResponse.getDefaultInstance()).getRowsList();
+  }
+
+  /**
+   * RunTransaction executes retryable within a transaction, committing
+   * on success and aborting on any non-retryable error. Retryable
+   * errors restart the transaction, with backoff where the conflict
+   * requires it, mirroring KV.RunTransaction in Go.
+   */
+  public void runTransaction(String name, Data.IsolationType isolation, Retryable retryable)
+      throws Exception {
+    TxnSender txnSender = new TxnSender(sender, name, isolation);
+    KV txn = new KV(txnSender, user);
+    long backoffMillis = 50;
+    while (true) {
+      txnSender.ended = false;
+      try {
+        retryable.run(txn);
+        if (!txnSender.ended) {
+          txn.call("EndTransaction", Api.RequestHeader.newBuilder(),
+              Api.EndTransactionRequest.newBuilder().setCommit(true),
+              Api.EndTransactionResponse.getDefaultInstance());
+        }
+        return;
+      } catch (DBException e) {
+        String n = e.getName();
+        if (n.equals("read_within_uncertainty_interval") || n.equals("transaction_retry")) {
+          continue;
+        }
+        if (n.equals("transaction_aborted") || n.equals("transaction_push")) {
+          Thread.sleep(backoffMillis);
+          backoffMillis = Math.min(backoffMillis * 2, 5000);
+          continue;
+        }
+        txnSender.abort(txn);
+        throw e;
+      } catch (Exception e) {
+        txnSender.abort(txn);
+        throw e;
+      }
+    }
+  }
+
+  private static Api.RequestHeader.Builder header(byte[] key) {
+    return Api.RequestHeader.newBuilder().setKey(ByteString.copyFrom(key));
+  }
+
+  private static boolean isWrite(String method) {
+    return !(method.equals("Get") || method.equals("Scan") || method.equals("Contains"));
+  }
+
+  private static void setField(Message.Builder b, String name, Object value) {
+    b.setField(b.getDescriptorForType().findFieldByName(name), value);
+  }
+
+  private static Message getField(Message m, String name) {
+    FieldDescriptor fd = m.getDescriptorForType().findFieldByName(name);
+    return fd != null && m.hasField(fd) ? (Message) m.getField(fd) : null;
+  }
+
+  static DBException replyError(Message reply) {
+    Api.ResponseHeader header = (Api.ResponseHeader) getField(reply, "header");
+    if (header == null || !header.hasError()) {
+      return null;
+    }
+    for (Map.Entry<FieldDescriptor, Object> e : header.getError().getAllFields().entrySet()) {
+      return new DBException(e.getKey().getName(), (Message) e.getValue());
+    }
+    return null;
+  }
+
+  /** TxnSender attaches the current transaction to each call. */
+  private static class TxnSender implements Sender {
+    private final Sender wrapped;
+    private final String name;
+    private final Data.IsolationType isolation;
+    private Data.Transaction txn;
+    boolean ended;
+
+    TxnSender(Sender wrapped, String name, Data.IsolationType isolation) {
+      this.wrapped = wrapped;
+      this.name = name;
+      this.isolation = isolation;
+      reset(0);
+    }
+
+    private void reset(int priority) {
+      txn = Data.Transaction.newBuilder()
+          .setName(name).setIsolation(isolation).setPriority(priority).buildPartial();
+    }
+
+    @Override
+    public <T extends Message> T send(String method, Message args, T replyPrototype)
+        throws IOException {
+      Message.Builder b = args.toBuilder();
+      Api.RequestHeader h = (Api.RequestHeader) getField(args, "header");
+      setField(b, "header", h.toBuilder().setTxn(txn).build());
+      T reply = wrapped.send(method, b.build(), replyPrototype);
+      Api.ResponseHeader rh = (Api.ResponseHeader) getField(reply, "header");
+      if (rh != null && rh.hasTxn()) {
+        txn = rh.getTxn();
+      }
+      DBException err = replyError(reply);
+      if (err != null && err.getName().equals("transaction_aborted")) {
+        // Restart anew, keeping the priority as a minimum.
+        reset(((Errors.TransactionAbortedError) err.getDetail()).getTxn().getPriority());
+      } else if (err == null && method.equals("EndTransaction")) {
+        ended = true;
+      }
+      return reply;
+    }
+
+    void abort(KV kv) {
+      if (ended) {
+        return;
+      }
+      try {
+        kv.call("EndTransaction", Api.RequestHeader.newBuilder(),
+            Api.EndTransactionRequest.newBuilder().setCommit(false),
+            Api.EndTransactionResponse.getDefaultInstance());
+      } catch (Exception e) {
+        // Best effort; the transaction will eventually be aborted by
+        // a conflicting writer once its heartbeat expires.
+      }
+    }
+  }
+}
@@ -40,6 +40,19 @@ var TxnRetryOptions = util.RetryOptions{
 type TransactionOptions struct {
 	Name      string // Concise desc of txn for debugging
 	Isolation proto.IsolationType
+	// Linearizable delays acknowledgement of the commit until the
+	// commit timestamp has passed on all nodes; see
+	// proto.EndTransactionRequest.
+	Linearizable bool
+	// CausalityToken, if set, is a token obtained via KV.CausalityToken
+	// after an earlier transaction, possibly by another client. The
+	// transaction is timestamped after the token and so observes all
+	// effects of the earlier transaction.
+	CausalityToken proto.Timestamp
+	// Deadline, if set, is the latest timestamp at which the
+	// transaction may commit; see proto.EndTransactionRequest. It may
+	// be lowered while the transaction runs with KV.UpdateDeadline.
+	Deadline proto.Timestamp
 }
 
 // KVSender is an interface for sending a request to a Key-Value
@@ -58,9 +71,10 @@ type Clock interface {
 	Now() int64
 }
 
-// KV provides serial access to a KV store via Call and parallel
-// access via Prepare and Flush. A KV instance is not thread safe.
-type KV struct {
+// Options are the defaults of a KV client's session, applied to each
+// of its calls and transactions so that applications needn't set them
+// at every call site.
+type Options struct {
 	// User is the default user to set on API calls. If User is set to
 	// non-empty in call arguments, this value is ignored.
 	User string
@@ -68,10 +82,34 @@ type KV struct {
 	// UserPriority is set non-zero in call arguments, this value is
 	// ignored.
 	UserPriority int32
+	// ReadConsistency is the default consistency to set on Contains,
+	// Get and Scan calls made outside of a transaction. If
+	// ReadConsistency is set in call arguments, this value is ignored.
+	// See proto.ReadConsistencyType for the staleness of inconsistent
+	// and bounded staleness reads.
+	ReadConsistency proto.ReadConsistencyType
+	// MaxStaleness is the maximum staleness of reads made with
+	// proto.BOUNDED_STALENESS consistency by default.
+	MaxStaleness time.Duration
+	// MaxRetries is the maximum number of times a transaction run via
+	// RunTransaction is retried after conflicts before it's aborted.
+	// Zero retries indefinitely.
+	MaxRetries int
+	// Timeout is the deadline, measured from the start of each
+	// transaction run via RunTransaction, after which the transaction
+	// is aborted rather than retried. Zero imposes no deadline.
+	Timeout time.Duration
+}
 
-	sender   KVSender
-	clock    Clock
-	prepared []*Call
+// KV provides serial access to a KV store via Call and parallel
+// access via Prepare and Flush. A KV instance is not thread safe.
+type KV struct {
+	Options
+
+	sender         KVSender
+	clock          Clock
+	prepared       []*Call
+	causalityToken proto.Timestamp
 }
 
 // NewKV creates a new instance of KV using the specified sender. To
@@ -114,6 +152,12 @@ func (kv *KV) Call(method string, args proto.Request, reply proto.Response) erro
 	if args.Header().UserPriority == nil && kv.UserPriority != 0 {
 		args.Header().UserPriority = gogoproto.Int32(kv.UserPriority)
 	}
+	if args.Header().ReadConsistency == proto.CONSISTENT && supportsReadConsistency(method) {
+		if _, ok := kv.sender.(*txnSender); !ok {
+			args.Header().ReadConsistency = kv.ReadConsistency
+			args.Header().MaxStaleness = kv.MaxStaleness.Nanoseconds()
+		}
+	}
 	call := &Call{
 		Method: method,
 		Args:   args,
@@ -121,6 +165,9 @@ func (kv *KV) Call(method string, args proto.Request, reply proto.Response) erro
 	}
 	call.resetClientCmdID(kv.clock)
 	kv.sender.Send(call)
+	if sr, ok := call.Reply.(*proto.ScanResponse); ok {
+		sr.DecompressKeys()
+	}
 	err := call.Reply.Header().GoError()
 	if err != nil {
 		log.Infof("failed %s: %s", call.Method, err)
@@ -128,6 +175,23 @@ func (kv *KV) Call(method string, args proto.Request, reply proto.Response) erro
 	return err
 }
 
+// supportsReadConsistency returns true if the method may be executed
+// with a read consistency other than proto.CONSISTENT.
+func supportsReadConsistency(method string) bool {
+	return method == proto.Contains || method == proto.Get || method == proto.Scan
+}
+
+// CompareAndSet writes the specified key/value pairs only if the
+// values of the keys of all conditions match their expected values.
+// If a condition fails, nothing is written and a
+// proto.ConditionFailedError is returned. If all keys are addressed
+// to a single range, they are written in a single command; otherwise,
+// the call is executed as a transaction, which is not supported from
+// within a transaction.
+func (kv *KV) CompareAndSet(conditions []proto.CompareAndSetCondition, puts []proto.KeyValue) error {
+	return kv.Call(proto.CompareAndSet, proto.CompareAndSetArgs(conditions, puts), &proto.CompareAndSetResponse{})
+}
+
 // Prepare accepts a KV API call, specified by method name, arguments
 // and a reply struct. The call will be buffered locally until the
 // first call to Flush(), at which time it will be sent for execution
@@ -195,10 +259,24 @@ func (kv *KV) Flush() (err error) {
 	for i, reply := range bReply.Responses {
 		replies[i].Reset()
 		gogoproto.Merge(replies[i], reply.GetValue().(gogoproto.Message))
+		if sr, ok := replies[i].(*proto.ScanResponse); ok {
+			sr.DecompressKeys()
+		}
 	}
 	return
 }
 
+// CausalityToken returns the commit timestamp of the last transaction
+// run via RunTransaction, or the zero timestamp if there was none.
+// Passing the token as TransactionOptions.CausalityToken to a later
+// transaction, by this or any other client, guarantees that the later
+// transaction observes all effects of this one. Tokens are
+// proto.Timestamp messages and may be marshaled to pass them between
+// processes.
+func (kv *KV) CausalityToken() proto.Timestamp {
+	return kv.causalityToken
+}
+
 // RunTransaction executes retryable in the context of a distributed
 // transaction. The transaction is automatically aborted if retryable
 // returns any error aside from recoverable internal errors, and is
@@ -216,23 +294,40 @@ func (kv *KV) RunTransaction(opts *TransactionOptions, retryable func(txn *KV) e
 	// Create a new KV for the transaction using a transactional KV sender.
 	txnSender := newTxnSender(kv.Sender(), opts)
 	txnKV := NewKV(txnSender, kv.clock)
-	txnKV.User = kv.User
-	txnKV.UserPriority = kv.UserPriority
+	txnKV.Options = kv.Options
 	defer txnKV.Close()
 
 	// Run retryable in a retry loop until we encounter a success or
 	// error condition this loop isn't capable of handling.
 	retryOpts := TxnRetryOptions
 	retryOpts.Tag = opts.Name
+	start := time.Now()
+	retries := 0
+	// retry returns status unless the transaction may not be retried
+	// again after failing with err, in which case the loop is broken.
+	retry := func(status util.RetryStatus, err error) (util.RetryStatus, error) {
+		if kv.MaxRetries > 0 && retries >= kv.MaxRetries {
+			return util.RetryBreak, util.Errorf("transaction %q failed after %d retries: %s", opts.Name, retries, err)
+		}
+		if kv.Timeout > 0 && time.Since(start) >= kv.Timeout {
+			return util.RetryBreak, util.Errorf("transaction %q exceeded its %s deadline: %s", opts.Name, kv.Timeout, err)
+		}
+		retries++
+		return status, nil
+	}
 	if err := util.RetryWithBackoff(retryOpts, func() (util.RetryStatus, error) {
 		txnSender.txnEnd = false // always reset before [re]starting txn
+		txnSender.deadline = nil
+		if !opts.Deadline.Equal(proto.ZeroTimestamp) {
+			txnSender.updateDeadline(opts.Deadline)
+		}
 		err := retryable(txnKV)
 		if err == nil && !txnSender.txnEnd {
 			// If there were no errors running retryable, commit the txn. This
 			// may block waiting for outstanding writes to complete in case
 			// retryable didn't -- we need the most recent of all response
 			// timestamps in order to commit.
-			etArgs := &proto.EndTransactionRequest{Commit: true}
+			etArgs := &proto.EndTransactionRequest{Commit: true, Linearizable: opts.Linearizable, Deadline: txnSender.deadline}
 			etReply := &proto.EndTransactionResponse{}
 			// Prepare and flush for end txn in order to execute entire txn in
 			// a single round trip if possible.
@@ -242,18 +337,18 @@ func (kv *KV) RunTransaction(opts *TransactionOptions, retryable func(txn *KV) e
 		switch t := err.(type) {
 		case *proto.ReadWithinUncertaintyIntervalError:
 			// Retry immediately on read within uncertainty interval.
-			return util.RetryReset, nil
+			return retry(util.RetryReset, t)
 		case *proto.TransactionAbortedError:
 			// If the transaction was aborted, the txnSender will have created
 			// a new txn. We allow backoff/retry in this case.
-			return util.RetryContinue, nil
+			return retry(util.RetryContinue, t)
 		case *proto.TransactionPushError:
 			// Backoff and retry on failure to push a conflicting transaction.
-			return util.RetryContinue, nil
+			return retry(util.RetryContinue, t)
 		case *proto.TransactionRetryError:
 			// Return RetryReset for an immediate retry (as in the case of
 			// an SSI txn whose timestamp was pushed).
-			return util.RetryReset, nil
+			return retry(util.RetryReset, t)
 		default:
 			// For all other cases, finish retry loop, returning possible error.
 			return util.RetryBreak, t
@@ -267,6 +362,22 @@ func (kv *KV) RunTransaction(opts *TransactionOptions, retryable func(txn *KV) e
 		}
 		return err
 	}
+	kv.causalityToken = txnSender.txn.Timestamp
+	return nil
+}
+
+// UpdateDeadline lowers the deadline of the transaction of txn, the
+// transactional client supplied to a RunTransaction retryable
+// function, to deadline if it's earlier than the current one. The
+// transaction fails to commit if its commit timestamp exceeds the
+// deadline. Deadlines set by UpdateDeadline don't carry over to
+// retries of the transaction.
+func (kv *KV) UpdateDeadline(deadline proto.Timestamp) error {
+	ts, ok := kv.sender.(*txnSender)
+	if !ok {
+		return util.Errorf("UpdateDeadline may only be invoked on a transactional client")
+	}
+	ts.updateDeadline(deadline)
 	return nil
 }
 
@@ -281,7 +392,7 @@ func (kv *KV) GetI(key proto.Key, iface interface{}) (bool, proto.Timestamp, err
 	if err != nil || value == nil {
 		return false, proto.Timestamp{}, err
 	}
-	if value.Integer != nil {
+	if _, err := value.GetInt(); err == nil {
 		return false, proto.Timestamp{}, util.Errorf("unexpected integer value at key %q: %+v", key, value)
 	}
 	if err := gob.NewDecoder(bytes.NewBuffer(value.Bytes)).Decode(iface); err != nil {
@@ -298,7 +409,7 @@ func (kv *KV) GetProto(key proto.Key, msg gogoproto.Message) (bool, proto.Timest
 	if err != nil || value == nil {
 		return false, proto.Timestamp{}, err
 	}
-	if value.Integer != nil {
+	if _, err := value.GetInt(); err == nil {
 		return false, proto.Timestamp{}, util.Errorf("unexpected integer value at key %q: %+v", key, value)
 	}
 	if err := gogoproto.Unmarshal(value.Bytes, msg); err != nil {
@@ -179,6 +179,68 @@ func TestKVCommitTransaction(t *testing.T) {
 	}
 }
 
+// TestKVCausalityToken verifies that the commit timestamp of a
+// transaction is exported as the client's causality token and that a
+// token supplied to a transaction is sent as its minimum timestamp.
+func TestKVCausalityToken(t *testing.T) {
+	commitTS := proto.Timestamp{WallTime: 10, Logical: 1}
+	var sentTS proto.Timestamp
+	client := NewKV(newTestSender(func(call *Call) {
+		txn := *call.Args.Header().Txn
+		sentTS = txn.Timestamp
+		txn.Timestamp = commitTS
+		call.Reply.Header().Txn = &txn
+	}), nil)
+	if err := client.RunTransaction(&TransactionOptions{}, func(txn *KV) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	token := client.CausalityToken()
+	if !token.Equal(commitTS) {
+		t.Fatalf("expected causality token %s; got %s", commitTS, token)
+	}
+
+	other := NewKV(client.Sender(), nil)
+	if err := other.RunTransaction(&TransactionOptions{CausalityToken: token}, func(txn *KV) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !sentTS.Equal(token) {
+		t.Errorf("expected transaction to be sent with token %s; got %s", token, sentTS)
+	}
+}
+
+// TestKVTransactionDeadline verifies that the earliest of the
+// deadlines of the transaction options and those set by
+// UpdateDeadline is sent with the commit.
+func TestKVTransactionDeadline(t *testing.T) {
+	var deadline *proto.Timestamp
+	client := NewKV(newTestSender(func(call *Call) {
+		if call.Method == proto.EndTransaction {
+			deadline = call.Args.(*proto.EndTransactionRequest).Deadline
+		}
+	}), nil)
+	if err := client.UpdateDeadline(proto.Timestamp{WallTime: 1}); err == nil {
+		t.Error("expected error updating the deadline of a non-transactional client")
+	}
+	opts := &TransactionOptions{Deadline: proto.Timestamp{WallTime: 10}}
+	if err := client.RunTransaction(opts, func(txn *KV) error {
+		for _, wallTime := range []int64{5, 7} {
+			if err := txn.UpdateDeadline(proto.Timestamp{WallTime: wallTime}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if deadline == nil || !deadline.Equal(proto.Timestamp{WallTime: 5}) {
+		t.Errorf("expected commit with deadline 5; got %v", deadline)
+	}
+}
+
 // TestKVCommitTransactionOnce verifies that if the transaction is
 // ended explicitly in the retryable func, it is not automatically
 // ended a second time at completion of retryable func.
@@ -276,3 +338,44 @@ func TestKVRunTransactionRetryOnErrors(t *testing.T) {
 		}
 	}
 }
+
+// TestKVRunTransactionRetryLimits verifies that transactions are
+// aborted rather than retried once they exceed the client's maximum
+// retries or deadline.
+func TestKVRunTransactionRetryLimits(t *testing.T) {
+	TxnRetryOptions.Backoff = 1 * time.Millisecond
+
+	testCases := []struct {
+		opts     Options
+		expCount int // Expected attempts
+	}{
+		{Options{MaxRetries: 2}, 3},
+		{Options{Timeout: time.Nanosecond}, 1},
+	}
+	for i, test := range testCases {
+		count := 0
+		aborted := false
+		client := NewKV(newTestSender(func(call *Call) {
+			switch call.Method {
+			case proto.Put:
+				count++
+				call.Reply.Header().SetGoError(&proto.TransactionRetryError{})
+			case proto.EndTransaction:
+				aborted = !call.Args.(*proto.EndTransactionRequest).Commit
+			}
+		}), nil)
+		client.Options = test.opts
+		err := client.RunTransaction(&TransactionOptions{}, func(txn *KV) error {
+			return txn.Call(proto.Put, testPutReq, &proto.PutResponse{})
+		})
+		if err == nil {
+			t.Errorf("%d: expected error", i)
+		}
+		if count != test.expCount {
+			t.Errorf("%d: expected %d attempts; got %d", i, test.expCount, count)
+		}
+		if !aborted {
+			t.Errorf("%d: expected transaction to be aborted", i)
+		}
+	}
+}
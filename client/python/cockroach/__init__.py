@@ -0,0 +1,23 @@
+# Copyright 2014 The Cockroach Authors.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+# implied. See the License for the specific language governing
+# permissions and limitations under the License. See the AUTHORS file
+# for names of contributors.
+
+"""Reference Python client for the Cockroach key-value API."""
+
+import os
+import sys
+
+# The generated *_pb2 modules import each other by bare module name,
+# so the generated directory must be importable directly.
+sys.path.insert(0, os.path.join(os.path.dirname(__file__), "proto"))
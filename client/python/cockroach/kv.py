@@ -0,0 +1,280 @@
+# Copyright 2014 The Cockroach Authors.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+# implied. See the License for the specific language governing
+# permissions and limitations under the License. See the AUTHORS file
+# for names of contributors.
+
+"""Key-value client speaking protobuf over HTTP.
+
+See the "Wire Contract" section of client/doc.go for the protocol.
+"""
+
+import random
+import time
+
+try:
+    from urllib.request import Request, urlopen
+    from urllib.error import HTTPError, URLError
+except ImportError:  # Python 2
+    from urllib2 import Request, urlopen, HTTPError, URLError
+
+import api_pb2
+import data_pb2
+
+KV_DB_ENDPOINT = "/kv/db/"
+PROTO_CONTENT_TYPE = "application/x-protobuf"
+
+# HTTP status codes which are retried with backoff.
+RETRYABLE_STATUS = (429, 503, 504)
+
+# Methods which mutate data and therefore carry a client command ID,
+# mirroring proto.WriteMethods for the public API.
+WRITE_METHODS = frozenset([
+    "Put", "ConditionalPut", "CompareAndSet", "Increment", "Delete",
+    "DeleteRange", "EndTransaction", "ReapQueue", "EnqueueUpdate",
+    "EnqueueMessage", "Batch",
+])
+
+
+class RetryOptions(object):
+    """Exponential backoff parameters; see util.RetryOptions."""
+
+    def __init__(self, backoff=0.05, max_backoff=5.0, constant=2,
+                 max_attempts=0):
+        self.backoff = backoff
+        self.max_backoff = max_backoff
+        self.constant = constant
+        self.max_attempts = max_attempts  # 0 retries indefinitely
+
+    def sleeps(self):
+        """Yields successive backoff durations in seconds."""
+        backoff, attempts = self.backoff, 0
+        while self.max_attempts == 0 or attempts < self.max_attempts:
+            attempts += 1
+            yield backoff
+            backoff = min(backoff * self.constant, self.max_backoff)
+
+
+HTTP_RETRY_OPTIONS = RetryOptions()
+TXN_RETRY_OPTIONS = RetryOptions()
+
+
+class Error(Exception):
+    """An error returned by the database in ResponseHeader.error.
+
+    name is the name of the set field of the proto Error union (e.g.
+    "write_intent", "transaction_retry") and detail the typed error
+    message itself.
+    """
+
+    def __init__(self, name, detail):
+        Exception.__init__(self, "%s: %s" % (name, detail))
+        self.name = name
+        self.detail = detail
+
+
+class HTTPSender(object):
+    """Sends calls to a Cockroach node; the analog of client.HTTPSender.
+
+    Transport errors and retryable HTTP status codes are retried with
+    backoff using the same request body, and therefore the same client
+    command ID, so that mutations are executed at most once.
+    """
+
+    def __init__(self, server, scheme="http", timeout=30,
+                 retry_options=HTTP_RETRY_OPTIONS):
+        self.server = server
+        self.scheme = scheme
+        self.timeout = timeout
+        self.retry_options = retry_options
+
+    def send(self, method, args, reply):
+        url = "%s://%s%s%s" % (self.scheme, self.server, KV_DB_ENDPOINT, method)
+        body = args.SerializeToString()
+        sleeps = self.retry_options.sleeps()
+        while True:
+            req = Request(url, body, {
+                "Content-Type": PROTO_CONTENT_TYPE,
+                "Accept": PROTO_CONTENT_TYPE,
+            })
+            try:
+                resp = urlopen(req, timeout=self.timeout)
+                reply.ParseFromString(resp.read())
+                return
+            except HTTPError as e:
+                if e.code not in RETRYABLE_STATUS:
+                    raise
+                err = e
+            except URLError as e:
+                err = e
+            try:
+                time.sleep(next(sleeps))
+            except StopIteration:
+                raise err
+
+
+def _reply_error(reply):
+    """Returns an Error for the reply's header error, or None."""
+    if not reply.header.HasField("error"):
+        return None
+    fields = reply.header.error.ListFields()
+    if not fields:
+        return None
+    desc, value = fields[0]
+    return Error(desc.name, value)
+
+
+def _new_cmd_id(header):
+    header.cmd_id.wall_time = int(time.time() * 1e9)
+    header.cmd_id.random = random.getrandbits(63)
+
+
+class KV(object):
+    """Synchronous access to the key-value API; see client.KV."""
+
+    def __init__(self, sender, user="", user_priority=0):
+        self.sender = sender
+        self.user = user
+        self.user_priority = user_priority
+
+    def call(self, method, args, reply):
+        """Sends args to method and fills in reply.
+
+        Raises Error if the response header carries an error.
+        """
+        if not args.header.user:
+            args.header.user = self.user
+        if self.user_priority and not args.header.HasField("user_priority"):
+            args.header.user_priority = self.user_priority
+        if method in WRITE_METHODS:
+            _new_cmd_id(args.header)
+        self.sender.send(method, args, reply)
+        err = _reply_error(reply)
+        if err is not None:
+            raise err
+        return reply
+
+    def get(self, key):
+        """Returns the bytes value at key, or None if not found."""
+        args = api_pb2.GetRequest()
+        args.header.key = key
+        reply = self.call("Get", args, api_pb2.GetResponse())
+        if not reply.HasField("value"):
+            return None
+        return reply.value.bytes
+
+    def put(self, key, value):
+        args = api_pb2.PutRequest()
+        args.header.key = key
+        args.value.bytes = value
+        self.call("Put", args, api_pb2.PutResponse())
+
+    def increment(self, key, inc):
+        args = api_pb2.IncrementRequest()
+        args.header.key = key
+        args.increment = inc
+        return self.call("Increment", args, api_pb2.IncrementResponse()).new_value
+
+    def delete(self, key):
+        args = api_pb2.DeleteRequest()
+        args.header.key = key
+        self.call("Delete", args, api_pb2.DeleteResponse())
+
+    def scan(self, start, end, max_results):
+        """Returns a list of (key, bytes) tuples in [start, end)."""
+        args = api_pb2.ScanRequest()
+        args.header.key = start
+        args.header.end_key = end
+        args.max_results = max_results
+        reply = self.call("Scan", args, api_pb2.ScanResponse())
+        return [(row.key, row.value.bytes) for row in reply.rows]
+
+    def run_transaction(self, name, retryable,
+                        isolation=data_pb2.SERIALIZABLE,
+                        retry_options=TXN_RETRY_OPTIONS):
+        """Runs retryable(txn) in a transaction; see KV.RunTransaction.
+
+        The transaction is committed if retryable returns normally and
+        aborted if it raises anything other than a retryable
+        transaction error, which is re-raised.
+        """
+        sender = _TxnSender(self.sender, name, isolation)
+        txn = KV(sender, self.user, self.user_priority)
+        sleeps = retry_options.sleeps()
+        while True:
+            sender.ended = False
+            try:
+                retryable(txn)
+                if not sender.ended:
+                    txn.call("EndTransaction",
+                             _end_txn_request(True),
+                             api_pb2.EndTransactionResponse())
+                return
+            except Error as e:
+                if e.name in ("read_within_uncertainty_interval",
+                              "transaction_retry"):
+                    continue
+                if e.name in ("transaction_aborted", "transaction_push"):
+                    try:
+                        time.sleep(next(sleeps))
+                        continue
+                    except StopIteration:
+                        pass
+                sender.abort(txn)
+                raise
+            except Exception:
+                sender.abort(txn)
+                raise
+
+
+def _end_txn_request(commit):
+    args = api_pb2.EndTransactionRequest()
+    args.commit = commit
+    return args
+
+
+class _TxnSender(object):
+    """Attaches and updates the transaction on every call; see txnSender."""
+
+    def __init__(self, wrapped, name, isolation):
+        self.wrapped = wrapped
+        self.name = name
+        self.isolation = isolation
+        self.ended = False
+        self.reset(0)
+
+    def reset(self, priority):
+        self.txn = data_pb2.Transaction()
+        self.txn.name = self.name
+        self.txn.isolation = self.isolation
+        self.txn.priority = priority
+
+    def send(self, method, args, reply):
+        args.header.txn.CopyFrom(self.txn)
+        self.wrapped.send(method, args, reply)
+        if reply.header.HasField("txn"):
+            self.txn.CopyFrom(reply.header.txn)
+        err = _reply_error(reply)
+        if err is not None and err.name == "transaction_aborted":
+            # Restart anew, keeping the priority as a minimum.
+            self.reset(err.detail.txn.priority)
+        elif err is None and method == "EndTransaction":
+            self.ended = True
+
+    def abort(self, txn):
+        if self.ended:
+            return
+        try:
+            txn.call("EndTransaction", _end_txn_request(False),
+                     api_pb2.EndTransactionResponse())
+        except Error:
+            pass
@@ -0,0 +1,122 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// DefaultScanChunkSize is the number of rows fetched per chunk by a
+// Scanner if no chunk size is specified.
+const DefaultScanChunkSize = 1000
+
+// A Scanner streams the rows of a scan over a key range in chunks of
+// bounded size. Each chunk is fetched with a separate Scan call once
+// the rows of the preceding chunk have been consumed, so that neither
+// the client nor the gateway ever holds more than one chunk of a
+// large scan in memory and the first rows are available as soon as
+// the first chunk has been read.
+//
+// Outside of a transaction, all chunks are read at the timestamp of
+// the first chunk, so the rows streamed form a consistent snapshot.
+// Like KV, a Scanner is not thread safe.
+//
+//   s := kv.NewScanner(proto.Key("a"), proto.Key("z"), 0)
+//   for s.Next() {
+//     row := s.Row()
+//     ...
+//   }
+//   if err := s.Err(); err != nil {
+//     ...
+//   }
+type Scanner struct {
+	kv   *KV
+	args proto.ScanRequest
+	rows []proto.KeyValue // Unconsumed rows of the current chunk
+	row  proto.KeyValue   // The current row
+	done bool             // True if the last chunk has been fetched
+	err  error
+}
+
+// NewScanner returns a Scanner which streams the rows between start
+// and end in chunks of chunkSize rows. If chunkSize is not positive,
+// DefaultScanChunkSize is used. Chunks are requested with prefix-
+// compressed keys to further reduce their size on the wire.
+func (kv *KV) NewScanner(start, end proto.Key, chunkSize int64) *Scanner {
+	if chunkSize <= 0 {
+		chunkSize = DefaultScanChunkSize
+	}
+	return &Scanner{
+		kv: kv,
+		args: proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    start,
+				EndKey: end,
+			},
+			MaxResults:   chunkSize,
+			CompressKeys: true,
+		},
+	}
+}
+
+// Next advances the scanner to the next row, fetching the next chunk
+// if the current one has been consumed. It returns false once all
+// rows have been returned or an error occurs; Err distinguishes the
+// two cases.
+func (s *Scanner) Next() bool {
+	for len(s.rows) == 0 {
+		if s.done || s.err != nil {
+			return false
+		}
+		s.fetch()
+	}
+	s.row, s.rows = s.rows[0], s.rows[1:]
+	return true
+}
+
+// Row returns the row most recently returned by Next.
+func (s *Scanner) Row() proto.KeyValue {
+	return s.row
+}
+
+// Err returns the error, if any, which ended the scan.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// fetch reads the next chunk of rows and advances the scan's start
+// key past the last row read.
+func (s *Scanner) fetch() {
+	// Copy the args, as the call may modify them.
+	args := s.args
+	reply := &proto.ScanResponse{}
+	if s.err = s.kv.Call(proto.Scan, &args, reply); s.err != nil {
+		return
+	}
+	s.rows = reply.Rows
+	if int64(len(reply.Rows)) < s.args.MaxResults {
+		s.done = true
+		return
+	}
+	s.args.Key = reply.Rows[len(reply.Rows)-1].Key.Next()
+	if !s.args.Key.Less(s.args.EndKey) {
+		s.done = true
+	}
+	// Pin non-transactional scans to the timestamp of the first chunk.
+	if _, ok := s.kv.sender.(*txnSender); !ok && s.args.Timestamp.Equal(proto.ZeroTimestamp) {
+		s.args.Timestamp = reply.Timestamp
+	}
+}
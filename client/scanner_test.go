@@ -0,0 +1,86 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// TestScanner verifies that a Scanner fetches rows in chunks only as
+// they are consumed, decompresses their keys and reads all chunks at
+// the timestamp of the first.
+func TestScanner(t *testing.T) {
+	var keys []proto.Key
+	for i := 0; i < 10; i++ {
+		keys = append(keys, proto.Key(fmt.Sprintf("key-%02d", i)))
+	}
+	var calls int
+	client := NewKV(newTestSender(func(call *Call) {
+		calls++
+		args := call.Args.(*proto.ScanRequest)
+		reply := call.Reply.(*proto.ScanResponse)
+		if calls > 1 && !args.Timestamp.Equal(proto.Timestamp{WallTime: 1}) {
+			t.Errorf("expected chunk %d to be read at first chunk's timestamp; got %s", calls, args.Timestamp)
+		}
+		for _, key := range keys {
+			if !key.Less(args.Key) && key.Less(args.EndKey) && int64(len(reply.Rows)) < args.MaxResults {
+				reply.Rows = append(reply.Rows, proto.KeyValue{Key: key})
+			}
+		}
+		reply.Timestamp = proto.Timestamp{WallTime: int64(calls)}
+		if args.CompressKeys {
+			reply.CompressKeys()
+		}
+	}), nil)
+
+	s := client.NewScanner(keys[1], proto.KeyMax, 3)
+	var rows int
+	for s.Next() {
+		rows++
+		if key := s.Row().Key; !key.Equal(keys[rows]) {
+			t.Errorf("expected row %d to have key %q; got %q", rows, keys[rows], key)
+		}
+		// Chunks are fetched only once the preceding chunk is consumed.
+		if expCalls := (rows + 2) / 3; calls != expCalls {
+			t.Errorf("expected %d chunks fetched after %d rows; got %d", expCalls, rows, calls)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 9 || calls != 4 {
+		t.Errorf("expected 9 rows in 4 chunks; got %d rows in %d chunks", rows, calls)
+	}
+}
+
+// TestScannerError verifies that an error fetching a chunk ends the
+// scan and is returned by Err.
+func TestScannerError(t *testing.T) {
+	client := NewKV(newTestSender(func(call *Call) {
+		call.Reply.Header().SetGoError(errors.New("scan failed"))
+	}), nil)
+	s := client.NewScanner(proto.KeyMin, proto.KeyMax, 0)
+	if s.Next() {
+		t.Error("expected no rows")
+	}
+	if err := s.Err(); err == nil {
+		t.Error("expected scan error")
+	}
+}
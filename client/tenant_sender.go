@@ -0,0 +1,217 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// tenantMethods are the methods which may be invoked through a
+// TenantSender. The keys of other methods, such as admin and queue
+// methods, aren't confined to a tenant's key space.
+var tenantMethods = map[string]struct{}{
+	proto.Contains:       {},
+	proto.Get:            {},
+	proto.Put:            {},
+	proto.ConditionalPut: {},
+	proto.CompareAndSet:  {},
+	proto.Increment:      {},
+	proto.Delete:         {},
+	proto.DeleteRange:    {},
+	proto.Scan:           {},
+	proto.EndTransaction: {},
+	proto.Batch:          {},
+}
+
+// A TenantSender proxies requests to the underlying KVSender on
+// behalf of a tenant, confining them to the tenant's key space: the
+// keys of requests are prefixed with proto.TenantPrefix and the
+// prefix is removed from the keys of responses. Value checksums,
+// which cover keys, are recomputed accordingly. Keys reported by
+// errors retain the prefix.
+//
+// A TenantSender only scopes keys; the tenant is isolated from other
+// tenants by the permission configs for its prefix.
+type TenantSender struct {
+	wrapped  KVSender
+	tenantID int64
+	prefix   proto.Key
+}
+
+// NewTenantSender returns a new instance of TenantSender which wraps
+// a KVSender and confines requests to the keys of the tenant with
+// the given ID.
+func NewTenantSender(wrapped KVSender, tenantID int64) *TenantSender {
+	return &TenantSender{
+		wrapped:  wrapped,
+		tenantID: tenantID,
+		prefix:   proto.TenantPrefix(tenantID),
+	}
+}
+
+// Send proxies a copy of the call's arguments with the tenant's keys
+// to the wrapped sender and translates the reply's keys back to the
+// tenant's.
+func (ts *TenantSender) Send(call *Call) {
+	args := gogoproto.Clone(call.Args).(proto.Request)
+	if err := ts.prefixRequest(call.Method, args); err != nil {
+		call.Reply.Header().SetGoError(err)
+		return
+	}
+	ts.wrapped.Send(&Call{Method: call.Method, Args: args, Reply: call.Reply})
+	if call.Reply.Header().GoError() != nil {
+		return
+	}
+	if err := ts.stripResponse(call.Args, args, call.Reply); err != nil {
+		call.Reply.Header().SetGoError(err)
+	}
+}
+
+// Close closes the wrapped sender.
+func (ts *TenantSender) Close() {
+	ts.wrapped.Close()
+}
+
+// prefixKey returns the tenant's key for key. KeyMax maps to the end
+// of the tenant's key space.
+func (ts *TenantSender) prefixKey(key proto.Key) proto.Key {
+	if key.Equal(proto.KeyMax) {
+		return ts.prefix.PrefixEnd()
+	}
+	return proto.MakeKey(ts.prefix, key)
+}
+
+// stripKey returns key without the tenant's prefix, or an error if
+// key lies outside of the tenant's key space.
+func (ts *TenantSender) stripKey(key proto.Key) (proto.Key, error) {
+	if !bytes.HasPrefix(key, ts.prefix) {
+		return nil, util.Errorf("key %q lies outside of the key space of tenant %d", key, ts.tenantID)
+	}
+	return key[len(ts.prefix):], nil
+}
+
+// rekeyValue verifies the checksum of v, if any, against from and
+// recomputes it for to.
+func rekeyValue(v *proto.Value, from, to proto.Key) error {
+	if v == nil || v.Checksum == nil {
+		return nil
+	}
+	if err := v.Verify(from); err != nil {
+		return err
+	}
+	v.Checksum = nil
+	v.InitChecksum(to)
+	return nil
+}
+
+// prefixRequest prefixes the keys of args with the tenant's prefix.
+func (ts *TenantSender) prefixRequest(method string, args proto.Request) error {
+	if _, ok := tenantMethods[method]; !ok {
+		return util.Errorf("%s may not be invoked by tenants", method)
+	}
+	header := args.Header()
+	key := header.Key
+	// The key of EndTransaction is supplied by the coordinator from
+	// the transaction record, which is already the tenant's.
+	if method != proto.EndTransaction {
+		header.Key = ts.prefixKey(header.Key)
+		if len(header.EndKey) > 0 {
+			header.EndKey = ts.prefixKey(header.EndKey)
+		}
+	}
+	switch t := args.(type) {
+	case *proto.PutRequest:
+		return rekeyValue(&t.Value, key, header.Key)
+	case *proto.ConditionalPutRequest:
+		if err := rekeyValue(&t.Value, key, header.Key); err != nil {
+			return err
+		}
+		return rekeyValue(t.ExpValue, key, header.Key)
+	case *proto.CompareAndSetRequest:
+		for i := range t.Conditions {
+			c := &t.Conditions[i]
+			prefixed := ts.prefixKey(c.Key)
+			if err := rekeyValue(c.ExpValue, c.Key, prefixed); err != nil {
+				return err
+			}
+			c.Key = prefixed
+		}
+		for i := range t.Puts {
+			p := &t.Puts[i]
+			prefixed := ts.prefixKey(p.Key)
+			if err := rekeyValue(&p.Value, p.Key, prefixed); err != nil {
+				return err
+			}
+			p.Key = prefixed
+		}
+	case *proto.BatchRequest:
+		for i := range t.Requests {
+			req := t.Requests[i].GetValue().(proto.Request)
+			reqMethod, err := proto.MethodForRequest(req)
+			if err != nil {
+				return err
+			}
+			if err := ts.prefixRequest(reqMethod, req); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stripResponse removes the tenant's prefix from the keys of reply,
+// the response to args, which are the prefixed copy of orig.
+func (ts *TenantSender) stripResponse(orig, args proto.Request, reply proto.Response) error {
+	switch t := reply.(type) {
+	case *proto.GetResponse:
+		return rekeyValue(t.Value, args.Header().Key, orig.Header().Key)
+	case *proto.ScanResponse:
+		t.DecompressKeys()
+		for i := range t.Rows {
+			row := &t.Rows[i]
+			key, err := ts.stripKey(row.Key)
+			if err != nil {
+				return err
+			}
+			if err := rekeyValue(&row.Value, row.Key, key); err != nil {
+				return err
+			}
+			row.Key = key
+		}
+	case *proto.DeleteRangeResponse:
+		for i := range t.DeletedKeys {
+			key, err := ts.stripKey(t.DeletedKeys[i].Key)
+			if err != nil {
+				return err
+			}
+			t.DeletedKeys[i].Key = key
+		}
+	case *proto.BatchResponse:
+		origReqs := orig.(*proto.BatchRequest).Requests
+		reqs := args.(*proto.BatchRequest).Requests
+		for i := range t.Responses {
+			if err := ts.stripResponse(origReqs[i].GetValue().(proto.Request), reqs[i].GetValue().(proto.Request),
+				t.Responses[i].GetValue().(proto.Response)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
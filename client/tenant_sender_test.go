@@ -0,0 +1,102 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package client
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// TestTenantSender verifies that a TenantSender prefixes the keys of
+// requests with the tenant's prefix, strips it from the keys of
+// responses, recomputes value checksums and refuses methods whose
+// keys it can't confine.
+func TestTenantSender(t *testing.T) {
+	const tenantID = 5
+	values := map[string]proto.Value{}
+	kv := NewKV(NewTenantSender(newTestSender(func(call *Call) {
+		header := call.Args.Header()
+		switch args := call.Args.(type) {
+		case *proto.PutRequest:
+			if err := args.Value.Verify(header.Key); err != nil {
+				call.Reply.Header().SetGoError(err)
+				return
+			}
+			values[string(header.Key)] = args.Value
+		case *proto.GetRequest:
+			if v, ok := values[string(header.Key)]; ok {
+				call.Reply.(*proto.GetResponse).Value = &v
+			}
+		case *proto.ScanRequest:
+			var keys []string
+			for k := range values {
+				if !proto.Key(k).Less(header.Key) && proto.Key(k).Less(header.EndKey) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			reply := call.Reply.(*proto.ScanResponse)
+			for _, k := range keys {
+				reply.Rows = append(reply.Rows, proto.KeyValue{Key: proto.Key(k), Value: values[k]})
+			}
+			reply.CompressKeys()
+		}
+	}), tenantID), nil)
+
+	for _, key := range []string{"b", "a"} {
+		if err := kv.PutI(proto.Key(key), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := range values {
+		if id, _, ok := proto.DecodeTenantKey(proto.Key(key)); !ok || id != tenantID {
+			t.Errorf("expected key %q to belong to tenant %d", key, tenantID)
+		}
+	}
+	var s string
+	if ok, _, err := kv.GetI(proto.Key("a"), &s); !ok || err != nil || s != "a" {
+		t.Errorf("expected to get %q; got %t, %q, %v", "a", ok, s, err)
+	}
+
+	args := &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{Key: proto.KeyMin, EndKey: proto.KeyMax},
+		MaxResults:    10,
+	}
+	reply := &proto.ScanResponse{}
+	if err := kv.Call(proto.Scan, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Rows) != 2 || !reply.Rows[0].Key.Equal(proto.Key("a")) || !reply.Rows[1].Key.Equal(proto.Key("b")) {
+		t.Errorf("expected rows at the tenant's keys a and b; got %+v", reply.Rows)
+	}
+	for _, row := range reply.Rows {
+		if err := row.Value.Verify(row.Key); err != nil {
+			t.Error(err)
+		}
+	}
+	if !args.Key.Equal(proto.KeyMin) || !args.EndKey.Equal(proto.KeyMax) {
+		t.Errorf("expected the caller's arguments to be unchanged; got %q-%q", args.Key, args.EndKey)
+	}
+
+	if err := kv.Call(proto.AdminSplit, &proto.AdminSplitRequest{
+		RequestHeader: proto.RequestHeader{Key: proto.Key("a")},
+		SplitKey:      proto.Key("b"),
+	}, &proto.AdminSplitResponse{}); err == nil {
+		t.Error("expected tenants to be refused admin methods")
+	}
+}
@@ -31,6 +31,10 @@ type txnSender struct {
 	wrapped KVSender
 	txnEnd  bool // True if EndTransaction was invoked internally
 	txn     *proto.Transaction
+	token   proto.Timestamp // Causality token; see TransactionOptions
+	// deadline is the latest timestamp at which the transaction may
+	// commit, or nil for none.
+	deadline *proto.Timestamp
 }
 
 // newTxnSender returns a new instance of txnSender which wraps a
@@ -41,7 +45,9 @@ func newTxnSender(wrapped KVSender, opts *TransactionOptions) *txnSender {
 		txn: &proto.Transaction{
 			Name:      opts.Name,
 			Isolation: opts.Isolation,
+			Timestamp: opts.CausalityToken,
 		},
+		token: opts.CausalityToken,
 	}
 }
 
@@ -63,6 +69,7 @@ func (ts *txnSender) Send(call *Call) {
 			Name:      ts.txn.Name,
 			Isolation: ts.txn.Isolation,
 			Priority:  t.Txn.Priority, // acts as a minimum priority on restart
+			Timestamp: ts.token,
 		}
 	case nil:
 		if call.Method == proto.EndTransaction {
@@ -71,6 +78,14 @@ func (ts *txnSender) Send(call *Call) {
 	}
 }
 
+// updateDeadline lowers the transaction's deadline to deadline, if
+// earlier.
+func (ts *txnSender) updateDeadline(deadline proto.Timestamp) {
+	if ts.deadline == nil || deadline.Less(*ts.deadline) {
+		ts.deadline = &deadline
+	}
+}
+
 // Close is a noop for the txnSender.
 func (ts *txnSender) Close() {
 }
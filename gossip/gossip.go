@@ -166,6 +166,21 @@ func (g *Gossip) AddInfo(key string, val interface{}, ttl time.Duration) error {
 	return err
 }
 
+// RestoreInfo adds an info object restored from a snapshot persisted
+// by an earlier run of the node. The info is stamped with the wall
+// time in Unix nanoseconds at which the snapshot was taken, so that
+// any info gossiped since supersedes it, and expires at the wall time
+// ttlStamp. Unlike AddInfo, restored infos don't mark the node as
+// connected to the gossip network.
+func (g *Gossip) RestoreInfo(key string, val interface{}, timestamp, ttlStamp int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	i := g.is.newInfo(key, val, 0)
+	i.Timestamp = timestamp
+	i.TTLStamp = ttlStamp
+	return g.is.addInfo(i)
+}
+
 // GetInfo returns an info value by key or an error if specified
 // key does not exist or has expired.
 func (g *Gossip) GetInfo(key string) (interface{}, error) {
@@ -260,10 +275,10 @@ func (g *Gossip) Outgoing() []net.Addr {
 // management in separate goroutines and returns.
 func (g *Gossip) Start(rpcServer *rpc.Server) {
 	// Start up asynchronous processors.
-	g.server.start(rpcServer) // serve gossip protocol
-	go g.bootstrap()          // bootstrap gossip client
-	go g.manage()             // manage gossip clients
-	go g.maybeWarnAboutInit()
+	g.server.start(rpcServer)                 // serve gossip protocol
+	go util.RunLabeled("gossip", g.bootstrap) // bootstrap gossip client
+	go util.RunLabeled("gossip", g.manage)    // manage gossip clients
+	go util.RunLabeled("gossip", g.maybeWarnAboutInit)
 }
 
 // Stop shuts down the gossip server. Returns a channel which signals
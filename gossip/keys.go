@@ -34,6 +34,12 @@ const (
 	// KeyConfigZone is the zone configuration map.
 	KeyConfigZone = "zones"
 
+	// KeyLatencyPrefix is the key prefix for gossiping the round-trip
+	// times measured by each node to the other nodes. The suffix is the
+	// measuring node's ID in hexadecimal and the value a map from node
+	// ID to round-trip time in nanoseconds.
+	KeyLatencyPrefix = "latency-"
+
 	// KeyMaxAvailCapacityPrefix is the key prefix for gossiping available
 	// store capacity. The suffix is composed of: <node ID>-<store ID>.
 	// The value is a storage.StoreDescriptor struct.
@@ -51,6 +57,11 @@ const (
 	// string address of the node. E.g. node-1bfa: fwd56.sjcb1:24001
 	KeyNodeIDPrefix = "node-"
 
+	// KeySettings is the map of cluster settings which differ from
+	// their defaults. The value is a map from setting name to string
+	// encoded value.
+	KeySettings = "settings"
+
 	// KeySentinel is a key for gossip which must not expire or else the
 	// node considers itself partitioned and will retry with bootstrap hosts.
 	KeySentinel = KeyClusterID
@@ -62,6 +73,19 @@ const (
 	KeyFirstRangeDescriptor = "first-range"
 )
 
+// MakeCapacityGossipKey returns the gossip key for the descriptor of a
+// store.
+func MakeCapacityGossipKey(nodeID, storeID int32) string {
+	return KeyMaxAvailCapacityPrefix + strconv.FormatInt(int64(nodeID), 10) + "-" +
+		strconv.FormatInt(int64(storeID), 10)
+}
+
+// MakeLatencyGossipKey returns the gossip key for the round-trip
+// times measured by a node.
+func MakeLatencyGossipKey(nodeID int32) string {
+	return KeyLatencyPrefix + strconv.FormatInt(int64(nodeID), 16)
+}
+
 // MakeNodeIDGossipKey returns the gossip key for node ID info.
 func MakeNodeIDGossipKey(nodeID int32) string {
 	return KeyNodeIDPrefix + strconv.FormatInt(int64(nodeID), 16)
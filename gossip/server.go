@@ -132,7 +132,7 @@ func (s *server) start(rpcServer *rpc.Server) {
 	}
 	rpcServer.AddCloseCallback(s.onClose)
 
-	go func() {
+	go util.RunLabeled("gossip", func() {
 		// Periodically wakeup blocked client gossip requests.
 		gossipTimeout := time.Tick(s.jitteredGossipInterval())
 		for {
@@ -142,7 +142,7 @@ func (s *server) start(rpcServer *rpc.Server) {
 				s.ready.Broadcast()
 			}
 		}
-	}()
+	})
 }
 
 // stop sets the server's closed bool to true and broadcasts to
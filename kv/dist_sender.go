@@ -31,6 +31,7 @@ import (
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 
 	gogoproto "github.com/gogo/protobuf/proto"
 )
@@ -55,6 +56,19 @@ var rpcRetryOpts = util.RetryOptions{
 	MaxAttempts: 0, // retry indefinitely
 }
 
+var (
+	// distSenderLatency records the latency in nanoseconds of calls
+	// sent via DistSenders, including retries.
+	distSenderLatency = metrics.DefaultRegistry.Histogram("kv.dist.latency", metrics.DefaultWindow)
+	// distSenderRPCs counts the RPCs sent to ranges' replicas.
+	distSenderRPCs = metrics.DefaultRegistry.Counter("kv.dist.rpcs")
+	// distSenderRetries counts the RPCs retried after errors.
+	distSenderRetries = metrics.DefaultRegistry.Counter("kv.dist.retries")
+	// distSenderMethodMetrics record the latency of the calls of each
+	// method at the gateway, and the RPC retries they incurred.
+	distSenderMethodMetrics = metrics.DefaultRegistry.MethodMetrics("kv.dist.", "retries")
+)
+
 // A firstRangeMissingError indicates that the first range has not yet
 // been gossipped. This will be the case for a node which hasn't yet
 // joined the gossip network.
@@ -92,6 +106,9 @@ type DistSender struct {
 	gossip *gossip.Gossip
 	// rangeCache caches replica metadata for key ranges.
 	rangeCache *RangeDescriptorCache
+	// groups caches the groups of which users are members, for
+	// permission configs which grant permissions to groups.
+	groups *groupCache
 }
 
 // NewDistSender returns a client.KVSender instance which connects to the
@@ -101,6 +118,7 @@ func NewDistSender(gossip *gossip.Gossip) *DistSender {
 		gossip: gossip,
 	}
 	ds.rangeCache = NewRangeDescriptorCache(ds)
+	ds.groups = newGroupCache(ds)
 	return ds
 }
 
@@ -110,7 +128,9 @@ func NewDistSender(gossip *gossip.Gossip) *DistSender {
 // key range implicated by the command, the lowest common denominator
 // for permission. For example, if a scan crosses two permission
 // configs, both configs must allow read permissions or the entire
-// scan will fail.
+// scan will fail. Permissions granted to groups apply to their
+// members; the user's groups are only resolved if a permission config
+// does not grant the user permission directly.
 func (ds *DistSender) verifyPermissions(method string, header *proto.RequestHeader) error {
 	// The root user can always proceed.
 	if header.User == storage.UserRoot {
@@ -137,14 +157,26 @@ func (ds *DistSender) verifyPermissions(method string, header *proto.RequestHead
 	if end == nil {
 		end = header.Key
 	}
+	var groups []string
+	var resolved bool
+	allowed := func(perm *proto.PermConfig, groups ...string) bool {
+		return (!proto.NeedReadPerm(method) || perm.CanRead(header.User, groups...)) &&
+			(!proto.NeedWritePerm(method) || perm.CanWrite(header.User, groups...))
+	}
 	return permMap.(storage.PrefixConfigMap).VisitPrefixes(
 		header.Key, end, func(start, end proto.Key, config interface{}) error {
 			perm := config.(*proto.PermConfig)
-			if proto.NeedReadPerm(method) && !perm.CanRead(header.User) {
-				return util.Errorf("user %q cannot invoke %s at %q; permissions: %+v",
-					header.User, method, string(start), perm)
+			if allowed(perm) {
+				return nil
 			}
-			if proto.NeedWritePerm(method) && !perm.CanWrite(header.User) {
+			if perm.HasGroups() && !resolved {
+				var err error
+				if groups, err = ds.groups.lookup(header.User); err != nil {
+					return err
+				}
+				resolved = true
+			}
+			if !allowed(perm, groups...) {
 				return util.Errorf("user %q cannot invoke %s at %q; permissions: %+v",
 					header.User, method, string(start), perm)
 			}
@@ -239,6 +271,12 @@ func (ds *DistSender) getRangeDescriptor(key proto.Key) ([]proto.RangeDescriptor
 	return ds.internalRangeLookup(metadataKey, desc)
 }
 
+// lookupRange implements the rangeLookuper interface by consulting
+// the range descriptor cache.
+func (ds *DistSender) lookupRange(key proto.Key) (*proto.RangeDescriptor, error) {
+	return ds.rangeCache.LookupRangeDescriptor(key)
+}
+
 // sendRPC sends one or more RPCs to replicas from the supplied
 // proto.Replica slice. First, replicas which have gossipped
 // addresses are corralled and then sent via rpc.Send, with requirement
@@ -248,10 +286,15 @@ func (ds *DistSender) sendRPC(desc *proto.RangeDescriptor, method string, args p
 		return util.Errorf("%s: replicas set is empty", method)
 	}
 
-	// Build a slice of replica addresses (if gossipped).
+	// Build a slice of replica addresses (if gossipped). Non-voting
+	// replicas only serve reads which may be served by any replica.
+	nearest := isNearestReplicaRead(method, args.Header())
 	var addrs []net.Addr
 	replicaMap := map[string]*proto.Replica{}
 	for i := range desc.Replicas {
+		if desc.Replicas[i].NonVoter && !nearest {
+			continue
+		}
 		addr, err := ds.nodeIDToAddr(desc.Replicas[i].NodeID)
 		if err != nil {
 			log.V(1).Infof("node %d address is not gossipped", desc.Replicas[i].NodeID)
@@ -271,6 +314,11 @@ func (ds *DistSender) sendRPC(desc *proto.RangeDescriptor, method string, args p
 		SendNextTimeout: defaultSendNextTimeout,
 		Timeout:         defaultRPCTimeout,
 	}
+	// Reads which needn't be served by the leader go to the nearest
+	// healthy replica, as measured by heartbeat round-trip times.
+	if nearest {
+		rpcOpts.Ordering = rpc.OrderByLatency
+	}
 	// getArgs clones the arguments on demand for all but the first replica.
 	firstArgs := true
 	getArgs := func(addr net.Addr) interface{} {
@@ -298,6 +346,17 @@ func (ds *DistSender) sendRPC(desc *proto.RangeDescriptor, method string, args p
 	return err
 }
 
+// isNearestReplicaRead returns true if the request is a read which
+// may be served by any replica. Only INCONSISTENT reads qualify;
+// BOUNDED_STALENESS reads are still served by the range leader.
+//
+// TODO: route BOUNDED_STALENESS reads to the nearest replica
+// as well once followers can determine that their data is recent
+// enough.
+func isNearestReplicaRead(method string, header *proto.RequestHeader) bool {
+	return proto.IsReadOnly(method) && header.ReadConsistency == proto.INCONSISTENT
+}
+
 // Send implements the clent.KVSender interface. It verifies
 // permissions and looks up the appropriate range based on the
 // supplied key and sends the RPC according to the specified
@@ -307,6 +366,12 @@ func (ds *DistSender) sendRPC(desc *proto.RangeDescriptor, method string, args p
 // individual ranges sequentially and combines the results
 // transparently.
 func (ds *DistSender) Send(call *client.Call) {
+	defer func(start time.Time) {
+		latency := time.Since(start)
+		distSenderLatency.RecordDuration(latency)
+		distSenderMethodMetrics.RecordLatency(call.Method, latency)
+	}(time.Now())
+
 	// Verify permissions.
 	if err := ds.verifyPermissions(call.Method, call.Args.Header()); err != nil {
 		call.Reply.Header().SetGoError(err)
@@ -320,6 +385,10 @@ func (ds *DistSender) Send(call *client.Call) {
 	// responses and descNext are only used when executing across ranges.
 	var responses []proto.Response
 	var descNext *proto.RangeDescriptor
+	// scanned counts the rows read by a range-spanning scan.
+	var scanned int64
+	// returned counts the keys returned by a range-spanning delete range.
+	var returned int64
 	// args will be changed to point to a copy of call.Args if the request
 	// spans ranges since in that case we need to alter its contents.
 	args := call.Args
@@ -359,6 +428,7 @@ func (ds *DistSender) Send(call *client.Call) {
 					// Make a new reply object for this call.
 					reply = gogoproto.Clone(call.Reply).(proto.Response)
 				}
+				distSenderRPCs.Inc(1)
 				err = ds.sendRPC(desc, call.Method, args, reply)
 			}
 
@@ -372,9 +442,13 @@ func (ds *DistSender) Send(call *client.Call) {
 					// Range descriptor might be out of date - evict it.
 					ds.rangeCache.EvictCachedRangeDescriptor(args.Header().Key)
 					// On addressing errors, don't backoff and retry immediately.
+					distSenderRetries.Inc(1)
+					distSenderMethodMetrics.Inc(call.Method, "retries")
 					return util.RetryReset, nil
 				default:
 					if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
+						distSenderRetries.Inc(1)
+						distSenderMethodMetrics.Inc(call.Method, "retries")
 						return util.RetryContinue, nil
 					}
 				}
@@ -395,6 +469,31 @@ func (ds *DistSender) Send(call *client.Call) {
 		if descNext == nil {
 			break
 		}
+		// A scan which has already read its maximum number of results
+		// need not query the next range; otherwise, the next range need
+		// only return the remainder.
+		if scanArgs, ok := args.(*proto.ScanRequest); ok && scanArgs.MaxResults > 0 {
+			scanned += int64(len(reply.(*proto.ScanResponse).Rows))
+			maxResults := call.Args.(*proto.ScanRequest).MaxResults
+			if scanned >= maxResults {
+				break
+			}
+			scanArgs.MaxResults = maxResults - scanned
+		}
+		if scArgs, ok := args.(*proto.InternalScanChangesRequest); ok && scArgs.MaxResults > 0 {
+			scanned += int64(len(reply.(*proto.InternalScanChangesResponse).Changes))
+			maxResults := call.Args.(*proto.InternalScanChangesRequest).MaxResults
+			if scanned >= maxResults {
+				break
+			}
+			scArgs.MaxResults = maxResults - scanned
+		}
+		// Likewise, a delete range returns no more deleted keys than
+		// requested in total.
+		if drArgs, ok := args.(*proto.DeleteRangeRequest); ok && drArgs.MaxReturnedKeys > 0 {
+			returned += int64(len(reply.(*proto.DeleteRangeResponse).DeletedKeys))
+			drArgs.MaxReturnedKeys = call.Args.(*proto.DeleteRangeRequest).MaxReturnedKeys - returned
+		}
 		// In next iteration, query next range.
 		args.Header().Key = descNext.StartKey
 		// "Untruncate" EndKey to original.
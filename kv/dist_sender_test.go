@@ -158,3 +158,47 @@ func TestVerifyPermissions(t *testing.T) {
 	}
 	n.Stop()
 }
+
+// TestVerifyPermissionsGroups verifies that permissions granted to
+// groups apply to the groups' members.
+func TestVerifyPermissionsGroups(t *testing.T) {
+	n := gossip.NewSimulationNetwork(1, "unix", gossip.DefaultTestGossipInterval)
+	defer n.Stop()
+	ds := NewDistSender(n.Nodes[0].Gossip)
+	ds.groups.groups = map[string][]string{
+		"alice": {"readers", "writers"},
+		"bob":   {"readers"},
+	}
+	ds.groups.expires = time.Now().Add(time.Hour)
+	config := &proto.PermConfig{
+		Read:  []string{"@readers", "carol"},
+		Write: []string{"@writers"},
+	}
+	configMap, err := storage.NewPrefixConfigMap([]*storage.PrefixConfig{{engine.KeyMin, nil, config}})
+	if err != nil {
+		t.Fatalf("failed to make prefix config map, err: %s", err)
+	}
+	ds.gossip.AddInfo(gossip.KeyConfigPermission, configMap, time.Hour)
+
+	testData := []struct {
+		method        string
+		user          string
+		hasPermission bool
+	}{
+		{proto.Get, "alice", true},
+		{proto.Put, "alice", true},
+		{proto.Get, "bob", true},
+		{proto.Put, "bob", false},
+		{proto.Get, "carol", true},
+		{proto.Put, "carol", false},
+		{proto.Get, "readers", false},
+	}
+	for _, test := range testData {
+		err := ds.verifyPermissions(test.method, &proto.RequestHeader{User: test.user, Key: proto.Key("a")})
+		if err != nil && test.hasPermission {
+			t.Errorf("user: %s should have had permission to %s, err: %s", test.user, test.method, err)
+		} else if err == nil && !test.hasPermission {
+			t.Errorf("user: %s should not have had permission to %s", test.user, test.method)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// groupCacheTTL is the time for which group memberships are cached.
+// Membership changes take effect on each node within this interval.
+const groupCacheTTL = 10 * time.Second
+
+// A groupCache resolves the groups of which a user is a member. The
+// memberships of all groups are read from engine.KeyGroupPrefix as
+// needed and cached for groupCacheTTL.
+type groupCache struct {
+	sender client.KVSender // Sender via which memberships are read
+
+	sync.Mutex                     // Protects groups and expires
+	groups     map[string][]string // Maps users to their groups
+	expires    time.Time
+}
+
+// newGroupCache returns a groupCache reading group memberships via
+// the supplied sender.
+func newGroupCache(sender client.KVSender) *groupCache {
+	return &groupCache{sender: sender}
+}
+
+// lookup returns the groups of which user is a member, reading the
+// memberships of all groups if the cached memberships have expired.
+func (gc *groupCache) lookup(user string) ([]string, error) {
+	gc.Lock()
+	defer gc.Unlock()
+	if gc.groups == nil || time.Now().After(gc.expires) {
+		groups, err := gc.readGroups()
+		if err != nil {
+			return nil, err
+		}
+		gc.groups = groups
+		gc.expires = time.Now().Add(groupCacheTTL)
+	}
+	return gc.groups[user], nil
+}
+
+// readGroups scans the memberships of all groups, returning a map
+// from users to the groups of which they are members.
+func (gc *groupCache) readGroups() (map[string][]string, error) {
+	call := &client.Call{
+		Method: proto.Scan,
+		Args: &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.KeyGroupPrefix,
+				EndKey: engine.KeyGroupPrefix.PrefixEnd(),
+				User:   storage.UserRoot,
+			},
+		},
+		Reply: &proto.ScanResponse{},
+	}
+	gc.sender.Send(call)
+	if err := call.Reply.Header().GoError(); err != nil {
+		return nil, util.Errorf("unable to read group memberships: %s", err)
+	}
+	groups := map[string][]string{}
+	for _, kv := range call.Reply.(*proto.ScanResponse).Rows {
+		name := string(bytes.TrimPrefix(kv.Key, engine.KeyGroupPrefix))
+		config := &proto.GroupConfig{}
+		if err := gogoproto.Unmarshal(kv.Value.Bytes, config); err != nil {
+			return nil, util.Errorf("unable to decode membership of group %q: %s", name, err)
+		}
+		for _, member := range config.Members {
+			groups[member] = append(groups[member], name)
+		}
+	}
+	return groups, nil
+}
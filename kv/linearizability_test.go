@@ -0,0 +1,170 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	historyClients      = 4
+	historyOpsPerClient = 25
+	// partitionProbability is the chance that a call is lost either
+	// on its way to the database or on its way back.
+	partitionProbability = 0.05
+)
+
+// A partitionSender simulates a flaky network between client and
+// gateway by failing calls before they are sent (the call has no
+// effect) or after they are sent (the client doesn't learn whether
+// the call took effect).
+type partitionSender struct {
+	wrapped client.KVSender
+	mu      sync.Mutex
+	rand    *rand.Rand
+}
+
+func (ps *partitionSender) chance() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.rand.Float64() < partitionProbability
+}
+
+func (ps *partitionSender) Send(call *client.Call) {
+	if ps.chance() {
+		call.Reply.Header().SetGoError(util.Errorf("partitioned before send"))
+		return
+	}
+	ps.wrapped.Send(call)
+	if ps.chance() {
+		call.Reply.Header().SetGoError(util.Errorf("partitioned after send"))
+	}
+}
+
+func (ps *partitionSender) Close() {}
+
+// TestKVLinearizabilityUnderPartitions runs concurrent clients issuing
+// gets, puts, conditional puts and increments through a flaky sender
+// and verifies the recorded history is linearizable. Calls failing due
+// to the simulated partition are treated as indeterminate.
+func TestKVLinearizabilityUnderPartitions(t *testing.T) {
+	db, _, _, _, _, err := createTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &partitionSender{wrapped: db.Sender(), rand: rand.New(rand.NewSource(0))}
+	history := &client.History{}
+
+	var wg sync.WaitGroup
+	for c := 0; c < historyClients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			kv := client.NewKV(client.NewHistorySender(sender, history, c), nil)
+			kv.User = storage.UserRoot
+			r := rand.New(rand.NewSource(int64(c)))
+			for i := 0; i < historyOpsPerClient; i++ {
+				value := []byte(fmt.Sprintf("%d.%d", c, i))
+				// Keys "a" and "b" hold byte values; "c" is a counter.
+				key := proto.Key([]string{"a", "b"}[r.Intn(2)])
+				switch r.Intn(4) {
+				case 0:
+					kv.Call(proto.Get, proto.GetArgs(key), &proto.GetResponse{})
+				case 1:
+					kv.Call(proto.Put, proto.PutArgs(key, value), &proto.PutResponse{})
+				case 2:
+					// Conditional put expecting the currently read value.
+					gReply := &proto.GetResponse{}
+					if kv.Call(proto.Get, proto.GetArgs(key), gReply) != nil {
+						continue
+					}
+					cArgs := &proto.ConditionalPutRequest{
+						Value:    proto.Value{Bytes: value},
+						ExpValue: gReply.Value,
+					}
+					cArgs.Key = key
+					kv.Call(proto.ConditionalPut, cArgs, &proto.ConditionalPutResponse{})
+				case 3:
+					kv.Call(proto.Increment, proto.IncrementArgs(proto.Key("c"), 1), &proto.IncrementResponse{})
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if err := client.CheckLinearizable(history.Entries()); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestTxnStrictSerializability runs concurrent transactions which read
+// two keys and write one of them, a workload prone to write skew
+// under snapshot isolation, and verifies the committed transactions
+// are strictly serializable.
+func TestTxnStrictSerializability(t *testing.T) {
+	db, _, _, _, _, err := createTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := &client.History{}
+
+	var wg sync.WaitGroup
+	for c := 0; c < historyClients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				var ops []client.Operation
+				invoke := history.Invoke()
+				opts := &client.TransactionOptions{Name: fmt.Sprintf("txn-%d.%d", c, i), Isolation: proto.SERIALIZABLE}
+				err := db.RunTransaction(opts, func(txn *client.KV) error {
+					ops = nil
+					for _, key := range []proto.Key{proto.Key("a"), proto.Key("b")} {
+						gReply := &proto.GetResponse{}
+						if err := txn.Call(proto.Get, proto.GetArgs(key), gReply); err != nil {
+							return err
+						}
+						ops = append(ops, client.Operation{Method: proto.Get, Key: key, Value: gReply.Value})
+					}
+					key := proto.Key([]string{"a", "b"}[c%2])
+					value := proto.Value{Bytes: []byte(fmt.Sprintf("%d.%d", c, i))}
+					if err := txn.Call(proto.Put, proto.PutArgs(key, value.Bytes), &proto.PutResponse{}); err != nil {
+						return err
+					}
+					ops = append(ops, client.Operation{Method: proto.Put, Key: key, Value: &value})
+					return nil
+				})
+				if err != nil {
+					ops = nil
+				}
+				history.Complete(c, invoke, ops, false)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if err := client.CheckSerializable(history.Entries(), true); err != nil {
+		t.Error(err)
+	}
+}
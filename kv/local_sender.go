@@ -123,6 +123,11 @@ func (ls *LocalSender) Send(call *client.Call) {
 		if err == nil {
 			store, err = ls.GetStore(header.Replica.StoreID)
 		}
+		// Don't send work to a store whose disk has stalled; the command
+		// would block indefinitely.
+		if err == nil && store.Stalled() {
+			err = &storage.StoreStalledError{StoreID: store.StoreID(), Duration: store.StallDuration()}
+		}
 		if err != nil {
 			call.Reply.Header().SetGoError(err)
 		} else {
@@ -187,3 +192,16 @@ func (ls *LocalSender) lookupReplica(start, end proto.Key) (int64, *proto.Replic
 	}
 	return 0, nil, proto.NewRangeKeyMismatchError(start, end, nil)
 }
+
+// lookupRange implements the rangeLookuper interface by consulting
+// each store in turn for the range containing key.
+func (ls *LocalSender) lookupRange(key proto.Key) (*proto.RangeDescriptor, error) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	for _, store := range ls.storeMap {
+		if rng := store.LookupRange(key, nil); rng != nil {
+			return rng.Desc, nil
+		}
+	}
+	return nil, proto.NewRangeKeyMismatchError(key, nil, nil)
+}
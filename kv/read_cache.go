@@ -0,0 +1,241 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"code.google.com/p/biogo.store/llrb"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/metrics"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// readCacheKey is the key type used to store and sort entries in the
+// ReadCacheSender. Entries are sorted by key and then by user, as
+// reads are cached per user so that permissions continue to apply.
+type readCacheKey struct {
+	key  proto.Key
+	user string
+}
+
+// Compare implements the llrb.Comparable interface for readCacheKey,
+// so that it can be used as a key for util.OrderedCache.
+func (a readCacheKey) Compare(b llrb.Comparable) int {
+	bk := b.(readCacheKey)
+	if c := bytes.Compare(a.key, bk.key); c != 0 {
+		return c
+	}
+	switch {
+	case a.user < bk.user:
+		return -1
+	case a.user > bk.user:
+		return 1
+	}
+	return 0
+}
+
+// readCacheEntry is a cached read.
+type readCacheEntry struct {
+	value     *proto.Value    // nil if the key was not found
+	timestamp proto.Timestamp // Timestamp of the read
+	expires   int64           // Expiration in wall time nanoseconds
+}
+
+// ReadCacheStats are the statistics of a ReadCacheSender.
+type ReadCacheStats struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	Entries int     `json:"entries"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// A ReadCacheSender is a client.KVSender which serves repeated
+// non-transactional Gets of the same key from a small LRU cache.
+// Cached reads are invalidated by writes sent through the
+// ReadCacheSender and otherwise expire after a TTL. To keep cached
+// reads from being staler than the clock uncertainty the cluster
+// already tolerates, the TTL is capped at the clock's maximum offset;
+// with no maximum offset, nothing is cached. Writes made through other
+// gateways are only reflected once cached reads expire, so the cache
+// suits keys which are read far more often than they change, such as
+// configs and descriptors.
+type ReadCacheSender struct {
+	wrapped client.KVSender
+	clock   *hlc.Clock
+	ttl     time.Duration
+	hits    *metrics.Counter
+	misses  *metrics.Counter
+
+	sync.Mutex // Protects cache and gen
+	cache      *util.OrderedCache
+	gen        int64 // Incremented by each invalidation
+}
+
+// NewReadCacheSender returns a ReadCacheSender wrapping the supplied
+// sender which caches up to size reads for at most ttl. Its hit and
+// miss counts are registered as the node's read cache metrics.
+func NewReadCacheSender(wrapped client.KVSender, clock *hlc.Clock, size int, ttl time.Duration) *ReadCacheSender {
+	rc := &ReadCacheSender{
+		wrapped: wrapped,
+		clock:   clock,
+		ttl:     ttl,
+		hits:    metrics.NewCounter(),
+		misses:  metrics.NewCounter(),
+		cache: util.NewOrderedCache(util.CacheConfig{
+			Policy: util.CacheLRU,
+			ShouldEvict: func(n int, k, v interface{}) bool {
+				return n > size
+			},
+		}),
+	}
+	metrics.DefaultRegistry.Register("kv.readcache.hits", rc.hits)
+	metrics.DefaultRegistry.Register("kv.readcache.misses", rc.misses)
+	return rc
+}
+
+// Send implements the client.KVSender interface. Cacheable Gets are
+// served from the cache if possible; all other calls are sent via the
+// wrapped sender, invalidating any cached reads of keys they write
+// once done. A read is only cached if no invalidation happened while
+// it was in flight, as it may have read a value the invalidating
+// write has since replaced.
+func (rc *ReadCacheSender) Send(call *client.Call) {
+	if !rc.cacheable(call) {
+		rc.wrapped.Send(call)
+		rc.invalidate(call.Method, call.Args)
+		return
+	}
+	header := call.Args.Header()
+	key := readCacheKey{key: header.Key, user: header.User}
+	now := rc.clock.PhysicalNow()
+	rc.Lock()
+	v, ok := rc.cache.Get(key)
+	if ok && v.(*readCacheEntry).expires <= now {
+		rc.cache.Del(key)
+		ok = false
+	}
+	gen := rc.gen
+	rc.Unlock()
+	if ok {
+		rc.hits.Inc(1)
+		entry := v.(*readCacheEntry)
+		reply := call.Reply.(*proto.GetResponse)
+		if entry.value != nil {
+			reply.Value = gogoproto.Clone(entry.value).(*proto.Value)
+		}
+		reply.Timestamp = entry.timestamp
+		return
+	}
+	rc.misses.Inc(1)
+	rc.wrapped.Send(call)
+	reply := call.Reply.(*proto.GetResponse)
+	if reply.Error != nil {
+		return
+	}
+	entry := &readCacheEntry{timestamp: reply.Timestamp, expires: now + rc.effectiveTTL().Nanoseconds()}
+	if reply.Value != nil {
+		entry.value = gogoproto.Clone(reply.Value).(*proto.Value)
+	}
+	rc.Lock()
+	if rc.gen == gen {
+		rc.cache.Add(key, entry)
+	}
+	rc.Unlock()
+}
+
+// Close implements the client.KVSender interface.
+func (rc *ReadCacheSender) Close() {
+	rc.wrapped.Close()
+}
+
+// Stats returns the cache's hit and miss counts and current size.
+func (rc *ReadCacheSender) Stats() ReadCacheStats {
+	stats := ReadCacheStats{
+		Hits:   rc.hits.Count(),
+		Misses: rc.misses.Count(),
+	}
+	rc.Lock()
+	stats.Entries = rc.cache.Len()
+	rc.Unlock()
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// effectiveTTL returns the TTL of newly cached reads.
+func (rc *ReadCacheSender) effectiveTTL() time.Duration {
+	if maxOffset := rc.clock.MaxOffset(); maxOffset < rc.ttl {
+		return maxOffset
+	}
+	return rc.ttl
+}
+
+// cacheable returns whether the call is a Get of a single key at the
+// current time outside of a transaction.
+func (rc *ReadCacheSender) cacheable(call *client.Call) bool {
+	if call.Method != proto.Get || rc.effectiveTTL() <= 0 {
+		return false
+	}
+	header := call.Args.Header()
+	return header.Txn == nil && header.Timestamp.Equal(proto.ZeroTimestamp) && len(header.EndKey) == 0
+}
+
+// invalidate removes cached reads of keys which may be written by the
+// call's args. Batches are invalidated request by request. Ending a
+// transaction clears the cache entirely, as the keys written by the
+// transaction are not known here.
+func (rc *ReadCacheSender) invalidate(method string, args proto.Request) {
+	if !proto.NeedWritePerm(method) {
+		return
+	}
+	if batch, ok := args.(*proto.BatchRequest); ok {
+		for i := range batch.Requests {
+			req := batch.Requests[i].GetValue().(proto.Request)
+			if m, err := proto.MethodForRequest(req); err == nil {
+				rc.invalidate(m, req)
+			}
+		}
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	rc.gen++
+	if method == proto.EndTransaction {
+		rc.cache.Clear()
+		return
+	}
+	header := args.Header()
+	start := readCacheKey{key: header.Key}
+	end := header.EndKey
+	if len(end) == 0 {
+		end = header.Key.Next()
+	}
+	for {
+		k, _, ok := rc.cache.Ceil(start)
+		if !ok || !k.(readCacheKey).key.Less(end) {
+			return
+		}
+		rc.cache.Del(k)
+		start = k.(readCacheKey)
+	}
+}
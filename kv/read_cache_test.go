@@ -0,0 +1,165 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// newReadCacheTestSender returns a ReadCacheSender wrapping a sender
+// which serves Gets from the supplied map and counts the Gets it
+// serves.
+func newReadCacheTestSender(data map[string][]byte, gets *int) (*ReadCacheSender, *hlc.ManualClock) {
+	manual := hlc.NewManualClock(0)
+	clock := hlc.NewClock(manual.UnixNano)
+	clock.SetMaxOffset(50 * time.Millisecond)
+	sender := newTestSender(func(call *client.Call) {
+		switch call.Method {
+		case proto.Get:
+			*gets++
+			if v, ok := data[string(call.Args.Header().Key)]; ok {
+				call.Reply.(*proto.GetResponse).Value = &proto.Value{Bytes: v}
+			}
+		case proto.Put:
+			args := call.Args.(*proto.PutRequest)
+			data[string(args.Key)] = args.Value.Bytes
+		}
+	})
+	return NewReadCacheSender(sender, clock, 10, time.Second), manual
+}
+
+// readCacheGet sends a Get of key via sender and returns the value read.
+func readCacheGet(t *testing.T, sender client.KVSender, key, user string) []byte {
+	call := &client.Call{Method: proto.Get, Args: proto.GetArgs(proto.Key(key)), Reply: &proto.GetResponse{}}
+	call.Args.Header().User = user
+	sender.Send(call)
+	if err := call.Reply.Header().GoError(); err != nil {
+		t.Fatal(err)
+	}
+	if v := call.Reply.(*proto.GetResponse).Value; v != nil {
+		return v.Bytes
+	}
+	return nil
+}
+
+// TestReadCacheSender verifies that repeated Gets are served from the
+// cache until invalidated by a write or expired, that reads are
+// cached per user and that hits and misses are counted.
+func TestReadCacheSender(t *testing.T) {
+	data := map[string][]byte{"a": []byte("1")}
+	var gets int
+	rc, manual := newReadCacheTestSender(data, &gets)
+
+	for i := 0; i < 3; i++ {
+		if v := readCacheGet(t, rc, "a", "root"); !bytes.Equal(v, []byte("1")) {
+			t.Fatalf("expected value 1; got %q", v)
+		}
+	}
+	if readCacheGet(t, rc, "b", "root") != nil || readCacheGet(t, rc, "b", "root") != nil {
+		t.Error("expected missing key b")
+	}
+	if gets != 2 {
+		t.Errorf("expected 2 Gets to reach wrapped sender; got %d", gets)
+	}
+
+	// Reads are cached per user.
+	readCacheGet(t, rc, "a", "other")
+	if gets != 3 {
+		t.Errorf("expected Get by another user to reach wrapped sender; got %d Gets", gets)
+	}
+
+	// A write invalidates cached reads of the key for all users.
+	put := &client.Call{Method: proto.Put, Args: proto.PutArgs(proto.Key("a"), []byte("2")), Reply: &proto.PutResponse{}}
+	rc.Send(put)
+	if v := readCacheGet(t, rc, "a", "root"); !bytes.Equal(v, []byte("2")) {
+		t.Errorf("expected value 2 after write; got %q", v)
+	}
+	if v := readCacheGet(t, rc, "a", "other"); !bytes.Equal(v, []byte("2")) {
+		t.Errorf("expected value 2 after write; got %q", v)
+	}
+
+	// Cached reads expire after the clock's maximum offset, which is
+	// less than the configured TTL.
+	gets = 0
+	data["a"] = []byte("3")
+	manual.Set((49 * time.Millisecond).Nanoseconds())
+	if v := readCacheGet(t, rc, "a", "root"); !bytes.Equal(v, []byte("2")) {
+		t.Errorf("expected cached value 2; got %q", v)
+	}
+	manual.Set((50 * time.Millisecond).Nanoseconds())
+	if v := readCacheGet(t, rc, "a", "root"); !bytes.Equal(v, []byte("3")) {
+		t.Errorf("expected expired read to return value 3; got %q", v)
+	}
+	if gets != 1 {
+		t.Errorf("expected 1 Get to reach wrapped sender; got %d", gets)
+	}
+
+	// Transactional reads are never cached.
+	call := &client.Call{Method: proto.Get, Args: proto.GetArgs(proto.Key("a")), Reply: &proto.GetResponse{}}
+	call.Args.Header().Txn = &proto.Transaction{ID: []byte("txn")}
+	rc.Send(call)
+	rc.Send(call)
+	if gets != 3 {
+		t.Errorf("expected transactional Gets to reach wrapped sender; got %d Gets", gets)
+	}
+
+	if stats := rc.Stats(); stats.Hits != 4 || stats.Misses != 6 || stats.HitRate != 0.4 {
+		t.Errorf("expected 4 hits and 6 misses; got %+v", stats)
+	}
+}
+
+// TestReadCacheSenderConcurrentWrite verifies that a read isn't cached
+// if a write is sent while the read is in flight, as the read may have
+// returned the value the write replaced.
+func TestReadCacheSenderConcurrentWrite(t *testing.T) {
+	data := map[string][]byte{"a": []byte("1")}
+	var gets int
+	var rc *ReadCacheSender
+	var wrapped client.KVSender
+	wrapped = newTestSender(func(call *client.Call) {
+		switch call.Method {
+		case proto.Get:
+			gets++
+			call.Reply.(*proto.GetResponse).Value = &proto.Value{Bytes: data["a"]}
+			if gets == 1 {
+				// The write completes after the value was read.
+				rc.Send(&client.Call{Method: proto.Put, Args: proto.PutArgs(proto.Key("a"), []byte("2")), Reply: &proto.PutResponse{}})
+			}
+		case proto.Put:
+			data["a"] = call.Args.(*proto.PutRequest).Value.Bytes
+		}
+	})
+	manual := hlc.NewManualClock(0)
+	clock := hlc.NewClock(manual.UnixNano)
+	clock.SetMaxOffset(50 * time.Millisecond)
+	rc = NewReadCacheSender(wrapped, clock, 10, time.Second)
+
+	if v := readCacheGet(t, rc, "a", "root"); !bytes.Equal(v, []byte("1")) {
+		t.Fatalf("expected value 1 read before the write; got %q", v)
+	}
+	if v := readCacheGet(t, rc, "a", "root"); !bytes.Equal(v, []byte("2")) {
+		t.Errorf("expected value 2 after the write; got %q", v)
+	}
+	if gets != 2 {
+		t.Errorf("expected both Gets to reach wrapped sender; got %d", gets)
+	}
+}
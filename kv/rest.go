@@ -42,6 +42,9 @@ const (
 	RangePrefix = RESTPrefix + "range"
 	// CounterPrefix is the prefix for the endpoint that increments a key by a given amount.
 	CounterPrefix = RESTPrefix + "counter/"
+	// SequencePrefix is the prefix for the endpoint that returns the
+	// next value of a named sequence.
+	SequencePrefix = RESTPrefix + "sequence/"
 )
 
 // Function signture for an HTTP handler that only takes a writer and a request
@@ -82,17 +85,24 @@ var routingTable = map[string]map[string]actionHandler{
 		methodPost:   keyedAction(CounterPrefix, (*RESTServer).handleCounterAction),
 		methodDelete: keyedAction(CounterPrefix, (*RESTServer).handleDeleteAction),
 	},
+	SequencePrefix: {
+		methodPost: keyedAction(SequencePrefix, (*RESTServer).handleSequenceAction),
+	},
 }
 
 // A RESTServer provides a RESTful HTTP API to interact with
 // an underlying key-value store.
 type RESTServer struct {
-	db *client.KV // Key-value database client
+	db        *client.KV     // Key-value database client
+	sequences *sequenceCache // Values of sequences cached by this node
 }
 
 // NewRESTServer allocates and returns a new server.
 func NewRESTServer(db *client.KV) *RESTServer {
-	return &RESTServer{db: db}
+	return &RESTServer{
+		db:        db,
+		sequences: newSequenceCache(db, defaultSequenceBlockSize),
+	}
 }
 
 // ServeHTTP satisfies the http.Handler interface and arbitrates requests
@@ -242,6 +252,24 @@ func (s *RESTServer) handleCounterAction(w http.ResponseWriter, r *http.Request,
 	writeJSON(w, http.StatusOK, ir)
 }
 
+// sequenceResponse is the response to a request for the next value
+// of a sequence.
+type sequenceResponse struct {
+	Value int64 `json:"value"`
+}
+
+// handleSequenceAction returns the next value of the sequence named
+// by key. See sequenceCache for the guarantees made of sequence
+// values.
+func (s *RESTServer) handleSequenceAction(w http.ResponseWriter, r *http.Request, key proto.Key) {
+	value, err := s.sequences.next(string(key))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, sequenceResponse{Value: value})
+}
+
 func (s *RESTServer) handlePutAction(w http.ResponseWriter, r *http.Request, key proto.Key) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -397,6 +397,53 @@ func TestMixingCounters(t *testing.T) {
 	}
 }
 
+// TestSequence verifies that sequence values are handed out in order
+// from a node's cached block and that another node allocates its
+// values from a separate block.
+func TestSequence(t *testing.T) {
+	addr, server, db := startServer(t)
+	defer server.Close()
+
+	next := func() int64 {
+		resp, err := httpDo(addr, methodPost, SequencePrefix+"seq", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d; got %d", http.StatusOK, resp.StatusCode)
+		}
+		var seqResp sequenceResponse
+		if err := json.NewDecoder(resp.Body).Decode(&seqResp); err != nil {
+			t.Fatal(err)
+		}
+		return seqResp.Value
+	}
+	for i := int64(1); i <= 3; i++ {
+		if value := next(); value != i {
+			t.Errorf("expected value %d; got %d", i, value)
+		}
+	}
+
+	// Another node allocates the next block.
+	other := newSequenceCache(db, defaultSequenceBlockSize)
+	if value, err := other.next("seq"); err != nil || value != defaultSequenceBlockSize+1 {
+		t.Errorf("expected value %d; got %d, %v", defaultSequenceBlockSize+1, value, err)
+	}
+	if value := next(); value != 4 {
+		t.Errorf("expected value 4; got %d", value)
+	}
+
+	resp, err := httpDo(addr, methodGet, SequencePrefix+"seq", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status code %d; got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
 // TestSystemKeys makes sure that the internal system keys are
 // accessible through the HTTP API.
 // TODO(spencer): we need to ensure proper permissions through the
@@ -0,0 +1,97 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// defaultSequenceBlockSize is the number of sequence values a node
+// allocates at a time.
+const defaultSequenceBlockSize = 100
+
+// A sequence holds the block of values of a named sequence which the
+// node has allocated but not yet handed out.
+type sequence struct {
+	sync.Mutex
+	next, end int64 // Next value to hand out and end of block (exclusive)
+}
+
+// A sequenceCache hands out the values of named sequences, each
+// backed by a key under engine.KeySequencePrefix. Values are
+// allocated in blocks via a single Increment of the sequence key, so
+// that a sequence does not become a hot key written once per value.
+// Values are unique and positive, and increase for the callers of
+// a single node, but nodes hand out values from different blocks, so
+// values are neither contiguous nor ordered across nodes. Values
+// cached by a node which exits are never handed out.
+type sequenceCache struct {
+	db        *client.KV
+	blockSize int64
+
+	sync.Mutex
+	seqs map[string]*sequence
+}
+
+// newSequenceCache returns a sequenceCache which allocates blocks of
+// blockSize values using db.
+func newSequenceCache(db *client.KV, blockSize int64) *sequenceCache {
+	return &sequenceCache{
+		db:        db,
+		blockSize: blockSize,
+		seqs:      map[string]*sequence{},
+	}
+}
+
+// next returns the next value of the named sequence, allocating a
+// new block of values if the node's cached block is exhausted.
+func (sc *sequenceCache) next(name string) (int64, error) {
+	if len(name) == 0 {
+		return 0, util.Errorf("empty sequence name not allowed")
+	}
+	sc.Lock()
+	seq, ok := sc.seqs[name]
+	if !ok {
+		seq = &sequence{}
+		sc.seqs[name] = seq
+	}
+	sc.Unlock()
+
+	seq.Lock()
+	defer seq.Unlock()
+	if seq.next == seq.end {
+		ir := &proto.IncrementResponse{}
+		if err := sc.db.Call(proto.Increment, &proto.IncrementRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:  engine.MakeKey(engine.KeySequencePrefix, proto.Key(name)),
+				User: storage.UserRoot,
+			},
+			Increment: sc.blockSize,
+		}, ir); err != nil {
+			return 0, util.Errorf("unable to allocate values of sequence %q: %s", name, err)
+		}
+		seq.next, seq.end = ir.NewValue-sc.blockSize+1, ir.NewValue+1
+	}
+	value := seq.next
+	seq.next++
+	return value, nil
+}
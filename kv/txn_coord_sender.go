@@ -19,7 +19,9 @@
 package kv
 
 import (
+	"bytes"
 	"flag"
+	"sort"
 	"sync"
 	"time"
 
@@ -33,6 +35,10 @@ import (
 	gogoproto "github.com/gogo/protobuf/proto"
 )
 
+// intentResolutionConcurrency bounds the number of resolve intent
+// commands sent in parallel upon a transaction's commit or abort.
+const intentResolutionConcurrency = 8
+
 var linearizable = flag.Bool("linearizable", false, "enables linearizable behaviour "+
 	"of operations on this node by making sure that no commit timestamp is reported "+
 	"back to the client until all other node clocks have necessarily passed it.")
@@ -65,10 +71,18 @@ type txnMetadata struct {
 	// to update the write intent when the transaction is committed.
 	keys *util.IntervalCache
 
+	// startTS is the time at which the transaction first mutated data
+	// through this coordinator.
+	startTS proto.Timestamp
+
 	// lastUpdateTS is the latest time when the client sent transaction
 	// operations to this coordinator.
 	lastUpdateTS proto.Timestamp
 
+	// retries counts the restarts of the transaction, as observed by
+	// this coordinator.
+	retries int
+
 	// timeoutDuration is the time after which the transaction should be
 	// considered abandoned by the client. That is, when
 	// current_timestamp > lastUpdateTS + timeoutDuration If this value
@@ -107,42 +121,127 @@ func (tm *txnMetadata) addKeyRange(start, end proto.Key) {
 
 // close sends resolve intent commands for all key ranges this
 // transaction has covered, clears the keys cache and closes the
-// metadata heartbeat.
+// metadata heartbeat. Intents are resolved asynchronously; see
+// resolveIntents.
 func (tm *txnMetadata) close(txn *proto.Transaction, sender client.KVSender) {
 	if tm.keys.Len() > 0 {
 		log.V(1).Infof("cleaning up %d intent(s) for transaction %s", tm.keys.Len(), txn)
 	}
+	var intents []keyRange
 	for _, o := range tm.keys.GetOverlaps(engine.KeyMin, engine.KeyMax) {
-		call := &client.Call{
-			Method: proto.InternalResolveIntent,
-			Args: &proto.InternalResolveIntentRequest{
-				RequestHeader: proto.RequestHeader{
-					Timestamp: txn.Timestamp,
-					Key:       o.Key.Start().(proto.Key),
-					User:      storage.UserRoot,
-					Txn:       txn,
-				},
-			},
-			Reply: &proto.InternalResolveIntentResponse{},
+		intents = append(intents, keyRange{
+			start: o.Key.Start().(proto.Key),
+			end:   o.Key.End().(proto.Key),
+		})
+	}
+	if len(intents) > 0 {
+		go resolveIntents(txn, intents, sender)
+	}
+	tm.keys.Clear()
+	close(tm.closer)
+}
+
+// A keyRange is a span of keys from start up to but not including end.
+type keyRange struct {
+	start, end proto.Key
+}
+
+// A rangeLookuper looks up the descriptor of the range containing a
+// key. Senders which implement it allow the TxnCoordSender to group
+// the intents of a transaction by range.
+type rangeLookuper interface {
+	lookupRange(key proto.Key) (*proto.RangeDescriptor, error)
+}
+
+// groupIntents groups the supplied intent key ranges by the range
+// containing them. Intents are not merged: a key range spanning the
+// gaps between sparse intents would make the range scan all of the
+// keys between them. Intents on range-local keys, or which straddle a
+// range boundary, are grouped alone. If lookup is nil, each intent is
+// grouped alone.
+func groupIntents(intents []keyRange, lookup rangeLookuper) [][]keyRange {
+	if lookup == nil {
+		groups := make([][]keyRange, len(intents))
+		for i, kr := range intents {
+			groups[i] = []keyRange{kr}
 		}
-		// Set the end key only if it's not equal to Key.Next(). This
-		// saves us from unnecessarily clearing intents as a range.
-		endKey := o.Key.End().(proto.Key)
-		if !call.Args.Header().Key.Next().Equal(endKey) {
-			call.Args.Header().EndKey = endKey
+		return groups
+	}
+	sort.Sort(keyRangeSlice(intents))
+	var groups [][]keyRange
+	// desc is the descriptor of the range wholly containing the
+	// intents of the last group, if any.
+	var desc *proto.RangeDescriptor
+	for _, kr := range intents {
+		if desc != nil && desc.ContainsKeyRange(kr.start, kr.end) {
+			groups[len(groups)-1] = append(groups[len(groups)-1], kr)
+			continue
+		}
+		desc = nil
+		if !bytes.HasPrefix(kr.start, engine.KeyLocalPrefix) {
+			if d, err := lookup.lookupRange(kr.start); err != nil {
+				log.Warningf("failed to look up range for intent %q: %s", kr.start, err)
+			} else if d.ContainsKeyRange(kr.start, kr.end) {
+				desc = d
+			}
 		}
-		// We don't care about the reply channel; these are best
-		// effort. We simply fire and forget, each in its own goroutine.
+		groups = append(groups, []keyRange{kr})
+	}
+	return groups
+}
+
+// keyRangeSlice implements sort.Interface, ordering key ranges by
+// start key.
+type keyRangeSlice []keyRange
+
+func (krs keyRangeSlice) Len() int           { return len(krs) }
+func (krs keyRangeSlice) Swap(i, j int)      { krs[i], krs[j] = krs[j], krs[i] }
+func (krs keyRangeSlice) Less(i, j int) bool { return krs[i].start.Less(krs[j].start) }
+
+// resolveIntents resolves the supplied intents of txn. If sender can
+// look up ranges, intents are first grouped by range and the resolve
+// intent commands of each range are sent together, one after the
+// other. Point intents are resolved with point commands; only intents
+// written by range commands are resolved as a range. Ranges are
+// resolved in parallel, at most intentResolutionConcurrency at a time.
+// Resolution is best effort; failures are logged and otherwise ignored
+// as ranges eventually garbage collect abandoned intents on their own.
+func resolveIntents(txn *proto.Transaction, intents []keyRange, sender client.KVSender) {
+	lookup, _ := sender.(rangeLookuper)
+	sem := make(chan struct{}, intentResolutionConcurrency)
+	for _, group := range groupIntents(intents, lookup) {
+		calls := make([]*client.Call, len(group))
+		for i, kr := range group {
+			calls[i] = &client.Call{
+				Method: proto.InternalResolveIntent,
+				Args: &proto.InternalResolveIntentRequest{
+					RequestHeader: proto.RequestHeader{
+						Timestamp: txn.Timestamp,
+						Key:       kr.start,
+						User:      storage.UserRoot,
+						Txn:       txn,
+					},
+				},
+				Reply: &proto.InternalResolveIntentResponse{},
+			}
+			// Set the end key only if it's not equal to Key.Next(). This
+			// saves us from unnecessarily clearing intents as a range.
+			if !kr.start.Next().Equal(kr.end) {
+				calls[i].Args.Header().EndKey = kr.end
+			}
+		}
+		sem <- struct{}{}
 		go func() {
-			log.V(1).Infof("cleaning up intent %q for txn %s", call.Args.Header().Key, txn)
-			sender.Send(call)
-			if call.Reply.Header().Error != nil {
-				log.Warningf("failed to cleanup %q intent: %s", call.Args.Header().Key, call.Reply.Header().GoError())
+			defer func() { <-sem }()
+			for _, call := range calls {
+				log.V(1).Infof("cleaning up intent %q for txn %s", call.Args.Header().Key, txn)
+				sender.Send(call)
+				if call.Reply.Header().Error != nil {
+					log.Warningf("failed to cleanup %q intent: %s", call.Args.Header().Key, call.Reply.Header().GoError())
+				}
 			}
 		}()
 	}
-	tm.keys.Clear()
-	close(tm.closer)
 }
 
 // A TxnCoordSender is an implementation of client.KVSender which
@@ -184,14 +283,69 @@ func (tc *TxnCoordSender) Send(call *client.Call) {
 	header := call.Args.Header()
 	tc.maybeBeginTxn(header)
 
-	// Process batch specially; otherwise, send via wrapped sender.
+	// Process batch specially, as well as compare-and-set calls which
+	// span ranges; otherwise, send via wrapped sender.
 	if call.Method == proto.Batch {
 		tc.sendBatch(call.Args.(*proto.BatchRequest), call.Reply.(*proto.BatchResponse))
+	} else if call.Method == proto.CompareAndSet && !tc.isSingleRange(header.Key, header.EndKey) {
+		tc.sendCompareAndSet(call.Args.(*proto.CompareAndSetRequest), call.Reply.(*proto.CompareAndSetResponse))
 	} else {
 		tc.sendOne(call)
 	}
 }
 
+// isSingleRange returns true if the keys from start to end are
+// addressed to a single range or if the wrapped sender cannot look
+// up ranges, in which case the range executing a command which does
+// span ranges returns an error.
+func (tc *TxnCoordSender) isSingleRange(start, end proto.Key) bool {
+	lookup, ok := tc.wrapped.(rangeLookuper)
+	if !ok {
+		return true
+	}
+	desc, err := lookup.lookupRange(start)
+	return err != nil || !desc.EndKey.Less(end)
+}
+
+// sendCompareAndSet executes a compare-and-set which spans ranges
+// as a transaction which reads the keys of the conditions and, if
+// all hold, writes the puts.
+func (tc *TxnCoordSender) sendCompareAndSet(args *proto.CompareAndSetRequest, reply *proto.CompareAndSetResponse) {
+	if args.Txn != nil {
+		reply.SetGoError(util.Errorf("compare-and-set within a transaction must address a single range"))
+		return
+	}
+	// Must not call Close() on this KV - that would call tc.Close().
+	tmpKV := client.NewKV(tc, nil)
+	tmpKV.User = args.User
+	tmpKV.UserPriority = args.GetUserPriority()
+	txnOpts := &client.TransactionOptions{
+		Name: "compare-and-set",
+	}
+	err := tmpKV.RunTransaction(txnOpts, func(txn *client.KV) error {
+		for _, cond := range args.Conditions {
+			gReply := &proto.GetResponse{}
+			if err := txn.Call(proto.Get, proto.GetArgs(cond.Key), gReply); err != nil {
+				return err
+			}
+			if err := engine.CheckCondition(cond.ExpValue, gReply.Value); err != nil {
+				return err
+			}
+		}
+		for _, kv := range args.Puts {
+			txn.Prepare(proto.Put, &proto.PutRequest{
+				RequestHeader: proto.RequestHeader{Key: kv.Key},
+				Value:         kv.Value,
+			}, &proto.PutResponse{})
+		}
+		return txn.Flush()
+	})
+	if err == nil {
+		reply.NumWritten = int64(len(args.Puts))
+	}
+	reply.SetGoError(err)
+}
+
 // Close implements the client.KVSender interface by stopping ongoing
 // heartbeats for extant transactions. Close does not attempt to
 // resolve existing write intents for transactions which this
@@ -208,12 +362,24 @@ func (tc *TxnCoordSender) Close() {
 // maybeBeginTxn begins a new transaction if a txn has been specified
 // in the request but has a nil ID. The new transaction is initialized
 // using the name and isolation in the otherwise uninitialized txn.
-// The Priority, if non-zero is used as a minimum.
+// The Priority, if non-zero is used as a minimum. The Timestamp, if
+// non-zero, is a causality token: the new transaction is timestamped
+// after it.
 func (tc *TxnCoordSender) maybeBeginTxn(header *proto.RequestHeader) {
 	if header.Txn != nil {
 		if len(header.Txn.ID) == 0 {
+			token := header.Txn.Timestamp
+			if !token.Equal(proto.ZeroTimestamp) {
+				// Advance the clock past the token so that the timestamps
+				// of subsequent transactions on this node also follow it.
+				if _, err := tc.clock.Update(token); err != nil {
+					log.Warningf("causality token %s is ahead of the local clock: %s", token, err)
+				}
+			}
+			now := tc.clock.Now()
+			now.Forward(token.Add(0, 1))
 			newTxn := proto.NewTransaction(header.Txn.Name, engine.KeyAddress(header.Key), header.GetUserPriority(),
-				header.Txn.Isolation, tc.clock.Now(), tc.clock.MaxOffset().Nanoseconds())
+				header.Txn.Isolation, now, tc.clock.MaxOffset().Nanoseconds())
 			// Use existing priority as a minimum. This is used on transaction
 			// aborts to ratchet priority when creating successor transaction.
 			if newTxn.Priority < header.Txn.Priority {
@@ -256,6 +422,13 @@ func (tc *TxnCoordSender) sendOne(call *client.Call) {
 			// Remember when EndTransaction started in case we want to
 			// be linearizable.
 			startNS = tc.clock.PhysicalNow()
+			// A commit already past its deadline is refused without
+			// being sent; the range checks the final commit timestamp.
+			if args := call.Args.(*proto.EndTransactionRequest); args.Commit &&
+				args.Deadline != nil && args.Deadline.Less(header.Txn.Timestamp) {
+				call.Reply.Header().SetGoError(proto.NewTransactionDeadlineExceededError(header.Txn, *args.Deadline))
+				return
+			}
 		}
 	}
 
@@ -278,10 +451,12 @@ func (tc *TxnCoordSender) sendOne(call *client.Call) {
 		var ok bool
 		var txnMeta *txnMetadata
 		if txnMeta, ok = tc.txns[string(header.Txn.ID)]; !ok {
+			now := tc.clock.Now()
 			txnMeta = &txnMetadata{
 				txn:             *header.Txn,
 				keys:            util.NewIntervalCache(util.CacheConfig{Policy: util.CacheNone}),
-				lastUpdateTS:    tc.clock.Now(),
+				startTS:         now,
+				lastUpdateTS:    now,
 				timeoutDuration: tc.clientTimeout,
 				closer:          make(chan struct{}),
 			}
@@ -303,6 +478,8 @@ func (tc *TxnCoordSender) sendOne(call *client.Call) {
 	case *proto.TransactionAbortedError:
 		// If already aborted, cleanup the txn on this TxnCoordSender.
 		tc.cleanupTxn(&t.Txn)
+	case *proto.ReadWithinUncertaintyIntervalError, *proto.TransactionPushError, *proto.TransactionRetryError:
+		tc.recordRetry(call.Reply.Header().Txn)
 	case *proto.OpRequiresTxnError:
 		// Run a one-off transaction with that single command.
 		log.Infof("%s: auto-wrapping in txn and re-executing", call.Method)
@@ -322,24 +499,31 @@ func (tc *TxnCoordSender) sendOne(call *client.Call) {
 		var txn *proto.Transaction
 		if call.Method == proto.EndTransaction {
 			txn = call.Reply.Header().Txn
-			// If the -linearizable flag is set, we want to make sure that
-			// all the clocks in the system are past the commit timestamp
-			// of the transaction. This is guaranteed if either
+			// If the -linearizable flag is set or the transaction asked
+			// to be linearizable, we want to make sure that all the
+			// clocks in the system are past the commit timestamp of the
+			// transaction. This is guaranteed if either
 			// - the commit timestamp is MaxOffset behind startNS
 			// - MaxOffset ns were spent in this function
 			// when returning to the client. Below we choose the option
 			// that involves less waiting, which is likely the first one
 			// unless a transaction commits with an odd timestamp.
+			// Otherwise, the remaining wait is returned to the client
+			// as the commit wait.
 			if tsNS := txn.Timestamp.WallTime; startNS > tsNS {
 				startNS = tsNS
 			}
 			sleepNS := tc.clock.MaxOffset() -
 				time.Duration(tc.clock.PhysicalNow()-startNS)
-			if *linearizable && sleepNS > 0 {
-				defer func() {
-					log.V(1).Infof("%v: waiting %dms on EndTransaction for linearizability", txn.ID, sleepNS/1000000)
-					time.Sleep(sleepNS)
-				}()
+			if sleepNS > 0 && txn.Status == proto.COMMITTED {
+				if *linearizable || call.Args.(*proto.EndTransactionRequest).Linearizable {
+					defer func() {
+						log.V(1).Infof("%v: waiting %dms on EndTransaction for linearizability", txn.ID, sleepNS/1000000)
+						time.Sleep(sleepNS)
+					}()
+				} else {
+					call.Reply.(*proto.EndTransactionResponse).CommitWait = sleepNS.Nanoseconds()
+				}
 			}
 		}
 		if txn != nil && txn.Status != proto.PENDING {
@@ -371,6 +555,9 @@ func (tc *TxnCoordSender) sendBatch(batchArgs *proto.BatchRequest, batchReply *p
 			args.Header().UserPriority = batchArgs.UserPriority
 		}
 		args.Header().Txn = batchArgs.Txn
+		if batchArgs.ReturnStats {
+			args.Header().ReturnStats = true
+		}
 
 		// Create a reply from the method type and add to batch response.
 		if i >= len(batchReply.Responses) {
@@ -383,10 +570,17 @@ func (tc *TxnCoordSender) sendBatch(batchArgs *proto.BatchRequest, batchReply *p
 			call.Reply = batchReply.Responses[i].GetValue().(proto.Response)
 		}
 		tc.sendOne(call)
-		// Amalgamate transaction updates and propagate first error, if applicable.
+		// Amalgamate transaction updates and statistics and propagate
+		// first error, if applicable.
 		if batchReply.Txn != nil {
 			batchReply.Txn.Update(call.Reply.Header().Txn)
 		}
+		if stats := call.Reply.Header().Stats; stats != nil {
+			if batchReply.Stats == nil {
+				batchReply.Stats = &proto.ResponseStats{}
+			}
+			batchReply.Stats.Add(stats)
+		}
 		if call.Reply.Header().Error != nil {
 			batchReply.Error = call.Reply.Header().Error
 			return
@@ -462,6 +656,127 @@ func (tc *TxnCoordSender) cleanupTxn(txn *proto.Transaction) {
 	delete(tc.txns, string(txn.ID))
 }
 
+// recordRetry counts a restart of txn, which has been updated to its
+// next epoch and priority, if the transaction is tracked.
+func (tc *TxnCoordSender) recordRetry(txn *proto.Transaction) {
+	if txn == nil {
+		return
+	}
+	tc.Lock()
+	defer tc.Unlock()
+	if txnMeta, ok := tc.txns[string(txn.ID)]; ok {
+		txnMeta.retries++
+		// The timestamp is left unchanged, so that an abort of the
+		// transaction by CancelTxn never regresses the timestamp of
+		// its record.
+		txnMeta.txn.Epoch = txn.Epoch
+		txnMeta.txn.Priority = txn.Priority
+	}
+}
+
+// TxnSpan is a key range written by a transaction, from Start up to
+// but not including End.
+type TxnSpan struct {
+	Start proto.Key `json:"start"`
+	End   proto.Key `json:"end"`
+}
+
+// TxnInfo describes an open transaction, as tracked by the
+// TxnCoordSender coordinating it. Transactions are tracked from
+// their first write through the coordinator.
+type TxnInfo struct {
+	ID        string              `json:"id"`
+	Name      string              `json:"name"`
+	Key       proto.Key           `json:"key"`
+	Isolation proto.IsolationType `json:"isolation"`
+	Priority  int32               `json:"priority"`
+	Epoch     int32               `json:"epoch"`
+	Retries   int                 `json:"retries"`
+	AgeNanos  int64               `json:"age_nanos"`  // Since the first write
+	IdleNanos int64               `json:"idle_nanos"` // Since the last request
+	Spans     []TxnSpan           `json:"spans"`      // Key ranges written
+}
+
+// Transactions returns the transactions currently coordinated by the
+// TxnCoordSender, oldest first.
+func (tc *TxnCoordSender) Transactions() []TxnInfo {
+	now := tc.clock.Now()
+	tc.Lock()
+	defer tc.Unlock()
+	infos := []TxnInfo{}
+	for _, txnMeta := range tc.txns {
+		info := TxnInfo{
+			ID:        string(txnMeta.txn.ID),
+			Name:      txnMeta.txn.Name,
+			Key:       txnMeta.txn.Key,
+			Isolation: txnMeta.txn.Isolation,
+			Priority:  txnMeta.txn.Priority,
+			Epoch:     txnMeta.txn.Epoch,
+			Retries:   txnMeta.retries,
+			AgeNanos:  now.WallTime - txnMeta.startTS.WallTime,
+			IdleNanos: now.WallTime - txnMeta.lastUpdateTS.WallTime,
+			Spans:     []TxnSpan{},
+		}
+		for _, o := range txnMeta.keys.GetOverlaps(engine.KeyMin, engine.KeyMax) {
+			info.Spans = append(info.Spans, TxnSpan{
+				Start: o.Key.Start().(proto.Key),
+				End:   o.Key.End().(proto.Key),
+			})
+		}
+		infos = append(infos, info)
+	}
+	sort.Sort(txnInfosByAge(infos))
+	return infos
+}
+
+// txnInfosByAge implements sort.Interface, ordering transactions
+// oldest first.
+type txnInfosByAge []TxnInfo
+
+func (ti txnInfosByAge) Len() int           { return len(ti) }
+func (ti txnInfosByAge) Swap(i, j int)      { ti[i], ti[j] = ti[j], ti[i] }
+func (ti txnInfosByAge) Less(i, j int) bool { return ti[i].AgeNanos > ti[j].AgeNanos }
+
+// CancelTxn aborts the transaction with the specified ID, which must
+// be coordinated by the TxnCoordSender, and resolves its intents. The
+// client subsequently fails to commit the transaction.
+func (tc *TxnCoordSender) CancelTxn(id string) error {
+	tc.Lock()
+	txnMeta, ok := tc.txns[id]
+	var txn *proto.Transaction
+	if ok {
+		txn = gogoproto.Clone(&txnMeta.txn).(*proto.Transaction)
+	}
+	tc.Unlock()
+	if !ok {
+		return util.Errorf("transaction %q not found", id)
+	}
+	call := &client.Call{
+		Method: proto.EndTransaction,
+		Args: &proto.EndTransactionRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:       txn.Key,
+				Timestamp: tc.clock.Now(),
+				User:      storage.UserRoot,
+				Txn:       txn,
+			},
+			Commit: false,
+		},
+		Reply: &proto.EndTransactionResponse{},
+	}
+	tc.wrapped.Send(call)
+	switch err := call.Reply.Header().GoError().(type) {
+	case nil:
+		tc.cleanupTxn(call.Reply.Header().Txn)
+	case *proto.TransactionAbortedError:
+		tc.cleanupTxn(&err.Txn)
+	default:
+		return err
+	}
+	log.Infof("canceled transaction %s", txn)
+	return nil
+}
+
 // hasClientAbandonedCoord returns true if the transaction specified by
 // txnID has not been updated by the client adding a request within
 // the allowed timeout. If abandoned, the transaction is removed from
@@ -460,6 +460,60 @@ func TestTxnCoordSenderCleanupOnAborted(t *testing.T) {
 	verifyCleanup(key, db, eng, t)
 }
 
+// TestTxnCoordSenderTransactions verifies that open transactions are
+// listed with their age and written key ranges, and that canceling a
+// transaction aborts it and cleans up its intents.
+func TestTxnCoordSenderTransactions(t *testing.T) {
+	db, eng, clock, manual, ls, err := createTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coord := getCoord(db)
+	defer db.Close()
+	defer ls.Close()
+
+	key := proto.Key("a")
+	txn := newTxn(db, clock, key)
+	for _, k := range []proto.Key{key, proto.Key("b")} {
+		if err := db.Call(proto.Put, createPutRequest(k, []byte("value"), txn), &proto.PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manual.Set(time.Second.Nanoseconds())
+
+	infos := coord.Transactions()
+	if len(infos) != 1 {
+		t.Fatalf("expected one transaction; got %+v", infos)
+	}
+	if info := infos[0]; info.ID != string(txn.ID) || info.AgeNanos != time.Second.Nanoseconds() ||
+		info.Priority != txn.Priority || len(info.Spans) != 2 || !info.Spans[0].Start.Equal(key) {
+		t.Errorf("unexpected transaction info %+v", info)
+	}
+
+	if err := coord.CancelTxn("unknown"); err == nil {
+		t.Error("expected error canceling unknown transaction")
+	}
+	if err := coord.CancelTxn(string(txn.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if infos := coord.Transactions(); len(infos) != 0 {
+		t.Errorf("expected no transactions after cancel; got %+v", infos)
+	}
+	verifyCleanup(key, db, eng, t)
+
+	etArgs := &proto.EndTransactionRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:       txn.Key,
+			Timestamp: txn.Timestamp,
+			Txn:       txn,
+		},
+		Commit: true,
+	}
+	if err := db.Call(proto.EndTransaction, etArgs, &proto.EndTransactionResponse{}); err == nil {
+		t.Error("expected canceled transaction to fail to commit")
+	}
+}
+
 // TestTxnCoordSenderGC verifies that the coordinator cleans up extant
 // transactions after the lastUpdateTS exceeds the timeout.
 func TestTxnCoordSenderGC(t *testing.T) {
@@ -589,3 +643,217 @@ func TestTxnCoordSenderTxnUpdatedOnError(t *testing.T) {
 		}
 	}
 }
+
+// TestTxnCoordSenderCausalityToken verifies that a transaction begun
+// with a causality token is timestamped after the token, even when
+// the token is ahead of the coordinator's clock.
+func TestTxnCoordSenderCausalityToken(t *testing.T) {
+	manual := hlc.NewManualClock(0)
+	clock := hlc.NewClock(manual.UnixNano)
+	clock.SetMaxOffset(20)
+
+	ts := NewTxnCoordSender(newTestSender(func(call *client.Call) {}), clock)
+	defer ts.Close()
+
+	for i, token := range []proto.Timestamp{makeTS(10, 5), makeTS(100, 0)} {
+		header := &proto.RequestHeader{
+			Key: proto.Key("a"),
+			Txn: &proto.Transaction{Name: "test txn", Timestamp: token},
+		}
+		ts.maybeBeginTxn(header)
+		if !token.Less(header.Txn.Timestamp) {
+			t.Errorf("%d: expected txn timestamp after token %s; got %s", i, token, header.Txn.Timestamp)
+		}
+	}
+}
+
+// TestTxnCoordSenderLinearizableCommit verifies that the commit of a
+// transaction requesting linearizability is acknowledged only after
+// the maximum clock offset has elapsed, and that other transactions
+// are instead told the remaining commit wait.
+func TestTxnCoordSenderLinearizableCommit(t *testing.T) {
+	const maxOffset = 20 * time.Millisecond
+	manual := hlc.NewManualClock(0)
+	clock := hlc.NewClock(manual.UnixNano)
+	clock.SetMaxOffset(maxOffset)
+
+	ts := NewTxnCoordSender(newTestSender(func(call *client.Call) {
+		if call.Method == proto.EndTransaction {
+			txn := gogoproto.Clone(call.Args.Header().Txn).(*proto.Transaction)
+			txn.Status = proto.COMMITTED
+			call.Reply.Header().Txn = txn
+		}
+	}), clock)
+	defer ts.Close()
+
+	for _, linearizable := range []bool{false, true} {
+		reply := &proto.EndTransactionResponse{}
+		start := time.Now()
+		ts.Send(&client.Call{
+			Method: proto.EndTransaction,
+			Args: &proto.EndTransactionRequest{
+				RequestHeader: proto.RequestHeader{
+					Key: proto.Key("a"),
+					Txn: &proto.Transaction{Name: "test txn", ID: []byte("txn")},
+				},
+				Commit:       true,
+				Linearizable: linearizable,
+			},
+			Reply: reply,
+		})
+		if err := reply.GoError(); err != nil {
+			t.Fatal(err)
+		}
+		if linearizable {
+			if elapsed := time.Since(start); elapsed < maxOffset {
+				t.Errorf("expected linearizable commit to wait %s; waited %s", maxOffset, elapsed)
+			}
+			if reply.CommitWait != 0 {
+				t.Errorf("expected no commit wait after waiting; got %d", reply.CommitWait)
+			}
+		} else if reply.CommitWait != maxOffset.Nanoseconds() {
+			t.Errorf("expected commit wait %d; got %d", maxOffset.Nanoseconds(), reply.CommitWait)
+		}
+	}
+}
+
+// testRangeLookuper implements rangeLookuper over a fixed set of
+// range descriptors.
+type testRangeLookuper []proto.RangeDescriptor
+
+func (trl testRangeLookuper) lookupRange(key proto.Key) (*proto.RangeDescriptor, error) {
+	for i := range trl {
+		if trl[i].ContainsKey(key) {
+			return &trl[i], nil
+		}
+	}
+	return nil, proto.NewRangeKeyMismatchError(key, nil, nil)
+}
+
+// TestGroupIntents verifies that intents are grouped by range without
+// being merged and that intents straddling ranges or on range-local
+// keys are grouped alone.
+func TestGroupIntents(t *testing.T) {
+	lookup := testRangeLookuper{
+		{StartKey: engine.KeyMin, EndKey: proto.Key("m")},
+		{StartKey: proto.Key("m"), EndKey: engine.KeyMax},
+	}
+	kr := func(start, end string) keyRange {
+		return keyRange{start: proto.Key(start), end: proto.Key(end)}
+	}
+	localKey := engine.RangeDescriptorKey(proto.Key("a"))
+	intents := []keyRange{
+		kr("q", "q\x00"),
+		kr("a", "a\x00"),
+		kr("c", "f"),
+		kr("b", "b\x00"),
+		kr("l", "n"),
+		kr("n", "n\x00"),
+		kr("x", "z"),
+		{start: localKey, end: localKey.Next()},
+	}
+	expected := [][]keyRange{
+		{{start: localKey, end: localKey.Next()}},
+		{kr("a", "a\x00"), kr("b", "b\x00"), kr("c", "f")},
+		{kr("l", "n")},
+		{kr("n", "n\x00"), kr("q", "q\x00"), kr("x", "z")},
+	}
+	if groups := groupIntents(intents, lookup); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected intent groups %v; got %v", expected, groups)
+	}
+	if groups := groupIntents(intents[:2], nil); len(groups) != 2 {
+		t.Errorf("expected intents to be grouped alone without range lookups; got %v", groups)
+	}
+}
+
+// TestTxnCoordSenderEndTxnGroupsIntents verifies that committing a
+// transaction which wrote many keys within a range groups its intents
+// by that range and resolves each of them.
+func TestTxnCoordSenderEndTxnGroupsIntents(t *testing.T) {
+	db, eng, clock, _, ls, err := createTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer ls.Close()
+
+	txn := newTxn(db, clock, proto.Key("a"))
+	keys := []proto.Key{proto.Key("a"), proto.Key("c"), proto.Key("e")}
+	for _, key := range keys {
+		if err := db.Call(proto.Put, createPutRequest(key, []byte("value"), txn), &proto.PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	coord := getCoord(db)
+	coord.Lock()
+	intents := coord.txns[string(txn.ID)].keys.GetOverlaps(engine.KeyMin, engine.KeyMax)
+	coord.Unlock()
+	var krs []keyRange
+	for _, o := range intents {
+		krs = append(krs, keyRange{start: o.Key.Start().(proto.Key), end: o.Key.End().(proto.Key)})
+	}
+	if groups := groupIntents(krs, ls); len(groups) != 1 || len(groups[0]) != len(keys) {
+		t.Errorf("expected %d intents in a single group; got %v", len(keys), groups)
+	}
+
+	etArgs := &proto.EndTransactionRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:       txn.Key,
+			Timestamp: txn.Timestamp,
+			Txn:       txn,
+		},
+		Commit: true,
+	}
+	if err := db.Call(proto.EndTransaction, etArgs, &proto.EndTransactionResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		verifyCleanup(key, db, eng, t)
+	}
+}
+
+// TestTxnCoordSenderCompareAndSetAcrossRanges verifies that a
+// compare-and-set whose keys span ranges is executed as a
+// transaction.
+func TestTxnCoordSenderCompareAndSetAcrossRanges(t *testing.T) {
+	db, _, _, _, lSender, err := createTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	splitKey := proto.Key("b")
+	if err := db.Call(proto.AdminSplit, &proto.AdminSplitRequest{
+		RequestHeader: proto.RequestHeader{Key: splitKey},
+		SplitKey:      splitKey,
+	}, &proto.AdminSplitResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if desc, err := lSender.lookupRange(proto.Key("a")); err != nil || !desc.EndKey.Equal(splitKey) {
+		t.Fatalf("expected range ending at %q; got %+v, %v", splitKey, desc, err)
+	}
+
+	puts := []proto.KeyValue{
+		{Key: proto.Key("a"), Value: proto.Value{Bytes: []byte("1")}},
+		{Key: proto.Key("c"), Value: proto.Value{Bytes: []byte("1")}},
+	}
+	conds := []proto.CompareAndSetCondition{{Key: proto.Key("a")}, {Key: proto.Key("c")}}
+	if err := db.CompareAndSet(conds, puts); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range puts {
+		gr := &proto.GetResponse{}
+		if err := db.Call(proto.Get, proto.GetArgs(kv.Key), gr); err != nil {
+			t.Fatal(err)
+		}
+		if gr.Value == nil || !bytes.Equal(gr.Value.Bytes, []byte("1")) {
+			t.Errorf("expected value 1 at %q; got %+v", kv.Key, gr.Value)
+		}
+	}
+
+	// The keys now exist, so the conditions fail.
+	err = db.CompareAndSet(conds, puts)
+	if _, ok := err.(*proto.ConditionFailedError); !ok {
+		t.Errorf("expected condition failed error; got %v", err)
+	}
+}
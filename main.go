@@ -58,9 +58,20 @@ func main() {
 	c := commander.Commander{
 		Name: "cockroach",
 		Commands: []*commander.Command{
+			server.CmdBackupMeta,
+			server.CmdCheckpoint,
+			server.CmdDebug,
+			server.CmdImportStore,
 			server.CmdInit,
+			server.CmdKeyUsage,
+			server.CmdLoad,
+			server.CmdEffectiveZone,
 			server.CmdGetZone,
 			server.CmdLsZones,
+			server.CmdMigrateStores,
+			server.CmdRecoverMeta,
+			server.CmdRestoreTable,
+			server.CmdRewriteStores,
 			server.CmdRmZone,
 			server.CmdSetZone,
 			server.CmdStart,
@@ -75,7 +86,13 @@ to precede any additional arguments,
 
   cockroach <command> [options] [arguments].`,
 				Run: func(cmd *commander.Command, args []string) {
-					flag.CommandLine.PrintDefaults()
+					visible := flag.NewFlagSet("", flag.ContinueOnError)
+					flag.CommandLine.VisitAll(func(f *flag.Flag) {
+						if _, ok := server.HiddenFlags[f.Name]; !ok {
+							visible.Var(f.Value, f.Name, f.Usage)
+						}
+					})
+					visible.PrintDefaults()
 				},
 			},
 		},
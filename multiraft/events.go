@@ -58,3 +58,15 @@ func decodeCommand(data []byte) (commandID string, command []byte) {
 	}
 	return string(data[1 : 1+commandIDLen]), data[1+commandIDLen:]
 }
+
+// DecodeCommand returns the ID and payload of the command encoded in
+// data, the data of a log entry submitted by SubmitCommand or
+// ChangeGroupMembership. Returns false if data isn't an encoded
+// command, such as the empty entry appended by a new leader.
+func DecodeCommand(data []byte) (commandID string, command []byte, ok bool) {
+	if len(data) < 1+commandIDLen || data[0] != commandEncodingVersion {
+		return "", nil, false
+	}
+	commandID, command = decodeCommand(data)
+	return commandID, command, true
+}
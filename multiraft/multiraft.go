@@ -22,6 +22,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
@@ -44,6 +45,12 @@ type Config struct {
 	HeartbeatIntervalTicks int
 	TickInterval           time.Duration
 
+	// GroupRecvQueueSize is the maximum number of inbound messages
+	// buffered per group; further messages for the group are dropped
+	// until the buffered ones are processed. Defaults to
+	// defaultGroupRecvQueueSize if zero.
+	GroupRecvQueueSize int
+
 	// If Strict is true, some warnings become fatal panics and additional (possibly expensive)
 	// sanity checks will be done.
 	Strict bool
@@ -77,6 +84,9 @@ type MultiRaft struct {
 	createGroupChan chan *createGroupOp
 	removeGroupChan chan *removeGroupOp
 	proposalChan    chan proposal
+	recvQueue       *recvQueue
+	sendDropped     *metrics.Counter
+	recvDropped     *metrics.Counter
 	stopper         *util.Stopper
 }
 
@@ -97,6 +107,9 @@ func NewMultiRaft(nodeID uint64, config *Config) (*MultiRaft, error) {
 	if config.Ticker == nil {
 		config.Ticker = newTicker(config.TickInterval)
 	}
+	if config.GroupRecvQueueSize == 0 {
+		config.GroupRecvQueueSize = defaultGroupRecvQueueSize
+	}
 
 	m := &MultiRaft{
 		Config: *config,
@@ -107,6 +120,9 @@ func NewMultiRaft(nodeID uint64, config *Config) (*MultiRaft, error) {
 		createGroupChan: make(chan *createGroupOp, 100),
 		removeGroupChan: make(chan *removeGroupOp, 100),
 		proposalChan:    make(chan proposal, 100),
+		recvQueue:       newRecvQueue(config.GroupRecvQueueSize),
+		sendDropped:     metrics.NewCounter(),
+		recvDropped:     metrics.NewCounter(),
 		stopper:         util.NewStopper(1),
 	}
 
@@ -121,7 +137,7 @@ func NewMultiRaft(nodeID uint64, config *Config) (*MultiRaft, error) {
 // Start runs the raft algorithm in a background goroutine.
 func (m *MultiRaft) Start() error {
 	s := newState(m)
-	go s.start()
+	go util.RunLabeled("raft", s.start)
 
 	return nil
 }
@@ -133,14 +149,44 @@ func (m *MultiRaft) Stop() {
 	m.multiNode.Stop()
 }
 
+// RecvQueueStats returns the counts of queued and dropped raft messages.
+func (m *MultiRaft) RecvQueueStats() RecvQueueStats {
+	stats := m.recvQueue.stats()
+	stats.SendDropped = m.sendDropped.Count()
+	return stats
+}
+
+// RegisterMetrics registers the counts of raft messages dropped by
+// this MultiRaft with reg, as "send.dropped" and "recv.dropped" under
+// prefix.
+func (m *MultiRaft) RegisterMetrics(reg *metrics.Registry, prefix string) {
+	reg.Register(prefix+"send.dropped", m.sendDropped)
+	reg.Register(prefix+"recv.dropped", m.recvDropped)
+}
+
 // RaftMessage implements ServerInterface; this method is called by net/rpc
-// when we receive a message.
+// when we receive a message. The message is queued for processing;
+// errRecvQueueFull is returned if the message's group has too many
+// queued messages.
 func (ms *multiraftServer) RaftMessage(req *RaftMessageRequest,
 	resp *RaftMessageResponse) error {
 	m := (*MultiRaft)(ms)
 	log.V(5).Infof("node %v: group %v got message %s", m.nodeID, req.GroupID,
 		raft.DescribeMessage(req.Message))
-	return m.multiNode.Step(context.Background(), req.GroupID, req.Message)
+	if !m.recvQueue.push(req.GroupID, req.Message) {
+		m.recvDropped.Inc(1)
+		raftRecvDropped.Inc(1)
+		log.V(4).Infof("node %v: group %v dropped message %s", m.nodeID, req.GroupID,
+			raft.DescribeMessage(req.Message))
+		return errRecvQueueFull
+	}
+	return nil
+}
+
+// step steps a message received for groupID into the raft state
+// machine.
+func (m *MultiRaft) step(groupID uint64, msg raftpb.Message) error {
+	return m.multiNode.Step(context.Background(), groupID, msg)
 }
 
 // strictErrorLog panics in strict mode and logs an error otherwise. Arguments are printf-style
@@ -289,7 +335,8 @@ func newState(m *MultiRaft) *state {
 
 func (s *state) start() {
 	log.V(1).Infof("node %v starting", s.nodeID)
-	go s.writeTask.start()
+	go util.RunLabeled("raft", s.writeTask.start)
+	go util.RunLabeled("raft", func() { s.recvQueue.start(s.step) })
 	// These maps form a kind of state machine: We don't want to read from the
 	// ready channel until the groups we got from the last read have made their
 	// way through the rest of the pipeline.
@@ -365,6 +412,7 @@ func (s *state) stop() {
 		}
 	}
 	s.writeTask.stop()
+	s.recvQueue.stop()
 	s.stopper.SetStopped()
 }
 
@@ -378,7 +426,7 @@ func (s *state) addNode(nodeID uint64) error {
 	if err != nil {
 		return err
 	}
-	s.nodes[nodeID] = &node{nodeID, 1, &asyncClient{nodeID, conn}}
+	s.nodes[nodeID] = &node{nodeID, 1, newAsyncClient(nodeID, conn, s.sendDropped)}
 	return nil
 }
 
@@ -408,6 +456,7 @@ func (s *state) createGroup(op *createGroupOp) {
 
 func (s *state) removeGroup(op *removeGroupOp) {
 	s.multiNode.RemoveGroup(op.groupID)
+	s.recvQueue.removeGroup(op.groupID)
 	delete(s.groups, op.groupID)
 	op.ch <- nil
 }
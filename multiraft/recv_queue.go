@@ -0,0 +1,193 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// defaultGroupRecvQueueSize is the number of inbound messages buffered
+// per group if Config.GroupRecvQueueSize is not set.
+const defaultGroupRecvQueueSize = 64
+
+// errRecvQueueFull is returned to the sender of a message dropped
+// because its group's receive queue was full.
+var errRecvQueueFull = util.Error("raft receive queue full")
+
+// RecvQueueStats describes the inbound raft messages of a node.
+type RecvQueueStats struct {
+	// Queued is the number of messages awaiting processing.
+	Queued int
+	// Dropped is the number of messages dropped because their group's
+	// receive queue was full.
+	Dropped int64
+	// GroupDropped maps the IDs of groups which dropped messages to the
+	// number of messages they dropped.
+	GroupDropped map[uint64]int64
+	// SendDropped is the number of outbound messages dropped because
+	// too many messages to their destination node were outstanding.
+	SendDropped int64
+}
+
+// groupRecvQueue holds the queued messages of a group.
+type groupRecvQueue struct {
+	msgs    []raftpb.Message
+	dropped int64
+	pending bool // true if the group is in recvQueue.pending
+}
+
+// recvQueue buffers inbound raft messages in a bounded queue per
+// group. Messages are stepped into the raft state machine by a single
+// goroutine which takes one message from each group with queued
+// messages in turn, so that a group flooding the node with messages,
+// such as one in a tight election loop, can neither exhaust memory nor
+// starve the other groups. Messages arriving at a group's full queue
+// are dropped; raft tolerates lost messages.
+type recvQueue struct {
+	maxSize int
+	stopper *util.Stopper
+	signal  chan struct{}
+
+	mu      sync.Mutex
+	groups  map[uint64]*groupRecvQueue
+	pending []uint64 // IDs of groups with queued messages, in turn order
+	queued  int
+	dropped int64
+}
+
+// newRecvQueue creates a recvQueue buffering up to maxSize messages
+// per group. The caller should start the queue after creating it.
+func newRecvQueue(maxSize int) *recvQueue {
+	return &recvQueue{
+		maxSize: maxSize,
+		stopper: util.NewStopper(1),
+		signal:  make(chan struct{}, 1),
+		groups:  map[uint64]*groupRecvQueue{},
+	}
+}
+
+// push queues msg for groupID. Returns false if the message was
+// dropped because the group's queue is full.
+func (q *recvQueue) push(groupID uint64, msg raftpb.Message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	g, ok := q.groups[groupID]
+	if !ok {
+		g = &groupRecvQueue{}
+		q.groups[groupID] = g
+	}
+	if len(g.msgs) >= q.maxSize {
+		g.dropped++
+		q.dropped++
+		return false
+	}
+	g.msgs = append(g.msgs, msg)
+	q.queued++
+	if !g.pending {
+		g.pending = true
+		q.pending = append(q.pending, groupID)
+	}
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop removes and returns the next message of the group whose turn
+// it is. Returns false if no messages are queued.
+func (q *recvQueue) pop() (uint64, raftpb.Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) > 0 {
+		groupID := q.pending[0]
+		q.pending = q.pending[1:]
+		g, ok := q.groups[groupID]
+		if !ok || len(g.msgs) == 0 {
+			continue
+		}
+		msg := g.msgs[0]
+		g.msgs = g.msgs[1:]
+		q.queued--
+		if len(g.msgs) > 0 {
+			q.pending = append(q.pending, groupID)
+		} else {
+			g.pending = false
+			// Release the drained slice's backing array.
+			g.msgs = nil
+		}
+		return groupID, msg, true
+	}
+	return 0, raftpb.Message{}, false
+}
+
+// removeGroup discards the queue of groupID, including its messages.
+func (q *recvQueue) removeGroup(groupID uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if g, ok := q.groups[groupID]; ok {
+		q.queued -= len(g.msgs)
+		delete(q.groups, groupID)
+	}
+}
+
+// stats returns the queue's message counts.
+func (q *recvQueue) stats() RecvQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := RecvQueueStats{
+		Queued:       q.queued,
+		Dropped:      q.dropped,
+		GroupDropped: map[uint64]int64{},
+	}
+	for groupID, g := range q.groups {
+		if g.dropped > 0 {
+			stats.GroupDropped[groupID] = g.dropped
+		}
+	}
+	return stats
+}
+
+// start steps queued messages into the raft state machine using step.
+// Blocks until stopped, so should be run in a goroutine.
+func (q *recvQueue) start(step func(groupID uint64, msg raftpb.Message) error) {
+	for {
+		select {
+		case <-q.stopper.ShouldStop():
+			q.stopper.SetStopped()
+			return
+		case <-q.signal:
+		}
+		for {
+			groupID, msg, ok := q.pop()
+			if !ok {
+				break
+			}
+			if err := step(groupID, msg); err != nil {
+				log.Warningf("group %v failed to step message: %s", groupID, err)
+			}
+		}
+	}
+}
+
+// stop the running queue.
+func (q *recvQueue) stop() {
+	q.stopper.Stop()
+}
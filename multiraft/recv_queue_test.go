@@ -0,0 +1,82 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// TestRecvQueueRoundRobin verifies that queued messages are popped one
+// group at a time in turn and in order within each group.
+func TestRecvQueueRoundRobin(t *testing.T) {
+	q := newRecvQueue(10)
+	for i := uint64(1); i <= 3; i++ {
+		q.push(1, raftpb.Message{Index: i})
+	}
+	q.push(2, raftpb.Message{Index: 1})
+	q.push(3, raftpb.Message{Index: 1})
+	q.push(3, raftpb.Message{Index: 2})
+
+	type popped struct{ groupID, index uint64 }
+	expected := []popped{{1, 1}, {2, 1}, {3, 1}, {1, 2}, {3, 2}, {1, 3}}
+	var actual []popped
+	for {
+		groupID, msg, ok := q.pop()
+		if !ok {
+			break
+		}
+		actual = append(actual, popped{groupID, msg.Index})
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected messages %v; got %v", expected, actual)
+	}
+	if stats := q.stats(); stats.Queued != 0 {
+		t.Errorf("expected empty queue; got %+v", stats)
+	}
+}
+
+// TestRecvQueueDrops verifies that messages for a group with a full
+// queue are dropped and counted without affecting other groups, and
+// that removing a group discards its messages.
+func TestRecvQueueDrops(t *testing.T) {
+	q := newRecvQueue(2)
+	for i := 0; i < 5; i++ {
+		if ok := q.push(1, raftpb.Message{}); ok != (i < 2) {
+			t.Errorf("%d: expected push to return %t", i, i < 2)
+		}
+	}
+	if !q.push(2, raftpb.Message{}) {
+		t.Errorf("expected push to other group to succeed")
+	}
+	stats := q.stats()
+	if stats.Queued != 3 || stats.Dropped != 3 || !reflect.DeepEqual(stats.GroupDropped, map[uint64]int64{1: 3}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	q.removeGroup(1)
+	if groupID, _, ok := q.pop(); !ok || groupID != 2 {
+		t.Errorf("expected message of group 2; got %d, %t", groupID, ok)
+	}
+	if _, _, ok := q.pop(); ok {
+		t.Errorf("expected no more messages")
+	}
+	if stats := q.stats(); stats.Queued != 0 {
+		t.Errorf("expected empty queue; got %+v", stats)
+	}
+}
@@ -23,7 +23,9 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/cockroachdb/cockroach/util/fault"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 	"github.com/coreos/etcd/raft/raftpb"
 )
 
@@ -73,15 +75,68 @@ type ClientInterface interface {
 	Close() error
 }
 
+// maxOutstandingRaftMessages is the maximum number of messages sent to
+// a node which may await completion. Further messages to the node are
+// dropped, so that a slow or overloaded node exerts backpressure on
+// its senders instead of accumulating their messages.
+const maxOutstandingRaftMessages = 256
+
+var (
+	// raftSendDropped counts the outbound raft messages dropped by all
+	// of the node's MultiRafts.
+	raftSendDropped = metrics.DefaultRegistry.Counter("raft.send.dropped")
+	// raftRecvDropped counts the inbound raft messages dropped because
+	// their group's receive queue was full.
+	raftRecvDropped = metrics.DefaultRegistry.Counter("raft.recv.dropped")
+)
+
 // asyncClient bridges MultiRaft's channel-oriented interface with the synchronous RPC interface.
 // Outgoing requests are run in a non-blocking fire-and-forget fashion.
 type asyncClient struct {
 	nodeID uint64
 	conn   ClientInterface
+	// done receives completed calls; outstanding counts the calls not
+	// yet received from it. Both are accessed only from the goroutine
+	// sending messages.
+	done        chan *rpc.Call
+	outstanding int
+	dropped     *metrics.Counter // counts messages dropped
+}
+
+// newAsyncClient creates an asyncClient sending messages to nodeID
+// over conn and counting messages it drops in dropped.
+func newAsyncClient(nodeID uint64, conn ClientInterface, dropped *metrics.Counter) *asyncClient {
+	return &asyncClient{
+		nodeID:  nodeID,
+		conn:    conn,
+		done:    make(chan *rpc.Call, maxOutstandingRaftMessages),
+		dropped: dropped,
+	}
 }
 
 func (a *asyncClient) raftMessage(req *RaftMessageRequest) {
-	a.conn.Go(raftMessageName, req, &RaftMessageResponse{}, nil)
+	// Raft tolerates lost messages, so injected faults simply drop them.
+	if fault.MaybeDrop(fault.RaftMessage) {
+		return
+	}
+	// Reap completed calls.
+reap:
+	for {
+		select {
+		case <-a.done:
+			a.outstanding--
+		default:
+			break reap
+		}
+	}
+	if a.outstanding >= maxOutstandingRaftMessages {
+		a.dropped.Inc(1)
+		raftSendDropped.Inc(1)
+		log.V(4).Infof("dropping message to node %v: too many outstanding messages", a.nodeID)
+		return
+	}
+	a.outstanding++
+	a.conn.Go(raftMessageName, req, &RaftMessageResponse{}, a.done)
 }
 
 type localRPCTransport struct {
@@ -37,6 +37,10 @@ const (
 	// matches the value specified in the request. Specifying a null value
 	// for existing means the value must not yet exist.
 	ConditionalPut = "ConditionalPut"
+	// CompareAndSet sets the values of a set of keys if the existing
+	// values of another set of keys match the values specified in the
+	// request.
+	CompareAndSet = "CompareAndSet"
 	// Increment increments the value at the specified key. Once called
 	// for a key, Put & Get will return errors; only Increment will
 	// continue to be a valid command. The value must be deleted before
@@ -68,6 +72,10 @@ const (
 	Batch = "Batch"
 	// AdminSplit is called to coordinate a split of a range.
 	AdminSplit = "AdminSplit"
+	// AdminFreeze stops a range from applying read-write commands.
+	AdminFreeze = "AdminFreeze"
+	// AdminUnfreeze resumes read-write commands on a frozen range.
+	AdminUnfreeze = "AdminUnfreeze"
 )
 
 type stringSet map[string]struct{}
@@ -89,6 +97,7 @@ var AllMethods = stringSet{
 	Get:                   struct{}{},
 	Put:                   struct{}{},
 	ConditionalPut:        struct{}{},
+	CompareAndSet:         struct{}{},
 	Increment:             struct{}{},
 	Delete:                struct{}{},
 	DeleteRange:           struct{}{},
@@ -98,11 +107,16 @@ var AllMethods = stringSet{
 	EnqueueUpdate:         struct{}{},
 	EnqueueMessage:        struct{}{},
 	AdminSplit:            struct{}{},
+	AdminFreeze:           struct{}{},
+	AdminUnfreeze:         struct{}{},
 	Batch:                 struct{}{},
 	InternalHeartbeatTxn:  struct{}{},
 	InternalPushTxn:       struct{}{},
 	InternalResolveIntent: struct{}{},
+	InternalQueryIntent:   struct{}{},
 	InternalMerge:         struct{}{},
+	InternalScanChanges:   struct{}{},
+	InternalSetFrozen:     struct{}{},
 }
 
 // PublicMethods specifies the set of methods accessible via the
@@ -112,6 +126,7 @@ var PublicMethods = stringSet{
 	Get:            struct{}{},
 	Put:            struct{}{},
 	ConditionalPut: struct{}{},
+	CompareAndSet:  struct{}{},
 	Increment:      struct{}{},
 	Delete:         struct{}{},
 	DeleteRange:    struct{}{},
@@ -122,6 +137,8 @@ var PublicMethods = stringSet{
 	EnqueueMessage: struct{}{},
 	Batch:          struct{}{},
 	AdminSplit:     struct{}{},
+	AdminFreeze:    struct{}{},
+	AdminUnfreeze:  struct{}{},
 }
 
 // InternalMethods specifies the set of methods accessible only
@@ -130,7 +147,9 @@ var InternalMethods = stringSet{
 	InternalHeartbeatTxn:  struct{}{},
 	InternalPushTxn:       struct{}{},
 	InternalResolveIntent: struct{}{},
+	InternalQueryIntent:   struct{}{},
 	InternalMerge:         struct{}{},
+	InternalScanChanges:   struct{}{},
 }
 
 // ReadMethods specifies the set of methods which read and return data.
@@ -138,16 +157,20 @@ var ReadMethods = stringSet{
 	Contains:            struct{}{},
 	Get:                 struct{}{},
 	ConditionalPut:      struct{}{},
+	CompareAndSet:       struct{}{},
 	Increment:           struct{}{},
 	Scan:                struct{}{},
 	ReapQueue:           struct{}{},
 	InternalRangeLookup: struct{}{},
+	InternalQueryIntent: struct{}{},
+	InternalScanChanges: struct{}{},
 }
 
 // WriteMethods specifies the set of methods which write data.
 var WriteMethods = stringSet{
 	Put:                   struct{}{},
 	ConditionalPut:        struct{}{},
+	CompareAndSet:         struct{}{},
 	Increment:             struct{}{},
 	Delete:                struct{}{},
 	DeleteRange:           struct{}{},
@@ -160,6 +183,7 @@ var WriteMethods = stringSet{
 	InternalPushTxn:       struct{}{},
 	InternalResolveIntent: struct{}{},
 	InternalMerge:         struct{}{},
+	InternalSetFrozen:     struct{}{},
 }
 
 // TxnMethods specifies the set of methods which leave key intents
@@ -167,6 +191,7 @@ var WriteMethods = stringSet{
 var TxnMethods = stringSet{
 	Put:            struct{}{},
 	ConditionalPut: struct{}{},
+	CompareAndSet:  struct{}{},
 	Increment:      struct{}{},
 	Delete:         struct{}{},
 	DeleteRange:    struct{}{},
@@ -179,7 +204,9 @@ var TxnMethods = stringSet{
 // read-only nor read-write commands but instead execute directly on
 // the Raft leader.
 var adminMethods = stringSet{
-	AdminSplit: struct{}{},
+	AdminSplit:    struct{}{},
+	AdminFreeze:   struct{}{},
+	AdminUnfreeze: struct{}{},
 }
 
 // NeedReadPerm returns true if the specified method requires read permissions.
@@ -306,6 +333,33 @@ func ScanArgs(key, endKey Key, maxResults int64) *ScanRequest {
 	}
 }
 
+// CompareAndSetArgs returns a CompareAndSetRequest object
+// initialized to put the specified key/value pairs if all conditions
+// hold. The request's key and end key span all keys of conditions
+// and puts.
+func CompareAndSetArgs(conditions []CompareAndSetCondition, puts []KeyValue) *CompareAndSetRequest {
+	args := &CompareAndSetRequest{
+		Conditions: conditions,
+		Puts:       puts,
+	}
+	addKey := func(key Key) {
+		if args.Key == nil || key.Less(args.Key) {
+			args.Key = key
+		}
+		if end := key.Next(); args.EndKey == nil || args.EndKey.Less(end) {
+			args.EndKey = end
+		}
+	}
+	for _, cond := range conditions {
+		addKey(cond.Key)
+	}
+	for i := range puts {
+		puts[i].Value.InitChecksum(puts[i].Key)
+		addKey(puts[i].Key)
+	}
+	return args
+}
+
 // MethodForRequest returns the method name corresponding to the type
 // of the request.
 func MethodForRequest(req Request) (string, error) {
@@ -318,6 +372,8 @@ func MethodForRequest(req Request) (string, error) {
 		return Put, nil
 	case *ConditionalPutRequest:
 		return ConditionalPut, nil
+	case *CompareAndSetRequest:
+		return CompareAndSet, nil
 	case *IncrementRequest:
 		return Increment, nil
 	case *DeleteRequest:
@@ -338,14 +394,24 @@ func MethodForRequest(req Request) (string, error) {
 		return Batch, nil
 	case *AdminSplitRequest:
 		return AdminSplit, nil
+	case *AdminFreezeRequest:
+		return AdminFreeze, nil
+	case *AdminUnfreezeRequest:
+		return AdminUnfreeze, nil
 	case *InternalHeartbeatTxnRequest:
 		return InternalHeartbeatTxn, nil
 	case *InternalPushTxnRequest:
 		return InternalPushTxn, nil
 	case *InternalResolveIntentRequest:
 		return InternalResolveIntent, nil
+	case *InternalQueryIntentRequest:
+		return InternalQueryIntent, nil
 	case *InternalMergeRequest:
 		return InternalMerge, nil
+	case *InternalScanChangesRequest:
+		return InternalScanChanges, nil
+	case *InternalSetFrozenRequest:
+		return InternalSetFrozen, nil
 	}
 	return "", util.Errorf("unhandled request %T", req)
 }
@@ -371,6 +437,8 @@ func CreateArgs(method string) (Request, error) {
 		return &PutRequest{}, nil
 	case ConditionalPut:
 		return &ConditionalPutRequest{}, nil
+	case CompareAndSet:
+		return &CompareAndSetRequest{}, nil
 	case Increment:
 		return &IncrementRequest{}, nil
 	case Delete:
@@ -391,14 +459,24 @@ func CreateArgs(method string) (Request, error) {
 		return &BatchRequest{}, nil
 	case AdminSplit:
 		return &AdminSplitRequest{}, nil
+	case AdminFreeze:
+		return &AdminFreezeRequest{}, nil
+	case AdminUnfreeze:
+		return &AdminUnfreezeRequest{}, nil
 	case InternalHeartbeatTxn:
 		return &InternalHeartbeatTxnRequest{}, nil
 	case InternalPushTxn:
 		return &InternalPushTxnRequest{}, nil
 	case InternalResolveIntent:
 		return &InternalResolveIntentRequest{}, nil
+	case InternalQueryIntent:
+		return &InternalQueryIntentRequest{}, nil
 	case InternalMerge:
 		return &InternalMergeRequest{}, nil
+	case InternalScanChanges:
+		return &InternalScanChangesRequest{}, nil
+	case InternalSetFrozen:
+		return &InternalSetFrozenRequest{}, nil
 	}
 	return nil, util.Errorf("unhandled method %s", method)
 }
@@ -414,6 +492,8 @@ func CreateReply(method string) (Response, error) {
 		return &PutResponse{}, nil
 	case ConditionalPut:
 		return &ConditionalPutResponse{}, nil
+	case CompareAndSet:
+		return &CompareAndSetResponse{}, nil
 	case Increment:
 		return &IncrementResponse{}, nil
 	case Delete:
@@ -434,14 +514,24 @@ func CreateReply(method string) (Response, error) {
 		return &BatchResponse{}, nil
 	case AdminSplit:
 		return &AdminSplitResponse{}, nil
+	case AdminFreeze:
+		return &AdminFreezeResponse{}, nil
+	case AdminUnfreeze:
+		return &AdminUnfreezeResponse{}, nil
 	case InternalHeartbeatTxn:
 		return &InternalHeartbeatTxnResponse{}, nil
 	case InternalPushTxn:
 		return &InternalPushTxnResponse{}, nil
 	case InternalResolveIntent:
 		return &InternalResolveIntentResponse{}, nil
+	case InternalQueryIntent:
+		return &InternalQueryIntentResponse{}, nil
 	case InternalMerge:
 		return &InternalMergeResponse{}, nil
+	case InternalScanChanges:
+		return &InternalScanChangesResponse{}, nil
+	case InternalSetFrozen:
+		return &InternalSetFrozenResponse{}, nil
 	}
 	return nil, util.Errorf("unhandled method %s", method)
 }
@@ -487,6 +577,12 @@ func (rh *ResponseHeader) Combine(otherRH *ResponseHeader) {
 		if rh.Txn != nil && otherRH.GetTxn() == nil {
 			rh.Txn = nil
 		}
+		if otherStats := otherRH.GetStats(); otherStats != nil {
+			if rh.Stats == nil {
+				rh.Stats = &ResponseStats{}
+			}
+			rh.Stats.Add(otherStats)
+		}
 	}
 }
 
@@ -494,7 +590,14 @@ func (rh *ResponseHeader) Combine(otherRH *ResponseHeader) {
 func (sr *ScanResponse) Combine(c Response) {
 	otherSR := c.(*ScanResponse)
 	if sr != nil {
+		// The first row of a compressed response shares no prefix, so
+		// compressed responses concatenate; mixed ones are decompressed.
+		if len(sr.Rows) > 0 && len(otherSR.Rows) > 0 && sr.KeysCompressed() != otherSR.KeysCompressed() {
+			sr.DecompressKeys()
+			otherSR.DecompressKeys()
+		}
 		sr.Rows = append(sr.Rows, otherSR.GetRows()...)
+		sr.SharedPrefixLens = append(sr.SharedPrefixLens, otherSR.GetSharedPrefixLens()...)
 		sr.Header().Combine(otherSR.Header())
 	}
 }
@@ -504,6 +607,7 @@ func (dr *DeleteRangeResponse) Combine(c Response) {
 	otherDR := c.(*DeleteRangeResponse)
 	if dr != nil {
 		dr.NumDeleted += otherDR.GetNumDeleted()
+		dr.DeletedKeys = append(dr.DeletedKeys, otherDR.GetDeletedKeys()...)
 		dr.Header().Combine(otherDR.Header())
 	}
 }
@@ -517,6 +621,25 @@ func (rr *InternalResolveIntentResponse) Combine(c Response) {
 	}
 }
 
+// Combine implements the Combinable interface for
+// InternalScanChangesResponse.
+func (sr *InternalScanChangesResponse) Combine(c Response) {
+	otherSR := c.(*InternalScanChangesResponse)
+	if sr != nil {
+		sr.Changes = append(sr.Changes, otherSR.GetChanges()...)
+		sr.Header().Combine(otherSR.Header())
+	}
+}
+
+// Add adds the statistics in other to rs.
+func (rs *ResponseStats) Add(other *ResponseStats) {
+	rs.KeysScanned += other.KeysScanned
+	rs.BytesRead += other.BytesRead
+	rs.IntentsEncountered += other.IntentsEncountered
+	rs.EngineNanos += other.EngineNanos
+	rs.RaftNanos += other.RaftNanos
+}
+
 // Header implements the Request interface for RequestHeader.
 func (rh *RequestHeader) Header() *RequestHeader {
 	return rh
@@ -574,14 +697,74 @@ func (gr *GetResponse) Verify(req Request) error {
 
 // Verify verifies the integrity of every value returned in the scan.
 func (sr *ScanResponse) Verify(req Request) error {
-	for _, kv := range sr.Rows {
-		if err := kv.Value.Verify(kv.Key); err != nil {
+	if sr.KeysCompressed() && len(sr.SharedPrefixLens) != len(sr.Rows) {
+		return util.Errorf("scan response has %d shared prefix lengths for %d rows", len(sr.SharedPrefixLens), len(sr.Rows))
+	}
+	var key Key
+	for i, kv := range sr.Rows {
+		if sr.KeysCompressed() {
+			key = decompressKey(key, kv.Key, sr.SharedPrefixLens[i])
+		} else {
+			key = kv.Key
+		}
+		if err := kv.Value.Verify(key); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// KeysCompressed returns whether the keys of the scanned rows are
+// prefix-compressed.
+func (sr *ScanResponse) KeysCompressed() bool {
+	return len(sr.SharedPrefixLens) > 0
+}
+
+// CompressKeys prefix-compresses the keys of the scanned rows: each
+// key is truncated to the bytes following the prefix it shares with
+// the preceding row's key, and the length of that shared prefix is
+// recorded in SharedPrefixLens. This shrinks responses to scans over
+// keys with long common prefixes.
+func (sr *ScanResponse) CompressKeys() {
+	if sr.KeysCompressed() || len(sr.Rows) == 0 {
+		return
+	}
+	sr.SharedPrefixLens = make([]int32, len(sr.Rows))
+	var prev Key
+	for i := range sr.Rows {
+		key := sr.Rows[i].Key
+		var n int
+		for n < len(prev) && n < len(key) && prev[n] == key[n] {
+			n++
+		}
+		sr.SharedPrefixLens[i] = int32(n)
+		sr.Rows[i].Key = key[n:]
+		prev = key
+	}
+}
+
+// DecompressKeys restores the full keys of the scanned rows if they
+// are prefix-compressed.
+func (sr *ScanResponse) DecompressKeys() {
+	if !sr.KeysCompressed() {
+		return
+	}
+	var prev Key
+	for i := range sr.Rows {
+		prev = decompressKey(prev, sr.Rows[i].Key, sr.SharedPrefixLens[i])
+		sr.Rows[i].Key = prev
+	}
+	sr.SharedPrefixLens = nil
+}
+
+// decompressKey returns the key made up of the first shared bytes of
+// prev followed by suffix.
+func decompressKey(prev, suffix Key, shared int32) Key {
+	key := make(Key, 0, int(shared)+len(suffix))
+	key = append(key, prev[:shared]...)
+	return append(key, suffix...)
+}
+
 // Add adds a request to the batch request. The batch inherits
 // the key range of the first request added to it.
 //
@@ -139,3 +139,57 @@ func TestCombinable(t *testing.T) {
 		t.Errorf("wanted %v, got %v", wantedDR, dr1)
 	}
 }
+
+// TestScanResponseCompressKeys verifies that prefix-compressed scan
+// responses restore their keys on decompression, and that compressed,
+// uncompressed and mixed responses combine correctly.
+func TestScanResponseCompressKeys(t *testing.T) {
+	makeResponse := func(keys ...string) *ScanResponse {
+		sr := &ScanResponse{}
+		for _, k := range keys {
+			sr.Rows = append(sr.Rows, KeyValue{Key: Key(k), Value: Value{Bytes: []byte(k)}})
+		}
+		return sr
+	}
+
+	sr := makeResponse("a/b/c", "a/b/d", "a/c", "b")
+	sr.CompressKeys()
+	if expLens := []int32{0, 4, 2, 0}; !reflect.DeepEqual(sr.SharedPrefixLens, expLens) {
+		t.Errorf("expected shared prefix lengths %v; got %v", expLens, sr.SharedPrefixLens)
+	}
+	for i, exp := range []string{"a/b/c", "d", "c", "b"} {
+		if key := string(sr.Rows[i].Key); key != exp {
+			t.Errorf("%d: expected compressed key %q; got %q", i, exp, key)
+		}
+	}
+	sr.DecompressKeys()
+	if expSR := makeResponse("a/b/c", "a/b/d", "a/c", "b"); !reflect.DeepEqual(sr, expSR) {
+		t.Errorf("expected %+v; got %+v", expSR, sr)
+	}
+
+	testCases := []struct {
+		compress1, compress2 bool
+	}{
+		{false, false},
+		{true, true},
+		{true, false},
+		{false, true},
+	}
+	for i, test := range testCases {
+		sr1, sr2 := makeResponse("a/a", "a/b"), makeResponse("a/c", "a/d")
+		if test.compress1 {
+			sr1.CompressKeys()
+		}
+		if test.compress2 {
+			sr2.CompressKeys()
+		}
+		sr1.Combine(sr2)
+		if err := sr1.Verify(&ScanRequest{}); err != nil {
+			t.Errorf("%d: %s", i, err)
+		}
+		sr1.DecompressKeys()
+		if expSR := makeResponse("a/a", "a/b", "a/c", "a/d"); !reflect.DeepEqual(sr1, expSR) {
+			t.Errorf("%d: expected %+v; got %+v", i, expSR, sr1)
+		}
+	}
+}
@@ -83,22 +83,48 @@ func (r *RangeDescriptor) FindReplica(storeID int32) *Replica {
 	panic(fmt.Sprintf("unable to find matching replica for store %d: %v", storeID, r.Replicas))
 }
 
-// CanRead does a linear search for user to verify read permission.
-func (p *PermConfig) CanRead(user string) bool {
-	for _, u := range p.Read {
-		if u == user {
-			return true
+// GroupPrefix begins PermConfig ACL entries which name a group of
+// users rather than a single user.
+const GroupPrefix = "@"
+
+// CanRead does a linear search for user, or for any of the groups of
+// which user is a member, to verify read permission.
+func (p *PermConfig) CanRead(user string, groups ...string) bool {
+	return aclContains(p.Read, user, groups)
+}
+
+// CanWrite does a linear search for user, or for any of the groups of
+// which user is a member, to verify write permission.
+func (p *PermConfig) CanWrite(user string, groups ...string) bool {
+	return aclContains(p.Write, user, groups)
+}
+
+// HasGroups returns whether any of the config's ACL entries name a
+// group.
+func (p *PermConfig) HasGroups() bool {
+	for _, acl := range [][]string{p.Read, p.Write} {
+		for _, u := range acl {
+			if strings.HasPrefix(u, GroupPrefix) {
+				return true
+			}
 		}
 	}
 	return false
 }
 
-// CanWrite does a linear search for user to verify write permission.
-func (p *PermConfig) CanWrite(user string) bool {
-	for _, u := range p.Write {
+// aclContains returns whether the acl contains user or any of groups.
+func aclContains(acl []string, user string, groups []string) bool {
+	for _, u := range acl {
 		if u == user {
 			return true
 		}
+		if strings.HasPrefix(u, GroupPrefix) {
+			for _, g := range groups {
+				if u[len(GroupPrefix):] == g {
+					return true
+				}
+			}
+		}
 	}
 	return false
 }
@@ -151,3 +151,25 @@ func TestPermConfig(t *testing.T) {
 		t.Errorf("unexpected read access for user \"bar\"")
 	}
 }
+
+func TestPermConfigGroups(t *testing.T) {
+	p := &PermConfig{
+		Read:  []string{"foo", "@readers"},
+		Write: []string{"foo"},
+	}
+	if !p.HasGroups() {
+		t.Errorf("expected config to have groups")
+	}
+	if !p.CanRead("bar", "writers", "readers") {
+		t.Errorf("expected read permission for member of \"readers\"")
+	}
+	if p.CanRead("bar", "writers") || p.CanRead("readers") {
+		t.Errorf("unexpected read access for non-member of \"readers\"")
+	}
+	if p.CanWrite("bar", "readers") {
+		t.Errorf("unexpected write access for member of \"readers\"")
+	}
+	if (&PermConfig{Read: []string{"foo"}}).HasGroups() {
+		t.Errorf("expected config to have no groups")
+	}
+}
@@ -22,9 +22,11 @@ import (
 	"crypto/md5"
 	"fmt"
 	"math"
+	"math/big"
 	"math/rand"
 	"sort"
 	"strings"
+	"time"
 
 	"code.google.com/p/biogo.store/interval"
 	"code.google.com/p/biogo.store/llrb"
@@ -42,6 +44,12 @@ var (
 	KeyMin = Key("")
 	// KeyMax is a maximum key value which sorts after all other keys.
 	KeyMax = Key(strings.Repeat("\xff", KeyMaxLength))
+	// KeyTenantPrefix is the prefix of the keys of tenants, which
+	// immediately follows the system keys. Each tenant's keys are
+	// prefixed by its TenantPrefix, so that the zone, permission and
+	// accounting configs for that prefix apply to the tenant's keys
+	// alone.
+	KeyTenantPrefix = Key("\x01tenant-")
 )
 
 // Key is a custom type for a byte string in proto
@@ -62,6 +70,30 @@ func MakeKey(keys ...Key) Key {
 	return Key(bytes.Join(byteSlices, nil))
 }
 
+// TenantPrefix returns the prefix of the keys of the tenant with the
+// given ID. The ID is encoded so that no tenant's prefix is a prefix
+// of another's and so that tenants sort by ID.
+func TenantPrefix(tenantID int64) Key {
+	return MakeKey(KeyTenantPrefix, encoding.EncodeInt(nil, tenantID))
+}
+
+// MakeTenantKey returns the key at which the tenant with the given ID
+// stores key.
+func MakeTenantKey(tenantID int64, key Key) Key {
+	return MakeKey(TenantPrefix(tenantID), key)
+}
+
+// DecodeTenantKey returns the tenant ID and the tenant's key encoded
+// in a key made by MakeTenantKey. ok is false if key belongs to no
+// tenant.
+func DecodeTenantKey(key Key) (tenantID int64, tenantKey Key, ok bool) {
+	if !bytes.HasPrefix(key, KeyTenantPrefix) || len(key) == len(KeyTenantPrefix) {
+		return 0, nil, false
+	}
+	b, tenantID := encoding.DecodeInt(key[len(KeyTenantPrefix):])
+	return tenantID, Key(b), true
+}
+
 // Returns the next possible byte by appending an \x00.
 func bytesNext(b []byte) []byte {
 	if len(b) == KeyMaxLength && bytes.Equal(b, KeyMax) {
@@ -260,6 +292,14 @@ func (t Timestamp) Add(wallTime int64, logical int32) Timestamp {
 	}
 }
 
+// Prev returns the timestamp immediately preceding t.
+func (t Timestamp) Prev() Timestamp {
+	if t.Logical > 0 {
+		return Timestamp{WallTime: t.WallTime, Logical: t.Logical - 1}
+	}
+	return Timestamp{WallTime: t.WallTime - 1, Logical: math.MaxInt32}
+}
+
 // Forward updates the timestamp from the one given, if that moves it
 // forwards in time.
 func (t *Timestamp) Forward(s Timestamp) {
@@ -277,9 +317,7 @@ func (t *Timestamp) Backward(s Timestamp) {
 }
 
 // InitChecksum initializes a checksum based on the provided key and
-// the contents of the value. If the value contains a byte slice, the
-// checksum includes it directly; if the value contains an integer,
-// the checksum includes the integer as 8 bytes in big-endian order.
+// the contents of the value, including its tag; see computeChecksum.
 func (v *Value) InitChecksum(key []byte) {
 	if v.Checksum == nil {
 		v.Checksum = gogoproto.Uint32(v.computeChecksum(key))
@@ -306,6 +344,8 @@ func (v *Value) Verify(key []byte) error {
 // the contents of the value. If the value contains a byte slice, the
 // checksum includes it directly; if the value contains an integer,
 // the checksum includes the integer as 8 bytes in big-endian order.
+// A tag, if set, follows as its length in 8 bytes and then its bytes,
+// so that a corrupted tag can't pass for the value's bytes.
 func (v *Value) computeChecksum(key []byte) uint32 {
 	c := encoding.NewCRC32Checksum(key)
 	if v.Bytes != nil {
@@ -313,9 +353,130 @@ func (v *Value) computeChecksum(key []byte) uint32 {
 	} else if v.Integer != nil {
 		c.Write(encoding.EncodeUint64(nil, uint64(v.GetInteger())))
 	}
+	if v.Tag != nil {
+		c.Write(encoding.EncodeUint64(nil, uint64(len(v.GetTag()))))
+		c.Write([]byte(v.GetTag()))
+	}
 	return c.Sum32()
 }
 
+// SetInt sets the value to the integer i. Integer values are
+// identified by the integer field alone and may be incremented with
+// the Increment API call. Any existing checksum is cleared; call
+// InitChecksum to recompute it.
+func (v *Value) SetInt(i int64) {
+	v.Bytes = nil
+	v.Integer = gogoproto.Int64(i)
+	v.Tag = nil
+	v.Checksum = nil
+}
+
+// GetInt returns the integer held by the value or an error if the
+// value does not contain an integer.
+func (v *Value) GetInt() (int64, error) {
+	if v.Bytes != nil || v.Integer == nil {
+		return 0, util.Errorf("value is not an integer: %+v", v)
+	}
+	return v.GetInteger(), nil
+}
+
+// SetFloat encodes f into the value's bytes and tags it as a float.
+// Any existing checksum is cleared.
+func (v *Value) SetFloat(f float64) {
+	v.setTagged(_CR_FLOAT, encoding.EncodeUint64(nil, math.Float64bits(f)))
+}
+
+// GetFloat decodes the float held by the value or returns an error
+// if the value is not tagged as a float.
+func (v *Value) GetFloat() (float64, error) {
+	b, err := v.getTagged(_CR_FLOAT)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, util.Errorf("float value should be exactly 8 bytes: %d", len(b))
+	}
+	_, u := encoding.DecodeUint64(b)
+	return math.Float64frombits(u), nil
+}
+
+// SetDecimal encodes the rational r into the value's bytes and tags
+// it as a decimal. Any existing checksum is cleared.
+func (v *Value) SetDecimal(r *big.Rat) {
+	v.setTagged(_CR_DECIMAL, []byte(r.String()))
+}
+
+// GetDecimal decodes the rational held by the value or returns an
+// error if the value is not tagged as a decimal.
+func (v *Value) GetDecimal() (*big.Rat, error) {
+	b, err := v.getTagged(_CR_DECIMAL)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := new(big.Rat).SetString(string(b))
+	if !ok {
+		return nil, util.Errorf("unable to decode decimal value %q", b)
+	}
+	return r, nil
+}
+
+// SetBytes sets the value's bytes to b and tags it as a byte slice.
+// Any existing checksum is cleared.
+func (v *Value) SetBytes(b []byte) {
+	v.setTagged(_CR_BYTES, b)
+}
+
+// GetBytesChecked returns the byte slice held by the value or an
+// error if the value is not tagged as a byte slice. Unlike
+// GetBytes, it will not return bytes which encode another type.
+func (v *Value) GetBytesChecked() ([]byte, error) {
+	return v.getTagged(_CR_BYTES)
+}
+
+// SetTime encodes t, converted to UTC, into the value's bytes and
+// tags it as a time. Any existing checksum is cleared.
+func (v *Value) SetTime(t time.Time) {
+	t = t.UTC()
+	b := encoding.EncodeUint64(nil, uint64(t.Unix()))
+	b = encoding.EncodeUint32(b, uint32(t.Nanosecond()))
+	v.setTagged(_CR_TIME, b)
+}
+
+// GetTime decodes the time held by the value or returns an error if
+// the value is not tagged as a time. The returned time is in UTC.
+func (v *Value) GetTime() (time.Time, error) {
+	b, err := v.getTagged(_CR_TIME)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(b) != 12 {
+		return time.Time{}, util.Errorf("time value should be exactly 12 bytes: %d", len(b))
+	}
+	b, sec := encoding.DecodeUint64(b)
+	_, nsec := encoding.DecodeUint32(b)
+	return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+}
+
+// setTagged sets the value's bytes to b with the supplied tag,
+// clearing the integer field and any existing checksum.
+func (v *Value) setTagged(t ValueType, b []byte) {
+	if b == nil {
+		b = []byte{}
+	}
+	v.Bytes = b
+	v.Integer = nil
+	v.Tag = gogoproto.String(t.String())
+	v.Checksum = nil
+}
+
+// getTagged returns the value's bytes if the value is tagged with t.
+func (v *Value) getTagged(t ValueType) ([]byte, error) {
+	if v.GetTag() != t.String() {
+		return nil, util.Errorf("value is not tagged as %s: %+v", t, v)
+	}
+	return v.Bytes, nil
+}
+
 // KeyGetter is a hack to allow Compare() to work for the batch
 // update structs which wrap RawKeyValue.
 // TODO(petermattis): Is there somehow a better way to do this?
@@ -481,6 +642,7 @@ func (mvcc *MVCCMetadata) IsInline() bool {
 func NewScanMetadata(nowNanos int64) *ScanMetadata {
 	return &ScanMetadata{
 		LastScanNanos:     nowNanos,
+		LastVerifyNanos:   nowNanos,
 		OldestIntentNanos: gogoproto.Int64(nowNanos),
 		GC: GCMetadata{
 			ByteCounts: make([]int64, 10),
@@ -20,6 +20,7 @@ package proto
 import (
 	"bytes"
 	"math"
+	"math/big"
 	"math/rand"
 	"reflect"
 	"strings"
@@ -90,6 +91,31 @@ func TestKeyPrefixEnd(t *testing.T) {
 	}
 }
 
+// TestTenantKeys verifies that tenant keys decode to their tenant
+// and key, that tenants' keys don't overlap and that keys of no
+// tenant are recognized.
+func TestTenantKeys(t *testing.T) {
+	for _, tenantID := range []int64{1, 10, 1 << 40} {
+		for _, key := range []Key{KeyMin, Key("a"), Key("\xff\xff")} {
+			tk := MakeTenantKey(tenantID, key)
+			if id, k, ok := DecodeTenantKey(tk); !ok || id != tenantID || !k.Equal(key) {
+				t.Errorf("expected %q to decode to tenant %d key %q; got %t, %d, %q", tk, tenantID, key, ok, id, k)
+			}
+			if !tk.Less(TenantPrefix(tenantID + 1)) {
+				t.Errorf("key %q of tenant %d sorts after tenant %d", tk, tenantID, tenantID+1)
+			}
+		}
+	}
+	if bytes.HasPrefix(TenantPrefix(10), TenantPrefix(1)) {
+		t.Errorf("prefix of tenant 10 is prefixed by that of tenant 1")
+	}
+	for _, key := range []Key{KeyMin, Key("a"), Key("\x00\x00meta1"), KeyTenantPrefix} {
+		if _, _, ok := DecodeTenantKey(key); ok {
+			t.Errorf("expected %q to belong to no tenant", key)
+		}
+	}
+}
+
 func TestKeyEqual(t *testing.T) {
 	a1 := Key("a1")
 	a2 := Key("a2")
@@ -266,6 +292,24 @@ func TestEqual(t *testing.T) {
 	}
 }
 
+func TestTimestampPrev(t *testing.T) {
+	testCases := []struct {
+		ts, expPrev Timestamp
+	}{
+		{makeTS(1, 2), makeTS(1, 1)},
+		{makeTS(1, 1), makeTS(1, 0)},
+		{makeTS(2, 0), makeTS(1, math.MaxInt32)},
+	}
+	for i, c := range testCases {
+		if prev := c.ts.Prev(); !prev.Equal(c.expPrev) {
+			t.Errorf("%d: expected %s; got %s", i, c.expPrev, prev)
+		}
+		if !c.ts.Prev().Less(c.ts) {
+			t.Errorf("%d: expected %s < %s", i, c.ts.Prev(), c.ts)
+		}
+	}
+}
+
 func TestValueBothBytesAndIntegerSet(t *testing.T) {
 	k := []byte("key")
 	v := Value{Bytes: []byte("a"), Integer: gogoproto.Int64(0)}
@@ -338,6 +382,25 @@ func TestValueChecksumWithBytes(t *testing.T) {
 	}
 }
 
+// TestValueChecksumWithTag verifies that the checksum covers the
+// value's tag.
+func TestValueChecksumWithTag(t *testing.T) {
+	k := []byte("key")
+	v := Value{Bytes: []byte("abc"), Tag: gogoproto.String("float")}
+	v.InitChecksum(k)
+	if err := v.Verify(k); err != nil {
+		t.Error(err)
+	}
+	v.Tag = gogoproto.String("time")
+	if err := v.Verify(k); err == nil {
+		t.Error("expected checksum verification failure on different tag")
+	}
+	v.Tag = nil
+	if err := v.Verify(k); err == nil {
+		t.Error("expected checksum verification failure on removed tag")
+	}
+}
+
 func TestValueChecksumWithInteger(t *testing.T) {
 	k := []byte("key")
 	testValues := []int64{0, 1, -1, math.MinInt64, math.MaxInt64}
@@ -359,6 +422,73 @@ func TestValueChecksumWithInteger(t *testing.T) {
 	}
 }
 
+// TestValueTypedEncodings verifies that each of the typed setters
+// round trips through its getter, produces a verifiable checksum and
+// is rejected by the getters of the other types.
+func TestValueTypedEncodings(t *testing.T) {
+	k := []byte("key")
+	now := time.Unix(1425000000, 123456789)
+	testCases := []struct {
+		set   func(v *Value)
+		check func(v *Value) (bool, error)
+	}{
+		{func(v *Value) { v.SetInt(-42) }, func(v *Value) (bool, error) {
+			i, err := v.GetInt()
+			return i == -42, err
+		}},
+		{func(v *Value) { v.SetFloat(math.Pi) }, func(v *Value) (bool, error) {
+			f, err := v.GetFloat()
+			return f == math.Pi, err
+		}},
+		{func(v *Value) { v.SetDecimal(big.NewRat(-1, 3)) }, func(v *Value) (bool, error) {
+			r, err := v.GetDecimal()
+			return err == nil && r.Cmp(big.NewRat(-1, 3)) == 0, err
+		}},
+		{func(v *Value) { v.SetBytes([]byte("foo")) }, func(v *Value) (bool, error) {
+			b, err := v.GetBytesChecked()
+			return bytes.Equal(b, []byte("foo")), err
+		}},
+		{func(v *Value) { v.SetTime(now) }, func(v *Value) (bool, error) {
+			ts, err := v.GetTime()
+			return ts.Equal(now), err
+		}},
+	}
+	for i, c := range testCases {
+		v := &Value{}
+		c.set(v)
+		v.InitChecksum(k)
+		if err := v.Verify(k); err != nil {
+			t.Errorf("%d: %s", i, err)
+		}
+		// Round trip through the wire encoding.
+		data, err := gogoproto.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v2 := &Value{}
+		if err := gogoproto.Unmarshal(data, v2); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := c.check(v2); err != nil || !ok {
+			t.Errorf("%d: unexpected decoded value %+v: %v", i, v2, err)
+		}
+		// Getters of every other type should fail.
+		for j, o := range testCases {
+			if i == j {
+				continue
+			}
+			if _, err := o.check(v2); err == nil {
+				t.Errorf("%d: expected getter %d to fail on %+v", i, j, v2)
+			}
+		}
+		// Resetting the value must clear the stale checksum.
+		c.set(v)
+		if v.Checksum != nil {
+			t.Errorf("%d: expected checksum to be cleared", i)
+		}
+	}
+}
+
 func TestGCMetadataEstimatedBytes(t *testing.T) {
 	gc := GCMetadata{
 		TTLSeconds: 100,
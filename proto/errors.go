@@ -118,6 +118,13 @@ func NewTransactionStatusError(txn *Transaction, msg string) *TransactionStatusE
 	}
 }
 
+// NewTransactionDeadlineExceededError initializes a new
+// TransactionStatusError for a transaction whose commit timestamp
+// exceeds the deadline of its commit.
+func NewTransactionDeadlineExceededError(txn *Transaction, deadline Timestamp) *TransactionStatusError {
+	return NewTransactionStatusError(txn, fmt.Sprintf("commit timestamp %s exceeds deadline %s", txn.Timestamp, deadline))
+}
+
 // Error formats error.
 func (e *TransactionStatusError) Error() string {
 	return fmt.Sprintf("txn %s: %s", e.Txn, e.Msg)
@@ -147,3 +154,29 @@ func (e *OpRequiresTxnError) Error() string {
 func (e *ConditionFailedError) Error() string {
 	return fmt.Sprintf("unexpected value: %s", e.ActualValue)
 }
+
+// NewBatchTimestampBeforeGCError initializes a new error indicating a
+// read at timestamp ts below the range's GC threshold.
+func NewBatchTimestampBeforeGCError(ts, threshold Timestamp) *BatchTimestampBeforeGCError {
+	return &BatchTimestampBeforeGCError{
+		Timestamp: ts,
+		Threshold: threshold,
+	}
+}
+
+// Error formats error.
+func (e *BatchTimestampBeforeGCError) Error() string {
+	return fmt.Sprintf("batch timestamp %s must be after GC threshold %s", e.Timestamp, e.Threshold)
+}
+
+// NewReplicaCorruptionError initializes a new error indicating that
+// the replica's state may have diverged, as described by format and
+// args.
+func NewReplicaCorruptionError(format string, args ...interface{}) *ReplicaCorruptionError {
+	return &ReplicaCorruptionError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Error formats error.
+func (e *ReplicaCorruptionError) Error() string {
+	return fmt.Sprintf("replica corruption: %s", e.Message)
+}
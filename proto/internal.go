@@ -43,6 +43,10 @@ const (
 	// InternalResolveIntent resolves existing write intents for a key or
 	// key range.
 	InternalResolveIntent = "InternalResolveIntent"
+	// InternalQueryIntent verifies whether a write intent of the
+	// transaction in the request header exists at a key, without
+	// resolving it.
+	InternalQueryIntent = "InternalQueryIntent"
 	// InternalMerge merges a given value into the specified key. Merge is a
 	// high-performance operation provided by underlying data storage for values
 	// which are accumulated over several writes. Because it is not
@@ -51,6 +55,14 @@ const (
 	// The logic used to merge values of different types is described in more
 	// detail by the "Merge" method of engine.Engine.
 	InternalMerge = "InternalMerge"
+	// InternalScanChanges returns the most recent versions of the keys
+	// in a span changed since a timestamp, including deletions.
+	InternalScanChanges = "InternalScanChanges"
+	// InternalSetFrozen freezes or unfreezes a range. It is proposed
+	// by the range's leader on behalf of AdminFreeze and AdminUnfreeze
+	// so that each replica records the frozen state as it applies the
+	// command.
+	InternalSetFrozen = "InternalSetFrozen"
 )
 
 // ToValue generates a Value message which contains an encoded copy of this
@@ -17,7 +17,13 @@
 // Author: Spencer Kimball (spencer.kimball@gmail.com)
 
 #include <algorithm>
+#include <errno.h>
 #include <limits>
+#include <memory>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
 #include <google/protobuf/repeated_field.h>
 #include "rocksdb/cache.h"
 #include "rocksdb/compaction_filter.h"
@@ -25,6 +31,7 @@
 #include "rocksdb/env.h"
 #include "rocksdb/merge_operator.h"
 #include "rocksdb/options.h"
+#include "rocksdb/table_properties.h"
 #include "api.pb.h"
 #include "data.pb.h"
 #include "internal.pb.h"
@@ -39,15 +46,20 @@ struct DBBatch {
 
 struct DBEngine {
   rocksdb::DB* rep;
+  // Whether the block cache has a partition for background reads.
+  bool background_cache;
 };
 
 struct DBIterator {
   rocksdb::Iterator* rep;
+  bool background;
 };
 
 struct DBSnapshot {
   rocksdb::DB* db;
   const rocksdb::Snapshot* rep;
+  bool fill_cache;
+  bool background;
 };
 
 }  // extern "C"
@@ -61,6 +73,18 @@ const rocksdb::Slice kKeyLocalRangeKeyPrefix("\x00\x00\x00k", 4);
 const rocksdb::Slice kKeyLocalResponseCacheSuffix("res-");
 const rocksdb::Slice kKeyLocalTransactionSuffix("txn-");
 
+// The names of the SSTable user properties holding the bounds of the
+// MVCC timestamps and keys of the versions in each table.
+const std::string kTimestampMinProp = "crdb.ts.min";
+const std::string kTimestampMaxProp = "crdb.ts.max";
+const std::string kKeyMinProp = "crdb.key.min";
+const std::string kKeyMaxProp = "crdb.key.max";
+
+// The length of the encoded timestamp trailing a versioned MVCC key:
+// an 8 byte wall time followed by a 4 byte logical clock, both
+// encoded in decreasing order.
+const int kMVCCTimestampLen = 12;
+
 const DBStatus kSuccess = { NULL, 0 };
 
 std::string ToString(DBSlice s) {
@@ -97,10 +121,115 @@ rocksdb::ReadOptions MakeReadOptions(DBSnapshot* snap) {
   rocksdb::ReadOptions options;
   if (snap != NULL) {
     options.snapshot = snap->rep;
+    options.fill_cache = snap->fill_cache;
   }
   return options;
 }
 
+// background_read is set while the calling thread reads on behalf of
+// a background snapshot. It selects the partition of the block cache
+// filled by the read.
+__thread bool background_read = false;
+
+// BackgroundReadScope marks the reads of the calling thread as
+// background reads for the lifetime of the scope if background is
+// true.
+class BackgroundReadScope {
+ public:
+  explicit BackgroundReadScope(bool background)
+      : prev_(background_read) {
+    background_read = prev_ || background;
+  }
+  ~BackgroundReadScope() {
+    background_read = prev_;
+  }
+
+ private:
+  const bool prev_;
+};
+
+// PartitionedCache is a block cache split into a partition filled by
+// foreground reads and one filled by background reads, each an LRU
+// cache of its own capacity. Lookups are served from either
+// partition, but a block read by a background scan only ever evicts
+// other blocks read by background scans, so that a scan over an
+// entire range can't evict the working set of foreground reads.
+class PartitionedCache : public rocksdb::Cache {
+ public:
+  PartitionedCache(size_t foreground_capacity, size_t background_capacity)
+      : foreground_(rocksdb::NewLRUCache(foreground_capacity)),
+        background_(rocksdb::NewLRUCache(background_capacity)) {
+  }
+
+  virtual Handle* Insert(const rocksdb::Slice& key, void* value, size_t charge,
+                         void (*deleter)(const rocksdb::Slice& key, void* value)) {
+    rocksdb::Cache* c = background_read ? background_.get() : foreground_.get();
+    return Wrap(c, c->Insert(key, value, charge, deleter));
+  }
+
+  virtual Handle* Lookup(const rocksdb::Slice& key) {
+    Handle* h = foreground_->Lookup(key);
+    if (h != NULL) {
+      return Wrap(foreground_.get(), h);
+    }
+    return Wrap(background_.get(), background_->Lookup(key));
+  }
+
+  virtual void Release(Handle* handle) {
+    PartitionHandle* h = static_cast<PartitionHandle*>(handle);
+    h->cache->Release(h->rep);
+    delete h;
+  }
+
+  virtual void* Value(Handle* handle) {
+    PartitionHandle* h = static_cast<PartitionHandle*>(handle);
+    return h->cache->Value(h->rep);
+  }
+
+  virtual void Erase(const rocksdb::Slice& key) {
+    foreground_->Erase(key);
+    background_->Erase(key);
+  }
+
+  virtual uint64_t NewId() {
+    return foreground_->NewId();
+  }
+
+  virtual size_t GetCapacity() const {
+    return foreground_->GetCapacity() + background_->GetCapacity();
+  }
+
+  virtual size_t GetUsage() const {
+    return foreground_->GetUsage() + background_->GetUsage();
+  }
+
+  virtual void ApplyToAllCacheEntries(void (*callback)(void*, size_t),
+                                      bool thread_safe) {
+    foreground_->ApplyToAllCacheEntries(callback, thread_safe);
+    background_->ApplyToAllCacheEntries(callback, thread_safe);
+  }
+
+ private:
+  // PartitionHandle wraps the handle of an entry of a partition.
+  struct PartitionHandle : public Handle {
+    rocksdb::Cache* cache;
+    Handle* rep;
+  };
+
+  static Handle* Wrap(rocksdb::Cache* c, Handle* rep) {
+    if (rep == NULL) {
+      return NULL;
+    }
+    PartitionHandle* h = new PartitionHandle;
+    h->cache = c;
+    h->rep = rep;
+    return h;
+  }
+
+  const std::shared_ptr<rocksdb::Cache> foreground_;
+  const std::shared_ptr<rocksdb::Cache> background_;
+};
+
 // GetResponseHeader extracts the response header for each type of
 // response in the ReadWriteCmdResponse union.
 const proto::ResponseHeader* GetResponseHeader(const proto::ReadWriteCmdResponse& rwResp) {
@@ -130,6 +259,10 @@ const proto::ResponseHeader* GetResponseHeader(const proto::ReadWriteCmdResponse
     return &rwResp.internal_resolve_intent().header();
   } else if (rwResp.has_internal_merge()) {
     return &rwResp.internal_merge().header();
+  } else if (rwResp.has_compare_and_set()) {
+    return &rwResp.compare_and_set().header();
+  } else if (rwResp.has_internal_set_frozen()) {
+    return &rwResp.internal_set_frozen().header();
   }
   return NULL;
 }
@@ -282,6 +415,97 @@ class DBCompactionFilterFactory : public rocksdb::CompactionFilterFactory {
   int64_t min_rcache_ts_;
 };
 
+// EncodeInt64 and DecodeInt64 convert between an int64 and a fixed
+// length string for use as a table property value.
+std::string EncodeInt64(int64_t v) {
+  std::string result(8, '\0');
+  for (int i = 7; i >= 0; i--, v >>= 8) {
+    result[i] = static_cast<char>(v & 0xff);
+  }
+  return result;
+}
+
+bool DecodeInt64(const std::string& s, int64_t* v) {
+  if (s.size() != 8) {
+    return false;
+  }
+  uint64_t u = 0;
+  for (int i = 0; i < 8; i++) {
+    u = (u << 8) | static_cast<uint8_t>(s[i]);
+  }
+  *v = static_cast<int64_t>(u);
+  return true;
+}
+
+// DBTimestampCollector records the range of the wall times of the
+// MVCC versions in an SSTable, and the smallest and largest keys of
+// the table, as user properties of the table. These allow the scan
+// queue to determine that a range holds no versions old enough to be
+// garbage collected without iterating over the range.
+class DBTimestampCollector : public rocksdb::TablePropertiesCollector {
+ public:
+  DBTimestampCollector()
+      : min_wall_time_(std::numeric_limits<int64_t>::max()),
+        max_wall_time_(std::numeric_limits<int64_t>::min()) {
+  }
+
+  virtual rocksdb::Status Add(const rocksdb::Slice& key, const rocksdb::Slice& value) {
+    // Keys are added in sorted order.
+    if (min_key_.empty()) {
+      min_key_ = key.ToString();
+    }
+    max_key_ = key.ToString();
+
+    // Only versioned keys carry a timestamp; metadata keys have no
+    // remainder after the binary-encoded key.
+    std::string decoded, remainder;
+    if (!DecodeBinary(key, &decoded, &remainder) || remainder.size() != kMVCCTimestampLen) {
+      return rocksdb::Status::OK();
+    }
+    uint64_t wall_time = 0;
+    for (int i = 0; i < 8; i++) {
+      wall_time = (wall_time << 8) | static_cast<uint8_t>(remainder[i]);
+    }
+    int64_t ts = static_cast<int64_t>(~wall_time);
+    min_wall_time_ = std::min(min_wall_time_, ts);
+    max_wall_time_ = std::max(max_wall_time_, ts);
+    return rocksdb::Status::OK();
+  }
+
+  virtual rocksdb::Status Finish(rocksdb::UserCollectedProperties* properties) {
+    (*properties)[kTimestampMinProp] = EncodeInt64(min_wall_time_);
+    (*properties)[kTimestampMaxProp] = EncodeInt64(max_wall_time_);
+    (*properties)[kKeyMinProp] = min_key_;
+    (*properties)[kKeyMaxProp] = max_key_;
+    return rocksdb::Status::OK();
+  }
+
+  virtual rocksdb::UserCollectedProperties GetReadableProperties() const {
+    return rocksdb::UserCollectedProperties();
+  }
+
+  virtual const char* Name() const {
+    return "cockroach_timestamp_collector";
+  }
+
+ private:
+  int64_t min_wall_time_;
+  int64_t max_wall_time_;
+  std::string min_key_;
+  std::string max_key_;
+};
+
+class DBTimestampCollectorFactory : public rocksdb::TablePropertiesCollectorFactory {
+ public:
+  virtual rocksdb::TablePropertiesCollector* CreateTablePropertiesCollector() {
+    return new DBTimestampCollector;
+  }
+
+  virtual const char* Name() const {
+    return "cockroach_timestamp_collector_factory";
+  }
+};
+
 bool WillOverflow(int64_t a, int64_t b) {
   // Morally MinInt64 < a+b < MaxInt64, but without overflows.
   // First make sure that a <= b. If not, swap them.
@@ -600,6 +824,57 @@ class DBMergeOperator : public rocksdb::MergeOperator {
   }
 };
 
+// CopyFile copies the first size bytes of the file src to the new
+// file dst. If size is the maximum uint64_t, the whole file is
+// copied.
+rocksdb::Status CopyFile(const std::string& src, const std::string& dst, uint64_t size) {
+  const bool whole = size == std::numeric_limits<uint64_t>::max();
+  FILE* in = fopen(src.c_str(), "rb");
+  if (in == NULL) {
+    return rocksdb::Status::IOError(src, strerror(errno));
+  }
+  FILE* out = fopen(dst.c_str(), "wb");
+  if (out == NULL) {
+    fclose(in);
+    return rocksdb::Status::IOError(dst, strerror(errno));
+  }
+  rocksdb::Status status;
+  char buf[64 << 10];
+  while (size > 0) {
+    size_t n = fread(buf, 1, std::min<uint64_t>(size, sizeof(buf)), in);
+    if (n == 0) {
+      if (!whole) {
+        status = rocksdb::Status::IOError(src, "unexpected end of file");
+      }
+      break;
+    }
+    if (fwrite(buf, 1, n, out) != n) {
+      status = rocksdb::Status::IOError(dst, strerror(errno));
+      break;
+    }
+    if (!whole) {
+      size -= n;
+    }
+  }
+  fclose(in);
+  if (fclose(out) != 0 && status.ok()) {
+    status = rocksdb::Status::IOError(dst, strerror(errno));
+  }
+  return status;
+}
+
+// LinkFile hard-links the file src to dst, falling back to a copy if
+// they are on different file systems.
+rocksdb::Status LinkFile(const std::string& src, const std::string& dst) {
+  if (link(src.c_str(), dst.c_str()) == 0) {
+    return rocksdb::Status::OK();
+  }
+  if (errno != EXDEV) {
+    return rocksdb::Status::IOError(dst, strerror(errno));
+  }
+  return CopyFile(src, dst, std::numeric_limits<uint64_t>::max());
+}
+
 class DBLogger : public rocksdb::Logger {
  public:
   DBLogger(DBLoggerFunc f)
@@ -621,12 +896,38 @@ class DBLogger : public rocksdb::Logger {
 
 DBStatus DBOpen(DBEngine **db, DBSlice dir, DBOptions db_opts) {
   rocksdb::Options options;
-  options.block_cache = rocksdb::NewLRUCache(db_opts.cache_size);
+  const bool background_cache = db_opts.background_cache_size > 0 &&
+      db_opts.background_cache_size < db_opts.cache_size;
+  if (background_cache) {
+    options.block_cache.reset(new PartitionedCache(
+        db_opts.cache_size - db_opts.background_cache_size,
+        db_opts.background_cache_size));
+  } else {
+    options.block_cache = rocksdb::NewLRUCache(db_opts.cache_size);
+  }
   options.allow_os_buffer = db_opts.allow_os_buffer;
   options.compaction_filter_factory.reset(new DBCompactionFilterFactory());
   options.create_if_missing = true;
   options.info_log.reset(new DBLogger(db_opts.logger));
   options.merge_operator.reset(new DBMergeOperator);
+  options.table_properties_collector_factories.push_back(
+      std::make_shared<DBTimestampCollectorFactory>());
+  switch (db_opts.compression) {
+    case DBCompressionNone:
+      options.compression = rocksdb::kNoCompression;
+      break;
+    case DBCompressionSnappy:
+      options.compression = rocksdb::kSnappyCompression;
+      break;
+    case DBCompressionZlib:
+      options.compression = rocksdb::kZlibCompression;
+      break;
+    case DBCompressionLZ4:
+      options.compression = rocksdb::kLZ4Compression;
+      break;
+    default:
+      break;
+  }
 
   rocksdb::DB *db_ptr;
   rocksdb::Status status = rocksdb::DB::Open(options, ToString(dir), &db_ptr);
@@ -635,6 +936,7 @@ DBStatus DBOpen(DBEngine **db, DBSlice dir, DBOptions db_opts) {
   }
   *db = new DBEngine;
   (*db)->rep = db_ptr;
+  (*db)->background_cache = background_cache;
   return kSuccess;
 }
 
@@ -676,6 +978,50 @@ DBStatus DBCompactRange(DBEngine* db, DBSlice* start, DBSlice* end) {
   return ToDBStatus(db->rep->CompactRange(sPtr, ePtr));
 }
 
+DBStatus DBGetTimestampBounds(DBEngine* db, DBSlice start, DBSlice end,
+                               int64_t* min_wall_time, int64_t* max_wall_time, int* found) {
+  *min_wall_time = std::numeric_limits<int64_t>::max();
+  *max_wall_time = std::numeric_limits<int64_t>::min();
+  *found = 0;
+
+  // Data in the memtable isn't covered by table properties. It isn't
+  // flushed here, which would stall writes on every call; it is
+  // treated as recent instead.
+  rocksdb::TablePropertiesCollection tables;
+  rocksdb::Status status = db->rep->GetPropertiesOfAllTables(&tables);
+  if (!status.ok()) {
+    return ToDBStatus(status);
+  }
+
+  const rocksdb::Slice s = ToSlice(start);
+  const rocksdb::Slice e = ToSlice(end);
+  for (auto it = tables.begin(); it != tables.end(); ++it) {
+    const rocksdb::UserCollectedProperties& props = it->second->user_collected_properties;
+    auto min_key = props.find(kKeyMinProp);
+    auto max_key = props.find(kKeyMaxProp);
+    if (min_key == props.end() || max_key == props.end()) {
+      // The table was written without timestamp properties.
+      return kSuccess;
+    }
+    // Skip tables which don't overlap [start, end).
+    if (rocksdb::Slice(max_key->second).compare(s) < 0 ||
+        rocksdb::Slice(min_key->second).compare(e) >= 0) {
+      continue;
+    }
+    int64_t table_min, table_max;
+    auto min_ts = props.find(kTimestampMinProp);
+    auto max_ts = props.find(kTimestampMaxProp);
+    if (min_ts == props.end() || max_ts == props.end() ||
+        !DecodeInt64(min_ts->second, &table_min) || !DecodeInt64(max_ts->second, &table_max)) {
+      return kSuccess;
+    }
+    *min_wall_time = std::min(*min_wall_time, table_min);
+    *max_wall_time = std::max(*max_wall_time, table_max);
+  }
+  *found = 1;
+  return kSuccess;
+}
+
 uint64_t DBApproximateSize(DBEngine* db, DBSlice start, DBSlice end) {
   const rocksdb::Range r(ToSlice(start), ToSlice(end));
   uint64_t result;
@@ -683,6 +1029,78 @@ uint64_t DBApproximateSize(DBEngine* db, DBSlice start, DBSlice end) {
   return result;
 }
 
+DBStatus DBCheckpoint(DBEngine* db, DBSlice dir) {
+  const std::string checkpoint_dir = ToString(dir);
+  rocksdb::Env* env = rocksdb::Env::Default();
+  if (env->FileExists(checkpoint_dir)) {
+    return ToDBStatus(rocksdb::Status::InvalidArgument(checkpoint_dir, "already exists"));
+  }
+  // Keep the live files from being deleted by compactions while they
+  // are linked.
+  rocksdb::Status status = db->rep->DisableFileDeletions();
+  if (!status.ok()) {
+    return ToDBStatus(status);
+  }
+  std::vector<std::string> live_files;
+  uint64_t manifest_size = 0;
+  status = db->rep->GetLiveFiles(live_files, &manifest_size, true /* flush_memtable */);
+  if (status.ok()) {
+    status = env->CreateDir(checkpoint_dir);
+  }
+  const std::string db_dir = db->rep->GetName();
+  for (size_t i = 0; status.ok() && i < live_files.size(); i++) {
+    // Live file names are relative to the database directory and
+    // start with a slash.
+    const std::string& name = live_files[i];
+    const std::string src = db_dir + name;
+    const std::string dst = checkpoint_dir + name;
+    if (name.size() > 4 && name.compare(name.size() - 4, 4, ".sst") == 0) {
+      // SSTables are immutable and may be shared.
+      status = LinkFile(src, dst);
+    } else if (name.find("MANIFEST") != std::string::npos) {
+      // The manifest is appended to; copy only its live prefix.
+      status = CopyFile(src, dst, manifest_size);
+    } else {
+      status = CopyFile(src, dst, std::numeric_limits<uint64_t>::max());
+    }
+  }
+  rocksdb::Status enable_status = db->rep->EnableFileDeletions(false /* force */);
+  if (status.ok()) {
+    status = enable_status;
+  }
+  return ToDBStatus(status);
+}
+
+DBStatus DBSyncWAL(DBEngine* db) {
+  // A synchronous write of a batch holding only log data appends to
+  // the WAL and fsyncs it without modifying the database.
+  rocksdb::WriteOptions options;
+  options.sync = true;
+  rocksdb::WriteBatch batch;
+  batch.PutLogData("sync");
+  return ToDBStatus(db->rep->Write(options, &batch));
+}
+
+namespace {
+
+// GetInt64Property returns the value of the named integer property
+// of the database, or 0 if the property is not reported.
+int64_t GetInt64Property(rocksdb::DB* db, const std::string& name) {
+  std::string value;
+  if (!db->GetProperty(name, &value)) {
+    return 0;
+  }
+  return strtoll(value.c_str(), NULL, 10);
+}
+
+}  // namespace
+
+DBStatus DBGetLSMStats(DBEngine* db, int64_t* l0_file_count, int64_t* compaction_debt) {
+  *l0_file_count = GetInt64Property(db->rep, "rocksdb.num-files-at-level0");
+  *compaction_debt = GetInt64Property(db->rep, "rocksdb.estimate-pending-compaction-bytes");
+  return kSuccess;
+}
+
 DBStatus DBPut(DBEngine* db, DBSlice key, DBSlice value) {
   rocksdb::WriteOptions options;
   return ToDBStatus(db->rep->Put(options, ToSlice(key), ToSlice(value)));
@@ -694,6 +1112,7 @@ DBStatus DBMerge(DBEngine* db, DBSlice key, DBSlice value) {
 }
 
 DBStatus DBGet(DBEngine* db, DBSnapshot* snap, DBSlice key, DBString* value) {
+  BackgroundReadScope scope(snap != NULL && snap->background);
   std::string tmp;
   rocksdb::Status s = db->rep->Get(MakeReadOptions(snap), ToSlice(key), &tmp);
   if (!s.ok()) {
@@ -724,9 +1143,18 @@ DBSnapshot* DBNewSnapshot(DBEngine* db)  {
   DBSnapshot *snap = new DBSnapshot;
   snap->db = db->rep;
   snap->rep = db->rep->GetSnapshot();
+  snap->fill_cache = true;
+  snap->background = false;
   return snap;
 }
 
+void DBSnapshotSetBackground(DBEngine* db, DBSnapshot* snap) {
+  snap->background = true;
+  // Without a partition of its own, background reads don't fill the
+  // cache at all.
+  snap->fill_cache = db->background_cache;
+}
+
 void DBSnapshotRelease(DBSnapshot* snap) {
   snap->db->ReleaseSnapshot(snap->rep);
   delete snap;
@@ -735,6 +1163,7 @@ void DBSnapshotRelease(DBSnapshot* snap) {
 DBIterator* DBNewIter(DBEngine* db, DBSnapshot* snap) {
   DBIterator* iter = new DBIterator;
   iter->rep = db->rep->NewIterator(MakeReadOptions(snap));
+  iter->background = snap != NULL && snap->background;
   return iter;
 }
 
@@ -744,14 +1173,17 @@ void DBIterDestroy(DBIterator* iter) {
 }
 
 void DBIterSeek(DBIterator* iter, DBSlice key) {
+  BackgroundReadScope scope(iter->background);
   iter->rep->Seek(ToSlice(key));
 }
 
 void DBIterSeekToFirst(DBIterator* iter) {
+  BackgroundReadScope scope(iter->background);
   iter->rep->SeekToFirst();
 }
 
 void DBIterSeekToLast(DBIterator* iter) {
+  BackgroundReadScope scope(iter->background);
   iter->rep->SeekToLast();
 }
 
@@ -760,6 +1192,7 @@ int DBIterValid(DBIterator* iter) {
 }
 
 void DBIterNext(DBIterator* iter) {
+  BackgroundReadScope scope(iter->background);
   iter->rep->Next();
 }
 
@@ -49,12 +49,26 @@ typedef struct DBSnapshot DBSnapshot;
 
 typedef void (*DBLoggerFunc)(void* state, const char* str, int len);
 
+// DBCompression selects the compression of a database's tables.
+typedef enum {
+  DBCompressionDefault,  // RocksDB's default, Snappy
+  DBCompressionNone,
+  DBCompressionSnappy,
+  DBCompressionZlib,
+  DBCompressionLZ4,
+} DBCompression;
+
 // DBOptions contains local database options.
 typedef struct {
   int64_t cache_size;
+  // The share of cache_size reserved for blocks read through
+  // background snapshots. If zero, background reads don't fill the
+  // cache.
+  int64_t background_cache_size;
   int allow_os_buffer;
   // A function pointer to direct log messages to.
   DBLoggerFunc logger;
+  DBCompression compression;
 } DBOptions;
 
 // Opens the database located in "dir", creating it if it doesn't
@@ -86,6 +100,35 @@ DBStatus DBCompactRange(DBEngine* db, DBSlice* start, DBSlice* end);
 // range [start,end].
 uint64_t DBApproximateSize(DBEngine* db, DBSlice start, DBSlice end);
 
+// Computes the range of the wall times of the MVCC versions stored
+// in [start, end) from the properties of the SSTables overlapping the
+// span. The bounds are conservative, as a table's versions may lie
+// outside of the span. Versions still in the memtable are not covered;
+// they are treated as recent. If no versions are stored in the span,
+// *min_wall_time is INT64_MAX and *max_wall_time is INT64_MIN. *found
+// is set to 0 if any table lacks the timestamp properties, in which
+// case the bounds are unknown.
+DBStatus DBGetTimestampBounds(DBEngine* db, DBSlice start, DBSlice end,
+                               int64_t* min_wall_time, int64_t* max_wall_time, int* found);
+
+// Creates a checkpoint of the database in "dir", which must not yet
+// exist. The memtable is flushed and the live SSTables are hard-linked
+// into "dir" (or copied if "dir" is on another file system) along
+// with copies of the manifest and CURRENT files, so that "dir" can be
+// opened as a database holding the data as of the checkpoint.
+DBStatus DBCheckpoint(DBEngine* db, DBSlice dir);
+
+// Syncs the write-ahead log to disk, returning once the fsync
+// completes.
+DBStatus DBSyncWAL(DBEngine* db);
+
+// Sets *l0_file_count to the number of SSTables in level 0 of the LSM
+// tree, each of which may need to be consulted by a read, and
+// *compaction_debt to the estimated number of bytes compactions must
+// rewrite to bring the tree's levels within their target sizes.
+// Values which the database does not report are set to 0.
+DBStatus DBGetLSMStats(DBEngine* db, int64_t* l0_file_count, int64_t* compaction_debt);
+
 // Sets the database entry for "key" to "value".
 DBStatus DBPut(DBEngine* db, DBSlice key, DBSlice value);
 
@@ -109,6 +152,13 @@ DBStatus DBWrite(DBEngine* db, DBBatch *batch);
 // DBSnapshotRelease().
 DBSnapshot* DBNewSnapshot(DBEngine* db);
 
+// Marks reads using the snapshot as background reads. Background
+// scans over large amounts of data which is unlikely to be read again
+// soon should use such a snapshot so as not to evict the working set
+// of foreground reads: their blocks fill only the background partition
+// of the block cache or, if the database has none, aren't cached.
+void DBSnapshotSetBackground(DBEngine* db, DBSnapshot* snapshot);
+
 // Releases a snapshot, freeing up any associated memory and other
 // resources.
 void DBSnapshotRelease(DBSnapshot* snapshot);
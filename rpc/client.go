@@ -74,6 +74,7 @@ type Client struct {
 	healthy      bool
 	closed       bool
 	offset       proto.RemoteOffset // Latest measured clock offset from the server
+	latency      time.Duration      // Round-trip time of the latest heartbeat
 	clock        *hlc.Clock
 	remoteClocks *RemoteClockMonitor
 }
@@ -189,6 +190,29 @@ func (c *Client) RemoteOffset() proto.RemoteOffset {
 	return c.offset
 }
 
+// Latency returns the round-trip time of the client's most recent
+// successful heartbeat, or zero if none has been measured.
+func (c *Client) Latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latency
+}
+
+// Latencies returns the round-trip times of the most recent
+// heartbeats of the process-wide cached clients which are healthy,
+// keyed by server address.
+func Latencies() map[string]time.Duration {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	latencies := map[string]time.Duration{}
+	for addr, c := range clients {
+		if latency := c.Latency(); c.IsHealthy() && latency > 0 {
+			latencies[addr] = latency
+		}
+	}
+	return latencies
+}
+
 // Close removes the client from the clients map and closes
 // the Closed channel.
 func (c *Client) Close() {
@@ -235,6 +259,7 @@ func (c *Client) heartbeat() error {
 		log.V(1).Infof("client %s heartbeat: %v", c.Addr(), call.Error)
 		c.mu.Lock()
 		c.healthy = true
+		c.latency = time.Duration(receiveTime - sendTime)
 		c.offset.MeasuredAt = receiveTime
 		if receiveTime-sendTime > maximumClockReadingDelay.Nanoseconds() {
 			c.offset = proto.InfiniteOffset
@@ -52,9 +52,31 @@ func TestClientHeartbeat(t *testing.T) {
 		t.Fatal("expected cached client to be returned while healthy")
 	}
 	<-c.Ready
+	if c.Latency() <= 0 {
+		t.Errorf("expected heartbeat latency to be measured; got %s", c.Latency())
+	}
+	if _, ok := Latencies()[s.Addr().String()]; !ok {
+		t.Errorf("expected latency of %s in %v", s.Addr(), Latencies())
+	}
 	s.Close()
 }
 
+// TestOrderByLatency verifies that healthy clients are ordered by
+// increasing latency, followed by unhealthy clients.
+func TestOrderByLatency(t *testing.T) {
+	far := &Client{healthy: true, latency: 30 * time.Millisecond}
+	near := &Client{healthy: true, latency: 1 * time.Millisecond}
+	mid := &Client{healthy: true, latency: 5 * time.Millisecond}
+	down := &Client{healthy: false}
+	ordered := orderByLatency([]*Client{down, far, near, mid})
+	expected := []*Client{near, mid, far, down}
+	for i := range expected {
+		if ordered[i] != expected[i] {
+			t.Errorf("%d: expected client with latency %s; got %s", i, expected[i].latency, ordered[i].latency)
+		}
+	}
+}
+
 // TestClientHeartbeatBadServer verifies that the client is not marked
 // as "ready" until a heartbeat request succeeds.
 func TestClientHeartbeatBadServer(t *testing.T) {
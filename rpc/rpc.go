@@ -7,6 +7,8 @@ type Context struct {
 	localClock   *hlc.Clock
 	tlsConfig    *TLSConfig
 	RemoteClocks *RemoteClockMonitor
+	// ReusePort binds servers' TCP listeners with SO_REUSEPORT.
+	ReusePort bool
 }
 
 // NewContext creates an rpc Context with the supplied values.
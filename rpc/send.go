@@ -23,11 +23,25 @@ import (
 	"math/rand"
 	"net"
 	"net/rpc"
+	"sort"
 	"time"
 
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/fault"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+var (
+	// rpcSends counts the RPCs sent via Send.
+	rpcSends = metrics.DefaultRegistry.Counter("rpc.sends")
+	// rpcSendErrors counts the RPCs sent via Send which failed, timed
+	// out or whose connection was closed.
+	rpcSendErrors = metrics.DefaultRegistry.Counter("rpc.send.errors")
+	// rpcSendLatency records the latency in nanoseconds of the RPCs
+	// sent via Send which completed.
+	rpcSendLatency = metrics.DefaultRegistry.Histogram("rpc.send.latency", metrics.DefaultWindow)
 )
 
 // OrderingPolicy is an enum for ordering strategies when there
@@ -39,6 +53,9 @@ const (
 	OrderStable = iota
 	// OrderRandom randomly orders available endpoints.
 	OrderRandom
+	// OrderByLatency orders available endpoints by the round-trip time
+	// of their most recent heartbeat, nearest first.
+	OrderByLatency
 )
 
 // An Options structure describes the algorithm for sending RPCs to
@@ -126,11 +143,12 @@ func Send(opts Options, method string, addrs []net.Addr, getArgs func(addr net.A
 		for _, idx := range rand.Perm(len(unhealthy)) {
 			clients = append(clients, unhealthy[idx])
 		}
+	case OrderByLatency:
+		for _, addr := range addrs {
+			clients = append(clients, NewClient(addr, nil, context))
+		}
+		clients = orderByLatency(clients)
 	}
-	// TODO(spencer): going to need to also sort by affinity; closest
-	// ping time should win. Makes sense to have the rpc client/server
-	// heartbeat measure ping times. With a bit of seasoning, each
-	// node will be able to order the healthy replicas based on latency.
 
 	replies := []interface{}(nil)
 	helperChan := make(chan interface{}, len(clients))
@@ -202,10 +220,19 @@ func Send(opts Options, method string, addrs []net.Addr, getArgs func(addr net.A
 // otherwise an error is sent.
 func sendOne(client *Client, timeout time.Duration, method string, args, reply interface{}, c chan interface{}) {
 	<-client.Ready
+	fault.MaybeDelay(fault.RPCSend)
+	if err := fault.MaybeError(fault.RPCSend); err != nil {
+		c <- rpcError{err.Error()}
+		return
+	}
+	rpcSends.Inc(1)
+	start := time.Now()
 	call := client.Go(method, args, reply, nil)
 	select {
 	case <-call.Done:
+		rpcSendLatency.RecordDuration(time.Since(start))
 		if call.Error != nil {
+			rpcSendErrors.Inc(1)
 			// Handle cases which are retryable.
 			switch call.Error {
 			case rpc.ErrShutdown: // client connection fails: rpc/client.go
@@ -229,8 +256,37 @@ func sendOne(client *Client, timeout time.Duration, method string, args, reply i
 			c <- reply
 		}
 	case <-client.Closed:
+		rpcSendErrors.Inc(1)
 		c <- rpcError{fmt.Sprintf("rpc to %s failed as client connection was closed", method)}
 	case <-time.After(timeout):
+		rpcSendErrors.Inc(1)
 		c <- rpcError{fmt.Sprintf("rpc to %s timed out after %s", method, timeout)}
 	}
 }
+
+// orderByLatency returns the clients ordered by heartbeat latency,
+// nearest first. Known-unhealthy clients, whose latency is unknown or
+// stale, are kept last in random order.
+func orderByLatency(clients []*Client) []*Client {
+	var healthy, unhealthy []*Client
+	for _, client := range clients {
+		if client.IsHealthy() {
+			healthy = append(healthy, client)
+		} else {
+			unhealthy = append(unhealthy, client)
+		}
+	}
+	sort.Sort(clientsByLatency(healthy))
+	ordered := healthy
+	for _, idx := range rand.Perm(len(unhealthy)) {
+		ordered = append(ordered, unhealthy[idx])
+	}
+	return ordered
+}
+
+// clientsByLatency sorts clients by increasing heartbeat latency.
+type clientsByLatency []*Client
+
+func (cl clientsByLatency) Len() int           { return len(cl) }
+func (cl clientsByLatency) Swap(i, j int)      { cl[i], cl[j] = cl[j], cl[i] }
+func (cl clientsByLatency) Less(i, j int) bool { return cl[i].Latency() < cl[j].Latency() }
@@ -73,7 +73,7 @@ func (s *Server) AddCloseCallback(cb func(conn net.Conn)) {
 // Start runs the RPC server. After this method returns, the socket
 // will have been bound. Use Server.Addr() to ascertain server address.
 func (s *Server) Start() error {
-	ln, err := tlsListen(s.addr.Network(), s.addr.String(), s.context.tlsConfig)
+	ln, err := tlsListen(s.addr.Network(), s.addr.String(), s.context.tlsConfig, s.context.ReusePort)
 	if err != nil {
 		return err
 	}
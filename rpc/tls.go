@@ -29,6 +29,7 @@ import (
 	"path"
 	"sync"
 
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
@@ -105,17 +106,22 @@ func LoadTestTLSConfig(projectRoot string) (*TLSConfig, error) {
 	return LoadTLSConfig(path.Join(projectRoot, "resources", "test_certs"))
 }
 
-// tlsListen wraps either net.Listen or crypto/tls.Listen, depending on the contents of
-// the passed TLSConfig.
-func tlsListen(network string, address string, config *TLSConfig) (net.Listener, error) {
+// tlsListen listens on the address, wrapping the listener with
+// crypto/tls depending on the contents of the passed TLSConfig. If
+// reusePort is true, TCP sockets are bound with SO_REUSEPORT.
+func tlsListen(network string, address string, config *TLSConfig, reusePort bool) (net.Listener, error) {
+	ln, err := util.Listen(network, address, reusePort)
+	if err != nil {
+		return nil, err
+	}
 	cfg := config.Config()
 	if cfg == nil {
 		if network != "unix" {
 			log.Warningf("Listening via %s to %s without TLS", network, address)
 		}
-		return net.Listen(network, address)
+		return ln, nil
 	}
-	return tls.Listen(network, address, cfg)
+	return tls.NewListener(ln, cfg), nil
 }
 
 // tlsDial wraps either net.Dial or crypto/tls.Dial, depending on the contents of
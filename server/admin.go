@@ -19,19 +19,28 @@
 package server
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	// This is imported for its side-effect of registering expvar
 	// endpoints with the http.DefaultServeMux.
 	_ "expvar"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	// This is imported for its side-effect of registering pprof
 	// endpoints with the http.DefaultServeMux.
 	_ "net/http/pprof"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/structured"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 const (
@@ -47,14 +56,62 @@ const (
 	// debugEndpoint is the prefix of golang's standard debug functionality
 	// for access to exported vars and pprof tools.
 	debugEndpoint = "/debug/"
+	// groupsPathPrefix is the prefix for group membership changes:
+	// <prefix>/<group>.
+	groupsPathPrefix = adminEndpoint + "groups"
 	// healthzPath is the healthz endpoint.
 	healthzPath = adminEndpoint + "healthz"
+	// logsPath is the path for the rotation and retention of the
+	// node's log files.
+	logsPath = adminEndpoint + "logs"
+	// loginPath is the path for creating sessions.
+	loginPath = adminEndpoint + "login"
+	// logoutPath is the path for revoking sessions.
+	logoutPath = adminEndpoint + "logout"
 	// acctPathPrefix is the prefix for accounting configuration changes.
 	acctPathPrefix = adminEndpoint + "acct"
 	// permPathPrefix is the prefix for permission configuration changes.
 	permPathPrefix = adminEndpoint + "perms"
 	// zonePathPrefix is the prefix for zone configuration changes.
 	zonePathPrefix = adminEndpoint + "zones"
+	// metaBackupPath is the path for fetching a snapshot of the
+	// cluster metadata.
+	metaBackupPath = adminEndpoint + "meta-backup"
+	// backupSchedulesPathPrefix is the prefix for backup schedule
+	// changes: <prefix>/<schedule-name>.
+	backupSchedulesPathPrefix = adminEndpoint + "backup-schedules"
+	// changefeedsPath is the path for creating changefeeds.
+	changefeedsPath = adminEndpoint + "changefeeds"
+	// schemaChangesPath is the path for adding columns to structured
+	// schemas online.
+	schemaChangesPath = adminEndpoint + "schema-changes"
+	// explainPathPrefix is the prefix for explaining structured reads:
+	// <prefix>/<schema-key>/<table>.
+	explainPathPrefix = adminEndpoint + "explain"
+	// jobsPathPrefix is the prefix for listing, pausing, resuming and
+	// canceling jobs: <prefix>/<job-id>/<action>.
+	jobsPathPrefix = adminEndpoint + "jobs"
+	// queuesPathPrefix is the prefix for pausing, disabling and
+	// enabling store queues: <prefix>/<store-id>/<queue>.
+	queuesPathPrefix = adminEndpoint + "queues"
+	// tableStatsPathPrefix is the prefix for creating table stats jobs
+	// and fetching table stats: <prefix>/<schema-key>/<table>.
+	tableStatsPathPrefix = adminEndpoint + "table-stats"
+	// settingsPathPrefix is the prefix for cluster setting changes:
+	// <prefix>/<setting-key>.
+	settingsPathPrefix = adminEndpoint + "settings"
+	// transactionsPathPrefix is the prefix for canceling transactions
+	// coordinated by the node: <prefix>/<txn-id>/cancel.
+	transactionsPathPrefix = adminEndpoint + "transactions"
+	// placementDryRunPath predicts the replica movement caused by
+	// taking nodes down or changing a zone config.
+	placementDryRunPath = adminEndpoint + "placement-dry-run"
+	// raftLogPathPrefix is the prefix for debugging the Raft logs of
+	// the node's replicas: <prefix>/<raft-id>.
+	raftLogPathPrefix = adminEndpoint + "raft-log"
+	// systemPathPrefix is the prefix for browsing system tables:
+	// <prefix>/<table>.
+	systemPathPrefix = adminEndpoint + "system"
 )
 
 // An actionHandler is an interface which provides Get, Put & Delete
@@ -68,20 +125,61 @@ type actionHandler interface {
 // A adminServer provides a RESTful HTTP API to administration of
 // the cockroach cluster.
 type adminServer struct {
-	db   *client.KV // Key-value database client
-	acct *acctHandler
-	perm *permHandler
-	zone *zoneHandler
+	db        *client.KV      // Key-value database client
+	stores    *kv.LocalSender // Node-local stores
+	acct      *acctHandler
+	perm      *permHandler
+	groups    *groupHandler
+	zone      *zoneHandler
+	backups   *backupScheduleHandler
+	settings  *settingsHandler
+	jobs      *jobRegistry
+	scheduler *backupScheduler
+	sessions  *sessionManager
+	txns      *kv.TxnCoordSender       // Nil if not coordinating transactions
+	schemas   *structured.SchemaLeases // Nil until the node has started
 }
 
 // newAdminServer allocates and returns a new REST server for
 // administrative APIs.
-func newAdminServer(db *client.KV) *adminServer {
-	return &adminServer{
-		db:   db,
-		acct: &acctHandler{db: db},
-		perm: &permHandler{db: db},
-		zone: &zoneHandler{db: db},
+func newAdminServer(db *client.KV, stores *kv.LocalSender) *adminServer {
+	s := &adminServer{
+		db:       db,
+		stores:   stores,
+		acct:     &acctHandler{db: db},
+		perm:     &permHandler{db: db},
+		groups:   &groupHandler{db: db},
+		zone:     &zoneHandler{db: db, findStores: findGossipedStores(stores)},
+		backups:  &backupScheduleHandler{db: db},
+		settings: &settingsHandler{db: db},
+		jobs:     newJobRegistry(db),
+		sessions: newSessionManager(db),
+	}
+	s.jobs.register(backupJobType, s.runBackup)
+	s.jobs.register(changefeedJobType, s.runChangefeed)
+	s.jobs.register(schemaChangeJobType, s.runSchemaChange)
+	s.jobs.register(tableStatsJobType, s.runTableStats)
+	s.scheduler = &backupScheduler{db: db, jobs: s.jobs}
+	return s
+}
+
+// findGossipedStores returns a function which finds gossiped stores
+// using the first of the node's local stores. All local stores share
+// the node's gossip network, so any one of them suffices.
+func findGossipedStores(stores *kv.LocalSender) storage.FindStoreFunc {
+	return func(required proto.Attributes) ([]*storage.StoreDescriptor, error) {
+		var result []*storage.StoreDescriptor
+		var found bool
+		err := stores.VisitStores(func(s *storage.Store) error {
+			if found {
+				return nil
+			}
+			found = true
+			var err error
+			result, err = s.FindStores(required)
+			return err
+		})
+		return result, err
 	}
 }
 
@@ -92,10 +190,34 @@ func (s *adminServer) RegisterHandlers(mux *http.ServeMux) {
 	// get exported variables and pprof tools.
 	mux.HandleFunc(acctPathPrefix, s.handleAcctAction)
 	mux.HandleFunc(acctPathPrefix+"/", s.handleAcctAction)
+	mux.HandleFunc(backupSchedulesPathPrefix, s.handleBackupScheduleAction)
+	mux.HandleFunc(backupSchedulesPathPrefix+"/", s.handleBackupScheduleAction)
+	mux.HandleFunc(changefeedsPath, s.handleChangefeedsAction)
 	mux.HandleFunc(debugEndpoint, s.handleDebug)
+	mux.HandleFunc(explainPathPrefix+"/", s.handleExplainAction)
+	mux.HandleFunc(groupsPathPrefix, s.handleGroupAction)
+	mux.HandleFunc(groupsPathPrefix+"/", s.handleGroupAction)
 	mux.HandleFunc(healthzPath, s.handleHealthz)
+	mux.HandleFunc(jobsPathPrefix, s.handleJobsAction)
+	mux.HandleFunc(jobsPathPrefix+"/", s.handleJobsAction)
+	mux.HandleFunc(logsPath, s.handleLogsAction)
+	mux.HandleFunc(loginPath, s.sessions.handleLogin)
+	mux.HandleFunc(logoutPath, s.sessions.handleLogout)
+	mux.HandleFunc(metaBackupPath, s.handleMetaBackup)
 	mux.HandleFunc(permPathPrefix, s.handlePermAction)
 	mux.HandleFunc(permPathPrefix+"/", s.handlePermAction)
+	mux.HandleFunc(placementDryRunPath, s.handlePlacementDryRun)
+	mux.HandleFunc(queuesPathPrefix, s.handleQueuesAction)
+	mux.HandleFunc(queuesPathPrefix+"/", s.handleQueuesAction)
+	mux.HandleFunc(raftLogPathPrefix+"/", s.handleRaftLogAction)
+	mux.HandleFunc(schemaChangesPath, s.handleSchemaChangesAction)
+	mux.HandleFunc(settingsPathPrefix, s.handleSettingsAction)
+	mux.HandleFunc(settingsPathPrefix+"/", s.handleSettingsAction)
+	mux.HandleFunc(tableStatsPathPrefix, s.handleTableStatsAction)
+	mux.HandleFunc(tableStatsPathPrefix+"/", s.handleTableStatsAction)
+	mux.HandleFunc(transactionsPathPrefix+"/", s.handleTransactionsAction)
+	mux.HandleFunc(systemPathPrefix, s.handleSystemTables)
+	mux.HandleFunc(systemPathPrefix+"/", s.handleSystemTables)
 	mux.HandleFunc(zonePathPrefix, s.handleZoneAction)
 	mux.HandleFunc(zonePathPrefix+"/", s.handleZoneAction)
 }
@@ -108,12 +230,41 @@ func (s *adminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
 
 // handleDebug passes requests with the debugPathPrefix onto the default
 // serve mux, which is preconfigured (by import of expvar and net/http/pprof)
-// to serve endpoints which access exported variables and pprof tools.
+// to serve endpoints which access exported variables, pprof tools and
+// execution traces. Requests must first pass authorizeDebug.
 func (s *adminServer) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if err := authorizeDebug(r, *adminToken); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	handler, _ := http.DefaultServeMux.Handler(r)
 	handler.ServeHTTP(w, r)
 }
 
+// authorizeDebug returns an error if the request may not access the
+// debug or system table endpoints, which expose process internals and
+// cluster configuration and can consume significant resources (e.g.
+// CPU profiles). If token is non-empty,
+// requests presenting it as a bearer token are authorized. Otherwise,
+// or if no token is presented, only requests originating from the
+// loopback interface are authorized.
+func authorizeDebug(r *http.Request, token string) error {
+	if auth := r.Header.Get("Authorization"); token != "" && auth != "" {
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			return util.Errorf("invalid admin token")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return util.Errorf("unable to parse remote address %q: %s", r.RemoteAddr, err)
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return util.Errorf("non-local requests require an admin token")
+	}
+	return nil
+}
+
 // TODO(bram): using a single handler instead of one each for zone/perm/acct
 // handleAcctAction handles actions for accounting configuration by method.
 func (s *adminServer) handleAcctAction(w http.ResponseWriter, r *http.Request) {
@@ -157,6 +308,93 @@ func (s *adminServer) handleZoneAction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleQueuesAction lists the state of each store's queues on GET
+// and sets the state of a queue on PUT or POST to
+// <prefix>/<store-id>/<queue>, with the body containing one of
+// "enabled", "paused" or "disabled".
+func (s *adminServer) handleQueuesAction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		states := map[string]map[string]string{}
+		if err := s.stores.VisitStores(func(store *storage.Store) error {
+			storeStates := map[string]string{}
+			for name, state := range store.QueueStates() {
+				storeStates[name] = state.String()
+			}
+			states[strconv.Itoa(int(store.StoreID()))] = storeStates
+			return nil
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(states)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case "PUT", "POST":
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, queuesPathPrefix), "/"), "/")
+		if len(parts) != 2 {
+			http.Error(w, "expected path "+queuesPathPrefix+"/<store-id>/<queue>", http.StatusBadRequest)
+			return
+		}
+		storeID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid store ID %q: %s", parts[0], err), http.StatusBadRequest)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+		state, err := storage.ParseQueueState(strings.TrimSpace(string(b)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		store, err := s.stores.GetStore(int32(storeID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := store.SetQueueState(parts[1], state); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	}
+}
+
+// handleTransactionsAction handles POST requests to cancel open
+// transactions coordinated by the node, as listed by the
+// transactions status endpoint.
+func (s *adminServer) handleTransactionsAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" && r.Method != "POST" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, transactionsPathPrefix), "/"), "/")
+	if len(parts) != 2 || parts[1] != "cancel" {
+		http.Error(w, "expected path "+transactionsPathPrefix+"/<txn-id>/cancel", http.StatusBadRequest)
+		return
+	}
+	if s.txns == nil {
+		http.Error(w, "node is not coordinating transactions", http.StatusNotFound)
+		return
+	}
+	if err := s.txns.CancelTxn(parts[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func unescapePath(path, prefix string) (string, error) {
 	result, err := url.QueryUnescape(strings.TrimPrefix(path, prefix))
 	if err != nil {
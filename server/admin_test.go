@@ -22,11 +22,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/log"
 )
@@ -40,7 +44,7 @@ func startAdminServer() *httptest.Server {
 	if err != nil {
 		log.Fatal(err)
 	}
-	admin := newAdminServer(db)
+	admin := newAdminServer(db, kv.NewLocalSender())
 	mux := http.NewServeMux()
 	admin.RegisterHandlers(mux)
 	httpServer := httptest.NewServer(mux)
@@ -107,3 +111,217 @@ func TestAdminDebugPprof(t *testing.T) {
 		t.Errorf("expected match: %t; err nil: %v", matches, err)
 	}
 }
+
+// TestAuthorizeDebug verifies that debug endpoints are restricted to
+// loopback requests or requests presenting the admin token.
+func TestAuthorizeDebug(t *testing.T) {
+	testCases := []struct {
+		remoteAddr, auth, token string
+		expOK                   bool
+	}{
+		{"127.0.0.1:1234", "", "", true},
+		{"[::1]:1234", "", "", true},
+		{"10.0.0.1:1234", "", "", false},
+		{"10.0.0.1:1234", "", "secret", false},
+		{"10.0.0.1:1234", "Bearer secret", "secret", true},
+		{"10.0.0.1:1234", "Bearer wrong", "secret", false},
+		// A wrong token is rejected even from loopback.
+		{"127.0.0.1:1234", "Bearer wrong", "secret", false},
+		// Tokens are ignored if none is configured.
+		{"10.0.0.1:1234", "Bearer secret", "", false},
+	}
+	for i, test := range testCases {
+		req, err := http.NewRequest("GET", "/debug/pprof/heap", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		if err := authorizeDebug(req, test.token); (err == nil) != test.expOK {
+			t.Errorf("%d: expected ok=%t; got %v", i, test.expOK, err)
+		}
+	}
+}
+
+// TestAdminQueues verifies listing queue states and the handling of
+// unknown stores.
+func TestAdminQueues(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+	jI, err := getJSON(s.URL + queuesPathPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := jI.(map[string]interface{}); !ok {
+		t.Errorf("expected JSON object; got %v", jI)
+	}
+	req, err := http.NewRequest("PUT", s.URL+queuesPathPrefix+"/1/scan", strings.NewReader("paused"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendAdminRequest(req); err == nil {
+		t.Error("expected error pausing queue on unknown store")
+	}
+}
+
+// TestAdminPlacementDryRun verifies that placement dry runs require
+// a change and plan the ranges of the node's stores.
+func TestAdminPlacementDryRun(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+	req, err := http.NewRequest("POST", s.URL+placementDryRunPath, strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendAdminRequest(req); err == nil {
+		t.Error("expected error for dry run without a change")
+	}
+	if req, err = http.NewRequest("POST", s.URL+placementDryRunPath, strings.NewReader(`{"down_nodes": [2]}`)); err != nil {
+		t.Fatal(err)
+	}
+	body, err := sendAdminRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan storage.PlacementPlan
+	if err := json.Unmarshal(body, &plan); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Ranges) != 0 || plan.Bytes != 0 {
+		t.Errorf("expected no movement without local stores; got %+v", plan)
+	}
+}
+
+// TestAdminLogs verifies fetching and changing the rotation and
+// retention of log files.
+func TestAdminLogs(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+	defer log.SetFileConfig(log.FileConfig{})
+	req, err := http.NewRequest("PUT", s.URL+logsPath,
+		strings.NewReader(`{"max_file_size": 1048576, "max_total_size": 0, "max_age": "720h"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendAdminRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	expected := log.FileConfig{MaxFileSize: 1 << 20, MaxAge: 720 * time.Hour}
+	if cfg := log.GetFileConfig(); cfg != expected {
+		t.Errorf("expected log config %+v; got %+v", expected, cfg)
+	}
+	jI, err := getJSON(s.URL + logsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := jI.(map[string]interface{}); !ok || m["max_age"] != "720h0m0s" {
+		t.Errorf("expected max_age of 720h0m0s; got %v", jI)
+	}
+	req, err = http.NewRequest("PUT", s.URL+logsPath, strings.NewReader(`{"max_age": "-1h"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendAdminRequest(req); err == nil {
+		t.Error("expected error setting negative max age")
+	}
+}
+
+// TestAdminSystemTables verifies listing system tables and paging
+// through the zone configs and range descriptors of a bootstrapped
+// cluster.
+func TestAdminSystemTables(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+	jI, err := getJSON(s.URL + systemPathPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, ok := jI.([]interface{}); !ok || len(names) != len(systemTables) {
+		t.Errorf("expected %d system tables; got %v", len(systemTables), jI)
+	}
+
+	// getPage fetches and decodes a page of a system table.
+	type page struct {
+		Rows []struct {
+			Key string
+		}
+		NextKey string `json:"next_key"`
+	}
+	getPage := func(path string) (*page, []byte) {
+		body, err := getText(s.URL + systemPathPrefix + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &page{}
+		if err := json.Unmarshal(body, p); err != nil {
+			t.Fatalf("unable to unmarshal %s: %s", body, err)
+		}
+		return p, body
+	}
+
+	p, body := getPage("/zones")
+	if len(p.Rows) != 1 || p.NextKey != "" {
+		t.Errorf("expected the default zone config; got %s", body)
+	}
+	if !strings.Contains(string(body), "range_max_bytes") {
+		t.Errorf("expected decoded zone config; got %s", body)
+	}
+
+	// Page through range descriptors one at a time. The bootstrapped
+	// cluster has a meta1 and a meta2 descriptor for the first range.
+	var keys []string
+	for start := ""; ; {
+		p, _ := getPage("/descriptors?limit=1&start=" + start)
+		for _, row := range p.Rows {
+			keys = append(keys, row.Key)
+		}
+		if p.NextKey == "" {
+			break
+		}
+		start = p.NextKey
+	}
+	if len(keys) != 2 {
+		t.Errorf("expected 2 range descriptors; got %q", keys)
+	}
+
+	if _, err := getJSON(s.URL + systemPathPrefix + "/unknown"); err == nil {
+		t.Error("expected error fetching unknown system table")
+	}
+}
+
+// TestAdminMetaBackup verifies that a metadata backup contains the
+// full contents of each system table and the ID generators.
+func TestAdminMetaBackup(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+	body, err := getText(s.URL + metaBackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup struct {
+		Tables map[string]struct {
+			Rows []struct {
+				Key string
+			}
+			NextKey string `json:"next_key"`
+		}
+		IDGenerators map[string]int64 `json:"id_generators"`
+	}
+	if err := json.Unmarshal(body, &backup); err != nil {
+		t.Fatalf("unable to unmarshal %s: %s", body, err)
+	}
+	if len(backup.Tables) != len(systemTables) {
+		t.Errorf("expected %d system tables; got %s", len(systemTables), body)
+	}
+	for name, expRows := range map[string]int{"accounting": 1, "descriptors": 2, "permissions": 1, "zones": 1} {
+		if table := backup.Tables[name]; len(table.Rows) != expRows || table.NextKey != "" {
+			t.Errorf("expected %d rows in %s; got %+v", expRows, name, table)
+		}
+	}
+	expGens := map[string]int64{"node-idgen": 1, "store-idgen-1": 1}
+	if !reflect.DeepEqual(backup.IDGenerators, expGens) {
+		t.Errorf("expected ID generators %v; got %v", expGens, backup.IDGenerators)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/cloud"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var (
+	// auditLogPath and auditLogURI specify the sinks of the audit log,
+	// which records administrative operations and, optionally, access
+	// to sensitive data. The audit log is disabled unless one is set.
+	auditLogPath = flag.String("audit_log", "", "file to which audit log entries are appended")
+	auditLogURI  = flag.String("audit_log_uri", "", "external storage URI (e.g. s3://bucket/audit) "+
+		"to which audit log entries are periodically uploaded")
+	// auditKeyPrefixes specifies the sensitive data whose access is
+	// audited.
+	auditKeyPrefixes = flag.String("audit_key_prefixes", "", "comma-separated list of key "+
+		"prefixes; reads and writes of keys with these prefixes by clients of this node "+
+		"are recorded in the audit log")
+)
+
+// auditFlushInterval is the interval at which audit log entries are
+// uploaded to external storage.
+const auditFlushInterval = 10 * time.Second
+
+// An auditEntry is a structured record of an audited operation.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Source is the remote address of an HTTP request.
+	Source string `json:"source,omitempty"`
+	// Auth is the means by which an HTTP request authenticated:
+	// "session", "token" or "none".
+	Auth string `json:"auth,omitempty"`
+	// User is the user of a key-value operation.
+	User string `json:"user,omitempty"`
+	// Operation is the HTTP method or key-value method.
+	Operation string `json:"operation"`
+	// Target is the path of an HTTP request or the key or key range
+	// of a key-value operation.
+	Target string `json:"target"`
+	// Status is the HTTP status of the response.
+	Status int `json:"status,omitempty"`
+	// Error is the error of a failed key-value operation.
+	Error string `json:"error,omitempty"`
+}
+
+// An auditLogger writes audit log entries as lines of JSON to a file
+// and to external storage, where entries are uploaded periodically to
+// files named by the node's host and the time of the upload. A nil
+// auditLogger records nothing.
+type auditLogger struct {
+	prefixes []proto.Key
+	file     *os.File              // Nil unless -audit_log is set
+	storage  cloud.ExternalStorage // Nil unless -audit_log_uri is set
+	host     string
+	stopper  *util.Stopper
+
+	mu      sync.Mutex   // Protects pending and writes to file
+	pending bytes.Buffer // Entries not yet uploaded to storage
+}
+
+// newAuditLogger returns an auditLogger writing to the file at path
+// and to the external storage at uri, auditing access to keys with
+// the comma-separated prefixes. Returns nil if neither path nor uri
+// is set.
+func newAuditLogger(path, uri, prefixes, host string) (*auditLogger, error) {
+	if path == "" && uri == "" {
+		if prefixes != "" {
+			return nil, util.Errorf("audited key prefixes require -audit_log or -audit_log_uri")
+		}
+		return nil, nil
+	}
+	al := &auditLogger{
+		host:    host,
+		stopper: util.NewStopper(1),
+	}
+	for _, p := range strings.Split(prefixes, ",") {
+		if p != "" {
+			al.prefixes = append(al.prefixes, proto.Key(p))
+		}
+	}
+	if uri != "" {
+		var err error
+		if al.storage, err = cloud.FromURI(uri); err != nil {
+			return nil, err
+		}
+	}
+	if path != "" {
+		var err error
+		if al.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return nil, util.Errorf("unable to open audit log: %s", err)
+		}
+	}
+	return al, nil
+}
+
+// start launches the goroutine uploading entries to external storage.
+func (al *auditLogger) start() {
+	if al == nil {
+		return
+	}
+	go util.RunLabeled("audit", func() {
+		ticker := time.NewTicker(auditFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				al.flush()
+			case <-al.stopper.ShouldStop():
+				al.flush()
+				al.stopper.SetStopped()
+				return
+			}
+		}
+	})
+}
+
+// stop uploads pending entries and closes the audit log file.
+func (al *auditLogger) stop() {
+	if al == nil {
+		return
+	}
+	al.stopper.Stop()
+	if al.file != nil {
+		al.file.Close()
+	}
+}
+
+// record writes the entry to the audit log.
+func (al *auditLogger) record(e auditEntry) {
+	if al == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("unable to encode audit log entry %+v: %s", e, err)
+		return
+	}
+	line = append(line, '\n')
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.file != nil {
+		if _, err := al.file.Write(line); err != nil {
+			log.Errorf("unable to write audit log entry %s: %s", line, err)
+		}
+	}
+	if al.storage != nil {
+		al.pending.Write(line)
+	}
+}
+
+// flush uploads pending entries to external storage. Entries which
+// fail to upload are retained for the next flush.
+func (al *auditLogger) flush() {
+	if al.storage == nil {
+		return
+	}
+	al.mu.Lock()
+	content := append([]byte(nil), al.pending.Bytes()...)
+	al.pending.Reset()
+	al.mu.Unlock()
+	if len(content) == 0 {
+		return
+	}
+	name := fmt.Sprintf("audit-%s-%020d.log", al.host, time.Now().UnixNano())
+	if err := al.storage.WriteFile(name, content); err != nil {
+		log.Errorf("unable to upload audit log to %s: %s", al.storage, err)
+		al.mu.Lock()
+		// Retain the entries ahead of those recorded since.
+		rest := append(content, al.pending.Bytes()...)
+		al.pending.Reset()
+		al.pending.Write(rest)
+		al.mu.Unlock()
+	}
+}
+
+// auditedKeys returns whether the span from key to endKey, or only
+// key if endKey is empty, includes keys with an audited prefix.
+func (al *auditLogger) auditedKeys(key, endKey proto.Key) bool {
+	for _, p := range al.prefixes {
+		if bytes.HasPrefix(key, p) {
+			return true
+		}
+		if len(endKey) > 0 && key.Less(p.PrefixEnd()) && p.Less(endKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// auditHTTP returns whether HTTP requests with the given method and
+// path are audited: all requests for the debug endpoints and requests
+// modifying state via the admin endpoints, which include permission
+// changes, logins and logouts.
+func auditHTTP(method, path string) bool {
+	if strings.HasPrefix(path, debugEndpoint) {
+		return true
+	}
+	return strings.HasPrefix(path, adminEndpoint) && method != "GET" && method != "HEAD"
+}
+
+// httpAuth returns the means by which r authenticates.
+func httpAuth(r *http.Request) string {
+	if r.Header.Get("Authorization") != "" {
+		return "token"
+	}
+	if _, err := r.Cookie(sessionCookieName); err == nil {
+		return "session"
+	}
+	return "none"
+}
+
+// statusRecorder records the status of an HTTP response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// An auditSender is a client.KVSender which records admin operations,
+// and reads and writes of keys with audited prefixes, in the audit
+// log after sending them via the wrapped sender.
+type auditSender struct {
+	wrapped client.KVSender
+	audit   *auditLogger
+}
+
+// Send implements the client.KVSender interface.
+func (as *auditSender) Send(call *client.Call) {
+	as.wrapped.Send(call)
+	header := call.Args.Header()
+	if !proto.IsAdmin(call.Method) && !as.audit.auditedKeys(header.Key, header.EndKey) {
+		return
+	}
+	target := fmt.Sprintf("%q", header.Key)
+	if len(header.EndKey) > 0 {
+		target += fmt.Sprintf("-%q", header.EndKey)
+	}
+	e := auditEntry{
+		Time:      time.Now(),
+		User:      header.User,
+		Operation: call.Method,
+		Target:    target,
+	}
+	if err := call.Reply.Header().GoError(); err != nil {
+		e.Error = err.Error()
+	}
+	as.audit.record(e)
+}
+
+// Close implements the client.KVSender interface.
+func (as *auditSender) Close() {
+	as.wrapped.Close()
+}
@@ -0,0 +1,129 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/cloud"
+)
+
+// noopSender is a client.KVSender which sends nothing.
+type noopSender struct{}
+
+func (noopSender) Send(call *client.Call) {}
+func (noopSender) Close()                 {}
+
+// TestAuditedKeys verifies that keys and key ranges are audited if
+// they include keys with an audited prefix.
+func TestAuditedKeys(t *testing.T) {
+	al := &auditLogger{prefixes: []proto.Key{proto.Key("b"), proto.Key("secret-")}}
+	testCases := []struct {
+		key, endKey string
+		expect      bool
+	}{
+		{"a", "", false},
+		{"b", "", true},
+		{"ba", "", true},
+		{"secret-x", "", true},
+		{"secret", "", false},
+		{"a", "b", false},
+		{"a", "ba", true},
+		{"a", "z", true},
+		{"c", "secret-", false},
+		{"c", "secret-0", true},
+		{"secret-z", "t", true},
+		{"t", "z", false},
+	}
+	for i, test := range testCases {
+		var endKey proto.Key
+		if test.endKey != "" {
+			endKey = proto.Key(test.endKey)
+		}
+		if audited := al.auditedKeys(proto.Key(test.key), endKey); audited != test.expect {
+			t.Errorf("%d: expected %q-%q audited=%t", i, test.key, test.endKey, test.expect)
+		}
+	}
+}
+
+// TestAuditLog verifies that admin operations and accesses of
+// audited keys are written to the audit log file and uploaded to
+// external storage.
+func TestAuditLog(t *testing.T) {
+	dirs := createTempDirs(2, t)
+	defer resetTestData(dirs)
+	path := filepath.Join(dirs[0], "audit.log")
+	al, err := newAuditLogger(path, "nodelocal://"+dirs[1], "secret-", "host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.start()
+	sender := &auditSender{wrapped: noopSender{}, audit: al}
+	calls := []*client.Call{
+		{Method: proto.Put, Args: &proto.PutRequest{RequestHeader: proto.RequestHeader{Key: proto.Key("secret-a"), User: "root"}}, Reply: &proto.PutResponse{}},
+		{Method: proto.Get, Args: &proto.GetRequest{RequestHeader: proto.RequestHeader{Key: proto.Key("public")}}, Reply: &proto.GetResponse{}},
+		{Method: proto.AdminSplit, Args: &proto.AdminSplitRequest{RequestHeader: proto.RequestHeader{Key: proto.Key("m")}}, Reply: &proto.AdminSplitResponse{}},
+	}
+	for _, call := range calls {
+		sender.Send(call)
+	}
+	// Stopping uploads the pending entries.
+	al.stop()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ops []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, e.Operation)
+	}
+	if len(ops) != 2 || ops[0] != proto.Put || ops[1] != proto.AdminSplit {
+		t.Errorf("expected put and split to be audited; got %v", ops)
+	}
+
+	es, err := cloud.FromURI("nodelocal://" + dirs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := es.ListFiles()
+	if err != nil || len(names) != 1 {
+		t.Fatalf("expected one uploaded audit log file; got %v, %v", names, err)
+	}
+	uploaded, err := ioutil.ReadFile(filepath.Join(dirs[1], names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(uploaded) != string(written) {
+		t.Errorf("expected uploaded entries %q to match written entries %q", uploaded, written)
+	}
+}
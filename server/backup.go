@@ -0,0 +1,402 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/cloud"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+const (
+	// backupJobType is the job type of backups.
+	backupJobType = "backup"
+	// backupTimeFormat formats the time of a backup as the prefix of
+	// its file name, such that file names sort by time.
+	backupTimeFormat = "20060102T150405.000000000Z"
+	// fullBackupSuffix and incrementalBackupSuffix are the suffixes of
+	// the file names of full and incremental backups.
+	fullBackupSuffix        = "-full.json"
+	incrementalBackupSuffix = "-incremental.json"
+	// backupSchedulerInterval is the interval at which backup
+	// schedules are checked for backups which are due.
+	backupSchedulerInterval = 30 * time.Second
+)
+
+// runBackup runs a backup job, writing a metaBackup to the job's
+// destination in external storage, along with backups of the node's
+// ranges if requested, and pruning backups beyond the retention
+// limit. An incremental backup includes the rows written since the
+// most recent backup in the destination; if there is none, a full
+// backup is written instead.
+func (s *adminServer) runBackup(jc *jobContext) error {
+	details := &proto.BackupDetails{}
+	if err := gogoproto.Unmarshal(jc.Job().Details, details); err != nil {
+		return util.Errorf("unable to decode backup details: %s", err)
+	}
+	es, err := cloud.FromURI(details.Destination)
+	if err != nil {
+		return err
+	}
+	names, err := listBackups(es)
+	if err != nil {
+		return err
+	}
+	var since int64
+	suffix := fullBackupSuffix
+	if details.Incremental && len(names) > 0 {
+		last, err := time.Parse(backupTimeFormat, names[len(names)-1][:len(backupTimeFormat)])
+		if err != nil {
+			return util.Errorf("unable to parse time of backup %q: %s", names[len(names)-1], err)
+		}
+		since = last.UnixNano()
+		suffix = incrementalBackupSuffix
+	}
+
+	backup, err := s.metaBackup(since)
+	if err != nil {
+		return err
+	}
+	if err := jc.Progress(0.5, nil); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := backup.Time.UTC().Format(backupTimeFormat) + suffix
+	if err := es.WriteFile(name, b); err != nil {
+		return err
+	}
+	if err := jc.Progress(0.9, nil); err != nil {
+		return err
+	}
+	if details.Ranges {
+		if err := s.backupRanges(es); err != nil {
+			return err
+		}
+	}
+	return pruneBackups(es, int(details.RetainFull))
+}
+
+// backupRanges writes a backup of each range of the node's stores to
+// es, from which ranges relocated between the stores are preloaded.
+// Only the stores of the node running the job are backed up.
+func (s *adminServer) backupRanges(es cloud.ExternalStorage) error {
+	var stores []*storage.Store
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		stores = append(stores, store)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, store := range stores {
+		n, err := store.BackupRanges(es)
+		if err != nil {
+			return util.Errorf("unable to back up ranges of store %d: %s", store.StoreID(), err)
+		}
+		log.Infof("backed up %d range(s) of store %d to %s", n, store.StoreID(), es)
+	}
+	return nil
+}
+
+// listBackups returns the file names of the backups in es, sorted by
+// time.
+func listBackups(es cloud.ExternalStorage) ([]string, error) {
+	files, err := es.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range files {
+		if len(name) > len(backupTimeFormat) && (strings.HasSuffix(name, fullBackupSuffix) ||
+			strings.HasSuffix(name, incrementalBackupSuffix)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pruneBackups removes all but the most recent retainFull full
+// backups in es, along with the incremental backups preceding the
+// oldest retained full backup. A retainFull of zero retains all
+// backups.
+func pruneBackups(es cloud.ExternalStorage, retainFull int) error {
+	if retainFull <= 0 {
+		return nil
+	}
+	names, err := listBackups(es)
+	if err != nil {
+		return err
+	}
+	var fulls []int
+	for i, name := range names {
+		if strings.HasSuffix(name, fullBackupSuffix) {
+			fulls = append(fulls, i)
+		}
+	}
+	if len(fulls) <= retainFull {
+		return nil
+	}
+	for _, name := range names[:fulls[len(fulls)-retainFull]] {
+		log.Infof("pruning backup %s from %s", name, es)
+		if err := es.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A backupScheduler periodically creates backup jobs according to
+// the backup schedules stored under engine.KeyBackupSchedulePrefix.
+// Schedules are advanced transactionally, so each scheduled backup is
+// created by only one of the nodes running a scheduler.
+type backupScheduler struct {
+	db      *client.KV
+	jobs    *jobRegistry
+	stopper *util.Stopper
+}
+
+// start begins checking schedules every backupSchedulerInterval.
+func (bs *backupScheduler) start() {
+	bs.stopper = util.NewStopper(1)
+	go func() {
+		ticker := time.NewTicker(backupSchedulerInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := bs.checkSchedules(time.Now()); err != nil {
+					log.Warningf("unable to check backup schedules: %s", err)
+				}
+			case <-bs.stopper.ShouldStop():
+				bs.stopper.SetStopped()
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the scheduler, if started.
+func (bs *backupScheduler) stop() {
+	if bs.stopper != nil {
+		bs.stopper.Stop()
+	}
+}
+
+// checkSchedules creates a backup job for each schedule with a full
+// or incremental backup due at now.
+func (bs *backupScheduler) checkSchedules(now time.Time) error {
+	sr := &proto.ScanResponse{}
+	if err := bs.db.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.KeyBackupSchedulePrefix,
+			EndKey: engine.KeyBackupSchedulePrefix.PrefixEnd(),
+			User:   storage.UserRoot,
+		},
+	}, sr); err != nil {
+		return err
+	}
+	for _, kv := range sr.Rows {
+		name := string(bytes.TrimPrefix(kv.Key, engine.KeyBackupSchedulePrefix))
+		if err := bs.checkSchedule(name, now); err != nil {
+			log.Warningf("backup schedule %q: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// checkSchedule advances the named schedule past now and creates a
+// backup job if one was due. If both full and incremental backups are
+// due, only the full backup is run.
+func (bs *backupScheduler) checkSchedule(name string, now time.Time) error {
+	key := engine.MakeKey(engine.KeyBackupSchedulePrefix, proto.Key(name))
+	var details *proto.BackupDetails
+	txnOpts := &client.TransactionOptions{Name: fmt.Sprintf("backup schedule %q", name)}
+	if err := bs.db.RunTransaction(txnOpts, func(txn *client.KV) error {
+		details = nil
+		sched := &proto.BackupSchedule{}
+		ok, _, err := txn.GetProto(key, sched)
+		if err != nil || !ok {
+			return err
+		}
+		fullDue := sched.NextFullNanos <= now.UnixNano()
+		incrDue := sched.IncrementalCron != "" && sched.NextIncrementalNanos <= now.UnixNano()
+		if !fullDue && !incrDue {
+			return nil
+		}
+		details = &proto.BackupDetails{
+			Destination: sched.Destination,
+			Incremental: !fullDue,
+			RetainFull:  sched.RetainFull,
+		}
+		if err := advanceBackupSchedule(sched, now); err != nil {
+			return err
+		}
+		return txn.PutProto(key, sched)
+	}); err != nil {
+		return err
+	}
+	if details == nil {
+		return nil
+	}
+	b, err := gogoproto.Marshal(details)
+	if err != nil {
+		return err
+	}
+	kind := "full"
+	if details.Incremental {
+		kind = "incremental"
+	}
+	job, err := bs.jobs.Create(backupJobType, fmt.Sprintf("scheduled %s backup %q", kind, name), b)
+	if err != nil {
+		return err
+	}
+	log.Infof("backup schedule %q created %s backup job %d", name, kind, job.ID)
+	return nil
+}
+
+// advanceBackupSchedule sets the times of the schedule's next full and
+// incremental backups to the first matching times after now.
+func advanceBackupSchedule(sched *proto.BackupSchedule, now time.Time) error {
+	full, err := util.ParseCron(sched.FullCron)
+	if err != nil {
+		return err
+	}
+	next := full.Next(now)
+	if next.IsZero() {
+		return util.Errorf("full backup cron expression %q never matches", sched.FullCron)
+	}
+	sched.NextFullNanos = next.UnixNano()
+	sched.NextIncrementalNanos = 0
+	if sched.IncrementalCron != "" {
+		incr, err := util.ParseCron(sched.IncrementalCron)
+		if err != nil {
+			return err
+		}
+		if next = incr.Next(now); next.IsZero() {
+			return util.Errorf("incremental backup cron expression %q never matches", sched.IncrementalCron)
+		}
+		sched.NextIncrementalNanos = next.UnixNano()
+	}
+	return nil
+}
+
+// A backupScheduleHandler implements the actionHandler interface.
+type backupScheduleHandler struct {
+	db *client.KV // Key-value database client
+}
+
+// Put writes the backup schedule with the name specified by path. The
+// schedule is parsed from the input body and must specify a valid
+// full backup cron expression and a destination. The times of the
+// next backups are computed from the current time.
+func (bh *backupScheduleHandler) Put(path string, body []byte, r *http.Request) error {
+	if len(path) <= 1 {
+		return util.Errorf("no schedule name specified for backup schedule Put")
+	}
+	sched := &proto.BackupSchedule{}
+	if err := util.UnmarshalRequest(r, body, sched, util.AllEncodings); err != nil {
+		return util.Errorf("backup schedule has invalid format: %q: %s", body, err)
+	}
+	if sched.Destination == "" {
+		return util.Errorf("backup schedule must specify a destination")
+	}
+	if _, err := cloud.FromURI(sched.Destination); err != nil {
+		return err
+	}
+	if err := advanceBackupSchedule(sched, time.Now()); err != nil {
+		return err
+	}
+	return bh.db.PutProto(engine.MakeKey(engine.KeyBackupSchedulePrefix, proto.Key(path[1:])), sched)
+}
+
+// Get retrieves the backup schedule with the name specified by path,
+// or lists the names of all schedules if path is empty.
+func (bh *backupScheduleHandler) Get(path string, r *http.Request) (body []byte, contentType string, err error) {
+	if len(path) <= 1 {
+		sr := &proto.ScanResponse{}
+		if err = bh.db.Call(proto.Scan, &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.KeyBackupSchedulePrefix,
+				EndKey: engine.KeyBackupSchedulePrefix.PrefixEnd(),
+				User:   storage.UserRoot,
+			},
+			MaxResults: maxGetResults,
+		}, sr); err != nil {
+			return
+		}
+		names := []string{}
+		for _, kv := range sr.Rows {
+			trimmed := bytes.TrimPrefix(kv.Key, engine.KeyBackupSchedulePrefix)
+			names = append(names, url.QueryEscape(string(trimmed)))
+		}
+		return util.MarshalResponse(r, names, util.AllEncodings)
+	}
+	sched := &proto.BackupSchedule{}
+	var ok bool
+	if ok, _, err = bh.db.GetProto(engine.MakeKey(engine.KeyBackupSchedulePrefix, proto.Key(path[1:])), sched); err != nil {
+		return
+	}
+	if !ok {
+		err = util.Errorf("no backup schedule found with name %q", path[1:])
+		return
+	}
+	return util.MarshalResponse(r, sched, util.AllEncodings)
+}
+
+// Delete removes the backup schedule with the name specified by path.
+func (bh *backupScheduleHandler) Delete(path string, r *http.Request) error {
+	if len(path) <= 1 {
+		return util.Errorf("no schedule name specified for backup schedule Delete")
+	}
+	return bh.db.Call(proto.Delete, &proto.DeleteRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  engine.MakeKey(engine.KeyBackupSchedulePrefix, proto.Key(path[1:])),
+			User: storage.UserRoot,
+		},
+	}, &proto.DeleteResponse{})
+}
+
+// handleBackupScheduleAction handles actions for backup schedules by
+// method.
+func (s *adminServer) handleBackupScheduleAction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.handleGetAction(s.backups, w, r, backupSchedulesPathPrefix)
+	case "PUT", "POST":
+		s.handlePutAction(s.backups, w, r, backupSchedulesPathPrefix)
+	case "DELETE":
+		s.handleDeleteAction(s.backups, w, r, backupSchedulesPathPrefix)
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/cloud"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// createTestAdminServer returns an admin server for a bootstrapped
+// in-memory cluster.
+func createTestAdminServer(t *testing.T) *adminServer {
+	db, err := BootstrapCluster("cluster-1", engine.NewInMem(proto.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newAdminServer(db, kv.NewLocalSender())
+}
+
+// runTestBackup runs a backup job to completion and returns the
+// names of the backups in dir.
+func runTestBackup(t *testing.T, s *adminServer, dir string, incremental bool, retainFull int32) []string {
+	b, err := gogoproto.Marshal(&proto.BackupDetails{
+		Destination: dir,
+		Incremental: incremental,
+		RetainFull:  retainFull,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.jobs.Create(backupJobType, "test backup", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.jobs.Wait()
+	verifyJob(t, s.jobs, job.ID, proto.JOB_SUCCEEDED, 1)
+	return backupNames(t, dir)
+}
+
+// backupNames returns the names of the backups in dir.
+func backupNames(t *testing.T, dir string) []string {
+	es, err := cloud.FromURI(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := listBackups(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// TestBackupIncrementalAndPrune verifies that incremental backups
+// hold only rows written since the previous backup, and that old
+// backups are pruned beyond the retention limit.
+func TestBackupIncrementalAndPrune(t *testing.T) {
+	s := createTestAdminServer(t)
+	defer s.db.Close()
+	dir := createTempDirs(1, t)
+	defer resetTestData(dir)
+
+	// An incremental backup with no previous backup is a full backup.
+	names := runTestBackup(t, s, dir[0], true, 0)
+	if len(names) != 1 || !strings.HasSuffix(names[0], fullBackupSuffix) {
+		t.Fatalf("expected one full backup; got %v", names)
+	}
+
+	zoneKey := engine.MakeKey(engine.KeyConfigZonePrefix, proto.Key("db1"))
+	if err := s.db.PutProto(zoneKey, &proto.ZoneConfig{RangeMaxBytes: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	names = runTestBackup(t, s, dir[0], true, 0)
+	if len(names) != 2 || !strings.HasSuffix(names[1], incrementalBackupSuffix) {
+		t.Fatalf("expected full and incremental backups; got %v", names)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir[0], names[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var incr struct {
+		SinceNanos int64 `json:"since_nanos"`
+		Tables     map[string]struct {
+			Rows []json.RawMessage `json:"rows"`
+		} `json:"tables"`
+	}
+	if err := json.Unmarshal(b, &incr); err != nil {
+		t.Fatal(err)
+	}
+	if incr.SinceNanos == 0 {
+		t.Error("expected incremental backup to specify since_nanos")
+	}
+	for name, table := range incr.Tables {
+		// The records of the backup jobs are themselves written between
+		// backups.
+		if name == "jobs" {
+			continue
+		}
+		expRows := 0
+		if name == "zones" {
+			expRows = 1
+		}
+		if len(table.Rows) != expRows {
+			t.Errorf("table %s: expected %d rows in incremental backup; got %d", name, expRows, len(table.Rows))
+		}
+	}
+
+	// A full backup retaining one full backup prunes the others.
+	names = runTestBackup(t, s, dir[0], false, 1)
+	if len(names) != 1 || !strings.HasSuffix(names[0], fullBackupSuffix) {
+		t.Errorf("expected only the newest full backup to remain; got %v", names)
+	}
+}
+
+// TestBackupScheduler verifies that backup jobs are created when
+// scheduled backups are due and that each is created only once.
+func TestBackupScheduler(t *testing.T) {
+	s := createTestAdminServer(t)
+	defer s.db.Close()
+	dir := createTempDirs(1, t)
+	defer resetTestData(dir)
+
+	now := time.Date(2015, 1, 14, 10, 30, 0, 0, time.UTC)
+	sched := &proto.BackupSchedule{
+		FullCron:        "@daily",
+		IncrementalCron: "@hourly",
+		Destination:     dir[0],
+	}
+	if err := advanceBackupSchedule(sched, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.PutProto(engine.MakeKey(engine.KeyBackupSchedulePrefix, proto.Key("nightly")), sched); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		now        time.Time
+		expJobs    int
+		expBackups []string
+	}{
+		// Nothing is due yet.
+		{now, 0, nil},
+		// The incremental backup is due; as there's no prior backup, a
+		// full backup is written.
+		{now.Add(time.Hour), 1, []string{fullBackupSuffix}},
+		// Not due again until the next hour.
+		{now.Add(time.Hour), 1, []string{fullBackupSuffix}},
+		{now.Add(2 * time.Hour), 2, []string{fullBackupSuffix, incrementalBackupSuffix}},
+		// Both are due; only the full backup is run.
+		{now.Add(24 * time.Hour), 3, []string{fullBackupSuffix, incrementalBackupSuffix, fullBackupSuffix}},
+	}
+	for i, c := range testCases {
+		if err := s.scheduler.checkSchedules(c.now); err != nil {
+			t.Fatal(err)
+		}
+		s.jobs.Wait()
+		jobs, err := s.jobs.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != c.expJobs {
+			t.Errorf("%d: expected %d jobs; got %d", i, c.expJobs, len(jobs))
+		}
+		names := backupNames(t, dir[0])
+		if len(names) != len(c.expBackups) {
+			t.Fatalf("%d: expected backups %v; got %v", i, c.expBackups, names)
+		}
+		for j, name := range names {
+			if !strings.HasSuffix(name, c.expBackups[j]) {
+				t.Errorf("%d: expected backup %d to end in %s; got %s", i, j, c.expBackups[j], name)
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+const (
+	// changefeedJobType is the job type of changefeeds.
+	changefeedJobType = "changefeed"
+	// defaultChangefeedPollInterval is the interval at which spans are
+	// polled for changes if the changefeed doesn't specify one.
+	defaultChangefeedPollInterval = 1 * time.Second
+	// changefeedScanBatchSize is the maximum number of rows read per
+	// scan while polling a span.
+	changefeedScanBatchSize = 1000
+)
+
+// formatChangefeedTimestamp formats ts for changefeed envelopes.
+func formatChangefeedTimestamp(ts proto.Timestamp) string {
+	return fmt.Sprintf("%d.%010d", ts.WallTime, ts.Logical)
+}
+
+// runChangefeed runs a changefeed job, which polls its spans for keys
+// changed since each span's resolved timestamp and emits the changes,
+// including deletions, to the job's sink, followed by the new resolved
+// timestamp. Spans are checkpointed in the job record once their
+// changes have been flushed to the sink, so changes are delivered at
+// least once across pauses and restarts. Changefeeds run until paused
+// or canceled.
+//
+// Polling reads each span at a single timestamp. As the read updates
+// the timestamp cache, no write at or below that timestamp can
+// subsequently commit within the span, so the timestamp is resolved
+// once the read completes.
+func (s *adminServer) runChangefeed(jc *jobContext) error {
+	details := &proto.ChangefeedDetails{}
+	if err := gogoproto.Unmarshal(jc.Job().Details, details); err != nil {
+		return util.Errorf("unable to decode changefeed details: %s", err)
+	}
+	sink, err := newChangefeedSink(details.Sink)
+	if err != nil {
+		return err
+	}
+	progress := &proto.ChangefeedProgress{Spans: details.Spans}
+	if cp := jc.Job().Checkpoint; len(cp) > 0 {
+		progress = &proto.ChangefeedProgress{}
+		if err := gogoproto.Unmarshal(cp, progress); err != nil {
+			return util.Errorf("unable to decode changefeed checkpoint: %s", err)
+		}
+	}
+	interval := time.Duration(details.PollIntervalNanos)
+	if interval <= 0 {
+		interval = defaultChangefeedPollInterval
+	}
+	for {
+		if err := s.pollChangefeed(jc, sink, progress); err != nil {
+			return err
+		}
+		time.Sleep(interval)
+	}
+}
+
+// pollChangefeed emits the changes to each span of progress since its
+// resolved timestamp, checkpointing each span as it completes, and
+// then emits the new resolved timestamp. Only keys changed since the
+// resolved timestamp are read. A span which has not yet been resolved
+// emits its current values, without the deletions which preceded the
+// changefeed.
+func (s *adminServer) pollChangefeed(jc *jobContext, sink changefeedSink, progress *proto.ChangefeedProgress) error {
+	// The first read is at the current time, which all subsequent
+	// reads of the poll share.
+	var ts proto.Timestamp
+	for i := range progress.Spans {
+		span := &progress.Spans[i]
+		initial := span.Resolved.Equal(proto.ZeroTimestamp)
+		for start := span.StartKey; ; {
+			sr := &proto.InternalScanChangesResponse{}
+			if err := s.db.Call(proto.InternalScanChanges, &proto.InternalScanChangesRequest{
+				RequestHeader: proto.RequestHeader{
+					Key:       start,
+					EndKey:    span.EndKey,
+					User:      storage.UserRoot,
+					Timestamp: ts,
+				},
+				Since:      span.Resolved,
+				MaxResults: changefeedScanBatchSize,
+			}, sr); err != nil {
+				return err
+			}
+			if ts.Equal(proto.ZeroTimestamp) {
+				ts = sr.Timestamp
+			}
+			for _, change := range sr.Changes {
+				env := changefeedEnvelope{
+					Key:     url.QueryEscape(string(change.Key)),
+					Updated: formatChangefeedTimestamp(change.Timestamp),
+				}
+				switch {
+				case change.Value == nil:
+					if initial {
+						continue
+					}
+					env.Deleted = true
+				default:
+					if i, err := change.Value.GetInt(); err == nil {
+						env.Integer = &i
+					} else {
+						env.Value = base64.StdEncoding.EncodeToString(change.Value.Bytes)
+					}
+				}
+				sink.Emit(env)
+			}
+			if len(sr.Changes) < changefeedScanBatchSize {
+				break
+			}
+			start = sr.Changes[len(sr.Changes)-1].Key.Next()
+		}
+		if err := sink.Flush(); err != nil {
+			return err
+		}
+		span.Resolved = ts
+		b, err := gogoproto.Marshal(progress)
+		if err != nil {
+			return err
+		}
+		if err := jc.Progress(0, b); err != nil {
+			return err
+		}
+	}
+	sink.Emit(changefeedEnvelope{Resolved: formatChangefeedTimestamp(ts)})
+	return sink.Flush()
+}
+
+// A changefeedRequest is the body of a request to create a changefeed.
+// Span keys are query escaped; the poll interval is a duration such
+// as "5s".
+type changefeedRequest struct {
+	Sink         string                  `json:"sink"`
+	Spans        []changefeedSpanRequest `json:"spans"`
+	PollInterval string                  `json:"poll_interval,omitempty"`
+}
+
+// A changefeedSpanRequest is a span of a changefeedRequest.
+type changefeedSpanRequest struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// createChangefeed validates req and creates a changefeed job.
+func (s *adminServer) createChangefeed(req *changefeedRequest) (*proto.Job, error) {
+	if _, err := newChangefeedSink(req.Sink); err != nil {
+		return nil, err
+	}
+	if len(req.Spans) == 0 {
+		return nil, util.Errorf("changefeed must specify at least one span")
+	}
+	details := &proto.ChangefeedDetails{Sink: req.Sink}
+	if req.PollInterval != "" {
+		d, err := time.ParseDuration(req.PollInterval)
+		if err != nil || d <= 0 {
+			return nil, util.Errorf("invalid poll interval %q", req.PollInterval)
+		}
+		details.PollIntervalNanos = d.Nanoseconds()
+	}
+	for _, sp := range req.Spans {
+		start, err := url.QueryUnescape(sp.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := url.QueryUnescape(sp.End)
+		if err != nil {
+			return nil, err
+		}
+		if !proto.Key(start).Less(proto.Key(end)) {
+			return nil, util.Errorf("invalid span [%q, %q)", start, end)
+		}
+		details.Spans = append(details.Spans, proto.ChangefeedSpan{
+			StartKey: proto.Key(start),
+			EndKey:   proto.Key(end),
+		})
+	}
+	b, err := gogoproto.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	return s.jobs.Create(changefeedJobType, fmt.Sprintf("changefeed to %s", req.Sink), b)
+}
+
+// handleChangefeedsAction creates a changefeed job on POST of a
+// changefeedRequest, responding with the job's record. Changefeeds
+// are thereafter controlled via the jobs endpoint.
+func (s *adminServer) handleChangefeedsAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	req := &changefeedRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid changefeed request: %s", err), http.StatusBadRequest)
+		return
+	}
+	job, err := s.createChangefeed(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b, err = json.Marshal(job); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
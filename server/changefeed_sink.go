@@ -0,0 +1,188 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// sinkRetryOptions configures retries of deliveries to changefeed
+// sinks.
+var sinkRetryOptions = util.RetryOptions{
+	Tag:         "changefeed sink",
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+	Constant:    2,
+	MaxAttempts: 10,
+}
+
+// A changefeedEnvelope is the JSON encoding of a row change or of a
+// resolved timestamp emitted by a changefeed. Keys are query escaped
+// and timestamps formatted as "<wall-nanos>.<logical>". A row carries
+// either Value, the base64-encoded bytes, or Integer, unless it was
+// deleted, in which case Deleted is set.
+type changefeedEnvelope struct {
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Integer  *int64 `json:"integer,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Updated  string `json:"updated,omitempty"`
+	Resolved string `json:"resolved,omitempty"`
+}
+
+// A changefeedSink delivers envelopes emitted by a changefeed. Emitted
+// envelopes are buffered until Flush, which returns only once they
+// have been durably delivered. Envelopes may be delivered more than
+// once.
+type changefeedSink interface {
+	Emit(env changefeedEnvelope)
+	Flush() error
+}
+
+// newChangefeedSink returns the sink specified by uri: a webhook for
+// http and https URIs, or a Kafka topic written via the Kafka REST
+// proxy listening at host:port for kafka-rest://host:port/topic URIs.
+// There is no native Kafka client in the tree.
+func newChangefeedSink(uri string) (changefeedSink, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, util.Errorf("invalid sink URI %q: %s", uri, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &webhookSink{url: uri}, nil
+	case "kafka-rest":
+		topic := strings.Trim(u.Path, "/")
+		if u.Host == "" || topic == "" || strings.Contains(topic, "/") {
+			return nil, util.Errorf("kafka-rest sink URI %q must be of the form kafka-rest://host:port/topic", uri)
+		}
+		scheme := "http"
+		if u.Query().Get("tls") == "true" {
+			scheme = "https"
+		}
+		return &kafkaRESTSink{url: fmt.Sprintf("%s://%s/topics/%s", scheme, u.Host, url.QueryEscape(topic))}, nil
+	default:
+		return nil, util.Errorf("unsupported sink scheme %q", u.Scheme)
+	}
+}
+
+// postWithRetry posts body to url, retrying on network errors and
+// server errors.
+func postWithRetry(url, contentType string, body []byte) error {
+	var lastErr error
+	err := util.RetryWithBackoff(sinkRetryOptions, func() (util.RetryStatus, error) {
+		resp, err := http.Post(url, contentType, bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			return util.RetryContinue, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return util.RetryBreak, nil
+		}
+		lastErr = util.Errorf("POST %s: %s", url, resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+			return util.RetryContinue, lastErr
+		}
+		return util.RetryBreak, lastErr
+	})
+	if _, ok := err.(*util.RetryMaxAttemptsError); ok && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
+
+// A webhookSink posts buffered envelopes as a JSON object of the form
+// {"payload": [...], "length": n}.
+type webhookSink struct {
+	url    string
+	buffer []changefeedEnvelope
+}
+
+// Emit implements changefeedSink.
+func (ws *webhookSink) Emit(env changefeedEnvelope) {
+	ws.buffer = append(ws.buffer, env)
+}
+
+// Flush implements changefeedSink.
+func (ws *webhookSink) Flush() error {
+	if len(ws.buffer) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(struct {
+		Payload []changefeedEnvelope `json:"payload"`
+		Length  int                  `json:"length"`
+	}{ws.buffer, len(ws.buffer)})
+	if err != nil {
+		return err
+	}
+	if err := postWithRetry(ws.url, "application/json", b); err != nil {
+		return err
+	}
+	ws.buffer = nil
+	return nil
+}
+
+// A kafkaRESTRecord is a record produced via the Kafka REST proxy. Row
+// changes are keyed by their row key, so that changes to a row are
+// ordered within a partition; resolved timestamps are unkeyed.
+type kafkaRESTRecord struct {
+	Key   *string            `json:"key"`
+	Value changefeedEnvelope `json:"value"`
+}
+
+// A kafkaRESTSink produces buffered envelopes to a Kafka topic via the
+// Kafka REST proxy's v2 JSON API.
+type kafkaRESTSink struct {
+	url     string
+	records []kafkaRESTRecord
+}
+
+// Emit implements changefeedSink.
+func (ks *kafkaRESTSink) Emit(env changefeedEnvelope) {
+	rec := kafkaRESTRecord{Value: env}
+	if env.Key != "" {
+		key := env.Key
+		rec.Key = &key
+	}
+	ks.records = append(ks.records, rec)
+}
+
+// Flush implements changefeedSink.
+func (ks *kafkaRESTSink) Flush() error {
+	if len(ks.records) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(struct {
+		Records []kafkaRESTRecord `json:"records"`
+	}{ks.records})
+	if err != nil {
+		return err
+	}
+	if err := postWithRetry(ks.url, "application/vnd.kafka.json.v2+json", b); err != nil {
+		return err
+	}
+	ks.records = nil
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// A fakeWebhook records the envelopes posted to it. The first post
+// fails with a server error to exercise retries.
+type fakeWebhook struct {
+	sync.Mutex
+	envs   []changefeedEnvelope
+	failed bool
+}
+
+func (fw *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fw.Lock()
+	defer fw.Unlock()
+	if !fw.failed {
+		fw.failed = true
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	var body struct {
+		Payload []changefeedEnvelope `json:"payload"`
+		Length  int                  `json:"length"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Length != len(body.Payload) {
+		http.Error(w, "bad payload", http.StatusBadRequest)
+		return
+	}
+	fw.envs = append(fw.envs, body.Payload...)
+}
+
+// updated returns the timestamp of the most recent change to key, and
+// whether a resolved timestamp has been received since.
+func (fw *fakeWebhook) updated(key string) (string, bool) {
+	env, resolved := fw.latest(key)
+	return env.Updated, resolved
+}
+
+// latest returns the most recent change to key, and whether a
+// resolved timestamp has been received since.
+func (fw *fakeWebhook) latest(key string) (changefeedEnvelope, bool) {
+	fw.Lock()
+	defer fw.Unlock()
+	var latest changefeedEnvelope
+	var resolved bool
+	for _, env := range fw.envs {
+		if env.Key == key {
+			latest, resolved = env, false
+		} else if env.Resolved != "" {
+			resolved = true
+		}
+	}
+	return latest, resolved
+}
+
+// count returns the number of changes to key received.
+func (fw *fakeWebhook) count(key string) int {
+	fw.Lock()
+	defer fw.Unlock()
+	var n int
+	for _, env := range fw.envs {
+		if env.Key == key {
+			n++
+		}
+	}
+	return n
+}
+
+func putTestValue(t *testing.T, s *adminServer, key, value string) {
+	if err := s.db.Call(proto.Put, &proto.PutRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  proto.Key(key),
+			User: storage.UserRoot,
+		},
+		Value: proto.Value{Bytes: []byte(value)},
+	}, &proto.PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestChangefeedWebhook verifies that a changefeed emits existing rows
+// but not earlier deletions, then only rows subsequently written or
+// deleted, along with resolved timestamps, and checkpoints its spans
+// in its job record.
+func TestChangefeedWebhook(t *testing.T) {
+	s := createTestAdminServer(t)
+	defer s.db.Close()
+	fw := &fakeWebhook{}
+	hs := httptest.NewServer(fw)
+	defer hs.Close()
+
+	putTestValue(t, s, "a", "1")
+	putTestValue(t, s, "b", "1")
+	putTestValue(t, s, "c", "outside span")
+	putTestValue(t, s, "deleted", "1")
+	if err := s.db.Call(proto.Delete, &proto.DeleteRequest{
+		RequestHeader: proto.RequestHeader{Key: proto.Key("deleted"), User: storage.UserRoot},
+	}, &proto.DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.createChangefeed(&changefeedRequest{
+		Sink:         hs.URL,
+		Spans:        []changefeedSpanRequest{{Start: "a", End: "c"}, {Start: "deleted", End: "deletee"}},
+		PollInterval: "10ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first string
+	if err := util.IsTrueWithin(func() bool {
+		var resolved bool
+		first, resolved = fw.updated("a")
+		return first != "" && resolved
+	}, 5*time.Second); err != nil {
+		t.Fatalf("expected row a and resolved timestamp: %s", err)
+	}
+	putTestValue(t, s, "a", "2")
+	if err := util.IsTrueWithin(func() bool {
+		updated, resolved := fw.updated("a")
+		return updated != first && resolved
+	}, 5*time.Second); err != nil {
+		t.Fatalf("expected update of row a: %s", err)
+	}
+	if updated, _ := fw.updated("c"); updated != "" {
+		t.Errorf("expected no changes outside of span; got update of c at %s", updated)
+	}
+	if n := fw.count("deleted"); n != 0 {
+		t.Errorf("expected no changes for a key deleted before the changefeed; got %d", n)
+	}
+	if n := fw.count("b"); n != 1 {
+		t.Errorf("expected unchanged row b to be emitted once; got %d", n)
+	}
+
+	if err := s.db.Call(proto.Delete, &proto.DeleteRequest{
+		RequestHeader: proto.RequestHeader{Key: proto.Key("a"), User: storage.UserRoot},
+	}, &proto.DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		env, resolved := fw.latest("a")
+		return env.Deleted && resolved
+	}, 5*time.Second); err != nil {
+		t.Fatalf("expected deletion of row a: %s", err)
+	}
+
+	if err := s.jobs.Pause(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	s.jobs.Wait()
+	paused, err := s.jobs.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := &proto.ChangefeedProgress{}
+	if err := gogoproto.Unmarshal(paused.Checkpoint, progress); err != nil {
+		t.Fatal(err)
+	}
+	if len(progress.Spans) != 2 {
+		t.Fatalf("expected checkpoints of both spans; got %+v", progress)
+	}
+	for i, span := range progress.Spans {
+		if span.Resolved.Equal(proto.ZeroTimestamp) {
+			t.Errorf("%d: expected checkpoint of resolved span; got %+v", i, span)
+		}
+	}
+}
+
+// TestChangefeedRequestErrors verifies validation of changefeed
+// requests.
+func TestChangefeedRequestErrors(t *testing.T) {
+	s := createTestAdminServer(t)
+	defer s.db.Close()
+	for i, body := range []string{
+		`{"sink": "ftp://host", "spans": [{"start": "a", "end": "b"}]}`,
+		`{"sink": "kafka://host:9092/changes", "spans": [{"start": "a", "end": "b"}]}`,
+		`{"sink": "kafka-rest://host:9092", "spans": [{"start": "a", "end": "b"}]}`,
+		`{"sink": "http://host"}`,
+		`{"sink": "http://host", "spans": [{"start": "b", "end": "a"}]}`,
+		`{"sink": "http://host", "spans": [{"start": "a", "end": "b"}], "poll_interval": "-1s"}`,
+	} {
+		req := &changefeedRequest{}
+		if err := json.Unmarshal([]byte(body), req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.createChangefeed(req); err == nil {
+			t.Errorf("%d: expected error", i)
+		}
+	}
+}
+
+// TestKafkaRESTSink verifies that envelopes are produced to the topic
+// via the Kafka REST proxy, keyed by row key.
+func TestKafkaRESTSink(t *testing.T) {
+	var body []byte
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/changes" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer hs.Close()
+	sink, err := newChangefeedSink("kafka-rest://" + strings.TrimPrefix(hs.URL, "http://") + "/changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Emit(changefeedEnvelope{Key: "a", Value: "MQ==", Updated: "1.0000000000"})
+	sink.Emit(changefeedEnvelope{Resolved: "1.0000000000"})
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var produced struct {
+		Records []kafkaRESTRecord `json:"records"`
+	}
+	if err := json.Unmarshal(body, &produced); err != nil {
+		t.Fatal(err)
+	}
+	if len(produced.Records) != 2 || produced.Records[0].Key == nil || *produced.Records[0].Key != "a" ||
+		produced.Records[1].Key != nil || produced.Records[1].Value.Resolved == "" {
+		t.Errorf("unexpected records produced: %s", body)
+	}
+}
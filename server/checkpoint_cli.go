@@ -0,0 +1,154 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// A CmdCheckpoint command creates, lists and clones named checkpoints
+// of a node's stores.
+var CmdCheckpoint = &commander.Command{
+	UsageLine: "checkpoint [options] (create <name> | ls | clone <name> <dir>)",
+	Short:     "creates, lists and clones named checkpoints of stores",
+	Long: `
+Manages named checkpoints of the stores specified by -stores. A
+checkpoint is a consistent, point-in-time copy of a store, kept in the
+"checkpoints" subdirectory of the store's directory. Its files are
+hard-linked to those of the store, so checkpoints are fast to create
+and initially take up little space. The stores are opened directly,
+so the node using them must not be running. In-memory stores are
+skipped.
+
+create <name>
+
+Creates a checkpoint named <name> of each store.
+
+ls
+
+Lists the checkpoints of each store.
+
+clone <name> <dir>
+
+Clones checkpoint <name> of each store to <dir>/<i>, where <i> is
+the store's index in -stores, for use as the stores of a new node.
+The clones are copies of the original stores, including their node,
+store and cluster IDs, so a test cluster cloned from checkpoints
+must be made up of clones of all of the original cluster's nodes and
+must not be able to reach the original cluster. For example:
+
+  cockroach checkpoint -stores=ssd=/mnt/ssd1 create before-upgrade
+  cockroach checkpoint -stores=ssd=/mnt/ssd1 clone before-upgrade /mnt/ssd2/test
+  cockroach start -stores=ssd=/mnt/ssd2/test/0 ...
+`,
+	Run:  runCheckpoint,
+	Flag: *flag.CommandLine,
+}
+
+// runCheckpoint dispatches to the requested checkpoint operation on
+// each store specified by -stores.
+func runCheckpoint(cmd *commander.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return
+	}
+	var op func(i int, r *engine.RocksDB) error
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		op = func(i int, r *engine.RocksDB) error {
+			if err := r.CreateNamedCheckpoint(args[1]); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "store %d: created checkpoint %s\n", i, r.CheckpointDir(args[1]))
+			return nil
+		}
+	case args[0] == "ls" && len(args) == 1:
+		op = func(i int, r *engine.RocksDB) error {
+			names, err := r.NamedCheckpoints()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "store %d: %d checkpoint(s)\n", i, len(names))
+			for _, name := range names {
+				fmt.Fprintf(os.Stdout, "  %s\n", name)
+			}
+			return nil
+		}
+	case args[0] == "clone" && len(args) == 3:
+		op = func(i int, r *engine.RocksDB) error {
+			return cloneCheckpoint(r.CheckpointDir(args[1]), filepath.Join(args[2], strconv.Itoa(i)))
+		}
+	default:
+		cmd.Usage()
+		return
+	}
+
+	engines, err := initEngines(*stores)
+	if err != nil {
+		log.Errorf("failed to initialize engines from -stores=%s: %s", *stores, err)
+		return
+	}
+	for i, e := range engines {
+		r, ok := engine.Unwrap(e).(*engine.RocksDB)
+		if !ok {
+			log.Warningf("skipping store %d: checkpoints are not supported by in-memory stores", i)
+			continue
+		}
+		// Cloning reads only the checkpoint, not the store itself.
+		if args[0] != "clone" {
+			if err := r.Start(); err != nil {
+				log.Errorf("failed to start engine %d: %s", i, err)
+				return
+			}
+			defer r.Stop()
+		}
+		if err := op(i, r); err != nil {
+			log.Errorf("checkpoint %s failed for store %d: %s", args[0], i, err)
+			return
+		}
+	}
+}
+
+// cloneCheckpoint opens the checkpoint in dir and checkpoints it in
+// turn to cloneDir, so that the named checkpoint is left unchanged by
+// the use of the clone.
+func cloneCheckpoint(dir, cloneDir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cloneDir), 0755); err != nil {
+		return err
+	}
+	checkpoint := engine.NewRocksDB(proto.Attributes{}, dir)
+	if err := checkpoint.Start(); err != nil {
+		return err
+	}
+	defer checkpoint.Stop()
+	if err := checkpoint.Checkpoint(cloneDir); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "cloned checkpoint %s to %s\n", dir, cloneDir)
+	return nil
+}
@@ -0,0 +1,279 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var (
+	debugSeconds = flag.Duration("debug_seconds", 30*time.Second, "duration of CPU "+
+		"profiles and execution traces captured with the debug command")
+	debugOutput = flag.String("debug_output", "", "file to which the debug command "+
+		"writes captured profiles; empty for stdout")
+	debugRecoverConfirm = flag.Bool("debug_recover_confirm", false, "rewrite the range "+
+		"descriptor with debug recover; without it, debug recover only reports what it "+
+		"would do")
+	debugZipAddrs = flag.String("debug_zip_addrs", "", "comma-separated list of "+
+		"the HTTP addresses of nodes to include in debug zip, in addition to -addr")
+)
+
+// debugProfiles maps profile names accepted by the debug command to
+// paths under the debug endpoint. The boolean indicates whether the
+// profile is captured over -debug_seconds.
+var debugProfiles = map[string]struct {
+	path  string
+	timed bool
+}{
+	"cpu":          {"pprof/profile", true},
+	"heap":         {"pprof/heap", false},
+	"goroutine":    {"pprof/goroutine", false},
+	"block":        {"pprof/block", false},
+	"threadcreate": {"pprof/threadcreate", false},
+	"trace":        {"pprof/trace", true},
+}
+
+// A CmdDebug command provides debugging facilities.
+var CmdDebug = &commander.Command{
+	UsageLine: "debug [options] (pprof <profile> | zip <file> | mvcc-history <key> | recover <raft-id>)",
+	Short:     "captures profiles and inspects stores for debugging",
+	Long: `
+pprof <profile>
+
+Captures a profile from the node specified by -addr and writes it to
+-debug_output (or stdout). <profile> is one of cpu, heap, goroutine,
+block, threadcreate or trace. CPU profiles and execution traces are
+captured over -debug_seconds.
+
+Requests to nodes from non-loopback addresses must supply the node's
+-admin_token. For example:
+
+  cockroach debug -addr=host:8080 -admin_token=secret -debug_output=cpu.prof pprof cpu
+  go tool pprof cockroach cpu.prof
+
+zip <file>
+
+Writes a support bundle to the zip archive <file>, holding the jobs and
+cluster settings, and from the node specified by -addr and each of the
+nodes specified by -debug_zip_addrs: the node's details, goroutines,
+gossip state, heap profile, hot ranges, queue states, read cache
+statistics and log files. Files which can't be fetched, for example
+from unreachable nodes, are replaced by .err files holding the error.
+For example:
+
+  cockroach debug -addr=host1:8080 -debug_zip_addrs=host2:8080,host3:8080 \
+    -admin_token=secret zip debug.zip
+
+mvcc-history <key>
+
+Prints all versions of <key> present in the stores specified by
+-stores, newest first, with timestamps, deletion tombstones and write
+intents. Versions which have been garbage collected are not shown.
+The stores are opened directly, so the node using them must not be
+running. Keys may be specified as Go-quoted strings to include
+non-printable bytes. For example:
+
+  cockroach debug -stores=ssd=/mnt/ssd1 mvcc-history '"account\x00123"'
+
+recover <raft-id>
+
+UNSAFE: resurrects a range which has permanently lost quorum by
+rewriting the descriptor of its replica in the stores specified by
+-stores so that the replica becomes the range's only replica. Writes
+the surviving replica did not see are lost, and the range's other
+replicas must never be restarted. The range's addressing records are
+rewritten where they are held by the same stores; any others are
+listed and must be rebuilt with recover-meta on the nodes holding
+them. The stores are opened directly, so the node using them must not
+be running. Without -debug_recover_confirm, the rewrite is only
+reported. For example:
+
+  cockroach debug -stores=ssd=/mnt/ssd1 -debug_recover_confirm recover 42
+`,
+	Run:  runDebug,
+	Flag: *flag.CommandLine,
+}
+
+// runDebug dispatches to the requested debug facility.
+func runDebug(cmd *commander.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		return
+	}
+	switch args[0] {
+	case "pprof":
+		profile, ok := debugProfiles[args[1]]
+		if !ok {
+			cmd.Usage()
+			return
+		}
+		runDebugPprof(args[1], profile.path, profile.timed)
+	case "zip":
+		runDebugZip(args[1])
+	case "mvcc-history":
+		key := args[1]
+		if strings.HasPrefix(key, `"`) {
+			var err error
+			if key, err = strconv.Unquote(key); err != nil {
+				log.Errorf("unable to unquote key %s: %s", args[1], err)
+				return
+			}
+		}
+		runDebugMVCCHistory(proto.Key(key))
+	case "recover":
+		raftID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			log.Errorf("invalid raft ID %s: %s", args[1], err)
+			return
+		}
+		runDebugRecover(raftID)
+	default:
+		cmd.Usage()
+	}
+}
+
+// runDebugPprof fetches the named profile from the debug endpoint at
+// the specified path. Timed profiles are captured over -debug_seconds.
+func runDebugPprof(name, path string, timed bool) {
+	url := fmt.Sprintf("%s://%s%s%s", adminScheme, *addr, debugEndpoint, path)
+	if timed {
+		url = fmt.Sprintf("%s?seconds=%d", url, int(debugSeconds.Seconds()))
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Errorf("unable to create request to debug endpoint: %s", err)
+		return
+	}
+	if *adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+	}
+	if timed {
+		log.Infof("capturing %s profile for %s", name, *debugSeconds)
+	}
+	b, err := sendAdminRequest(req)
+	if err != nil {
+		log.Errorf("debug request failed: %s", err)
+		return
+	}
+	if *debugOutput == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*debugOutput, b, 0644); err != nil {
+		log.Errorf("unable to write profile to %s: %s", *debugOutput, err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "wrote %s profile (%d bytes) to %s\n", name, len(b), *debugOutput)
+}
+
+// runDebugMVCCHistory prints all versions of key in each of the
+// stores specified by -stores.
+func runDebugMVCCHistory(key proto.Key) {
+	engines, err := initEngines(*stores)
+	if err != nil {
+		log.Errorf("failed to initialize engines from -stores=%s: %s", *stores, err)
+		return
+	}
+	for i, e := range engines {
+		if err := e.Start(); err != nil {
+			log.Errorf("failed to start engine %d: %s", i, err)
+			return
+		}
+		defer e.Stop()
+		versions, err := engine.MVCCGetVersions(e, key)
+		if err != nil {
+			log.Errorf("failed to read versions of %q from store %d: %s", key, i, err)
+			return
+		}
+		fmt.Fprintf(os.Stdout, "store %d: %d version(s) of %q\n", i, len(versions), key)
+		for _, v := range versions {
+			fmt.Fprintf(os.Stdout, "  %s\n", formatMVCCVersion(v))
+		}
+	}
+}
+
+// formatMVCCVersion formats a version for mvcc-history output.
+func formatMVCCVersion(v engine.MVCCVersion) string {
+	var desc string
+	switch {
+	case v.Deleted:
+		desc = "<deleted>"
+	case v.Value == nil:
+		desc = "<nil>"
+	default:
+		if i, err := v.Value.GetInt(); err == nil {
+			desc = fmt.Sprintf("integer %d", i)
+		} else {
+			desc = fmt.Sprintf("%q", v.Value.Bytes)
+		}
+	}
+	if v.Txn != nil {
+		desc += fmt.Sprintf(" (intent of txn %s)", v.Txn)
+	}
+	return fmt.Sprintf("%s: %s", v.Timestamp, desc)
+}
+
+// runDebugRecover resurrects the range with the specified Raft ID
+// from its replica in the stores specified by -stores.
+func runDebugRecover(raftID int64) {
+	engines, err := initEngines(*stores)
+	if err != nil {
+		log.Errorf("failed to initialize engines from -stores=%s: %s", *stores, err)
+		return
+	}
+	for i, e := range engines {
+		if err := e.Start(); err != nil {
+			log.Errorf("failed to start engine %d: %s", i, err)
+			return
+		}
+		defer e.Stop()
+	}
+	now := hlc.NewClock(hlc.UnixNano).Now()
+	res, err := storage.ResurrectRange(engines, raftID, now, !*debugRecoverConfirm)
+	if err != nil {
+		log.Errorf("unable to recover range %d: %s", raftID, err)
+		return
+	}
+	verb := "would rewrite"
+	if *debugRecoverConfirm {
+		verb = "rewrote"
+	}
+	fmt.Fprintf(os.Stdout, "%s range %d [%q, %q) on store %d: replicas %+v -> %+v\n",
+		verb, raftID, res.New.StartKey, res.New.EndKey, res.StoreID, res.Old.Replicas, res.New.Replicas)
+	for _, key := range res.Updated {
+		fmt.Fprintf(os.Stdout, "%s addressing record %q\n", verb, key)
+	}
+	for _, key := range res.Skipped {
+		fmt.Fprintf(os.Stdout, "addressing record %q is not held by these stores; rebuild it with recover-meta\n", key)
+	}
+	if !*debugRecoverConfirm {
+		fmt.Fprintf(os.Stdout, "rerun with -debug_recover_confirm to apply\n")
+	}
+}
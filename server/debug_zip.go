@@ -0,0 +1,173 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// debugZipClusterFiles lists the cluster-wide files of a debug zip
+// and the paths from which they're fetched. They're fetched from the
+// first reachable node.
+var debugZipClusterFiles = []struct{ name, path string }{
+	{"jobs.json", jobsPathPrefix},
+	{"settings.json", settingsPathPrefix},
+}
+
+// debugZipNodeFiles lists the files of a debug zip fetched from each
+// node and the paths from which they're fetched.
+var debugZipNodeFiles = []struct{ name, path string }{
+	{"details.json", statusDetailsKey},
+	{"goroutines.txt", statusLocalGoroutinesKey},
+	{"gossip.json", statusGossipKeyPrefix},
+	{"heap.prof", debugEndpoint + "pprof/heap"},
+	{"hotranges.json", statusHotRangesKey},
+	{"queues.json", queuesPathPrefix},
+	{"readcache.json", statusLocalReadCacheKey},
+	{"transactions.json", statusTransactionsKey},
+}
+
+// debugZipGet fetches path from the node at addr, presenting the
+// -admin_token if specified.
+func debugZipGet(addr, path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s", adminScheme, addr, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if *adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+	}
+	return sendAdminRequest(req)
+}
+
+// A debugZipper writes the files of a debug zip.
+type debugZipper struct {
+	zw     *zip.Writer
+	failed int // Number of files which couldn't be fetched
+}
+
+// add writes the named file with contents b or, if the file couldn't
+// be fetched, a file named <name>.err holding the error.
+func (z *debugZipper) add(name string, b []byte, fetchErr error) error {
+	if fetchErr != nil {
+		z.failed++
+		name, b = name+".err", []byte(fetchErr.Error()+"\n")
+	}
+	fh := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	fh.SetModTime(time.Now())
+	w, err := z.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// addNode writes the files fetched from the node at addr, including
+// its log files, under nodes/<addr>/. Nodes which don't respond to
+// health checks are recorded as unreachable.
+func (z *debugZipper) addNode(addr string) error {
+	prefix := path.Join("nodes", strings.Replace(addr, ":", "_", -1))
+	if _, err := debugZipGet(addr, healthzPath); err != nil {
+		return z.add(path.Join(prefix, "unreachable"), nil, err)
+	}
+	for _, f := range debugZipNodeFiles {
+		b, err := debugZipGet(addr, f.path)
+		if err := z.add(path.Join(prefix, f.name), b, err); err != nil {
+			return err
+		}
+	}
+	b, err := debugZipGet(addr, statusLocalLogsKeyPrefix)
+	var names []string
+	if err == nil {
+		err = json.Unmarshal(b, &names)
+	}
+	if err != nil {
+		return z.add(path.Join(prefix, "logs"), nil, err)
+	}
+	for _, name := range names {
+		b, err := debugZipGet(addr, statusLocalLogsKeyPrefix+name)
+		if err := z.add(path.Join(prefix, "logs", name), b, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDebugZip writes a debug zip to w holding the cluster-wide files
+// and the files of each of the nodes at addrs. Returns the number of
+// files which couldn't be fetched.
+func writeDebugZip(w io.Writer, addrs []string) (int, error) {
+	z := &debugZipper{zw: zip.NewWriter(w)}
+	for _, f := range debugZipClusterFiles {
+		var b []byte
+		err := util.Errorf("no node reachable")
+		for _, addr := range addrs {
+			if b, err = debugZipGet(addr, f.path); err == nil {
+				break
+			}
+		}
+		if err := z.add(f.name, b, err); err != nil {
+			return z.failed, err
+		}
+	}
+	for _, addr := range addrs {
+		if err := z.addNode(addr); err != nil {
+			return z.failed, err
+		}
+	}
+	return z.failed, z.zw.Close()
+}
+
+// runDebugZip writes a debug zip to the named file, gathering files
+// from the node at -addr and those at -debug_zip_addrs.
+func runDebugZip(name string) {
+	addrs := []string{*addr}
+	seen := map[string]bool{*addr: true}
+	for _, a := range strings.Split(*debugZipAddrs, ",") {
+		if a = strings.TrimSpace(a); a != "" && !seen[a] {
+			seen[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		log.Errorf("unable to create %s: %s", name, err)
+		return
+	}
+	defer f.Close()
+	failed, err := writeDebugZip(f, addrs)
+	if err != nil {
+		log.Errorf("unable to write %s: %s", name, err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "wrote debug zip of %d node(s) to %s", len(addrs), name)
+	if failed > 0 {
+		fmt.Fprintf(os.Stdout, "; %d file(s) could not be fetched, see the .err files", failed)
+	}
+	fmt.Fprintln(os.Stdout)
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestDebugZip verifies that a debug zip holds the cluster-wide files
+// and the files of each reachable node, and records unreachable nodes.
+func TestDebugZip(t *testing.T) {
+	db, err := BootstrapCluster("cluster-1", engine.NewInMem(proto.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stores := kv.NewLocalSender()
+	mux := http.NewServeMux()
+	newAdminServer(db, stores).RegisterHandlers(mux)
+	newStatusServer(db, gossip.New(nil), stores).RegisterHandlers(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	nodeAddr := strings.TrimPrefix(s.URL, "http://")
+	// Nothing listens on the discard port.
+	deadAddr := "127.0.0.1:9"
+
+	var buf bytes.Buffer
+	failed, err := writeDebugZip(&buf, []string{deadAddr, nodeAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed != 1 {
+		t.Errorf("expected only the unreachable node to fail; got %d failures", failed)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]bool{}
+	for _, f := range zr.File {
+		files[f.Name] = true
+	}
+	nodePrefix := "nodes/" + strings.Replace(nodeAddr, ":", "_", -1) + "/"
+	expFiles := []string{"jobs.json", "settings.json", "nodes/127.0.0.1_9/unreachable.err"}
+	for _, f := range debugZipNodeFiles {
+		expFiles = append(expFiles, nodePrefix+f.name)
+	}
+	for _, name := range expFiles {
+		if !files[name] {
+			t.Errorf("expected %s in debug zip; got %v", name, files)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/structured"
+)
+
+// An explainSpan is a span of an explainResponse, with query escaped
+// keys.
+type explainSpan struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// An explainResponse is the plan of a structured read, with readable
+// spans.
+type explainResponse struct {
+	*structured.Plan
+	Spans []explainSpan `json:"spans"`
+}
+
+// handleExplainAction responds to GET of
+// <prefix>/<schema-key>/<table>?<column>=<value>&... with the plan of
+// a read of the table's rows with the given column values: the index
+// used, the spans of keys read and the estimated number of rows. Rows
+// are estimated from the stats of the ranges overlapping the spans
+// which have replicas on this node's stores; other ranges aren't
+// counted. The plan is of the version of the schema leased by the
+// node; until the node has started, requests are refused with 503.
+func (s *adminServer) handleExplainAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, explainPathPrefix), "/"), "/")
+	if len(parts) != 2 {
+		http.Error(w, "expected path "+explainPathPrefix+"/<schema-key>/<table>", http.StatusBadRequest)
+		return
+	}
+	if s.schemas == nil {
+		http.Error(w, "schema leases are unavailable until the node has started", http.StatusServiceUnavailable)
+		return
+	}
+	schema, _, err := s.schemas.Acquire(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if schema == nil {
+		http.Error(w, "schema "+parts[0]+" not found", http.StatusNotFound)
+		return
+	}
+	values := map[string]string{}
+	for name, v := range r.URL.Query() {
+		values[name] = v[0]
+	}
+	plan, err := structured.Explain(schema, parts[1], values, s.countRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := &explainResponse{Plan: plan}
+	for _, span := range plan.Spans {
+		resp.Spans = append(resp.Spans, explainSpan{
+			Start: url.QueryEscape(string(span.Start)),
+			End:   url.QueryEscape(string(span.End)),
+		})
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// countRows estimates the rows of span as the live keys of the ranges
+// with replicas on this node's stores which overlap it.
+func (s *adminServer) countRows(span structured.Span) (int64, error) {
+	var rows int64
+	counted := map[int64]struct{}{}
+	err := s.stores.VisitStores(func(store *storage.Store) error {
+		descs, err := storage.ReadRangeDescriptors(store.Engine())
+		if err != nil {
+			return err
+		}
+		for _, desc := range descs {
+			if _, ok := counted[desc.RaftID]; ok {
+				continue
+			}
+			if !span.Start.Less(desc.EndKey) || !desc.StartKey.Less(span.End) {
+				continue
+			}
+			counted[desc.RaftID] = struct{}{}
+			ms, err := engine.MVCCGetRangeStats(store.Engine(), desc.RaftID)
+			if err != nil {
+				return err
+			}
+			rows += ms.LiveCount
+		}
+		return nil
+	})
+	return rows, err
+}
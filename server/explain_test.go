@@ -0,0 +1,38 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestExplainBeforeStart verifies that explain requests are refused
+// with 503 until the node's schema leases are available.
+func TestExplainBeforeStart(t *testing.T) {
+	s := createTestAdminServer(t)
+	defer s.db.Close()
+	req, err := http.NewRequest("GET", explainPathPrefix+"/db/users?id=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.handleExplainAction(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503; got %d", w.Code)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// makeGossipSnapshot returns a snapshot taken at wallTime of the
+// cluster membership known to g: the descriptors of stores, including
+// the node's own, and the first range's descriptor, if gossiped.
+func makeGossipSnapshot(g *gossip.Gossip, stores []*storage.StoreDescriptor, wallTime int64) *proto.GossipSnapshot {
+	snap := &proto.GossipSnapshot{WallTime: wallTime}
+	for _, sd := range stores {
+		snap.Stores = append(snap.Stores, proto.GossipSnapshotStore{
+			NodeID:         sd.Node.NodeID,
+			AddressNetwork: sd.Node.Address.Network(),
+			Address:        sd.Node.Address.String(),
+			NodeAttrs:      sd.Node.Attrs,
+			StoreID:        sd.StoreID,
+			Attrs:          sd.Attrs,
+			Capacity:       sd.Capacity.Capacity,
+			Available:      sd.Capacity.Available,
+		})
+	}
+	if info, err := g.GetInfo(gossip.KeyFirstRangeDescriptor); err == nil {
+		if desc, ok := info.(proto.RangeDescriptor); ok {
+			snap.FirstRange = &desc
+		}
+	}
+	return snap
+}
+
+// restoreGossipSnapshot adds the store descriptors, node addresses and
+// first range descriptor of snap to g, where they expire
+// ttlCapacityGossip after now in nanoseconds since the Unix epoch, as
+// though gossiped when the node started. Snapshots of any age are
+// restored: after a full cluster restart, they're the only source of
+// the cluster membership until the nodes gossip again. Infos gossiped
+// since the snapshot was taken are kept. Returns the number of
+// restored infos.
+func restoreGossipSnapshot(g *gossip.Gossip, snap *proto.GossipSnapshot, now int64) int {
+	ttlStamp := now + int64(ttlCapacityGossip)
+	var restored int
+	restore := func(key string, val interface{}) {
+		if err := g.RestoreInfo(key, val, snap.WallTime, ttlStamp); err == nil {
+			restored++
+		}
+	}
+	nodes := map[int32]bool{}
+	for _, ss := range snap.Stores {
+		addr := util.MakeRawAddr(ss.AddressNetwork, ss.Address)
+		node := storage.NodeDescriptor{NodeID: ss.NodeID, Address: &addr, Attrs: ss.NodeAttrs}
+		if !nodes[ss.NodeID] {
+			nodes[ss.NodeID] = true
+			restore(gossip.MakeNodeIDGossipKey(ss.NodeID), node.Address)
+		}
+		// Whether the store has restarted since the snapshot is
+		// unknown, so it isn't taken to be warm until it gossips.
+		restore(gossip.MakeCapacityGossipKey(ss.NodeID, ss.StoreID), storage.StoreDescriptor{
+			StoreID:   ss.StoreID,
+			Attrs:     ss.Attrs,
+			Node:      node,
+			Capacity:  engine.StoreCapacity{Capacity: ss.Capacity, Available: ss.Available},
+			WarmingUp: true,
+		})
+	}
+	if snap.FirstRange != nil {
+		restore(gossip.KeyFirstRangeDescriptor, *snap.FirstRange)
+	}
+	return restored
+}
+
+// saveGossipSnapshot persists a snapshot of the cluster membership
+// known to the node to each of its stores.
+func (n *Node) saveGossipSnapshot() {
+	var snap *proto.GossipSnapshot
+	n.lSender.VisitStores(func(s *storage.Store) error {
+		if snap == nil {
+			// All stores of the node know the same gossiped stores.
+			stores, err := s.FindStores(proto.Attributes{})
+			if err != nil {
+				return err
+			}
+			snap = makeGossipSnapshot(n.gossip, stores, s.Clock().PhysicalNow())
+		}
+		if err := engine.MVCCPutProto(s.Engine(), nil, engine.StoreGossipSnapshotKey(), proto.ZeroTimestamp, nil, snap); err != nil {
+			log.Warningf("unable to persist gossip snapshot to store %s: %s", s, err)
+		}
+		return nil
+	})
+}
+
+// loadGossipSnapshot restores the most recent snapshot of the cluster
+// membership persisted to the node's stores into gossip, as of now in
+// nanoseconds since the Unix epoch.
+func (n *Node) loadGossipSnapshot(now int64) {
+	var latest *proto.GossipSnapshot
+	n.lSender.VisitStores(func(s *storage.Store) error {
+		snap := &proto.GossipSnapshot{}
+		ok, err := engine.MVCCGetProto(s.Engine(), engine.StoreGossipSnapshotKey(), proto.ZeroTimestamp, nil, snap)
+		if err != nil {
+			log.Warningf("unable to read gossip snapshot of store %s: %s", s, err)
+			return nil
+		}
+		if ok && (latest == nil || latest.WallTime < snap.WallTime) {
+			latest = snap
+		}
+		return nil
+	})
+	if latest == nil {
+		return
+	}
+	restored := restoreGossipSnapshot(n.gossip, latest, now)
+	log.Infof("restored %d gossip info(s) from snapshot of %d store(s)", restored, len(latest.Stores))
+}
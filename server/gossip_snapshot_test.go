@@ -0,0 +1,95 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestGossipSnapshot verifies that the cluster membership persisted
+// in a gossip snapshot is restored into gossip, and that infos
+// gossiped since the snapshot was taken are kept.
+func TestGossipSnapshot(t *testing.T) {
+	addr := util.MakeRawAddr("tcp", "node1:26257")
+	stores := []*storage.StoreDescriptor{
+		{StoreID: 1, Node: storage.NodeDescriptor{NodeID: 1, Address: &addr}, Capacity: engine.StoreCapacity{Capacity: 100, Available: 50}},
+		{StoreID: 2, Node: storage.NodeDescriptor{NodeID: 1, Address: &addr}, Attrs: proto.Attributes{Attrs: []string{"ssd"}}},
+	}
+	g := gossip.New(nil)
+	firstRange := proto.RangeDescriptor{RaftID: 1, StartKey: engine.KeyMin, EndKey: engine.KeyMax}
+	if err := g.AddInfo(gossip.KeyFirstRangeDescriptor, firstRange, 0*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	snapTime := time.Now().UnixNano()
+	snap := makeGossipSnapshot(g, stores, snapTime)
+
+	e := engine.NewInMem(proto.Attributes{}, 1<<20)
+	if err := engine.MVCCPutProto(e, nil, engine.StoreGossipSnapshotKey(), proto.ZeroTimestamp, nil, snap); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &proto.GossipSnapshot{}
+	if ok, err := engine.MVCCGetProto(e, engine.StoreGossipSnapshotKey(), proto.ZeroTimestamp, nil, loaded); !ok || err != nil {
+		t.Fatalf("unable to read gossip snapshot: %t, %v", ok, err)
+	}
+
+	restored := gossip.New(nil)
+	// Store 2's descriptor was gossiped after the snapshot was taken.
+	fresh := *stores[1]
+	fresh.Capacity.Available = 10
+	if err := restored.AddInfo(gossip.MakeCapacityGossipKey(1, 2), fresh, ttlCapacityGossip); err != nil {
+		t.Fatal(err)
+	}
+	if n := restoreGossipSnapshot(restored, loaded, snapTime); n != 3 {
+		t.Errorf("expected a node address, a store descriptor and the first range to be restored; got %d infos", n)
+	}
+
+	if info, err := restored.GetInfo(gossip.MakeNodeIDGossipKey(1)); err != nil || info.(net.Addr).String() != addr.String() {
+		t.Errorf("expected address %s of node 1; got %v, %v", addr, info, err)
+	}
+	if info, err := restored.GetInfo(gossip.MakeCapacityGossipKey(1, 1)); err != nil ||
+		info.(storage.StoreDescriptor).Capacity.Available != 50 || !info.(storage.StoreDescriptor).WarmingUp {
+		t.Errorf("expected the descriptor of store 1, not known to be warm; got %+v, %v", info, err)
+	}
+	if info, err := restored.GetInfo(gossip.MakeCapacityGossipKey(1, 2)); err != nil ||
+		info.(storage.StoreDescriptor).Capacity.Available != 10 {
+		t.Errorf("expected the fresher descriptor of store 2 to be kept; got %+v, %v", info, err)
+	}
+	if info, err := restored.GetInfo(gossip.KeyFirstRangeDescriptor); err != nil ||
+		info.(proto.RangeDescriptor).RaftID != firstRange.RaftID {
+		t.Errorf("expected the first range descriptor; got %+v, %v", info, err)
+	}
+
+	// Snapshots of any age are restored, and their infos expire
+	// ttlCapacityGossip after the node started.
+	if n := restoreGossipSnapshot(gossip.New(nil), loaded, snapTime+int64(10*ttlCapacityGossip)); n != 3 {
+		t.Errorf("expected all infos to be restored from an old snapshot; got %d infos", n)
+	}
+	expired := gossip.New(nil)
+	if n := restoreGossipSnapshot(expired, loaded, snapTime-int64(ttlCapacityGossip)); n != 3 {
+		t.Errorf("expected all infos to be restored; got %d infos", n)
+	}
+	if _, err := expired.GetInfo(gossip.KeyFirstRangeDescriptor); err == nil {
+		t.Error("expected infos restored by a node started ttlCapacityGossip ago to have expired")
+	}
+}
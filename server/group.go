@@ -0,0 +1,116 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// A groupHandler implements the actionHandler interface. Group
+// memberships are stored under engine.KeyGroupPrefix and may be
+// granted permissions by naming the group, prefixed by
+// proto.GroupPrefix, in permission configs. Membership changes take
+// effect once each node's cached memberships expire.
+type groupHandler struct {
+	db *client.KV // Key-value database client
+}
+
+// Put writes the membership of the group specified by path. The
+// membership is parsed from the body, which must validly parse into
+// a group config struct.
+func (gh *groupHandler) Put(path string, body []byte, r *http.Request) error {
+	if len(path) <= 1 {
+		return util.Errorf("no group specified for group Put")
+	}
+	config := &proto.GroupConfig{}
+	if err := util.UnmarshalRequest(r, body, config, util.AllEncodings); err != nil {
+		return util.Errorf("group config has invalid format: %s: %s", config, err)
+	}
+	return gh.db.PutProto(engine.GroupKey(path[1:]), config)
+}
+
+// Get retrieves the membership of the group specified by path. If
+// path is empty, the names of all groups are returned.
+func (gh *groupHandler) Get(path string, r *http.Request) (body []byte, contentType string, err error) {
+	if len(path) <= 1 {
+		sr := &proto.ScanResponse{}
+		if err = gh.db.Call(proto.Scan, &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.KeyGroupPrefix,
+				EndKey: engine.KeyGroupPrefix.PrefixEnd(),
+				User:   storage.UserRoot,
+			},
+			MaxResults: maxGetResults,
+		}, sr); err != nil {
+			return
+		}
+		if len(sr.Rows) == maxGetResults {
+			log.Warningf("retrieved maximum number of results (%d); some may be missing", maxGetResults)
+		}
+		names := []string{}
+		for _, kv := range sr.Rows {
+			trimmed := bytes.TrimPrefix(kv.Key, engine.KeyGroupPrefix)
+			names = append(names, url.QueryEscape(string(trimmed)))
+		}
+		return util.MarshalResponse(r, names, util.AllEncodings)
+	}
+	config := &proto.GroupConfig{}
+	var ok bool
+	if ok, _, err = gh.db.GetProto(engine.GroupKey(path[1:]), config); err != nil {
+		return
+	}
+	if !ok {
+		err = util.Errorf("no group %q found", path[1:])
+		return
+	}
+	return util.MarshalResponse(r, config, util.AllEncodings)
+}
+
+// Delete removes the group specified by path.
+func (gh *groupHandler) Delete(path string, r *http.Request) error {
+	if len(path) <= 1 {
+		return util.Errorf("no group specified for group Delete")
+	}
+	return gh.db.Call(proto.Delete, &proto.DeleteRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  engine.GroupKey(path[1:]),
+			User: storage.UserRoot,
+		},
+	}, &proto.DeleteResponse{})
+}
+
+// handleGroupAction handles actions for group memberships by method.
+func (s *adminServer) handleGroupAction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.handleGetAction(s.groups, w, r, groupsPathPrefix)
+	case "PUT", "POST":
+		s.handlePutAction(s.groups, w, r, groupsPathPrefix)
+	case "DELETE":
+		s.handleDeleteAction(s.groups, w, r, groupsPathPrefix)
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	}
+}
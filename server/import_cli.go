@@ -0,0 +1,174 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// storeManifestFile is the name of the file in a store directory to
+// which import-store writes the store's manifest.
+const storeManifestFile = "store-manifest.json"
+
+// A CmdImportStore command writes manifests of store copies and
+// imports store copies verified against their manifests.
+var CmdImportStore = &commander.Command{
+	UsageLine: "import-store [options] (manifest <src> | load <src> <dir>)",
+	Short:     "verifies and imports copies of stores",
+	Long: `
+Imports a copy of a store, such as a checkpoint clone or the SSTables
+and RocksDB manifest of a store copied by a backup, into a new store.
+Before the copy is imported, it's verified against a manifest of the
+store's ranges written when the copy was made. Stores are opened
+directly, so the node using them must not be running. Opening a store
+may write to its directory.
+
+manifest <src>
+
+Writes the manifest of the store in <src> to <src>/store-manifest.json.
+The manifest holds the store's ident and the descriptor, key count
+and checksum of each of its ranges.
+
+load <src> <dir>
+
+Verifies the store in <src> against <src>/store-manifest.json and
+copies it to a new store in <dir>. The ident and range descriptors of
+the store must match the manifest, and each range's data must match
+its checksum. Ranges of the store missing from the manifest are
+dropped along with their data. The new store has the ident of the
+original, so a test cluster seeded with imported stores must be made
+up of imports of all of the original cluster's stores and must not be
+able to reach the original cluster. For example:
+
+  cockroach checkpoint -stores=ssd=/mnt/ssd1 clone nightly /mnt/backup/nightly
+  cockroach import-store manifest /mnt/backup/nightly/0
+  cockroach import-store load /mnt/backup/nightly/0 /mnt/ssd2/test
+  cockroach start -stores=ssd=/mnt/ssd2/test ...
+`,
+	Run:  runImportStore,
+	Flag: *flag.CommandLine,
+}
+
+// runImportStore dispatches to the requested import-store operation.
+func runImportStore(cmd *commander.Command, args []string) {
+	var err error
+	switch {
+	case len(args) == 2 && args[0] == "manifest":
+		err = writeStoreManifest(args[1])
+	case len(args) == 3 && args[0] == "load":
+		err = importStore(args[1], args[2])
+	default:
+		cmd.Usage()
+		return
+	}
+	if err != nil {
+		log.Errorf("import-store %s failed: %s", args[0], err)
+	}
+}
+
+// openStoreCopy opens the existing store in dir.
+func openStoreCopy(dir string) (*engine.RocksDB, error) {
+	// Opening a RocksDB creates it if it's missing.
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	r := engine.NewRocksDB(proto.Attributes{}, dir)
+	if err := r.Start(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// writeStoreManifest writes the manifest of the store in dir.
+func writeStoreManifest(dir string) error {
+	src, err := openStoreCopy(dir)
+	if err != nil {
+		return err
+	}
+	defer src.Stop()
+	manifest, err := storage.NewStoreManifest(src)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, storeManifestFile)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "wrote manifest of %d range(s) to %s\n", len(manifest.Ranges), path)
+	return nil
+}
+
+// importStore verifies the store in srcDir against its manifest and
+// copies it to a new store in dir.
+func importStore(srcDir, dir string) error {
+	b, err := ioutil.ReadFile(filepath.Join(srcDir, storeManifestFile))
+	if err != nil {
+		return err
+	}
+	manifest := &storage.StoreManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return util.Errorf("unable to decode manifest: %s", err)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return util.Errorf("%s already exists", dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	src, err := openStoreCopy(srcDir)
+	if err != nil {
+		return err
+	}
+	defer src.Stop()
+	dst := engine.NewRocksDB(proto.Attributes{}, dir)
+	if err := dst.Start(); err != nil {
+		return err
+	}
+
+	imp, err := storage.ImportStore(src, dst, manifest)
+	if err != nil {
+		// Leave no partially imported store behind.
+		dst.Stop()
+		if err := dst.Destroy(); err != nil {
+			log.Warningf("unable to remove partially imported store %s: %s", dir, err)
+		}
+		return err
+	}
+	dst.CompactRange(nil, nil)
+	dst.Stop()
+	fmt.Fprintf(os.Stdout, "imported store %d of node %d to %s: %d range(s), %d key(s) (%d bytes)\n",
+		manifest.Ident.StoreID, manifest.Ident.NodeID, dir, imp.Ranges, imp.Keys, imp.Bytes)
+	for _, raftID := range imp.DroppedRanges {
+		fmt.Fprintf(os.Stdout, "  dropped range %d: missing from manifest\n", raftID)
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// A jobFunc runs a job, resuming from jc.Job().Checkpoint if set. It
+// should call jc.Progress periodically and return the error from
+// Progress, if any, so that the job stops promptly when paused or
+// canceled.
+type jobFunc func(jc *jobContext) error
+
+// jobTypes maps job types to the functions which run them. Long
+// running operations, such as backup, restore, index backfill and GC
+// campaigns, register themselves here via registerJobType, or with a
+// single registry via jobRegistry.register if they require state
+// beyond the jobContext.
+var jobTypes = map[string]jobFunc{}
+
+// registerJobType registers fn to run jobs of the given type. It is
+// intended to be called from init functions.
+func registerJobType(typ string, fn jobFunc) {
+	if _, ok := jobTypes[typ]; ok {
+		panic(fmt.Sprintf("job type %q registered twice", typ))
+	}
+	jobTypes[typ] = fn
+}
+
+// A jobInterruptedError is returned by jobContext.Progress when the
+// job is no longer running, having been paused or canceled.
+type jobInterruptedError struct {
+	id     int64
+	status proto.JobStatus
+}
+
+// Error implements the error interface.
+func (e *jobInterruptedError) Error() string {
+	return fmt.Sprintf("job %d interrupted: %s", e.id, e.status)
+}
+
+// A jobContext is supplied to a running jobFunc.
+type jobContext struct {
+	registry *jobRegistry
+	job      proto.Job
+}
+
+// Job returns the job's record as of its start or most recent
+// progress update.
+func (jc *jobContext) Job() *proto.Job {
+	return &jc.job
+}
+
+// Progress records the fraction completed and a checkpoint from which
+// the job may be resumed. Returns a jobInterruptedError if the job
+// has been paused or canceled, in which case the job should stop.
+func (jc *jobContext) Progress(fraction float64, checkpoint []byte) error {
+	job, err := jc.registry.update(jc.job.ID, func(job *proto.Job) error {
+		if job.Status != proto.JOB_RUNNING {
+			return &jobInterruptedError{id: job.ID, status: job.Status}
+		}
+		job.FractionCompleted = fraction
+		job.Checkpoint = checkpoint
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	jc.job = *job
+	return nil
+}
+
+// A jobRegistry creates, runs and controls jobs, persisting their
+// records under engine.KeyJobPrefix.
+//
+// TODO: jobs which were running when their node exited are
+// left RUNNING. They should be adopted by another node, which
+// requires a lease on the job record so that only one node runs each
+// job.
+type jobRegistry struct {
+	db      *client.KV
+	mu      sync.Mutex
+	types   map[string]jobFunc
+	running map[int64]struct{} // IDs of jobs executing on this node
+	wg      sync.WaitGroup
+}
+
+// newJobRegistry returns a new job registry using db.
+func newJobRegistry(db *client.KV) *jobRegistry {
+	jr := &jobRegistry{
+		db:      db,
+		types:   map[string]jobFunc{},
+		running: map[int64]struct{}{},
+	}
+	for typ, fn := range jobTypes {
+		jr.types[typ] = fn
+	}
+	return jr
+}
+
+// register registers fn to run jobs of the given type created or
+// resumed by this registry.
+func (jr *jobRegistry) register(typ string, fn jobFunc) {
+	jr.types[typ] = fn
+}
+
+// Create allocates and persists a new job of the specified type with
+// type-specific details and starts running it.
+func (jr *jobRegistry) Create(typ, description string, details []byte) (*proto.Job, error) {
+	if _, ok := jr.types[typ]; !ok {
+		return nil, util.Errorf("unknown job type %q", typ)
+	}
+	iReply := &proto.IncrementResponse{}
+	if err := jr.db.Call(proto.Increment, &proto.IncrementRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  engine.KeyJobIDGenerator,
+			User: storage.UserRoot,
+		},
+		Increment: 1,
+	}, iReply); err != nil {
+		return nil, util.Errorf("unable to allocate job ID: %s", err)
+	}
+	now := time.Now().UnixNano()
+	job := &proto.Job{
+		ID:            iReply.NewValue,
+		Type:          typ,
+		Description:   description,
+		Status:        proto.JOB_RUNNING,
+		CreatedNanos:  now,
+		ModifiedNanos: now,
+		Details:       details,
+	}
+	if err := jr.db.PutProto(engine.JobKey(job.ID), job); err != nil {
+		return nil, err
+	}
+	jr.start(job)
+	return job, nil
+}
+
+// Get returns the record of the job with the given ID.
+func (jr *jobRegistry) Get(id int64) (*proto.Job, error) {
+	job := &proto.Job{}
+	ok, _, err := jr.db.GetProto(engine.JobKey(id), job)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, util.Errorf("job %d not found", id)
+	}
+	return job, nil
+}
+
+// List returns the records of all jobs, ordered by ID.
+func (jr *jobRegistry) List() ([]*proto.Job, error) {
+	sr := &proto.ScanResponse{}
+	if err := jr.db.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.KeyJobPrefix,
+			EndKey: engine.KeyJobPrefix.PrefixEnd(),
+			User:   storage.UserRoot,
+		},
+	}, sr); err != nil {
+		return nil, err
+	}
+	jobs := make([]*proto.Job, 0, len(sr.Rows))
+	for _, kv := range sr.Rows {
+		job := &proto.Job{}
+		if err := gogoproto.Unmarshal(kv.Value.Bytes, job); err != nil {
+			return nil, util.Errorf("unable to decode job at key %q: %s", kv.Key, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Pause pauses a running job. The job stops at its next progress
+// update and may later be resumed from its most recent checkpoint.
+func (jr *jobRegistry) Pause(id int64) error {
+	_, err := jr.update(id, func(job *proto.Job) error {
+		if job.Status != proto.JOB_RUNNING {
+			return util.Errorf("cannot pause job %d: job is %s", id, job.Status)
+		}
+		job.Status = proto.JOB_PAUSED
+		return nil
+	})
+	return err
+}
+
+// Resume restarts a paused job from its most recent checkpoint. A job
+// which has been paused but has not yet stopped cannot be resumed.
+func (jr *jobRegistry) Resume(id int64) error {
+	jr.mu.Lock()
+	_, running := jr.running[id]
+	jr.mu.Unlock()
+	if running {
+		return util.Errorf("cannot resume job %d: job has not yet stopped", id)
+	}
+	job, err := jr.update(id, func(job *proto.Job) error {
+		if job.Status != proto.JOB_PAUSED {
+			return util.Errorf("cannot resume job %d: job is %s", id, job.Status)
+		}
+		if _, ok := jr.types[job.Type]; !ok {
+			return util.Errorf("cannot resume job %d: unknown job type %q", id, job.Type)
+		}
+		job.Status = proto.JOB_RUNNING
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	jr.start(job)
+	return nil
+}
+
+// Cancel cancels a running or paused job. A running job stops at its
+// next progress update.
+func (jr *jobRegistry) Cancel(id int64) error {
+	_, err := jr.update(id, func(job *proto.Job) error {
+		if job.Status != proto.JOB_RUNNING && job.Status != proto.JOB_PAUSED {
+			return util.Errorf("cannot cancel job %d: job is %s", id, job.Status)
+		}
+		job.Status = proto.JOB_CANCELED
+		return nil
+	})
+	return err
+}
+
+// Wait blocks until all jobs running on this node have stopped.
+func (jr *jobRegistry) Wait() {
+	jr.wg.Wait()
+}
+
+// update transactionally reads the record of the job with the given
+// ID, applies fn and writes back the result if fn succeeds.
+func (jr *jobRegistry) update(id int64, fn func(job *proto.Job) error) (*proto.Job, error) {
+	var job *proto.Job
+	txnOpts := &client.TransactionOptions{Name: fmt.Sprintf("update job %d", id)}
+	if err := jr.db.RunTransaction(txnOpts, func(txn *client.KV) error {
+		job = &proto.Job{}
+		ok, _, err := txn.GetProto(engine.JobKey(id), job)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return util.Errorf("job %d not found", id)
+		}
+		if err := fn(job); err != nil {
+			return err
+		}
+		job.ModifiedNanos = time.Now().UnixNano()
+		return txn.PutProto(engine.JobKey(id), job)
+	}); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// start runs the job in a new goroutine. On return of the job's
+// function, the job is marked succeeded or failed, unless it was
+// interrupted by a pause or cancellation.
+func (jr *jobRegistry) start(job *proto.Job) {
+	fn := jr.types[job.Type]
+	jr.mu.Lock()
+	jr.running[job.ID] = struct{}{}
+	jr.mu.Unlock()
+	jr.wg.Add(1)
+	go func() {
+		defer jr.wg.Done()
+		defer func() {
+			jr.mu.Lock()
+			delete(jr.running, job.ID)
+			jr.mu.Unlock()
+		}()
+		jobErr := fn(&jobContext{registry: jr, job: *job})
+		if _, ok := jobErr.(*jobInterruptedError); ok {
+			log.Infof("%s", jobErr)
+			return
+		}
+		if _, err := jr.update(job.ID, func(j *proto.Job) error {
+			if j.Status != proto.JOB_RUNNING {
+				return &jobInterruptedError{id: j.ID, status: j.Status}
+			}
+			if jobErr != nil {
+				j.Status = proto.JOB_FAILED
+				j.Error = jobErr.Error()
+			} else {
+				j.Status = proto.JOB_SUCCEEDED
+				j.FractionCompleted = 1
+			}
+			return nil
+		}); err != nil {
+			log.Warningf("unable to record completion of job %d: %s", job.ID, err)
+		}
+	}()
+}
+
+// handleJobsAction lists all jobs on GET of <prefix>, returns a
+// single job on GET of <prefix>/<id> and pauses, resumes or cancels a
+// job on POST or PUT of <prefix>/<id>/<action>, where action is one
+// of "pause", "resume" or "cancel".
+func (s *adminServer) handleJobsAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, jobsPathPrefix), "/"), "/")
+	if len(parts) == 1 && parts[0] == "" {
+		parts = nil
+	}
+	var id int64
+	if len(parts) > 0 {
+		var err error
+		if id, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid job ID %q: %s", parts[0], err), http.StatusBadRequest)
+			return
+		}
+	}
+	switch r.Method {
+	case "GET":
+		var result interface{}
+		var err error
+		switch len(parts) {
+		case 0:
+			result, err = s.jobs.List()
+		case 1:
+			if result, err = s.jobs.Get(id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "expected path "+jobsPathPrefix+"[/<id>]", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case "PUT", "POST":
+		if len(parts) != 2 {
+			http.Error(w, "expected path "+jobsPathPrefix+"/<id>/<action>", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch parts[1] {
+		case "pause":
+			err = s.jobs.Pause(id)
+		case "resume":
+			err = s.jobs.Resume(id)
+		case "cancel":
+			err = s.jobs.Cancel(id)
+		default:
+			http.Error(w, fmt.Sprintf("unknown job action %q", parts[1]), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+const testJobNumSteps = 4
+
+var (
+	// testJobSteps unblocks each step of a test job.
+	testJobSteps = make(chan struct{})
+	// testJobProgressed is signaled after each step's progress update.
+	testJobProgressed = make(chan struct{})
+)
+
+func init() {
+	// The test job runs testJobNumSteps steps, checkpointing the index
+	// of the next step after each.
+	registerJobType("test", func(jc *jobContext) error {
+		i := 0
+		if cp := jc.Job().Checkpoint; len(cp) > 0 {
+			i = int(cp[0])
+		}
+		for ; i < testJobNumSteps; i++ {
+			<-testJobSteps
+			if err := jc.Progress(float64(i+1)/testJobNumSteps, []byte{byte(i + 1)}); err != nil {
+				return err
+			}
+			testJobProgressed <- struct{}{}
+		}
+		return nil
+	})
+}
+
+func stepTestJob() {
+	testJobSteps <- struct{}{}
+	<-testJobProgressed
+}
+
+func verifyJob(t *testing.T, jr *jobRegistry, id int64, status proto.JobStatus, fraction float64) *proto.Job {
+	job, err := jr.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != status || job.FractionCompleted != fraction {
+		t.Errorf("expected job %d %s at %.2f; got %s at %.2f", id, status, fraction,
+			job.Status, job.FractionCompleted)
+	}
+	return job
+}
+
+// TestJobPauseResume verifies that a paused job stops at its next
+// progress update and resumes from its checkpoint.
+func TestJobPauseResume(t *testing.T) {
+	db, err := BootstrapCluster("cluster-1", engine.NewInMem(proto.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	jr := newJobRegistry(db)
+
+	if _, err := jr.Create("unknown", "", nil); err == nil {
+		t.Error("expected error creating job of unknown type")
+	}
+	job, err := jr.Create("test", "pause and resume", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stepTestJob()
+	if err := jr.Pause(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	// The job is interrupted at its next progress update.
+	testJobSteps <- struct{}{}
+	jr.Wait()
+	paused := verifyJob(t, jr, job.ID, proto.JOB_PAUSED, 0.25)
+	if !bytes.Equal(paused.Checkpoint, []byte{1}) {
+		t.Errorf("expected checkpoint [1]; got %v", paused.Checkpoint)
+	}
+	if err := jr.Pause(job.ID); err == nil {
+		t.Error("expected error pausing paused job")
+	}
+
+	if err := jr.Resume(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < testJobNumSteps; i++ {
+		stepTestJob()
+	}
+	jr.Wait()
+	verifyJob(t, jr, job.ID, proto.JOB_SUCCEEDED, 1)
+	if err := jr.Resume(job.ID); err == nil {
+		t.Error("expected error resuming succeeded job")
+	}
+
+	jobs, err := jr.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Errorf("expected job %d listed; got %+v", job.ID, jobs)
+	}
+}
+
+// TestJobCancel verifies canceling running and paused jobs.
+func TestJobCancel(t *testing.T) {
+	db, err := BootstrapCluster("cluster-1", engine.NewInMem(proto.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	jr := newJobRegistry(db)
+
+	running, err := jr.Create("test", "cancel running", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jr.Cancel(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	testJobSteps <- struct{}{}
+	jr.Wait()
+	verifyJob(t, jr, running.ID, proto.JOB_CANCELED, 0)
+
+	paused, err := jr.Create("test", "cancel paused", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jr.Pause(paused.ID); err != nil {
+		t.Fatal(err)
+	}
+	testJobSteps <- struct{}{}
+	jr.Wait()
+	if err := jr.Cancel(paused.ID); err != nil {
+		t.Fatal(err)
+	}
+	verifyJob(t, jr, paused.ID, proto.JOB_CANCELED, 0)
+	if err := jr.Resume(paused.ID); err == nil {
+		t.Error("expected error resuming canceled job")
+	}
+	if err := jr.Cancel(paused.ID); err == nil {
+		t.Error("expected error canceling canceled job")
+	}
+}
+
+// TestAdminJobs verifies listing and controlling jobs via the admin
+// REST API.
+func TestAdminJobs(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+	jI, err := getJSON(s.URL + jobsPathPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs, ok := jI.([]interface{}); !ok || len(jobs) != 0 {
+		t.Errorf("expected empty list of jobs; got %v", jI)
+	}
+	for _, path := range []string{"/1/pause", "/x/pause", "/1/frobnicate", "/1"} {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s%s%s", s.URL, jobsPathPrefix, path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sendAdminRequest(req); err == nil {
+			t.Errorf("%s: expected error", path)
+		}
+	}
+}
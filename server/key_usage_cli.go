@@ -0,0 +1,103 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// A CmdKeyUsage command displays the disk usage of the cluster by
+// top-level key prefix.
+var CmdKeyUsage = &commander.Command{
+	UsageLine: "key-usage [options] [<node-addr>...]",
+	Short:     "displays disk usage by top-level key prefix",
+	Long: `
+Fetches the live bytes, total bytes of all versions and range counts
+of the ranges led by each of the nodes at <node-addr>..., or at -addr
+if none are given, and displays their sums by top-level key prefix,
+largest first. The top-level prefix of a key is its tenant's prefix
+for tenant keys and otherwise the key up to and including its first
+'/', such as the schema key of structured tables; system keys share
+one prefix. To report on the whole cluster, list all of its nodes.
+For example:
+
+  cockroach key-usage node1:8080 node2:8080 node3:8080
+`,
+	Run:  runKeyUsage,
+	Flag: *flag.CommandLine,
+}
+
+// runKeyUsage fetches the key usage of each node via the status API
+// and prints their sums.
+func runKeyUsage(cmd *commander.Command, args []string) {
+	addrs := args
+	if len(addrs) == 0 {
+		addrs = []string{*addr}
+	}
+	total := &storage.KeyUsage{}
+	for _, nodeAddr := range addrs {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s", adminScheme, nodeAddr, statusKeyUsageKey), nil)
+		if err != nil {
+			log.Errorf("unable to create request to status endpoint: %s", err)
+			return
+		}
+		b, err := sendAdminRequest(req)
+		if err != nil {
+			log.Errorf("unable to fetch key usage of node %s: %s", nodeAddr, err)
+			return
+		}
+		ku := &storage.KeyUsage{}
+		if err := json.Unmarshal(b, ku); err != nil {
+			log.Errorf("unable to parse key usage of node %s: %s", nodeAddr, err)
+			return
+		}
+		total.Add(ku)
+	}
+	printKeyUsage(os.Stdout, total)
+}
+
+// printKeyUsage writes the usage of each prefix of ku to w, largest
+// first.
+func printKeyUsage(w io.Writer, ku *storage.KeyUsage) {
+	prefixes := append([]storage.PrefixUsage(nil), ku.Prefixes...)
+	sort.Sort(prefixUsagesBySize(prefixes))
+	fmt.Fprintf(w, "%-32s %14s %14s %8s\n", "PREFIX", "LIVE BYTES", "TOTAL BYTES", "RANGES")
+	for _, pu := range prefixes {
+		fmt.Fprintf(w, "%-32q %14d %14d %8d\n", string(pu.Prefix), pu.LiveBytes, pu.TotalBytes, pu.Ranges)
+	}
+	if ku.ScannedRanges > 0 {
+		fmt.Fprintf(w, "(%d range(s) holding several prefixes were scanned)\n", ku.ScannedRanges)
+	}
+}
+
+// prefixUsagesBySize sorts prefix usages by decreasing total bytes.
+type prefixUsagesBySize []storage.PrefixUsage
+
+func (pus prefixUsagesBySize) Len() int      { return len(pus) }
+func (pus prefixUsagesBySize) Swap(i, j int) { pus[i], pus[j] = pus[j], pus[i] }
+func (pus prefixUsagesBySize) Less(i, j int) bool {
+	return pus[i].TotalBytes > pus[j].TotalBytes
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/gob"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+const (
+	// latencyGossipInterval is the interval at which each node gossips
+	// the round-trip times it has measured to the other nodes.
+	latencyGossipInterval = 10 * time.Second
+	// ttlLatencyGossip is the time-to-live for gossiped round-trip
+	// times, after which the measurements of a node which has stopped
+	// gossiping are dropped.
+	ttlLatencyGossip = 3 * latencyGossipInterval
+)
+
+func init() {
+	gob.Register(map[int32]int64{})
+}
+
+// A latencyMonitor measures the round-trip times from its node to all
+// other nodes using the RPC heartbeats of clients it opens to each,
+// gossips them, and collects the gossiped times of all nodes into a
+// matrix.
+type latencyMonitor struct {
+	gossip *gossip.Gossip
+
+	mu    sync.Mutex
+	addrs map[int32]net.Addr        // Gossiped RPC addresses by node ID
+	rtts  map[int32]map[int32]int64 // Gossiped round-trip nanos, from node to node
+}
+
+// A latencyMatrix holds the round-trip times between pairs of nodes.
+// RTTNanos[i][j] is the round-trip time in nanoseconds measured by
+// node NodeIDs[i] to node NodeIDs[j]; zero on the diagonal and -1 if
+// not measured.
+type latencyMatrix struct {
+	NodeIDs  []int32
+	RTTNanos [][]int64
+}
+
+// newLatencyMonitor returns a latencyMonitor using the supplied gossip
+// network.
+func newLatencyMonitor(g *gossip.Gossip) *latencyMonitor {
+	return &latencyMonitor{
+		gossip: g,
+		addrs:  map[int32]net.Addr{},
+		rtts:   map[int32]map[int32]int64{},
+	}
+}
+
+// registerCallbacks registers for gossip updates to node addresses
+// and round-trip times.
+func (lm *latencyMonitor) registerCallbacks() {
+	lm.gossip.RegisterCallback("^"+gossip.KeyNodeIDPrefix+"[0-9a-f]+$", lm.gossipUpdate)
+	lm.gossip.RegisterCallback("^"+gossip.KeyLatencyPrefix+"[0-9a-f]+$", lm.gossipUpdate)
+}
+
+// gossipUpdate is a callback for gossip updates to node addresses and
+// round-trip times.
+func (lm *latencyMonitor) gossipUpdate(key string, contentsChanged bool) {
+	if !contentsChanged {
+		return
+	}
+	var prefix string
+	if strings.HasPrefix(key, gossip.KeyLatencyPrefix) {
+		prefix = gossip.KeyLatencyPrefix
+	} else {
+		prefix = gossip.KeyNodeIDPrefix
+	}
+	nodeID, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 16, 32)
+	if err != nil {
+		log.Errorf("unable to parse node ID from gossip key %s: %s", key, err)
+		return
+	}
+	info, err := lm.gossip.GetInfo(key)
+	if err != nil {
+		log.Errorf("unable to fetch %s from gossip: %s", key, err)
+		return
+	}
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	switch v := info.(type) {
+	case net.Addr:
+		lm.addrs[int32(nodeID)] = v
+	case map[int32]int64:
+		lm.rtts[int32(nodeID)] = v
+	default:
+		log.Errorf("unexpected gossiped value for %s: %+v", key, info)
+	}
+}
+
+// gossipLatencies connects to each of the other gossiped nodes, so
+// that their round-trip times are measured by heartbeats, and gossips
+// the times measured so far on behalf of nodeID.
+func (lm *latencyMonitor) gossipLatencies(nodeID int32) {
+	latencies := rpc.Latencies()
+	rtts := map[int32]int64{}
+	lm.mu.Lock()
+	for id, addr := range lm.addrs {
+		if id == nodeID {
+			continue
+		}
+		if latency, ok := latencies[addr.String()]; ok {
+			rtts[id] = latency.Nanoseconds()
+		} else {
+			rpc.NewClient(addr, nil, lm.gossip.RPCContext)
+		}
+	}
+	lm.mu.Unlock()
+	if err := lm.gossip.AddInfo(gossip.MakeLatencyGossipKey(nodeID), rtts, ttlLatencyGossip); err != nil {
+		log.Errorf("couldn't gossip round-trip times for node %d: %s", nodeID, err)
+	}
+}
+
+// matrix returns the gossiped round-trip times between all known
+// nodes.
+func (lm *latencyMonitor) matrix() latencyMatrix {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	known := map[int32]struct{}{}
+	for id := range lm.addrs {
+		known[id] = struct{}{}
+	}
+	for id := range lm.rtts {
+		known[id] = struct{}{}
+	}
+	m := latencyMatrix{NodeIDs: []int32{}, RTTNanos: [][]int64{}}
+	for id := range known {
+		m.NodeIDs = append(m.NodeIDs, id)
+	}
+	sort.Sort(proto.Int32Slice(m.NodeIDs))
+	for _, from := range m.NodeIDs {
+		row := make([]int64, len(m.NodeIDs))
+		for j, to := range m.NodeIDs {
+			if rtt, ok := lm.rtts[from][to]; ok {
+				row[j] = rtt
+			} else if from != to {
+				row[j] = -1
+			}
+		}
+		m.RTTNanos = append(m.RTTNanos, row)
+	}
+	return m
+}
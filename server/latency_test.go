@@ -0,0 +1,60 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestLatencyMatrix verifies that gossiped node addresses and
+// round-trip times are collected into a latency matrix.
+func TestLatencyMatrix(t *testing.T) {
+	g := gossip.New(nil)
+	lm := newLatencyMonitor(g)
+	lm.registerCallbacks()
+	for _, id := range []int32{1, 2, 3} {
+		if err := g.AddInfo(gossip.MakeNodeIDGossipKey(id), util.MakeRawAddr("tcp", "127.0.0.1:0"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.AddInfo(gossip.KeyNodeCount, int64(3), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo(gossip.MakeLatencyGossipKey(1), map[int32]int64{2: 5e6, 3: 80e6}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo(gossip.MakeLatencyGossipKey(3), map[int32]int64{1: 81e6}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	expected := latencyMatrix{
+		NodeIDs: []int32{1, 2, 3},
+		RTTNanos: [][]int64{
+			{0, 5e6, 80e6},
+			{-1, 0, -1},
+			{81e6, -1, 0},
+		},
+	}
+	if err := util.IsTrueWithin(func() bool {
+		return reflect.DeepEqual(lm.matrix(), expected)
+	}, time.Second); err != nil {
+		t.Errorf("expected matrix %+v; got %+v", expected, lm.matrix())
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var (
+	loadConcurrency = flag.Int("load_concurrency", 8, "number of concurrent "+
+		"workers generating load")
+	loadDuration = flag.Duration("load_duration", time.Minute, "duration for "+
+		"which to generate load")
+	loadReadPercent = flag.Int("load_read_percent", 50, "percentage of "+
+		"operations which are reads; the remainder are writes")
+	loadKeys = flag.Int64("load_keys", 100000, "number of distinct keys in "+
+		"the key space")
+	loadDistribution = flag.String("load_distribution", "uniform", "distribution "+
+		"of keys accessed; one of uniform, zipf or sequential")
+	loadValueBytes = flag.Int("load_value_bytes", 256, "size in bytes of "+
+		"written values")
+	loadBatchSize = flag.Int("load_batch_size", 1, "number of operations "+
+		"prepared and flushed together per request batch")
+	loadTxnSize = flag.Int("load_txn_size", 0, "number of operations per "+
+		"transaction; 0 to run operations outside of transactions")
+	loadPrefix = flag.String("load_prefix", "load-", "key prefix under which "+
+		"load is generated")
+	loadSeed = flag.Int64("load_seed", 0, "random seed for key and operation "+
+		"selection; 0 to seed from the clock")
+)
+
+// A CmdLoad command generates load against a cockroach cluster.
+var CmdLoad = &commander.Command{
+	UsageLine: "load [options] kv",
+	Short:     "generates a load against the cluster",
+	Long: `
+Generates a load against the cluster specified by -addr and reports
+throughput and latency histograms per operation type. The only
+workload currently available is "kv", which issues gets and puts
+against a configurable key space.
+
+The mix of reads and writes is set with -load_read_percent, the key
+distribution with -load_distribution (uniform, zipf or sequential)
+and the number of keys with -load_keys. Operations are sent singly,
+in batches of -load_batch_size using Prepare/Flush, or grouped into
+transactions of -load_txn_size operations.
+
+For example:
+
+  cockroach load -load_concurrency=16 -load_read_percent=90 -load_distribution=zipf kv
+`,
+	Run:  runLoad,
+	Flag: *flag.CommandLine,
+}
+
+// runLoad runs the workload named by args[0] for -load_duration and
+// prints a summary on completion.
+func runLoad(cmd *commander.Command, args []string) {
+	if len(args) != 1 || args[0] != "kv" {
+		cmd.Usage()
+		return
+	}
+	if *loadKeys <= 0 || *loadConcurrency <= 0 || *loadBatchSize <= 0 ||
+		*loadReadPercent < 0 || *loadReadPercent > 100 {
+		log.Errorf("invalid load options; keys, concurrency and batch size must be positive " +
+			"and the read percentage must be between 0 and 100")
+		return
+	}
+	seed := *loadSeed
+	if seed == 0 {
+		seed = util.NewPseudoSeed()
+	}
+
+	g := &kvLoadGenerator{
+		readPercent:  *loadReadPercent,
+		keys:         *loadKeys,
+		distribution: *loadDistribution,
+		valueBytes:   *loadValueBytes,
+		batchSize:    *loadBatchSize,
+		txnSize:      *loadTxnSize,
+		prefix:       *loadPrefix,
+		stats:        newLoadStats(),
+	}
+	if err := g.validate(); err != nil {
+		log.Error(err)
+		return
+	}
+
+	stopper := util.NewStopper(*loadConcurrency)
+	for i := 0; i < *loadConcurrency; i++ {
+		// Each worker has its own KV, which is not thread safe.
+		kv := client.NewKV(client.NewHTTPSender(*addr, &http.Transport{}), nil)
+		go g.run(kv, rand.New(rand.NewSource(seed+int64(i))), stopper)
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	deadline := time.After(*loadDuration)
+	var lastOps int64
+RUN:
+	for {
+		select {
+		case <-ticker.C:
+			ops := atomic.LoadInt64(&g.stats.ops)
+			log.Infof("%s: %d ops/sec, %d errors", time.Now().Sub(start)/time.Second*time.Second,
+				ops-lastOps, atomic.LoadInt64(&g.stats.errors))
+			lastOps = ops
+		case <-deadline:
+			break RUN
+		}
+	}
+	ticker.Stop()
+	stopper.Stop()
+	g.stats.print(time.Now().Sub(start))
+}
+
+// kvLoadGenerator issues gets and puts against a key space.
+type kvLoadGenerator struct {
+	readPercent  int
+	keys         int64
+	distribution string
+	valueBytes   int
+	batchSize    int
+	txnSize      int
+	prefix       string
+	sequence     int64 // Next key for sequential distribution
+	stats        *loadStats
+}
+
+func (g *kvLoadGenerator) validate() error {
+	switch g.distribution {
+	case "uniform", "zipf", "sequential":
+		return nil
+	}
+	return util.Errorf("unknown key distribution %q", g.distribution)
+}
+
+// keyGenerator returns a function which yields keys according to the
+// generator's distribution.
+func (g *kvLoadGenerator) keyGenerator(r *rand.Rand) func() proto.Key {
+	var next func() int64
+	switch g.distribution {
+	case "zipf":
+		// Skew accesses toward low key indexes.
+		zipf := rand.NewZipf(r, 1.1, 1, uint64(g.keys))
+		next = func() int64 { return int64(zipf.Uint64()) % g.keys }
+	case "sequential":
+		next = func() int64 { return (atomic.AddInt64(&g.sequence, 1) - 1) % g.keys }
+	default:
+		next = func() int64 { return r.Int63n(g.keys) }
+	}
+	return func() proto.Key {
+		return proto.Key(fmt.Sprintf("%s%016d", g.prefix, next()))
+	}
+}
+
+// run generates load using kv until the stopper is stopped.
+func (g *kvLoadGenerator) run(kv *client.KV, r *rand.Rand, stopper *util.Stopper) {
+	defer stopper.SetStopped()
+	nextKey := g.keyGenerator(r)
+	value := make([]byte, g.valueBytes)
+	for i := range value {
+		value[i] = byte(r.Intn(256))
+	}
+
+	// prepareOps prepares count randomly selected reads and writes.
+	prepareOps := func(kv *client.KV, count int) {
+		for i := 0; i < count; i++ {
+			if r.Intn(100) < g.readPercent {
+				kv.Prepare(proto.Get, proto.GetArgs(nextKey()), &proto.GetResponse{})
+			} else {
+				kv.Prepare(proto.Put, proto.PutArgs(nextKey(), value), &proto.PutResponse{})
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-stopper.ShouldStop():
+			return
+		default:
+		}
+
+		var opName string
+		var count int
+		var err error
+		start := time.Now()
+		switch {
+		case g.txnSize > 0:
+			opName, count = "txn", g.txnSize
+			opts := &client.TransactionOptions{Name: "load", Isolation: proto.SERIALIZABLE}
+			err = kv.RunTransaction(opts, func(txn *client.KV) error {
+				prepareOps(txn, g.txnSize)
+				return txn.Flush()
+			})
+		case g.batchSize > 1:
+			opName, count = "batch", g.batchSize
+			prepareOps(kv, g.batchSize)
+			err = kv.Flush()
+		default:
+			count = 1
+			if r.Intn(100) < g.readPercent {
+				opName = "get"
+				err = kv.Call(proto.Get, proto.GetArgs(nextKey()), &proto.GetResponse{})
+			} else {
+				opName = "put"
+				err = kv.Call(proto.Put, proto.PutArgs(nextKey(), value), &proto.PutResponse{})
+			}
+		}
+		g.stats.record(opName, count, time.Now().Sub(start), err)
+	}
+}
+
+// loadStats accumulates latency histograms by operation type.
+type loadStats struct {
+	ops    int64 // Accessed atomically
+	errors int64 // Accessed atomically
+
+	mu         sync.Mutex
+	histograms map[string]*latencyHistogram
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{histograms: map[string]*latencyHistogram{}}
+}
+
+// record records the latency of a request comprising count
+// operations. Failed requests count toward errors only.
+func (ls *loadStats) record(opName string, count int, latency time.Duration, err error) {
+	if err != nil {
+		atomic.AddInt64(&ls.errors, 1)
+		log.V(1).Infof("%s failed: %s", opName, err)
+		return
+	}
+	atomic.AddInt64(&ls.ops, int64(count))
+	ls.mu.Lock()
+	h, ok := ls.histograms[opName]
+	if !ok {
+		h = newLatencyHistogram()
+		ls.histograms[opName] = h
+	}
+	h.record(latency)
+	ls.mu.Unlock()
+}
+
+// loadHistogramBuckets are the upper bounds of the latency histogram
+// buckets printed by loadStats.print.
+var loadHistogramBuckets = []time.Duration{
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// A latencyHistogram counts latencies in the fixed buckets of
+// loadHistogramBuckets, plus an overflow bucket, so that its size
+// doesn't grow with the duration of the load.
+type latencyHistogram struct {
+	counts []int64 // Indexed as loadHistogramBuckets, then overflow
+	total  int64
+	max    time.Duration
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int64, len(loadHistogramBuckets)+1)}
+}
+
+// record adds latency l to the histogram.
+func (h *latencyHistogram) record(l time.Duration) {
+	h.counts[sort.Search(len(loadHistogramBuckets), func(i int) bool {
+		return l <= loadHistogramBuckets[i]
+	})]++
+	h.total++
+	if l > h.max {
+		h.max = l
+	}
+}
+
+// percentile returns an upper bound of the pth percentile of the
+// recorded latencies: the upper bound of the bucket it falls in, or
+// the maximum latency if that is lower or it falls in the overflow
+// bucket.
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(float64(h.total-1)*p/100) + 1
+	var seen int64
+	for i, c := range h.counts[:len(loadHistogramBuckets)] {
+		if seen += c; seen >= rank {
+			if loadHistogramBuckets[i] < h.max {
+				return loadHistogramBuckets[i]
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+// print writes throughput, percentiles and a latency histogram for
+// each operation type to stdout.
+func (ls *loadStats) print(elapsed time.Duration) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ops := atomic.LoadInt64(&ls.ops)
+	fmt.Fprintf(os.Stdout, "%d ops in %s (%.1f ops/sec), %d errors\n",
+		ops, elapsed, float64(ops)/elapsed.Seconds(), atomic.LoadInt64(&ls.errors))
+
+	var names []string
+	for name := range ls.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := ls.histograms[name]
+		fmt.Fprintf(os.Stdout, "\n%s: %d requests, p50<=%s p95<=%s p99<=%s max=%s\n", name, h.total,
+			h.percentile(50), h.percentile(95), h.percentile(99), h.max)
+		for i, c := range h.counts {
+			if i < len(loadHistogramBuckets) {
+				fmt.Fprintf(os.Stdout, "  <= %-8s %8d\n", loadHistogramBuckets[i], c)
+			} else {
+				fmt.Fprintf(os.Stdout, "  >  %-8s %8d\n", loadHistogramBuckets[i-1], c)
+			}
+		}
+	}
+}
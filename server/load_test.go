@@ -0,0 +1,151 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestLatencyHistogram verifies that latencies are counted in fixed
+// buckets and that percentiles are bounded by the buckets' upper
+// bounds and the maximum latency.
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	if p := h.percentile(50); p != 0 {
+		t.Errorf("expected 0 for an empty histogram; got %s", p)
+	}
+	for i := 0; i < 98; i++ {
+		h.record(700 * time.Microsecond)
+	}
+	h.record(3 * time.Millisecond)
+	h.record(2 * time.Second)
+
+	if h.total != 100 || h.counts[1] != 98 || h.counts[3] != 1 || h.counts[len(h.counts)-1] != 1 {
+		t.Errorf("unexpected bucket counts %v (total %d)", h.counts, h.total)
+	}
+	testCases := []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{50, 1 * time.Millisecond},
+		{98, 1 * time.Millisecond},
+		{99, 5 * time.Millisecond},
+		{100, 2 * time.Second},
+	}
+	for i, test := range testCases {
+		if p := h.percentile(test.p); p != test.expected {
+			t.Errorf("%d: expected p%g to be %s; got %s", i, test.p, test.expected, p)
+		}
+	}
+}
+
+// TestLoadStatsRecord verifies that failed requests count as errors
+// only and that operations are counted per request.
+func TestLoadStatsRecord(t *testing.T) {
+	ls := newLoadStats()
+	ls.record("batch", 4, time.Millisecond, nil)
+	ls.record("batch", 4, time.Millisecond, errors.New("failed"))
+	ls.record("get", 1, time.Millisecond, nil)
+	if ops, errs := atomic.LoadInt64(&ls.ops), atomic.LoadInt64(&ls.errors); ops != 5 || errs != 1 {
+		t.Errorf("expected 5 ops and 1 error; got %d, %d", ops, errs)
+	}
+	if len(ls.histograms) != 2 || ls.histograms["batch"].total != 1 || ls.histograms["get"].total != 1 {
+		t.Errorf("expected one request each of batch and get; got %+v", ls.histograms)
+	}
+}
+
+// TestLoadKeyGenerator verifies that keys of each distribution carry
+// the prefix and fall within the key space, and that unknown
+// distributions are rejected.
+func TestLoadKeyGenerator(t *testing.T) {
+	for _, dist := range []string{"uniform", "zipf", "sequential"} {
+		g := &kvLoadGenerator{keys: 10, distribution: dist, prefix: "load-"}
+		if err := g.validate(); err != nil {
+			t.Fatal(err)
+		}
+		nextKey := g.keyGenerator(rand.New(rand.NewSource(0)))
+		for i := 0; i < 100; i++ {
+			key := nextKey()
+			if !bytes.HasPrefix(key, []byte("load-")) || bytes.Compare(key, []byte("load-0000000000000010")) >= 0 {
+				t.Fatalf("%s: key %q outside of the key space", dist, key)
+			}
+		}
+	}
+	if err := (&kvLoadGenerator{distribution: "normal"}).validate(); err == nil {
+		t.Error("expected unknown distribution to be rejected")
+	}
+}
+
+// TestLoadGeneratorRun runs the kv workload against a test server in
+// each of its modes and verifies that operations are recorded without
+// errors.
+func TestLoadGeneratorRun(t *testing.T) {
+	s := StartTestServer(t)
+	defer s.Stop()
+
+	testCases := []struct {
+		batchSize, txnSize int
+		opNames            []string
+	}{
+		{1, 0, []string{"get", "put"}},
+		{4, 0, []string{"batch"}},
+		{1, 3, []string{"txn"}},
+	}
+	for i, test := range testCases {
+		g := &kvLoadGenerator{
+			readPercent:  50,
+			keys:         100,
+			distribution: "uniform",
+			valueBytes:   16,
+			batchSize:    test.batchSize,
+			txnSize:      test.txnSize,
+			prefix:       "load-",
+			stats:        newLoadStats(),
+		}
+		stopper := util.NewStopper(1)
+		kv := client.NewKV(s.kv.Sender(), nil)
+		go g.run(kv, rand.New(rand.NewSource(int64(i))), stopper)
+		if err := util.IsTrueWithin(func() bool {
+			return atomic.LoadInt64(&g.stats.ops) >= 20
+		}, 5*time.Second); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		stopper.Stop()
+
+		if errs := atomic.LoadInt64(&g.stats.errors); errs != 0 {
+			t.Errorf("%d: expected no errors; got %d", i, errs)
+		}
+		g.stats.mu.Lock()
+		for name := range g.stats.histograms {
+			found := false
+			for _, opName := range test.opNames {
+				found = found || name == opName
+			}
+			if !found {
+				t.Errorf("%d: unexpected operation %q", i, name)
+			}
+		}
+		g.stats.mu.Unlock()
+	}
+}
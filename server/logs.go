@@ -0,0 +1,133 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// logGCInterval is the interval at which log files retained beyond
+// the limits set by -log_max_total_size and -log_max_age are deleted.
+const logGCInterval = time.Minute
+
+// logConfig is the JSON representation of log.FileConfig served and
+// accepted by the admin logs endpoint. MaxAge is formatted as a
+// duration, e.g. "72h".
+type logConfig struct {
+	MaxFileSize  uint64 `json:"max_file_size"`
+	MaxTotalSize int64  `json:"max_total_size"`
+	MaxAge       string `json:"max_age"`
+}
+
+// newLogConfig returns the JSON representation of cfg.
+func newLogConfig(cfg log.FileConfig) logConfig {
+	return logConfig{
+		MaxFileSize:  cfg.MaxFileSize,
+		MaxTotalSize: cfg.MaxTotalSize,
+		MaxAge:       cfg.MaxAge.String(),
+	}
+}
+
+// fileConfig parses the JSON representation into a log.FileConfig.
+func (lc logConfig) fileConfig() (log.FileConfig, error) {
+	cfg := log.FileConfig{
+		MaxFileSize:  lc.MaxFileSize,
+		MaxTotalSize: lc.MaxTotalSize,
+	}
+	if lc.MaxAge != "" {
+		var err error
+		if cfg.MaxAge, err = time.ParseDuration(lc.MaxAge); err != nil {
+			return log.FileConfig{}, util.Errorf("invalid max_age %q: %s", lc.MaxAge, err)
+		}
+	}
+	if cfg.MaxTotalSize < 0 || cfg.MaxAge < 0 {
+		return log.FileConfig{}, util.Errorf("log retention limits may not be negative: %+v", lc)
+	}
+	return cfg, nil
+}
+
+// startLogGC periodically deletes log files retained beyond the
+// limits of the current log.FileConfig until the returned stopper is
+// stopped.
+func startLogGC() *util.Stopper {
+	stopper := util.NewStopper(1)
+	go util.RunLabeled("log-gc", func() {
+		ticker := time.NewTicker(logGCInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n, err := log.GCFiles(time.Now()); err != nil {
+					log.Warningf("unable to delete old log files: %s", err)
+				} else if n > 0 && log.V(1) {
+					log.Infof("deleted %d old log file(s)", n)
+				}
+			case <-stopper.ShouldStop():
+				stopper.SetStopped()
+				return
+			}
+		}
+	})
+	return stopper
+}
+
+// handleLogsAction serves the rotation and retention of the node's
+// log files on GET and changes them on PUT or POST, immediately
+// deleting any files retained beyond the new limits. The changes
+// last until the node is restarted.
+func (s *adminServer) handleLogsAction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+		var lc logConfig
+		if err := json.Unmarshal(b, &lc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg, err := lc.fileConfig()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.SetFileConfig(cfg)
+		if _, err := log.GCFiles(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(newLogConfig(log.GetFileConfig()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
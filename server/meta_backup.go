@@ -0,0 +1,182 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A metaBackupStore is the registration of a store, as gossiped by
+// its node.
+type metaBackupStore struct {
+	NodeID     int32    `json:"node_id"`
+	Address    string   `json:"address"`
+	NodeAttrs  []string `json:"node_attrs,omitempty"`
+	StoreID    int32    `json:"store_id"`
+	StoreAttrs []string `json:"store_attrs,omitempty"`
+}
+
+// A metaBackup is a snapshot of the cluster metadata: the meta1 and
+// meta2 range descriptors, the accounting, permission and zone
+// configs, the values of the node, store and Raft ID generators and
+// the registrations of all stores known via gossip. An incremental
+// backup has SinceNanos set and its tables hold only the rows written
+// after that time.
+type metaBackup struct {
+	Time         time.Time                   `json:"time"`
+	SinceNanos   int64                       `json:"since_nanos,omitempty"`
+	Tables       map[string]*systemTablePage `json:"tables"`
+	IDGenerators map[string]int64            `json:"id_generators"`
+	Stores       []metaBackupStore           `json:"stores"`
+}
+
+// handleMetaBackup responds to GET requests with a metaBackup. As the
+// backup exposes the cluster configuration, requests must pass
+// authorizeDebug.
+func (s *adminServer) handleMetaBackup(w http.ResponseWriter, r *http.Request) {
+	if err := authorizeDebug(r, *adminToken); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	backup, err := s.metaBackup(0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// metaBackup reads each of the system tables, the ID generators and
+// the gossiped store registrations. If since is non-zero, only table
+// rows written after since, in nanoseconds since the Unix epoch, are
+// included. Deletions are not captured by incremental backups.
+func (s *adminServer) metaBackup(since int64) (*metaBackup, error) {
+	backup := &metaBackup{
+		Time:         time.Now(),
+		SinceNanos:   since,
+		Tables:       map[string]*systemTablePage{},
+		IDGenerators: map[string]int64{},
+	}
+	for name, table := range systemTables {
+		var result *systemTablePage
+		for start := table.start; start != nil; {
+			page, err := s.scanSystemTable(name, table, start, maxSystemTableLimit)
+			if err != nil {
+				return nil, err
+			}
+			if since != 0 {
+				rows := page.Rows[:0]
+				for _, row := range page.Rows {
+					if row.wallTime > since {
+						rows = append(rows, row)
+					}
+				}
+				page.Rows = rows
+			}
+			if result == nil {
+				result = page
+			} else {
+				result.Rows = append(result.Rows, page.Rows...)
+			}
+			start = page.next
+		}
+		result.NextKey = ""
+		backup.Tables[name] = result
+	}
+
+	// The store ID generators are keyed by node ID.
+	sr := &proto.ScanResponse{}
+	if err := s.db.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.KeyStoreIDGeneratorPrefix,
+			EndKey: engine.KeyStoreIDGeneratorPrefix.PrefixEnd(),
+			User:   storage.UserRoot,
+		},
+	}, sr); err != nil {
+		return nil, err
+	}
+	kvs := sr.Rows
+	for _, key := range []proto.Key{engine.KeyNodeIDGenerator, engine.KeyRaftIDGenerator} {
+		gr := &proto.GetResponse{}
+		if err := s.db.Call(proto.Get, &proto.GetRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:  key,
+				User: storage.UserRoot,
+			},
+		}, gr); err != nil {
+			return nil, err
+		}
+		if gr.Value != nil {
+			kvs = append(kvs, proto.KeyValue{Key: key, Value: *gr.Value})
+		}
+	}
+	for _, kv := range kvs {
+		id, err := kv.Value.GetInt()
+		if err != nil {
+			return nil, util.Errorf("invalid ID generator %q: %s", kv.Key, err)
+		}
+		backup.IDGenerators[string(kv.Key[len(engine.KeySystemPrefix):])] = id
+	}
+
+	descs, err := s.zone.findStores(proto.Attributes{})
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range descs {
+		store := metaBackupStore{
+			NodeID:     desc.Node.NodeID,
+			NodeAttrs:  desc.Node.Attrs.Attrs,
+			StoreID:    desc.StoreID,
+			StoreAttrs: desc.Attrs.Attrs,
+		}
+		if desc.Node.Address != nil {
+			store.Address = desc.Node.Address.String()
+		}
+		backup.Stores = append(backup.Stores, store)
+	}
+	sort.Sort(metaBackupStores(backup.Stores))
+	return backup, nil
+}
+
+// metaBackupStores sorts store registrations by node and store ID.
+type metaBackupStores []metaBackupStore
+
+func (mbs metaBackupStores) Len() int      { return len(mbs) }
+func (mbs metaBackupStores) Swap(i, j int) { mbs[i], mbs[j] = mbs[j], mbs[i] }
+func (mbs metaBackupStores) Less(i, j int) bool {
+	if mbs[i].NodeID != mbs[j].NodeID {
+		return mbs[i].NodeID < mbs[j].NodeID
+	}
+	return mbs[i].StoreID < mbs[j].StoreID
+}
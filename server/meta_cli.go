@@ -0,0 +1,143 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var recoverMetaConfirm = flag.Bool("recover_meta_confirm", false, "rewrite range "+
+	"addressing records with recover-meta; without it, recover-meta only "+
+	"reports what it would do")
+
+// A CmdBackupMeta command writes a snapshot of the cluster metadata
+// to a file.
+var CmdBackupMeta = &commander.Command{
+	UsageLine: "backup-meta [options] <file>",
+	Short:     "writes a snapshot of the cluster metadata to a file",
+	Long: `
+Fetches a snapshot of the cluster metadata from the node specified by
+-addr and writes it to <file> as JSON. The snapshot contains the meta1
+and meta2 range descriptors, the accounting, permission and zone
+configs, the node, store and Raft ID generators and the registrations
+of all stores known to the node via gossip.
+
+Requests to nodes from non-loopback addresses must supply the node's
+-admin_token.
+`,
+	Run:  runBackupMeta,
+	Flag: *flag.CommandLine,
+}
+
+// runBackupMeta fetches a metadata snapshot via the REST API and
+// writes it to the specified file.
+func runBackupMeta(cmd *commander.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return
+	}
+	url := fmt.Sprintf("%s://%s%s", adminScheme, *addr, metaBackupPath)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Errorf("unable to create request to admin REST endpoint: %s", err)
+		return
+	}
+	if *adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+	}
+	b, err := sendAdminRequest(req)
+	if err != nil {
+		log.Errorf("metadata backup failed: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(args[0], b, 0600); err != nil {
+		log.Errorf("unable to write metadata backup to %s: %s", args[0], err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "wrote metadata backup (%d bytes) to %s\n", len(b), args[0])
+}
+
+// A CmdRecoverMeta command rebuilds the range addressing records from
+// the replicas in a node's stores.
+var CmdRecoverMeta = &commander.Command{
+	UsageLine: "recover-meta [options]",
+	Short:     "rebuilds range addressing records from surviving replicas",
+	Long: `
+Rebuilds the meta1 and meta2 range addressing records from the range
+descriptors of the replicas in the stores specified by -stores. This
+is a last resort for recovering from the loss or corruption of the
+meta ranges, and is intended for a node holding replicas of all
+surviving ranges. The stores are opened directly, so the node using
+them must not be running.
+
+Nothing is written unless the replicas found cover the entire key
+space without gaps or overlaps and agree on range bounds, and every
+range holding addressing records has a replica in the stores. Without
+-recover_meta_confirm, the ranges found are only reported. For
+example:
+
+  cockroach recover-meta -stores=ssd=/mnt/ssd1,ssd=/mnt/ssd2
+  cockroach recover-meta -stores=ssd=/mnt/ssd1,ssd=/mnt/ssd2 -recover_meta_confirm
+`,
+	Run:  runRecoverMeta,
+	Flag: *flag.CommandLine,
+}
+
+// runRecoverMeta rebuilds range addressing records in the stores
+// specified by -stores.
+func runRecoverMeta(cmd *commander.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		return
+	}
+	engines, err := initEngines(*stores)
+	if err != nil {
+		log.Errorf("failed to initialize engines from -stores=%s: %s", *stores, err)
+		return
+	}
+	for i, e := range engines {
+		if err := e.Start(); err != nil {
+			log.Errorf("failed to start engine %d: %s", i, err)
+			return
+		}
+		defer e.Stop()
+	}
+	now := hlc.NewClock(hlc.UnixNano).Now()
+	report, err := storage.RecoverMetaAddressing(engines, now, !*recoverMetaConfirm)
+	if err != nil {
+		log.Errorf("unable to recover range addressing records: %s", err)
+		return
+	}
+	for _, desc := range report.Descriptors {
+		fmt.Fprintf(os.Stdout, "range %d: [%q, %q)\n", desc.RaftID, desc.StartKey, desc.EndKey)
+	}
+	if *recoverMetaConfirm {
+		fmt.Fprintf(os.Stdout, "rewrote %d addressing record(s) for %d range(s)\n",
+			report.Records, len(report.Descriptors))
+	} else {
+		fmt.Fprintf(os.Stdout, "would rewrite %d addressing record(s) for %d range(s); "+
+			"rerun with -recover_meta_confirm to apply\n", report.Records, len(report.Descriptors))
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var migrateStoresConfirm = flag.Bool("migrate_stores_confirm", false, "run pending "+
+	"store migrations with migrate-stores; without it, migrate-stores only reports them")
+
+// A CmdMigrateStores command runs pending on-disk format migrations
+// on a node's stores.
+var CmdMigrateStores = &commander.Command{
+	UsageLine: "migrate-stores [options]",
+	Short:     "migrates stores to the current on-disk format",
+	Long: `
+Reports the on-disk format version of each store specified by -stores
+and the migrations required to bring it to the version supported by
+this binary. With -migrate_stores_confirm, the migrations are run.
+The stores are opened directly, so the node using them must not be
+running.
+
+Stores are also migrated when a node starts; this command allows
+migrations to be run and verified across a cluster's nodes before
+restarting them. For example:
+
+  cockroach migrate-stores -stores=ssd=/mnt/ssd1,ssd=/mnt/ssd2
+  cockroach migrate-stores -stores=ssd=/mnt/ssd1,ssd=/mnt/ssd2 -migrate_stores_confirm
+`,
+	Run:  runMigrateStores,
+	Flag: *flag.CommandLine,
+}
+
+// runMigrateStores migrates the stores specified by -stores.
+func runMigrateStores(cmd *commander.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		return
+	}
+	engines, err := initEngines(*stores)
+	if err != nil {
+		log.Errorf("failed to initialize engines from -stores=%s: %s", *stores, err)
+		return
+	}
+	for i, e := range engines {
+		if err := e.Start(); err != nil {
+			log.Errorf("failed to start engine %d: %s", i, err)
+			return
+		}
+		defer e.Stop()
+	}
+	for _, e := range engines {
+		version, err := storage.ReadStoreVersion(e)
+		if err != nil {
+			log.Errorf("unable to read format version of store %s: %s", e, err)
+			return
+		}
+		names, err := storage.MigrateStore(e, !*migrateStoresConfirm)
+		for _, name := range names {
+			fmt.Fprintf(os.Stdout, "%s: %s\n", e, name)
+		}
+		if err != nil {
+			log.Errorf("unable to migrate store %s: %s", e, err)
+			return
+		}
+		if *migrateStoresConfirm {
+			fmt.Fprintf(os.Stdout, "%s: migrated from format version %d to %d\n", e, version, storage.StoreVersion())
+		} else if len(names) > 0 {
+			fmt.Fprintf(os.Stdout, "%s: %d migration(s) pending from format version %d; "+
+				"rerun with -migrate_stores_confirm to apply\n", e, len(names), version)
+		} else {
+			fmt.Fprintf(os.Stdout, "%s: format version %d is current\n", e, version)
+		}
+	}
+}
@@ -29,10 +29,13 @@ import (
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/cloud"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/structured"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/settings"
 )
 
 const (
@@ -62,9 +65,13 @@ type Node struct {
 	gossip     *gossip.Gossip         // Nodes gossip cluster ID, node ID -> host:port
 	db         *client.KV             // KV DB client; used to access global id generators
 	lSender    *kv.LocalSender        // Local KV sender for access to node-local stores
+	latency    *latencyMonitor        // Round-trip times between nodes
 	closer     chan struct{}
 
 	maxAvailPrefix string // Prefix for max avail capacity gossip topic
+
+	terminateOnSlowSync bool                  // Exit if a store becomes suspect due to slow syncs
+	relocationBackups   cloud.ExternalStorage // Range backups preloading relocations; may be nil
 }
 
 // allocateNodeID increments the node id generator key to allocate
@@ -158,6 +165,7 @@ func NewNode(db *client.KV, gossip *gossip.Gossip) *Node {
 		gossip:  gossip,
 		db:      db,
 		lSender: kv.NewLocalSender(),
+		latency: newLatencyMonitor(gossip),
 		closer:  make(chan struct{}),
 	}
 	return n
@@ -184,12 +192,20 @@ func (n *Node) start(rpcServer *rpc.Server, clock *hlc.Clock,
 	if err := rpcServer.RegisterName("Node", n); err != nil {
 		log.Fatalf("unable to register node service with RPC server: %s", err)
 	}
+	if err := rpcServer.RegisterName("Snapshot", &snapshotService{stores: n.lSender}); err != nil {
+		log.Fatalf("unable to register snapshot service with RPC server: %s", err)
+	}
 
 	// Initialize stores, including bootstrapping new ones.
 	if err := n.initStores(clock, engines); err != nil {
 		return err
 	}
-	go n.startGossip()
+	n.gossip.RegisterCallback(gossip.KeySettings, n.settingsGossipUpdate)
+	n.latency.registerCallbacks()
+	go util.RunLabeled("gossip", n.startGossip)
+	go util.RunLabeled("replica-attrs", n.updateReplicaAttrs)
+	go util.RunLabeled("latency", n.startLatencyGossip)
+	go util.RunLabeled("heartbeat", n.startStallDetection)
 	log.Infof("Started node with %v engine(s) and attributes %v", engines, attrs)
 	return nil
 }
@@ -210,6 +226,10 @@ func (n *Node) initStores(clock *hlc.Clock, engines []engine.Engine) error {
 
 	for _, e := range engines {
 		s := storage.NewStore(clock, e, n.db, n.gossip)
+		s.SetNodeStores(n.lSender.VisitStores)
+		s.SetRelocationBackups(n.relocationBackups)
+		s.SetSnapshotTransport(&snapshotTransport{gossip: n.gossip})
+		s.SetSplitKeyFunc(structured.NewSplitKeyFunc(n.db))
 		// Initialize each store in turn, handling un-bootstrapped errors by
 		// adding the store to the bootstraps list.
 		if err := s.Start(); err != nil {
@@ -237,6 +257,24 @@ func (n *Node) initStores(clock *hlc.Clock, engines []engine.Engine) error {
 		return err
 	}
 
+	// Finish or undo the relocations of ranges between the node's
+	// stores which were interrupted by the restart. Resolving a
+	// relocation visits the node's stores itself.
+	var stores []*storage.Store
+	n.lSender.VisitStores(func(s *storage.Store) error {
+		stores = append(stores, s)
+		return nil
+	})
+	for _, s := range stores {
+		if err := s.ResolveRelocations(); err != nil {
+			return err
+		}
+	}
+
+	// Restore the cluster membership known before the node restarted,
+	// so that ranges can be addressed while gossip converges.
+	n.loadGossipSnapshot(clock.PhysicalNow())
+
 	// Connect gossip before starting bootstrap. For new nodes, connecting
 	// to the gossip network is necessary to get the cluster ID.
 	n.connectGossip()
@@ -343,15 +381,39 @@ func (n *Node) connectGossip() {
 	}
 }
 
+// settingsGossipUpdate is a callback for gossip updates to the
+// cluster settings. Settings absent from the gossiped map revert to
+// their defaults.
+func (n *Node) settingsGossipUpdate(key string, contentsChanged bool) {
+	if !contentsChanged {
+		return
+	}
+	info, err := n.gossip.GetInfo(key)
+	if err != nil {
+		log.Errorf("unable to fetch cluster settings from gossip: %s", err)
+		return
+	}
+	values, ok := info.(map[string]string)
+	if !ok {
+		log.Errorf("gossiped info is not a map of cluster settings: %+v", info)
+		return
+	}
+	settings.Update(values)
+}
+
 // startGossip loops on a periodic ticker to gossip node-related
 // information. Loops until the node is closed and should be
 // invoked via goroutine.
 func (n *Node) startGossip() {
+	// Gossip immediately, so that changed store attributes are
+	// visible to allocators without waiting for the first tick.
+	n.gossipCapacities()
 	ticker := time.NewTicker(gossipInterval)
 	for {
 		select {
 		case <-ticker.C:
 			n.gossipCapacities()
+			n.saveGossipSnapshot()
 		case <-n.closer:
 			ticker.Stop()
 			return
@@ -359,21 +421,97 @@ func (n *Node) startGossip() {
 	}
 }
 
+// startLatencyGossip loops on a periodic ticker to gossip the
+// round-trip times from this node to the other nodes. Loops until the
+// node is closed and should be invoked via goroutine.
+func (n *Node) startLatencyGossip() {
+	ticker := time.NewTicker(latencyGossipInterval)
+	for {
+		select {
+		case <-ticker.C:
+			if n.Descriptor.NodeID != 0 {
+				n.latency.gossipLatencies(n.Descriptor.NodeID)
+			}
+		case <-n.closer:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// startStallDetection loops on a periodic ticker, checking the disk
+// heartbeats of the node's stores. Loops until the node is closed and
+// should be invoked via goroutine.
+func (n *Node) startStallDetection() {
+	ticker := time.NewTicker(storage.StoreHeartbeatInterval)
+	for {
+		select {
+		case <-ticker.C:
+			n.checkStalledStores()
+		case <-n.closer:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// checkStalledStores logs a warning for each store whose disk
+// heartbeat has been outstanding beyond storage.StoreStallThreshold
+// and exits the process if any has been outstanding beyond
+// storage.StoreStallFatalThreshold. If the node was started with
+// -terminate_on_slow_sync, it also exits if any store is suspect due
+// to slow WAL syncs. Returns the IDs of stalled stores.
+func (n *Node) checkStalledStores() []int32 {
+	var stalled []int32
+	n.lSender.VisitStores(func(s *storage.Store) error {
+		d := s.StallDuration()
+		if d > storage.StoreStallFatalThreshold {
+			log.Fatalf("store %s: disk stalled for %s; exiting", s, d)
+		}
+		if n.terminateOnSlowSync && s.Suspect() {
+			log.Fatalf("store %s: WAL syncs persistently exceed %s; exiting", s, storage.SlowSyncThreshold)
+		}
+		if d > storage.StoreStallThreshold {
+			log.Warningf("store %s: disk stalled for %s", s, d)
+			stalled = append(stalled, s.StoreID())
+		}
+		return nil
+	})
+	return stalled
+}
+
+// updateReplicaAttrs rewrites the attributes recorded for each
+// store's replicas in the descriptors of the ranges it leads, so that
+// descriptors reflect attributes changed since the stores were last
+// started.
+func (n *Node) updateReplicaAttrs() {
+	n.lSender.VisitStores(func(s *storage.Store) error {
+		count, err := s.UpdateReplicaAttrs()
+		if err != nil {
+			log.Warningf("unable to update replica attributes for store %+v: %v", s.Ident, err)
+		}
+		if count > 0 {
+			log.Infof("updated attributes of %d replica(s) on store %+v", count, s.Ident)
+		}
+		return nil
+	})
+}
+
 // gossipCapacities calls capacity on each store and adds it to the
-// gossip network.
+// gossip network. Stalled stores are not gossiped, so that they are
+// not chosen as allocation targets.
 func (n *Node) gossipCapacities() {
 	n.lSender.VisitStores(func(s *storage.Store) error {
+		if s.Stalled() {
+			return nil
+		}
 		storeDesc, err := s.Descriptor(&n.Descriptor)
 		if err != nil {
 			log.Warningf("problem getting store descriptor for store %+v: %v", s.Ident, err)
 			return nil
 		}
-		// Unique gossip key per store.
-		keyMaxCapacity := gossip.KeyMaxAvailCapacityPrefix +
-			strconv.FormatInt(int64(storeDesc.Node.NodeID), 10) + "-" +
-			strconv.FormatInt(int64(storeDesc.StoreID), 10)
-		// Gossip store descriptor.
-		n.gossip.AddInfo(keyMaxCapacity, *storeDesc, ttlCapacityGossip)
+		// Gossip store descriptor, keyed uniquely per store.
+		n.gossip.AddInfo(gossip.MakeCapacityGossipKey(storeDesc.Node.NodeID, storeDesc.StoreID), *storeDesc, ttlCapacityGossip)
 		return nil
 	})
 }
@@ -411,6 +549,11 @@ func (n *Node) ConditionalPut(args *proto.ConditionalPutRequest, reply *proto.Co
 	return n.executeCmd(proto.ConditionalPut, args, reply)
 }
 
+// CompareAndSet .
+func (n *Node) CompareAndSet(args *proto.CompareAndSetRequest, reply *proto.CompareAndSetResponse) error {
+	return n.executeCmd(proto.CompareAndSet, args, reply)
+}
+
 // Increment .
 func (n *Node) Increment(args *proto.IncrementRequest, reply *proto.IncrementResponse) error {
 	return n.executeCmd(proto.Increment, args, reply)
@@ -456,6 +599,16 @@ func (n *Node) AdminSplit(args *proto.AdminSplitRequest, reply *proto.AdminSplit
 	return n.executeCmd(proto.AdminSplit, args, reply)
 }
 
+// AdminFreeze .
+func (n *Node) AdminFreeze(args *proto.AdminFreezeRequest, reply *proto.AdminFreezeResponse) error {
+	return n.executeCmd(proto.AdminFreeze, args, reply)
+}
+
+// AdminUnfreeze .
+func (n *Node) AdminUnfreeze(args *proto.AdminUnfreezeRequest, reply *proto.AdminUnfreezeResponse) error {
+	return n.executeCmd(proto.AdminUnfreeze, args, reply)
+}
+
 // InternalRangeLookup .
 func (n *Node) InternalRangeLookup(args *proto.InternalRangeLookupRequest, reply *proto.InternalRangeLookupResponse) error {
 	return n.executeCmd(proto.InternalRangeLookup, args, reply)
@@ -476,7 +629,17 @@ func (n *Node) InternalResolveIntent(args *proto.InternalResolveIntentRequest, r
 	return n.executeCmd(proto.InternalResolveIntent, args, reply)
 }
 
+// InternalQueryIntent .
+func (n *Node) InternalQueryIntent(args *proto.InternalQueryIntentRequest, reply *proto.InternalQueryIntentResponse) error {
+	return n.executeCmd(proto.InternalQueryIntent, args, reply)
+}
+
 // InternalMerge .
 func (n *Node) InternalMerge(args *proto.InternalMergeRequest, reply *proto.InternalMergeResponse) error {
 	return n.executeCmd(proto.InternalMerge, args, reply)
 }
+
+// InternalScanChanges .
+func (n *Node) InternalScanChanges(args *proto.InternalScanChangesRequest, reply *proto.InternalScanChangesResponse) error {
+	return n.executeCmd(proto.InternalScanChanges, args, reply)
+}
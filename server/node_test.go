@@ -197,3 +197,73 @@ func TestNodeJoin(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestNodeRelocateRange verifies that a range may be moved between the
+// stores of a node and that it continues to be addressable after the
+// move.
+func TestNodeRelocateRange(t *testing.T) {
+	ts := &TestServer{
+		Engines: []engine.Engine{
+			engine.NewInMem(proto.Attributes{}, 100<<20),
+			engine.NewInMem(proto.Attributes{}, 100<<20),
+		},
+	}
+	if err := ts.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	if err := util.IsTrueWithin(func() bool { return ts.node.lSender.GetStoreCount() == 2 }, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var store1, store2 *storage.Store
+	if err := ts.node.lSender.VisitStores(func(s *storage.Store) error {
+		if s.Engine() == ts.Engines[0] {
+			store1 = s
+		} else {
+			store2 = s
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.node.db.Call(proto.AdminSplit, &proto.AdminSplitRequest{
+		RequestHeader: proto.RequestHeader{Key: proto.Key("m")},
+		SplitKey:      proto.Key("m"),
+	}, &proto.AdminSplitResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	put := proto.PutArgs(proto.Key("n"), []byte("value"))
+	put.User = storage.UserRoot
+	if err := ts.node.db.Call(proto.Put, put, &proto.PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rng := store1.LookupRange(proto.Key("n"), nil)
+	if rng == nil {
+		t.Fatal("expected store 1 to contain range with key \"n\"")
+	}
+	if err := store1.RelocateRange(rng, store2); err != nil {
+		t.Fatal(err)
+	}
+	if rng := store1.LookupRange(proto.Key("n"), nil); rng != nil {
+		t.Errorf("expected range to be removed from store 1; got %+v", rng.Desc)
+	}
+	rng = store2.LookupRange(proto.Key("n"), nil)
+	if rng == nil {
+		t.Fatal("expected store 2 to contain range with key \"n\"")
+	}
+	if replica := rng.Desc.FindReplica(store2.StoreID()); replica == nil {
+		t.Errorf("expected range descriptor to contain replica on store %d; got %+v", store2.StoreID(), rng.Desc)
+	}
+
+	get := proto.GetArgs(proto.Key("n"))
+	get.User = storage.UserRoot
+	reply := &proto.GetResponse{}
+	if err := ts.node.db.Call(proto.Get, get, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Value == nil || !bytes.Equal(reply.Value.Bytes, []byte("value")) {
+		t.Errorf("expected value \"value\"; got %+v", reply.Value)
+	}
+}
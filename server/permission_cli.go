@@ -118,6 +118,10 @@ For example:
     - readWriteUser
     - WriteOnlyUser
 
+Entries beginning with "@" name groups of users, whose members are
+managed via the admin groups endpoint. For example, "@analysts" grants
+permissions to all members of the group "analysts".
+
 Setting permission configs will guarantee that users will have permissions for
 this key prefix and all sub prefixes of the one that is set
 `,
@@ -0,0 +1,107 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// A placementDryRunRequest describes a hypothetical change to the
+// cluster: nodes taken down and, if Zone is set, the replacement of
+// the config of the zone with key prefix ZonePrefix, the empty prefix
+// being the default zone.
+type placementDryRunRequest struct {
+	DownNodes  []int32           `json:"down_nodes"`
+	ZonePrefix string            `json:"zone_prefix"`
+	Zone       *proto.ZoneConfig `json:"zone"`
+}
+
+// handlePlacementDryRun responds to POST of a placementDryRunRequest
+// with a storage.PlacementPlan predicting the replicas which would be
+// removed and created, and the bytes copied, were the change made.
+// Nothing is changed. The plan covers the ranges with replicas on
+// this node's stores: to predict the cost of taking a node down, ask
+// that node; to predict that of a zone config change, ask each node.
+func (s *adminServer) handlePlacementDryRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	req := &placementDryRunRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid placement dry run request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.DownNodes) == 0 && req.Zone == nil {
+		http.Error(w, "placement dry run must specify down nodes or a zone config", http.StatusBadRequest)
+		return
+	}
+	plan, err := s.placementDryRun(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if b, err = json.Marshal(plan); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// placementDryRun plans the placement of the replicas on this node's
+// stores after the change described by req. Ranges with replicas on
+// several of the node's stores are planned once.
+func (s *adminServer) placementDryRun(req *placementDryRunRequest) (*storage.PlacementPlan, error) {
+	zones, err := s.zone.configMap()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int64]struct{}{}
+	var ranges []storage.PlacementRange
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		storeRanges, err := store.PlacementRanges()
+		if err != nil {
+			return err
+		}
+		for _, pr := range storeRanges {
+			if _, ok := seen[pr.Desc.RaftID]; !ok {
+				seen[pr.Desc.RaftID] = struct{}{}
+				ranges = append(ranges, pr)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return storage.PlanPlacement(ranges, zones, &storage.PlacementChange{
+		DownNodes:  req.DownNodes,
+		ZonePrefix: proto.Key(req.ZonePrefix),
+		Zone:       req.Zone,
+	}, s.zone.findStores)
+}
@@ -0,0 +1,157 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+const (
+	// minFileDescriptors is the open file limit below which RocksDB,
+	// which keeps its table files open, and the node's connections are
+	// likely to run out of file descriptors.
+	minFileDescriptors = 10000
+	// minDiskAvailable is the free space below which a store's disk is
+	// considered nearly full.
+	minDiskAvailable = 1 << 30 // 1GB
+	// minDiskAvailableFraction is the fraction of a store's disk which
+	// should remain free.
+	minDiskAvailableFraction = 0.05
+	// minMemory is the memory limit below which the node is likely to
+	// be killed for exceeding it.
+	minMemory = 1 << 30 // 1GB
+)
+
+// errPreflightUnsupported is returned by the platform-specific probes
+// of preflight checks which aren't supported on this platform.
+var errPreflightUnsupported = util.Errorf("not supported on this platform")
+
+// runPreflightChecks examines the environment in which the node is to
+// be started with the stores specified by storesSpec, logging a
+// warning for each problem found. If strict is true, an error listing
+// the problems is returned instead, so that the node refuses to start.
+func runPreflightChecks(storesSpec string, strict bool) error {
+	var warnings []string
+	warn := func(warning string) {
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	// probeFailed notes that a check couldn't be made.
+	probeFailed := func(check string, err error) {
+		if log.V(1) {
+			log.Infof("skipping preflight check of %s: %s", check, err)
+		}
+	}
+
+	if limit, err := fileDescriptorLimit(); err != nil {
+		probeFailed("file descriptor limit", err)
+	} else {
+		warn(checkFileDescriptors(limit))
+	}
+
+	var memStores uint64
+	for _, spec := range storesRE.FindAllStringSubmatch(storesSpec, -1) {
+		path := spec[2]
+		if size, err := strconv.ParseUint(path, 10, 64); err == nil {
+			memStores += size
+			continue
+		}
+		if avail, total, err := diskSpace(existingParent(path)); err != nil {
+			probeFailed("disk space of store "+path, err)
+		} else {
+			warn(checkDiskSpace(path, avail, total))
+		}
+	}
+
+	if synced, err := clockSynchronized(); err != nil {
+		probeFailed("clock synchronization", err)
+	} else if !synced {
+		warn("the system clock is not synchronized; run NTP so that clock offsets " +
+			"remain within -max_offset, beyond which the node exits")
+	}
+
+	if limit, err := memoryLimit(); err != nil {
+		probeFailed("memory limit", err)
+	} else {
+		warn(checkMemory(limit, memStores))
+	}
+
+	if len(warnings) == 0 {
+		return nil
+	}
+	if strict {
+		return util.Errorf("preflight checks failed with -strict_checks:\n  %s",
+			strings.Join(warnings, "\n  "))
+	}
+	for _, warning := range warnings {
+		log.Warningf("preflight check: %s", warning)
+	}
+	return nil
+}
+
+// checkFileDescriptors returns a warning if limit open files are too
+// few.
+func checkFileDescriptors(limit uint64) string {
+	if limit >= minFileDescriptors {
+		return ""
+	}
+	return fmt.Sprintf("the open file limit is %d, but at least %d is recommended; "+
+		"raise it with \"ulimit -n\"", limit, minFileDescriptors)
+}
+
+// checkDiskSpace returns a warning if the disk holding the store at
+// path, of which avail out of total bytes are free, is nearly full.
+func checkDiskSpace(path string, avail, total uint64) string {
+	if avail >= minDiskAvailable && float64(avail) >= minDiskAvailableFraction*float64(total) {
+		return ""
+	}
+	return fmt.Sprintf("the disk of store %s has only %d of %d bytes free; free up space "+
+		"or move the store to a larger disk", path, avail, total)
+}
+
+// checkMemory returns a warning if the memory limit of the process
+// is too low, or too low to hold in-memory stores of memStores bytes.
+func checkMemory(limit, memStores uint64) string {
+	if limit < memStores+minMemory {
+		return fmt.Sprintf("the memory limit is %d bytes, but in-memory stores need %d "+
+			"bytes and at least %d more are recommended; raise the limit of the "+
+			"process' cgroup or reduce the capacity of in-memory stores", limit, memStores, uint64(minMemory))
+	}
+	return ""
+}
+
+// existingParent returns path or, if it doesn't exist yet, its
+// nearest existing ancestor, on whose disk the store will be created.
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
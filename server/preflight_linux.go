@@ -0,0 +1,89 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// +build linux
+
+package server
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// timeError is the clock state returned by adjtimex when the kernel
+// considers the clock unsynchronized.
+const timeError = 5
+
+// cgroupMemoryLimitFiles are the files holding the memory limit of
+// the process' cgroup under cgroup v2 and v1 respectively.
+var cgroupMemoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// fileDescriptorLimit returns the soft limit of open files.
+func fileDescriptorLimit() (uint64, error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, err
+	}
+	return rlimit.Cur, nil
+}
+
+// diskSpace returns the bytes available to unprivileged users and the
+// total bytes of the filesystem holding path.
+func diskSpace(path string) (avail, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
+
+// clockSynchronized returns whether the kernel considers the system
+// clock synchronized, e.g. by an NTP daemon.
+func clockSynchronized() (bool, error) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false, err
+	}
+	return state != timeError, nil
+}
+
+// memoryLimit returns the lesser of the physical memory and the
+// memory limit of the process' cgroup, if any.
+func memoryLimit() (uint64, error) {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0, err
+	}
+	limit := uint64(info.Totalram) * uint64(info.Unit)
+	for _, file := range cgroupMemoryLimitFiles {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		// An unlimited cgroup reads "max" under v2 and a value beyond
+		// the physical memory under v1.
+		if cgroupLimit, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err == nil && cgroupLimit < limit {
+			limit = cgroupLimit
+		}
+		break
+	}
+	return limit, nil
+}
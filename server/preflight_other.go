@@ -0,0 +1,37 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// +build !linux
+
+package server
+
+// The preflight probes below are only implemented on Linux; their
+// checks are skipped elsewhere.
+
+func fileDescriptorLimit() (uint64, error) {
+	return 0, errPreflightUnsupported
+}
+
+func diskSpace(path string) (avail, total uint64, err error) {
+	return 0, 0, errPreflightUnsupported
+}
+
+func clockSynchronized() (bool, error) {
+	return false, errPreflightUnsupported
+}
+
+func memoryLimit() (uint64, error) {
+	return 0, errPreflightUnsupported
+}
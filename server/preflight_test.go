@@ -0,0 +1,62 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPreflightChecks verifies the thresholds of the individual
+// preflight checks.
+func TestPreflightChecks(t *testing.T) {
+	testCases := []struct {
+		warning  string
+		expected bool
+	}{
+		{checkFileDescriptors(1024), true},
+		{checkFileDescriptors(minFileDescriptors), false},
+		{checkDiskSpace("/data", 100<<20, 100<<30), true},
+		{checkDiskSpace("/data", 2<<30, 100<<30), true},
+		{checkDiskSpace("/data", 10<<30, 100<<30), false},
+		{checkMemory(512<<20, 0), true},
+		{checkMemory(2<<30, 2<<30), true},
+		{checkMemory(4<<30, 2<<30), false},
+	}
+	for i, c := range testCases {
+		if (c.warning != "") != c.expected {
+			t.Errorf("%d: expected warning %t; got %q", i, c.expected, c.warning)
+		}
+	}
+}
+
+// TestPreflightExistingParent verifies that the disk space of a store
+// which doesn't exist yet is checked on its nearest existing ancestor.
+func TestPreflightExistingParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_preflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if p := existingParent(filepath.Join(dir, "a", "b")); p != dir {
+		t.Errorf("expected %s; got %s", dir, p)
+	}
+	if p := existingParent(dir); p != dir {
+		t.Errorf("expected %s; got %s", dir, p)
+	}
+}
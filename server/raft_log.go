@@ -0,0 +1,102 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// defaultRaftLogEntries is the number of the most recent entries of a
+// Raft log returned if no window is specified.
+const defaultRaftLogEntries = 20
+
+// A storeRaftLog is the Raft log of a range's replica on a store.
+type storeRaftLog struct {
+	StoreID int32
+	RaftLog *storage.RaftLogStatus
+}
+
+// handleRaftLogAction responds to GET of <prefix>/<raft-id>?lo=&hi=
+// with the Raft state of the range's replicas on this node's stores
+// and the decoded entries of their logs from index lo up to, but not
+// including, index hi. By default, the most recent
+// defaultRaftLogEntries entries are returned.
+func (s *adminServer) handleRaftLogAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, raftLogPathPrefix), "/")
+	raftID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "expected path "+raftLogPathPrefix+"/<raft-id>", http.StatusBadRequest)
+		return
+	}
+	var lo, hi uint64
+	for name, index := range map[string]*uint64{"lo": &lo, "hi": &hi} {
+		if v := r.URL.Query().Get(name); v != "" {
+			if *index, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s %q: %s", name, v, err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	logs := []storeRaftLog{}
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		rng, err := store.GetRange(raftID)
+		if err != nil {
+			return nil
+		}
+		rngLo, rngHi := lo, hi
+		if rngHi == 0 {
+			last, err := rng.LastIndex()
+			if err != nil {
+				return err
+			}
+			rngHi = last + 1
+			if rngLo == 0 && rngHi > defaultRaftLogEntries {
+				rngLo = rngHi - defaultRaftLogEntries
+			}
+		}
+		status, err := rng.RaftLog(rngLo, rngHi)
+		if err != nil {
+			return err
+		}
+		logs = append(logs, storeRaftLog{StoreID: store.StoreID(), RaftLog: status})
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(logs) == 0 {
+		http.Error(w, fmt.Sprintf("range %d has no replica on this node", raftID), http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(logs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/structured"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// A CmdRestoreTable command restores a table of a structured schema
+// from copies of a cluster's stores into a running cluster.
+var CmdRestoreTable = &commander.Command{
+	UsageLine: "restore-table [options] <schema-key> <table> <new-table> <new-table-key> <dir>...",
+	Short:     "restores a table from copies of a cluster's stores",
+	Long: `
+Restores table <table> of the schema with key <schema-key> from a
+full-cluster backup into the running cluster specified by -addr, as a
+new table <new-table> with the table key <new-table-key> in the
+cluster's schema of the same key. The backup is given as the
+directories of copies of all of the backed-up cluster's stores, such
+as clones of their checkpoints; of each key, the most recently
+committed value among the copies is restored. The copies are opened
+directly, so they must not be in use by a node.
+
+The keys of the table's rows and indexes are rewritten to the new
+table key as they're written, after which the table is added to the
+schema. The new table key must be unused. Tables interleaved in
+another table can't be restored on their own, and the rows of tables
+interleaved in the restored table are skipped. For example:
+
+  cockroach checkpoint -stores=ssd=/mnt/ssd1 clone nightly /mnt/backup/node1
+  ...
+  cockroach restore-table -addr=host:8080 pdb User OldUser ou /mnt/backup/node1/0 /mnt/backup/node2/0
+`,
+	Run:  runRestoreTable,
+	Flag: *flag.CommandLine,
+}
+
+// runRestoreTable restores the table specified by args.
+func runRestoreTable(cmd *commander.Command, args []string) {
+	if len(args) < 5 {
+		cmd.Usage()
+		return
+	}
+	var backup []engine.Engine
+	for _, dir := range args[4:] {
+		r, err := openStoreCopy(dir)
+		if err != nil {
+			log.Errorf("unable to open store copy %s: %s", dir, err)
+			return
+		}
+		defer r.Stop()
+		backup = append(backup, r)
+	}
+	kv := client.NewKV(client.NewHTTPSender(*addr, &http.Transport{}), nil)
+	res, err := structured.RestoreTable(kv, backup, args[0], args[1], args[2], args[3])
+	if err != nil {
+		log.Errorf("restore-table failed: %s", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "restored table %q of schema %q as %q: %d row(s), %d index key(s) (%d bytes)\n",
+		args[1], args[0], args[2], res.Rows, res.IndexKeys, res.Bytes)
+}
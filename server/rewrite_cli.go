@@ -0,0 +1,135 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var (
+	rewriteCompression = flag.String("rewrite_compression", "", "compression of the "+
+		"stores written by rewrite-stores: none, snappy, zlib or lz4; defaults to snappy")
+	rewriteDropOrphans = flag.Bool("rewrite_drop_orphans", false, "omit range-local "+
+		"data of ranges without a descriptor in the store from the stores written by "+
+		"rewrite-stores")
+)
+
+// A CmdRewriteStores command writes compacted copies of a node's
+// stores.
+var CmdRewriteStores = &commander.Command{
+	UsageLine: "rewrite-stores [options] <dir>",
+	Short:     "writes compacted copies of stores",
+	Long: `
+Copies each store specified by -stores to <dir>/<i>, where <i> is the
+store's index in -stores. Each copy is written afresh and compacted,
+so that it holds none of the overwritten and deleted data of the
+original, and its tables are written with -rewrite_compression. With
+-rewrite_drop_orphans, the range-local data of ranges without a
+descriptor in the store, such as that left behind by a replica which
+was removed while its node was down, is omitted. The original stores
+are left unchanged. They are opened directly, so the node using them
+must not be running. In-memory stores are skipped.
+
+Copies are useful for migrating stores to new settings or disks, and
+as forensic copies of stores which can be examined without modifying
+the originals. For example:
+
+  cockroach rewrite-stores -stores=ssd=/mnt/ssd1 -rewrite_compression=zlib /mnt/ssd2/rewritten
+  cockroach start -stores=ssd=/mnt/ssd2/rewritten/0 ...
+`,
+	Run:  runRewriteStores,
+	Flag: *flag.CommandLine,
+}
+
+// runRewriteStores rewrites the stores specified by -stores to the
+// directory in args.
+func runRewriteStores(cmd *commander.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return
+	}
+	compression, err := engine.ParseCompression(*rewriteCompression)
+	if err != nil {
+		log.Errorf("invalid -rewrite_compression: %s", err)
+		return
+	}
+	engines, err := initEngines(*stores)
+	if err != nil {
+		log.Errorf("failed to initialize engines from -stores=%s: %s", *stores, err)
+		return
+	}
+	for i, e := range engines {
+		src, ok := engine.Unwrap(e).(*engine.RocksDB)
+		if !ok {
+			log.Warningf("skipping store %d: in-memory stores can't be rewritten", i)
+			continue
+		}
+		dir := filepath.Join(args[0], strconv.Itoa(i))
+		if err := rewriteStore(src, dir, compression); err != nil {
+			log.Errorf("failed to rewrite store %s to %s: %s", src, dir, err)
+			return
+		}
+	}
+}
+
+// rewriteStore copies the store src to a new store in dir, written
+// with the specified compression, and compacts the copy.
+func rewriteStore(src *engine.RocksDB, dir string, compression engine.Compression) error {
+	// Opening a RocksDB creates it if it's missing, which mustn't
+	// happen to the original.
+	if _, err := os.Stat(src.Dir()); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return util.Errorf("%s already exists", dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if err := src.Start(); err != nil {
+		return err
+	}
+	defer src.Stop()
+	dst := engine.NewRocksDB(proto.Attributes{}, dir)
+	dst.SetCompression(compression)
+	if err := dst.Start(); err != nil {
+		return err
+	}
+	defer dst.Stop()
+
+	rewrite, err := storage.RewriteStore(src, dst, *rewriteDropOrphans)
+	if err != nil {
+		return err
+	}
+	dst.CompactRange(nil, nil)
+	fmt.Fprintf(os.Stdout, "%s: copied %d key(s) (%d bytes) to %s", src, rewrite.Keys, rewrite.Bytes, dir)
+	if *rewriteDropOrphans {
+		fmt.Fprintf(os.Stdout, ", dropping %d orphaned key(s)", rewrite.DroppedKeys)
+	}
+	fmt.Fprintln(os.Stdout)
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/structured"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+const (
+	// schemaChangeJobType is the job type of schema changes.
+	schemaChangeJobType = "schema_change"
+	// schemaChangeRetryInterval is the interval at which a schema
+	// change retries a step blocked by leases on an old version of the
+	// schema.
+	schemaChangeRetryInterval = 5 * time.Second
+)
+
+// runSchemaChange runs a schema change job, which advances the columns
+// added to its schema through the delete-only and write-only states,
+// backfilling them before they become public. Each step waits for the
+// leases on the schema's preceding version to be released or expire.
+func (s *adminServer) runSchemaChange(jc *jobContext) error {
+	details := &proto.SchemaChangeDetails{}
+	if err := gogoproto.Unmarshal(jc.Job().Details, details); err != nil {
+		return util.Errorf("unable to decode schema change details: %s", err)
+	}
+	db := structured.NewDB(s.db)
+	backfill := structured.NewBackfiller(s.db)
+	var steps int
+	for {
+		done, err := structured.AdvanceSchemaChange(db, details.SchemaKey, backfill)
+		_, waiting := err.(*structured.SchemaLeaseError)
+		if waiting {
+			log.V(1).Infof("schema change of %q waiting: %s", details.SchemaKey, err)
+		} else if err != nil {
+			return err
+		} else if done {
+			return nil
+		} else {
+			steps++
+		}
+		// Each column takes two steps to become public.
+		fraction := float64(steps) / 2
+		if fraction > 1 {
+			fraction = 1
+		}
+		if err := jc.Progress(fraction, nil); err != nil {
+			return err
+		}
+		if waiting {
+			time.Sleep(schemaChangeRetryInterval)
+		}
+	}
+}
+
+// A schemaChangeRequest is the body of a request to add a column to a
+// table of a structured schema. The column's fields are named as those
+// of structured.Column.
+type schemaChangeRequest struct {
+	Schema string             `json:"schema"`
+	Table  string             `json:"table"`
+	Column *structured.Column `json:"column"`
+}
+
+// handleSchemaChangesAction adds a column on POST of a
+// schemaChangeRequest and creates the job which makes it public,
+// responding with the job's record.
+func (s *adminServer) handleSchemaChangesAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	req := &schemaChangeRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid schema change request: %s", err), http.StatusBadRequest)
+		return
+	}
+	job, err := s.createSchemaChange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b, err = json.Marshal(job); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// createSchemaChange adds the column of req in the delete-only state
+// and creates a schema change job.
+func (s *adminServer) createSchemaChange(req *schemaChangeRequest) (*proto.Job, error) {
+	if req.Column == nil {
+		return nil, util.Errorf("schema change must specify a column")
+	}
+	if err := structured.AddColumn(structured.NewDB(s.db), req.Schema, req.Table, req.Column); err != nil {
+		return nil, err
+	}
+	b, err := gogoproto.Marshal(&proto.SchemaChangeDetails{SchemaKey: req.Schema})
+	if err != nil {
+		return nil, err
+	}
+	return s.jobs.Create(schemaChangeJobType,
+		fmt.Sprintf("add column %q to table %q of schema %q", req.Column.Name, req.Table, req.Schema), b)
+}
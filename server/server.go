@@ -20,6 +20,7 @@ package server
 
 import (
 	"compress/gzip"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
@@ -32,6 +33,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	commander "code.google.com/p/go-commander"
@@ -42,21 +44,36 @@ import (
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/cloud"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/structured"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/fault"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
 const staticDir = "./ui/"
 
 var (
-	rpcAddr  = flag.String("rpc", ":0", "host:port to bind for RPC traffic; 0 to pick unused port")
+	rpcAddr = flag.String("rpc", ":0", "host:port to bind for intra-cluster RPC traffic, "+
+		"including gossip; 0 to pick unused port")
 	httpAddr = flag.String("http", ":8080", "host:port to bind for HTTP traffic; 0 to pick unused port")
 
 	certDir = flag.String("certs", "", "directory containing RSA key and x509 certs")
 
+	// clientRPCAddr and clientCertDir separate client-facing traffic
+	// from intra-cluster traffic, which is served on -rpc using the
+	// certs in -certs, so that each may be exposed on its own network
+	// with its own certificates.
+	clientRPCAddr = flag.String("client_rpc", "", "host:port to bind for client RPC traffic, "+
+		"separately from intra-cluster RPC traffic on -rpc; 0 to pick unused port; empty to "+
+		"serve client RPC traffic only on -rpc")
+	clientCertDir = flag.String("client_certs", "", "directory containing RSA key and x509 certs "+
+		"for the client-facing -http and -client_rpc listeners; if empty, HTTP traffic is served "+
+		"without TLS and -client_rpc uses the certs in -certs")
+
 	// stores is specified to enable durable storage via RocksDB-backed
 	// key-value stores. Memory-backed key value stores may be
 	// optionally specified via mem=<integer byte size>.
@@ -86,6 +103,81 @@ var (
 	bootstrapOnly = flag.Bool("bootstrap_only", false, "specify --bootstrap_only "+
 		"to avoid starting the server after bootstrapping with the init command.")
 
+	// adminToken guards the debug endpoints. Requests which present
+	// it as a bearer token are allowed from any address; otherwise
+	// only requests from the loopback interface are served. The CLI
+	// uses the same flag to authenticate to a running node.
+	adminToken = flag.String("admin_token", "", "token which must be presented as "+
+		"\"Authorization: Bearer <token>\" to access /debug endpoints from non-loopback addresses")
+
+	// requireSession requires the web UI and other HTTP clients of the
+	// admin and key-value endpoints to log in.
+	requireSession = flag.Bool("require_session", false, "require a session cookie, "+
+		"obtained by logging in at "+loginPath+", or the admin token for the admin and "+
+		"key-value HTTP endpoints")
+
+	// readCacheSize enables caching of repeated reads served to
+	// clients by the node's KV endpoints.
+	readCacheSize = flag.Int("read_cache_size", 0, "number of non-transactional reads "+
+		"cached for repeated reads of the same key by clients of this node; 0 to disable")
+	readCacheTTL = flag.Duration("read_cache_ttl", 100*time.Millisecond, "time for which "+
+		"reads are cached with -read_cache_size; capped at -max_offset")
+
+	// terminateOnSlowSync exits the node when one of its stores
+	// becomes suspect, so that Raft leadership moves to healthy nodes
+	// rather than committing with second-long latencies.
+	terminateOnSlowSync = flag.Bool("terminate_on_slow_sync", false, "exit the node if a store's "+
+		"write-ahead log syncs are persistently slow, instead of continuing with high commit latencies")
+
+	// reusePort and drainTimeout allow a node to be restarted on the
+	// same host without refusing or abruptly closing connections: the
+	// new process binds the addresses of the old one, which drains its
+	// in-flight requests on SIGTERM.
+	reusePort = flag.Bool("reuse_port", false, "bind the RPC and HTTP addresses with "+
+		"SO_REUSEPORT, so that a new process may bind them while this one drains")
+	drainTimeout = flag.Duration("drain_timeout", 10*time.Second, "maximum time to wait "+
+		"for in-flight HTTP requests to complete after receiving SIGTERM")
+
+	// logMaxFileSize, logMaxTotalSize and logMaxAge control the
+	// rotation and retention of the log files written to -log_dir.
+	// They may be changed at runtime via the admin logs endpoint.
+	logMaxFileSize = flag.Uint64("log_max_file_size", 0, "size in bytes at which "+
+		"log files are rotated; 0 for the default of 1.8GB")
+	logMaxTotalSize = flag.Int64("log_max_total_size", 0, "total size in bytes of the "+
+		"log files of each severity beyond which the oldest are deleted; 0 to disable")
+	logMaxAge = flag.Duration("log_max_age", 0, "time since their last write after "+
+		"which log files are deleted; 0 to disable")
+
+	// relocationBackupURI locates the range backups written by backup
+	// jobs with ranges set, from which ranges relocated between the
+	// node's stores are preloaded.
+	relocationBackupURI = flag.String("relocation_backup_uri", "", "external storage URI "+
+		"(e.g. s3://bucket/backups) of range backups from which ranges relocated between "+
+		"this node's stores are preloaded; empty to copy ranges in full")
+
+	// crashReportDir and crashReportURL opt in to crash reports, which
+	// record redacted stacks and build info of panics in the node's
+	// long-running goroutines.
+	crashReportDir = flag.String("crash_report_dir", "", "directory to which reports of "+
+		"panics, with redacted stacks and build info, are written; empty to disable")
+	crashReportURL = flag.String("crash_report_url", "", "HTTPS endpoint to which crash "+
+		"reports are also posted; requires -crash_report_dir")
+
+	// strictChecks turns the warnings of the preflight checks run
+	// before the node starts into errors.
+	strictChecks = flag.Bool("strict_checks", false, "refuse to start the node if "+
+		"preflight checks of file descriptor limits, disk space, clock synchronization "+
+		"or memory limits fail, rather than warning")
+
+	// faults specifies faults to inject, for resilience testing only.
+	// It's hidden from the parameters listed by listparams.
+	faults = flag.String("faults", "", "faults to inject, for testing only, e.g. "+
+		"engine.write:error=0.001,rpc.send:delay=0.01/50ms; see fault.ParseSpecs")
+
+	// HiddenFlags names the flags omitted from the parameters listed
+	// by listparams.
+	HiddenFlags = map[string]struct{}{"faults": {}}
+
 	// Regular expression for capturing data directory specifications.
 	storesRE = regexp.MustCompile(`([^=]+)=([^,]+)(,|$)`)
 
@@ -109,6 +201,12 @@ stores, the number of bytes. Although the paths should be specified to
 correspond uniquely to physical devices, this requirement isn't
 strictly enforced.
 
+Intra-cluster traffic, including gossip, is served on the -rpc address
+using the certs in -certs. Client traffic is served on the -http
+address and, if specified, on a separate -client_rpc address, using
+the certs in -client_certs, so that client and intra-cluster traffic
+may be confined to separate networks.
+
 A node exports an HTTP API with the following endpoints:
 
   Health check:           /healthz
@@ -151,7 +249,7 @@ func runInit(cmd *commander.Command, args []string) {
 		return
 	}
 	e := engines[0]
-	if _, ok := e.(*engine.InMem); ok {
+	if _, ok := engine.Unwrap(e).(*engine.InMem); ok {
 		log.Errorf("Cannot initialize a cluster using an in-memory store")
 		return
 	}
@@ -189,17 +287,26 @@ type server struct {
 	host           string
 	mux            *http.ServeMux
 	clock          *hlc.Clock
+	tlsConfig      *rpc.TLSConfig // TLS configuration for intra-cluster traffic
 	rpc            *rpc.Server
 	gossip         *gossip.Gossip
 	kv             *client.KV
 	kvDB           *kv.DBServer
 	kvREST         *kv.RESTServer
+	readCache      *kv.ReadCacheSender // Nil unless -read_cache_size is set
+	audit          *auditLogger        // Nil unless the audit log is enabled
 	node           *Node
 	admin          *adminServer
 	status         *statusServer
 	structuredDB   structured.DB
 	structuredREST *structured.RESTServer
 	httpListener   *net.Listener // holds http endpoint information
+	httpServer     *http.Server
+	activeRequests *metrics.Gauge // number of in-flight HTTP requests
+	logGC          *util.Stopper  // Deletes old log files; nil until started
+
+	clientRPC       *rpc.Server    // Nil unless -client_rpc is set
+	clientTLSConfig *rpc.TLSConfig // TLS configuration for the HTTP listener
 }
 
 // runStart starts the cockroach node using -stores as the list of
@@ -208,11 +315,24 @@ type server struct {
 // cluster via the gossip network.
 func runStart(cmd *commander.Command, args []string) {
 	log.Info("Starting cockroach cluster")
+	if err := util.EnableCrashReports(*crashReportDir, *crashReportURL); err != nil {
+		log.Errorf("Failed to enable crash reports: %v", err)
+		return
+	}
+	defer util.ReportPanic("main")
+	if err := runPreflightChecks(*stores, *strictChecks); err != nil {
+		log.Errorf("Failed to start Cockroach server: %v", err)
+		return
+	}
 	s, err := newServer(*rpcAddr, *certDir, *maxOffset)
 	if err != nil {
 		log.Errorf("Failed to start Cockroach server: %v", err)
 		return
 	}
+	if err := s.initClientListeners(*clientRPCAddr, *clientCertDir); err != nil {
+		log.Errorf("Failed to configure client listeners: %v", err)
+		return
+	}
 
 	// Init engines from -stores.
 	engines, err := initEngines(*stores)
@@ -225,6 +345,19 @@ func runStart(cmd *commander.Command, args []string) {
 		return
 	}
 
+	if *faults != "" {
+		specs, err := fault.ParseSpecs(*faults)
+		if err != nil {
+			log.Errorf("Failed to parse -faults=%s: %v", *faults, err)
+			return
+		}
+		log.Warningf("Injecting faults: %s", *faults)
+		fault.SetInjector(fault.NewRandomInjector(time.Now().UnixNano(), specs))
+		for i, e := range engines {
+			engines[i] = engine.NewFaultEngine(e)
+		}
+	}
+
 	err = s.start(engines, *attrs, *httpAddr, false)
 	defer s.stop()
 	if err != nil {
@@ -233,10 +366,14 @@ func runStart(cmd *commander.Command, args []string) {
 	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-	// Block until one of the signals above is received.
-	<-c
+	// Block until one of the signals above is received. SIGTERM, sent
+	// to restart the node, drains in-flight requests first.
+	if sig := <-c; sig == syscall.SIGTERM {
+		log.Infof("Draining in-flight requests for up to %s", *drainTimeout)
+		s.drain(*drainTimeout)
+	}
 }
 
 // parseAttributes parses a colon-separated list of strings,
@@ -304,33 +441,28 @@ func newServer(rpcAddr, certDir string, maxOffset time.Duration) (*server, error
 		host = "127.0.0.1"
 	}
 
-	// If the specified rpc address includes no host component, use the hostname.
-	if strings.HasPrefix(rpcAddr, ":") {
-		rpcAddr = host + rpcAddr
-	}
-	_, err = net.ResolveTCPAddr("tcp", rpcAddr)
+	rpcAddr, err = resolveRPCAddr(host, rpcAddr)
 	if err != nil {
-		return nil, util.Errorf("unable to resolve RPC address %q: %v", rpcAddr, err)
+		return nil, err
 	}
-
-	var tlsConfig *rpc.TLSConfig
-	if certDir == "" {
-		tlsConfig = rpc.LoadInsecureTLSConfig()
-	} else {
-		var err error
-		if tlsConfig, err = rpc.LoadTLSConfig(certDir); err != nil {
-			return nil, util.Errorf("unable to load TLS config: %v", err)
-		}
+	tlsConfig, err := loadTLSConfig(certDir)
+	if err != nil {
+		return nil, err
 	}
 
 	s := &server{
-		host:  host,
-		mux:   http.NewServeMux(),
-		clock: hlc.NewClock(hlc.UnixNano),
+		host:            host,
+		mux:             http.NewServeMux(),
+		clock:           hlc.NewClock(hlc.UnixNano),
+		tlsConfig:       tlsConfig,
+		clientTLSConfig: rpc.LoadInsecureTLSConfig(),
+		activeRequests:  metrics.NewGauge(),
 	}
 	s.clock.SetMaxOffset(maxOffset)
+	metrics.DefaultRegistry.Register("server.http.active_requests", s.activeRequests)
 
 	rpcContext := rpc.NewContext(s.clock, tlsConfig)
+	rpcContext.ReusePort = *reusePort
 	go rpcContext.RemoteClocks.MonitorRemoteOffsets()
 
 	s.rpc = rpc.NewServer(util.MakeRawAddr("tcp", rpcAddr), rpcContext)
@@ -342,17 +474,105 @@ func newServer(rpcAddr, certDir string, maxOffset time.Duration) (*server, error
 	s.kv = client.NewKV(sender, nil)
 	s.kv.User = storage.UserRoot
 
-	s.kvDB = kv.NewDBServer(sender)
-	s.kvREST = kv.NewRESTServer(s.kv)
+	// Reads by clients of the KV endpoints are optionally cached. The
+	// node's own client is not, so that node internals never observe
+	// cached reads.
+	var gatewaySender client.KVSender = sender
+	if *readCacheSize > 0 {
+		s.readCache = kv.NewReadCacheSender(sender, s.clock, *readCacheSize, *readCacheTTL)
+		gatewaySender = s.readCache
+	}
+	// Operations by clients of the KV endpoints are optionally audited.
+	if s.audit, err = newAuditLogger(*auditLogPath, *auditLogURI, *auditKeyPrefixes, host); err != nil {
+		return nil, err
+	}
+	if s.audit != nil {
+		gatewaySender = &auditSender{wrapped: gatewaySender, audit: s.audit}
+	}
+	gatewayKV := s.kv
+	if gatewaySender != client.KVSender(sender) {
+		gatewayKV = client.NewKV(gatewaySender, nil)
+		gatewayKV.User = storage.UserRoot
+	}
+	s.kvDB = kv.NewDBServer(gatewaySender)
+	s.kvREST = kv.NewRESTServer(gatewayKV)
 	s.node = NewNode(s.kv, s.gossip)
-	s.admin = newAdminServer(s.kv)
-	s.status = newStatusServer(s.kv, s.gossip)
+	s.node.terminateOnSlowSync = *terminateOnSlowSync
+	if *relocationBackupURI != "" {
+		if s.node.relocationBackups, err = cloud.FromURI(*relocationBackupURI); err != nil {
+			return nil, err
+		}
+	}
+	s.admin = newAdminServer(s.kv, s.node.lSender)
+	s.admin.txns = sender
+	s.status = newStatusServer(s.kv, s.gossip, s.node.lSender)
+	s.status.readCache = s.readCache
+	s.status.latency = s.node.latency
+	s.status.txns = sender
 	s.structuredDB = structured.NewDB(s.kv)
 	s.structuredREST = structured.NewRESTServer(s.structuredDB)
 
 	return s, nil
 }
 
+// resolveRPCAddr returns rpcAddr, using host if the address includes
+// no host component, and verifies that it resolves.
+func resolveRPCAddr(host, rpcAddr string) (string, error) {
+	if strings.HasPrefix(rpcAddr, ":") {
+		rpcAddr = host + rpcAddr
+	}
+	if _, err := net.ResolveTCPAddr("tcp", rpcAddr); err != nil {
+		return "", util.Errorf("unable to resolve RPC address %q: %v", rpcAddr, err)
+	}
+	return rpcAddr, nil
+}
+
+// loadTLSConfig loads the TLS configuration from the certs in
+// certDir, or an insecure configuration if certDir is empty.
+func loadTLSConfig(certDir string) (*rpc.TLSConfig, error) {
+	if certDir == "" {
+		return rpc.LoadInsecureTLSConfig(), nil
+	}
+	tlsConfig, err := rpc.LoadTLSConfig(certDir)
+	if err != nil {
+		return nil, util.Errorf("unable to load TLS config: %v", err)
+	}
+	return tlsConfig, nil
+}
+
+// initClientListeners configures the listeners for client-facing
+// traffic. If clientCertDir is set, HTTP traffic is served with TLS
+// using its certs. If clientRPCAddr is set, the node's key-value
+// methods are also served by an RPC server bound to it, which uses
+// the certs in clientCertDir or, if unset, the server's intra-cluster
+// TLS configuration. Gossip is served only on the intra-cluster RPC
+// server. Must be invoked before start.
+func (s *server) initClientListeners(clientRPCAddr, clientCertDir string) error {
+	if clientCertDir != "" {
+		var err error
+		if s.clientTLSConfig, err = loadTLSConfig(clientCertDir); err != nil {
+			return err
+		}
+	}
+	if clientRPCAddr == "" {
+		return nil
+	}
+	addr, err := resolveRPCAddr(s.host, clientRPCAddr)
+	if err != nil {
+		return err
+	}
+	tlsConfig := s.tlsConfig
+	if clientCertDir != "" {
+		tlsConfig = s.clientTLSConfig
+	}
+	// Clients' clocks are not monitored, so the client RPC server has
+	// its own context.
+	rpcContext := rpc.NewContext(s.clock, tlsConfig)
+	rpcContext.ReusePort = *reusePort
+	s.clientRPC = rpc.NewServer(util.MakeRawAddr("tcp", addr), rpcContext)
+	return nil
+}
+
 // start runs the RPC and HTTP servers, starts the gossip instance (if
 // selfBootstrap is true, uses the rpc server's address as the gossip
 // bootstrap), and starts the node using the supplied engines slice.
@@ -375,21 +595,42 @@ func (s *server) start(engines []engine.Engine, attrs, httpAddr string, selfBoot
 	if err := s.node.start(s.rpc, s.clock, engines, nodeAttrs); err != nil {
 		return err
 	}
+	s.admin.schemas = structured.NewSchemaLeases(s.structuredDB, s.node.Descriptor.NodeID)
+	if s.clientRPC != nil {
+		if err := s.clientRPC.RegisterName("Node", s.node); err != nil {
+			return util.Errorf("unable to register node service with client RPC server: %s", err)
+		}
+		if err := s.clientRPC.Start(); err != nil {
+			return err
+		}
+		log.Infof("Started client RPC server at %s", s.clientRPC.Addr())
+	}
 
-	// TODO(spencer): add tls to the HTTP server.
 	s.initHTTP()
 	if strings.HasPrefix(httpAddr, ":") {
 		httpAddr = s.host + httpAddr
 	}
-	ln, err := net.Listen("tcp", httpAddr)
+	ln, err := util.Listen("tcp", httpAddr, *reusePort)
 	if err != nil {
 		return util.Errorf("could not listen on %s: %s", httpAddr, err)
 	}
+	if cfg := s.clientTLSConfig.Config(); cfg != nil {
+		ln = tls.NewListener(ln, cfg)
+	}
 	// Obtaining the http end point listener is difficult using
 	// http.ListenAndServe(), so we are storing it with the server.
 	s.httpListener = &ln
 	log.Infof("Starting HTTP server at %s", ln.Addr())
-	go http.Serve(ln, s)
+	s.httpServer = &http.Server{Handler: s}
+	go s.httpServer.Serve(ln)
+	s.admin.scheduler.start()
+	s.audit.start()
+	log.SetFileConfig(log.FileConfig{
+		MaxFileSize:  *logMaxFileSize,
+		MaxTotalSize: *logMaxTotalSize,
+		MaxAge:       *logMaxAge,
+	})
+	s.logGC = startLogGC()
 	return nil
 }
 
@@ -407,11 +648,45 @@ func (s *server) initHTTP() {
 	s.mux.Handle(structured.StructuredKeyPrefix, s.structuredREST)
 }
 
+// drain stops accepting connections and waits up to timeout for
+// in-flight HTTP requests to complete. Connections kept alive by HTTP
+// clients are closed after their next response, so that clients
+// reconnect to the process which has bound the addresses anew.
+// In-flight RPCs continue to be served until the server is stopped.
+func (s *server) drain(timeout time.Duration) {
+	s.httpServer.SetKeepAlivesEnabled(false)
+	(*s.httpListener).Close()
+	if s.clientRPC != nil {
+		s.clientRPC.Close()
+	}
+	s.rpc.Close()
+
+	deadline := time.Now().Add(timeout)
+	for s.activeRequests.Value() > 0 {
+		if time.Now().After(deadline) {
+			log.Warningf("%d HTTP request(s) still in flight after %s", s.activeRequests.Value(), timeout)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func (s *server) stop() {
+	s.admin.scheduler.stop()
+	if s.admin.schemas != nil {
+		s.admin.schemas.ReleaseAll()
+	}
 	s.node.stop()
 	s.gossip.Stop()
+	if s.clientRPC != nil {
+		s.clientRPC.Close()
+	}
 	s.rpc.Close()
 	s.kv.Close()
+	s.audit.stop()
+	if s.logGC != nil {
+		s.logGC.Stop()
+	}
 }
 
 type gzipResponseWriter struct {
@@ -444,7 +719,33 @@ func (w *gzipResponseWriter) Close() {
 
 // ServeHTTP is necessary to implement the http.Handler interface. It
 // will gzip a response if the appropriate request headers are set.
+// In-flight requests are counted so that they may be drained. If
+// -require_session is set, requests for endpoints requiring sessions
+// must first pass authorization. Audited requests are recorded in the
+// audit log.
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.activeRequests.Inc(1)
+	defer s.activeRequests.Inc(-1)
+	if s.audit != nil && auditHTTP(r.Method, r.URL.Path) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = rec
+		defer func() {
+			s.audit.record(auditEntry{
+				Time:      time.Now(),
+				Source:    r.RemoteAddr,
+				Auth:      httpAuth(r),
+				Operation: r.Method,
+				Target:    r.URL.Path,
+				Status:    rec.status,
+			})
+		}()
+	}
+	if *requireSession && sessionRequired(r.URL.Path) {
+		if err := s.admin.sessions.authorize(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
 	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 		s.mux.ServeHTTP(w, r)
 		return
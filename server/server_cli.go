@@ -27,13 +27,28 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strings"
 
 	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
-var addr = flag.String("addr", "127.0.0.1:8080", "address for connection to cockroach cluster")
+var (
+	addr   = flag.String("addr", "127.0.0.1:8080", "address for connection to cockroach cluster")
+	tenant = flag.Int64("tenant", 0, "if non-zero, the ID of the tenant to whose key "+
+		"space the key prefixes of accounting, permission and zone config commands are relative")
+)
+
+// configKeyPrefix returns the escaped key prefix of a config command,
+// qualified by the prefix of the tenant specified by -tenant, if any.
+func configKeyPrefix(prefix string) string {
+	if *tenant == 0 {
+		return prefix
+	}
+	return url.QueryEscape(string(proto.TenantPrefix(*tenant))) + prefix
+}
 
 // sendAdminRequest send an HTTP request and processes the response for
 // its body or error message if a non-200 response code.
@@ -74,7 +89,7 @@ func runGetConfig(prefix string, cmd *commander.Command, args []string) {
 		return
 	}
 	friendlyName := getFriendlyNameFromPrefix(prefix)
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s/%s", adminScheme, *addr, prefix, args[0]), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s/%s", adminScheme, *addr, prefix, configKeyPrefix(args[0])), nil)
 	if err != nil {
 		log.Errorf("unable to create request to admin REST endpoint: %s", err)
 		return
@@ -122,7 +137,13 @@ func runLsConfigs(prefix string, cmd *commander.Command, args []string) {
 			re = nil
 		}
 	}
+	tenantPrefix := configKeyPrefix("")
 	for _, prefix := range prefixes {
+		// With -tenant, only the tenant's configs are listed.
+		if !strings.HasPrefix(prefix, tenantPrefix) {
+			continue
+		}
+		prefix = prefix[len(tenantPrefix):]
 		if re != nil {
 			unescaped, err := url.QueryUnescape(prefix)
 			if err != nil || !re.MatchString(unescaped) {
@@ -144,7 +165,7 @@ func runRmConfig(prefix string, cmd *commander.Command, args []string) {
 		return
 	}
 	friendlyName := getFriendlyNameFromPrefix(prefix)
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s://%s%s/%s", adminScheme, *addr, prefix, args[0]), nil)
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s://%s%s/%s", adminScheme, *addr, prefix, configKeyPrefix(args[0])), nil)
 	if err != nil {
 		log.Errorf("unable to create request to admin REST endpoint: %s", err)
 		return
@@ -175,7 +196,7 @@ func runSetConfig(prefix string, cmd *commander.Command, args []string) {
 		return
 	}
 	// Send to admin REST API.
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s%s/%s", adminScheme, *addr, prefix, args[0]), bytes.NewReader(body))
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s%s/%s", adminScheme, *addr, prefix, configKeyPrefix(args[0])), bytes.NewReader(body))
 	if err != nil {
 		log.Errorf("unable to create request to admin REST endpoint: %s", err)
 		return
@@ -19,6 +19,7 @@ package server
 
 import (
 	"compress/gzip"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -26,12 +27,15 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/client"
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
@@ -237,6 +241,78 @@ func TestGzip(t *testing.T) {
 	}
 }
 
+// TestClientListeners verifies that client-facing HTTP traffic is
+// served with the client certs and that the client RPC server is
+// separate from the intra-cluster RPC server and does not serve
+// gossip.
+func TestClientListeners(t *testing.T) {
+	ts := &TestServer{
+		ClientRPCAddr: "127.0.0.1:0",
+		ClientCertDir: "../resources/test_certs",
+	}
+	if err := ts.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	if ts.ClientRPCAddr == ts.RPCAddr {
+		t.Fatalf("expected distinct client and intra-cluster RPC addresses; got %s", ts.RPCAddr)
+	}
+
+	httpClient := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := httpClient.Get("https://" + ts.HTTPAddr + "/_admin/healthz")
+	if err != nil {
+		t.Fatalf("error requesting healthz over TLS: %s", err)
+	}
+	resp.Body.Close()
+	if resp, err := http.Get("http://" + ts.HTTPAddr + "/_admin/healthz"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("expected healthz without TLS to fail")
+		}
+	}
+
+	tlsConfig, err := rpc.LoadTestTLSConfig("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := util.MakeRawAddr("tcp", ts.ClientRPCAddr)
+	c := rpc.NewClient(addr, nil, rpc.NewContext(ts.Clock(), tlsConfig))
+	select {
+	case <-c.Ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("unable to connect to client RPC server at %s", addr)
+	}
+	if err := c.Call("Gossip.Gossip", &proto.GetRequest{}, &proto.GetResponse{}); err == nil {
+		t.Errorf("expected client RPC server not to serve gossip")
+	}
+}
+
+// TestDrain verifies that a drained server no longer accepts HTTP
+// connections.
+func TestDrain(t *testing.T) {
+	ts := &TestServer{}
+	if err := ts.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	url := "http://" + ts.HTTPAddr + "/_admin/healthz"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error requesting healthz at %s: %s", url, err)
+	}
+	resp.Body.Close()
+
+	ts.drain(time.Second)
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected request to drained server to fail")
+	}
+}
+
 // TestMultiRangeScanDeleteRange tests that commands that commands which access
 // multiple ranges are carried out properly.
 func TestMultiRangeScanDeleteRange(t *testing.T) {
@@ -0,0 +1,292 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/structured"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/settings"
+)
+
+// sessionCookieName is the name of the cookie holding the signed
+// session ID.
+const sessionCookieName = "cockroach_session"
+
+// sessionTTL is the lifetime of a session from login.
+var sessionTTL = settings.RegisterDurationSetting("server.session.ttl",
+	"lifetime of HTTP sessions from login", 12*time.Hour).WithValidation(settings.PositiveDuration)
+
+// sessionRecord is the record of a session, stored under
+// engine.KeySessionPrefix so that sessions are valid on all nodes.
+type sessionRecord struct {
+	User    string
+	Created time.Time
+	Expires time.Time
+}
+
+// loginRequest is the body of a login request.
+type loginRequest struct {
+	Token string `json:"token"`
+}
+
+// A sessionManager issues, verifies and revokes sessions. Session
+// cookies hold a session ID signed with a secret shared by all nodes
+// via the database, so that forged IDs are rejected without a lookup.
+// Sessions are revoked by deleting their records.
+type sessionManager struct {
+	db *client.KV // Key-value database client
+
+	mu     sync.Mutex
+	secret []byte // Lazily loaded or created cluster-wide signing secret
+}
+
+// newSessionManager returns a sessionManager storing sessions via db.
+func newSessionManager(db *client.KV) *sessionManager {
+	return &sessionManager{db: db}
+}
+
+// getSecret returns the cluster-wide signing secret, creating it if
+// no node has yet done so.
+func (sm *sessionManager) getSecret() ([]byte, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.secret != nil {
+		return sm.secret, nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	err := sm.db.Call(proto.ConditionalPut, &proto.ConditionalPutRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  engine.KeySessionSecret,
+			User: storage.UserRoot,
+		},
+		Value: proto.Value{Bytes: secret},
+	}, &proto.ConditionalPutResponse{})
+	if err != nil {
+		// Another node may have created the secret first.
+		cErr, ok := err.(*proto.ConditionFailedError)
+		if !ok || cErr.ActualValue == nil {
+			return nil, util.Errorf("unable to create session secret: %s", err)
+		}
+		secret = cErr.ActualValue.Bytes
+	}
+	sm.secret = secret
+	return secret, nil
+}
+
+// sign returns the cookie value for the session with the given ID.
+func (sm *sessionManager) sign(id string) (string, error) {
+	secret, err := sm.getSecret()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify returns the session ID from the cookie value, or an error
+// if its signature is invalid.
+func (sm *sessionManager) verify(value string) (string, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", util.Errorf("malformed session cookie")
+	}
+	id := value[:i]
+	expected, err := sm.sign(id)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(value), []byte(expected)) {
+		return "", util.Errorf("invalid session cookie")
+	}
+	return id, nil
+}
+
+// create stores a new session for user and returns its cookie.
+func (sm *sessionManager) create(user string, now time.Time) (*http.Cookie, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+	record := &sessionRecord{
+		User:    user,
+		Created: now,
+		Expires: now.Add(sessionTTL.Get()),
+	}
+	value, err := sm.sign(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.db.PutI(engine.SessionKey(id), record); err != nil {
+		return nil, err
+	}
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  record.Expires,
+		HttpOnly: true,
+	}, nil
+}
+
+// lookup returns the session with the ID held by the cookie value,
+// or an error if the cookie is invalid or the session was revoked or
+// has expired.
+func (sm *sessionManager) lookup(value string, now time.Time) (*sessionRecord, error) {
+	id, err := sm.verify(value)
+	if err != nil {
+		return nil, err
+	}
+	record := &sessionRecord{}
+	ok, _, err := sm.db.GetI(engine.SessionKey(id), record)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, util.Errorf("session has been revoked")
+	}
+	if now.After(record.Expires) {
+		if err := sm.revoke(id); err != nil {
+			log.Warningf("unable to remove expired session: %s", err)
+		}
+		return nil, util.Errorf("session has expired")
+	}
+	return record, nil
+}
+
+// revoke deletes the record of the session with the given ID.
+func (sm *sessionManager) revoke(id string) error {
+	return sm.db.Call(proto.Delete, &proto.DeleteRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  engine.SessionKey(id),
+			User: storage.UserRoot,
+		},
+	}, &proto.DeleteResponse{})
+}
+
+// authorize returns an error if the request may not access endpoints
+// requiring a session. Requests presenting an Authorization header,
+// such as those of the CLI, are authorized as by authorizeDebug;
+// others must present the cookie of a valid session.
+func (sm *sessionManager) authorize(r *http.Request) error {
+	if r.Header.Get("Authorization") != "" {
+		return authorizeDebug(r, *adminToken)
+	}
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return util.Errorf("no session; log in at %s", loginPath)
+	}
+	_, err = sm.lookup(c.Value, time.Now())
+	return err
+}
+
+// sessionRequired returns whether requests for path must be
+// authorized by authorize when sessions are required: those for the
+// admin endpoints other than health checks and login, and those for
+// the key-value and status endpoints.
+func sessionRequired(path string) bool {
+	switch path {
+	case healthzPath, loginPath, logoutPath:
+		return false
+	}
+	for _, prefix := range []string{adminEndpoint, kv.RESTPrefix, kv.DBPrefix, structured.StructuredKeyPrefix, statusKeyPrefix} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleLogin creates a session for requests presenting the admin
+// token as JSON ({"token": "..."}) or, if no admin token is
+// configured, for requests from the loopback interface. The session
+// cookie is set in the response.
+func (sm *sessionManager) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "login requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req loginRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if *adminToken != "" {
+		if subtle.ConstantTimeCompare([]byte(req.Token), []byte(*adminToken)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+	} else if err := authorizeDebug(r, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	cookie, err := sm.create(storage.UserRoot, time.Now())
+	if err != nil {
+		log.Errorf("unable to create session: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cookie.Secure = r.TLS != nil
+	http.SetCookie(w, cookie)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleLogout revokes the session presented by the request, if any,
+// and clears its cookie.
+func (sm *sessionManager) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "logout requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		if id, err := sm.verify(c.Value); err == nil {
+			if err := sm.revoke(id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	w.WriteHeader(http.StatusOK)
+}
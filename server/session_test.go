@@ -0,0 +1,101 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestSessions verifies that endpoints requiring sessions may be
+// accessed only after logging in and until logging out, and that
+// forged and expired sessions are rejected.
+func TestSessions(t *testing.T) {
+	defer func(required bool) { *requireSession = required }(*requireSession)
+	*requireSession = true
+	s := StartTestServer(t)
+	defer s.Stop()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	base, err := url.Parse("http://" + s.HTTPAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus := func(method, path string, expected int) {
+		req, err := http.NewRequest(method, base.String()+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%s %s: expected status %d; got %d", method, path, expected, resp.StatusCode)
+		}
+	}
+	sessionCookie := func() string {
+		cookies := jar.Cookies(base)
+		if len(cookies) != 1 {
+			t.Fatalf("expected one session cookie; got %v", cookies)
+		}
+		return cookies[0].Value
+	}
+
+	expectStatus("GET", healthzPath, http.StatusOK)
+	expectStatus("GET", zonePathPrefix, http.StatusUnauthorized)
+	expectStatus("GET", statusDetailsKey, http.StatusUnauthorized)
+	expectStatus("POST", loginPath, http.StatusOK)
+	expectStatus("GET", zonePathPrefix, http.StatusOK)
+	expectStatus("GET", statusDetailsKey, http.StatusOK)
+
+	// A cookie with a forged signature is rejected.
+	value := sessionCookie()
+	id := value[:strings.LastIndex(value, ".")]
+	if _, err := s.admin.sessions.lookup(id+".00", time.Now()); err == nil {
+		t.Errorf("expected forged session cookie to be rejected")
+	}
+
+	// Expired sessions are rejected and removed.
+	if _, err := s.admin.sessions.lookup(value, time.Now().Add(2*sessionTTL.Get())); err == nil {
+		t.Errorf("expected expired session to be rejected")
+	}
+	if ok, _, err := s.admin.db.GetI(engine.SessionKey(id), &sessionRecord{}); ok || err != nil {
+		t.Errorf("expected expired session record to be removed; got %t, %v", ok, err)
+	}
+	expectStatus("GET", zonePathPrefix, http.StatusUnauthorized)
+
+	// Logging out revokes the session.
+	expectStatus("POST", loginPath, http.StatusOK)
+	expectStatus("GET", zonePathPrefix, http.StatusOK)
+	value = sessionCookie()
+	expectStatus("POST", logoutPath, http.StatusOK)
+	expectStatus("GET", zonePathPrefix, http.StatusUnauthorized)
+	if _, err := s.admin.sessions.lookup(value, time.Now()); err == nil {
+		t.Errorf("expected revoked session to be rejected")
+	}
+}
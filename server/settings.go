@@ -0,0 +1,142 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/settings"
+)
+
+// settingInfo describes a cluster setting in admin responses.
+type settingInfo struct {
+	Key         string `json:"key"`
+	Type        string `json:"type"`
+	Value       string `json:"value"`
+	Default     string `json:"default"`
+	Description string `json:"description"`
+}
+
+// A settingsHandler implements the actionHandler interface. Setting
+// values are stored under engine.KeySettingPrefix and distributed to
+// all nodes via gossip by the leader of the range holding them.
+type settingsHandler struct {
+	db *client.KV // Key-value database client
+}
+
+// Put validates and stores the value of the setting specified by
+// path. The value is the plain text body of the request.
+func (sh *settingsHandler) Put(path string, body []byte, r *http.Request) error {
+	if len(path) <= 1 {
+		return util.Errorf("no setting specified for settings Put")
+	}
+	value := strings.TrimSpace(string(body))
+	if err := settings.Validate(path[1:], value); err != nil {
+		return err
+	}
+	return sh.db.Call(proto.Put, &proto.PutRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  engine.MakeKey(engine.KeySettingPrefix, proto.Key(path[1:])),
+			User: storage.UserRoot,
+		},
+		Value: proto.Value{Bytes: []byte(value)},
+	}, &proto.PutResponse{})
+}
+
+// Get returns the setting specified by path, or all settings if path
+// is empty. Values are read from the database rather than from the
+// node's gossiped settings, so they reflect changes not yet gossiped.
+func (sh *settingsHandler) Get(path string, r *http.Request) (body []byte, contentType string, err error) {
+	sr := &proto.ScanResponse{}
+	if err = sh.db.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.KeySettingPrefix,
+			EndKey: engine.KeySettingPrefix.PrefixEnd(),
+			User:   storage.UserRoot,
+		},
+		MaxResults: maxGetResults,
+	}, sr); err != nil {
+		return
+	}
+	values := map[string]string{}
+	for _, kv := range sr.Rows {
+		values[string(bytes.TrimPrefix(kv.Key, engine.KeySettingPrefix))] = string(kv.Value.Bytes)
+	}
+	info := func(s settings.Setting) settingInfo {
+		si := settingInfo{
+			Key:         s.Key(),
+			Type:        s.Type(),
+			Value:       s.Default(),
+			Default:     s.Default(),
+			Description: s.Description(),
+		}
+		if v, ok := values[s.Key()]; ok {
+			si.Value = v
+		}
+		return si
+	}
+	if len(path) > 1 {
+		s, ok := settings.Lookup(path[1:])
+		if !ok {
+			err = util.Errorf("unknown setting %q", path[1:])
+			return
+		}
+		return util.MarshalResponse(r, info(s), util.AllEncodings)
+	}
+	infos := []settingInfo{}
+	for _, key := range settings.Keys() {
+		s, _ := settings.Lookup(key)
+		infos = append(infos, info(s))
+	}
+	return util.MarshalResponse(r, infos, util.AllEncodings)
+}
+
+// Delete resets the setting specified by path to its default.
+func (sh *settingsHandler) Delete(path string, r *http.Request) error {
+	if len(path) <= 1 {
+		return util.Errorf("no setting specified for settings Delete")
+	}
+	if _, ok := settings.Lookup(path[1:]); !ok {
+		return util.Errorf("unknown setting %q", path[1:])
+	}
+	return sh.db.Call(proto.Delete, &proto.DeleteRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  engine.MakeKey(engine.KeySettingPrefix, proto.Key(path[1:])),
+			User: storage.UserRoot,
+		},
+	}, &proto.DeleteResponse{})
+}
+
+// handleSettingsAction handles actions for cluster settings by method.
+func (s *adminServer) handleSettingsAction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.handleGetAction(s.settings, w, r, settingsPathPrefix)
+	case "PUT", "POST":
+		s.handlePutAction(s.settings, w, r, settingsPathPrefix)
+	case "DELETE":
+		s.handleDeleteAction(s.settings, w, r, settingsPathPrefix)
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	}
+}
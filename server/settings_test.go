@@ -0,0 +1,90 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func sendSettingsRequest(method, url, value string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	return sendAdminRequest(req)
+}
+
+// TestAdminSettings verifies changing, validating and resetting
+// cluster settings via the admin REST API.
+func TestAdminSettings(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+	url := s.URL + settingsPathPrefix + "/storage.scan_queue.max_size"
+
+	getSetting := func() settingInfo {
+		body, err := getText(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var si settingInfo
+		if err := json.Unmarshal(body, &si); err != nil {
+			t.Fatal(err)
+		}
+		return si
+	}
+	if si := getSetting(); si.Value != "100" || si.Default != "100" || si.Type != "integer" {
+		t.Errorf("unexpected default setting %+v", si)
+	}
+	if _, err := sendSettingsRequest("PUT", url, "50\n"); err != nil {
+		t.Fatal(err)
+	}
+	if si := getSetting(); si.Value != "50" {
+		t.Errorf("expected value 50; got %+v", si)
+	}
+	for _, value := range []string{"0", "-1", "many"} {
+		if _, err := sendSettingsRequest("PUT", url, value); err == nil {
+			t.Errorf("%q: expected validation error", value)
+		}
+	}
+	if _, err := sendSettingsRequest("PUT", s.URL+settingsPathPrefix+"/unknown", "1"); err == nil {
+		t.Error("expected error setting unknown setting")
+	}
+	if _, err := sendSettingsRequest("DELETE", url, ""); err != nil {
+		t.Fatal(err)
+	}
+	if si := getSetting(); si.Value != "100" {
+		t.Errorf("expected value reset to default; got %+v", si)
+	}
+
+	body, err := getText(s.URL + settingsPathPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infos []settingInfo
+	if err := json.Unmarshal(body, &infos); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, si := range infos {
+		found = found || si.Key == "raft.command_compression.threshold"
+	}
+	if !found {
+		t.Errorf("expected raft compression threshold in settings; got %+v", infos)
+	}
+}
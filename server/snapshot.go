@@ -0,0 +1,147 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// snapshotConnectTimeout bounds the wait for a connection to the node
+// of a snapshot's delegate or recipient.
+const snapshotConnectTimeout = 10 * time.Second
+
+// snapshotService serves the "Snapshot" RPC service, through which
+// range leaders on other nodes request and deliver snapshots of
+// ranges held by the node's stores. It is registered on the node's
+// RPC server only, never on the client RPC server.
+type snapshotService struct {
+	stores *kv.LocalSender
+}
+
+// Request sends a snapshot of the delegate store's replica of a range
+// to the recipient.
+func (ss *snapshotService) Request(args *proto.RequestSnapshotRequest, reply *proto.RequestSnapshotResponse) error {
+	s, err := ss.stores.GetStore(args.Delegate.StoreID)
+	if err != nil {
+		return err
+	}
+	return s.SnapshotReplica(&args.Desc, args.Recipient)
+}
+
+// Apply initializes the recipient store's replica of a range from the
+// delivered snapshot.
+func (ss *snapshotService) Apply(args *proto.ApplySnapshotRequest, reply *proto.ApplySnapshotResponse) error {
+	s, err := ss.stores.GetStore(args.Recipient.StoreID)
+	if err != nil {
+		return err
+	}
+	return s.ApplySnapshot(&args.Snapshot)
+}
+
+// Seed seeds the recipient store's replica of a range from a backup of
+// the source store's replica.
+func (ss *snapshotService) Seed(args *proto.SeedReplicaRequest, reply *proto.SeedReplicaResponse) error {
+	s, err := ss.stores.GetStore(args.Recipient.StoreID)
+	if err != nil {
+		return err
+	}
+	reply.LeaseAppliedIndex, err = s.SeedReplica(&args.Desc, args.SourceStoreID)
+	return err
+}
+
+// CatchUp catches up the recipient store's seeded replica of a range
+// and starts it.
+func (ss *snapshotService) CatchUp(args *proto.CatchUpReplicaRequest, reply *proto.CatchUpReplicaResponse) error {
+	s, err := ss.stores.GetStore(args.Recipient.StoreID)
+	if err != nil {
+		return err
+	}
+	return s.CatchUpReplica(&args.CatchUp)
+}
+
+// snapshotTransport implements storage.SnapshotTransport by calling
+// the snapshot service of the node of each delegate or recipient, at
+// the node's gossiped address.
+type snapshotTransport struct {
+	gossip *gossip.Gossip
+}
+
+// RequestSnapshot implements storage.SnapshotTransport.
+func (st *snapshotTransport) RequestSnapshot(delegate, recipient proto.Replica, desc *proto.RangeDescriptor) error {
+	return st.call(delegate.NodeID, "Snapshot.Request", &proto.RequestSnapshotRequest{
+		Delegate:  delegate,
+		Recipient: recipient,
+		Desc:      *desc,
+	}, &proto.RequestSnapshotResponse{})
+}
+
+// SendSnapshot implements storage.SnapshotTransport.
+func (st *snapshotTransport) SendSnapshot(recipient proto.Replica, snap *proto.RangeBackup) error {
+	return st.call(recipient.NodeID, "Snapshot.Apply", &proto.ApplySnapshotRequest{
+		Recipient: recipient,
+		Snapshot:  *snap,
+	}, &proto.ApplySnapshotResponse{})
+}
+
+// SeedReplica implements storage.SnapshotTransport.
+func (st *snapshotTransport) SeedReplica(recipient proto.Replica, source int32, desc *proto.RangeDescriptor) (uint64, error) {
+	reply := &proto.SeedReplicaResponse{}
+	if err := st.call(recipient.NodeID, "Snapshot.Seed", &proto.SeedReplicaRequest{
+		Recipient:     recipient,
+		SourceStoreID: source,
+		Desc:          *desc,
+	}, reply); err != nil {
+		return 0, err
+	}
+	return reply.LeaseAppliedIndex, nil
+}
+
+// CatchUpReplica implements storage.SnapshotTransport.
+func (st *snapshotTransport) CatchUpReplica(recipient proto.Replica, catchUp *proto.RangeCatchUp) error {
+	return st.call(recipient.NodeID, "Snapshot.CatchUp", &proto.CatchUpReplicaRequest{
+		Recipient: recipient,
+		CatchUp:   *catchUp,
+	}, &proto.CatchUpReplicaResponse{})
+}
+
+// call invokes method of the snapshot service of the node with ID
+// nodeID.
+func (st *snapshotTransport) call(nodeID int32, method string, args, reply interface{}) error {
+	info, err := st.gossip.GetInfo(gossip.MakeNodeIDGossipKey(nodeID))
+	if err != nil {
+		return util.Errorf("unable to look up address of node %d: %s", nodeID, err)
+	}
+	addr, ok := info.(net.Addr)
+	if !ok {
+		return util.Errorf("unexpected address %v of node %d", info, nodeID)
+	}
+	c := rpc.NewClient(addr, nil, st.gossip.RPCContext)
+	select {
+	case <-c.Ready:
+	case <-c.Closed:
+		return util.Errorf("connection to node %d at %s closed", nodeID, addr)
+	case <-time.After(snapshotConnectTimeout):
+		return util.Errorf("timed out connecting to node %d at %s", nodeID, addr)
+	}
+	return c.Call(method, args, reply)
+}
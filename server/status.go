@@ -19,13 +19,26 @@ package server
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"net/http"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/cockroachdb/cockroach/client"
 	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/server/status"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/cloud"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
+	"github.com/cockroachdb/cockroach/util/settings"
 )
 
 const (
@@ -35,9 +48,34 @@ const (
 	// statusKeyPrefix is the root of the RESTful cluster statistics and metrics API.
 	statusKeyPrefix = "/_status/"
 
+	// statusDetailsKey exposes the build information, flags, cluster
+	// setting overrides, stores and Go runtime statistics of the node
+	// serving the request, for gathering into support bundles.
+	statusDetailsKey = statusKeyPrefix + "details"
+
 	// statusGossipKeyPrefix exposes a view of the gossip network.
 	statusGossipKeyPrefix = statusKeyPrefix + "gossip"
 
+	// statusHotRangesKey exposes the ranges with the highest request
+	// rates on each of the node's stores.
+	statusHotRangesKey = statusKeyPrefix + "hotranges"
+
+	// statusGCScoresKey exposes the ranges of each of the node's stores
+	// with the highest GC scores, along with the inputs of the scores.
+	statusGCScoresKey = statusKeyPrefix + "gcscores"
+
+	// defaultHotRanges is the number of hot ranges returned per store
+	// if not specified by the "n" query parameter.
+	defaultHotRanges = 10
+
+	// statusKeyUsageKey exposes the disk usage of the ranges led by the
+	// node's stores, aggregated by top-level key prefix.
+	statusKeyUsageKey = statusKeyPrefix + "keyusage"
+
+	// statusLatencyKey exposes the matrix of round-trip times between
+	// all pairs of nodes, as measured by RPC heartbeats.
+	statusLatencyKey = statusKeyPrefix + "latency"
+
 	// statusLocalKeyPrefix exposes the status of the node serving the request.
 	// This is equivalent to GETing statusNodesKeyPrefix/<current-node-id>.
 	// Useful for debugging nodes that aren't communicating with the cluster properly.
@@ -46,6 +84,22 @@ const (
 	// statusLocalStacksKey exposes stack traces of running goroutines.
 	statusLocalStacksKey = statusLocalKeyPrefix + "stacks"
 
+	// statusLocalGoroutinesKey exposes stack traces of running
+	// goroutines, grouped by the subsystem they belong to.
+	statusLocalGoroutinesKey = statusLocalKeyPrefix + "goroutines"
+
+	// statusLocalLogsKeyPrefix lists the node's log files, and serves
+	// each at <prefix><file-name>.
+	statusLocalLogsKeyPrefix = statusLocalKeyPrefix + "logs/"
+
+	// statusLocalReadCacheKey exposes the hit rate of the read cache
+	// of the node's KV endpoints.
+	statusLocalReadCacheKey = statusLocalKeyPrefix + "readcache"
+
+	// statusMetricsKey exposes the metrics of the node serving the
+	// request in the Prometheus text format.
+	statusMetricsKey = statusKeyPrefix + "metrics"
+
 	// statusNodesKeyPrefix exposes status for each of the nodes the cluster.
 	// GETing statusNodesKeyPrefix will list all nodes.
 	// Individual node status can be queried at statusNodesKeyPrefix/NodeID.
@@ -54,21 +108,28 @@ const (
 	// statusStoresKeyPrefix exposes status for each store.
 	statusStoresKeyPrefix = statusKeyPrefix + "stores/"
 
-	// statusTransactionsKeyPrefix exposes transaction statistics.
-	statusTransactionsKeyPrefix = statusKeyPrefix + "txns/"
+	// statusTransactionsKey exposes the open transactions coordinated
+	// by the node serving the request, oldest first.
+	statusTransactionsKey = statusKeyPrefix + "transactions"
 )
 
 // A statusServer provides a RESTful status API.
 type statusServer struct {
 	db     *client.KV
 	gossip *gossip.Gossip
+	stores *kv.LocalSender // Node-local stores
+
+	readCache *kv.ReadCacheSender // Nil if reads are not cached
+	latency   *latencyMonitor     // Nil if latencies are not monitored
+	txns      *kv.TxnCoordSender  // Nil if not coordinating transactions
 }
 
 // newStatusServer allocates and returns a statusServer.
-func newStatusServer(db *client.KV, gossip *gossip.Gossip) *statusServer {
+func newStatusServer(db *client.KV, gossip *gossip.Gossip, stores *kv.LocalSender) *statusServer {
 	return &statusServer{
 		db:     db,
 		gossip: gossip,
+		stores: stores,
 	}
 }
 
@@ -76,12 +137,21 @@ func newStatusServer(db *client.KV, gossip *gossip.Gossip) *statusServer {
 // serve mux.
 func (s *statusServer) RegisterHandlers(mux *http.ServeMux) {
 	mux.HandleFunc(statusKeyPrefix, s.handleStatus)
+	mux.HandleFunc(statusDetailsKey, s.handleDetails)
 	mux.HandleFunc(statusGossipKeyPrefix, s.handleGossipStatus)
+	mux.HandleFunc(statusHotRangesKey, s.handleHotRanges)
+	mux.HandleFunc(statusGCScoresKey, s.handleGCScores)
+	mux.HandleFunc(statusKeyUsageKey, s.handleKeyUsage)
+	mux.HandleFunc(statusLatencyKey, s.handleLatency)
 	mux.HandleFunc(statusLocalKeyPrefix, s.handleLocalStatus)
 	mux.HandleFunc(statusLocalStacksKey, s.handleLocalStacks)
+	mux.HandleFunc(statusLocalGoroutinesKey, s.handleLocalGoroutines)
+	mux.HandleFunc(statusLocalLogsKeyPrefix, s.handleLocalLogs)
+	mux.HandleFunc(statusLocalReadCacheKey, s.handleLocalReadCache)
+	mux.HandleFunc(statusMetricsKey, s.handleMetrics)
 	mux.HandleFunc(statusNodesKeyPrefix, s.handleNodeStatus)
 	mux.HandleFunc(statusStoresKeyPrefix, s.handleStoresStatus)
-	mux.HandleFunc(statusTransactionsKeyPrefix, s.handleTransactionStatus)
+	mux.HandleFunc(statusTransactionsKey, s.handleTransactionStatus)
 }
 
 // TODO(shawn) lots of implementing - setting up a skeleton for hack week.
@@ -101,6 +171,114 @@ func (s *statusServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// redactedFlags lists flags whose values are secret and are not
+// exposed by the details endpoint.
+var redactedFlags = map[string]struct{}{
+	"admin_token": {},
+}
+
+// redactedURIFlags lists flags whose values are URIs which may carry
+// credentials in their user information or query parameters. These
+// are removed from the values exposed by the details endpoint.
+var redactedURIFlags = map[string]struct{}{
+	"audit_log_uri":         {},
+	"crash_report_url":      {},
+	"relocation_backup_uri": {},
+}
+
+// storeDetails describes one of a node's stores.
+type storeDetails struct {
+	StoreID  int32
+	Engine   string // Engine attributes and data directory or size
+	Capacity engine.StoreCapacity
+}
+
+// runtimeDetails holds Go runtime statistics.
+type runtimeDetails struct {
+	NumCPU       int
+	GOMAXPROCS   int
+	NumGoroutine int
+	NumCgoCall   int64
+	HeapAlloc    uint64 // Bytes of allocated heap objects
+	HeapObjects  uint64
+	Sys          uint64 // Bytes obtained from the OS
+	NumGC        uint32
+	PauseTotalNs uint64
+}
+
+// nodeDetails describes the environment of a node.
+type nodeDetails struct {
+	Build    util.BuildInfo
+	Flags    map[string]string
+	Settings map[string]string // Cluster settings differing from their defaults
+	Stores   []storeDetails
+	Runtime  runtimeDetails
+}
+
+// handleDetails handles GET requests for the details of the node's
+// environment. The values of secret flags are redacted, as are the
+// credentials of URI flags. Requests must pass authorizeDebug, as the
+// details expose the node's configuration.
+func (s *statusServer) handleDetails(w http.ResponseWriter, r *http.Request) {
+	if err := authorizeDebug(r, *adminToken); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	details := nodeDetails{
+		Build:    util.GetBuildInfo(),
+		Flags:    map[string]string{},
+		Settings: settings.Overrides(),
+		Stores:   []storeDetails{},
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if _, ok := redactedFlags[f.Name]; ok && value != "" {
+			value = "<redacted>"
+		}
+		if _, ok := redactedURIFlags[f.Name]; ok && value != "" {
+			value = cloud.RedactURI(value)
+		}
+		details.Flags[f.Name] = value
+	})
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		capacity, err := store.Capacity()
+		if err != nil {
+			return err
+		}
+		details.Stores = append(details.Stores, storeDetails{
+			StoreID:  store.StoreID(),
+			Engine:   fmt.Sprint(store.Engine()),
+			Capacity: capacity,
+		})
+		return nil
+	}); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	details.Runtime = runtimeDetails{
+		NumCPU:       runtime.NumCPU(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumGoroutine: runtime.NumGoroutine(),
+		NumCgoCall:   runtime.NumCgoCall(),
+		HeapAlloc:    ms.HeapAlloc,
+		HeapObjects:  ms.HeapObjects,
+		Sys:          ms.Sys,
+		NumGC:        ms.NumGC,
+		PauseTotalNs: ms.PauseTotalNs,
+	}
+	b, err := json.Marshal(details)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
 // handleGossipStatus handles GET requests for gossip network status.
 func (s *statusServer) handleGossipStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -112,6 +290,135 @@ func (s *statusServer) handleGossipStatus(w http.ResponseWriter, r *http.Request
 	w.Write(b)
 }
 
+// storeHotRanges lists the hottest ranges of a store.
+type storeHotRanges struct {
+	StoreID   int32
+	HotRanges []storage.HotRange
+}
+
+// handleHotRanges handles GET requests for the hottest ranges on each
+// of the node's stores, as measured by decaying requests per second.
+// The number of ranges per store may be specified with the "n" query
+// parameter.
+func (s *statusServer) handleHotRanges(w http.ResponseWriter, r *http.Request) {
+	n := defaultHotRanges
+	if nStr := r.URL.Query().Get("n"); nStr != "" {
+		var err error
+		if n, err = strconv.Atoi(nStr); err != nil {
+			http.Error(w, fmt.Sprintf("invalid n %q: %s", nStr, err), http.StatusBadRequest)
+			return
+		}
+	}
+	result := []storeHotRanges{}
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		result = append(result, storeHotRanges{
+			StoreID:   store.StoreID(),
+			HotRanges: store.HotRanges(n),
+		})
+		return nil
+	}); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// storeGCScores lists the ranges of a store with the highest GC
+// scores.
+type storeGCScores struct {
+	StoreID  int32
+	GCScores []storage.RangeGCScore
+}
+
+// handleGCScores handles GET requests for the ranges on each of the
+// node's stores which the scan queue scores highest for garbage
+// collection, with the inputs of their scores. The number of ranges
+// per store may be specified with the "n" query parameter.
+func (s *statusServer) handleGCScores(w http.ResponseWriter, r *http.Request) {
+	n := defaultHotRanges
+	if nStr := r.URL.Query().Get("n"); nStr != "" {
+		var err error
+		if n, err = strconv.Atoi(nStr); err != nil {
+			http.Error(w, fmt.Sprintf("invalid n %q: %s", nStr, err), http.StatusBadRequest)
+			return
+		}
+	}
+	result := []storeGCScores{}
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		scores, err := store.GCScores(n)
+		if err != nil {
+			return err
+		}
+		result = append(result, storeGCScores{StoreID: store.StoreID(), GCScores: scores})
+		return nil
+	}); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleKeyUsage handles GET requests for the live and total bytes
+// and range counts of the ranges led by the node's stores, aggregated
+// by top-level key prefix. Summing the usage of all nodes yields that
+// of the cluster.
+func (s *statusServer) handleKeyUsage(w http.ResponseWriter, r *http.Request) {
+	result := &storage.KeyUsage{Prefixes: []storage.PrefixUsage{}}
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		ku, err := store.KeyUsage()
+		if err != nil {
+			return err
+		}
+		result.Add(ku)
+		return nil
+	}); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleLatency handles GET requests for the matrix of round-trip
+// times between nodes.
+func (s *statusServer) handleLatency(w http.ResponseWriter, r *http.Request) {
+	m := latencyMatrix{NodeIDs: []int32{}, RTTNanos: [][]int64{}}
+	if s.latency != nil {
+		m = s.latency.matrix()
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
 // handleLocalStatus handles GET requests for local-node status.
 func (s *statusServer) handleLocalStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -137,6 +444,113 @@ func (s *statusServer) handleLocalStacks(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// handleLocalGoroutines handles GET requests for goroutine stack
+// traces grouped by subsystem (e.g. gossip, raft, scanner), to help
+// diagnose hangs on shutdown and stalled queues. Goroutines which
+// were not started with util.RunLabeled are grouped as unlabeled.
+// Requests must pass authorizeDebug, as stacks may hold keys and
+// values.
+func (s *statusServer) handleLocalGoroutines(w http.ResponseWriter, r *http.Request) {
+	if err := authorizeDebug(r, *adminToken); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	groups, err := util.GoroutinesBySubsystem()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for _, g := range groups {
+		fmt.Fprintf(w, "=== %s: %d goroutines\n\n", g.Subsystem, g.Count)
+		for _, stack := range g.Stacks {
+			fmt.Fprintf(w, "%s\n\n", stack)
+		}
+	}
+}
+
+// logFiles returns the directory holding the node's log files and
+// their names, sorted. Log files are those written by glog to its
+// -log_dir, which are named after the program.
+func logFiles() (string, []string, error) {
+	files, err := log.ListFiles()
+	if err != nil {
+		return "", nil, err
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return log.Dir(), names, nil
+}
+
+// handleLocalLogs handles GET requests listing the node's log files
+// or, if a file name is specified, returning the file's contents.
+// Requests must pass authorizeDebug, as logs may hold keys and values.
+func (s *statusServer) handleLocalLogs(w http.ResponseWriter, r *http.Request) {
+	if err := authorizeDebug(r, *adminToken); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	dir, names, err := logFiles()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, statusLocalLogsKeyPrefix)
+	if name == "" {
+		if names == nil {
+			names = []string{}
+		}
+		b, err := json.Marshal(names)
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+	// Only listed files are served, so that the path can't escape the
+	// log directory.
+	if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+		http.Error(w, fmt.Sprintf("no log file %q", name), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	http.ServeFile(w, r, filepath.Join(dir, name))
+}
+
+// handleLocalReadCache returns the statistics of the node's read
+// cache, or an empty object if reads are not cached.
+func (s *statusServer) handleLocalReadCache(w http.ResponseWriter, r *http.Request) {
+	var stats interface{} = struct{}{}
+	if s.readCache != nil {
+		stats = s.readCache.Stats()
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleMetrics handles GET requests for the node's metrics, as
+// registered with the default metrics registry, for scraping by
+// Prometheus.
+func (s *statusServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.PrometheusContentType)
+	if err := metrics.DefaultRegistry.WritePrometheus(w); err != nil {
+		log.Error(err)
+	}
+}
+
 // handleNodeStatus handles GET requests for node status.
 func (s *statusServer) handleNodeStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -161,9 +575,23 @@ func (s *statusServer) handleStoresStatus(w http.ResponseWriter, r *http.Request
 	w.Write([]byte(`{"stores": []}`))
 }
 
-// handleTransactionStatus handles GET requests for transaction status.
+// handleTransactionStatus handles GET requests for the open
+// transactions coordinated by the node, with their age, retries,
+// priority and the key ranges they've written. Transactions may be
+// canceled via the admin API.
 func (s *statusServer) handleTransactionStatus(w http.ResponseWriter, r *http.Request) {
+	result := struct {
+		Transactions []kv.TxnInfo `json:"transactions"`
+	}{[]kv.TxnInfo{}}
+	if s.txns != nil {
+		result.Transactions = s.txns.Transactions()
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-
-	w.Write([]byte(`{"transactions": []}`))
+	w.Write(b)
 }
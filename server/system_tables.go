@@ -0,0 +1,204 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+const (
+	// defaultSystemTableLimit is the number of rows returned per page
+	// if no limit is specified.
+	defaultSystemTableLimit = 100
+	// maxSystemTableLimit caps the number of rows returned per page.
+	maxSystemTableLimit = 1000
+)
+
+// A systemTable is a well-known span of the system keyspace, the
+// values of which are all protos of the same type.
+type systemTable struct {
+	start, end proto.Key
+	newValue   func() gogoproto.Message
+}
+
+// systemTables maps the names of browsable system tables to their
+// key spans.
+var systemTables = map[string]systemTable{
+	"accounting": {
+		start:    engine.KeyConfigAccountingPrefix,
+		end:      engine.KeyConfigAccountingPrefix.PrefixEnd(),
+		newValue: func() gogoproto.Message { return &proto.AcctConfig{} },
+	},
+	"backup-schedules": {
+		start:    engine.KeyBackupSchedulePrefix,
+		end:      engine.KeyBackupSchedulePrefix.PrefixEnd(),
+		newValue: func() gogoproto.Message { return &proto.BackupSchedule{} },
+	},
+	"descriptors": {
+		start:    engine.KeyMetaPrefix,
+		end:      engine.KeyMetaMax,
+		newValue: func() gogoproto.Message { return &proto.RangeDescriptor{} },
+	},
+	"groups": {
+		start:    engine.KeyGroupPrefix,
+		end:      engine.KeyGroupPrefix.PrefixEnd(),
+		newValue: func() gogoproto.Message { return &proto.GroupConfig{} },
+	},
+	"jobs": {
+		start:    engine.KeyJobPrefix,
+		end:      engine.KeyJobPrefix.PrefixEnd(),
+		newValue: func() gogoproto.Message { return &proto.Job{} },
+	},
+	"permissions": {
+		start:    engine.KeyConfigPermissionPrefix,
+		end:      engine.KeyConfigPermissionPrefix.PrefixEnd(),
+		newValue: func() gogoproto.Message { return &proto.PermConfig{} },
+	},
+	"zones": {
+		start:    engine.KeyConfigZonePrefix,
+		end:      engine.KeyConfigZonePrefix.PrefixEnd(),
+		newValue: func() gogoproto.Message { return &proto.ZoneConfig{} },
+	},
+}
+
+// A systemTableRow is a single decoded key/value pair. Keys are query
+// escaped. If the value fails to decode, Error is set instead.
+type systemTableRow struct {
+	Key   string            `json:"key"`
+	Value gogoproto.Message `json:"value,omitempty"`
+	Error string            `json:"error,omitempty"`
+
+	wallTime int64 // Wall time of the write, for incremental backups
+}
+
+// A systemTablePage is a page of rows from a system table. If more
+// rows remain, NextKey is set to the query-escaped key from which to
+// continue via the "start" parameter.
+type systemTablePage struct {
+	Table   string           `json:"table"`
+	Rows    []systemTableRow `json:"rows"`
+	NextKey string           `json:"next_key,omitempty"`
+	next    proto.Key        // Unescaped NextKey
+}
+
+// handleSystemTables lists the browsable system tables on GET of
+// <prefix> and pages through a table on GET of <prefix>/<table>.
+// The "start" parameter specifies the key from which to resume and
+// "limit" the maximum number of rows to return. Requests must pass
+// authorizeDebug, as system tables expose the cluster configuration.
+func (s *adminServer) handleSystemTables(w http.ResponseWriter, r *http.Request) {
+	if err := authorizeDebug(r, *adminToken); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, systemPathPrefix), "/")
+	if name == "" {
+		var names []string
+		for name := range systemTables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		result = names
+	} else {
+		table, ok := systemTables[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown system table %q", name), http.StatusNotFound)
+			return
+		}
+		limit := defaultSystemTableLimit
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", l), http.StatusBadRequest)
+				return
+			}
+			if limit > maxSystemTableLimit {
+				limit = maxSystemTableLimit
+			}
+		}
+		page, err := s.scanSystemTable(name, table, proto.Key(r.URL.Query().Get("start")), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = page
+	}
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// scanSystemTable returns up to limit decoded rows of the table,
+// beginning at start (or the start of the table, if start precedes
+// it).
+func (s *adminServer) scanSystemTable(name string, table systemTable, start proto.Key, limit int) (*systemTablePage, error) {
+	if start.Less(table.start) {
+		start = table.start
+	}
+	page := &systemTablePage{Table: name, Rows: []systemTableRow{}}
+	if !start.Less(table.end) {
+		return page, nil
+	}
+	sr := &proto.ScanResponse{}
+	if err := s.db.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    start,
+			EndKey: table.end,
+			User:   storage.UserRoot,
+		},
+		MaxResults: int64(limit),
+	}, sr); err != nil {
+		return nil, err
+	}
+	for _, kv := range sr.Rows {
+		row := systemTableRow{Key: url.QueryEscape(string(kv.Key))}
+		if kv.Value.Timestamp != nil {
+			row.wallTime = kv.Value.Timestamp.WallTime
+		}
+		value := table.newValue()
+		if err := gogoproto.Unmarshal(kv.Value.Bytes, value); err != nil {
+			row.Error = fmt.Sprintf("unable to decode value: %s", err)
+		} else {
+			row.Value = value
+		}
+		page.Rows = append(page.Rows, row)
+	}
+	if len(sr.Rows) == limit {
+		page.next = sr.Rows[len(sr.Rows)-1].Key.Next()
+		page.NextKey = url.QueryEscape(string(page.next))
+	}
+	return page, nil
+}
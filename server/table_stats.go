@@ -0,0 +1,154 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/structured"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+const (
+	// tableStatsJobType is the job type of table stats collection.
+	tableStatsJobType = "table_stats"
+	// defaultTableStatsInterval is the interval over which each
+	// collection of table stats is spread if the job doesn't specify
+	// one.
+	defaultTableStatsInterval = 1 * time.Hour
+)
+
+// runTableStats runs a table stats job, which repeatedly collects the
+// stats of the tables of all structured schemas until paused or
+// canceled. Like the range scanner, each collection is paced to
+// complete in approximately the job's interval: after each top-level
+// table, the job waits for its share of the remaining interval.
+func (s *adminServer) runTableStats(jc *jobContext) error {
+	details := &proto.TableStatsDetails{}
+	if err := gogoproto.Unmarshal(jc.Job().Details, details); err != nil {
+		return util.Errorf("unable to decode table stats details: %s", err)
+	}
+	interval := time.Duration(details.IntervalNanos)
+	if interval <= 0 {
+		interval = defaultTableStatsInterval
+	}
+	for {
+		start := time.Now()
+		if err := structured.CollectStats(s.db, func(done, total int) error {
+			if err := jc.Progress(float64(done)/float64(total), nil); err != nil {
+				return err
+			}
+			if remaining := interval - time.Since(start); remaining > 0 && done < total {
+				time.Sleep(remaining / time.Duration(total-done))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		// Wait out the rest of the interval before the next collection.
+		if err := jc.Progress(1, nil); err != nil {
+			return err
+		}
+		if remaining := interval - time.Since(start); remaining > 0 {
+			time.Sleep(remaining)
+		}
+	}
+}
+
+// A tableStatsRequest is the body of a request to create a table
+// stats job. The interval is a duration such as "30m".
+type tableStatsRequest struct {
+	Interval string `json:"interval,omitempty"`
+}
+
+// handleTableStatsAction creates a table stats job on POST of a
+// tableStatsRequest, responding with the job's record, and responds
+// to GET of <prefix>/<schema-key>/<table> with the table's most
+// recently collected stats.
+func (s *adminServer) handleTableStatsAction(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	switch r.Method {
+	case "GET":
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, tableStatsPathPrefix), "/"), "/")
+		if len(parts) != 2 {
+			http.Error(w, "expected path "+tableStatsPathPrefix+"/<schema-key>/<table>", http.StatusBadRequest)
+			return
+		}
+		stats, err := structured.GetTableStats(s.db, parts[0], parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if stats == nil {
+			http.Error(w, fmt.Sprintf("no stats collected for table %q of schema %q", parts[1], parts[0]), http.StatusNotFound)
+			return
+		}
+		result = stats
+	case "POST":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+		req := &tableStatsRequest{}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid table stats request: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		job, err := s.createTableStats(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = job
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// createTableStats validates req and creates a table stats job.
+func (s *adminServer) createTableStats(req *tableStatsRequest) (*proto.Job, error) {
+	details := &proto.TableStatsDetails{}
+	if req.Interval != "" {
+		d, err := time.ParseDuration(req.Interval)
+		if err != nil || d <= 0 {
+			return nil, util.Errorf("invalid interval %q", req.Interval)
+		}
+		details.IntervalNanos = d.Nanoseconds()
+	}
+	b, err := gogoproto.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	return s.jobs.Create(tableStatsJobType, "collect table stats", b)
+}
@@ -34,15 +34,13 @@ const (
 )
 
 // A TestServer encapsulates an in-memory instantiation of a cockroach
-// node with a single store. Example usage of a TestServer follows:
+// node. Example usage of a TestServer follows:
 //
 //   s := &server.TestServer{}
 //   if err := s.Start(); err != nil {
 //     t.Fatal(err)
 //   }
 //   defer s.Stop()
-//
-// TODO(spencer): add support for multiple stores.
 type TestServer struct {
 	// CertDir specifies the directory containing certs for SSL
 	// connections. Default will load insecure TLS config.
@@ -54,6 +52,15 @@ type TestServer struct {
 	// HTTPAddr and RPCAddr default to localhost with port set
 	// at time of call to Start() to an available port.
 	HTTPAddr, RPCAddr string
+	// ClientRPCAddr, if set, is the address of a separate RPC server
+	// for client traffic, updated at time of call to Start() like
+	// RPCAddr. ClientCertDir, if set, specifies the directory
+	// containing certs for the client-facing listeners.
+	ClientRPCAddr, ClientCertDir string
+	// Engines are the engines backing the node's stores. The first is
+	// bootstrapped. Defaults to a single in-memory engine with a
+	// maximum of 100M.
+	Engines []engine.Engine
 	// server is the embedded Cockroach server struct.
 	*server
 }
@@ -84,8 +91,8 @@ func (ts *TestServer) Clock() *hlc.Clock {
 	return nil
 }
 
-// Start starts the TestServer by bootstrapping an in-memory store
-// (defaults to maximum of 100M). The server is started, launching the
+// Start starts the TestServer by bootstrapping the first of its
+// engines. The server is started, launching the
 // node RPC server and all HTTP endpoints. Use the value of
 // TestServer.HTTPAddr after Start() for client connections.
 func (ts *TestServer) Start() error {
@@ -102,11 +109,16 @@ func (ts *TestServer) Start() error {
 	if err != nil {
 		return util.Errorf("could not init server: %s", err)
 	}
-	engines := []engine.Engine{engine.NewInMem(proto.Attributes{}, 100<<20)}
-	if _, err := BootstrapCluster("cluster-1", engines[0]); err != nil {
+	if err := ts.initClientListeners(ts.ClientRPCAddr, ts.ClientCertDir); err != nil {
+		return util.Errorf("could not init client listeners: %s", err)
+	}
+	if len(ts.Engines) == 0 {
+		ts.Engines = []engine.Engine{engine.NewInMem(proto.Attributes{}, 100<<20)}
+	}
+	if _, err := BootstrapCluster("cluster-1", ts.Engines[0]); err != nil {
 		return util.Errorf("could not bootstrap cluster: %s", err)
 	}
-	err = ts.start(engines, "", ts.HTTPAddr, true) // TODO(spencer): should shutdown server.
+	err = ts.start(ts.Engines, "", ts.HTTPAddr, true) // TODO(spencer): should shutdown server.
 	if err != nil {
 		return util.Errorf("could not start server: %s", err)
 	}
@@ -114,6 +126,9 @@ func (ts *TestServer) Start() error {
 	// ports bound.
 	ts.HTTPAddr = (*ts.httpListener).Addr().String()
 	ts.RPCAddr = ts.rpc.Addr().String()
+	if ts.clientRPC != nil {
+		ts.ClientRPCAddr = ts.clientRPC.Addr().String()
+	}
 
 	return nil
 }
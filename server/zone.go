@@ -19,8 +19,10 @@ package server
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/cockroachdb/cockroach/client"
 	"github.com/cockroachdb/cockroach/proto"
@@ -28,17 +30,28 @@ import (
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	gogoproto "github.com/gogo/protobuf/proto"
 )
 
 // A zoneHandler implements the adminHandler interface.
 type zoneHandler struct {
-	db *client.KV // Key-value database client
+	db         *client.KV            // Key-value database client
+	findStores storage.FindStoreFunc // Finds gossiped stores by attributes
+}
+
+// An effectiveZoneConfig is the zone config which applies to a key,
+// along with the prefix of the zone from which it is inherited.
+type effectiveZoneConfig struct {
+	Prefix string            `json:"prefix" yaml:"prefix"`
+	Config *proto.ZoneConfig `json:"config" yaml:"config"`
 }
 
 // Put writes a zone config for the specified key prefix (which is
 // treated as a key). The zone config is parsed from the input
 // "body". The specified body must validly parse into a zone config
-// struct.
+// struct. If the "validate" query parameter is set, the zone config
+// is validated against the attributes of gossiped stores instead of
+// being written.
 func (zh *zoneHandler) Put(path string, body []byte, r *http.Request) error {
 	if len(path) == 0 {
 		return util.Errorf("no path specified for zone Put")
@@ -47,6 +60,9 @@ func (zh *zoneHandler) Put(path string, body []byte, r *http.Request) error {
 	if err := util.UnmarshalRequest(r, body, config, util.AllEncodings); err != nil {
 		return util.Errorf("zone config has invalid format: %q: %s", body, err)
 	}
+	if r.URL.Query().Get("validate") != "" {
+		return validateZoneConfig(config, zh.findStores)
+	}
 	zoneKey := engine.MakeKey(engine.KeyConfigZonePrefix, proto.Key(path[1:]))
 	if err := zh.db.PutProto(zoneKey, config); err != nil {
 		return err
@@ -61,8 +77,17 @@ func (zh *zoneHandler) Put(path string, body []byte, r *http.Request) error {
 // the default zone config if "key" is equal to "/", and will list all
 // configs if "key" is equal to "". The body result contains
 // JSON-formatted output for a listing of keys and JSON-formatted
-// output for retrieval of a zone config.
+// output for retrieval of a zone config. If the "effective" query
+// parameter is set, the zone config which applies to the key is
+// retrieved, whether or not the key is itself a zone prefix.
 func (zh *zoneHandler) Get(path string, r *http.Request) (body []byte, contentType string, err error) {
+	if len(path) > 0 && r.URL.Query().Get("effective") != "" {
+		var effective *effectiveZoneConfig
+		if effective, err = zh.effectiveConfig(proto.Key(path[1:])); err != nil {
+			return
+		}
+		return util.MarshalResponse(r, effective, util.AllEncodings)
+	}
 	// Scan all zones if the key is empty.
 	if len(path) == 0 {
 		sr := &proto.ScanResponse{}
@@ -121,3 +146,85 @@ func (zh *zoneHandler) Delete(path string, r *http.Request) error {
 		},
 	}, &proto.DeleteResponse{})
 }
+
+// effectiveConfig returns the zone config which applies to key,
+// inherited from the zone with the longest matching prefix.
+func (zh *zoneHandler) effectiveConfig(key proto.Key) (*effectiveZoneConfig, error) {
+	configMap, err := zh.configMap()
+	if err != nil {
+		return nil, err
+	}
+	match := configMap.MatchByPrefix(key)
+	return &effectiveZoneConfig{
+		Prefix: url.QueryEscape(string(match.Prefix)),
+		Config: match.Config.(*proto.ZoneConfig),
+	}, nil
+}
+
+// configMap reads all zone configs into a prefix config map.
+func (zh *zoneHandler) configMap() (storage.PrefixConfigMap, error) {
+	sr := &proto.ScanResponse{}
+	if err := zh.db.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.KeyConfigZonePrefix,
+			EndKey: engine.KeyConfigZonePrefix.PrefixEnd(),
+			User:   storage.UserRoot,
+		},
+		MaxResults: maxGetResults,
+	}, sr); err != nil {
+		return nil, err
+	}
+	var configs []*storage.PrefixConfig
+	for _, kv := range sr.Rows {
+		config := &proto.ZoneConfig{}
+		if err := gogoproto.Unmarshal(kv.Value.Bytes, config); err != nil {
+			return nil, util.Errorf("unable to unmarshal zone config %q: %s", kv.Key, err)
+		}
+		configs = append(configs, &storage.PrefixConfig{
+			Prefix: bytes.TrimPrefix(kv.Key, engine.KeyConfigZonePrefix),
+			Config: config,
+		})
+	}
+	return storage.NewPrefixConfigMap(configs)
+}
+
+// validateZoneConfig verifies that the required attributes of each
+// voting and non-voting replica and each lease preference are
+// satisfied by at least one store known via gossip. Returns an error
+// describing all unsatisfiable replicas and preferences. If no stores
+// are known at all, as before any have been gossiped, there is nothing
+// to validate against and the zone config is accepted.
+func validateZoneConfig(config *proto.ZoneConfig, findStores storage.FindStoreFunc) error {
+	if findStores == nil {
+		return nil
+	}
+	if stores, err := findStores(proto.Attributes{}); err != nil {
+		return err
+	} else if len(stores) == 0 {
+		log.Warningf("no stores known via gossip; unable to validate zone config")
+		return nil
+	}
+	var problems []string
+	for _, c := range []struct {
+		name  string
+		attrs []proto.Attributes
+	}{
+		{"replica", config.ReplicaAttrs},
+		{"non-voter", config.NonVoterAttrs},
+		{"lease preference", config.LeasePreferences},
+	} {
+		for i, attrs := range c.attrs {
+			stores, err := findStores(attrs)
+			if err != nil {
+				return err
+			}
+			if len(stores) == 0 {
+				problems = append(problems, fmt.Sprintf("%s %d: no store has attributes [%s]", c.name, i+1, attrs.SortedString()))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return util.Errorf("invalid zone config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
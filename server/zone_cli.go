@@ -19,11 +19,25 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
 
 	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	yaml "gopkg.in/yaml.v1"
 )
 
+var zoneDryRun = flag.Bool("zone_dry_run", false, "validate and print the diff of "+
+	"zone config changes made with set-zone without applying them")
+
 // A CmdGetZone command displays the zone config for the specified
 // prefix.
 var CmdGetZone = &commander.Command{
@@ -43,6 +57,42 @@ func runGetZone(cmd *commander.Command, args []string) {
 	runGetConfig(zonePathPrefix, cmd, args)
 }
 
+// A CmdEffectiveZone command displays the zone config which applies
+// to the specified key.
+var CmdEffectiveZone = &commander.Command{
+	UsageLine: "effective-zone [options] <key>",
+	Short:     "fetches and displays the zone config applying to a key",
+	Long: `
+Fetches and displays the effective zone configuration for <key>, which
+is inherited from the zone with the longest prefix of <key>, along
+with that zone's prefix. The key should be escaped via URL query
+escaping if it contains non-ascii bytes or spaces.
+`,
+	Run:  runEffectiveZone,
+	Flag: *flag.CommandLine,
+}
+
+// runEffectiveZone invokes the REST API with GET action, key as path
+// and the effective query parameter set.
+func runEffectiveZone(cmd *commander.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s/%s?effective=true", adminScheme, *addr, zonePathPrefix, configKeyPrefix(args[0])), nil)
+	if err != nil {
+		log.Errorf("unable to create request to admin REST endpoint: %s", err)
+		return
+	}
+	req.Header.Add("Accept", "text/yaml")
+	b, err := sendAdminRequest(req)
+	if err != nil {
+		log.Errorf("admin REST request failed: %s", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "effective zone config for key %q:\n%s\n", args[0], string(b))
+}
+
 // A CmdLsZones command displays a list of zone configs by prefix.
 var CmdLsZones = &commander.Command{
 	UsageLine: "ls-zones [options] [key-regexp]",
@@ -103,8 +153,28 @@ The zone config format has the following YAML schema:
   replicas:
     - [comma-separated attribute list]
     - ...
+  non_voters:
+    - [comma-separated attribute list]
+    - ...
+  lease_preferences:
+    - [comma-separated attribute list]
+    - ...
   range_min_bytes: <size-in-bytes>
   range_max_bytes: <size-in-bytes>
+  gc:
+    ttlseconds: <seconds>
+    maxversions: <count>
+
+Replicas listed under "replicas" vote; those listed under
+"non_voters" receive all writes but do not vote, serving reads in
+remote regions without adding to write latency. Lease preferences
+are honored among the stores of a node: a range is moved to the
+store on its node satisfying the first satisfiable lease preference.
+They do not move the range lease between nodes.
+
+Historical versions of a key are garbage collected once older than
+"ttlseconds" or once more than "maxversions" newer versions exist.
+Reads at timestamps whose versions have been collected are rejected.
 
 For example:
 
@@ -112,20 +182,158 @@ For example:
     - [us-east-1a, ssd]
     - [us-east-1b, ssd]
     - [us-west-1b, ssd]
+  non_voters:
+    - [eu-west-1a]
+  lease_preferences:
+    - [us-east-1a]
+    - [us-east-1b]
   range_min_bytes: 8388608
   range_min_bytes: 67108864
 
 Setting zone configs will guarantee that key ranges will be split
 such that no key range straddles two zone config specifications.
 This feature can be taken advantage of to pre-split ranges.
+
+Before the zone config is set, the attributes required of each
+replica are validated against the attributes of stores currently
+known via gossip, unless no stores are known yet, and a diff against
+the existing zone config for <key-prefix> is printed to standard
+error. The zone config is not set if validation fails. Specify
+-zone_dry_run to validate and print the diff only.
 `,
 	Run:  runSetZone,
 	Flag: *flag.CommandLine,
 }
 
-// runSetZone invokes the REST API with POST action and key prefix as
-// path. The specified configuration file is read from disk and sent
-// as the POST body.
+// runSetZone validates the zone config read from the specified file
+// and prints a diff against the existing zone config for the key
+// prefix. Unless -zone_dry_run is specified, it then invokes the REST
+// API with POST action and key prefix as path to set the zone config.
 func runSetZone(cmd *commander.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		return
+	}
+	body, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		log.Errorf("unable to read zone config file %q: %s", args[1], err)
+		return
+	}
+	config := &proto.ZoneConfig{}
+	if err := yaml.Unmarshal(body, config); err != nil {
+		log.Errorf("zone config file %q has invalid format: %s", args[1], err)
+		return
+	}
+	url := fmt.Sprintf("%s://%s%s/%s", adminScheme, *addr, zonePathPrefix, configKeyPrefix(args[0]))
+
+	// Validate the zone config against gossiped store attributes.
+	req, err := http.NewRequest("POST", url+"?validate=true", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("unable to create request to admin REST endpoint: %s", err)
+		return
+	}
+	req.Header.Add("Content-Type", "text/yaml")
+	if _, err := sendAdminRequest(req); err != nil {
+		log.Errorf("zone config validation failed: %s", err)
+		return
+	}
+
+	// Fetch the existing zone config, if any, and print a diff.
+	existing := &proto.ZoneConfig{}
+	if req, err = http.NewRequest("GET", url, nil); err != nil {
+		log.Errorf("unable to create request to admin REST endpoint: %s", err)
+		return
+	}
+	req.Header.Add("Accept", "application/json")
+	if b, err := sendAdminRequest(req); err != nil {
+		existing = nil
+	} else if err := json.Unmarshal(b, existing); err != nil {
+		log.Errorf("unable to parse admin REST response: %s", err)
+		return
+	}
+	diff, err := diffZoneConfigs(existing, config)
+	if err != nil {
+		log.Errorf("unable to diff zone configs: %s", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "zone config changes for key prefix %q:\n%s", args[0], diff)
+	if *zoneDryRun {
+		return
+	}
 	runSetConfig(zonePathPrefix, cmd, args)
 }
+
+// diffZoneConfigs returns a line-based diff of the YAML encodings of
+// the old and new zone configs. Removed lines are prefixed with "-",
+// added lines with "+" and unchanged lines with a space. A nil old
+// config is treated as empty.
+func diffZoneConfigs(oldConfig, newConfig *proto.ZoneConfig) (string, error) {
+	var oldLines []string
+	if oldConfig != nil {
+		b, err := yaml.Marshal(oldConfig)
+		if err != nil {
+			return "", err
+		}
+		oldLines = strings.SplitAfter(string(util.SanitizeYAML(b)), "\n")
+	}
+	b, err := yaml.Marshal(newConfig)
+	if err != nil {
+		return "", err
+	}
+	newLines := strings.SplitAfter(string(util.SanitizeYAML(b)), "\n")
+	return diffLines(oldLines, newLines), nil
+}
+
+// diffLines returns a diff of a and b computed from their longest
+// common subsequence of lines.
+func diffLines(a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var buf bytes.Buffer
+	writeLine := func(prefix, line string) {
+		if line == "" {
+			return
+		}
+		buf.WriteString(prefix + line)
+		if !strings.HasSuffix(line, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			writeLine(" ", a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			writeLine("-", a[i])
+			i++
+		default:
+			writeLine("+", b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		writeLine("-", a[i])
+	}
+	for ; j < len(b); j++ {
+		writeLine("+", b[j])
+	}
+	return buf.String()
+}
@@ -24,8 +24,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"testing"
 
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	yaml "gopkg.in/yaml.v1"
 )
@@ -300,3 +303,161 @@ func ExampleZoneContentTypes() {
 	// range_min_bytes: 1048576
 	// range_max_bytes: 67108864
 }
+
+// TestValidateZoneConfig verifies that zone configs are rejected if
+// any replica's required attributes are not satisfied by a store.
+func TestValidateZoneConfig(t *testing.T) {
+	storeAttrs := []proto.Attributes{
+		{Attrs: []string{"dc1", "ssd"}},
+		{Attrs: []string{"dc2", "hdd"}},
+	}
+	findStores := func(required proto.Attributes) ([]*storage.StoreDescriptor, error) {
+		var stores []*storage.StoreDescriptor
+		for i, attrs := range storeAttrs {
+			if required.IsSubset(attrs) {
+				stores = append(stores, &storage.StoreDescriptor{StoreID: int32(i + 1), Attrs: attrs})
+			}
+		}
+		return stores, nil
+	}
+	testCases := []struct {
+		replicas, nonVoters, leasePrefs [][]string
+		expErr                          string
+	}{
+		{[][]string{{}, {}, {}}, nil, nil, ""},
+		{[][]string{{"dc1"}, {"dc2"}}, nil, nil, ""},
+		{[][]string{{"ssd"}, {"hdd", "dc2"}}, nil, nil, ""},
+		{[][]string{{"dc1"}, {"dc3"}}, nil, nil, "replica 2: no store has attributes [dc3]"},
+		{[][]string{{"dc2", "ssd"}, {"dc1"}, {"mem"}}, nil, nil, "replica 1: no store has attributes [dc2,ssd]; replica 3"},
+		{[][]string{{"dc1"}}, [][]string{{"dc2"}}, [][]string{{"dc1"}}, ""},
+		{[][]string{{"dc1"}}, [][]string{{"dc3"}}, nil, "non-voter 1: no store has attributes [dc3]"},
+		{[][]string{{"dc1"}}, nil, [][]string{{"dc1"}, {"mem"}}, "lease preference 2: no store has attributes [mem]"},
+	}
+	toAttrs := func(attrsList [][]string) []proto.Attributes {
+		var result []proto.Attributes
+		for _, attrs := range attrsList {
+			result = append(result, proto.Attributes{Attrs: attrs})
+		}
+		return result
+	}
+	for i, test := range testCases {
+		config := &proto.ZoneConfig{
+			ReplicaAttrs:     toAttrs(test.replicas),
+			NonVoterAttrs:    toAttrs(test.nonVoters),
+			LeasePreferences: toAttrs(test.leasePrefs),
+		}
+		err := validateZoneConfig(config, findStores)
+		if test.expErr == "" && err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+		} else if test.expErr != "" && (err == nil || !strings.Contains(err.Error(), test.expErr)) {
+			t.Errorf("%d: expected error containing %q; got %v", i, test.expErr, err)
+		}
+	}
+
+	// Without any known stores, there is nothing to validate against.
+	storeAttrs = nil
+	config := &proto.ZoneConfig{ReplicaAttrs: toAttrs([][]string{{"dc3"}})}
+	if err := validateZoneConfig(config, findStores); err != nil {
+		t.Errorf("expected zone config to be accepted without known stores; got %s", err)
+	}
+}
+
+// TestZoneValidateAndEffective verifies that validation via the REST
+// API does not write the zone config and that the effective zone
+// config for a key is inherited from its longest matching prefix.
+func TestZoneValidateAndEffective(t *testing.T) {
+	httpServer := startAdminServer()
+	defer httpServer.Close()
+
+	// The test admin server knows no stores, so the zone config
+	// passes validation unchecked.
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s%s/db1?validate=true", adminScheme, *addr, zonePathPrefix),
+		strings.NewReader(testZoneConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "text/yaml")
+	if _, err := sendAdminRequest(req); err != nil {
+		t.Errorf("expected validation to pass without known stores; got %v", err)
+	}
+	req, err = http.NewRequest("GET", fmt.Sprintf("%s://%s%s/db1", adminScheme, *addr, zonePathPrefix), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendAdminRequest(req); err == nil {
+		t.Error("expected validation not to write zone config")
+	}
+
+	testConfigFn := createTestConfigFile(testZoneConfig)
+	defer os.Remove(testConfigFn)
+	runSetZone(CmdSetZone, []string{"db1", testConfigFn})
+
+	testCases := []struct {
+		key       string
+		expPrefix string
+		expMax    int64
+	}{
+		{"a", "", 67108864},
+		{"db", "", 67108864},
+		{"db1", "db1", 67108864},
+		{"db1%2Ftable", "db1", 67108864},
+		{"db2", "", 67108864},
+	}
+	for i, test := range testCases {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s/%s?effective=true", adminScheme, *addr, zonePathPrefix, test.key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Accept", "application/json")
+		body, err := sendAdminRequest(req)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		effective := &effectiveZoneConfig{}
+		if err := json.Unmarshal(body, effective); err != nil {
+			t.Fatalf("%d: unable to unmarshal %s: %s", i, body, err)
+		}
+		if effective.Prefix != test.expPrefix || effective.Config.RangeMaxBytes != test.expMax {
+			t.Errorf("%d: expected prefix %q with max bytes %d; got %s", i, test.expPrefix, test.expMax, body)
+		}
+	}
+	// Only the db1 zone has replica attributes.
+	req, err = http.NewRequest("GET", fmt.Sprintf("%s://%s%s/db1x?effective=true", adminScheme, *addr, zonePathPrefix), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := sendAdminRequest(req); err != nil || !strings.Contains(string(body), "dc1") {
+		t.Errorf("expected zone config of db1 to apply to db1x; got %s, %v", body, err)
+	}
+}
+
+// TestDiffZoneConfigs verifies the diff of zone config changes.
+func TestDiffZoneConfigs(t *testing.T) {
+	oldConfig := &proto.ZoneConfig{RangeMinBytes: 1048576, RangeMaxBytes: 67108864}
+	newConfig := &proto.ZoneConfig{RangeMinBytes: 1048576, RangeMaxBytes: 134217728}
+	diff, err := diffZoneConfigs(oldConfig, newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expDiff := " range_min_bytes: 1048576\n-range_max_bytes: 67108864\n+range_max_bytes: 134217728\n"
+	if diff != expDiff {
+		t.Errorf("expected diff:\n%s\ngot:\n%s", expDiff, diff)
+	}
+	if diff, err = diffZoneConfigs(nil, newConfig); err != nil {
+		t.Fatal(err)
+	}
+	expDiff = "+range_min_bytes: 1048576\n+range_max_bytes: 134217728\n"
+	if diff != expDiff {
+		t.Errorf("expected diff:\n%s\ngot:\n%s", expDiff, diff)
+	}
+}
+
+// TestDiffLines verifies the line diff.
+func TestDiffLines(t *testing.T) {
+	a := []string{"a\n", "b\n", "c\n", "d\n"}
+	b := []string{"a\n", "c\n", "e\n", "d\n"}
+	expDiff := " a\n-b\n c\n+e\n d\n"
+	if diff := diffLines(a, b); diff != expDiff {
+		t.Errorf("expected diff:\n%s\ngot:\n%s", expDiff, diff)
+	}
+}
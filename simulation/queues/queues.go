@@ -0,0 +1,104 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+/*
+Queues simulates stores holding ranges with synthetic stats over
+simulated time, feeding the scan queue prioritization and the replica
+allocator. No data is written; each tick applies a configurable
+workload, processes the highest priority ranges on each store and
+rebalances replicas off the fullest store.
+
+Reports are logged periodically and at the end of the run, covering
+GC latency (delay from bytes becoming GC'able until the range is
+scanned), queue starvation (ranges exceeding the verification or
+intent sweep intervals) and rebalance convergence (ticks until the
+spread of available capacity across stores falls within threshold).
+
+To run:
+
+    go run simulation/queues/queues.go -stores=5 -ranges=1000 -ticks=1440
+
+Use -add-store-at to add an empty store partway through the run and
+observe rebalancing.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+var (
+	stores         = flag.Int("stores", 5, "number of stores")
+	capacity       = flag.Int64("capacity", 1<<40, "capacity of each store in bytes")
+	ranges         = flag.Int("ranges", 1000, "number of ranges at start of simulation")
+	ticks          = flag.Int("ticks", 24*60, "number of ticks to simulate")
+	tick           = flag.Duration("tick", time.Hour, "simulated time per tick")
+	scansPerTick   = flag.Int("scans-per-tick", 10, "ranges processed by each store's scan queue per tick")
+	rebalances     = flag.Int("rebalances-per-tick", 1, "replica moves per tick")
+	threshold      = flag.Float64("rebalance-threshold", 0.05, "acceptable spread in fraction of available capacity across stores")
+	rangeBytes     = flag.Int64("range-bytes", 64<<20, "live bytes in each new range")
+	overwriteBytes = flag.Int64("overwrite-bytes", 1<<20, "non-live bytes added to each range per tick")
+	intentFraction = flag.Float64("intent-fraction", 0.01, "fraction of ranges which receive an intent per tick")
+	newRanges      = flag.Int("new-ranges-per-tick", 1, "number of new ranges allocated per tick")
+	gcTTL          = flag.Duration("gc-ttl", 24*time.Hour, "GC TTL for all ranges")
+	addStoreAt     = flag.Int("add-store-at", -1, "tick at which to add an empty store; -1 to disable")
+	reportEvery    = flag.Int("report-every", 24, "ticks between periodic reports")
+	seed           = flag.Int64("seed", 0, "random seed")
+)
+
+func main() {
+	flag.Parse()
+
+	sim := storage.NewSimulation(*stores, *capacity, storage.SimulationWorkload{
+		RangeBytes:       *rangeBytes,
+		OverwriteBytes:   *overwriteBytes,
+		IntentBytes:      1024,
+		IntentFraction:   *intentFraction,
+		NewRangesPerTick: *newRanges,
+		GCTTLSeconds:     int32(gcTTL.Seconds()),
+	}, *seed)
+	sim.TickInterval = *tick
+	sim.ScansPerTick = *scansPerTick
+	sim.RebalancesPerTick = *rebalances
+	sim.RebalanceThreshold = *threshold
+
+	// Create the initial ranges as though they were all created by a
+	// single burst of new range allocations.
+	initial := sim.Workload
+	sim.Workload = storage.SimulationWorkload{NewRangesPerTick: *ranges, RangeBytes: *rangeBytes, GCTTLSeconds: initial.GCTTLSeconds}
+	if err := sim.Tick(); err != nil {
+		log.Fatalf("simulation failed: %s", err)
+	}
+	sim.Workload = initial
+
+	for i := 1; i < *ticks; i++ {
+		if i == *addStoreAt {
+			log.Infof("adding store at tick %d", i)
+			sim.AddStore(*capacity)
+		}
+		if err := sim.Tick(); err != nil {
+			log.Fatalf("simulation failed: %s", err)
+		}
+		if *reportEvery > 0 && i%*reportEvery == 0 {
+			log.Infof("%s: %s", sim.Now().UTC().Format(time.RFC3339), sim.Report())
+		}
+	}
+	fmt.Println(sim.Report())
+}
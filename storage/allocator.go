@@ -22,9 +22,31 @@ import (
 	"math/rand"
 
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/settings"
 )
 
+var (
+	// maxReadAmplification is the number of level 0 files above which
+	// a store's LSM tree is considered unhealthy.
+	maxReadAmplification = settings.RegisterIntSetting("storage.allocator.max_read_amplification",
+		"number of level 0 files above which no replicas are placed on a store", 20).WithValidation(settings.PositiveInt)
+	// maxCompactionDebt is the compaction debt above which a store's
+	// LSM tree is considered unhealthy.
+	maxCompactionDebt = settings.RegisterByteSizeSetting("storage.allocator.max_compaction_debt",
+		"compaction debt above which no replicas are placed on a store", 64<<30)
+)
+
+// lsmHealthy returns whether the LSM tree of a store with capacity c
+// is healthy enough for the store to be given new replicas. Reads
+// slow down as level 0 files accumulate, and writes are throttled
+// once compactions fall behind.
+func lsmHealthy(c engine.StoreCapacity) bool {
+	return c.ReadAmplification <= maxReadAmplification.Get() &&
+		c.CompactionDebt <= maxCompactionDebt.Get()
+}
+
 // allocator makes allocation decisions based on a zone configuration,
 // existing range metadata and available stores. Configuration
 // settings and range metadata information is stored directly in the
@@ -40,6 +62,8 @@ type allocator struct {
 // error. It uses the allocator's StoreFinder to select the set of
 // available stores matching attributes for missing replicas and picks
 // using randomly weighted selection based on available capacities.
+// Stores advertised as suspect and stores with unhealthy LSM trees
+// are not considered.
 func (a *allocator) allocate(required proto.Attributes, existingReplicas []proto.Replica) (
 	*StoreDescriptor, error) {
 	// Get a set of current nodes -- we never want to allocate on an existing node.
@@ -57,7 +81,7 @@ func (a *allocator) allocate(required proto.Attributes, existingReplicas []proto
 	var candidates []*StoreDescriptor
 	var capacityTotal float64
 	for _, s := range stores {
-		if _, ok := usedNodes[s.Node.NodeID]; !ok {
+		if _, ok := usedNodes[s.Node.NodeID]; !ok && !s.Suspect && lsmHealthy(s.Capacity) {
 			candidates = append(candidates, s)
 			capacityTotal += s.Capacity.PercentAvail()
 		}
@@ -76,3 +100,84 @@ func (a *allocator) allocate(required proto.Attributes, existingReplicas []proto
 	}
 	return nil, util.Errorf("unable to find an appropriate store for requested replica attributes")
 }
+
+// allocateReplica returns a suitable store for the next replica of a
+// range in zone, given its existing replicas. Voting replicas, whose
+// attributes are described by the zone's ReplicaAttrs, are placed
+// before non-voting replicas, described by NonVoterAttrs. Returns
+// whether the new replica is a non-voting replica, or an error if the
+// existing replicas already satisfy all of the zone's replica
+// attributes.
+func (a *allocator) allocateReplica(zone *proto.ZoneConfig, existingReplicas []proto.Replica) (
+	*StoreDescriptor, bool, error) {
+	required, nonVoter, ok := nextReplicaAttrs(zone, existingReplicas)
+	if !ok {
+		return nil, false, util.Errorf("range already has all %d replicas required by its zone",
+			len(zone.ReplicaAttrs)+len(zone.NonVoterAttrs))
+	}
+	store, err := a.allocate(required, existingReplicas)
+	return store, nonVoter, err
+}
+
+// nextReplicaAttrs returns the attributes of the first voting, then
+// non-voting, replica of zone not satisfied by any of the existing
+// replicas of the same kind, and whether it is a non-voting replica.
+// Each existing replica satisfies at most one of the zone's replicas.
+// Returns false if all are satisfied.
+func nextReplicaAttrs(zone *proto.ZoneConfig, existingReplicas []proto.Replica) (
+	attrs proto.Attributes, nonVoter bool, ok bool) {
+	missing, _ := matchReplicaAttrs(zone, existingReplicas)
+	if len(missing) == 0 {
+		return proto.Attributes{}, false, false
+	}
+	return missing[0].attrs, missing[0].nonVoter, true
+}
+
+// A replicaSlot is the attributes required of one of the replicas of
+// a zone.
+type replicaSlot struct {
+	attrs    proto.Attributes
+	nonVoter bool
+}
+
+// matchReplicaAttrs matches the existing replicas to the voting, then
+// non-voting, replicas of zone, in order. Each existing replica
+// satisfies at most one of the zone's replicas of the same kind.
+// Returns the zone's replicas not satisfied by any existing replica
+// and, for each existing replica, whether it satisfies one.
+func matchReplicaAttrs(zone *proto.ZoneConfig, existingReplicas []proto.Replica) (
+	missing []replicaSlot, used []bool) {
+	used = make([]bool, len(existingReplicas))
+	find := func(attrs proto.Attributes, nonVoter bool) bool {
+		for i, replica := range existingReplicas {
+			if !used[i] && replica.NonVoter == nonVoter && attrs.IsSubset(replica.Attrs) {
+				used[i] = true
+				return true
+			}
+		}
+		return false
+	}
+	for _, attrs := range zone.ReplicaAttrs {
+		if !find(attrs, false) {
+			missing = append(missing, replicaSlot{attrs, false})
+		}
+	}
+	for _, attrs := range zone.NonVoterAttrs {
+		if !find(attrs, true) {
+			missing = append(missing, replicaSlot{attrs, true})
+		}
+	}
+	return missing, used
+}
+
+// leasePreferenceRank returns the index of the first of the zone's
+// lease preferences satisfied by attrs, or the number of preferences
+// if attrs satisfy none. Lower ranks are preferred.
+func leasePreferenceRank(zone *proto.ZoneConfig, attrs proto.Attributes) int {
+	for i, pref := range zone.LeasePreferences {
+		if pref.IsSubset(attrs) {
+			return i
+		}
+	}
+	return len(zone.LeasePreferences)
+}
@@ -288,3 +288,104 @@ func TestExistingReplica(t *testing.T) {
 		t.Errorf("expected result to have node 3 and store 4: %+v", result)
 	}
 }
+
+// TestSuspectStore verifies that stores advertised as suspect are
+// not chosen as allocation targets.
+func TestSuspectStore(t *testing.T) {
+	var a = allocator{
+		storeFinder: func(attrs proto.Attributes) ([]*StoreDescriptor, error) {
+			stores, err := sameDCStores(attrs)
+			for _, s := range stores {
+				s.Suspect = s.StoreID == 2
+			}
+			return stores, err
+		},
+		rand: *rand.New(rand.NewSource(0)),
+	}
+	// Stores 1 and 2 have the ssd attribute; store 1's node already
+	// holds a replica and store 2 is suspect.
+	result, err := a.allocate(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{
+		proto.Replica{
+			NodeID:  1,
+			StoreID: 1,
+			Attrs:   simpleZoneConfig.ReplicaAttrs[0],
+		},
+	})
+	if err == nil {
+		t.Errorf("expected no suitable store; got %+v", result)
+	}
+}
+
+// TestUnhealthyLSMStore verifies that stores whose LSM trees have
+// excessive read amplification or compaction debt are not chosen as
+// allocation targets.
+func TestUnhealthyLSMStore(t *testing.T) {
+	testCases := []engine.StoreCapacity{
+		{Capacity: 100, Available: 100, ReadAmplification: maxReadAmplification.Get() + 1},
+		{Capacity: 100, Available: 100, CompactionDebt: maxCompactionDebt.Get() + 1},
+	}
+	for i, capacity := range testCases {
+		var a = allocator{
+			storeFinder: func(attrs proto.Attributes) ([]*StoreDescriptor, error) {
+				stores, err := sameDCStores(attrs)
+				for _, s := range stores {
+					if s.StoreID == 2 {
+						s.Capacity = capacity
+					}
+				}
+				return stores, err
+			},
+			rand: *rand.New(rand.NewSource(0)),
+		}
+		// Stores 1 and 2 have the ssd attribute; store 1's node already
+		// holds a replica and store 2's LSM tree is unhealthy.
+		result, err := a.allocate(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{
+			proto.Replica{
+				NodeID:  1,
+				StoreID: 1,
+				Attrs:   simpleZoneConfig.ReplicaAttrs[0],
+			},
+		})
+		if err == nil {
+			t.Errorf("%d: expected no suitable store; got %+v", i, result)
+		}
+	}
+}
+
+// TestNextReplicaAttrs verifies that voting replicas are allocated
+// before non-voting replicas and that existing replicas satisfy at
+// most one of the zone's replicas.
+func TestNextReplicaAttrs(t *testing.T) {
+	zone := &proto.ZoneConfig{
+		ReplicaAttrs:  []proto.Attributes{{Attrs: []string{"us"}}, {Attrs: []string{"us"}}},
+		NonVoterAttrs: []proto.Attributes{{Attrs: []string{"eu"}}},
+	}
+	replica := func(attrs ...string) proto.Replica {
+		return proto.Replica{Attrs: proto.Attributes{Attrs: attrs}}
+	}
+	nonVoter := func(attrs ...string) proto.Replica {
+		return proto.Replica{Attrs: proto.Attributes{Attrs: attrs}, NonVoter: true}
+	}
+	testCases := []struct {
+		existing    []proto.Replica
+		expAttrs    string
+		expNonVoter bool
+		expOK       bool
+	}{
+		{nil, "us", false, true},
+		{[]proto.Replica{nonVoter("eu")}, "us", false, true},
+		{[]proto.Replica{replica("us", "ssd")}, "us", false, true},
+		{[]proto.Replica{replica("us"), replica("us")}, "eu", true, true},
+		// A voting replica does not satisfy a non-voting replica.
+		{[]proto.Replica{replica("us"), replica("us"), replica("eu")}, "eu", true, true},
+		{[]proto.Replica{replica("us"), nonVoter("us"), replica("us")}, "eu", true, true},
+		{[]proto.Replica{replica("us"), nonVoter("eu"), replica("us")}, "", false, false},
+	}
+	for i, test := range testCases {
+		attrs, nonVoter, ok := nextReplicaAttrs(zone, test.existing)
+		if ok != test.expOK || nonVoter != test.expNonVoter || attrs.SortedString() != test.expAttrs {
+			t.Errorf("%d: expected %q, %t, %t; got %q, %t, %t", i, test.expAttrs, test.expNonVoter, test.expOK,
+				attrs.SortedString(), nonVoter, ok)
+		}
+	}
+}
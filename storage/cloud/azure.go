@@ -0,0 +1,247 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package cloud
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// azureAPIVersion is the version of the Blob service REST API used.
+const azureAPIVersion = "2019-12-12"
+
+// azureStorage stores files as block blobs in an Azure Blob Storage
+// container, beneath a name prefix. Requests are authenticated with
+// the account's shared key.
+type azureStorage struct {
+	uri       *url.URL
+	endpoint  *url.URL
+	account   string
+	key       []byte
+	container string
+	prefix    string
+	now       func() time.Time
+	client    *http.Client
+}
+
+// newAzureStorage returns storage for an azure://container/prefix URI.
+func newAzureStorage(u *url.URL) (*azureStorage, error) {
+	if u.Host == "" {
+		return nil, util.Errorf("external storage URI %q must specify a container", redact(u))
+	}
+	account := credential(u, AzureAccountParam)
+	encodedKey := credential(u, AzureKeyParam)
+	if account == "" || encodedKey == "" {
+		return nil, util.Errorf("no credentials specified for external storage %q", redact(u))
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, util.Errorf("invalid %s: %s", AzureKeyParam, err)
+	}
+	endpoint := credential(u, AzureEndpointParam)
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, util.Errorf("invalid endpoint %q: %s", endpoint, err)
+	}
+	return &azureStorage{
+		uri:       u,
+		endpoint:  ep,
+		account:   account,
+		key:       key,
+		container: u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		now:       time.Now,
+		client:    http.DefaultClient,
+	}, nil
+}
+
+// request returns a function creating a signed request for the named
+// blob, or the container if blob is empty.
+func (as *azureStorage) request(method, blob string, query url.Values, payload []byte) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		p := "/" + as.container
+		if blob != "" {
+			p += "/" + blob
+		}
+		u := *as.endpoint
+		u.Path = path.Join(u.Path, p)
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("x-ms-date", as.now().UTC().Format(http.TimeFormat))
+		req.Header.Set("x-ms-version", azureAPIVersion)
+		if method == "PUT" {
+			req.Header.Set("x-ms-blob-type", "BlockBlob")
+		}
+		as.sign(req, p, len(payload))
+		return req, nil
+	}
+}
+
+// sign adds a shared key authorization header to req for the resource
+// at resourcePath.
+func (as *azureStorage) sign(req *http.Request, resourcePath string, contentLength int) {
+	length := ""
+	if contentLength > 0 {
+		length = strconv.Itoa(contentLength)
+	}
+	var msHeaders []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk)
+		}
+	}
+	sort.Strings(msHeaders)
+	var buf bytes.Buffer
+	for _, field := range []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date; x-ms-date is used instead.
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	} {
+		buf.WriteString(field)
+		buf.WriteByte('\n')
+	}
+	for _, k := range msHeaders {
+		fmt.Fprintf(&buf, "%s:%s\n", k, req.Header.Get(k))
+	}
+	fmt.Fprintf(&buf, "/%s%s", as.account, resourcePath)
+	query := req.URL.Query()
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		fmt.Fprintf(&buf, "\n%s:%s", strings.ToLower(k), strings.Join(values, ","))
+	}
+	h := hmac.New(sha256.New, as.key)
+	h.Write(buf.Bytes())
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", as.account,
+		base64.StdEncoding.EncodeToString(h.Sum(nil))))
+}
+
+// blob returns the name of the blob holding the named file.
+func (as *azureStorage) blob(name string) string {
+	return path.Join(as.prefix, name)
+}
+
+// ReadFile implements ExternalStorage.
+func (as *azureStorage) ReadFile(name string) (io.ReadCloser, error) {
+	resp, err := send(as.client, as.request("GET", as.blob(name), nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteFile implements ExternalStorage.
+func (as *azureStorage) WriteFile(name string, content []byte) error {
+	resp, err := send(as.client, as.request("PUT", as.blob(name), nil, content))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// enumerationResults is the response to a List Blobs request.
+type enumerationResults struct {
+	Blobs struct {
+		Blob []struct {
+			Name string
+		}
+	}
+	NextMarker string
+}
+
+// ListFiles implements ExternalStorage, paging through the blobs
+// beneath the prefix.
+func (as *azureStorage) ListFiles() ([]string, error) {
+	prefix := ""
+	if as.prefix != "" {
+		prefix = as.prefix + "/"
+	}
+	var names []string
+	var marker string
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := send(as.client, as.request("GET", "", query, nil))
+		if err != nil {
+			return nil, err
+		}
+		result := &enumerationResults{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, util.Errorf("unable to decode listing of %s: %s", as, err)
+		}
+		for _, b := range result.Blobs.Blob {
+			names = append(names, strings.TrimPrefix(b.Name, prefix))
+		}
+		if result.NextMarker == "" {
+			break
+		}
+		marker = result.NextMarker
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements ExternalStorage.
+func (as *azureStorage) Delete(name string) error {
+	resp, err := send(as.client, as.request("DELETE", as.blob(name), nil, nil))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// String implements ExternalStorage.
+func (as *azureStorage) String() string {
+	return redact(as.uri)
+}
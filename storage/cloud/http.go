@@ -0,0 +1,83 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package cloud
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// httpStorage stores files on an HTTP server which supports GET, PUT
+// and DELETE beneath a base URL. HTTP servers provide no standard
+// means of listing files, so ListFiles is unsupported.
+type httpStorage struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func (hs *httpStorage) url(name string) string {
+	u := *hs.base
+	u.Path = path.Join(u.Path, name)
+	return u.String()
+}
+
+// ReadFile implements ExternalStorage.
+func (hs *httpStorage) ReadFile(name string) (io.ReadCloser, error) {
+	resp, err := send(hs.client, func() (*http.Request, error) {
+		return http.NewRequest("GET", hs.url(name), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteFile implements ExternalStorage.
+func (hs *httpStorage) WriteFile(name string, content []byte) error {
+	resp, err := send(hs.client, func() (*http.Request, error) {
+		return http.NewRequest("PUT", hs.url(name), bytes.NewReader(content))
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// ListFiles implements ExternalStorage.
+func (hs *httpStorage) ListFiles() ([]string, error) {
+	return nil, util.Errorf("listing files is not supported by HTTP storage %s", hs)
+}
+
+// Delete implements ExternalStorage.
+func (hs *httpStorage) Delete(name string) error {
+	resp, err := send(hs.client, func() (*http.Request, error) {
+		return http.NewRequest("DELETE", hs.url(name), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// String implements ExternalStorage.
+func (hs *httpStorage) String() string {
+	return redact(hs.base)
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package cloud
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// localStorage stores files in a directory on the local node. It is
+// intended for testing and single node clusters.
+type localStorage struct {
+	dir string
+}
+
+// ReadFile implements ExternalStorage.
+func (ls *localStorage) ReadFile(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(ls.dir, name))
+}
+
+// WriteFile implements ExternalStorage. The file is written to a
+// temporary file and renamed so that a partially written file is
+// never visible.
+func (ls *localStorage) WriteFile(name string, content []byte) error {
+	path := filepath.Join(ls.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ListFiles implements ExternalStorage. Temporary files are omitted.
+func (ls *localStorage) ListFiles() ([]string, error) {
+	var names []string
+	if err := filepath.Walk(ls.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == ls.dir {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	}); err != nil {
+		return nil, util.Errorf("unable to list %s: %s", ls.dir, err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements ExternalStorage.
+func (ls *localStorage) Delete(name string) error {
+	return os.Remove(filepath.Join(ls.dir, name))
+}
+
+// String implements ExternalStorage.
+func (ls *localStorage) String() string {
+	return "nodelocal://" + ls.dir
+}
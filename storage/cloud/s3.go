@@ -0,0 +1,317 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package cloud
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// s3Storage stores files in a bucket of an S3-compatible object
+// store, beneath a key prefix. Requests are authenticated with AWS
+// Signature Version 4. Google Cloud Storage is accessed the same way
+// via its XML API, using HMAC keys.
+type s3Storage struct {
+	uri      *url.URL
+	endpoint *url.URL // Scheme and host of the object store
+	bucket   string
+	prefix   string
+	signer   *sigV4Signer
+	client   *http.Client
+}
+
+// newS3Storage returns storage for an s3://bucket/prefix URI.
+func newS3Storage(u *url.URL) (*s3Storage, error) {
+	region := credential(u, S3RegionParam)
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := credential(u, S3EndpointParam)
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	return newSigV4Storage(u, endpoint, &sigV4Signer{
+		accessKey:    credential(u, S3AccessKeyParam),
+		secret:       credential(u, S3SecretParam),
+		sessionToken: credential(u, S3SessionTokenParam),
+		region:       region,
+		service:      "s3",
+		now:          time.Now,
+	})
+}
+
+// newGCSStorage returns storage for a gs://bucket/prefix URI.
+func newGCSStorage(u *url.URL) (*s3Storage, error) {
+	endpoint := credential(u, GCSEndpointParam)
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	return newSigV4Storage(u, endpoint, &sigV4Signer{
+		accessKey: credential(u, GCSAccessKeyParam),
+		secret:    credential(u, GCSSecretParam),
+		region:    "auto",
+		service:   "s3",
+		now:       time.Now,
+	})
+}
+
+func newSigV4Storage(u *url.URL, endpoint string, signer *sigV4Signer) (*s3Storage, error) {
+	if u.Host == "" {
+		return nil, util.Errorf("external storage URI %q must specify a bucket", redact(u))
+	}
+	if signer.accessKey == "" || signer.secret == "" {
+		return nil, util.Errorf("no credentials specified for external storage %q", redact(u))
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, util.Errorf("invalid endpoint %q: %s", endpoint, err)
+	}
+	return &s3Storage{
+		uri:      u,
+		endpoint: ep,
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		signer:   signer,
+		client:   http.DefaultClient,
+	}, nil
+}
+
+// key returns the object key of the named file.
+func (s *s3Storage) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// request returns a function creating a signed, path-style request
+// for the object with the given key, or the bucket if key is empty.
+func (s *s3Storage) request(method, key string, query url.Values, payload []byte) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		p := "/" + s.bucket
+		if key != "" {
+			p += "/" + key
+		}
+		u := &url.URL{
+			Scheme:   s.endpoint.Scheme,
+			Host:     s.endpoint.Host,
+			Path:     p,
+			RawPath:  awsURIEncode(p, true),
+			RawQuery: canonicalQuery(query),
+		}
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		s.signer.sign(req, payload)
+		return req, nil
+	}
+}
+
+// ReadFile implements ExternalStorage.
+func (s *s3Storage) ReadFile(name string) (io.ReadCloser, error) {
+	resp, err := send(s.client, s.request("GET", s.key(name), nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteFile implements ExternalStorage.
+func (s *s3Storage) WriteFile(name string, content []byte) error {
+	resp, err := send(s.client, s.request("PUT", s.key(name), nil, content))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listBucketResult is the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// ListFiles implements ExternalStorage, paging through the objects
+// beneath the prefix.
+func (s *s3Storage) ListFiles() ([]string, error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	var names []string
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := send(s.client, s.request("GET", "", query, nil))
+		if err != nil {
+			return nil, err
+		}
+		result := &listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, util.Errorf("unable to decode listing of %s: %s", s, err)
+		}
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements ExternalStorage.
+func (s *s3Storage) Delete(name string) error {
+	resp, err := send(s.client, s.request("DELETE", s.key(name), nil, nil))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// String implements ExternalStorage.
+func (s *s3Storage) String() string {
+	return redact(s.uri)
+}
+
+// A sigV4Signer signs requests with AWS Signature Version 4.
+type sigV4Signer struct {
+	accessKey, secret, sessionToken string
+	region, service                 string
+	now                             func() time.Time
+}
+
+// sign adds the date, payload hash and authorization headers to req.
+// All headers present on req, along with the host, are signed. The
+// request's URL must already be canonically encoded.
+func (s *sigV4Signer) sign(req *http.Request, payload []byte) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, s.region, s.service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secret), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEncode percent-encodes all but the unreserved characters of
+// s, as required by Signature Version 4. Slashes are left unencoded
+// if keepSlash is true.
+func awsURIEncode(s string, keepSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// canonicalQuery encodes query sorted by key, as required by
+// Signature Version 4.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k, false)+"="+awsURIEncode(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
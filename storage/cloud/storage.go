@@ -0,0 +1,186 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package cloud provides access to files in external storage, such
+// as the destinations of backups, via a common interface with
+// implementations for Amazon S3, Google Cloud Storage, Azure Blob
+// Storage, plain HTTP servers and node-local directories.
+package cloud
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// ExternalStorage provides access to the files under a base location
+// in external storage. File names are relative to the base location.
+type ExternalStorage interface {
+	// ReadFile returns a reader for the contents of the named file.
+	// The caller must close the reader.
+	ReadFile(name string) (io.ReadCloser, error)
+	// WriteFile writes the named file, replacing any existing file.
+	WriteFile(name string, content []byte) error
+	// ListFiles returns the names of all files under the base location.
+	ListFiles() ([]string, error)
+	// Delete removes the named file.
+	Delete(name string) error
+	// String returns the base location, with credentials redacted.
+	String() string
+}
+
+// Query parameters of external storage URIs which supply credentials
+// and endpoints. If a credential is not specified in the URI, it is
+// read from the environment variable of the same name.
+const (
+	S3AccessKeyParam    = "AWS_ACCESS_KEY_ID"
+	S3SecretParam       = "AWS_SECRET_ACCESS_KEY"
+	S3SessionTokenParam = "AWS_SESSION_TOKEN"
+	S3RegionParam       = "AWS_REGION"
+	S3EndpointParam     = "AWS_ENDPOINT"
+	GCSAccessKeyParam   = "GCS_ACCESS_KEY_ID"
+	GCSSecretParam      = "GCS_SECRET"
+	GCSEndpointParam    = "GCS_ENDPOINT"
+	AzureAccountParam   = "AZURE_ACCOUNT_NAME"
+	AzureKeyParam       = "AZURE_ACCOUNT_KEY"
+	AzureEndpointParam  = "AZURE_ENDPOINT"
+)
+
+// storageRetryOptions configures retries of requests to external
+// storage which fail with network errors or server errors.
+var storageRetryOptions = util.RetryOptions{
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+	Constant:    2,
+	MaxAttempts: 5,
+}
+
+// FromURI returns the external storage specified by uri. Supported
+// schemes are:
+//
+//   nodelocal:///path (or a plain path) for a directory on the local node
+//   s3://bucket/prefix for Amazon S3
+//   gs://bucket/prefix for Google Cloud Storage, using HMAC keys
+//   azure://container/prefix for Azure Blob Storage
+//   http://host/path and https://host/path for HTTP servers which
+//   support GET, PUT and DELETE
+func FromURI(uri string) (ExternalStorage, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, util.Errorf("invalid external storage URI %q: %s", uri, err)
+	}
+	switch u.Scheme {
+	case "", "nodelocal":
+		if u.Path == "" {
+			return nil, util.Errorf("external storage URI %q must specify a path", uri)
+		}
+		return &localStorage{dir: u.Path}, nil
+	case "s3":
+		return newS3Storage(u)
+	case "gs":
+		return newGCSStorage(u)
+	case "azure":
+		return newAzureStorage(u)
+	case "http", "https":
+		return &httpStorage{base: u, client: http.DefaultClient}, nil
+	default:
+		return nil, util.Errorf("unsupported external storage scheme %q", u.Scheme)
+	}
+}
+
+// credential returns the named query parameter of u, or the value of
+// the environment variable of the same name if unset.
+func credential(u *url.URL, name string) string {
+	if v := u.Query().Get(name); v != "" {
+		return v
+	}
+	return os.Getenv(name)
+}
+
+// redact returns u as a string with its query parameters, which may
+// hold credentials, removed.
+func redact(u *url.URL) string {
+	c := *u
+	c.RawQuery = ""
+	return c.String()
+}
+
+// RedactURI returns uri with its user information and query
+// parameters, which may hold credentials, removed. URIs which fail to
+// parse are redacted in full.
+func RedactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "<redacted>"
+	}
+	u.User = nil
+	return redact(u)
+}
+
+// send issues the request created by newReq with retries, returning
+// the response if its status is 2xx. Requests which fail with network
+// errors, server errors or throttling are retried. The caller must
+// close the body of the returned response.
+func send(client *http.Client, newReq func() (*http.Request, error)) (*http.Response, error) {
+	var resp *http.Response
+	var lastErr error
+	err := util.RetryWithBackoff(storageRetryOptions, func() (util.RetryStatus, error) {
+		req, err := newReq()
+		if err != nil {
+			return util.RetryBreak, err
+		}
+		if resp, err = client.Do(req); err != nil {
+			lastErr = err
+			return util.RetryContinue, err
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return util.RetryBreak, nil
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		lastErr = &StatusError{Method: req.Method, URL: redact(req.URL), StatusCode: resp.StatusCode, Body: string(body)}
+		if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+			return util.RetryContinue, lastErr
+		}
+		return util.RetryBreak, lastErr
+	})
+	if _, ok := err.(*util.RetryMaxAttemptsError); ok && lastErr != nil {
+		return nil, util.Errorf("%s (after %d attempts)", lastErr, storageRetryOptions.MaxAttempts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// A StatusError is returned on a request to external storage which
+// fails with a non-2xx status.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
 )
 
 type metaAction func(*client.KV, proto.Key, *proto.RangeDescriptor) error
@@ -50,6 +51,12 @@ func SplitRangeAddressing(db *client.KV, left, right *proto.RangeDescriptor) err
 	return nil
 }
 
+// UpdateRangeAddressing overwrites the meta1 and meta2 range
+// addressing records for the range, e.g. after its replicas change.
+func UpdateRangeAddressing(db *client.KV, desc *proto.RangeDescriptor) error {
+	return updateRangeAddressing(db, desc, putMeta)
+}
+
 // MergeRangeAddressing removes subsumed meta1 and meta2 range
 // addressing records caused by merging and updates the records for
 // the new merged range. Left is the range descriptor for the "left"
@@ -67,6 +74,21 @@ func MergeRangeAddressing(db *client.KV, left, merged *proto.RangeDescriptor) er
 // updateRangeAddressing updates or deletes the range addressing
 // metadata for the range specified by desc. The action to take is
 // specified by the supplied metaAction function.
+func updateRangeAddressing(db *client.KV, desc *proto.RangeDescriptor, action metaAction) error {
+	keys, err := rangeAddressingKeys(desc)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := action(db, key, desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeAddressingKeys returns the keys of the meta1 and meta2
+// addressing records for the range specified by desc.
 //
 // The rules for meta1 and meta2 records are as follows:
 //
@@ -78,33 +100,67 @@ func MergeRangeAddressing(db *client.KV, left, merged *proto.RangeDescriptor) er
 //     - meta2(desc.EndKey)
 //     3a. If desc.StartKey is KeyMin or meta2:
 //         - meta1(KeyMax)
-func updateRangeAddressing(db *client.KV, desc *proto.RangeDescriptor, action metaAction) error {
+func rangeAddressingKeys(desc *proto.RangeDescriptor) ([]proto.Key, error) {
 	// 1. handle illegal case of start or end key being meta1.
 	if bytes.HasPrefix(desc.EndKey, engine.KeyMeta1Prefix) ||
 		bytes.HasPrefix(desc.StartKey, engine.KeyMeta1Prefix) {
-		return util.Errorf("meta1 addressing records cannot be split: %+v", desc)
+		return nil, util.Errorf("meta1 addressing records cannot be split: %+v", desc)
 	}
 	// 2. the case of the range ending with a meta2 prefix. This means
 	// the range is full of meta2. We must update the relevant meta1
 	// entry pointing to the end of this range.
 	if bytes.HasPrefix(desc.EndKey, engine.KeyMeta2Prefix) {
-		if err := action(db, engine.RangeMetaKey(desc.EndKey), desc); err != nil {
-			return err
+		return []proto.Key{engine.RangeMetaKey(desc.EndKey)}, nil
+	}
+	// 3. the range ends with a normal user key, so we must update the
+	// relevant meta2 entry pointing to the end of this range.
+	keys := []proto.Key{engine.MakeKey(engine.KeyMeta2Prefix, desc.EndKey)}
+	// 3a. the range starts with KeyMin or a meta2 addressing record,
+	// update the meta1 entry for KeyMax.
+	if bytes.Equal(desc.StartKey, engine.KeyMin) ||
+		bytes.HasPrefix(desc.StartKey, engine.KeyMeta2Prefix) {
+		keys = append(keys, engine.MakeKey(engine.KeyMeta1Prefix, engine.KeyMax))
+	}
+	return keys, nil
+}
+
+// FreezeRanges freezes each range overlapping [start, end), or
+// unfreezes them if freeze is false. The ranges are found via their
+// meta2 addressing records. Returns the descriptors of the ranges, in
+// key order. If an error occurs, ranges preceding the failed one
+// remain frozen (or unfrozen); the call may be retried.
+func FreezeRanges(db *client.KV, start, end proto.Key, freeze bool) ([]proto.RangeDescriptor, error) {
+	// The meta2 record of a range is keyed by its end key, so the
+	// first range overlapping start is the first record after it.
+	scanReply := &proto.ScanResponse{}
+	if err := db.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.MakeKey(engine.KeyMeta2Prefix, start.Next()),
+			EndKey: engine.KeyMeta2Prefix.PrefixEnd(),
+		},
+	}, scanReply); err != nil {
+		return nil, err
+	}
+	var descs []proto.RangeDescriptor
+	for _, kv := range scanReply.Rows {
+		var desc proto.RangeDescriptor
+		if err := gogoproto.Unmarshal(kv.Value.Bytes, &desc); err != nil {
+			return nil, err
 		}
-	} else {
-		// 3. the range ends with a normal user key, so we must update the
-		// relevant meta2 entry pointing to the end of this range.
-		if err := action(db, engine.MakeKey(engine.KeyMeta2Prefix, desc.EndKey), desc); err != nil {
-			return err
+		if !desc.StartKey.Less(end) {
+			break
 		}
-		// 3a. the range starts with KeyMin or a meta2 addressing record,
-		// update the meta1 entry for KeyMax.
-		if bytes.Equal(desc.StartKey, engine.KeyMin) ||
-			bytes.HasPrefix(desc.StartKey, engine.KeyMeta2Prefix) {
-			if err := action(db, engine.MakeKey(engine.KeyMeta1Prefix, engine.KeyMax), desc); err != nil {
-				return err
-			}
+		header := proto.RequestHeader{Key: desc.StartKey}
+		var err error
+		if freeze {
+			err = db.Call(proto.AdminFreeze, &proto.AdminFreezeRequest{RequestHeader: header}, &proto.AdminFreezeResponse{})
+		} else {
+			err = db.Call(proto.AdminUnfreeze, &proto.AdminUnfreezeRequest{RequestHeader: header}, &proto.AdminUnfreezeResponse{})
 		}
+		if err != nil {
+			return nil, util.Errorf("unable to freeze=%t range %d: %s", freeze, desc.RaftID, err)
+		}
+		descs = append(descs, desc)
 	}
-	return nil
+	return descs, nil
 }
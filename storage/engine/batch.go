@@ -166,17 +166,24 @@ func (b *Batch) Merge(key proto.EncodedKey, value []byte) error {
 	return nil
 }
 
+// Updates returns the pending updates to keys from start to end, in
+// key order, as BatchPut, BatchDelete and BatchMerge values.
+func (b *Batch) Updates(start, end proto.EncodedKey) []interface{} {
+	var updates []interface{}
+	b.updates.DoRange(func(n llrb.Comparable) (done bool) {
+		updates = append(updates, n)
+		return false
+	}, proto.RawKeyValue{Key: start}, proto.RawKeyValue{Key: end})
+	return updates
+}
+
 // Commit writes all pending updates to the underlying engine in
 // an atomic write batch.
 func (b *Batch) Commit() error {
 	if b.committed {
 		panic("this batch was already committed")
 	}
-	var batch []interface{}
-	b.updates.DoRange(func(n llrb.Comparable) (done bool) {
-		batch = append(batch, n)
-		return false
-	}, proto.RawKeyValue{Key: proto.EncodedKey(KeyMin)}, proto.RawKeyValue{Key: proto.EncodedKey(KeyMax)})
+	batch := b.Updates(proto.EncodedKey(KeyMin), proto.EncodedKey(KeyMax))
 	b.committed = true
 	return b.engine.WriteBatch(batch)
 }
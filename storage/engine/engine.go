@@ -30,6 +30,13 @@ import (
 type StoreCapacity struct {
 	Capacity  int64
 	Available int64
+	// ReadAmplification is the number of files in level 0 of the LSM
+	// tree, each of which may need to be consulted by a read.
+	ReadAmplification int64
+	// CompactionDebt is the estimated number of bytes which must be
+	// compacted to bring the LSM tree's levels within their target
+	// sizes.
+	CompactionDebt int64
 }
 
 // PercentAvail computes the percentage of disk space that is available.
@@ -135,6 +142,51 @@ type Engine interface {
 	Commit() error
 }
 
+// A TimestampBounder is an engine which can cheaply bound the MVCC
+// timestamps of the versions stored in a span of keys, for example
+// from metadata of the files holding them.
+type TimestampBounder interface {
+	// TimestampBounds returns the minimum and maximum wall times of
+	// the MVCC versions stored between start and end. The bounds are
+	// conservative: they may include versions outside of the span.
+	// Recently written versions which aren't yet covered by the
+	// metadata may be missed. ok is false if the bounds are unknown. If
+	// no versions are stored in the span, min is greater than max.
+	TimestampBounds(start, end proto.EncodedKey) (min, max int64, ok bool, err error)
+}
+
+// A Checkpointer is an engine which can create checkpoints:
+// consistent, point-in-time copies of its data which can be opened as
+// engines of their own.
+type Checkpointer interface {
+	// Checkpoint creates a checkpoint of the engine in dir, which must
+	// not yet exist.
+	Checkpoint(dir string) error
+}
+
+// A Syncer is an engine with a write-ahead log which can be synced
+// on demand, allowing the latency of its fsyncs to be monitored.
+type Syncer interface {
+	// SyncWAL syncs the engine's write-ahead log to disk, returning
+	// once the sync completes.
+	SyncWAL() error
+}
+
+// NewBackgroundSnapshot returns a snapshot of the engine for use by
+// background scans, such as GC and verification passes over entire
+// ranges. Where the engine supports it, reads through the snapshot
+// populate only the share of the block cache reserved for background
+// scans, or none of it if no share is reserved, so that a background
+// scan does not evict the working set of foreground reads. Otherwise,
+// this is equivalent to engine.NewSnapshot().
+func NewBackgroundSnapshot(engine Engine) Engine {
+	// Snapshots are read-only, so a fault engine's faults don't apply.
+	if r, ok := Unwrap(engine).(*RocksDB); ok {
+		return r.NewBackgroundSnapshot()
+	}
+	return engine.NewSnapshot()
+}
+
 // A BatchDelete is a delete operation executed as part of an atomic batch.
 type BatchDelete struct {
 	proto.RawKeyValue
@@ -546,6 +546,33 @@ func TestSnapshot(t *testing.T) {
 	}, t)
 }
 
+// TestBackgroundSnapshot verifies that a background snapshot, whose
+// reads fill at most the background share of the block cache,
+// provides the same isolation as a regular snapshot.
+func TestBackgroundSnapshot(t *testing.T) {
+	runWithAllEngines(func(engine Engine, t *testing.T) {
+		key := proto.EncodedKey("a")
+		if err := engine.Put(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		snap := NewBackgroundSnapshot(engine)
+		defer snap.Stop()
+		if err := engine.Put(key, []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := snap.Get(key); err != nil || !bytes.Equal(val, []byte("1")) {
+			t.Errorf("expected snapshot value 1; got %q, %v", val, err)
+		}
+		keyvals, err := Scan(snap, key, proto.EncodedKey(KeyMax), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keyvals) != 1 || !bytes.Equal(keyvals[0].Value, []byte("1")) {
+			t.Errorf("expected snapshot scan to return value 1; got %+v", keyvals)
+		}
+	}, t)
+}
+
 // TestSnapshotMethods verifies that snapshots allow only read-only
 // engine operations.
 func TestSnapshotMethods(t *testing.T) {
@@ -0,0 +1,127 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package engine
+
+import (
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/fault"
+)
+
+// faultEngine wraps an Engine, consulting the fault package before
+// each mutation. Reads are passed through unchanged.
+type faultEngine struct {
+	Engine
+}
+
+// faultDiskEngine is a faultEngine wrapping an engine which also
+// supports checkpoints, write-ahead log syncs and timestamp bounds,
+// such as RocksDB. Embedding Engine alone would hide these.
+type faultDiskEngine struct {
+	faultEngine
+	disk diskEngine
+}
+
+// A diskEngine is an engine supporting all of the optional engine
+// interfaces.
+type diskEngine interface {
+	Engine
+	Checkpointer
+	Syncer
+	TimestampBounder
+}
+
+// NewFaultEngine returns an engine which wraps e and injects write
+// errors (fault.EngineWrite) and slow syncs (fault.EngineSync) as
+// directed by the installed fault.Injector. The returned engine
+// implements the Checkpointer, Syncer and TimestampBounder interfaces
+// if e implements all of them.
+func NewFaultEngine(e Engine) Engine {
+	if d, ok := e.(diskEngine); ok {
+		return &faultDiskEngine{faultEngine: faultEngine{Engine: e}, disk: d}
+	}
+	return &faultEngine{Engine: e}
+}
+
+// Unwrap returns the engine wrapped by e if e is a fault engine, and
+// e itself otherwise. Use it before asserting the concrete type of an
+// engine.
+func Unwrap(e Engine) Engine {
+	switch fe := e.(type) {
+	case *faultEngine:
+		return fe.Engine
+	case *faultDiskEngine:
+		return fe.Engine
+	}
+	return e
+}
+
+func (fe *faultEngine) Put(key proto.EncodedKey, value []byte) error {
+	if err := fault.MaybeError(fault.EngineWrite); err != nil {
+		return err
+	}
+	return fe.Engine.Put(key, value)
+}
+
+func (fe *faultEngine) Clear(key proto.EncodedKey) error {
+	if err := fault.MaybeError(fault.EngineWrite); err != nil {
+		return err
+	}
+	return fe.Engine.Clear(key)
+}
+
+func (fe *faultEngine) Merge(key proto.EncodedKey, value []byte) error {
+	if err := fault.MaybeError(fault.EngineWrite); err != nil {
+		return err
+	}
+	return fe.Engine.Merge(key, value)
+}
+
+func (fe *faultEngine) WriteBatch(cmds []interface{}) error {
+	if err := fault.MaybeError(fault.EngineWrite); err != nil {
+		return err
+	}
+	fault.MaybeDelay(fault.EngineSync)
+	return fe.Engine.WriteBatch(cmds)
+}
+
+func (fe *faultEngine) NewBatch() Engine {
+	return &faultEngine{Engine: fe.Engine.NewBatch()}
+}
+
+func (fe *faultEngine) Commit() error {
+	if err := fault.MaybeError(fault.EngineWrite); err != nil {
+		return err
+	}
+	fault.MaybeDelay(fault.EngineSync)
+	return fe.Engine.Commit()
+}
+
+// Checkpoint implements the Checkpointer interface.
+func (fe *faultDiskEngine) Checkpoint(dir string) error {
+	return fe.disk.Checkpoint(dir)
+}
+
+// SyncWAL implements the Syncer interface, delaying the sync as
+// directed by fault.EngineSync.
+func (fe *faultDiskEngine) SyncWAL() error {
+	fault.MaybeDelay(fault.EngineSync)
+	return fe.disk.SyncWAL()
+}
+
+// TimestampBounds implements the TimestampBounder interface.
+func (fe *faultDiskEngine) TimestampBounds(start, end proto.EncodedKey) (int64, int64, bool, error) {
+	return fe.disk.TimestampBounds(start, end)
+}
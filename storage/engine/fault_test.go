@@ -0,0 +1,93 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package engine
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/fault"
+)
+
+// TestFaultEngine verifies that writes through a fault engine, both
+// direct and batched, fail when write errors are injected and succeed
+// otherwise.
+func TestFaultEngine(t *testing.T) {
+	defer fault.SetInjector(nil)
+	e := NewFaultEngine(NewInMem(proto.Attributes{}, 1<<20))
+	key := proto.EncodedKey("a")
+
+	fault.SetInjector(fault.NewRandomInjector(0, map[string]fault.Spec{
+		fault.EngineWrite: {ErrorProbability: 1},
+	}))
+	if err := e.Put(key, []byte("value")); err == nil {
+		t.Error("expected injected error on put")
+	}
+	b := e.NewBatch()
+	if err := b.Commit(); err == nil {
+		t.Error("expected injected error on batch commit")
+	}
+
+	fault.SetInjector(nil)
+	if err := e.Put(key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	val, err := e.Get(key)
+	if err != nil || string(val) != "value" {
+		t.Errorf("expected \"value\"; got %q, %v", val, err)
+	}
+}
+
+// TestFaultEngineInterfaces verifies that a fault engine implements
+// the optional engine interfaces exactly when the engine it wraps
+// does, and that Unwrap returns the wrapped engine.
+func TestFaultEngineInterfaces(t *testing.T) {
+	inMem := NewInMem(proto.Attributes{}, 1<<20)
+	fe := NewFaultEngine(inMem)
+	if _, ok := fe.(Checkpointer); ok {
+		t.Error("expected fault engine of an in-memory engine not to be a Checkpointer")
+	}
+	if Unwrap(fe) != inMem {
+		t.Errorf("expected the in-memory engine to be unwrapped; got %v", Unwrap(fe))
+	}
+
+	loc := util.CreateTempDirectory()
+	defer os.RemoveAll(loc)
+	rocksdb := NewRocksDB(proto.Attributes{}, loc)
+	if err := rocksdb.Start(); err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	defer rocksdb.Stop()
+	fe = NewFaultEngine(rocksdb)
+	if _, ok := fe.(Checkpointer); !ok {
+		t.Error("expected fault engine of rocksdb to be a Checkpointer")
+	}
+	if _, ok := fe.(TimestampBounder); !ok {
+		t.Error("expected fault engine of rocksdb to be a TimestampBounder")
+	}
+	syncer, ok := fe.(Syncer)
+	if !ok {
+		t.Fatal("expected fault engine of rocksdb to be a Syncer")
+	}
+	if err := syncer.SyncWAL(); err != nil {
+		t.Error(err)
+	}
+	if Unwrap(fe) != rocksdb {
+		t.Errorf("expected rocksdb to be unwrapped; got %v", Unwrap(fe))
+	}
+}
@@ -25,8 +25,8 @@ import (
 )
 
 // GarbageCollector GCs MVCC key/values using a zone-specific GC
-// policy allows either the union or intersection of maximum # of
-// versions and maximum age.
+// policy which collects versions beyond either a maximum # of
+// versions or a maximum age.
 type GarbageCollector struct {
 	now      proto.Timestamp // time at start of GC
 	policyFn func(key proto.Key) *proto.GCPolicy
@@ -52,7 +52,8 @@ func (gc *GarbageCollector) MVCCPrefix(key proto.EncodedKey) int {
 // The GC policy is determined via the policyFn specified when the
 // GarbageCollector was created. Returns a slice of deletions, one
 // per incoming keys. If an index in the returned array is set to
-// true, then that value will be garbage collected.
+// true, then that value will be garbage collected. A key without
+// versions, such as an inline value, is never garbage collected.
 func (gc *GarbageCollector) Filter(keys []proto.EncodedKey, values [][]byte) []bool {
 	if len(keys) == 1 {
 		return nil
@@ -66,7 +67,7 @@ func (gc *GarbageCollector) Filter(keys []proto.EncodedKey, values [][]byte) []b
 	}
 	// Using first key, look up the policy which applies to this set of MVCC values.
 	policy := gc.policyFn(dKey)
-	if policy == nil || policy.TTLSeconds <= 0 {
+	if policy == nil || (policy.TTLSeconds <= 0 && policy.MaxVersions <= 0) {
 		return nil
 	}
 	expiration := gc.now
@@ -91,8 +92,10 @@ func (gc *GarbageCollector) Filter(keys []proto.EncodedKey, values [][]byte) []b
 				survivors = true
 			}
 		} else {
-			if ts.Less(expiration) {
-				// If we encounter a version older than our GC timestamp, mark for deletion.
+			if (policy.TTLSeconds > 0 && ts.Less(expiration)) ||
+				(policy.MaxVersions > 0 && i >= int(policy.MaxVersions)) {
+				// If we encounter a version older than our GC timestamp or
+				// beyond the maximum number of versions, mark for deletion.
 				toDelete[i+1] = true
 			} else if !mvccVal.Deleted {
 				// Otherwise, if not marked for GC and not a tombstone, set survivors true.
@@ -135,3 +135,40 @@ func TestGarbageCollectorFilter(t *testing.T) {
 		}
 	}
 }
+
+// TestGarbageCollectorFilterMaxVersions verifies that versions beyond
+// the policy's maximum number of versions are garbage collected
+// regardless of their age, in addition to those older than the TTL.
+func TestGarbageCollectorFilterMaxVersions(t *testing.T) {
+	var policy proto.GCPolicy
+	gc := NewGarbageCollector(makeTS(0, 0), func(key proto.Key) *proto.GCPolicy {
+		return &policy
+	})
+	e := []byte{}
+	n := serializedMVCCValue(false, t)
+	d := serializedMVCCValue(true, t)
+	testData := []struct {
+		time        proto.Timestamp
+		ttlSeconds  int32
+		maxVersions int32
+		values      [][]byte
+		expDelete   []bool
+	}{
+		{makeTS(0, 0), 0, 0, [][]byte{e, n, n, n}, nil},
+		{makeTS(0, 0), 0, 1, [][]byte{e, n, n, n}, []bool{false, false, true, true}},
+		{makeTS(0, 0), 0, 2, [][]byte{e, n, n, n}, []bool{false, false, false, true}},
+		{makeTS(0, 0), 0, 3, [][]byte{e, n, n, n}, []bool{false, false, false, false}},
+		{makeTS(0, 0), 0, 1, [][]byte{e, d, n, n}, []bool{true, true, true, true}},
+		{makeTS(0, 0), 0, 2, [][]byte{e, d, n, n}, []bool{false, false, false, true}},
+		{makeTS(3E9, 0), 1, 3, [][]byte{e, n, n, n}, []bool{false, false, true, true}},
+		{makeTS(2E9, 0), 1, 2, [][]byte{e, n, n, n}, []bool{false, false, false, true}},
+	}
+	for i, test := range testData {
+		gc.now = test.time
+		policy = proto.GCPolicy{TTLSeconds: test.ttlSeconds, MaxVersions: test.maxVersions}
+		toDelete := gc.Filter(aKeys, test.values)
+		if !reflect.DeepEqual(toDelete, test.expDelete) {
+			t.Errorf("expected deletions (test %d): %v; got %v", i, test.expDelete, toDelete)
+		}
+	}
+}
@@ -44,6 +44,43 @@ func StoreIdentKey() proto.Key {
 	return MakeStoreKey(KeyLocalStoreIdentSuffix, proto.Key{})
 }
 
+// StoreVersionKey returns a store-local key for the store's on-disk
+// format version.
+func StoreVersionKey() proto.Key {
+	return MakeStoreKey(KeyLocalStoreVersionSuffix, proto.Key{})
+}
+
+// StoreHeartbeatKey returns a store-local key for the timestamp of
+// the store's most recent disk heartbeat.
+func StoreHeartbeatKey() proto.Key {
+	return MakeStoreKey(KeyLocalStoreHeartbeatSuffix, proto.Key{})
+}
+
+// StoreAttrsKey returns a store-local key for the attributes with
+// which the store was last started.
+func StoreAttrsKey() proto.Key {
+	return MakeStoreKey(KeyLocalStoreAttrsSuffix, proto.Key{})
+}
+
+// StoreQueueCheckpointKey returns a store-local key for the
+// checkpoint of the named range queue.
+func StoreQueueCheckpointKey(queue string) proto.Key {
+	return MakeStoreKey(KeyLocalStoreQueueSuffix, proto.Key(queue))
+}
+
+// StoreGossipSnapshotKey returns a store-local key for the snapshot
+// of the cluster membership last known to the store's node.
+func StoreGossipSnapshotKey() proto.Key {
+	return MakeStoreKey(KeyLocalStoreGossipSuffix, proto.Key{})
+}
+
+// StoreRelocationKey returns a store-local key marking the data of
+// the range with the given Raft ID as copied to the store by an
+// unfinished relocation.
+func StoreRelocationKey(raftID int64) proto.Key {
+	return MakeStoreKey(KeyLocalStoreRelocationSuffix, encoding.EncodeInt(nil, raftID))
+}
+
 // MakeRangeIDKey creates a range-local key based on the range's
 // Raft ID, metadata key suffix, and optional detail (e.g. the
 // encoded command ID for a response cache entry, etc.).
@@ -70,6 +107,18 @@ func RaftStateKey(raftID int64) proto.Key {
 	return MakeRangeIDKey(raftID, KeyLocalRaftStateSuffix, proto.Key{})
 }
 
+// RangeFrozenKey returns a range-local key by Raft ID which is present
+// while the range is frozen.
+func RangeFrozenKey(raftID int64) proto.Key {
+	return MakeRangeIDKey(raftID, KeyLocalRangeFrozenSuffix, proto.Key{})
+}
+
+// RangeLeaseAppliedIndexKey returns a range-local key by Raft ID
+// holding the lease index of the last command applied to the range.
+func RangeLeaseAppliedIndexKey(raftID int64) proto.Key {
+	return MakeRangeIDKey(raftID, KeyLocalRangeLeaseAppliedIndexSuffix, proto.Key{})
+}
+
 // DecodeRaftStateKey extracts the Raft ID from a RaftStateKey.
 func DecodeRaftStateKey(key proto.Key) int64 {
 	if !bytes.HasPrefix(key, KeyLocalRangeIDPrefix) {
@@ -81,6 +130,23 @@ func DecodeRaftStateKey(key proto.Key) int64 {
 	return raftID
 }
 
+// DecodeRangeIDKey decodes a range-local key by Raft ID into the
+// Raft ID, suffix and optional detail (may be nil).
+func DecodeRangeIDKey(key proto.Key) (raftID int64, suffix, detail proto.Key) {
+	if !bytes.HasPrefix(key, KeyLocalRangeIDPrefix) {
+		panic(fmt.Sprintf("key %q does not have %q prefix", key, KeyLocalRangeIDPrefix))
+	}
+	// Cut the prefix and the Raft ID.
+	b := key[len(KeyLocalRangeIDPrefix):]
+	b, raftID = encoding.DecodeInt(b)
+	if len(b) < KeyLocalSuffixLength {
+		panic(fmt.Sprintf("key %q does not have suffix of length %d", key, KeyLocalSuffixLength))
+	}
+	suffix = b[:KeyLocalSuffixLength]
+	detail = b[KeyLocalSuffixLength:]
+	return
+}
+
 // ResponseCacheKey returns a range-local key by Raft ID for a
 // response cache entry, with detail specified by encoding the
 // supplied client command ID.
@@ -140,6 +206,45 @@ func TransactionKey(key proto.Key, id []byte) proto.Key {
 	return MakeRangeKey(key, KeyLocalTransactionSuffix, proto.Key(id))
 }
 
+// SessionKey returns the key for the record of the HTTP session with
+// the given ID.
+func SessionKey(id string) proto.Key {
+	return MakeKey(KeySessionPrefix, proto.Key(id))
+}
+
+// GroupKey returns the key for the membership of the group with the
+// given name.
+func GroupKey(name string) proto.Key {
+	return MakeKey(KeyGroupPrefix, proto.Key(name))
+}
+
+// JobKey returns the key for the record of the job with the given
+// ID. IDs are encoded so that job records sort by ID.
+func JobKey(id int64) proto.Key {
+	return MakeKey(KeyJobPrefix, encoding.EncodeUint64(nil, uint64(id)))
+}
+
+// SchemaLeasePrefix returns the prefix of the keys of the leases on
+// versions of the structured schema with the given key.
+func SchemaLeasePrefix(schemaKey string) proto.Key {
+	return MakeKey(KeySchemaLeasePrefix, encoding.EncodeBinary(nil, []byte(schemaKey)))
+}
+
+// SchemaLeaseKey returns the key for the lease held by a node on a
+// version of the structured schema with the given key. Leases sort by
+// version.
+func SchemaLeaseKey(schemaKey string, version int64, nodeID int32) proto.Key {
+	return MakeKey(SchemaLeasePrefix(schemaKey), encoding.EncodeUint64(nil, uint64(version)),
+		encoding.EncodeUint32(nil, uint32(nodeID)))
+}
+
+// TableStatsKey returns the key for the statistics of the named table
+// of the structured schema with the given key.
+func TableStatsKey(schemaKey, table string) proto.Key {
+	return MakeKey(KeyTableStatsPrefix, encoding.EncodeBinary(nil, []byte(schemaKey)),
+		encoding.EncodeBinary(nil, []byte(table)))
+}
+
 // KeyAddress returns the address for the key, used to lookup the
 // range containing the key. In the normal case, this is simply the
 // key's value. However, for local keys, such as transaction records,
@@ -237,6 +342,9 @@ var (
 	KeyMin = proto.KeyMin
 	// KeyMax is a maximum key value which sorts after all other keys.
 	KeyMax = proto.KeyMax
+	// KeyTenantPrefix is the prefix of the keys of tenants; see
+	// proto.TenantPrefix.
+	KeyTenantPrefix = proto.KeyTenantPrefix
 
 	// KeyLocalPrefix is the prefix for keys which hold data local to a
 	// RocksDB instance, such as store and range-specific metadata which
@@ -275,6 +383,24 @@ var (
 	KeyLocalStoreIdentSuffix = proto.Key("iden")
 	// KeyLocalStoreStatSuffix is the suffix for store statistics.
 	KeyLocalStoreStatSuffix = proto.Key("sst-")
+	// KeyLocalStoreVersionSuffix stores the on-disk format version of
+	// the store, advanced by store migrations.
+	KeyLocalStoreVersionSuffix = proto.Key("vers")
+	// KeyLocalStoreHeartbeatSuffix is the suffix for the store's disk
+	// heartbeat, rewritten periodically to detect stalled disks.
+	KeyLocalStoreHeartbeatSuffix = proto.Key("hbt-")
+	// KeyLocalStoreAttrsSuffix stores the attributes with which the
+	// store was last started, to detect changes across restarts.
+	KeyLocalStoreAttrsSuffix = proto.Key("attr")
+	// KeyLocalStoreQueueSuffix is the suffix for the checkpoints of the
+	// store's range queues. The detail is the queue name.
+	KeyLocalStoreQueueSuffix = proto.Key("que-")
+	// KeyLocalStoreGossipSuffix stores the cluster membership last
+	// known to the store's node, restored into gossip on startup.
+	KeyLocalStoreGossipSuffix = proto.Key("goss")
+	// KeyLocalStoreRelocationSuffix marks ranges copied to the store by
+	// relocations which have yet to finish. The detail is the Raft ID.
+	KeyLocalStoreRelocationSuffix = proto.Key("rloc")
 
 	// KeyLocalRangeIDPrefix is the prefix identifying per-range data
 	// indexed by Raft ID. The Raft ID is appended to this prefix,
@@ -289,6 +415,12 @@ var (
 	KeyLocalRaftStateSuffix = proto.Key("rfts")
 	// KeyLocalRangeStatSuffix is the suffix for range statistics.
 	KeyLocalRangeStatSuffix = proto.Key("rst-")
+	// KeyLocalRangeFrozenSuffix is the suffix for the key marking a
+	// range as frozen. The value is the timestamp of the freeze.
+	KeyLocalRangeFrozenSuffix = proto.Key("frzn")
+	// KeyLocalRangeLeaseAppliedIndexSuffix is the suffix for the lease
+	// index of the last command applied to the range.
+	KeyLocalRangeLeaseAppliedIndexSuffix = proto.Key("rlai")
 	// KeyLocalResponseCacheSuffix is the suffix for keys storing
 	// command responses used to guarantee idempotency (see
 	// ResponseCache).
@@ -337,6 +469,9 @@ var (
 	// KeyMetaMax is the end of the range of addressing keys.
 	KeyMetaMax = MakeKey(KeySystemPrefix, proto.Key("\x01"))
 
+	// KeyBackupSchedulePrefix specifies the key prefix for backup
+	// schedules. The suffix is the schedule name.
+	KeyBackupSchedulePrefix = MakeKey(KeySystemPrefix, proto.Key("bsched-"))
 	// KeyConfigAccountingPrefix specifies the key prefix for accounting
 	// configurations. The suffix is the affected key prefix.
 	KeyConfigAccountingPrefix = MakeKey(KeySystemPrefix, proto.Key("acct"))
@@ -346,12 +481,39 @@ var (
 	// KeyConfigZonePrefix specifies the key prefix for zone
 	// configurations. The suffix is the affected key prefix.
 	KeyConfigZonePrefix = MakeKey(KeySystemPrefix, proto.Key("zone"))
+	// KeyGroupPrefix specifies the key prefix for the memberships of
+	// groups of users. The suffix is the group name.
+	KeyGroupPrefix = MakeKey(KeySystemPrefix, proto.Key("group-"))
+	// KeyJobPrefix specifies the key prefix for job records. The suffix
+	// is the encoded job ID.
+	KeyJobPrefix = MakeKey(KeySystemPrefix, proto.Key("job-"))
+	// KeyJobIDGenerator is the global job ID generator sequence.
+	KeyJobIDGenerator = MakeKey(KeySystemPrefix, proto.Key("jobs-idgen"))
 	// KeyNodeIDGenerator is the global node ID generator sequence.
 	KeyNodeIDGenerator = MakeKey(KeySystemPrefix, proto.Key("node-idgen"))
 	// KeyRaftIDGenerator is the global Raft consensus group ID generator sequence.
 	KeyRaftIDGenerator = MakeKey(KeySystemPrefix, proto.Key("raft-idgen"))
+	// KeySequencePrefix specifies the key prefix for named sequences.
+	// The suffix is the sequence name and the value its most recently
+	// allocated value.
+	KeySequencePrefix = MakeKey(KeySystemPrefix, proto.Key("seq-"))
+	// KeySessionPrefix specifies the key prefix for the records of
+	// HTTP sessions. The suffix is the session ID.
+	KeySessionPrefix = MakeKey(KeySystemPrefix, proto.Key("session-"))
+	// KeySessionSecret is the key of the secret with which session
+	// cookies are signed.
+	KeySessionSecret = MakeKey(KeySystemPrefix, proto.Key("session_secret"))
+	// KeySettingPrefix specifies the key prefix for cluster settings.
+	// The suffix is the setting name and the value its string encoding.
+	KeySettingPrefix = MakeKey(KeySystemPrefix, proto.Key("setting-"))
 	// KeySchemaPrefix specifies key prefixes for schema definitions.
 	KeySchemaPrefix = MakeKey(KeySystemPrefix, proto.Key("schema"))
+	// KeySchemaLeasePrefix specifies the key prefix for leases on
+	// versions of schemas; see SchemaLeaseKey.
+	KeySchemaLeasePrefix = MakeKey(KeySystemPrefix, proto.Key("slease-"))
+	// KeyTableStatsPrefix specifies the key prefix for statistics of
+	// the tables of structured schemas; see TableStatsKey.
+	KeyTableStatsPrefix = MakeKey(KeySystemPrefix, proto.Key("tstats-"))
 	// KeyStoreIDGeneratorPrefix specifies key prefixes for sequence
 	// generators, one per node, for store IDs.
 	KeyStoreIDGeneratorPrefix = MakeKey(KeySystemPrefix, proto.Key("store-idgen-"))
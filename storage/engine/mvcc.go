@@ -33,6 +33,12 @@ import (
 const (
 	// The size of the reservoir used by FindSplitKey.
 	splitReservoirSize = 100
+	// maxIntentScanKeys is the maximum number of keys examined by a
+	// scan for further intents of a transaction it conflicts with.
+	maxIntentScanKeys = 1000
+	// maxAdditionalIntents is the maximum number of further intents
+	// reported in a WriteIntentError by a scan.
+	maxAdditionalIntents = 100
 )
 
 // MVCCStats tracks byte and instance counts for:
@@ -308,6 +314,18 @@ func MVCCPutProto(engine Engine, ms *MVCCStats, key proto.Key, timestamp proto.T
 // keyB : MVCCMetadata of keyB
 // ...
 func MVCCGet(engine Engine, key proto.Key, timestamp proto.Timestamp, txn *proto.Transaction) (*proto.Value, error) {
+	return mvccGet(engine, key, timestamp, txn, true)
+}
+
+// MVCCGetInconsistent is like MVCCGet outside of a transaction, but
+// skips write intents instead of returning a WriteIntentError,
+// returning the most recent committed value as of timestamp.
+func MVCCGetInconsistent(engine Engine, key proto.Key, timestamp proto.Timestamp) (*proto.Value, error) {
+	return mvccGet(engine, key, timestamp, nil, false)
+}
+
+// mvccGet implements MVCCGet and MVCCGetInconsistent.
+func mvccGet(engine Engine, key proto.Key, timestamp proto.Timestamp, txn *proto.Transaction, consistent bool) (*proto.Value, error) {
 	if len(key) == 0 {
 		return nil, emptyKeyError()
 	}
@@ -329,7 +347,7 @@ func MVCCGet(engine Engine, key proto.Key, timestamp proto.Timestamp, txn *proto
 		return nil, err
 	}
 
-	return mvccGetInternal(engine, key, proto.RawKeyValue{Key: metaKey, Value: data}, timestamp, txn, earlier)
+	return mvccGetInternal(engine, key, proto.RawKeyValue{Key: metaKey, Value: data}, timestamp, txn, consistent, earlier)
 }
 
 // getEarlierFunc fetches an earlier version of a key starting at
@@ -340,10 +358,12 @@ type getEarlierFunc func(engine Engine, start, end proto.EncodedKey) (proto.RawK
 
 // mvccGetInternal parses the MVCCMetadata from the specified raw key
 // value, and reads the versioned value indicated by timestamp, taking
-// the transaction txn into account. earlier is a helper function to
-// get an earlier version of the value when doing historical reads.
+// the transaction txn into account. If consistent is false, intents
+// of other transactions are skipped instead of returning an error.
+// earlier is a helper function to get an earlier version of the value
+// when doing historical reads.
 func mvccGetInternal(engine Engine, key proto.Key, kv proto.RawKeyValue, timestamp proto.Timestamp,
-	txn *proto.Transaction, earlier getEarlierFunc) (*proto.Value, error) {
+	txn *proto.Transaction, consistent bool, earlier getEarlierFunc) (*proto.Value, error) {
 	meta := &proto.MVCCMetadata{}
 	err := gogoproto.Unmarshal(kv.Value, meta)
 	if err != nil {
@@ -358,7 +378,7 @@ func mvccGetInternal(engine Engine, key proto.Key, kv proto.RawKeyValue, timesta
 	// latest write and current read are within the same transaction.
 	if !timestamp.Less(meta.Timestamp) ||
 		(meta.Txn != nil && txn != nil && bytes.Equal(meta.Txn.ID, txn.ID)) {
-		if meta.Txn != nil && (txn == nil || !bytes.Equal(meta.Txn.ID, txn.ID)) {
+		if meta.Txn != nil && (txn == nil || !bytes.Equal(meta.Txn.ID, txn.ID)) && consistent {
 			// Trying to read the last value, but it's another transaction's
 			// intent; the reader will have to act on this.
 			return nil, &proto.WriteIntentError{Key: key, Txn: *meta.Txn}
@@ -368,8 +388,9 @@ func mvccGetInternal(engine Engine, key proto.Key, kv proto.RawKeyValue, timesta
 		// Check for case where we're reading our own txn's intent
 		// but it's got a different epoch. This can happen if the
 		// txn was restarted and an earlier iteration wrote the value
-		// we're now reading. In this case, we skip the intent.
-		if meta.Txn != nil && txn.Epoch != meta.Txn.Epoch {
+		// we're now reading. In this case, we skip the intent. An
+		// inconsistent read skips any intent it encounters.
+		if meta.Txn != nil && (txn == nil || txn.Epoch != meta.Txn.Epoch) {
 			kv, err = earlier(engine, latestKey.Next(), MVCCEncodeKey(key.Next()))
 		} else {
 			kv.Key = latestKey
@@ -462,18 +483,36 @@ func MVCCPut(engine Engine, ms *MVCCStats, key proto.Key, timestamp proto.Timest
 			"the timestamp %+v provided in value does not match the timestamp %+v in request",
 			value.Timestamp, timestamp)
 	}
-	return mvccPutInternal(engine, ms, key, timestamp, proto.MVCCValue{Value: &value}, txn)
+	return mvccPutInternal(engine, ms, key, timestamp, proto.MVCCValue{Value: &value}, txn, nil)
+}
+
+// MVCCPutExpiring is like MVCCPut, but additionally records an
+// expiration in the key's MVCC metadata, after which the key and all
+// of its versions are deleted by garbage collection.
+func MVCCPutExpiring(engine Engine, ms *MVCCStats, key proto.Key, timestamp proto.Timestamp, value proto.Value,
+	txn *proto.Transaction, expiration proto.Timestamp) error {
+	if timestamp.Equal(proto.ZeroTimestamp) {
+		return util.Errorf("key %q: inline values cannot expire", key)
+	}
+	if value.Timestamp != nil && !value.Timestamp.Equal(timestamp) {
+		return util.Errorf(
+			"the timestamp %+v provided in value does not match the timestamp %+v in request",
+			value.Timestamp, timestamp)
+	}
+	return mvccPutInternal(engine, ms, key, timestamp, proto.MVCCValue{Value: &value}, txn, &expiration)
 }
 
 // MVCCDelete marks the key deleted so that it will not be returned in
 // future get responses.
 func MVCCDelete(engine Engine, ms *MVCCStats, key proto.Key, timestamp proto.Timestamp, txn *proto.Transaction) error {
-	return mvccPutInternal(engine, ms, key, timestamp, proto.MVCCValue{Deleted: true}, txn)
+	return mvccPutInternal(engine, ms, key, timestamp, proto.MVCCValue{Deleted: true}, txn, nil)
 }
 
 // mvccPutInternal adds a new timestamped value to the specified key.
-// If value is nil, creates a deletion tombstone value.
-func mvccPutInternal(engine Engine, ms *MVCCStats, key proto.Key, timestamp proto.Timestamp, value proto.MVCCValue, txn *proto.Transaction) error {
+// If value is nil, creates a deletion tombstone value. The key's
+// expiration is set to expiration, which may be nil.
+func mvccPutInternal(engine Engine, ms *MVCCStats, key proto.Key, timestamp proto.Timestamp, value proto.MVCCValue,
+	txn *proto.Transaction, expiration *proto.Timestamp) error {
 	if len(key) == 0 {
 		return emptyKeyError()
 	}
@@ -563,6 +602,7 @@ func mvccPutInternal(engine Engine, ms *MVCCStats, key proto.Key, timestamp prot
 	newMeta.KeyBytes = valueKeySize
 	newMeta.ValBytes = valueSize
 	newMeta.Deleted = value.Deleted
+	newMeta.Expiration = expiration
 	metaKeySize, metaValSize, err := PutProto(engine, metaKey, newMeta)
 	if err != nil {
 		return err
@@ -590,10 +630,9 @@ func MVCCIncrement(engine Engine, ms *MVCCStats, key proto.Key, timestamp proto.
 	var int64Val int64
 	// If the value exists, verify it's an integer type not a byte slice.
 	if value != nil {
-		if value.Bytes != nil || value.Integer == nil {
+		if int64Val, err = value.GetInt(); err != nil {
 			return 0, util.Errorf("cannot increment key %q which already has a generic byte value: %+v", key, *value)
 		}
-		int64Val = value.GetInteger()
 	}
 
 	// Check for overflow and underflow.
@@ -607,7 +646,8 @@ func MVCCIncrement(engine Engine, ms *MVCCStats, key proto.Key, timestamp proto.
 	}
 
 	r := int64Val + inc
-	value = &proto.Value{Integer: gogoproto.Int64(r)}
+	value = &proto.Value{}
+	value.SetInt(r)
 	value.InitChecksum(key)
 	return r, MVCCPut(engine, ms, key, timestamp, *value, txn)
 }
@@ -625,7 +665,16 @@ func MVCCConditionalPut(engine Engine, ms *MVCCStats, key proto.Key, timestamp p
 	if err != nil {
 		return err
 	}
+	if err := CheckCondition(expValue, existVal); err != nil {
+		return err
+	}
+	return MVCCPut(engine, ms, key, timestamp, value, txn)
+}
 
+// CheckCondition returns a ConditionFailedError containing the
+// existing value if it does not match the expected value. A nil
+// expected value matches only a missing existing value.
+func CheckCondition(expValue, existVal *proto.Value) error {
 	if expValue == nil && existVal != nil {
 		return &proto.ConditionFailedError{
 			ActualValue: existVal,
@@ -638,14 +687,15 @@ func MVCCConditionalPut(engine Engine, ms *MVCCStats, key proto.Key, timestamp p
 			return &proto.ConditionFailedError{
 				ActualValue: existVal,
 			}
-		} else if expValue.Integer != nil && (existVal.Integer == nil || expValue.GetInteger() != existVal.GetInteger()) {
-			return &proto.ConditionFailedError{
-				ActualValue: existVal,
+		} else if expInt, err := expValue.GetInt(); err == nil {
+			if existInt, err := existVal.GetInt(); err != nil || expInt != existInt {
+				return &proto.ConditionFailedError{
+					ActualValue: existVal,
+				}
 			}
 		}
 	}
-
-	return MVCCPut(engine, ms, key, timestamp, value, txn)
+	return nil
 }
 
 // MVCCMerge implements a merge operation. Merge adds integer values,
@@ -671,31 +721,70 @@ func MVCCMerge(engine Engine, ms *MVCCStats, key proto.Key, value proto.Value) e
 }
 
 // MVCCDeleteRange deletes the range of key/value pairs specified by
-// start and end keys. Specify max=0 for unbounded deletes.
+// start and end keys. Specify max=0 for unbounded deletes. Inline
+// values within the range have no versions and are cleared
+// immediately; as they can't hold intents, deleting them in a
+// transaction is an error and nothing is deleted.
 func MVCCDeleteRange(engine Engine, ms *MVCCStats, key, endKey proto.Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) (int64, error) {
+	num, _, err := MVCCDeleteRangeKeys(engine, ms, key, endKey, max, 0, timestamp, txn)
+	return num, err
+}
+
+// MVCCDeleteRangeKeys is like MVCCDeleteRange but additionally
+// returns up to maxKeys of the deleted keys, along with the
+// timestamps of the values they held.
+func MVCCDeleteRangeKeys(engine Engine, ms *MVCCStats, key, endKey proto.Key, max, maxKeys int64, timestamp proto.Timestamp, txn *proto.Transaction) (int64, []proto.DeletedKey, error) {
 	// In order to detect the potential write intent by another
 	// concurrent transaction with a newer timestamp, we need
 	// to use the max timestamp for scan.
 	kvs, err := MVCCScan(engine, key, endKey, max, proto.MaxTimestamp, txn)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
+	// Values read from inline keys carry no timestamp.
+	if txn != nil {
+		for _, kv := range kvs {
+			if kv.Value.Timestamp == nil {
+				return 0, nil, util.Errorf("inline value at key %q may not be deleted in a transaction", kv.Key)
+			}
+		}
+	}
 	num := int64(0)
+	var deleted []proto.DeletedKey
 	for _, kv := range kvs {
-		err = MVCCDelete(engine, ms, kv.Key, timestamp, txn)
+		if kv.Value.Timestamp == nil {
+			err = MVCCDelete(engine, ms, kv.Key, proto.ZeroTimestamp, nil)
+		} else {
+			err = MVCCDelete(engine, ms, kv.Key, timestamp, txn)
+		}
 		if err != nil {
-			return num, err
+			return num, deleted, err
 		}
 		num++
+		if int64(len(deleted)) < maxKeys {
+			deleted = append(deleted, proto.DeletedKey{Key: kv.Key, Timestamp: kv.Value.Timestamp})
+		}
 	}
-	return num, nil
+	return num, deleted, nil
 }
 
 // MVCCScan scans the key range specified by start key through end key
 // up to some maximum number of results. Specify max=0 for unbounded
 // scans.
 func MVCCScan(engine Engine, key, endKey proto.Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) ([]proto.KeyValue, error) {
+	return mvccScan(engine, key, endKey, max, timestamp, txn, true)
+}
+
+// MVCCScanInconsistent is like MVCCScan outside of a transaction, but
+// skips write intents instead of returning a WriteIntentError,
+// returning the most recent committed values as of timestamp.
+func MVCCScanInconsistent(engine Engine, key, endKey proto.Key, max int64, timestamp proto.Timestamp) ([]proto.KeyValue, error) {
+	return mvccScan(engine, key, endKey, max, timestamp, nil, false)
+}
+
+// mvccScan implements MVCCScan and MVCCScanInconsistent.
+func mvccScan(engine Engine, key, endKey proto.Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction, consistent bool) ([]proto.KeyValue, error) {
 	if len(endKey) == 0 {
 		return nil, emptyKeyError()
 	}
@@ -713,18 +802,34 @@ func MVCCScan(engine Engine, key, endKey proto.Key, max int64, timestamp proto.T
 		return proto.RawKeyValue{}, iter.Error()
 	}
 
+	// Decode keys into an arena and reuse the buffers for the seek key
+	// to avoid allocations per row.
+	var arena keyArena
+	var nextKey proto.Key
 	res := []proto.KeyValue{}
 	for {
 		kv, err := earlier(engine, encKey, encEndKey)
 		if err != nil || kv.Value == nil {
 			return res, err
 		}
-		key, _, isValue := MVCCDecodeKey(kv.Key)
+		key, _, isValue := arena.decodeKey(kv.Key)
 		if isValue {
 			return nil, util.Errorf("expected an MVCC metadata key: %q", kv.Key)
 		}
-		value, err := mvccGetInternal(engine, key, kv, timestamp, txn, earlier)
+		value, err := mvccGetInternal(engine, key, kv, timestamp, txn, consistent, earlier)
 		if err != nil {
+			// Gather any further intents of the conflicting transaction
+			// within the scan so they can all be resolved after a single
+			// push of the transaction.
+			if wiErr, ok := err.(*proto.WriteIntentError); ok {
+				remaining := int64(0)
+				if max != 0 {
+					remaining = max - int64(len(res))
+				}
+				if scanErr := mvccScanIntents(iter, wiErr, encEndKey, remaining); scanErr != nil {
+					return nil, scanErr
+				}
+			}
 			return nil, err
 		}
 		if value != nil {
@@ -733,10 +838,109 @@ func MVCCScan(engine Engine, key, endKey proto.Key, max int64, timestamp proto.T
 				return res, nil
 			}
 		}
-		encKey = MVCCEncodeKey(key.Next())
+		nextKey = append(append(nextKey[:0], key...), 0)
+		encKey = encoding.EncodeBinary(encKey[:0], nextKey)
 	}
 }
 
+// MVCCScanChanges scans the key range specified by start key through
+// end key for keys whose most recent version as of timestamp was
+// written after since, up to some maximum number of results. Specify
+// max=0 for unbounded scans. The most recent version of each changed
+// key is returned, including deletion tombstones, whose value is nil.
+// Keys whose metadata shows no write after since are skipped without
+// reading their versions. Inline values are never returned. Intents
+// at or below timestamp result in a WriteIntentError.
+func MVCCScanChanges(engine Engine, key, endKey proto.Key, max int64, since, timestamp proto.Timestamp) ([]proto.KeyValueChange, error) {
+	if len(endKey) == 0 {
+		return nil, emptyKeyError()
+	}
+	encEndKey := MVCCEncodeKey(endKey)
+	iter := engine.NewIterator()
+	defer iter.Close()
+
+	res := []proto.KeyValueChange{}
+	iter.Seek(MVCCEncodeKey(key))
+	for iter.Valid() && bytes.Compare(iter.Key(), encEndKey) < 0 {
+		key, _, isValue := MVCCDecodeKey(iter.Key())
+		if isValue {
+			return nil, util.Errorf("expected an MVCC metadata key: %q", iter.Key())
+		}
+		meta := &proto.MVCCMetadata{}
+		if err := gogoproto.Unmarshal(iter.Value(), meta); err != nil {
+			return nil, err
+		}
+		nextKey := MVCCEncodeKey(key.Next())
+		if !meta.IsInline() && since.Less(meta.Timestamp) {
+			if meta.Txn != nil && !timestamp.Less(meta.Timestamp) {
+				wiErr := &proto.WriteIntentError{Key: key, Txn: *meta.Txn}
+				remaining := int64(0)
+				if max != 0 {
+					remaining = max - int64(len(res))
+				}
+				if err := mvccScanIntents(iter, wiErr, encEndKey, remaining); err != nil {
+					return nil, err
+				}
+				return nil, wiErr
+			}
+			// Versions sort newest first, so the first at or after the
+			// version key for timestamp is the most recent as of it.
+			iter.Seek(MVCCEncodeVersionKey(key, timestamp))
+			if iter.Valid() && bytes.Compare(iter.Key(), nextKey) < 0 {
+				_, ts, _ := MVCCDecodeKey(iter.Key())
+				if since.Less(ts) {
+					value := &proto.MVCCValue{}
+					if err := gogoproto.Unmarshal(iter.Value(), value); err != nil {
+						return nil, err
+					}
+					if value.Value != nil {
+						value.Value.Timestamp = &ts
+					}
+					res = append(res, proto.KeyValueChange{Key: key, Value: value.Value, Timestamp: ts})
+					if max != 0 && max == int64(len(res)) {
+						return res, nil
+					}
+				}
+			}
+		}
+		iter.Seek(nextKey)
+	}
+	return res, iter.Error()
+}
+
+// mvccScanIntents continues a scan which encountered the intent
+// described by wiErr using the scan's iterator, adding the keys of
+// further intents of the same transaction up to encEndKey to
+// wiErr.AdditionalKeys. At most max keys, or maxIntentScanKeys if max
+// is 0 or larger, are examined and at most maxAdditionalIntents keys
+// are added.
+func mvccScanIntents(iter Iterator, wiErr *proto.WriteIntentError, encEndKey proto.EncodedKey, max int64) error {
+	if max == 0 || max > maxIntentScanKeys {
+		max = maxIntentScanKeys
+	}
+	nextKey := MVCCEncodeKey(wiErr.Key.Next())
+	for num := int64(0); num < max && len(wiErr.AdditionalKeys) < maxAdditionalIntents; num++ {
+		iter.Seek(nextKey)
+		if !iter.Valid() || bytes.Compare(iter.Key(), encEndKey) >= 0 {
+			return iter.Error()
+		}
+		key, _, isValue := MVCCDecodeKey(iter.Key())
+		if isValue {
+			return util.Errorf("expected an MVCC metadata key: %q", iter.Key())
+		}
+		meta := &proto.MVCCMetadata{}
+		if err := gogoproto.Unmarshal(iter.Value(), meta); err != nil {
+			return err
+		}
+		if meta.Txn != nil && bytes.Equal(meta.Txn.ID, wiErr.Txn.ID) {
+			wiErr.AdditionalKeys = append(wiErr.AdditionalKeys, key)
+		}
+		// Skip the versions of the current key; see MVCCScan.
+		nextKey = MVCCEncodeKey(key.Next())
+	}
+	return nil
+}
+
 // MVCCIterateCommitted iterates over the key range specified by start
 // and end keys, returning only the most recently committed version of
 // each key/value pair. Intents are ignored. If a key has an intent
@@ -801,6 +1005,55 @@ func MVCCIterateCommitted(engine Engine, key, endKey proto.Key, f func(proto.Key
 	})
 }
 
+// An MVCCVersion is a single version of a key, as returned by
+// MVCCGetVersions.
+type MVCCVersion struct {
+	Timestamp proto.Timestamp
+	Value     *proto.Value       // Nil if Deleted
+	Deleted   bool               // True for a deletion tombstone
+	Txn       *proto.Transaction // Non-nil if this version is a write intent
+}
+
+// MVCCGetVersions returns all versions of key present in the engine,
+// newest first, including deletion tombstones and any write intent.
+// Versions which have been garbage collected are not returned. An
+// inline (non-versioned) value is returned as a single version with a
+// zero timestamp. This is intended for debugging and is not
+// consistent with concurrent writes.
+func MVCCGetVersions(engine Engine, key proto.Key) ([]MVCCVersion, error) {
+	if len(key) == 0 {
+		return nil, emptyKeyError()
+	}
+	metaKey := MVCCEncodeKey(key)
+	var meta *proto.MVCCMetadata
+	var versions []MVCCVersion
+	err := engine.Iterate(metaKey, MVCCEncodeKey(key.Next()), func(rawKV proto.RawKeyValue) (bool, error) {
+		_, ts, isValue := MVCCDecodeKey(rawKV.Key)
+		if !isValue {
+			meta = &proto.MVCCMetadata{}
+			if err := gogoproto.Unmarshal(rawKV.Value, meta); err != nil {
+				return false, util.Errorf("unable to unmarshal MVCC metadata for %q: %s", key, err)
+			}
+			if meta.IsInline() {
+				versions = append(versions, MVCCVersion{Value: meta.Value})
+				return true, nil
+			}
+			return false, nil
+		}
+		value := &proto.MVCCValue{}
+		if err := gogoproto.Unmarshal(rawKV.Value, value); err != nil {
+			return false, util.Errorf("unable to unmarshal MVCC value for %q at %s: %s", key, ts, err)
+		}
+		version := MVCCVersion{Timestamp: ts, Value: value.Value, Deleted: value.Deleted}
+		if meta != nil && meta.Txn != nil && ts.Equal(meta.Timestamp) {
+			version.Txn = meta.Txn
+		}
+		versions = append(versions, version)
+		return false, nil
+	})
+	return versions, err
+}
+
 // MVCCResolveWriteIntent either commits or aborts (rolls back) an
 // extant write intent for a given txn according to commit parameter.
 // ResolveWriteIntent will skip write intents of other txns.
@@ -986,6 +1239,28 @@ func MVCCResolveWriteIntentRange(engine Engine, ms *MVCCStats, key, endKey proto
 	return num, nil
 }
 
+// MVCCQueryIntent returns whether a write intent of the given txn
+// exists at key. The intent must have been written in the txn's
+// current epoch at or below the txn's timestamp; an intent which has
+// since been pushed to a later timestamp is not found. The intent is
+// left unchanged.
+func MVCCQueryIntent(engine Engine, key proto.Key, txn *proto.Transaction) (bool, error) {
+	if len(key) == 0 {
+		return false, emptyKeyError()
+	}
+	if txn == nil {
+		return false, util.Error("no txn specified")
+	}
+
+	meta := &proto.MVCCMetadata{}
+	ok, _, _, err := GetProto(engine, MVCCEncodeKey(key), meta)
+	if err != nil || !ok || meta.Txn == nil {
+		return false, err
+	}
+	return bytes.Equal(meta.Txn.ID, txn.ID) && meta.Txn.Epoch == txn.Epoch &&
+		!txn.Timestamp.Less(meta.Timestamp), nil
+}
+
 // IsValidSplitKey returns whether the key is a valid split key.
 // Certain key ranges cannot be split; split keys chosen within
 // any of these ranges are considered invalid.
@@ -1180,12 +1455,51 @@ func MVCCEncodeVersionKey(key proto.Key, timestamp proto.Timestamp) proto.Encode
 // key is for an MVCC versioned value.
 func MVCCDecodeKey(encodedKey proto.EncodedKey) (proto.Key, proto.Timestamp, bool) {
 	tsBytes, key := encoding.DecodeBinary(encodedKey)
+	ts, isValue := mvccDecodeTimestamp(tsBytes)
+	return key, ts, isValue
+}
+
+// mvccDecodeTimestamp decodes the bytes trailing the key of an
+// encoded MVCC key into a timestamp. Returns false if there are no
+// trailing bytes.
+func mvccDecodeTimestamp(tsBytes []byte) (proto.Timestamp, bool) {
 	if len(tsBytes) == 0 {
-		return key, proto.Timestamp{}, false
+		return proto.Timestamp{}, false
 	} else if len(tsBytes) != 12 {
 		panic(fmt.Sprintf("there should be 12 bytes for encoded timestamp: %q", tsBytes))
 	}
 	tsBytes, walltime := encoding.DecodeUint64Decreasing(tsBytes)
 	tsBytes, logical := encoding.DecodeUint32Decreasing(tsBytes)
-	return key, proto.Timestamp{WallTime: int64(walltime), Logical: int32(logical)}, true
+	return proto.Timestamp{WallTime: int64(walltime), Logical: int32(logical)}, true
+}
+
+// keyArenaChunkSize is the minimum size of the buffers into which a
+// keyArena decodes keys.
+const keyArenaChunkSize = 4096
+
+// A keyArena decodes MVCC keys back to back into shared buffers,
+// replacing an allocation per decoded key with an allocation per
+// chunk of keys. Decoded keys remain valid across subsequent decodes
+// and have no spare capacity, so appending to one never overwrites
+// another.
+type keyArena struct {
+	buf []byte
+}
+
+// decodeKey is like MVCCDecodeKey, but decodes the key into the
+// arena.
+func (a *keyArena) decodeKey(encodedKey proto.EncodedKey) (proto.Key, proto.Timestamp, bool) {
+	// The decoded key is never longer than its encoding.
+	if cap(a.buf)-len(a.buf) < len(encodedKey) {
+		size := keyArenaChunkSize
+		if len(encodedKey) > size {
+			size = len(encodedKey)
+		}
+		a.buf = make([]byte, 0, size)
+	}
+	start := len(a.buf)
+	tsBytes, buf := encoding.DecodeBinaryAppend(encodedKey, a.buf)
+	a.buf = buf
+	ts, isValue := mvccDecodeTimestamp(tsBytes)
+	return proto.Key(buf[start:len(buf):len(buf)]), ts, isValue
 }
@@ -113,6 +113,30 @@ func TestMVCCKeys(t *testing.T) {
 	}
 }
 
+// TestKeyArena verifies that keys decoded into a keyArena match
+// those decoded by MVCCDecodeKey and are not overwritten by later
+// decodes, including across arena chunks and appends.
+func TestKeyArena(t *testing.T) {
+	var arena keyArena
+	var keys []proto.Key
+	for i := 0; i < 1000; i++ {
+		key := proto.Key(fmt.Sprintf("key-%d-%s", i, strings.Repeat("x", i%50)))
+		encKey := MVCCEncodeVersionKey(key, makeTS(int64(i), int32(i)))
+		decKey, ts, isValue := arena.decodeKey(encKey)
+		expKey, expTS, _ := MVCCDecodeKey(encKey)
+		if !decKey.Equal(expKey) || !ts.Equal(expTS) || !isValue {
+			t.Fatalf("%d: expected %q, %s; got %q, %s, %t", i, expKey, expTS, decKey, ts, isValue)
+		}
+		_ = append(decKey, 'z')
+		keys = append(keys, decKey)
+	}
+	for i, key := range keys {
+		if exp := fmt.Sprintf("key-%d-%s", i, strings.Repeat("x", i%50)); string(key) != exp {
+			t.Errorf("%d: expected key %q; got %q", i, exp, key)
+		}
+	}
+}
+
 func TestMVCCEmptyKey(t *testing.T) {
 	engine := createTestEngine()
 	if _, err := MVCCGet(engine, proto.Key{}, makeTS(0, 1), nil); err == nil {
@@ -673,6 +697,109 @@ func TestMVCCIterateCommitted(t *testing.T) {
 	}
 }
 
+// TestMVCCScanChanges verifies that only keys changed since a
+// timestamp are returned, including deletions, and that intents at or
+// below the read timestamp conflict.
+func TestMVCCScanChanges(t *testing.T) {
+	engine := createTestEngine()
+	ts1 := makeTS(1, 0)
+	ts2 := makeTS(2, 0)
+	ts3 := makeTS(3, 0)
+	ts4 := makeTS(4, 0)
+	if err := MVCCPut(engine, nil, testKey1, ts1, value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey2, ts1, value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey2, ts2, value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey3, ts1, value3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCDelete(engine, nil, testKey3, ts3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey4, ts4, value4, txn1); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := MVCCScanChanges(engine, testKey1, testKey4.Next(), 0, ts1, ts3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expChanges := []proto.KeyValueChange{
+		{Key: testKey2, Value: &proto.Value{Bytes: value2.Bytes, Timestamp: &ts2}, Timestamp: ts2},
+		{Key: testKey3, Timestamp: ts3},
+	}
+	if !reflect.DeepEqual(changes, expChanges) {
+		t.Errorf("expected changes %v; got %v", expChanges, changes)
+	}
+	// A change after the read timestamp hides none before it.
+	if changes, err := MVCCScanChanges(engine, testKey1, testKey4.Next(), 1, ts1, ts2); err != nil || len(changes) != 1 || !changes[0].Key.Equal(testKey2) {
+		t.Errorf("expected change to %q; got %v, %v", testKey2, changes, err)
+	}
+	if _, err := MVCCScanChanges(engine, testKey1, testKey4.Next(), 0, ts3, ts4); err == nil {
+		t.Error("expected intent at the read timestamp to conflict")
+	} else if _, ok := err.(*proto.WriteIntentError); !ok {
+		t.Errorf("expected WriteIntentError; got %s", err)
+	}
+}
+
+func TestMVCCGetVersions(t *testing.T) {
+	engine := createTestEngine()
+	if err := MVCCPut(engine, nil, testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCDelete(engine, nil, testKey1, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey1, makeTS(3, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey1, makeTS(4, 0), value3, txn1); err != nil {
+		t.Fatal(err)
+	}
+	// Versions of other keys must not be returned.
+	if err := MVCCPut(engine, nil, testKey2, makeTS(5, 0), value4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := MVCCGetVersions(engine, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		ts      proto.Timestamp
+		value   []byte
+		deleted bool
+		intent  bool
+	}{
+		{makeTS(4, 0), value3.Bytes, false, true},
+		{makeTS(3, 0), value2.Bytes, false, false},
+		{makeTS(2, 0), nil, true, false},
+		{makeTS(1, 0), value1.Bytes, false, false},
+	}
+	if len(versions) != len(expected) {
+		t.Fatalf("expected %d versions; got %d: %+v", len(expected), len(versions), versions)
+	}
+	for i, e := range expected {
+		v := versions[i]
+		if !v.Timestamp.Equal(e.ts) || v.Deleted != e.deleted || (v.Txn != nil) != e.intent {
+			t.Errorf("%d: expected %+v; got %+v", i, e, v)
+		}
+		if !e.deleted && (v.Value == nil || !bytes.Equal(v.Value.Bytes, e.value)) {
+			t.Errorf("%d: expected value %q; got %+v", i, e.value, v.Value)
+		}
+	}
+
+	// A missing key has no versions.
+	if versions, err := MVCCGetVersions(engine, testKey3); err != nil || len(versions) != 0 {
+		t.Errorf("expected no versions; got %+v, %v", versions, err)
+	}
+}
+
 func TestMVCCDeleteRange(t *testing.T) {
 	engine := createTestEngine()
 	err := MVCCPut(engine, nil, testKey1, makeTS(1, 0), value1, nil)
@@ -723,6 +850,86 @@ func TestMVCCDeleteRange(t *testing.T) {
 	}
 }
 
+// TestMVCCDeleteRangeInline verifies that a versioned delete range
+// clears inline values in place and leaves tombstones for versioned
+// values.
+func TestMVCCDeleteRangeInline(t *testing.T) {
+	engine := createTestEngine()
+	if err := MVCCPut(engine, nil, testKey1, proto.ZeroTimestamp, value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey2, makeTS(1, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	num, err := MVCCDeleteRange(engine, nil, KeyMin, KeyMax, 0, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 {
+		t.Fatalf("expected 2 deletions; got %d", num)
+	}
+	if versions, err := MVCCGetVersions(engine, testKey1); err != nil || len(versions) != 0 {
+		t.Errorf("expected inline value to be cleared; got %+v, %v", versions, err)
+	}
+	if versions, err := MVCCGetVersions(engine, testKey2); err != nil || len(versions) != 2 || !versions[0].Deleted {
+		t.Errorf("expected tombstone over versioned value; got %+v, %v", versions, err)
+	}
+}
+
+// TestMVCCDeleteRangeInlineTxn verifies that a transactional delete
+// range over inline values fails without deleting anything, so the
+// values survive the transaction's abort.
+func TestMVCCDeleteRangeInlineTxn(t *testing.T) {
+	engine := createTestEngine()
+	if err := MVCCPut(engine, nil, testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey2, proto.ZeroTimestamp, value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MVCCDeleteRange(engine, nil, KeyMin, KeyMax, 0, makeTS(2, 0), txn1); err == nil {
+		t.Fatal("expected error deleting inline value in a transaction")
+	}
+	if _, err := MVCCResolveWriteIntentRange(engine, nil, KeyMin, KeyMax, 0, txn1Abort); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range []proto.KeyValue{{Key: testKey1, Value: value1}, {Key: testKey2, Value: value2}} {
+		value, err := MVCCGet(engine, kv.Key, makeTS(3, 0), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == nil || !bytes.Equal(value.Bytes, kv.Value.Bytes) {
+			t.Errorf("expected value %q at key %q to survive; got %+v", kv.Value.Bytes, kv.Key, value)
+		}
+	}
+}
+
+// TestMVCCDeleteRangeKeys verifies that deleted keys are returned with
+// the timestamps of their values, up to the requested number.
+func TestMVCCDeleteRangeKeys(t *testing.T) {
+	engine := createTestEngine()
+	if err := MVCCPut(engine, nil, testKey1, proto.ZeroTimestamp, value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []proto.Key{testKey2, testKey3} {
+		if err := MVCCPut(engine, nil, key, makeTS(1, 0), value2, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	num, deleted, err := MVCCDeleteRangeKeys(engine, nil, KeyMin, KeyMax, 0, 2, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 3 {
+		t.Errorf("expected 3 deletions; got %d", num)
+	}
+	if len(deleted) != 2 ||
+		!deleted[0].Key.Equal(testKey1) || deleted[0].Timestamp != nil ||
+		!deleted[1].Key.Equal(testKey2) || !deleted[1].Timestamp.Equal(makeTS(1, 0)) {
+		t.Errorf("expected the first 2 deleted keys and their timestamps; got %+v", deleted)
+	}
+}
+
 func TestMVCCDeleteRangeFailed(t *testing.T) {
 	engine := createTestEngine()
 	err := MVCCPut(engine, nil, testKey1, makeTS(1, 0), value1, nil)
@@ -1177,6 +1384,49 @@ func TestMVCCResolveTxnRange(t *testing.T) {
 	}
 }
 
+// TestMVCCQueryIntent verifies that intents are found only for the
+// txn and epoch which wrote them, at or above their timestamp, and
+// that querying leaves them unresolved.
+func TestMVCCQueryIntent(t *testing.T) {
+	engine := createTestEngine()
+	if err := MVCCPut(engine, nil, testKey1, makeTS(0, 1), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey2, makeTS(1, 0), value2, makeTxn(txn1, makeTS(1, 0))); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		key      proto.Key
+		txn      *proto.Transaction
+		expFound bool
+	}{
+		{testKey1, makeTxn(txn1, makeTS(1, 0)), false}, // committed value
+		{testKey2, makeTxn(txn1, makeTS(1, 0)), true},
+		{testKey2, makeTxn(txn1, makeTS(2, 0)), true},
+		{testKey2, makeTxn(txn1, makeTS(0, 1)), false}, // below intent
+		{testKey2, makeTxn(txn1e2, makeTS(1, 0)), false},
+		{testKey2, makeTxn(txn2, makeTS(1, 0)), false},
+		{testKey3, makeTxn(txn1, makeTS(1, 0)), false}, // missing key
+	}
+	for i, test := range testCases {
+		found, err := MVCCQueryIntent(engine, test.key, test.txn)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if found != test.expFound {
+			t.Errorf("%d: expected found=%t; got %t", i, test.expFound, found)
+		}
+	}
+
+	if _, err := MVCCGet(engine, testKey2, makeTS(1, 0), nil); err == nil {
+		t.Error("expected intent to remain after query")
+	}
+	if _, err := MVCCQueryIntent(engine, testKey2, nil); err == nil {
+		t.Error("expected error querying without txn")
+	}
+}
+
 func TestValidSplitKeys(t *testing.T) {
 	testCases := []struct {
 		key   proto.Key
@@ -1629,3 +1879,135 @@ func TestMVCCStatsWithRandomRuns(t *testing.T) {
 		}
 	}
 }
+
+// TestMVCCScanWriteIntentAdditionalKeys verifies that a scan which
+// encounters an intent reports the keys of further intents of the
+// same transaction within the scan.
+func TestMVCCScanWriteIntentAdditionalKeys(t *testing.T) {
+	engine := createTestEngine()
+	if err := MVCCPut(engine, nil, testKey1, makeTS(1, 0), value1, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey2, makeTS(1, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey3, makeTS(1, 0), value3, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey4, makeTS(1, 0), value4, txn2); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		max     int64
+		expKeys []proto.Key
+	}{
+		{0, []proto.Key{testKey3}},
+		{2, []proto.Key{testKey3}},
+		{1, nil},
+	}
+	for i, test := range testCases {
+		_, err := MVCCScan(engine, testKey1, KeyMax, test.max, makeTS(2, 0), nil)
+		wiErr, ok := err.(*proto.WriteIntentError)
+		if !ok {
+			t.Fatalf("%d: expected write intent error; got %v", i, err)
+		}
+		if !wiErr.Key.Equal(testKey1) || !reflect.DeepEqual(wiErr.AdditionalKeys, test.expKeys) {
+			t.Errorf("%d: expected intent at %q with additional keys %q; got %s with %q",
+				i, testKey1, test.expKeys, wiErr, wiErr.AdditionalKeys)
+		}
+	}
+}
+
+// TestMVCCScanWriteIntentAdditionalKeysLimit verifies that a scan
+// reports at most maxAdditionalIntents further intents.
+func TestMVCCScanWriteIntentAdditionalKeysLimit(t *testing.T) {
+	engine := createTestEngine()
+	for i := 0; i < maxAdditionalIntents+10; i++ {
+		key := proto.Key(fmt.Sprintf("key%04d", i))
+		if err := MVCCPut(engine, nil, key, makeTS(1, 0), value1, txn1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := MVCCScan(engine, KeyMin, KeyMax, 0, makeTS(2, 0), nil)
+	wiErr, ok := err.(*proto.WriteIntentError)
+	if !ok {
+		t.Fatalf("expected write intent error; got %v", err)
+	}
+	if len(wiErr.AdditionalKeys) != maxAdditionalIntents {
+		t.Errorf("expected %d additional keys; got %d", maxAdditionalIntents, len(wiErr.AdditionalKeys))
+	}
+}
+
+// TestMVCCInconsistentReads verifies that inconsistent gets and scans
+// skip intents and return the most recent committed values.
+func TestMVCCInconsistentReads(t *testing.T) {
+	engine := createTestEngine()
+	if err := MVCCPut(engine, nil, testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey1, makeTS(2, 0), value2, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(engine, nil, testKey2, makeTS(2, 0), value2, txn2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MVCCGet(engine, testKey1, makeTS(3, 0), nil); err == nil {
+		t.Error("expected write intent error on consistent get")
+	}
+	for _, ts := range []proto.Timestamp{makeTS(1, 0), makeTS(3, 0)} {
+		value, err := MVCCGetInconsistent(engine, testKey1, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == nil || !bytes.Equal(value.Bytes, value1.Bytes) {
+			t.Errorf("expected committed value %q at %s; got %+v", value1.Bytes, ts, value)
+		}
+	}
+	if value, err := MVCCGetInconsistent(engine, testKey2, makeTS(3, 0)); err != nil || value != nil {
+		t.Errorf("expected no committed value for intent; got %+v, %v", value, err)
+	}
+
+	kvs, err := MVCCScanInconsistent(engine, testKey1, testKey3, 0, makeTS(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || !bytes.Equal(kvs[0].Key, testKey1) || !bytes.Equal(kvs[0].Value.Bytes, value1.Bytes) {
+		t.Errorf("expected committed value of %q only; got %+v", testKey1, kvs)
+	}
+}
+
+// TestMVCCPutExpiring verifies that MVCCPutExpiring records the
+// expiration in the key's metadata, that resolving an intent retains
+// it and that a later write clears it.
+func TestMVCCPutExpiring(t *testing.T) {
+	engine := createTestEngine()
+	expiration := makeTS(10, 0)
+	if err := MVCCPutExpiring(engine, nil, testKey1, makeTS(0, 0), value1, nil, expiration); err == nil {
+		t.Error("expected error putting expiring inline value")
+	}
+	getExpiration := func() *proto.Timestamp {
+		meta := &proto.MVCCMetadata{}
+		if ok, _, _, err := GetProto(engine, MVCCEncodeKey(testKey1), meta); !ok || err != nil {
+			t.Fatalf("expected metadata for %q: %v", testKey1, err)
+		}
+		return meta.Expiration
+	}
+
+	if err := MVCCPutExpiring(engine, nil, testKey1, makeTS(1, 0), value1, txn1, expiration); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCResolveWriteIntent(engine, nil, testKey1, txn1Commit); err != nil {
+		t.Fatal(err)
+	}
+	if exp := getExpiration(); exp == nil || !exp.Equal(expiration) {
+		t.Errorf("expected expiration %s; got %v", expiration, exp)
+	}
+	if err := MVCCPut(engine, nil, testKey1, makeTS(2, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exp := getExpiration(); exp != nil {
+		t.Errorf("expected expiration to be cleared; got %s", exp)
+	}
+}
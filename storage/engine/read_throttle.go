@@ -0,0 +1,93 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/settings"
+)
+
+// backgroundReadRate limits the rate at which the iterators of
+// background snapshots read each engine.
+var backgroundReadRate = settings.RegisterByteSizeSetting("storage.background_read_rate",
+	"maximum bytes per second iterated by the background scans of each store, such as "+
+		"range verification, reduced fourfold while foreground reads are in flight; 0 for no limit", 32<<20)
+
+const (
+	// backgroundReadChunk is the number of bytes a background iterator
+	// reads between waits on its engine's read throttle, the size of
+	// a few blocks.
+	backgroundReadChunk = 64 << 10
+	// busyReadRateDivisor divides the background read rate while
+	// foreground reads are in flight.
+	busyReadRateDivisor = 4
+)
+
+// A readThrottle paces the reads of an engine's background iterators
+// so that they yield to its foreground reads: background reads
+// proceed at no more than the background read rate, and at a fraction
+// of it while any foreground read is in flight.
+//
+// readThrottle is thread safe.
+type readThrottle struct {
+	foreground int32 // Foreground reads in flight; accessed atomically
+
+	mu   sync.Mutex // Protects next
+	next time.Time  // Time until which background readers have used up the rate
+}
+
+// beginForeground notes the start of a foreground read.
+func (t *readThrottle) beginForeground() {
+	atomic.AddInt32(&t.foreground, 1)
+}
+
+// endForeground notes the end of a foreground read.
+func (t *readThrottle) endForeground() {
+	atomic.AddInt32(&t.foreground, -1)
+}
+
+// delay accounts for n bytes read by a background iterator at now and
+// returns how long the iterator must wait before reading on.
+func (t *readThrottle) delay(now time.Time, n int64) time.Duration {
+	rate := backgroundReadRate.Get()
+	if rate <= 0 {
+		return 0
+	}
+	if atomic.LoadInt32(&t.foreground) > 0 {
+		if rate /= busyReadRateDivisor; rate == 0 {
+			rate = 1
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Time left unused by background readers isn't banked.
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(n * int64(time.Second) / rate))
+	return t.next.Sub(now)
+}
+
+// wait blocks a background iterator which has read n bytes until
+// the read fits the background read rate.
+func (t *readThrottle) wait(n int64) {
+	if d := t.delay(time.Now(), n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/settings"
+)
+
+// TestReadThrottle verifies that background reads are paced at the
+// background read rate, slowed while foreground reads are in flight,
+// and not paced if the rate is zero.
+func TestReadThrottle(t *testing.T) {
+	defer settings.Update(nil)
+	settings.Update(map[string]string{backgroundReadRate.Key(): "1MiB"})
+
+	t0 := time.Unix(100, 0)
+	th := &readThrottle{}
+	if d := th.delay(t0, 1<<19); d != 500*time.Millisecond {
+		t.Errorf("expected 500ms delay; got %s", d)
+	}
+	// Reads of other background iterators queue up behind the first.
+	if d := th.delay(t0, 1<<19); d != time.Second {
+		t.Errorf("expected 1s delay; got %s", d)
+	}
+	// Time left unused isn't banked.
+	t1 := t0.Add(time.Minute)
+	if d := th.delay(t1, 1<<20); d != time.Second {
+		t.Errorf("expected 1s delay after idling; got %s", d)
+	}
+
+	th.beginForeground()
+	t2 := t1.Add(time.Minute)
+	if d := th.delay(t2, 1<<20); d != busyReadRateDivisor*time.Second {
+		t.Errorf("expected %ds delay with foreground reads in flight; got %s", busyReadRateDivisor, d)
+	}
+	th.endForeground()
+
+	settings.Update(map[string]string{backgroundReadRate.Key(): "0"})
+	if d := th.delay(t2, 1<<30); d != 0 {
+		t.Errorf("expected no delay without a rate; got %s", d)
+	}
+}
@@ -29,6 +29,10 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"unsafe"
 
@@ -37,6 +41,10 @@ import (
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
+// checkpointSubdir is the subdirectory of a RocksDB directory which
+// holds the database's named checkpoints.
+const checkpointSubdir = "checkpoints"
+
 // defaultCacheSize is the default value for the cacheSize command line flag.
 const defaultCacheSize = 1 << 30 // GB
 
@@ -45,11 +53,54 @@ const defaultCacheSize = 1 << 30 // GB
 var cacheSize = flag.Int64("cache_size", defaultCacheSize, "total size in bytes for "+
 	"caches, shared evenly if there are multiple storage devices")
 
+// backgroundCacheShare is the share of each store's block cache
+// reserved for the blocks read by background scans.
+var backgroundCacheShare = flag.Float64("background_cache_share", 0.1, "share of the block "+
+	"cache reserved for background scans, such as range verification, so that they can't "+
+	"evict the working set of foreground reads; 0 to keep their blocks out of the cache")
+
+// Compression selects the compression of a RocksDB engine's tables.
+type Compression int
+
+// Table compressions supported by RocksDB.
+const (
+	CompressionDefault Compression = iota // RocksDB's default, Snappy
+	CompressionNone
+	CompressionSnappy
+	CompressionZlib
+	CompressionLZ4
+)
+
+// compressionNames maps the names accepted by ParseCompression to
+// compressions.
+var compressionNames = map[string]Compression{
+	"none":   CompressionNone,
+	"snappy": CompressionSnappy,
+	"zlib":   CompressionZlib,
+	"lz4":    CompressionLZ4,
+}
+
+// ParseCompression returns the compression with the specified name,
+// one of "none", "snappy", "zlib" or "lz4", or the default
+// compression if name is empty.
+func ParseCompression(name string) (Compression, error) {
+	if name == "" {
+		return CompressionDefault, nil
+	}
+	c, ok := compressionNames[name]
+	if !ok {
+		return CompressionDefault, util.Errorf("unknown compression %q", name)
+	}
+	return c, nil
+}
+
 // RocksDB is a wrapper around a RocksDB database instance.
 type RocksDB struct {
-	rdb   *C.DBEngine
-	attrs proto.Attributes // Attributes for this engine
-	dir   string           // The data directory
+	rdb         *C.DBEngine
+	attrs       proto.Attributes // Attributes for this engine
+	dir         string           // The data directory
+	compression Compression      // Compression of tables written
+	throttle    readThrottle     // Paces the reads of background snapshots
 }
 
 // NewRocksDB allocates and returns a new RocksDB object.
@@ -60,6 +111,18 @@ func NewRocksDB(attrs proto.Attributes, dir string) *RocksDB {
 	}
 }
 
+// SetCompression sets the compression of the tables written by the
+// database. It must be called before Start; existing tables are
+// rewritten with the compression only as they're compacted.
+func (r *RocksDB) SetCompression(c Compression) {
+	r.compression = c
+}
+
+// Dir returns the data directory of the database.
+func (r *RocksDB) Dir() string {
+	return r.dir
+}
+
 // String formatter.
 func (r *RocksDB) String() string {
 	return fmt.Sprintf("%s=%s", r.attrs, r.dir)
@@ -73,11 +136,16 @@ func (r *RocksDB) Start() error {
 		return nil
 	}
 
+	if share := *backgroundCacheShare; share < 0 || share >= 1 {
+		return util.Errorf("background cache share %f not in [0, 1)", share)
+	}
 	status := C.DBOpen(&r.rdb, goToCSlice([]byte(r.dir)),
 		C.DBOptions{
-			cache_size:      C.int64_t(*cacheSize),
-			allow_os_buffer: C.int(1),
-			logger:          C.DBLoggerFunc(nil),
+			cache_size:            C.int64_t(*cacheSize),
+			background_cache_size: C.int64_t(float64(*cacheSize) * *backgroundCacheShare),
+			allow_os_buffer:       C.int(1),
+			logger:                C.DBLoggerFunc(nil),
+			compression:           C.DBCompression(r.compression),
 		})
 	err := statusToError(status)
 	if err != nil {
@@ -150,11 +218,21 @@ func (r *RocksDB) Get(key proto.EncodedKey) ([]byte, error) {
 	return r.getInternal(key, nil)
 }
 
-// Get returns the value for the given key.
-func (r *RocksDB) getInternal(key proto.EncodedKey, snapshotHandle *C.DBSnapshot) ([]byte, error) {
+// Get returns the value for the given key. Reads through background
+// snapshots are point reads which aren't throttled, but don't count
+// as foreground reads either.
+func (r *RocksDB) getInternal(key proto.EncodedKey, snap *rocksDBSnapshot) ([]byte, error) {
 	if len(key) == 0 {
 		return nil, emptyKeyError()
 	}
+	var snapshotHandle *C.DBSnapshot
+	if snap != nil {
+		snapshotHandle = snap.handle
+	}
+	if snap == nil || !snap.background {
+		r.throttle.beginForeground()
+		defer r.throttle.endForeground()
+	}
 	var result C.DBString
 	err := statusToError(C.DBGet(r.rdb, snapshotHandle, goToCSlice(key), &result))
 	if err != nil {
@@ -178,11 +256,11 @@ func (r *RocksDB) Iterate(start, end proto.EncodedKey, f func(proto.RawKeyValue)
 }
 
 func (r *RocksDB) iterateInternal(start, end proto.EncodedKey, f func(proto.RawKeyValue) (bool, error),
-	snapshotHandle *C.DBSnapshot) error {
+	snap *rocksDBSnapshot) error {
 	if bytes.Compare(start, end) >= 0 {
 		return nil
 	}
-	it := newRocksDBIterator(r.rdb, snapshotHandle)
+	it := newRocksDBIterator(r, snap)
 	defer it.Close()
 
 	it.Seek(start)
@@ -231,7 +309,7 @@ func (r *RocksDB) WriteBatch(cmds []interface{}) error {
 }
 
 // Capacity queries the underlying file system for disk capacity
-// information.
+// information and the database for the health of its LSM tree.
 func (r *RocksDB) Capacity() (StoreCapacity, error) {
 	var fs syscall.Statfs_t
 	var capacity StoreCapacity
@@ -240,6 +318,12 @@ func (r *RocksDB) Capacity() (StoreCapacity, error) {
 	}
 	capacity.Capacity = int64(fs.Bsize) * int64(fs.Blocks)
 	capacity.Available = int64(fs.Bsize) * int64(fs.Bavail)
+	var l0Files, debt C.int64_t
+	if err := statusToError(C.DBGetLSMStats(r.rdb, &l0Files, &debt)); err != nil {
+		return capacity, err
+	}
+	capacity.ReadAmplification = int64(l0Files)
+	capacity.CompactionDebt = int64(debt)
 	return capacity, nil
 }
 
@@ -283,6 +367,69 @@ func (r *RocksDB) ApproximateSize(start, end proto.EncodedKey) (uint64, error) {
 	return uint64(C.DBApproximateSize(r.rdb, goToCSlice(start), goToCSlice(end))), nil
 }
 
+// TimestampBounds implements the TimestampBounder interface using
+// properties recorded for each SSTable as it is written. Versions
+// still in the memtable are not covered; they are treated as recent,
+// as the memtable isn't flushed for fear of stalling writes.
+func (r *RocksDB) TimestampBounds(start, end proto.EncodedKey) (min, max int64, ok bool, err error) {
+	var cMin, cMax C.int64_t
+	var cFound C.int
+	if err = statusToError(C.DBGetTimestampBounds(r.rdb, goToCSlice(start), goToCSlice(end), &cMin, &cMax, &cFound)); err != nil {
+		return
+	}
+	return int64(cMin), int64(cMax), cFound != 0, nil
+}
+
+// Checkpoint implements the Checkpointer interface. The database's
+// SSTables are hard-linked into dir, so creating a checkpoint is fast
+// and initially consumes little space if dir is on the same file
+// system as the database; otherwise, they are copied.
+func (r *RocksDB) Checkpoint(dir string) error {
+	return statusToError(C.DBCheckpoint(r.rdb, goToCSlice([]byte(dir))))
+}
+
+// SyncWAL implements the Syncer interface.
+func (r *RocksDB) SyncWAL() error {
+	return statusToError(C.DBSyncWAL(r.rdb))
+}
+
+// CheckpointDir returns the directory of the checkpoint of the
+// database named name. Named checkpoints are kept in a subdirectory
+// of the database's directory so that they share its file system.
+func (r *RocksDB) CheckpointDir(name string) string {
+	return filepath.Join(r.dir, checkpointSubdir, name)
+}
+
+// CreateNamedCheckpoint creates a checkpoint of the database named
+// name. See CheckpointDir.
+func (r *RocksDB) CreateNamedCheckpoint(name string) error {
+	if len(name) == 0 || strings.ContainsRune(name, filepath.Separator) || name == "." || name == ".." {
+		return util.Errorf("invalid checkpoint name %q", name)
+	}
+	if err := os.MkdirAll(filepath.Join(r.dir, checkpointSubdir), 0755); err != nil {
+		return err
+	}
+	return r.Checkpoint(r.CheckpointDir(name))
+}
+
+// NamedCheckpoints returns the sorted names of the database's named
+// checkpoints.
+func (r *RocksDB) NamedCheckpoints() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(r.dir, checkpointSubdir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
 // Flush causes RocksDB to write all in-memory data to disk immediately.
 func (r *RocksDB) Flush() error {
 	return statusToError(C.DBFlush(r.rdb))
@@ -351,7 +498,7 @@ func goMerge(existing, update []byte) ([]byte, error) {
 
 // NewIterator returns an iterator over this rocksdb engine.
 func (r *RocksDB) NewIterator() Iterator {
-	return newRocksDBIterator(r.rdb, nil)
+	return newRocksDBIterator(r, nil)
 }
 
 // NewSnapshot creates a snapshot handle from engine and returns a
@@ -366,6 +513,17 @@ func (r *RocksDB) NewSnapshot() Engine {
 	}
 }
 
+// NewBackgroundSnapshot creates a snapshot handle from engine whose
+// reads populate only the background share of the block cache, if
+// any, and returns a read-only rocksDBSnapshot engine. Its iterators
+// are paced by the engine's read throttle.
+func (r *RocksDB) NewBackgroundSnapshot() Engine {
+	snap := r.NewSnapshot().(*rocksDBSnapshot)
+	C.DBSnapshotSetBackground(r.rdb, snap.handle)
+	snap.background = true
+	return snap
+}
+
 // NewBatch returns a new Batch wrapping this rocksdb engine.
 func (r *RocksDB) NewBatch() Engine {
 	return &Batch{engine: r}
@@ -377,8 +535,9 @@ func (r *RocksDB) Commit() error {
 }
 
 type rocksDBSnapshot struct {
-	parent *RocksDB
-	handle *C.DBSnapshot
+	parent     *RocksDB
+	handle     *C.DBSnapshot
+	background bool // Whether reads are background reads
 }
 
 // Start is a noop.
@@ -404,14 +563,14 @@ func (r *rocksDBSnapshot) Put(key proto.EncodedKey, value []byte) error {
 // Get returns the value for the given key, nil otherwise using
 // the snapshot handle.
 func (r *rocksDBSnapshot) Get(key proto.EncodedKey) ([]byte, error) {
-	return r.parent.getInternal(key, r.handle)
+	return r.parent.getInternal(key, r)
 }
 
 // Iterate iterates over the keys between start inclusive and end
 // exclusive, invoking f() on each key/value pair using the snapshot
 // handle.
 func (r *rocksDBSnapshot) Iterate(start, end proto.EncodedKey, f func(proto.RawKeyValue) (bool, error)) error {
-	return r.parent.iterateInternal(start, end, f, r.handle)
+	return r.parent.iterateInternal(start, end, f, r)
 }
 
 // Clear is illegal for snapshot and returns an error.
@@ -447,7 +606,7 @@ func (r *rocksDBSnapshot) ApproximateSize(start, end proto.EncodedKey) (uint64,
 // NewIterator returns a new instance of an Iterator over the
 // engine using the snapshot handle.
 func (r *rocksDBSnapshot) NewIterator() Iterator {
-	return newRocksDBIterator(r.parent.rdb, r.handle)
+	return newRocksDBIterator(r.parent, r)
 }
 
 // NewSnapshot is illegal for snapshot and returns nil.
@@ -466,26 +625,57 @@ func (r *rocksDBSnapshot) Commit() error {
 }
 
 type rocksDBIterator struct {
-	iter *C.DBIterator
+	iter       *C.DBIterator
+	throttle   *readThrottle
+	background bool  // Whether reads are paced by throttle
+	unpaced    int64 // Bytes read by a background iterator since it last waited
 }
 
 // newRocksDBIterator returns a new iterator over the supplied RocksDB
-// instance. If snapshotHandle is not nil, uses the indicated snapshot.
+// instance. If snap is not nil, uses the indicated snapshot. The
+// iterator of a background snapshot is paced by the engine's read
+// throttle; other iterators count as foreground reads until closed.
 // The caller must call rocksDBIterator.Close() when finished with the
 // iterator to free up resources.
-func newRocksDBIterator(rdb *C.DBEngine, snapshotHandle *C.DBSnapshot) *rocksDBIterator {
+func newRocksDBIterator(r *RocksDB, snap *rocksDBSnapshot) *rocksDBIterator {
 	// In order to prevent content displacement, caching is disabled
 	// when performing scans. Any options set within the shared read
 	// options field that should be carried over needs to be set here
 	// as well.
-	return &rocksDBIterator{
-		iter: C.DBNewIter(rdb, snapshotHandle),
+	var snapshotHandle *C.DBSnapshot
+	if snap != nil {
+		snapshotHandle = snap.handle
+	}
+	it := &rocksDBIterator{
+		iter:       C.DBNewIter(r.rdb, snapshotHandle),
+		throttle:   &r.throttle,
+		background: snap != nil && snap.background,
+	}
+	if !it.background {
+		it.throttle.beginForeground()
+	}
+	return it
+}
+
+// pace accounts for n bytes read by the iterator, waiting on the
+// engine's read throttle once a background iterator has read
+// backgroundReadChunk bytes.
+func (r *rocksDBIterator) pace(n int) {
+	if !r.background {
+		return
+	}
+	if r.unpaced += int64(n); r.unpaced >= backgroundReadChunk {
+		r.throttle.wait(r.unpaced)
+		r.unpaced = 0
 	}
 }
 
 // The following methods implement the Iterator interface.
 func (r *rocksDBIterator) Close() {
 	C.DBIterDestroy(r.iter)
+	if !r.background {
+		r.throttle.endForeground()
+	}
 }
 
 func (r *rocksDBIterator) Seek(key []byte) {
@@ -511,11 +701,13 @@ func (r *rocksDBIterator) Key() proto.EncodedKey {
 	// freed by the client. It is a direct reference to the data managed
 	// by the iterator, so it is copied instead of freed.
 	data := C.DBIterKey(r.iter)
+	r.pace(int(data.len))
 	return cSliceToGoBytes(data)
 }
 
 func (r *rocksDBIterator) Value() []byte {
 	data := C.DBIterValue(r.iter)
+	r.pace(int(data.len))
 	return cSliceToGoBytes(data)
 }
 
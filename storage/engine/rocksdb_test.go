@@ -22,6 +22,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"math/rand"
+	"os"
 	"reflect"
 	"testing"
 
@@ -177,6 +178,77 @@ func setupMVCCData(rocksdb *RocksDB, numVersions, numKeys int, b *testing.B) map
 	return results
 }
 
+// TestRocksDBNamedCheckpoints verifies that a named checkpoint holds
+// the data as of its creation and can be opened as a database.
+func TestRocksDBNamedCheckpoints(t *testing.T) {
+	loc := util.CreateTempDirectory()
+	defer os.RemoveAll(loc)
+	rocksdb := NewRocksDB(proto.Attributes{}, loc)
+	if err := rocksdb.Start(); err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	defer rocksdb.Stop()
+
+	key := MVCCEncodeKey(proto.Key("a"))
+	if err := rocksdb.Put(key, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rocksdb.CreateNamedCheckpoint("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rocksdb.Put(key, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c1", "", "../c2"} {
+		if err := rocksdb.CreateNamedCheckpoint(name); err == nil {
+			t.Errorf("expected error creating checkpoint %q", name)
+		}
+	}
+	if names, err := rocksdb.NamedCheckpoints(); err != nil || !reflect.DeepEqual(names, []string{"c1"}) {
+		t.Errorf("expected checkpoint c1; got %v, %v", names, err)
+	}
+
+	checkpoint := NewRocksDB(proto.Attributes{}, rocksdb.CheckpointDir("c1"))
+	if err := checkpoint.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Stop()
+	if val, err := checkpoint.Get(key); err != nil || !bytes.Equal(val, []byte("1")) {
+		t.Errorf("expected checkpointed value 1; got %q, %v", val, err)
+	}
+}
+
+// TestRocksDBTimestampBounds verifies that timestamp bounds are
+// computed from flushed SSTables only, without flushing the memtable.
+func TestRocksDBTimestampBounds(t *testing.T) {
+	loc := util.CreateTempDirectory()
+	defer os.RemoveAll(loc)
+	rocksdb := NewRocksDB(proto.Attributes{}, loc)
+	if err := rocksdb.Start(); err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	defer rocksdb.Stop()
+
+	start, end := MVCCEncodeKey(proto.Key("a")), MVCCEncodeKey(proto.Key("z"))
+	value := proto.Value{Bytes: []byte("value")}
+	if err := MVCCPut(rocksdb, nil, proto.Key("b"), makeTS(10, 0), value, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The version is only in the memtable, which isn't flushed.
+	if min, max, ok, err := rocksdb.TimestampBounds(start, end); err != nil || !ok || min <= max {
+		t.Errorf("expected no bounds of unflushed versions; got %d, %d, %t, %v", min, max, ok, err)
+	}
+	if err := rocksdb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := MVCCPut(rocksdb, nil, proto.Key("c"), makeTS(5, 0), value, nil); err != nil {
+		t.Fatal(err)
+	}
+	if min, max, ok, err := rocksdb.TimestampBounds(start, end); err != nil || !ok || min != 10 || max != 10 {
+		t.Errorf("expected bounds of flushed version at 10; got %d, %d, %t, %v", min, max, ok, err)
+	}
+}
+
 // runMVCCScan first creates test data (and resets benchmarking
 // timer). It then performs b.N MVCCScans in increments of
 // scanIncrement keys over all of the data in the rocksdb instance,
@@ -298,3 +370,44 @@ func BenchmarkMVCCMergeTimeSeries(b *testing.B) {
 	}
 	runMVCCMerge(value, 1024, 1024, b)
 }
+
+// TestRocksDBBackgroundCacheShare verifies that background snapshots
+// read correctly whether or not the block cache reserves a share for
+// background scans, and that invalid shares are refused.
+func TestRocksDBBackgroundCacheShare(t *testing.T) {
+	defer func(share float64) { *backgroundCacheShare = share }(*backgroundCacheShare)
+	for _, share := range []float64{0, 0.5, 1} {
+		*backgroundCacheShare = share
+		loc := util.CreateTempDirectory()
+		defer os.RemoveAll(loc)
+		rocksdb := NewRocksDB(proto.Attributes{}, loc)
+		if err := rocksdb.Start(); share >= 1 {
+			if err == nil {
+				rocksdb.Stop()
+				t.Errorf("share %f: expected an error", share)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("share %f: %s", share, err)
+		}
+
+		key := MVCCEncodeKey(proto.Key("a"))
+		if err := rocksdb.Put(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := rocksdb.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		snap := rocksdb.NewBackgroundSnapshot()
+		for i := 0; i < 2; i++ {
+			if val, err := snap.Get(key); err != nil || !bytes.Equal(val, []byte("1")) {
+				t.Errorf("share %f: expected value 1; got %q, %v", share, val, err)
+			}
+		}
+		if val, err := rocksdb.Get(key); err != nil || !bytes.Equal(val, []byte("1")) {
+			t.Errorf("share %f: expected value 1; got %q, %v", share, val, err)
+		}
+		snap.Stop()
+		rocksdb.Stop()
+	}
+}
@@ -19,7 +19,6 @@ package engine
 
 import (
 	"github.com/cockroachdb/cockroach/proto"
-	gogoproto "github.com/gogo/protobuf/proto"
 )
 
 // Constants for stat key construction.
@@ -72,7 +71,7 @@ func GetRangeStat(engine Engine, raftID int64, stat proto.Key) (int64, error) {
 	if err != nil || val == nil {
 		return 0, err
 	}
-	return val.GetInteger(), nil
+	return val.GetInt()
 }
 
 // MergeStat flushes the specified stat to merge counters via the
@@ -82,7 +81,8 @@ func MergeStat(engine Engine, raftID int64, storeID int32, stat proto.Key, statV
 	if statVal == 0 {
 		return nil
 	}
-	value := proto.Value{Integer: gogoproto.Int64(statVal)}
+	value := proto.Value{}
+	value.SetInt(statVal)
 	if raftID != 0 {
 		if err := MVCCMerge(engine, nil, RangeStatKey(raftID, stat), value); err != nil {
 			return err
@@ -100,7 +100,8 @@ func MergeStat(engine Engine, raftID int64, storeID int32, stat proto.Key, statV
 // instance for both the affected range and store. Only updates range
 // or store stats if the corresponding ID is non-zero.
 func SetStat(engine Engine, raftID int64, storeID int32, stat proto.Key, statVal int64) error {
-	value := proto.Value{Integer: gogoproto.Int64(statVal)}
+	value := proto.Value{}
+	value.SetInt(statVal)
 	if raftID != 0 {
 		if err := MVCCPut(engine, nil, RangeStatKey(raftID, stat), proto.ZeroTimestamp, value, nil); err != nil {
 			return err
@@ -0,0 +1,142 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+const (
+	// StoreHeartbeatInterval is the interval at which each store
+	// writes its disk heartbeat.
+	StoreHeartbeatInterval = 1 * time.Second
+	// StoreStallThreshold is how long a heartbeat write may remain
+	// outstanding before the store is considered stalled. Stalled
+	// stores are not sent commands and their queues are not processed.
+	StoreStallThreshold = 10 * time.Second
+	// StoreStallFatalThreshold is how long a store may remain stalled
+	// before the node exits. A stalled disk rarely recovers; exiting
+	// lets the cluster treat the node as dead instead of as up but
+	// unresponsive.
+	StoreStallFatalThreshold = 60 * time.Second
+	// SlowSyncThreshold is the WAL sync latency above which a sync is
+	// considered slow.
+	SlowSyncThreshold = 500 * time.Millisecond
+	// SlowSyncIntervals is the number of consecutive heartbeats with
+	// slow syncs after which a store is considered suspect.
+	SlowSyncIntervals = 5
+)
+
+// StoreStalledError indicates that a command was not executed because
+// the store's disk has stopped completing writes.
+type StoreStalledError struct {
+	StoreID  int32
+	Duration time.Duration
+}
+
+// Error formats error.
+func (e *StoreStalledError) Error() string {
+	return fmt.Sprintf("store %d is stalled: disk heartbeat outstanding for %s", e.StoreID, e.Duration)
+}
+
+// heartbeat synchronously writes the store's disk heartbeat. While
+// the write is outstanding, StallDuration reports how long it has
+// been in progress. If the engine is a Syncer, its write-ahead log is
+// then synced and the latency of the sync recorded.
+func (s *Store) heartbeat() error {
+	now := s.clock.PhysicalNow()
+	atomic.StoreInt64(&s.heartbeatStarted, now)
+	defer atomic.StoreInt64(&s.heartbeatStarted, 0)
+	ts := proto.Timestamp{WallTime: now}
+	if err := engine.MVCCPutProto(s.engine, nil, engine.StoreHeartbeatKey(), proto.ZeroTimestamp, nil, &ts); err != nil {
+		return err
+	}
+	syncer, ok := s.engine.(engine.Syncer)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	if err := syncer.SyncWAL(); err != nil {
+		return err
+	}
+	s.recordSyncLatency(time.Since(start))
+	return nil
+}
+
+// recordSyncLatency records the latency of a WAL sync and counts
+// consecutive slow syncs. The store becomes suspect once
+// SlowSyncIntervals consecutive syncs have been slow and remains so
+// until a sync completes within SlowSyncThreshold.
+func (s *Store) recordSyncLatency(latency time.Duration) {
+	storeSyncLatency.RecordDuration(latency)
+	if latency <= SlowSyncThreshold {
+		if atomic.SwapInt32(&s.slowSyncs, 0) >= SlowSyncIntervals {
+			log.Infof("store %d: WAL sync latency recovered to %s", s.StoreID(), latency)
+		}
+		return
+	}
+	if n := atomic.AddInt32(&s.slowSyncs, 1); n == SlowSyncIntervals {
+		log.Errorf("store %d: WAL sync took %s, exceeding %s for %d consecutive heartbeats; "+
+			"marking store suspect", s.StoreID(), latency, SlowSyncThreshold, n)
+	}
+}
+
+// Suspect returns true if the store's last SlowSyncIntervals WAL
+// syncs have all exceeded SlowSyncThreshold. Suspect stores are
+// advertised as such in gossip and are not chosen as allocation
+// targets.
+func (s *Store) Suspect() bool {
+	return atomic.LoadInt32(&s.slowSyncs) >= SlowSyncIntervals
+}
+
+// startHeartbeat writes the store's disk heartbeat every
+// StoreHeartbeatInterval until closer is closed.
+func (s *Store) startHeartbeat(closer chan struct{}) {
+	ticker := time.NewTicker(StoreHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.heartbeat(); err != nil {
+				log.Errorf("store %d: failed to write disk heartbeat: %s", s.StoreID(), err)
+			}
+		case <-closer:
+			return
+		}
+	}
+}
+
+// StallDuration returns how long the store's current disk heartbeat
+// has been outstanding, or zero if no heartbeat is in progress.
+func (s *Store) StallDuration() time.Duration {
+	started := atomic.LoadInt64(&s.heartbeatStarted)
+	if started == 0 {
+		return 0
+	}
+	return time.Duration(s.clock.PhysicalNow() - started)
+}
+
+// Stalled returns true if the store's disk heartbeat has been
+// outstanding for longer than StoreStallThreshold.
+func (s *Store) Stalled() bool {
+	return s.StallDuration() > StoreStallThreshold
+}
@@ -0,0 +1,208 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// keyUsageDelimiter ends the top-level prefix of a key, such as the
+// schema key of the rows of structured tables.
+const keyUsageDelimiter = '/'
+
+// maxTopLevelPrefixLength caps the length of the top-level prefix of
+// keys outside the system and tenant keyspaces. Without it, each key
+// of a flat keyspace, which has no delimiters, would be a prefix of
+// its own and get a report row of its own.
+const maxTopLevelPrefixLength = 8
+
+// TopLevelPrefix returns the top-level prefix of key, by which disk
+// usage is aggregated: the system key prefix for system keys, the
+// tenant's prefix for tenant keys and otherwise the key up to and
+// including its first '/'. Keys without a '/' in their first
+// maxTopLevelPrefixLength bytes are grouped by those bytes instead.
+func TopLevelPrefix(key proto.Key) proto.Key {
+	if key.Less(engine.KeySystemMax) {
+		return engine.KeySystemPrefix
+	}
+	if tenantID, _, ok := proto.DecodeTenantKey(key); ok {
+		return proto.TenantPrefix(tenantID)
+	}
+	if len(key) > maxTopLevelPrefixLength {
+		if i := bytes.IndexByte(key[:maxTopLevelPrefixLength], keyUsageDelimiter); i >= 0 {
+			return key[:i+1]
+		}
+		return key[:maxTopLevelPrefixLength]
+	}
+	if i := bytes.IndexByte(key, keyUsageDelimiter); i >= 0 {
+		return key[:i+1]
+	}
+	return key
+}
+
+// topLevelPrefixEnd returns the end of the span of keys with the
+// top-level prefix p. A shorter prefix without a '/' is a key of its
+// own; any other prefix spans all the keys it prefixes.
+func topLevelPrefixEnd(p proto.Key) proto.Key {
+	if p.Equal(engine.KeySystemPrefix) || bytes.HasPrefix(p, proto.KeyTenantPrefix) ||
+		len(p) == maxTopLevelPrefixLength || bytes.IndexByte(p, keyUsageDelimiter) >= 0 {
+		return p.PrefixEnd()
+	}
+	return p.Next()
+}
+
+// A PrefixUsage is the disk usage of the keys with a top-level prefix.
+type PrefixUsage struct {
+	Prefix     proto.Key
+	LiveBytes  int64
+	TotalBytes int64 // Key and value bytes of all versions
+	Ranges     int   // Ranges holding keys with the prefix
+}
+
+// A KeyUsage is the disk usage of ranges aggregated by the top-level
+// prefixes of their keys.
+type KeyUsage struct {
+	Prefixes []PrefixUsage // Sorted by prefix
+	// ScannedRanges is the number of ranges holding keys of several
+	// prefixes, whose usage is computed by scanning them rather than
+	// from their MVCC stats.
+	ScannedRanges int
+}
+
+// Add adds the usage of o to ku.
+func (ku *KeyUsage) Add(o *KeyUsage) {
+	index := ku.index()
+	for _, pu := range o.Prefixes {
+		ku.add(index, pu)
+	}
+	ku.ScannedRanges += o.ScannedRanges
+	sort.Sort(prefixUsages(ku.Prefixes))
+}
+
+// index returns the indexes of ku's prefix usages by prefix.
+func (ku *KeyUsage) index() map[string]int {
+	index := map[string]int{}
+	for i, pu := range ku.Prefixes {
+		index[string(pu.Prefix)] = i
+	}
+	return index
+}
+
+// add adds pu to the usage of its prefix, updating index.
+func (ku *KeyUsage) add(index map[string]int, pu PrefixUsage) {
+	i, ok := index[string(pu.Prefix)]
+	if !ok {
+		index[string(pu.Prefix)] = len(ku.Prefixes)
+		ku.Prefixes = append(ku.Prefixes, pu)
+		return
+	}
+	ku.Prefixes[i].LiveBytes += pu.LiveBytes
+	ku.Prefixes[i].TotalBytes += pu.TotalBytes
+	ku.Prefixes[i].Ranges += pu.Ranges
+}
+
+// prefixUsages sorts prefix usages by prefix.
+type prefixUsages []PrefixUsage
+
+func (pus prefixUsages) Len() int           { return len(pus) }
+func (pus prefixUsages) Swap(i, j int)      { pus[i], pus[j] = pus[j], pus[i] }
+func (pus prefixUsages) Less(i, j int) bool { return pus[i].Prefix.Less(pus[j].Prefix) }
+
+// KeyUsage returns the disk usage of the ranges led by the store,
+// aggregated by top-level prefix. The usage of a range whose keys
+// share a top-level prefix is read from its MVCC stats, which are
+// maintained incrementally; ranges holding keys of several prefixes,
+// which are rare once ranges are split by zone and accounting
+// configs, are scanned to break their usage down. As each range is
+// counted by its leader only, the usage of a cluster is the sum of
+// that of its stores.
+func (s *Store) KeyUsage() (*KeyUsage, error) {
+	s.mu.RLock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.RUnlock()
+
+	ku := &KeyUsage{}
+	index := map[string]int{}
+	for _, rng := range ranges {
+		if !rng.IsLeader() {
+			continue
+		}
+		rng.RLock()
+		desc := *rng.Desc
+		rng.RUnlock()
+		prefix := TopLevelPrefix(desc.StartKey)
+		if !topLevelPrefixEnd(prefix).Less(desc.EndKey) {
+			ms, err := engine.MVCCGetRangeStats(s.engine, desc.RaftID)
+			if err != nil {
+				return nil, err
+			}
+			ku.add(index, PrefixUsage{
+				Prefix:     prefix,
+				LiveBytes:  ms.LiveBytes,
+				TotalBytes: ms.KeyBytes + ms.ValBytes,
+				Ranges:     1,
+			})
+			continue
+		}
+		ku.ScannedRanges++
+		if err := s.scanKeyUsage(ku, index, desc.StartKey, desc.EndKey); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(prefixUsages(ku.Prefixes))
+	return ku, nil
+}
+
+// scanKeyUsage adds the usage of the keys from start to end, computed
+// by scanning them, to ku, seeking from each top-level prefix to the
+// next key with another.
+func (s *Store) scanKeyUsage(ku *KeyUsage, index map[string]int, start, end proto.Key) error {
+	for key := start; key.Less(end); {
+		prefix := TopLevelPrefix(key)
+		prefixEnd := topLevelPrefixEnd(prefix)
+		if end.Less(prefixEnd) {
+			prefixEnd = end
+		}
+		ms, err := engine.MVCCComputeStats(s.engine, key, prefixEnd)
+		if err != nil {
+			return err
+		}
+		if ms.KeyCount > 0 {
+			ku.add(index, PrefixUsage{
+				Prefix:     prefix,
+				LiveBytes:  ms.LiveBytes,
+				TotalBytes: ms.KeyBytes + ms.ValBytes,
+				Ranges:     1,
+			})
+		}
+		kvs, err := engine.Scan(s.engine, engine.MVCCEncodeKey(prefixEnd), engine.MVCCEncodeKey(end), 1)
+		if err != nil {
+			return err
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		key, _, _ = engine.MVCCDecodeKey(kvs[0].Key)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestTopLevelPrefix verifies the top-level prefixes of keys.
+func TestTopLevelPrefix(t *testing.T) {
+	testCases := []struct {
+		key, expPrefix proto.Key
+	}{
+		{engine.KeyMin, engine.KeySystemPrefix},
+		{engine.KeyMeta2Prefix, engine.KeySystemPrefix},
+		{proto.MakeTenantKey(7, proto.Key("db/t")), proto.TenantPrefix(7)},
+		{proto.Key("db/t/1"), proto.Key("db/")},
+		{proto.Key("db/"), proto.Key("db/")},
+		{proto.Key("flat"), proto.Key("flat")},
+		{proto.Key("flatkey-12345"), proto.Key("flatkey-")},
+		{proto.Key("accounts/1"), proto.Key("accounts")},
+		{proto.Key("accounts"), proto.Key("accounts")},
+	}
+	for i, test := range testCases {
+		if prefix := TopLevelPrefix(test.key); !prefix.Equal(test.expPrefix) {
+			t.Errorf("%d: expected prefix %q of %q; got %q", i, test.expPrefix, test.key, prefix)
+		}
+		if end := topLevelPrefixEnd(test.expPrefix); !test.key.Less(end) {
+			t.Errorf("%d: expected %q within the span of prefix %q; got end %q", i, test.key, test.expPrefix, end)
+		}
+	}
+}
+
+// TestStoreKeyUsage verifies that the usage of a range holding keys of
+// several prefixes is broken down by prefix, and that usages add up.
+func TestStoreKeyUsage(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	for _, key := range []string{"db1/a", "db1/b", "db2/a", "flat"} {
+		value := proto.Value{Bytes: []byte("value")}
+		if err := engine.MVCCPut(store.Engine(), nil, proto.Key(key), store.clock.Now(), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ku, err := store.KeyUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ku.ScannedRanges != 1 {
+		t.Errorf("expected the range to be scanned; got %d scanned ranges", ku.ScannedRanges)
+	}
+	expPrefixes := []proto.Key{engine.KeySystemPrefix, proto.Key("db1/"), proto.Key("db2/"), proto.Key("flat")}
+	if len(ku.Prefixes) != len(expPrefixes) {
+		t.Fatalf("expected prefixes %q; got %+v", expPrefixes, ku.Prefixes)
+	}
+	for i, pu := range ku.Prefixes {
+		if !pu.Prefix.Equal(expPrefixes[i]) || pu.Ranges != 1 || pu.LiveBytes <= 0 || pu.TotalBytes < pu.LiveBytes {
+			t.Errorf("%d: unexpected usage of prefix %q: %+v", i, expPrefixes[i], pu)
+		}
+	}
+	if db1, db2 := ku.Prefixes[1], ku.Prefixes[2]; db1.LiveBytes <= db2.LiveBytes {
+		t.Errorf("expected more live bytes for two keys of db1/ than one of db2/; got %d <= %d", db1.LiveBytes, db2.LiveBytes)
+	}
+
+	sum := &KeyUsage{}
+	sum.Add(ku)
+	sum.Add(ku)
+	if sum.ScannedRanges != 2 || len(sum.Prefixes) != len(ku.Prefixes) ||
+		sum.Prefixes[1].TotalBytes != 2*ku.Prefixes[1].TotalBytes || sum.Prefixes[1].Ranges != 2 {
+		t.Errorf("unexpected sum of usages: %+v", sum)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/proto"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// maxLockTableTxns is the maximum number of transactions whose
+// intents are tracked by a range's lock table. Intents of further
+// transactions are handled as if the table didn't exist.
+const maxLockTableTxns = 1024
+
+// A lockTable tracks the write intents discovered on a range, by
+// transaction, along with the requests waiting on them. A request
+// conflicting with a known intent queues up behind it instead of
+// executing: the first request in line pushes the intent's
+// transaction on behalf of the others, which wait for the intents to
+// be resolved rather than each rediscovering them by scanning and
+// pushing the transaction again. Waiting requests take their turns in
+// the order they arrived.
+//
+// The table is only a hint: intents resolved without its knowledge
+// stay tracked until the request whose turn it is pushes their
+// transaction, which then succeeds at once. It is safe for concurrent
+// use.
+type lockTable struct {
+	sync.Mutex
+	locks map[string]*txnLock // Keyed by transaction ID
+}
+
+// A txnLock is the set of known intents of a transaction on a range
+// and the queue of requests waiting on them.
+type txnLock struct {
+	txn      *proto.Transaction
+	keys     []proto.Key   // Sorted
+	waiters  []*lockWaiter // In order of arrival; the first pushes txn
+	released chan struct{} // Closed once the lock is released
+}
+
+// A lockWaiter is a request queued on a txnLock. Its turn channel is
+// closed once it's the first in line.
+type lockWaiter struct {
+	turn chan struct{}
+}
+
+// newLockTable returns an empty lock table.
+func newLockTable() *lockTable {
+	return &lockTable{locks: map[string]*txnLock{}}
+}
+
+// add records the intents reported by wiErr.
+func (lt *lockTable) add(wiErr *proto.WriteIntentError) {
+	lt.Lock()
+	defer lt.Unlock()
+	l, ok := lt.locks[string(wiErr.Txn.ID)]
+	if !ok {
+		if len(lt.locks) >= maxLockTableTxns {
+			return
+		}
+		l = &txnLock{released: make(chan struct{})}
+		lt.locks[string(wiErr.Txn.ID)] = l
+	}
+	l.txn = gogoproto.Clone(&wiErr.Txn).(*proto.Transaction)
+	for _, key := range append([]proto.Key{wiErr.Key}, wiErr.AdditionalKeys...) {
+		i := sort.Search(len(l.keys), func(i int) bool { return !l.keys[i].Less(key) })
+		if i < len(l.keys) && l.keys[i].Equal(key) {
+			continue
+		}
+		l.keys = append(l.keys, nil)
+		copy(l.keys[i+1:], l.keys[i:])
+		l.keys[i] = append(proto.Key(nil), key...)
+	}
+}
+
+// enqueue queues the request with the specified header behind the
+// known intents of another transaction on the lowest key of the
+// request's span which conflict with it. Reads only conflict with
+// intents at or below their timestamp. It returns the lock and the
+// request's place in its queue, or nil if no intent conflicts.
+func (lt *lockTable) enqueue(header *proto.RequestHeader, readOnly bool) (*txnLock, *lockWaiter) {
+	key, endKey := header.Key, header.EndKey
+	if len(endKey) == 0 {
+		endKey = key.Next()
+	}
+	lt.Lock()
+	defer lt.Unlock()
+	var first *txnLock
+	var firstKey proto.Key
+	for _, l := range lt.locks {
+		if header.Txn != nil && bytes.Equal(header.Txn.ID, l.txn.ID) {
+			continue
+		}
+		if readOnly && header.Timestamp.Less(l.txn.Timestamp) {
+			continue
+		}
+		i := sort.Search(len(l.keys), func(i int) bool { return !l.keys[i].Less(key) })
+		if i == len(l.keys) || !l.keys[i].Less(endKey) {
+			continue
+		}
+		if first == nil || l.keys[i].Less(firstKey) {
+			first, firstKey = l, l.keys[i]
+		}
+	}
+	if first == nil {
+		return nil, nil
+	}
+	w := &lockWaiter{turn: make(chan struct{})}
+	first.waiters = append(first.waiters, w)
+	if len(first.waiters) == 1 {
+		close(w.turn)
+	}
+	return first, w
+}
+
+// dequeue removes w from the queue of l, passing the turn on to the
+// next request in line if it was w's.
+func (lt *lockTable) dequeue(l *txnLock, w *lockWaiter) {
+	lt.Lock()
+	defer lt.Unlock()
+	for i, o := range l.waiters {
+		if o != w {
+			continue
+		}
+		l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+		if i == 0 && len(l.waiters) > 0 {
+			close(l.waiters[0].turn)
+		}
+		return
+	}
+}
+
+// release forgets the intents of the transaction with ID txnID, waking
+// all requests waiting on them.
+func (lt *lockTable) release(txnID []byte) {
+	lt.Lock()
+	defer lt.Unlock()
+	lt.releaseLocked(txnID)
+}
+
+// releaseLocked is release with lt held.
+func (lt *lockTable) releaseLocked(txnID []byte) {
+	l, ok := lt.locks[string(txnID)]
+	if !ok {
+		return
+	}
+	delete(lt.locks, string(txnID))
+	l.keys, l.waiters = nil, nil
+	close(l.released)
+}
+
+// resolve forgets the intents of the transaction with ID txnID on the
+// keys from key to endKey, releasing its lock once no intent is left.
+func (lt *lockTable) resolve(key, endKey proto.Key, txnID []byte) {
+	if len(endKey) == 0 {
+		endKey = key.Next()
+	}
+	lt.Lock()
+	defer lt.Unlock()
+	l, ok := lt.locks[string(txnID)]
+	if !ok {
+		return
+	}
+	start := sort.Search(len(l.keys), func(i int) bool { return !l.keys[i].Less(key) })
+	end := sort.Search(len(l.keys), func(i int) bool { return !l.keys[i].Less(endKey) })
+	l.keys = append(l.keys[:start], l.keys[end:]...)
+	if len(l.keys) == 0 {
+		lt.releaseLocked(txnID)
+	}
+}
+
+// clear forgets all intents, waking all waiting requests.
+func (lt *lockTable) clear() {
+	lt.Lock()
+	defer lt.Unlock()
+	for txnID := range lt.locks {
+		lt.releaseLocked([]byte(txnID))
+	}
+}
+
+// intentError returns a WriteIntentError reporting the intents of l,
+// as if they had been discovered by executing a request, or nil if l
+// has been released.
+func (lt *lockTable) intentError(l *txnLock) *proto.WriteIntentError {
+	lt.Lock()
+	defer lt.Unlock()
+	if len(l.keys) == 0 {
+		return nil
+	}
+	return &proto.WriteIntentError{
+		Key:            l.keys[0],
+		Txn:            *gogoproto.Clone(l.txn).(*proto.Transaction),
+		AdditionalKeys: append([]proto.Key(nil), l.keys[1:]...),
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// hasTurn returns whether the waiter's turn has come.
+func hasTurn(w *lockWaiter) bool {
+	select {
+	case <-w.turn:
+		return true
+	default:
+		return false
+	}
+}
+
+// TestLockTableQueue verifies that requests conflicting with known
+// intents take turns in order of arrival, and that requests of the
+// intents' transaction and reads below them don't wait.
+func TestLockTableQueue(t *testing.T) {
+	lt := newLockTable()
+	txn := &proto.Transaction{ID: []byte("txn"), Timestamp: proto.Timestamp{WallTime: 10}}
+	lt.add(&proto.WriteIntentError{Key: proto.Key("b"), Txn: *txn, AdditionalKeys: []proto.Key{proto.Key("d")}})
+
+	ts := proto.Timestamp{WallTime: 20}
+	if l, _ := lt.enqueue(&proto.RequestHeader{Key: proto.Key("c"), Timestamp: ts}, false); l != nil {
+		t.Error("expected no conflict on a key without intent")
+	}
+	if l, _ := lt.enqueue(&proto.RequestHeader{Key: proto.Key("b"), Timestamp: ts, Txn: txn}, false); l != nil {
+		t.Error("expected no conflict with the transaction's own intents")
+	}
+	if l, _ := lt.enqueue(&proto.RequestHeader{Key: proto.Key("b"), Timestamp: proto.Timestamp{WallTime: 5}}, true); l != nil {
+		t.Error("expected no conflict for a read below the intents")
+	}
+
+	l1, w1 := lt.enqueue(&proto.RequestHeader{Key: proto.Key("a"), EndKey: proto.Key("c"), Timestamp: ts}, true)
+	l2, w2 := lt.enqueue(&proto.RequestHeader{Key: proto.Key("d"), Timestamp: ts}, false)
+	if l1 == nil || l1 != l2 {
+		t.Fatalf("expected both requests to wait on the transaction's lock; got %v, %v", l1, l2)
+	}
+	if !hasTurn(w1) || hasTurn(w2) {
+		t.Fatal("expected the first request to have the first turn")
+	}
+	if wiErr := lt.intentError(l1); wiErr == nil || !wiErr.Key.Equal(proto.Key("b")) ||
+		len(wiErr.AdditionalKeys) != 1 || !wiErr.AdditionalKeys[0].Equal(proto.Key("d")) {
+		t.Errorf("expected intents at b and d; got %+v", wiErr)
+	}
+	lt.dequeue(l1, w1)
+	if !hasTurn(w2) {
+		t.Error("expected the turn to pass on to the second request")
+	}
+}
+
+// TestLockTableResolve verifies that a lock is released, waking its
+// waiters, once all of its intents are resolved.
+func TestLockTableResolve(t *testing.T) {
+	lt := newLockTable()
+	txn := proto.Transaction{ID: []byte("txn")}
+	lt.add(&proto.WriteIntentError{Key: proto.Key("a"), Txn: txn, AdditionalKeys: []proto.Key{proto.Key("b")}})
+	l, _ := lt.enqueue(&proto.RequestHeader{Key: proto.Key("a"), EndKey: proto.Key("z")}, false)
+	if l == nil {
+		t.Fatal("expected the request to wait on the transaction's lock")
+	}
+	lt.resolve(proto.Key("a"), nil, txn.ID)
+	select {
+	case <-l.released:
+		t.Fatal("expected the lock to be held while an intent is left")
+	default:
+	}
+	lt.resolve(proto.Key("a"), proto.Key("z"), txn.ID)
+	select {
+	case <-l.released:
+	default:
+		t.Fatal("expected the lock to be released")
+	}
+	if lt.intentError(l) != nil {
+		t.Error("expected no intents of a released lock")
+	}
+	if l, _ := lt.enqueue(&proto.RequestHeader{Key: proto.Key("b")}, false); l != nil {
+		t.Error("expected no conflict after the lock's release")
+	}
+}
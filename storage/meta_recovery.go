@@ -0,0 +1,191 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// A MetaRecoveryReport describes the range descriptors found in a
+// node's engines and the addressing records rebuilt from them.
+type MetaRecoveryReport struct {
+	Descriptors []*proto.RangeDescriptor // Sorted by start key
+	Records     int                      // Number of addressing records
+}
+
+// rangeDescsByStartKey sorts range descriptors by start key.
+type rangeDescsByStartKey []*proto.RangeDescriptor
+
+func (rd rangeDescsByStartKey) Len() int           { return len(rd) }
+func (rd rangeDescsByStartKey) Swap(i, j int)      { rd[i], rd[j] = rd[j], rd[i] }
+func (rd rangeDescsByStartKey) Less(i, j int) bool { return rd[i].StartKey.Less(rd[j].StartKey) }
+
+// localReplica is a replica of a range in one of the node's engines.
+type localReplica struct {
+	engine  engine.Engine
+	storeID int32
+}
+
+// ReadRangeDescriptors returns the committed range descriptors of the
+// ranges with replicas in the engine. Uncommitted intents, as left by
+// a split which crashed halfway, are ignored, as in Store.Start.
+func ReadRangeDescriptors(e engine.Engine) ([]*proto.RangeDescriptor, error) {
+	var descs []*proto.RangeDescriptor
+	start := engine.RangeDescriptorKey(engine.KeyMin)
+	end := engine.RangeDescriptorKey(engine.KeyMax)
+	if err := engine.MVCCIterateCommitted(e, start, end, func(kv proto.KeyValue) (bool, error) {
+		_, suffix, _ := engine.DecodeRangeKey(kv.Key)
+		if !suffix.Equal(engine.KeyLocalRangeDescriptorSuffix) {
+			return false, nil
+		}
+		desc := &proto.RangeDescriptor{}
+		if err := gogoproto.Unmarshal(kv.Value.Bytes, desc); err != nil {
+			return false, err
+		}
+		descs = append(descs, desc)
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	return descs, nil
+}
+
+// RecoverMetaAddressing rebuilds the meta1 and meta2 addressing
+// records from the range descriptors of the replicas in the supplied
+// engines. It is intended for disaster recovery after the replicas of
+// the meta ranges have been lost or corrupted elsewhere, and must only
+// be run against the engines of a stopped node.
+//
+// As a guard against making matters worse, nothing is written unless
+// the descriptors found are consistent between engines and cover the
+// entire key space without gaps or overlaps, and every range which
+// holds addressing records has a replica in one of the engines. The
+// existing addressing records of each such replica are deleted and
+// replaced at timestamp now. If dryRun is true, the checks are run
+// but nothing is written.
+func RecoverMetaAddressing(engines []engine.Engine, now proto.Timestamp, dryRun bool) (*MetaRecoveryReport, error) {
+	descs := map[int64]*proto.RangeDescriptor{}
+	replicas := map[int64][]localReplica{}
+	for i, e := range engines {
+		var ident proto.StoreIdent
+		ok, err := engine.MVCCGetProto(e, engine.StoreIdentKey(), proto.ZeroTimestamp, nil, &ident)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, util.Errorf("engine %d is not bootstrapped", i)
+		}
+		rangeDescs, err := ReadRangeDescriptors(e)
+		if err != nil {
+			return nil, util.Errorf("unable to read range descriptors of store %d: %s", ident.StoreID, err)
+		}
+		for _, desc := range rangeDescs {
+			if existing, ok := descs[desc.RaftID]; ok {
+				if !existing.StartKey.Equal(desc.StartKey) || !existing.EndKey.Equal(desc.EndKey) {
+					return nil, util.Errorf("replicas of range %d disagree on its bounds: [%q, %q) vs. [%q, %q) on store %d",
+						desc.RaftID, existing.StartKey, existing.EndKey, desc.StartKey, desc.EndKey, ident.StoreID)
+				}
+			} else {
+				descs[desc.RaftID] = desc
+			}
+			replicas[desc.RaftID] = append(replicas[desc.RaftID], localReplica{engine: e, storeID: ident.StoreID})
+		}
+	}
+
+	report := &MetaRecoveryReport{}
+	for _, desc := range descs {
+		report.Descriptors = append(report.Descriptors, desc)
+	}
+	sort.Sort(rangeDescsByStartKey(report.Descriptors))
+
+	// Verify the ranges cover the key space without gaps or overlaps.
+	expStart := engine.KeyMin
+	for _, desc := range report.Descriptors {
+		if desc.StartKey.Less(expStart) {
+			return nil, util.Errorf("range %d [%q, %q) overlaps preceding range", desc.RaftID, desc.StartKey, desc.EndKey)
+		} else if !desc.StartKey.Equal(expStart) {
+			return nil, util.Errorf("no replica found for keys [%q, %q)", expStart, desc.StartKey)
+		}
+		expStart = desc.EndKey
+	}
+	if !expStart.Equal(engine.KeyMax) {
+		return nil, util.Errorf("no replica found for keys [%q, %q)", expStart, engine.KeyMax)
+	}
+
+	// Group the addressing records by the range which holds them.
+	type metaRecord struct {
+		key  proto.Key
+		desc *proto.RangeDescriptor
+	}
+	records := map[int64][]metaRecord{}
+	for _, desc := range report.Descriptors {
+		keys, err := rangeAddressingKeys(desc)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			i := sort.Search(len(report.Descriptors), func(i int) bool {
+				return key.Less(report.Descriptors[i].EndKey)
+			})
+			holder := report.Descriptors[i]
+			if len(replicas[holder.RaftID]) == 0 {
+				return nil, util.Errorf("range %d holding addressing record %q has no local replica", holder.RaftID, key)
+			}
+			records[holder.RaftID] = append(records[holder.RaftID], metaRecord{key: key, desc: desc})
+			report.Records++
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	// Replace the addressing records of each replica of a range which
+	// overlaps the meta key span.
+	for _, desc := range report.Descriptors {
+		start, end := desc.StartKey, desc.EndKey
+		if start.Less(engine.KeyMetaPrefix) {
+			start = engine.KeyMetaPrefix
+		}
+		if engine.KeyMetaMax.Less(end) {
+			end = engine.KeyMetaMax
+		}
+		if !start.Less(end) {
+			continue
+		}
+		for _, replica := range replicas[desc.RaftID] {
+			batch := replica.engine.NewBatch()
+			ms := &engine.MVCCStats{}
+			if _, err := engine.MVCCDeleteRange(batch, ms, start, end, 0, now, nil); err != nil {
+				return nil, util.Errorf("unable to clear addressing records of range %d on store %d: %s",
+					desc.RaftID, replica.storeID, err)
+			}
+			for _, rec := range records[desc.RaftID] {
+				if err := engine.MVCCPutProto(batch, ms, rec.key, now, nil, rec.desc); err != nil {
+					return nil, err
+				}
+			}
+			ms.MergeStats(batch, desc.RaftID, replica.storeID)
+			if err := batch.Commit(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestRecoverMetaAddressing verifies that lost addressing records are
+// rebuilt from the range descriptors of local replicas, and that
+// nothing is written on a dry run.
+func TestRecoverMetaAddressing(t *testing.T) {
+	store, _ := createTestStore(t)
+	store.Stop()
+	eng := store.Engine()
+
+	metaKeys := []proto.Key{
+		engine.MakeKey(engine.KeyMeta1Prefix, engine.KeyMax),
+		engine.MakeKey(engine.KeyMeta2Prefix, engine.KeyMax),
+	}
+	now := store.clock.Now()
+	for _, key := range metaKeys {
+		if err := engine.MVCCDelete(eng, nil, key, now, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = store.clock.Now()
+	now.Logical++
+	for _, dryRun := range []bool{true, false} {
+		report, err := RecoverMetaAddressing([]engine.Engine{eng}, now, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Descriptors) != 1 || report.Records != 2 {
+			t.Errorf("expected 1 range and 2 records; got %+v", report)
+		}
+		for _, key := range metaKeys {
+			desc := &proto.RangeDescriptor{}
+			ok, err := engine.MVCCGetProto(eng, key, now, nil, desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok == dryRun || (ok && desc.RaftID != 1) {
+				t.Errorf("dry run %t: expected record %q present=%t; got %t, %+v", dryRun, key, !dryRun, ok, desc)
+			}
+		}
+	}
+}
+
+// TestRecoverMetaAddressingGuards verifies that nothing is written if
+// the local replicas leave gaps in or overlap in the key space.
+func TestRecoverMetaAddressingGuards(t *testing.T) {
+	store, _ := createTestStore(t)
+	store.Stop()
+
+	// Create a second engine with a replica of range [a, b).
+	other := engine.NewInMem(proto.Attributes{}, 1<<20)
+	if err := NewStore(store.clock, other, nil, nil).Bootstrap(proto.StoreIdent{StoreID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	desc := &proto.RangeDescriptor{
+		RaftID:   2,
+		StartKey: proto.Key("a"),
+		EndKey:   proto.Key("b"),
+		Replicas: []proto.Replica{{NodeID: 1, StoreID: 2}},
+	}
+	if err := engine.MVCCPutProto(other, nil, engine.RangeDescriptorKey(desc.StartKey), store.clock.Now(), nil, desc); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		engines []engine.Engine
+		expErr  string
+	}{
+		{[]engine.Engine{other}, "no replica found"},
+		{[]engine.Engine{store.Engine(), other}, "overlaps"},
+	}
+	for i, test := range testCases {
+		if _, err := RecoverMetaAddressing(test.engines, store.clock.Now(), false); err == nil || !strings.Contains(err.Error(), test.expErr) {
+			t.Errorf("%d: expected error containing %q; got %v", i, test.expErr, err)
+		}
+	}
+}
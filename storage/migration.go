@@ -0,0 +1,115 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// baseStoreVersion is the on-disk format version of stores created
+// before format versions were recorded.
+const baseStoreVersion = 1
+
+// A storeMigration is an idempotent transformation of a store's
+// on-disk data from the preceding format version to version. Being
+// idempotent, a migration interrupted by a crash is simply rerun.
+type storeMigration struct {
+	version int64
+	name    string
+	migrate func(engine.Engine) error
+}
+
+// storeMigrations lists the registered migrations in version order.
+// Changes to the on-disk format (e.g. moving keys or changing value
+// encodings) register a migration here instead of handling data in
+// both formats.
+var storeMigrations []storeMigration
+
+// registerStoreMigration adds a migration to the registry. Migrations
+// must be registered in consecutive version order.
+func registerStoreMigration(version int64, name string, migrate func(engine.Engine) error) {
+	if expected := StoreVersion() + 1; version != expected {
+		log.Fatalf("store migration %q registered with version %d; expected %d", name, version, expected)
+	}
+	storeMigrations = append(storeMigrations, storeMigration{version: version, name: name, migrate: migrate})
+}
+
+// StoreVersion returns the on-disk format version of stores written
+// by this binary.
+func StoreVersion() int64 {
+	return baseStoreVersion + int64(len(storeMigrations))
+}
+
+// ReadStoreVersion returns the on-disk format version of the store
+// held by the engine.
+func ReadStoreVersion(e engine.Engine) (int64, error) {
+	val, err := engine.MVCCGet(e, engine.StoreVersionKey(), proto.ZeroTimestamp, nil)
+	if err != nil {
+		return 0, err
+	}
+	if val == nil {
+		return baseStoreVersion, nil
+	}
+	version, err := val.GetInt()
+	if err != nil {
+		return 0, util.Errorf("invalid store version: %s", err)
+	}
+	return version, nil
+}
+
+// writeStoreVersion records the on-disk format version of the store
+// held by the engine.
+func writeStoreVersion(e engine.Engine, version int64) error {
+	value := proto.Value{}
+	value.SetInt(version)
+	return engine.MVCCPut(e, nil, engine.StoreVersionKey(), proto.ZeroTimestamp, value, nil)
+}
+
+// MigrateStore runs the migrations required to bring the store held
+// by the engine to StoreVersion, recording the version reached after
+// each. If dryRun is true, nothing is run. Returns the names of the
+// migrations run or, with dryRun, pending. Stores with a version
+// newer than StoreVersion are rejected.
+func MigrateStore(e engine.Engine, dryRun bool) ([]string, error) {
+	version, err := ReadStoreVersion(e)
+	if err != nil {
+		return nil, err
+	}
+	if version > StoreVersion() {
+		return nil, util.Errorf("store format version %d is newer than the supported version %d", version, StoreVersion())
+	}
+	var names []string
+	for _, m := range storeMigrations {
+		if m.version <= version {
+			continue
+		}
+		names = append(names, m.name)
+		if dryRun {
+			continue
+		}
+		log.Infof("migrating store %s to format version %d: %s", e, m.version, m.name)
+		if err := m.migrate(e); err != nil {
+			return names, util.Errorf("store migration to version %d (%s) failed: %s", m.version, m.name, err)
+		}
+		if err := writeStoreVersion(e, m.version); err != nil {
+			return names, err
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestMigrateStore verifies that pending migrations are run in order,
+// that the version is recorded after each and that migrations aren't
+// rerun.
+func TestMigrateStore(t *testing.T) {
+	defer func(migrations []storeMigration) { storeMigrations = migrations }(storeMigrations)
+	storeMigrations = nil
+
+	e := engine.NewInMem(proto.Attributes{}, 1<<20)
+	if version, err := ReadStoreVersion(e); err != nil || version != baseStoreVersion {
+		t.Fatalf("expected unversioned store at version %d; got %d, %v", baseStoreVersion, version, err)
+	}
+
+	var run []string
+	failSecond := true
+	registerStoreMigration(baseStoreVersion+1, "first", func(engine.Engine) error {
+		run = append(run, "first")
+		return nil
+	})
+	registerStoreMigration(baseStoreVersion+2, "second", func(engine.Engine) error {
+		run = append(run, "second")
+		if failSecond {
+			return util.Errorf("injected failure")
+		}
+		return nil
+	})
+
+	if names, err := MigrateStore(e, true); err != nil || !reflect.DeepEqual(names, []string{"first", "second"}) {
+		t.Fatalf("expected both migrations pending; got %v, %v", names, err)
+	}
+	if len(run) != 0 {
+		t.Fatalf("expected dry run not to run migrations; ran %v", run)
+	}
+
+	// The failed migration leaves the store at the first version.
+	if _, err := MigrateStore(e, false); err == nil {
+		t.Fatal("expected migration failure")
+	}
+	if version, err := ReadStoreVersion(e); err != nil || version != baseStoreVersion+1 {
+		t.Fatalf("expected version %d after failure; got %d, %v", baseStoreVersion+1, version, err)
+	}
+
+	failSecond = false
+	run = nil
+	if names, err := MigrateStore(e, false); err != nil || !reflect.DeepEqual(names, []string{"second"}) {
+		t.Fatalf("expected only second migration to run; got %v, %v", names, err)
+	}
+	if version, err := ReadStoreVersion(e); err != nil || version != StoreVersion() {
+		t.Fatalf("expected version %d; got %d, %v", StoreVersion(), version, err)
+	}
+
+	// Stores newer than this binary are rejected.
+	if err := writeStoreVersion(e, StoreVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateStore(e, false); err == nil {
+		t.Error("expected error migrating store with newer format version")
+	}
+}
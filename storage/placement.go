@@ -0,0 +1,196 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A PlacementChange is a hypothetical change to the cluster whose
+// effect on replica placement is predicted by PlanPlacement.
+type PlacementChange struct {
+	DownNodes []int32 // Nodes taken down
+	// ZonePrefix is the key prefix of the zone whose config is
+	// replaced by Zone; the empty prefix is the default zone.
+	ZonePrefix proto.Key
+	Zone       *proto.ZoneConfig // Nil if no zone config changes
+}
+
+// A PlacementRange is a range considered by PlanPlacement, along with
+// the size of its data.
+type PlacementRange struct {
+	Desc  proto.RangeDescriptor
+	Bytes int64
+}
+
+// A RangePlacement describes how a range's replicas would change
+// after a PlacementChange.
+type RangePlacement struct {
+	RaftID   int64
+	StartKey proto.Key
+	EndKey   proto.Key
+	Bytes    int64 // Size of the range's data, copied to each added replica
+	// Removed are the replicas lost on down nodes or no longer
+	// required by the range's zone.
+	Removed []proto.Replica
+	// Added are the attributes of the replicas which would be created.
+	Added []proto.Attributes
+	// Unplaceable is the number of added replicas no available store
+	// satisfies; the range stays under-replicated until one does.
+	Unplaceable int
+}
+
+// A PlacementPlan is the predicted effect of a PlacementChange: the
+// ranges whose replicas would change and the data movement needed.
+type PlacementPlan struct {
+	Ranges      []RangePlacement
+	Replicas    int   // Replicas created
+	Bytes       int64 // Bytes copied to create replicas
+	Unplaceable int   // Replicas for which no store is available
+}
+
+// PlanPlacement predicts the replicas of ranges which would be removed
+// and created after change, given the zone configs and the stores
+// found by findStores. Each range's replicas are matched to the
+// replicas required by its zone, as changed; replicas on down nodes
+// and replicas matching none are removed, and a replica is created
+// for each unmatched requirement, copying the range's data. New
+// replicas are only counted as placeable if a store on another node
+// than the range's other replicas satisfies them; like the allocator,
+// suspect stores and stores with unhealthy LSM trees are skipped.
+// The result doesn't account for ranges split by a zone change.
+func PlanPlacement(ranges []PlacementRange, zones PrefixConfigMap, change *PlacementChange,
+	findStores FindStoreFunc) (*PlacementPlan, error) {
+	if change.Zone != nil {
+		// The map is rebuilt without the entries it added to mark the
+		// ends of prefixes.
+		var configs []*PrefixConfig
+		for _, pc := range zones {
+			if pc.Canonical == nil && !pc.Prefix.Equal(change.ZonePrefix) {
+				configs = append(configs, &PrefixConfig{Prefix: pc.Prefix, Config: pc.Config})
+			}
+		}
+		configs = append(configs, &PrefixConfig{Prefix: change.ZonePrefix, Config: change.Zone})
+		var err error
+		if zones, err = NewPrefixConfigMap(configs); err != nil {
+			return nil, err
+		}
+	}
+	down := map[int32]struct{}{}
+	for _, nodeID := range change.DownNodes {
+		down[nodeID] = struct{}{}
+	}
+
+	plan := &PlacementPlan{}
+	for _, pr := range ranges {
+		zone, ok := zones.MatchByPrefix(pr.Desc.StartKey).Config.(*proto.ZoneConfig)
+		if !ok {
+			return nil, util.Errorf("range %d: no zone config found for key %q", pr.Desc.RaftID, pr.Desc.StartKey)
+		}
+		rp := RangePlacement{
+			RaftID:   pr.Desc.RaftID,
+			StartKey: pr.Desc.StartKey,
+			EndKey:   pr.Desc.EndKey,
+			Bytes:    pr.Bytes,
+		}
+		var survivors []proto.Replica
+		for _, replica := range pr.Desc.Replicas {
+			if _, ok := down[replica.NodeID]; ok {
+				rp.Removed = append(rp.Removed, replica)
+			} else {
+				survivors = append(survivors, replica)
+			}
+		}
+		missing, used := matchReplicaAttrs(zone, survivors)
+		usedNodes := map[int32]struct{}{}
+		for i, replica := range survivors {
+			if used[i] {
+				usedNodes[replica.NodeID] = struct{}{}
+			} else {
+				rp.Removed = append(rp.Removed, replica)
+			}
+		}
+		for _, slot := range missing {
+			rp.Added = append(rp.Added, slot.attrs)
+			target, err := placementTarget(slot.attrs, down, usedNodes, findStores)
+			if err != nil {
+				return nil, err
+			}
+			if target == nil {
+				rp.Unplaceable++
+				continue
+			}
+			usedNodes[target.Node.NodeID] = struct{}{}
+		}
+		if len(rp.Removed) == 0 && len(rp.Added) == 0 {
+			continue
+		}
+		plan.Ranges = append(plan.Ranges, rp)
+		plan.Replicas += len(rp.Added)
+		plan.Bytes += int64(len(rp.Added)) * rp.Bytes
+		plan.Unplaceable += rp.Unplaceable
+	}
+	return plan, nil
+}
+
+// placementTarget returns the store with the most available capacity
+// which satisfies attrs and could receive a new replica: one on a node
+// which is neither down nor used by another of the range's replicas.
+// Returns nil if there is none.
+func placementTarget(attrs proto.Attributes, down, usedNodes map[int32]struct{},
+	findStores FindStoreFunc) (*StoreDescriptor, error) {
+	stores, err := findStores(attrs)
+	if err != nil {
+		return nil, err
+	}
+	var target *StoreDescriptor
+	for _, s := range stores {
+		_, isDown := down[s.Node.NodeID]
+		_, isUsed := usedNodes[s.Node.NodeID]
+		if isDown || isUsed || s.Suspect || !lsmHealthy(s.Capacity) {
+			continue
+		}
+		if target == nil || s.Capacity.PercentAvail() > target.Capacity.PercentAvail() {
+			target = s
+		}
+	}
+	return target, nil
+}
+
+// PlacementRanges returns the store's ranges along with the sizes of
+// their data, for PlanPlacement.
+func (s *Store) PlacementRanges() ([]PlacementRange, error) {
+	s.mu.RLock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.RUnlock()
+	result := make([]PlacementRange, 0, len(ranges))
+	for _, rng := range ranges {
+		rng.RLock()
+		desc := *rng.Desc
+		rng.RUnlock()
+		bytes, err := engine.GetRangeSize(s.engine, desc.RaftID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, PlacementRange{Desc: desc, Bytes: bytes})
+	}
+	return result, nil
+}
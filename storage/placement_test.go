@@ -0,0 +1,100 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestPlanPlacement verifies the replicas removed and created, and
+// the bytes copied, after taking a node down and after changing a
+// zone config.
+func TestPlanPlacement(t *testing.T) {
+	ssd := proto.Attributes{Attrs: []string{"a", "ssd"}}
+	hdd := proto.Attributes{Attrs: []string{"a", "hdd"}}
+	zones, err := NewPrefixConfigMap([]*PrefixConfig{
+		{Prefix: engine.KeyMin, Config: &proto.ZoneConfig{ReplicaAttrs: []proto.Attributes{ssd, hdd}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The replicas are placed on sameDCStores.
+	ranges := []PlacementRange{
+		{Desc: proto.RangeDescriptor{RaftID: 1, StartKey: engine.KeyMin, EndKey: proto.Key("b"),
+			Replicas: []proto.Replica{{NodeID: 1, StoreID: 1, Attrs: ssd}, {NodeID: 3, StoreID: 4, Attrs: hdd}}},
+			Bytes: 100},
+		{Desc: proto.RangeDescriptor{RaftID: 2, StartKey: proto.Key("b"), EndKey: engine.KeyMax,
+			Replicas: []proto.Replica{{NodeID: 2, StoreID: 2, Attrs: ssd}, {NodeID: 3, StoreID: 4, Attrs: hdd}}},
+			Bytes: 50},
+	}
+
+	// Unchanged, no replicas move.
+	plan, err := PlanPlacement(ranges, zones, &PlacementChange{}, sameDCStores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Ranges) != 0 {
+		t.Errorf("expected no ranges to move; got %+v", plan.Ranges)
+	}
+
+	// Taking node 3 down loses both ranges' hdd replicas. The only
+	// other hdd store is on node 2, which already holds a replica of
+	// range 2.
+	plan, err = PlanPlacement(ranges, zones, &PlacementChange{DownNodes: []int32{3}}, sameDCStores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Ranges) != 2 || plan.Replicas != 2 || plan.Bytes != 150 || plan.Unplaceable != 1 {
+		t.Errorf("unexpected plan for node down: %+v", plan)
+	}
+	for _, rp := range plan.Ranges {
+		if len(rp.Removed) != 1 || rp.Removed[0].NodeID != 3 {
+			t.Errorf("range %d: expected the replica on node 3 removed; got %+v", rp.RaftID, rp.Removed)
+		}
+		if expUnplaceable := int(rp.RaftID - 1); rp.Unplaceable != expUnplaceable {
+			t.Errorf("range %d: expected %d unplaceable replicas; got %d", rp.RaftID, expUnplaceable, rp.Unplaceable)
+		}
+	}
+
+	// A zone at "b" requiring a single ssd replica drops range 2's hdd
+	// replica without copying data.
+	plan, err = PlanPlacement(ranges, zones, &PlacementChange{
+		ZonePrefix: proto.Key("b"),
+		Zone:       &proto.ZoneConfig{ReplicaAttrs: []proto.Attributes{ssd}},
+	}, sameDCStores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Ranges) != 1 || plan.Ranges[0].RaftID != 2 || len(plan.Ranges[0].Removed) != 1 ||
+		plan.Ranges[0].Removed[0].StoreID != 4 || plan.Replicas != 0 || plan.Bytes != 0 {
+		t.Errorf("unexpected plan for zone change: %+v", plan)
+	}
+
+	// Replacing the default zone with three replicas adds a replica
+	// of each range.
+	plan, err = PlanPlacement(ranges, zones, &PlacementChange{
+		Zone: &proto.ZoneConfig{ReplicaAttrs: []proto.Attributes{ssd, hdd, ssd}},
+	}, sameDCStores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Ranges) != 2 || plan.Replicas != 2 || plan.Bytes != 150 || plan.Unplaceable != 0 {
+		t.Errorf("unexpected plan for default zone change: %+v", plan)
+	}
+}
@@ -19,11 +19,87 @@ package storage
 
 import (
 	"container/heap"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
+	"github.com/cockroachdb/cockroach/util/settings"
 )
 
+// QueueStatesEnvVar is the environment variable from which the initial
+// state of queues is read, as a comma-separated list of
+// <queue>=<state> pairs, e.g. "scan=paused". This allows a node to be
+// started with a misbehaving queue already switched off.
+const QueueStatesEnvVar = "COCKROACH_QUEUE_STATES"
+
+// A QueueState is a runtime switch controlling whether a queue adds
+// and processes ranges. It allows queues to be stopped in an
+// emergency and later resumed without restarting the node.
+type QueueState int32
+
+const (
+	// QueueEnabled is the normal state of a queue.
+	QueueEnabled QueueState = iota
+	// QueuePaused queues ranges as usual but doesn't process them.
+	QueuePaused
+	// QueueDisabled neither queues nor processes ranges. Any queued
+	// ranges are dropped.
+	QueueDisabled
+)
+
+var queueStateNames = map[QueueState]string{
+	QueueEnabled:  "enabled",
+	QueuePaused:   "paused",
+	QueueDisabled: "disabled",
+}
+
+// String returns the name of the queue state.
+func (qs QueueState) String() string {
+	if name, ok := queueStateNames[qs]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseQueueState parses a queue state name.
+func ParseQueueState(name string) (QueueState, error) {
+	for qs, n := range queueStateNames {
+		if n == name {
+			return qs, nil
+		}
+	}
+	return 0, util.Errorf("unknown queue state %q; must be one of enabled, paused or disabled", name)
+}
+
+// parseQueueStates parses a comma-separated list of <queue>=<state>
+// pairs as found in QueueStatesEnvVar.
+func parseQueueStates(spec string) (map[string]QueueState, error) {
+	states := map[string]QueueState{}
+	for _, pair := range strings.Split(spec, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, util.Errorf("invalid queue state %q; expected <queue>=<state>", pair)
+		}
+		qs, err := ParseQueueState(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		states[parts[0]] = qs
+	}
+	return states, nil
+}
+
 // A rangeItem holds a range and its priority for use with a priority queue.
 type rangeItem struct {
 	value    *Range
@@ -81,14 +157,39 @@ type processFn func(time.Time, *Range) error
 // Queue implementations should embed a baseQueue and provide it
 // with shouldQueueFn.
 //
-// baseQueue is not thread safe.
+// baseQueue is not thread safe, with the exception of SetState and
+// State.
+//
+// Once a queue's checkpoint is loaded from its store's engine, the
+// queued ranges and the progress of the range being processed are
+// checkpointed to the engine as they change, so that the queue
+// resumes its work after the store restarts.
 type baseQueue struct {
 	name      string
 	shouldQ   shouldQueueFn        // Should a range be queued?
 	process   processFn            // Executes queue-specific work on range
 	maxSize   int                  // Maximum number of ranges to queue
+	maxSizeS  *settings.IntSetting // If set, overrides maxSize at runtime
 	priorityQ priorityQueue        // The priority queue
 	ranges    map[int64]*rangeItem // Map from RaftID to rangeItem (for updating priority)
+	now       func() time.Time     // Current time; time.Now unless set via setClock
+	state     int32                // QueueState; accessed atomically
+	stalled   func() bool          // If set and true, ranges are left queued rather than processed
+	warmup    *storeWarmup         // If set, paces processing while the store warms up
+
+	lastProcessed time.Time // Time at which the last range was processed
+
+	// Metrics shared by the queues of the same name on all stores.
+	pending   *metrics.Gauge     // Ranges queued
+	processed *metrics.Counter   // Ranges processed
+	spilled   *metrics.Counter   // Ranges dropped because the queue was full
+	failures  *metrics.Counter   // Ranges whose processing failed
+	latency   *metrics.Histogram // Processing latency in nanoseconds
+	reported  int                // This queue's length as last added to pending
+
+	eng        engine.Engine    // If set, the queue is checkpointed to eng
+	processing int64            // RaftID of the range being processed, or zero
+	resume     proto.EncodedKey // Key from which processing of the range resumes
 }
 
 // newBaseQueue returns a new instance of baseQueue with the
@@ -104,46 +205,242 @@ func newBaseQueue(name string, shouldQ shouldQueueFn, process processFn, maxSize
 		process: process,
 		maxSize: maxSize,
 		ranges:  map[int64]*rangeItem{},
+		now:     time.Now,
+
+		pending:   metrics.DefaultRegistry.Gauge("queue." + name + ".pending"),
+		processed: metrics.DefaultRegistry.Counter("queue." + name + ".processed"),
+		spilled:   metrics.DefaultRegistry.Counter("queue." + name + ".spilled"),
+		failures:  metrics.DefaultRegistry.Counter("queue." + name + ".failures"),
+		latency:   metrics.DefaultRegistry.Histogram("queue."+name+".latency", metrics.DefaultWindow),
+	}
+}
+
+// maxQueueSize returns the maximum number of ranges to queue, read
+// from the queue's cluster setting if it has one.
+func (bq *baseQueue) maxQueueSize() int {
+	if bq.maxSizeS != nil {
+		return int(bq.maxSizeS.Get())
+	}
+	return bq.maxSize
+}
+
+// setClock sets the clock used to supply the current time to the
+// shouldQ and process functions. Tests use this with an
+// hlc.ManualClock so that queue decisions are deterministic.
+func (bq *baseQueue) setClock(clock *hlc.Clock) {
+	bq.now = func() time.Time {
+		return time.Unix(0, clock.PhysicalNow())
 	}
 }
 
+// SetState sets the queue's state. Ranges queued when the queue is
+// disabled are dropped on the queue's next use.
+func (bq *baseQueue) SetState(state QueueState) {
+	atomic.StoreInt32(&bq.state, int32(state))
+	log.Infof("%s queue %s", bq.name, state)
+}
+
+// State returns the queue's state.
+func (bq *baseQueue) State() QueueState {
+	return QueueState(atomic.LoadInt32(&bq.state))
+}
+
+// checkState returns the queue's state, clearing the queue if it has
+// been disabled.
+func (bq *baseQueue) checkState() QueueState {
+	state := bq.State()
+	if state == QueueDisabled && bq.priorityQ.Len() > 0 {
+		bq.Clear()
+		bq.saveCheckpoint(bq.eng)
+	}
+	return state
+}
+
 // Length returns the current size of the queue.
 func (bq *baseQueue) Length() int {
 	return bq.priorityQ.Len()
 }
 
 // Pop dequeues and processes the highest priority range in the queue.
-// Returns the range if not empty; otherwise, returns nil.
+// Returns the range if not empty; otherwise, returns nil. Nothing is
+// processed unless the queue is enabled and its store's disk is not
+// stalled. While the store warms up after a restart, queued system
+// ranges are processed first and other ranges no sooner than the
+// warm-up's queue delay after the last range processed. A range which
+// has been stopped, e.g. because it was removed from its store, is
+// dequeued without being processed.
 func (bq *baseQueue) Pop() *Range {
-	if bq.priorityQ.Len() == 0 {
+	if bq.checkState() != QueueEnabled || bq.priorityQ.Len() == 0 {
 		return nil
 	}
-	item := heap.Pop(&bq.priorityQ).(*rangeItem)
-	delete(bq.ranges, item.value.Desc.RaftID)
+	if bq.stalled != nil && bq.stalled() {
+		log.V(1).Infof("%s queue: store is stalled; deferring processing", bq.name)
+		return nil
+	}
+	now := bq.now()
+	item := bq.priorityQ[0]
+	if bq.warmup != nil && bq.warmup.progress(now) < 1 {
+		if system := bq.firstSystemRange(); system != nil {
+			item = system
+		} else if delay := bq.warmup.queueDelay(now); now.Sub(bq.lastProcessed) < delay {
+			log.V(1).Infof("%s queue: store is warming up; deferring processing", bq.name)
+			return nil
+		}
+	}
+	bq.remove(item.index)
+	bq.updatePending()
+	if item.value.isStopped() {
+		log.V(1).Infof("%s queue: skipping removed range %d", bq.name, item.value.Desc.RaftID)
+		bq.saveCheckpoint(bq.eng)
+		return item.value
+	}
+	bq.lastProcessed = now
+	// Progress checkpointed for another range no longer applies.
+	if bq.processing != item.value.Desc.RaftID {
+		bq.processing, bq.resume = item.value.Desc.RaftID, nil
+	}
+	bq.saveCheckpoint(bq.eng)
 	log.Infof("processing range %d from %s queue with priority %f...",
 		item.value.Desc.RaftID, bq.name, item.priority)
-	if err := bq.process(time.Now(), item.value); err != nil {
+	start := time.Now()
+	if err := bq.process(bq.now(), item.value); err != nil {
+		bq.failures.Inc(1)
+		metrics.DefaultRegistry.Counter("queue." + bq.name + ".failures." + errorTypeName(err)).Inc(1)
 		log.Errorf("failure processing range %d from %s queue: %s",
 			item.value.Desc.RaftID, bq.name, err)
 	}
+	bq.processed.Inc(1)
+	bq.latency.RecordDuration(time.Since(start))
+	bq.processing, bq.resume = 0, nil
+	bq.saveCheckpoint(bq.eng)
 	return item.value
 }
 
+// firstSystemRange returns the highest priority queued system range,
+// or nil if none is queued.
+func (bq *baseQueue) firstSystemRange() *rangeItem {
+	var first *rangeItem
+	for _, item := range bq.priorityQ {
+		if isSystemRange(item.value) && (first == nil || item.priority > first.priority) {
+			first = item
+		}
+	}
+	return first
+}
+
+// resumeKey returns the key from which processing of rng resumes, as
+// checkpointed by an earlier, interrupted invocation of the queue's
+// process function. Returns nil if processing starts from the
+// beginning of the range.
+func (bq *baseQueue) resumeKey(rng *Range) proto.EncodedKey {
+	if bq.processing != rng.Desc.RaftID {
+		return nil
+	}
+	return bq.resume
+}
+
+// setResumeKey checkpoints the progress of processing rng to w, so
+// that processing resumes from key if interrupted. Queues call this
+// from their process functions, writing the checkpoint in the same
+// batch as the work done up to key.
+func (bq *baseQueue) setResumeKey(w engine.Engine, rng *Range, key proto.EncodedKey) {
+	bq.processing, bq.resume = rng.Desc.RaftID, key
+	bq.saveCheckpoint(w)
+}
+
+// saveCheckpoint writes the queue's checkpoint to w, if the queue is
+// checkpointed. Failures are logged; at worst, the queue loses work
+// queued since its last checkpoint on restart.
+func (bq *baseQueue) saveCheckpoint(w engine.Engine) {
+	if bq.eng == nil {
+		return
+	}
+	cp := &proto.QueueCheckpoint{
+		ProcessingRaftID: bq.processing,
+		ResumeKey:        bq.resume,
+	}
+	for _, item := range bq.priorityQ {
+		cp.Pending = append(cp.Pending, proto.QueuedRange{
+			RaftID:   item.value.Desc.RaftID,
+			Priority: item.priority,
+		})
+	}
+	if err := engine.MVCCPutProto(w, nil, engine.StoreQueueCheckpointKey(bq.name), proto.ZeroTimestamp, nil, cp); err != nil {
+		log.Errorf("unable to checkpoint %s queue: %s", bq.name, err)
+	}
+}
+
+// loadCheckpoint restores the queued ranges and the progress of the
+// range being processed from the queue's checkpoint in eng, and
+// checkpoints the queue to eng from then on. The range being
+// processed is queued ahead of all others. Ranges which no longer
+// exist, as found via getRange, are dropped.
+func (bq *baseQueue) loadCheckpoint(eng engine.Engine, getRange func(int64) (*Range, error)) error {
+	bq.eng = eng
+	cp := &proto.QueueCheckpoint{}
+	ok, err := engine.MVCCGetProto(eng, engine.StoreQueueCheckpointKey(bq.name), proto.ZeroTimestamp, nil, cp)
+	if err != nil || !ok {
+		return err
+	}
+	push := func(raftID int64, priority float64) {
+		if _, ok := bq.ranges[raftID]; ok {
+			return
+		}
+		rng, err := getRange(raftID)
+		if err != nil {
+			log.V(1).Infof("dropping range %d from %s queue checkpoint: %s", raftID, bq.name, err)
+			return
+		}
+		item := &rangeItem{value: rng, priority: priority}
+		heap.Push(&bq.priorityQ, item)
+		bq.ranges[raftID] = item
+	}
+	if cp.ProcessingRaftID != 0 {
+		bq.processing, bq.resume = cp.ProcessingRaftID, cp.ResumeKey
+		push(cp.ProcessingRaftID, math.Inf(1))
+	}
+	for _, qr := range cp.Pending {
+		push(qr.RaftID, qr.Priority)
+	}
+	bq.updatePending()
+	if bq.priorityQ.Len() > 0 {
+		log.Infof("restored %d range(s) to %s queue", bq.priorityQ.Len(), bq.name)
+	}
+	return nil
+}
+
+// DrainQueue synchronously processes all queued ranges in priority
+// order and returns them in the order processed. This is intended
+// for tests, which can avoid waiting on the range scanner.
+func (bq *baseQueue) DrainQueue() []*Range {
+	var ranges []*Range
+	for rng := bq.Pop(); rng != nil; rng = bq.Pop() {
+		ranges = append(ranges, rng)
+	}
+	return ranges
+}
+
 // MaybeAdd adds the specified range if bq.shouldQ specifies it should
 // be queued. Ranges are added to the queue using the priority
 // returned by bq.shouldQ. If the queue is too full, an already-queued
 // range with the lowest priority may be dropped.
 func (bq *baseQueue) MaybeAdd(rng *Range) {
-	should, priority := bq.shouldQ(time.Now(), rng)
+	if bq.checkState() == QueueDisabled {
+		return
+	}
+	should, priority := bq.shouldQ(bq.now(), rng)
 	item, ok := bq.ranges[rng.Desc.RaftID]
 	if !should {
 		if ok {
 			bq.remove(item.index)
+			bq.updatePending()
+			bq.saveCheckpoint(bq.eng)
 		}
 		return
 	} else if ok {
 		// Range has already been added; update priority.
 		bq.priorityQ.update(item, priority)
+		bq.saveCheckpoint(bq.eng)
 		return
 	}
 	item = &rangeItem{value: rng, priority: priority}
@@ -152,22 +449,49 @@ func (bq *baseQueue) MaybeAdd(rng *Range) {
 
 	// If adding this range has pushed the queue past its maximum size,
 	// remove the lowest priority element.
-	if pqLen := bq.priorityQ.Len(); pqLen > bq.maxSize {
+	if pqLen := bq.priorityQ.Len(); pqLen > bq.maxQueueSize() {
 		bq.remove(pqLen - 1)
+		bq.spilled.Inc(1)
 	}
+	bq.updatePending()
+	bq.saveCheckpoint(bq.eng)
 }
 
 // MaybeRemove removes the specified range from the queue if enqueued.
 func (bq *baseQueue) MaybeRemove(rng *Range) {
 	if item, ok := bq.ranges[rng.Desc.RaftID]; ok {
 		bq.remove(item.index)
+		bq.updatePending()
+		bq.saveCheckpoint(bq.eng)
 	}
 }
 
-// Clear removes all ranges from the queue.
+// Clear removes all ranges from the queue. The queue's checkpoint is
+// left as is, so that a queue cleared as its store stops resumes its
+// work on restart.
 func (bq *baseQueue) Clear() {
 	bq.ranges = map[int64]*rangeItem{}
 	bq.priorityQ = nil
+	bq.updatePending()
+}
+
+// updatePending adjusts the pending gauge, which sums the lengths of
+// the queues of the same name on all stores, by the change in this
+// queue's length since it was last updated.
+func (bq *baseQueue) updatePending() {
+	n := bq.priorityQ.Len()
+	bq.pending.Inc(int64(n - bq.reported))
+	bq.reported = n
+}
+
+// errorTypeName returns the name of the type of err as used in metric
+// names, e.g. "write_intent_error" for a *proto.WriteIntentError.
+func errorTypeName(err error) string {
+	name := fmt.Sprintf("%T", err)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return metrics.NameComponent(name)
 }
 
 func (bq *baseQueue) remove(index int) {
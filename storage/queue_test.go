@@ -18,11 +18,17 @@
 package storage
 
 import (
+	"bytes"
 	"container/heap"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
 // TestQueuePriorityQueue verifies priority queue implementation.
@@ -139,3 +145,261 @@ func TestBaseQueueAddUpdateAndRemove(t *testing.T) {
 		t.Errorf("expected r1")
 	}
 }
+
+// TestBaseQueueDrainWithManualClock verifies that a queue using a
+// manual clock passes the manual time to shouldQ and process, and
+// that DrainQueue synchronously processes ranges in priority order.
+func TestBaseQueueDrainWithManualClock(t *testing.T) {
+	manual := hlc.NewManualClock(0)
+	clock := hlc.NewClock(manual.UnixNano)
+	r1 := &Range{Desc: &proto.RangeDescriptor{RaftID: 1}}
+	r2 := &Range{Desc: &proto.RangeDescriptor{RaftID: 2}}
+	var shouldQTimes, processTimes []int64
+	shouldQ := func(now time.Time, r *Range) (shouldQueue bool, priority float64) {
+		shouldQTimes = append(shouldQTimes, now.UnixNano())
+		return true, float64(r.Desc.RaftID)
+	}
+	process := func(now time.Time, r *Range) error {
+		processTimes = append(processTimes, now.UnixNano())
+		return nil
+	}
+	bq := newBaseQueue("test", shouldQ, process, 2)
+	bq.setClock(clock)
+
+	manual.Set(10)
+	bq.MaybeAdd(r1)
+	manual.Set(20)
+	bq.MaybeAdd(r2)
+	manual.Set(30)
+	ranges := bq.DrainQueue()
+	if len(ranges) != 2 || ranges[0] != r2 || ranges[1] != r1 {
+		t.Errorf("expected [r2, r1]; got %v", ranges)
+	}
+	if bq.Length() != 0 {
+		t.Errorf("expected empty queue; got %d", bq.Length())
+	}
+	if !reflect.DeepEqual(shouldQTimes, []int64{10, 20}) {
+		t.Errorf("unexpected shouldQ times %v", shouldQTimes)
+	}
+	if !reflect.DeepEqual(processTimes, []int64{30, 30}) {
+		t.Errorf("unexpected process times %v", processTimes)
+	}
+}
+
+// TestBaseQueueStates verifies that a paused queue accepts but
+// doesn't process ranges and that a disabled queue drops them.
+func TestBaseQueueStates(t *testing.T) {
+	r1 := &Range{Desc: &proto.RangeDescriptor{RaftID: 1}}
+	r2 := &Range{Desc: &proto.RangeDescriptor{RaftID: 2}}
+	shouldQ := func(now time.Time, r *Range) (shouldQueue bool, priority float64) {
+		return true, float64(r.Desc.RaftID)
+	}
+	var processed int
+	process := func(now time.Time, r *Range) error {
+		processed++
+		return nil
+	}
+	bq := newBaseQueue("test", shouldQ, process, 2)
+
+	bq.SetState(QueuePaused)
+	bq.MaybeAdd(r1)
+	if bq.Length() != 1 {
+		t.Errorf("expected paused queue to accept range; length %d", bq.Length())
+	}
+	if rng := bq.Pop(); rng != nil || processed != 0 {
+		t.Errorf("expected paused queue not to process; got %v", rng)
+	}
+
+	bq.SetState(QueueEnabled)
+	if rng := bq.Pop(); rng != r1 || processed != 1 {
+		t.Errorf("expected r1 processed after resuming; got %v", rng)
+	}
+
+	bq.MaybeAdd(r1)
+	bq.SetState(QueueDisabled)
+	bq.MaybeAdd(r2)
+	if bq.Length() != 0 {
+		t.Errorf("expected disabled queue to be empty; length %d", bq.Length())
+	}
+	if rng := bq.Pop(); rng != nil || processed != 1 {
+		t.Errorf("expected disabled queue not to process; got %v", rng)
+	}
+}
+
+// TestBaseQueueStalled verifies that ranges are left queued rather
+// than processed while the queue's store is stalled.
+func TestBaseQueueStalled(t *testing.T) {
+	r1 := &Range{Desc: &proto.RangeDescriptor{RaftID: 1}}
+	shouldQ := func(now time.Time, r *Range) (shouldQueue bool, priority float64) {
+		return true, 1
+	}
+	var processed int
+	process := func(now time.Time, r *Range) error {
+		processed++
+		return nil
+	}
+	bq := newBaseQueue("test", shouldQ, process, 2)
+	stalled := true
+	bq.stalled = func() bool { return stalled }
+
+	bq.MaybeAdd(r1)
+	if rng := bq.Pop(); rng != nil || processed != 0 || bq.Length() != 1 {
+		t.Errorf("expected stalled queue to keep range queued; got %v, length %d", rng, bq.Length())
+	}
+	stalled = false
+	if rng := bq.Pop(); rng != r1 || processed != 1 {
+		t.Errorf("expected r1 processed once no longer stalled; got %v", rng)
+	}
+}
+
+// TestBaseQueueStoppedRange verifies that a range stopped while queued
+// is dequeued without being processed.
+func TestBaseQueueStoppedRange(t *testing.T) {
+	r1 := &Range{Desc: &proto.RangeDescriptor{RaftID: 1}, closer: make(chan struct{})}
+	r2 := &Range{Desc: &proto.RangeDescriptor{RaftID: 2}, closer: make(chan struct{})}
+	shouldQ := func(now time.Time, r *Range) (shouldQueue bool, priority float64) {
+		return true, float64(r.Desc.RaftID)
+	}
+	var processed []*Range
+	process := func(now time.Time, r *Range) error {
+		processed = append(processed, r)
+		return nil
+	}
+	bq := newBaseQueue("test", shouldQ, process, 2)
+	bq.MaybeAdd(r1)
+	bq.MaybeAdd(r2)
+	r2.stop()
+	if rng := bq.Pop(); rng != r2 || len(processed) != 0 {
+		t.Errorf("expected stopped r2 to be dequeued without processing; got %v, processed %v", rng, processed)
+	}
+	if rng := bq.Pop(); rng != r1 || len(processed) != 1 || processed[0] != r1 {
+		t.Errorf("expected r1 processed; got %v, processed %v", rng, processed)
+	}
+}
+
+// TestBaseQueueCheckpoint verifies that a queue's ranges and the
+// progress of the range being processed are restored from its
+// checkpoint, with the range being processed queued first and ranges
+// which no longer exist dropped.
+func TestBaseQueueCheckpoint(t *testing.T) {
+	eng := engine.NewInMem(proto.Attributes{}, 1<<20)
+	r1 := &Range{Desc: &proto.RangeDescriptor{RaftID: 1}}
+	r2 := &Range{Desc: &proto.RangeDescriptor{RaftID: 2}}
+	r3 := &Range{Desc: &proto.RangeDescriptor{RaftID: 3}}
+	ranges := map[int64]*Range{1: r1, 2: r2}
+	getRange := func(raftID int64) (*Range, error) {
+		if rng, ok := ranges[raftID]; ok {
+			return rng, nil
+		}
+		return nil, util.Errorf("range %d not found", raftID)
+	}
+	shouldQ := func(now time.Time, r *Range) (shouldQueue bool, priority float64) {
+		return true, float64(r.Desc.RaftID)
+	}
+	process := func(now time.Time, r *Range) error { return nil }
+
+	bq := newBaseQueue("test", shouldQ, process, 3)
+	if err := bq.loadCheckpoint(eng, getRange); err != nil {
+		t.Fatal(err)
+	}
+	bq.MaybeAdd(r1)
+	bq.MaybeAdd(r2)
+	bq.MaybeAdd(r3)
+	// Checkpoint progress in processing r1, as if interrupted.
+	bq.setResumeKey(eng, r1, proto.EncodedKey("b"))
+
+	restored := newBaseQueue("test", shouldQ, process, 3)
+	if err := restored.loadCheckpoint(eng, getRange); err != nil {
+		t.Fatal(err)
+	}
+	if key := restored.resumeKey(r1); !bytes.Equal(key, proto.EncodedKey("b")) {
+		t.Errorf("expected resume key \"b\"; got %q", key)
+	}
+	if key := restored.resumeKey(r2); key != nil {
+		t.Errorf("expected no resume key for r2; got %q", key)
+	}
+	if processed := restored.DrainQueue(); len(processed) != 2 || processed[0] != r1 || processed[1] != r2 {
+		t.Errorf("expected [r1, r2]; got %v", processed)
+	}
+
+	// Once drained, the checkpoint is empty.
+	restored = newBaseQueue("test", shouldQ, process, 3)
+	if err := restored.loadCheckpoint(eng, getRange); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Length() != 0 || restored.resumeKey(r1) != nil {
+		t.Errorf("expected empty queue; got length %d", restored.Length())
+	}
+}
+
+// TestBaseQueueMetrics verifies that queues record their pending
+// length, the ranges processed and spilled, failures by error type and
+// processing durations in the metrics registry.
+func TestBaseQueueMetrics(t *testing.T) {
+	r1 := &Range{Desc: &proto.RangeDescriptor{RaftID: 1}}
+	r2 := &Range{Desc: &proto.RangeDescriptor{RaftID: 2}}
+	r3 := &Range{Desc: &proto.RangeDescriptor{RaftID: 3}}
+	shouldQ := func(now time.Time, r *Range) (bool, float64) {
+		return true, float64(r.Desc.RaftID)
+	}
+	process := func(now time.Time, r *Range) error {
+		if r == r3 {
+			return &proto.WriteIntentError{}
+		}
+		return nil
+	}
+	bq := newBaseQueue("metrics_test", shouldQ, process, 2)
+	bq.MaybeAdd(r1)
+	bq.MaybeAdd(r2)
+	bq.MaybeAdd(r3) // Spills one of the lower priority ranges
+	if v := bq.pending.Value(); v != 2 {
+		t.Errorf("expected 2 pending ranges; got %d", v)
+	}
+	bq.DrainQueue()
+
+	reg := metrics.DefaultRegistry
+	for name, expected := range map[string]int64{
+		"queue.metrics_test.pending":                     0,
+		"queue.metrics_test.processed":                   2,
+		"queue.metrics_test.spilled":                     1,
+		"queue.metrics_test.failures":                    1,
+		"queue.metrics_test.failures.write_intent_error": 1,
+	} {
+		m, ok := reg.Get(name)
+		if !ok {
+			t.Errorf("metric %s not registered", name)
+			continue
+		}
+		var v int64
+		switch metric := m.(type) {
+		case *metrics.Counter:
+			v = metric.Count()
+		case *metrics.Gauge:
+			v = metric.Value()
+		}
+		if v != expected {
+			t.Errorf("expected %s to be %d; got %d", name, expected, v)
+		}
+	}
+	if n := bq.latency.Count(); n != 2 {
+		t.Errorf("expected 2 processing durations; got %d", n)
+	}
+}
+
+// TestParseQueueStates verifies parsing of the queue states
+// environment variable format.
+func TestParseQueueStates(t *testing.T) {
+	states, err := parseQueueStates("scan=paused,verify=disabled,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]QueueState{"scan": QueuePaused, "verify": QueueDisabled}
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected %v; got %v", expected, states)
+	}
+	for _, spec := range []string{"scan", "scan=stopped"} {
+		if _, err := parseQueueStates(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
@@ -18,19 +18,154 @@
 package storage
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
 	"log"
 	"sync"
 	"time"
 
 	"github.com/cockroachdb/cockroach/multiraft"
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/settings"
 	gogoproto "github.com/gogo/protobuf/proto"
 )
 
+var (
+	// raftCommandCompression enables compression of large commands.
+	raftCommandCompression = settings.RegisterBoolSetting("raft.command_compression.enabled",
+		"compress large commands before proposing them to raft", true)
+	// raftCommandCompressionThreshold is the size in bytes of encoded
+	// commands above which they are compressed before being proposed,
+	// so that large commands take less space in the Raft log and in
+	// memory while being replicated.
+	raftCommandCompressionThreshold = settings.RegisterByteSizeSetting("raft.command_compression.threshold",
+		"size above which commands are compressed before being proposed to raft", 16<<10)
+)
+
+const (
+	// raftEncodingPrefix begins commands which are not plainly encoded
+	// InternalRaftCommands and is followed by a byte specifying the
+	// encoding. Encoded protos never begin with a zero byte, as field
+	// numbers start at one.
+	//
+	// TODO: sideload the payloads of very large commands,
+	//   such as bulk ingestions, as files referenced from the Raft
+	//   entry once Raft groups replicate to other nodes and catch-up
+	//   can transfer such files.
+	raftEncodingPrefix = 0
+	// raftEncodingDeflate specifies a command compressed with DEFLATE.
+	raftEncodingDeflate = 1
+)
+
+// encodeRaftCommand marshals the command for proposal to Raft. If it
+// exceeds raftCommandCompressionThreshold, compression is enabled and
+// compression reduces its size, the command is compressed.
+func encodeRaftCommand(cmd *proto.InternalRaftCommand) ([]byte, error) {
+	data, err := gogoproto.Marshal(cmd)
+	if err != nil || !raftCommandCompression.Get() ||
+		int64(len(data)) <= raftCommandCompressionThreshold.Get() {
+		return data, err
+	}
+	buf := bytes.NewBuffer([]byte{raftEncodingPrefix, raftEncodingDeflate})
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeRaftCommand unmarshals a command encoded with
+// encodeRaftCommand.
+func decodeRaftCommand(data []byte, cmd *proto.InternalRaftCommand) error {
+	if len(data) > 0 && data[0] == raftEncodingPrefix {
+		if len(data) < 2 {
+			return util.Errorf("truncated Raft command encoding")
+		} else if data[1] != raftEncodingDeflate {
+			return util.Errorf("unknown Raft command encoding %d", data[1])
+		}
+		r := flate.NewReader(bytes.NewReader(data[2:]))
+		defer r.Close()
+		var err error
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	return gogoproto.Unmarshal(data, cmd)
+}
+
+// raftChecksumTable is the CRC32 table used to checksum the results
+// of commands.
+var raftChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Kinds of batch updates, as checksummed by batchChecksum.
+const (
+	checksumPut    = 'p'
+	checksumDelete = 'd'
+	checksumMerge  = 'm'
+)
+
+// batchChecksum returns the checksum of the writes pending in batch to
+// the range-local and user keys of the range described by desc. The
+// writes to the range's metadata indexed by Raft ID, such as its MVCC
+// stats and applied lease index, aren't covered: stats deltas depend
+// on the versions collected by the range's GC, which runs outside of
+// Raft. A checksum of zero is never returned, as zero indicates that
+// no checksum was computed; returns zero if batch isn't an engine
+// batch, possibly wrapped to record the command's stats.
+func batchChecksum(batch engine.Engine, desc *proto.RangeDescriptor) uint32 {
+	if se, ok := batch.(*statsEngine); ok {
+		batch = se.Engine
+	}
+	b, ok := engine.Unwrap(batch).(*engine.Batch)
+	if !ok {
+		return 0
+	}
+	h := crc32.New(raftChecksumTable)
+	var lenBuf [4]byte
+	write := func(kind byte, kv proto.RawKeyValue) {
+		h.Write([]byte{kind})
+		for _, field := range [][]byte{kv.Key, kv.Value} {
+			binary.BigEndian.PutUint32(lenBuf[:], uint32(len(field)))
+			h.Write(lenBuf[:])
+			h.Write(field)
+		}
+	}
+	for _, kr := range rangeKeyRanges(desc) {
+		for _, update := range b.Updates(kr.start, kr.end) {
+			switch t := update.(type) {
+			case engine.BatchPut:
+				write(checksumPut, t.RawKeyValue)
+			case engine.BatchDelete:
+				write(checksumDelete, t.RawKeyValue)
+			case engine.BatchMerge:
+				write(checksumMerge, t.RawKeyValue)
+			}
+		}
+	}
+	if sum := h.Sum32(); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
 type committedCommand struct {
 	cmdIDKey cmdIDKey
 	cmd      proto.InternalRaftCommand
+	dropped  bool // Set if the command was dropped by an interceptor
 }
 
 // raftInterface is the interface exposed by a raft implementation.
@@ -56,15 +191,30 @@ type raftInterface interface {
 	stop()
 }
 
+// A raftInterceptor is invoked with each committed command before it
+// is delivered for application. Returning false drops the command:
+// it is delivered marked as dropped, failing its proposer's waiting
+// request instead of being applied. Tests use interceptors to
+// observe, delay (by blocking) or drop Raft traffic deterministically.
+type raftInterceptor func(committedCommand) bool
+
+// singleNodeRaft runs each range's Raft group with the local store as
+// its only member. Replicas added to a range are initialized from
+// snapshots outside of Raft; see Store.SendSnapshot.
 type singleNodeRaft struct {
-	mr       *multiraft.MultiRaft
-	mu       sync.Mutex
-	groups   map[int64]struct{}
-	commitCh chan committedCommand
-	stopper  *util.Stopper
+	mr        *multiraft.MultiRaft
+	mu        sync.Mutex
+	groups    map[int64]struct{}
+	commitCh  chan committedCommand
+	intercept raftInterceptor
+	metrics   *raftMetrics
+	stopper   *util.Stopper
 }
 
-func newSingleNodeRaft(storage multiraft.Storage) *singleNodeRaft {
+// newSingleNodeRaft creates a single node raft instance. If intercept
+// is not nil, it is invoked with each committed command. Leadership
+// changes are counted in metrics.
+func newSingleNodeRaft(storage multiraft.Storage, intercept raftInterceptor, metrics *raftMetrics) *singleNodeRaft {
 	mr, err := multiraft.NewMultiRaft(1, &multiraft.Config{
 		Transport:              multiraft.NewLocalRPCTransport(),
 		Storage:                storage,
@@ -76,13 +226,15 @@ func newSingleNodeRaft(storage multiraft.Storage) *singleNodeRaft {
 		log.Fatal(err)
 	}
 	snr := &singleNodeRaft{
-		mr:       mr,
-		groups:   map[int64]struct{}{},
-		commitCh: make(chan committedCommand, 10),
-		stopper:  util.NewStopper(1),
+		mr:        mr,
+		groups:    map[int64]struct{}{},
+		commitCh:  make(chan committedCommand, 10),
+		intercept: intercept,
+		metrics:   metrics,
+		stopper:   util.NewStopper(1),
 	}
 	mr.Start()
-	go snr.run()
+	go util.RunLabeled("raft", snr.run)
 	return snr
 }
 
@@ -119,7 +271,7 @@ func (snr *singleNodeRaft) propose(cmdIDKey cmdIDKey, cmd proto.InternalRaftComm
 	if err != nil {
 		log.Fatal(err)
 	}
-	data, err := gogoproto.Marshal(&cmd)
+	data, err := encodeRaftCommand(&cmd)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -139,13 +291,22 @@ func (snr *singleNodeRaft) run() {
 		select {
 		case e := <-snr.mr.Events:
 			switch e := e.(type) {
+			case *multiraft.EventLeaderElection:
+				// NodeID is zero while an election is in progress.
+				if e.NodeID != 0 {
+					snr.metrics.leaderChanges.Inc(1)
+				}
 			case *multiraft.EventCommandCommitted:
 				var cmd proto.InternalRaftCommand
-				err := gogoproto.Unmarshal(e.Command, &cmd)
+				err := decodeRaftCommand(e.Command, &cmd)
 				if err != nil {
 					log.Fatal(err)
 				}
-				snr.commitCh <- committedCommand{cmdIDKey(e.CommandID), cmd}
+				cc := committedCommand{cmdIDKey: cmdIDKey(e.CommandID), cmd: cmd}
+				if snr.intercept != nil && !snr.intercept(cc) {
+					cc.dropped = true
+				}
+				snr.commitCh <- cc
 			}
 		case <-snr.stopper.ShouldStop():
 			snr.mr.Stop()
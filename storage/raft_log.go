@@ -0,0 +1,146 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// maxRaftLogWindow is the maximum number of entries returned by
+// RaftLog.
+const maxRaftLogWindow = 1000
+
+// A RaftLogEntry summarizes an entry of a range's Raft log.
+type RaftLogEntry struct {
+	Index     uint64
+	Term      uint64
+	Type      string
+	Size      int       // Size of the entry's data in bytes
+	CommandID string    // ID of the entry's command, if any
+	Method    string    // Method of the entry's command, if any
+	Key       proto.Key // Key of the entry's command, if any
+	Error     string    // Set if the entry's command can't be decoded
+}
+
+// A RaftReplicaProgress is the replication progress of a replica of a
+// range, as known to the local replica.
+type RaftReplicaProgress struct {
+	proto.Replica
+	Local bool
+	// Match is the index up to which the replica's log is known to
+	// match the local replica's, or zero if unknown. Only the local
+	// replica's progress is known until Raft groups have members on
+	// other stores.
+	Match uint64
+}
+
+// A RaftLogStatus is a window of a range's Raft log, decoded for
+// debugging replication, along with the replicas' progress.
+type RaftLogStatus struct {
+	RaftID     int64
+	Term       uint64 // Current term
+	Vote       uint64 // Node voted for in the current term
+	Commit     uint64 // Highest committed index
+	FirstIndex uint64
+	LastIndex  uint64
+	Leader     bool // Whether the local replica leads the range
+	Replicas   []RaftReplicaProgress
+	Entries    []RaftLogEntry
+}
+
+// RaftLog returns the range's Raft state and the decoded entries of
+// its log from index lo up to, but not including, index hi, clamped
+// to the log's indexes and to maxRaftLogWindow entries from lo.
+func (r *Range) RaftLog(lo, hi uint64) (*RaftLogStatus, error) {
+	hs, _, err := r.InitialState()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	last, err := r.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	status := &RaftLogStatus{
+		RaftID:     r.Desc.RaftID,
+		Term:       hs.Term,
+		Vote:       hs.Vote,
+		Commit:     hs.Commit,
+		FirstIndex: first,
+		LastIndex:  last,
+		Leader:     r.IsLeader(),
+	}
+	r.RLock()
+	for _, replica := range r.Desc.Replicas {
+		progress := RaftReplicaProgress{Replica: replica}
+		if replica.StoreID == r.rm.StoreID() {
+			progress.Local = true
+			progress.Match = last
+		}
+		status.Replicas = append(status.Replicas, progress)
+	}
+	r.RUnlock()
+
+	if lo < first {
+		lo = first
+	}
+	if hi > last+1 {
+		hi = last + 1
+	}
+	if hi > lo+maxRaftLogWindow {
+		hi = lo + maxRaftLogWindow
+	}
+	if lo >= hi {
+		return status, nil
+	}
+	ents, err := r.Entries(lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	for _, ent := range ents {
+		e := RaftLogEntry{
+			Index: ent.Index,
+			Term:  ent.Term,
+			Type:  ent.Type.String(),
+			Size:  len(ent.Data),
+		}
+		// The commands of configuration changes are carried in the
+		// change's context and aren't decoded.
+		if id, data, ok := multiraft.DecodeCommand(ent.Data); ok && ent.Type == raftpb.EntryNormal {
+			e.CommandID = fmt.Sprintf("%x", id)
+			if len(data) > 0 {
+				var cmd proto.InternalRaftCommand
+				if err := decodeRaftCommand(data, &cmd); err != nil {
+					e.Error = err.Error()
+				} else if args, ok := cmd.Cmd.GetValue().(proto.Request); ok {
+					e.Key = args.Header().Key
+					if e.Method, err = proto.MethodForRequest(args); err != nil {
+						e.Error = err.Error()
+					}
+				}
+			}
+		}
+		status.Entries = append(status.Entries, e)
+	}
+	return status, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// TestRangeRaftLog verifies that a range's Raft log is returned with
+// decoded commands, within the requested window, along with the
+// progress of the local replica.
+func TestRangeRaftLog(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	key := proto.Key("a")
+	pArgs, pReply := putArgs(key, []byte("value"), 1, store.StoreID())
+	if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := rng.RaftLog(0, 1<<62)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.LastIndex < status.FirstIndex || len(status.Entries) != int(status.LastIndex-status.FirstIndex+1) {
+		t.Fatalf("expected entries %d-%d; got %+v", status.FirstIndex, status.LastIndex, status.Entries)
+	}
+	var found bool
+	for _, e := range status.Entries {
+		if e.Error != "" {
+			t.Errorf("entry %d: %s", e.Index, e.Error)
+		}
+		if e.Method == proto.Put && e.Key.Equal(key) && e.CommandID != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a put of %q in the log; got %+v", key, status.Entries)
+	}
+	if len(status.Replicas) != 1 || !status.Replicas[0].Local || status.Replicas[0].Match != status.LastIndex {
+		t.Errorf("expected the local replica to match the log's last index; got %+v", status.Replicas)
+	}
+
+	if status, err = rng.RaftLog(status.LastIndex, status.LastIndex+10); err != nil {
+		t.Fatal(err)
+	} else if len(status.Entries) != 1 || status.Entries[0].Index != status.LastIndex {
+		t.Errorf("expected only the last entry; got %+v", status.Entries)
+	}
+}
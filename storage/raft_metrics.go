@@ -0,0 +1,68 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+// raftMetrics measure the replication health of a store's ranges.
+// They are registered under "store.<store-id>.raft." once the store
+// is started. Snapshots are not counted, as ranges are not yet
+// replicated via snapshots.
+type raftMetrics struct {
+	proposals     *metrics.Counter   // Commands proposed, including reproposals
+	reproposals   *metrics.Counter   // Commands proposed again after being overtaken
+	commitLatency *metrics.Histogram // Nanoseconds from proposal to commit of local commands
+	leaderChanges *metrics.Counter   // Leaders elected in the store's groups
+	entrySize     *metrics.Histogram // Sizes in bytes of entries appended to Raft logs
+}
+
+func newRaftMetrics() *raftMetrics {
+	return &raftMetrics{
+		proposals:     metrics.NewCounter(),
+		reproposals:   metrics.NewCounter(),
+		commitLatency: metrics.NewHistogram(metrics.DefaultWindow),
+		leaderChanges: metrics.NewCounter(),
+		entrySize:     metrics.NewHistogram(metrics.DefaultWindow),
+	}
+}
+
+// raftMetricsPrefix returns the prefix of the names under which the
+// Raft metrics of the store with the given ID are registered.
+func raftMetricsPrefix(storeID int32) string {
+	return fmt.Sprintf("store.%d.raft.", storeID)
+}
+
+// registerRaftMetrics registers the store's Raft metrics, and the
+// dropped message counts of the store's MultiRaft, with the default
+// registry, replacing those of any earlier instance of the store.
+func (s *Store) registerRaftMetrics(mr *multiraft.MultiRaft) {
+	prefix := raftMetricsPrefix(s.StoreID())
+	reg := metrics.DefaultRegistry
+	reg.Register(prefix+"proposals", s.raftMetrics.proposals)
+	reg.Register(prefix+"reproposals", s.raftMetrics.reproposals)
+	reg.Register(prefix+"commit_latency", s.raftMetrics.commitLatency)
+	reg.Register(prefix+"leader_changes", s.raftMetrics.leaderChanges)
+	reg.Register(prefix+"entry_size", s.raftMetrics.entrySize)
+	mr.RegisterMetrics(reg, prefix)
+}
+
+// RaftMetrics accessor.
+func (s *Store) RaftMetrics() *raftMetrics { return s.raftMetrics }
@@ -0,0 +1,66 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// TestRaftCommandEncoding verifies that commands above the
+// compression threshold are compressed, that smaller or
+// incompressible commands are not, and that all decode to the
+// original command.
+func TestRaftCommandEncoding(t *testing.T) {
+	random := make([]byte, 2*raftCommandCompressionThreshold.Get())
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		value       []byte
+		expCompress bool
+	}{
+		{[]byte("value"), false},
+		{bytes.Repeat([]byte("value"), int(raftCommandCompressionThreshold.Get())), true},
+		{random, false},
+	}
+	for i, test := range testCases {
+		args, _ := putArgs([]byte("a"), test.value, 1, 1)
+		cmd := proto.InternalRaftCommand{RaftID: 1}
+		cmd.Cmd.SetValue(args)
+		data, err := encodeRaftCommand(&cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := data[0] == raftEncodingPrefix; compressed != test.expCompress {
+			t.Errorf("%d: expected compressed? %t; got %t", i, test.expCompress, compressed)
+		}
+		var decoded proto.InternalRaftCommand
+		if err := decodeRaftCommand(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cmd, decoded) {
+			t.Errorf("%d: expected %+v; got %+v", i, cmd, decoded)
+		}
+	}
+	if err := decodeRaftCommand([]byte{raftEncodingPrefix, 99}, &proto.InternalRaftCommand{}); err == nil {
+		t.Error("expected error decoding unknown encoding")
+	}
+}
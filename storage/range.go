@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -51,6 +52,7 @@ func init() {
 	gob.Register(&proto.ZoneConfig{})
 	gob.Register(proto.RangeDescriptor{})
 	gob.Register(proto.Transaction{})
+	gob.Register(map[string]string{})
 }
 
 var (
@@ -79,6 +81,11 @@ const (
 	raftInitialLogTerm  = 5
 )
 
+// maxKeyGCThresholds bounds the number of keys whose GC threshold a
+// range tracks individually. Beyond it, the range-wide GC threshold is
+// advanced past the lowest key thresholds instead.
+const maxKeyGCThresholds = 1000
+
 // configDescriptor describes administrative configuration maps
 // affecting ranges of the key-value map by key prefix.
 type configDescriptor struct {
@@ -102,6 +109,7 @@ var tsCacheMethods = map[string]struct{}{
 	proto.Get:                   struct{}{},
 	proto.Put:                   struct{}{},
 	proto.ConditionalPut:        struct{}{},
+	proto.CompareAndSet:         struct{}{},
 	proto.Increment:             struct{}{},
 	proto.Scan:                  struct{}{},
 	proto.Delete:                struct{}{},
@@ -111,6 +119,7 @@ var tsCacheMethods = map[string]struct{}{
 	proto.EnqueueMessage:        struct{}{},
 	proto.InternalResolveIntent: struct{}{},
 	proto.InternalMerge:         struct{}{},
+	proto.InternalScanChanges:   struct{}{},
 }
 
 // UsesTimestampCache returns true if the method affects or is
@@ -124,8 +133,9 @@ func UsesTimestampCache(method string) bool {
 // sent to Raft. Once committed to the Raft log, the command is
 // executed and the result returned via the done channel.
 type pendingCmd struct {
-	Reply proto.Response
-	done  chan error // Used to signal waiting RPC handler
+	Reply    proto.Response
+	done     chan error // Used to signal waiting RPC handler
+	proposed time.Time  // Time at which the command was proposed to Raft
 }
 
 // A RangeManager is an interface satisfied by Store through which ranges
@@ -146,7 +156,10 @@ type RangeManager interface {
 	AddRange(rng *Range) error
 	RemoveRange(rng *Range) error
 	NewSnapshot() engine.Engine
+	AdjustSplitKey(key proto.Key) (proto.Key, error)
+	MayLead(rng *Range) bool
 	ProposeRaftCommand(cmdIDKey, proto.InternalRaftCommand)
+	RaftMetrics() *raftMetrics
 }
 
 // A Range is a contiguous keyspace with writes managed via an
@@ -163,12 +176,31 @@ type Range struct {
 	// Updated atomically.
 	lastIndex uint64
 	closer    chan struct{} // Channel for closing the range
+	load      *rangeLoad    // Decaying request and byte rates
+	locks     *lockTable    // Known write intents and the requests waiting on them
 
 	sync.RWMutex                 // Protects the following fields (and Desc)
 	cmdQ         *CommandQueue   // Enforce at most one command is running per key(s)
 	tsCache      *TimestampCache // Most recent timestamps for keys / key ranges
+	leading      bool            // Whether the replica led when last checked; see maybeLead
 	respCache    *ResponseCache  // Provides idempotence for retries
 	pendingCmds  map[cmdIDKey]*pendingCmd
+	gcThreshold  proto.Timestamp // Reads at or below are rejected
+	// GC thresholds of individual keys above gcThreshold, by key.
+	// Reads of a key at or below its threshold are rejected.
+	keyGCThresholds map[string]proto.Timestamp
+	// Wall time of the earliest key expiration. Zero until the range
+	// has been scanned, as keys may already have expired.
+	nextExpiration int64
+	// unfrozen is non-nil while the range is frozen and is closed when
+	// it's unfrozen. Read-write commands wait on it.
+	unfrozen chan struct{}
+	// Lease index of the last command applied and the last assigned to
+	// a proposal. See InternalRaftCommand.MaxLeaseIndex.
+	leaseAppliedIndex  uint64
+	proposedLeaseIndex uint64
+
+	proposeMu sync.Mutex // Serializes assignment of lease indexes and proposal
 }
 
 var _ multiraft.WriteableGroupStorage = &Range{}
@@ -180,8 +212,10 @@ func NewRange(desc *proto.RangeDescriptor, rm RangeManager) (*Range, error) {
 		rm:          rm,
 		lastIndex:   raftInitialLogIndex,
 		closer:      make(chan struct{}),
+		load:        newRangeLoad(),
 		cmdQ:        NewCommandQueue(),
 		tsCache:     NewTimestampCache(rm.Clock()),
+		locks:       newLockTable(),
 		respCache:   NewResponseCache(desc.RaftID, rm.Engine()),
 		pendingCmds: map[cmdIDKey]*pendingCmd{},
 	}
@@ -190,6 +224,37 @@ func NewRange(desc *proto.RangeDescriptor, rm RangeManager) (*Range, error) {
 	if err != nil {
 		return nil, err
 	}
+	scanMeta, err := r.GetScanMetadata()
+	if err != nil {
+		return nil, err
+	}
+	r.advanceGCThresholds(scanMeta.GC.Threshold, scanMeta.GC.KeyThresholds)
+	// The timestamp cache's low water mark covers the time before the
+	// replica's creation, so a replica leading from the start has taken
+	// up leadership already.
+	r.leading = r.IsLeader()
+
+	var frozenAt proto.Timestamp
+	frozen, err := engine.MVCCGetProto(rm.Engine(), engine.RangeFrozenKey(desc.RaftID), proto.ZeroTimestamp, nil, &frozenAt)
+	if err != nil {
+		return nil, err
+	}
+	if frozen {
+		r.unfrozen = make(chan struct{})
+	}
+
+	leaseIndex, err := engine.MVCCGet(rm.Engine(), engine.RangeLeaseAppliedIndexKey(desc.RaftID), proto.ZeroTimestamp, nil)
+	if err != nil {
+		return nil, err
+	}
+	if leaseIndex != nil {
+		index, err := leaseIndex.GetInt()
+		if err != nil {
+			return nil, util.Errorf("invalid lease applied index of range %d: %s", desc.RaftID, err)
+		}
+		r.leaseAppliedIndex = uint64(index)
+		r.proposedLeaseIndex = r.leaseAppliedIndex
+	}
 
 	return r, nil
 }
@@ -201,6 +266,7 @@ func (r *Range) start() {
 	r.maybeGossipClusterID()
 	r.maybeGossipFirstRange()
 	r.maybeGossipConfigs(configDescriptors...)
+	r.maybeGossipSettings()
 	// Only start gossiping if this range is the first range.
 	if r.IsFirstRange() {
 		go r.startGossip()
@@ -212,6 +278,17 @@ func (r *Range) stop() {
 	close(r.closer)
 }
 
+// isStopped returns true if the range has been stopped, e.g. because
+// it was removed from its store.
+func (r *Range) isStopped() bool {
+	select {
+	case <-r.closer:
+		return true
+	default:
+		return false
+	}
+}
+
 // Destroy cleans up all data associated with this range.
 func (r *Range) Destroy() error {
 	var deletes []interface{}
@@ -229,9 +306,43 @@ func (r *Range) IsFirstRange() bool {
 }
 
 // IsLeader returns true if this range replica is the raft leader.
-// TODO(spencer): this is always true for now.
+// While its store warms up after a restart, a replica defers to the
+// range's other replicas; see storeWarmup.
+// TODO(spencer): this is otherwise always true for now.
 func (r *Range) IsLeader() bool {
-	return true
+	return r.rm.MayLead(r)
+}
+
+// maybeLead returns whether this range replica is the leader. When the
+// replica takes up leadership, its timestamp cache is cleared, which
+// advances the low water mark to the start of its leadership plus the
+// maximum clock offset: the replica's cache holds none of the reads
+// served by the previous leader, all of which lie below that mark, so
+// writes beneath them must be pushed. Timestamps of the replica's own
+// earlier leadership lie below the mark as well.
+func (r *Range) maybeLead() bool {
+	leader := r.IsLeader()
+	r.Lock()
+	defer r.Unlock()
+	if leader && !r.leading {
+		r.tsCache.Clear(r.rm.Clock())
+		r.locks.clear()
+	}
+	r.leading = leader
+	return leader
+}
+
+// IsNonVoter returns true if this range replica is a non-voting
+// replica, which never leads and serves only inconsistent reads.
+func (r *Range) IsNonVoter() bool {
+	r.RLock()
+	defer r.RUnlock()
+	for _, replica := range r.Desc.Replicas {
+		if replica.StoreID == r.rm.StoreID() {
+			return replica.NonVoter
+		}
+	}
+	return false
 }
 
 // GetReplica returns the replica for this range from the range descriptor.
@@ -267,10 +378,150 @@ func (r *Range) GetScanMetadata() (*proto.ScanMetadata, error) {
 	return scanMeta, nil
 }
 
-// PutScanMetadata writes the scan metadata for this range.
+// PutScanMetadata writes the scan metadata for this range and
+// updates the range's GC threshold.
 func (r *Range) PutScanMetadata(scanMeta *proto.ScanMetadata) error {
 	key := engine.RangeScanMetadataKey(r.Desc.StartKey)
-	return engine.MVCCPutProto(r.rm.Engine(), nil, key, proto.ZeroTimestamp, nil, scanMeta)
+	if err := engine.MVCCPutProto(r.rm.Engine(), nil, key, proto.ZeroTimestamp, nil, scanMeta); err != nil {
+		return err
+	}
+	r.advanceGCThresholds(scanMeta.GC.Threshold, scanMeta.GC.KeyThresholds)
+	return nil
+}
+
+// GCThreshold returns the timestamp at or below which versions in
+// this range may have been garbage collected.
+func (r *Range) GCThreshold() proto.Timestamp {
+	r.RLock()
+	defer r.RUnlock()
+	return r.gcThreshold
+}
+
+// gcThresholds returns the range's GC threshold and the GC thresholds
+// of individual keys above it, sorted by key.
+func (r *Range) gcThresholds() (proto.Timestamp, []proto.KeyGCThreshold) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.gcThreshold, r.keyGCThresholdsLocked()
+}
+
+// advanceGCThresholds advances the range's GC threshold to threshold
+// and the GC thresholds of individual keys to keyThresholds. Key
+// thresholds at or below the range's threshold are dropped. Should
+// more than maxKeyGCThresholds remain, the range's threshold is
+// advanced past the lowest of them. No threshold ever moves
+// backwards. Returns the resulting thresholds, the key thresholds
+// sorted by key, to be persisted with the range's scan metadata.
+func (r *Range) advanceGCThresholds(threshold proto.Timestamp, keyThresholds []proto.KeyGCThreshold) (
+	proto.Timestamp, []proto.KeyGCThreshold) {
+	r.Lock()
+	defer r.Unlock()
+	r.gcThreshold.Forward(threshold)
+	for _, kt := range keyThresholds {
+		if r.keyGCThresholds == nil {
+			r.keyGCThresholds = map[string]proto.Timestamp{}
+		}
+		t := r.keyGCThresholds[string(kt.Key)]
+		t.Forward(kt.Threshold)
+		r.keyGCThresholds[string(kt.Key)] = t
+	}
+	if excess := len(r.keyGCThresholds) - maxKeyGCThresholds; excess > 0 {
+		lowest := make(keyGCThresholdsByThreshold, 0, len(r.keyGCThresholds))
+		for key, t := range r.keyGCThresholds {
+			lowest = append(lowest, proto.KeyGCThreshold{Key: proto.Key(key), Threshold: t})
+		}
+		sort.Sort(lowest)
+		for _, kt := range lowest[:excess] {
+			r.gcThreshold.Forward(kt.Threshold)
+		}
+	}
+	for key, t := range r.keyGCThresholds {
+		if !r.gcThreshold.Less(t) {
+			delete(r.keyGCThresholds, key)
+		}
+	}
+	return r.gcThreshold, r.keyGCThresholdsLocked()
+}
+
+// keyGCThresholdsLocked returns the GC thresholds of individual keys
+// sorted by key. The range must be locked.
+func (r *Range) keyGCThresholdsLocked() []proto.KeyGCThreshold {
+	var result []proto.KeyGCThreshold
+	for key, t := range r.keyGCThresholds {
+		result = append(result, proto.KeyGCThreshold{Key: proto.Key(key), Threshold: t})
+	}
+	sort.Sort(keyGCThresholdsByKey(result))
+	return result
+}
+
+// gcThresholdFor returns the timestamp at or below which versions of
+// the keys in [key, endKey), or of key alone if endKey is empty, may
+// have been garbage collected.
+func (r *Range) gcThresholdFor(key, endKey proto.Key) proto.Timestamp {
+	r.RLock()
+	defer r.RUnlock()
+	threshold := r.gcThreshold
+	if len(endKey) == 0 {
+		threshold.Forward(r.keyGCThresholds[string(key)])
+		return threshold
+	}
+	for k, t := range r.keyGCThresholds {
+		if !proto.Key(k).Less(key) && proto.Key(k).Less(endKey) {
+			threshold.Forward(t)
+		}
+	}
+	return threshold
+}
+
+type keyGCThresholdsByKey []proto.KeyGCThreshold
+
+func (k keyGCThresholdsByKey) Len() int           { return len(k) }
+func (k keyGCThresholdsByKey) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k keyGCThresholdsByKey) Less(i, j int) bool { return k[i].Key.Less(k[j].Key) }
+
+type keyGCThresholdsByThreshold []proto.KeyGCThreshold
+
+func (k keyGCThresholdsByThreshold) Len() int           { return len(k) }
+func (k keyGCThresholdsByThreshold) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k keyGCThresholdsByThreshold) Less(i, j int) bool { return k[i].Threshold.Less(k[j].Threshold) }
+
+// NextExpiration returns the wall time in nanoseconds at which the
+// earliest expiring key of the range expires. It is zero if the
+// range has not been scanned since it was loaded, as keys may then
+// already have expired.
+func (r *Range) NextExpiration() int64 {
+	r.RLock()
+	defer r.RUnlock()
+	return r.nextExpiration
+}
+
+// setNextExpiration sets the wall time at which the earliest expiring
+// key of the range expires, as found by a scan.
+func (r *Range) setNextExpiration(wallTime int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.nextExpiration = wallTime
+}
+
+// noteExpiration records that a key of the range expires at wallTime.
+func (r *Range) noteExpiration(wallTime int64) {
+	r.Lock()
+	defer r.Unlock()
+	if wallTime < r.nextExpiration {
+		r.nextExpiration = wallTime
+	}
+}
+
+// checkGCThreshold returns an error if ts is at or below the GC
+// threshold of the keys in [key, endKey), in which case a read might
+// silently miss versions which have already been garbage collected.
+// See gcThresholdFor.
+func (r *Range) checkGCThreshold(key, endKey proto.Key, ts proto.Timestamp) error {
+	threshold := r.gcThresholdFor(key, endKey)
+	if !threshold.Equal(proto.ZeroTimestamp) && !threshold.Less(ts) {
+		return proto.NewBatchTimestampBeforeGCError(ts, threshold)
+	}
+	return nil
 }
 
 // AddCmd adds a command for execution on this range. The command's
@@ -278,9 +529,19 @@ func (r *Range) PutScanMetadata(scanMeta *proto.ScanMetadata) error {
 // range's leadership is confirmed. The command is then dispatched
 // either along the read-only execution path or the read-write Raft
 // command queue. If wait is false, read-write commands are added to
-// Raft without waiting for their completion.
+// Raft without waiting for their completion. Inconsistent reads skip
+// the leadership check and are executed immediately; they are the
+// only commands served by non-voting replicas.
 func (r *Range) AddCmd(method string, args proto.Request, reply proto.Response, wait bool) error {
-	if !r.IsLeader() {
+	if err := verifyReadConsistency(method, args.Header()); err != nil {
+		reply.Header().SetGoError(err)
+		return err
+	}
+	// Inconsistent reads may be served by any replica.
+	if args.Header().ReadConsistency == proto.INCONSISTENT {
+		return r.addInconsistentReadCmd(method, args, reply)
+	}
+	if !r.maybeLead() || r.IsNonVoter() {
 		// TODO(spencer): when we happen to know the leader, fill it in here via replica.
 		err := &proto.NotLeaderError{}
 		reply.Header().SetGoError(err)
@@ -302,8 +563,23 @@ func (r *Range) AddCmd(method string, args proto.Request, reply proto.Response,
 // there are any overlapping commands already in the queue. Returns
 // the command queue insertion key, to be supplied to subsequent
 // invocation of cmdQ.Remove().
-func (r *Range) beginCmd(start, end proto.Key, readOnly bool) interface{} {
+//
+// Read-write commands additionally block while the range is frozen,
+// unless ignoreFreeze is set, as it is for the commands which freeze
+// and unfreeze the range. If the range is stopped while waiting, the
+// command is added to the queue regardless; callers reject it via
+// checkStopped.
+func (r *Range) beginCmd(start, end proto.Key, readOnly, ignoreFreeze bool) interface{} {
 	r.Lock()
+	for !readOnly && !ignoreFreeze && r.unfrozen != nil && !r.isStopped() {
+		unfrozen := r.unfrozen
+		r.Unlock()
+		select {
+		case <-unfrozen:
+		case <-r.closer:
+		}
+		r.Lock()
+	}
 	var wg sync.WaitGroup
 	r.cmdQ.GetWait(start, end, readOnly, &wg)
 	cmdKey := r.cmdQ.Add(start, end, readOnly)
@@ -312,6 +588,20 @@ func (r *Range) beginCmd(start, end proto.Key, readOnly bool) interface{} {
 	return cmdKey
 }
 
+// checkStopped returns a RangeNotFoundError and removes the command
+// from the command queue if the range was stopped while the command
+// waited in the queue, e.g. because the range was relocated to
+// another store.
+func (r *Range) checkStopped(cmdKey interface{}) error {
+	if !r.isStopped() {
+		return nil
+	}
+	r.Lock()
+	r.cmdQ.Remove(cmdKey)
+	r.Unlock()
+	return proto.NewRangeNotFoundError(r.Desc.RaftID)
+}
+
 // addAdminCmd executes the command directly. There is no interaction
 // with the command queue or the timestamp cache, as admin commands
 // are not meant to consistently access or modify the underlying data.
@@ -319,6 +609,10 @@ func (r *Range) addAdminCmd(method string, args proto.Request, reply proto.Respo
 	switch method {
 	case proto.AdminSplit:
 		r.AdminSplit(args.(*proto.AdminSplitRequest), reply.(*proto.AdminSplitResponse))
+	case proto.AdminFreeze:
+		r.AdminFreeze(args.(*proto.AdminFreezeRequest), reply.(*proto.AdminFreezeResponse))
+	case proto.AdminUnfreeze:
+		r.AdminUnfreeze(args.(*proto.AdminUnfreezeRequest), reply.(*proto.AdminUnfreezeResponse))
 	default:
 		return util.Errorf("unrecognized admin command type: %s", method)
 	}
@@ -331,9 +625,20 @@ func (r *Range) addAdminCmd(method string, args proto.Request, reply proto.Respo
 func (r *Range) addReadOnlyCmd(method string, args proto.Request, reply proto.Response) error {
 	header := args.Header()
 
+	// Reject historical reads below the GC threshold, which could
+	// otherwise return incomplete data.
+	if err := r.checkGCThreshold(header.Key, header.EndKey, header.Timestamp); err != nil {
+		reply.Header().SetGoError(err)
+		return err
+	}
+
 	// Add the read to the command queue to gate subsequent
 	// overlapping, commands until this command completes.
-	cmdKey := r.beginCmd(header.Key, header.EndKey, true)
+	cmdKey := r.beginCmd(header.Key, header.EndKey, true, false)
+	if err := r.checkStopped(cmdKey); err != nil {
+		reply.Header().SetGoError(err)
+		return err
+	}
 
 	// It's possible that arbitrary delays (e.g. major GC, VM
 	// de-prioritization, etc.) could cause the execution of this read
@@ -354,9 +659,15 @@ func (r *Range) addReadOnlyCmd(method string, args proto.Request, reply proto.Re
 		// TODO(spencer): when we happen to know the leader, fill it in here via replica.
 		return &proto.NotLeaderError{}
 	}
-	err := r.executeCmd(method, args, reply)
+	var err error
+	if header.ReadConsistency == proto.BOUNDED_STALENESS {
+		err = r.executeBoundedStalenessRead(method, args, reply)
+	} else {
+		err = r.executeCmd(method, args, reply, nil)
+	}
 
-	// Only update the timestamp cache if the command succeeded.
+	// Only update the timestamp cache if the command succeeded. For
+	// bounded staleness reads, this records the timestamp chosen.
 	r.Lock()
 	if err == nil && UsesTimestampCache(method) {
 		r.tsCache.Add(header.Key, header.EndKey, header.Timestamp, header.Txn.MD5(), true /* readOnly */)
@@ -367,6 +678,72 @@ func (r *Range) addReadOnlyCmd(method string, args proto.Request, reply proto.Re
 	return err
 }
 
+// addInconsistentReadCmd executes an inconsistent read immediately,
+// regardless of whether this replica is the leader and without
+// waiting on overlapping commands or updating the timestamp cache.
+func (r *Range) addInconsistentReadCmd(method string, args proto.Request, reply proto.Response) error {
+	header := args.Header()
+	if err := r.checkGCThreshold(header.Key, header.EndKey, header.Timestamp); err != nil {
+		reply.Header().SetGoError(err)
+		return err
+	}
+	return r.executeCmd(method, args, reply, nil)
+}
+
+// verifyReadConsistency returns an error if the read consistency
+// requested in header is not supported by the method.
+func verifyReadConsistency(method string, header *proto.RequestHeader) error {
+	if header.ReadConsistency == proto.CONSISTENT {
+		return nil
+	}
+	if method != proto.Contains && method != proto.Get && method != proto.Scan {
+		return util.Errorf("method %s does not support %s reads", method, header.ReadConsistency)
+	}
+	if header.Txn != nil {
+		return util.Errorf("%s reads are not supported within transactions", header.ReadConsistency)
+	}
+	if header.ReadConsistency == proto.BOUNDED_STALENESS && header.MaxStaleness < 0 {
+		return util.Errorf("negative max staleness %d", header.MaxStaleness)
+	}
+	return nil
+}
+
+// executeBoundedStalenessRead executes a bounded staleness read at
+// the newest timestamp, no older than the request's maximum
+// staleness, at which it encounters no write intents. Each
+// conflicting intent lowers the read timestamp to just below the
+// intent's timestamp and the read is retried. If no such timestamp
+// exists within the bound, the request timestamp is restored and the
+// WriteIntentError returned, so that the store resolves the conflict
+// as for a consistent read.
+//
+// TODO: without closed timestamps, only the leader knows
+//   that it has applied all writes below the chosen timestamp, so
+//   bounded staleness reads cannot yet be served by followers.
+func (r *Range) executeBoundedStalenessRead(method string, args proto.Request, reply proto.Response) error {
+	header := args.Header()
+	origTimestamp := header.Timestamp
+	minTimestamp := origTimestamp.Add(-header.MaxStaleness, 0)
+	// Never read at or below the GC threshold.
+	if threshold := r.gcThresholdFor(header.Key, header.EndKey); !threshold.Equal(proto.ZeroTimestamp) && !threshold.Less(minTimestamp) {
+		minTimestamp = threshold.Add(0, 1)
+	}
+	for {
+		err := r.executeCmd(method, args, reply, nil)
+		wiErr, ok := err.(*proto.WriteIntentError)
+		if !ok {
+			return err
+		}
+		if !minTimestamp.Less(header.Timestamp) {
+			header.Timestamp = origTimestamp
+			return err
+		}
+		header.Timestamp = wiErr.Txn.Timestamp.Prev()
+		header.Timestamp.Forward(minTimestamp)
+		reply.Reset()
+	}
+}
+
 // addReadWriteCmd first consults the response cache to determine whether
 // this command has already been sent to the range. If a response is
 // found, it's returned immediately and not submitted to raft. Next,
@@ -398,7 +775,11 @@ func (r *Range) addReadWriteCmd(method string, args proto.Request, reply proto.R
 	// done before getting the max timestamp for the key(s), as
 	// timestamp cache is only updated after preceding commands have
 	// been run to successful completion.
-	cmdKey := r.beginCmd(header.Key, header.EndKey, false)
+	cmdKey := r.beginCmd(header.Key, header.EndKey, false, method == proto.InternalSetFrozen)
+	if err := r.checkStopped(cmdKey); err != nil {
+		reply.Header().SetGoError(err)
+		return err
+	}
 
 	// Two important invariants of Cockroach: 1) encountering a more
 	// recently written value means transaction restart. 2) values must
@@ -456,14 +837,22 @@ func (r *Range) addReadWriteCmd(method string, args proto.Request, reply proto.R
 	if !ok {
 		log.Fatalf("unknown command type %T", args)
 	}
+	// A command already failed, such as by the timestamp cache, is
+	// discarded at apply time regardless of its result.
+	if checksummedMethods[method] && reply.Header().Error == nil {
+		raftCmd.Checksum = r.resultChecksum(method, args)
+	}
 	idKey := makeCmdIDKey(cmdID)
 	r.Lock()
+	pendingCmd.proposed = time.Now()
 	r.pendingCmds[idKey] = pendingCmd
 	r.Unlock()
 	// TODO(bdarnell): In certain raft failover scenarios, proposed
 	// commands may be abandoned. We need to re-propose the command
 	// if too much time passes with no response on the done channel.
-	r.rm.ProposeRaftCommand(idKey, raftCmd)
+	// The command's lease index ensures such a reproposal cannot apply
+	// in addition to the original.
+	r.proposeRaftCommand(idKey, raftCmd)
 
 	// Create a completion func for mandatory cleanups which we either
 	// run synchronously if we're waiting or in a goroutine otherwise.
@@ -496,10 +885,60 @@ func (r *Range) addReadWriteCmd(method string, args proto.Request, reply proto.R
 	return nil
 }
 
+// proposeRaftCommand assigns the command the next lease index of the
+// range and proposes it to raft. Proposals are serialized so that
+// commands are proposed in the order of their lease indexes.
+func (r *Range) proposeRaftCommand(idKey cmdIDKey, raftCmd proto.InternalRaftCommand) {
+	r.proposeMu.Lock()
+	defer r.proposeMu.Unlock()
+	r.Lock()
+	r.proposedLeaseIndex++
+	raftCmd.MaxLeaseIndex = r.proposedLeaseIndex
+	r.Unlock()
+	r.rm.ProposeRaftCommand(idKey, raftCmd)
+}
+
+// dropRaftCommand fails the pending command with the specified ID, if
+// any, for a committed command which was dropped instead of applied.
+func (r *Range) dropRaftCommand(idKey cmdIDKey) {
+	r.Lock()
+	cmd := r.pendingCmds[idKey]
+	delete(r.pendingCmds, idKey)
+	r.Unlock()
+	if cmd != nil {
+		cmd.done <- util.Errorf("raft command %x to range %d dropped", idKey, r.Desc.RaftID)
+	}
+}
+
 func (r *Range) processRaftCommand(idKey cmdIDKey, raftCmd proto.InternalRaftCommand) {
 	r.Lock()
 	cmd := r.pendingCmds[idKey]
+	if raftCmd.MaxLeaseIndex != 0 && raftCmd.MaxLeaseIndex <= r.leaseAppliedIndex {
+		// A command with a later lease index has already been applied,
+		// so this one is either a replay of a command which has been
+		// applied or was overtaken by later proposals, as may happen
+		// across a change of leadership. Every replica skips it. If it
+		// is still pending here, it has never applied and is proposed
+		// again with a new lease index.
+		applied := r.leaseAppliedIndex
+		r.Unlock()
+		if cmd != nil {
+			log.V(1).Infof("reproposing command %+v to range %d with lease index %d <= applied %d",
+				raftCmd.Cmd.GetValue(), r.Desc.RaftID, raftCmd.MaxLeaseIndex, applied)
+			// Propose asynchronously; proposals may block on the
+			// application of committed commands.
+			r.rm.RaftMetrics().reproposals.Inc(1)
+			go r.proposeRaftCommand(idKey, raftCmd)
+		} else {
+			log.V(1).Infof("skipping replayed command %+v to range %d with lease index %d",
+				raftCmd.Cmd.GetValue(), r.Desc.RaftID, raftCmd.MaxLeaseIndex)
+		}
+		return
+	}
 	delete(r.pendingCmds, idKey)
+	if raftCmd.MaxLeaseIndex != 0 {
+		r.leaseAppliedIndex = raftCmd.MaxLeaseIndex
+	}
 	r.Unlock()
 
 	args := raftCmd.Cmd.GetValue().(proto.Request)
@@ -519,7 +958,15 @@ func (r *Range) processRaftCommand(idKey cmdIDKey, raftCmd proto.InternalRaftCom
 			log.Fatal(err)
 		}
 	}
-	err = r.executeCmd(method, args, reply)
+	var raftNanos int64
+	if cmd != nil {
+		raftNanos = time.Since(cmd.proposed).Nanoseconds()
+		r.rm.RaftMetrics().commitLatency.Record(float64(raftNanos))
+	}
+	err = r.executeCmd(method, args, reply, &raftCmd)
+	if stats := reply.Header().Stats; stats != nil {
+		stats.RaftNanos = raftNanos
+	}
 	if cmd != nil {
 		cmd.done <- err
 	} else if err != nil {
@@ -527,6 +974,61 @@ func (r *Range) processRaftCommand(idKey cmdIDKey, raftCmd proto.InternalRaftCom
 	}
 }
 
+// verifyRaftCommand asserts, before a committed command is applied,
+// that it was proposed to this range. A command failing the check is
+// not applied; the returned ReplicaCorruptionError identifies the
+// command and the replica so that the divergence is attributable.
+func (r *Range) verifyRaftCommand(method string, raftCmd *proto.InternalRaftCommand) error {
+	if raftCmd == nil {
+		return nil
+	}
+	cmdID := raftCmd.Cmd.GetValue().(proto.Request).Header().CmdID
+	if raftCmd.RaftID != r.Desc.RaftID {
+		return proto.NewReplicaCorruptionError("%s command %+v proposed to range %d applied to range %d on store %d",
+			method, cmdID, raftCmd.RaftID, r.Desc.RaftID, r.rm.StoreID())
+	}
+	return nil
+}
+
+// checksummedMethods are the methods whose results are checksummed
+// when they're proposed and verified when they're applied. Their
+// writes depend only on the command and on the range's keys which the
+// command queue protects from concurrent commands. Other methods read
+// the replica's clock, or have effects beyond their writes, such as
+// splits, which can't be evaluated ahead of applying them.
+var checksummedMethods = map[string]bool{
+	proto.Put:            true,
+	proto.ConditionalPut: true,
+	proto.CompareAndSet:  true,
+	proto.Increment:      true,
+	proto.Delete:         true,
+	proto.DeleteRange:    true,
+	proto.InternalMerge:  true,
+}
+
+// resultChecksum evaluates the command against the range's current
+// state and returns the checksum of its writes, which are discarded.
+// Each replica applying the command verifies that its writes have the
+// same checksum, turning replicas whose state has diverged into an
+// attributable error rather than silent divergence. The writes of a
+// command which fails are empty. Returns zero if the checksum can't be
+// computed.
+func (r *Range) resultChecksum(method string, args proto.Request) uint32 {
+	_, reply, err := proto.CreateArgsAndReply(method)
+	if err != nil {
+		return 0
+	}
+	args = gogoproto.Clone(args).(proto.Request)
+	batch := r.rm.Engine().NewBatch()
+	if err := r.dispatchCmd(batch, &engine.MVCCStats{}, method, args, reply); err != nil {
+		return 0
+	}
+	if reply.Header().GoError() != nil {
+		batch = r.rm.Engine().NewBatch()
+	}
+	return batchChecksum(batch, r.Desc)
+}
+
 // startGossip periodically gossips the cluster ID if it's the
 // first range and the raft leader.
 func (r *Range) startGossip() {
@@ -611,8 +1113,37 @@ func (r *Range) loadConfigMap(keyPrefix proto.Key, configI interface{}) (PrefixC
 	return NewPrefixConfigMap(configs)
 }
 
-// maybeUpdateGossipConfigs is used to update gossip configs.
+// maybeGossipSettings gossips the cluster settings if they fall
+// within the range and this replica is the raft leader. Only settings
+// which have been changed from their defaults are stored.
+func (r *Range) maybeGossipSettings() {
+	if r.rm.Gossip() == nil || !r.IsLeader() || !r.ContainsKey(engine.KeySettingPrefix) {
+		return
+	}
+	if !r.ContainsKey(engine.KeySettingPrefix.PrefixEnd()) {
+		log.Fatalf("range splits cluster settings")
+	}
+	kvs, err := engine.MVCCScan(r.rm.Engine(), engine.KeySettingPrefix, engine.KeySettingPrefix.PrefixEnd(), 0, proto.MaxTimestamp, nil)
+	if err != nil {
+		log.Errorf("failed loading cluster settings: %s", err)
+		return
+	}
+	values := map[string]string{}
+	for _, kv := range kvs {
+		values[string(bytes.TrimPrefix(kv.Key, engine.KeySettingPrefix))] = string(kv.Value.Bytes)
+	}
+	if err := r.rm.Gossip().AddInfo(gossip.KeySettings, values, 0*time.Second); err != nil {
+		log.Errorf("failed to gossip cluster settings: %s", err)
+	}
+}
+
+// maybeUpdateGossipConfigs is used to update gossip configs and
+// cluster settings.
 func (r *Range) maybeUpdateGossipConfigs(key proto.Key) {
+	if bytes.HasPrefix(key, engine.KeySettingPrefix) {
+		r.maybeGossipSettings()
+		return
+	}
 	// Check whether this put has modified a configuration map.
 	for _, cd := range configDescriptors {
 		if bytes.HasPrefix(key, cd.keyPrefix) {
@@ -668,8 +1199,13 @@ func (r *Range) maybeSplit() {
 	}
 }
 
-// executeCmd switches over the method and multiplexes to execute the
-// appropriate storage API command.
+// executeCmd executes the command in a new batch, which is committed
+// if the command is a read/write command and succeeds. If raftCmd is
+// not nil, the command is being applied as the committed Raft command
+// raftCmd: it is verified first, and the range's lease applied index
+// is advanced to its MaxLeaseIndex in the batch which commits the
+// command's writes. The index advances even if the command fails, as
+// every replica fails it alike.
 //
 // TODO(Spencer): Differentiate between errors caused by the normal culprits --
 // bad inputs from clients, stale information, etc. and errors which might
@@ -678,21 +1214,117 @@ func (r *Range) maybeSplit() {
 // errors which should be classified as a ReplicaCorruptionError--when those
 // bubble up to the point where we've just tried to execute a Raft command, the
 // Raft replica would need to stall itself.
-func (r *Range) executeCmd(method string, args proto.Request, reply proto.Response) error {
+func (r *Range) executeCmd(method string, args proto.Request, reply proto.Response, raftCmd *proto.InternalRaftCommand) error {
+	header := args.Header()
+	// Create a new batch for the command to ensure all or nothing semantics.
+	var batch engine.Engine = r.rm.Engine().NewBatch()
+	// Create an engine.MVCCStats instance.
+	ms := &engine.MVCCStats{}
+	// If requested, record statistics of the command's execution.
+	var stats *proto.ResponseStats
+	if header.ReturnStats {
+		stats = &proto.ResponseStats{}
+		batch = newStatsEngine(batch, stats)
+	}
+	start := time.Now()
+
 	// Verify key is contained within range here to catch any range split
 	// or merge activity.
-	header := args.Header()
 	if !r.ContainsKeyRange(header.Key, header.EndKey) {
-		err := proto.NewRangeKeyMismatchError(header.Key, header.EndKey, r.Desc)
+		reply.Header().SetGoError(proto.NewRangeKeyMismatchError(header.Key, header.EndKey, r.Desc))
+	} else if err := r.verifyRaftCommand(method, raftCmd); err != nil {
 		reply.Header().SetGoError(err)
+	} else if err := r.dispatchCmd(batch, ms, method, args, reply); err != nil {
 		return err
 	}
 
-	// Create a new batch for the command to ensure all or nothing semantics.
-	batch := r.rm.Engine().NewBatch()
-	// Create an engine.MVCCStats instance.
-	ms := &engine.MVCCStats{}
+	// On success, flush the MVCC stats to the batch. On failure, the
+	// command's writes are discarded.
+	succeeded := reply.Header().GoError() == nil
+	if succeeded {
+		ms.MergeStats(batch, r.Desc.RaftID, r.rm.StoreID())
+	} else if raftCmd != nil {
+		batch = r.rm.Engine().NewBatch()
+	}
+	if raftCmd != nil && raftCmd.Checksum != 0 {
+		if checksum := batchChecksum(batch, r.Desc); checksum != raftCmd.Checksum {
+			reply.Header().SetGoError(proto.NewReplicaCorruptionError("%s command %+v on range %d, store %d has result checksum %08x; proposed with %08x",
+				method, header.CmdID, r.Desc.RaftID, r.rm.StoreID(), checksum, raftCmd.Checksum))
+			succeeded = false
+			batch = r.rm.Engine().NewBatch()
+		}
+	}
+	if raftCmd != nil && raftCmd.MaxLeaseIndex != 0 {
+		index := proto.Value{}
+		index.SetInt(int64(raftCmd.MaxLeaseIndex))
+		if err := engine.MVCCPut(batch, nil, engine.RangeLeaseAppliedIndexKey(r.Desc.RaftID), proto.ZeroTimestamp,
+			index, nil); err != nil {
+			reply.Header().SetGoError(proto.NewReplicaCorruptionError("unable to record lease applied index %d of range %d, store %d: %s",
+				raftCmd.MaxLeaseIndex, r.Desc.RaftID, r.rm.StoreID(), err))
+		}
+	}
+	if raftCmd != nil || (succeeded && proto.IsReadWrite(method)) {
+		if err := batch.Commit(); err != nil {
+			// Other replicas may have committed this command, so
+			// failing to do so here leaves this replica diverged.
+			reply.Header().SetGoError(proto.NewReplicaCorruptionError("unable to commit %s command %+v on range %d, store %d: %s",
+				method, header.CmdID, r.Desc.RaftID, r.rm.StoreID(), err))
+		} else if succeeded {
+			// Once the frozen state is committed, apply it to the replica.
+			if method == proto.InternalSetFrozen {
+				r.setFrozen(args.(*proto.InternalSetFrozenRequest).Frozen)
+			}
+			// If the commit succeeded, potentially initiate a split of this range.
+			r.maybeSplit()
+		}
+	}
+	if err, ok := reply.Header().GoError().(*proto.ReadWithinUncertaintyIntervalError); ok {
+		// A ReadUncertaintyIntervalError contains the timestamp of the value
+		// that provoked the conflict. However, we forward the timestamp to the
+		// node's time here. The reason is that the caller (which is always
+		// transactional when this error occurs) in our implementation wants to
+		// use this information to extract a timestamp after which reads from
+		// the nodes are causally consistent with the transaction. This allows
+		// the node to be classified as without further uncertain reads for the
+		// remainder of the transaction.
+		// See the comment on proto.Transaction.CertainNodes.
+		err.ExistingTimestamp.Forward(r.rm.Clock().Now())
+	}
+
+	// Maybe update gossip configs on a put or delete if there was no error.
+	if (method == proto.Put || method == proto.ConditionalPut || method == proto.Delete) &&
+		header.Key.Less(engine.KeySystemMax) && reply.Header().Error == nil {
+		r.maybeUpdateGossipConfigs(args.Header().Key)
+	}
+
+	// Propagate the request timestamp (which may have changed).
+	reply.Header().Timestamp = args.Header().Timestamp
+	if stats != nil {
+		stats.EngineNanos = time.Since(start).Nanoseconds()
+		reply.Header().Stats = stats
+	}
+
+	log.V(1).Infof("executed %s command %+v: %+v", method, args, reply)
+
+	// Add this command's result to the response cache if this is a
+	// read/write method. This must be done as part of the execution of
+	// raft commands so that every replica maintains the same responses
+	// to continue request idempotence when leadership changes.
+	if proto.IsReadWrite(method) {
+		if putErr := r.respCache.PutResponse(args.Header().CmdID, reply); putErr != nil {
+			log.Errorf("unable to write result of %+v: %+v to the response cache: %s",
+				args, reply, putErr)
+		}
+	}
+
+	// Return the error (if any) set in the reply.
+	return reply.Header().GoError()
+}
 
+// dispatchCmd switches over the method and multiplexes to execute the
+// appropriate storage API command on batch, accumulating the command's
+// MVCC stats deltas in ms. The command's result is set in reply.
+func (r *Range) dispatchCmd(batch engine.Engine, ms *engine.MVCCStats, method string, args proto.Request, reply proto.Response) error {
 	switch method {
 	case proto.Contains:
 		r.Contains(batch, args.(*proto.ContainsRequest), reply.(*proto.ContainsResponse))
@@ -702,6 +1334,8 @@ func (r *Range) executeCmd(method string, args proto.Request, reply proto.Respon
 		r.Put(batch, ms, args.(*proto.PutRequest), reply.(*proto.PutResponse))
 	case proto.ConditionalPut:
 		r.ConditionalPut(batch, ms, args.(*proto.ConditionalPutRequest), reply.(*proto.ConditionalPutResponse))
+	case proto.CompareAndSet:
+		r.CompareAndSet(batch, ms, args.(*proto.CompareAndSetRequest), reply.(*proto.CompareAndSetResponse))
 	case proto.Increment:
 		r.Increment(batch, ms, args.(*proto.IncrementRequest), reply.(*proto.IncrementResponse))
 	case proto.Delete:
@@ -726,65 +1360,23 @@ func (r *Range) executeCmd(method string, args proto.Request, reply proto.Respon
 		r.InternalPushTxn(batch, args.(*proto.InternalPushTxnRequest), reply.(*proto.InternalPushTxnResponse))
 	case proto.InternalResolveIntent:
 		r.InternalResolveIntent(batch, ms, args.(*proto.InternalResolveIntentRequest), reply.(*proto.InternalResolveIntentResponse))
+	case proto.InternalQueryIntent:
+		r.InternalQueryIntent(batch, args.(*proto.InternalQueryIntentRequest), reply.(*proto.InternalQueryIntentResponse))
 	case proto.InternalMerge:
 		r.InternalMerge(batch, ms, args.(*proto.InternalMergeRequest), reply.(*proto.InternalMergeResponse))
+	case proto.InternalScanChanges:
+		r.InternalScanChanges(batch, args.(*proto.InternalScanChangesRequest), reply.(*proto.InternalScanChangesResponse))
+	case proto.InternalSetFrozen:
+		r.InternalSetFrozen(batch, args.(*proto.InternalSetFrozenRequest), reply.(*proto.InternalSetFrozenResponse))
 	default:
 		return util.Errorf("unrecognized command %q", method)
 	}
-
-	// On success, flush the MVCC stats to the batch and commit.
-	if err := reply.Header().GoError(); err == nil {
-		if proto.IsReadWrite(method) {
-			ms.MergeStats(batch, r.Desc.RaftID, r.rm.StoreID())
-			if err := batch.Commit(); err != nil {
-				reply.Header().SetGoError(err)
-			} else {
-				// If the commit succeeded, potentially initiate a split of this range.
-				r.maybeSplit()
-			}
-		}
-	} else if err, ok := reply.Header().GoError().(*proto.ReadWithinUncertaintyIntervalError); ok {
-		// A ReadUncertaintyIntervalError contains the timestamp of the value
-		// that provoked the conflict. However, we forward the timestamp to the
-		// node's time here. The reason is that the caller (which is always
-		// transactional when this error occurs) in our implementation wants to
-		// use this information to extract a timestamp after which reads from
-		// the nodes are causally consistent with the transaction. This allows
-		// the node to be classified as without further uncertain reads for the
-		// remainder of the transaction.
-		// See the comment on proto.Transaction.CertainNodes.
-		err.ExistingTimestamp.Forward(r.rm.Clock().Now())
-	}
-
-	// Maybe update gossip configs on a put if there was no error.
-	if (method == proto.Put || method == proto.ConditionalPut) &&
-		header.Key.Less(engine.KeySystemMax) && reply.Header().Error == nil {
-		r.maybeUpdateGossipConfigs(args.Header().Key)
-	}
-
-	// Propagate the request timestamp (which may have changed).
-	reply.Header().Timestamp = args.Header().Timestamp
-
-	log.V(1).Infof("executed %s command %+v: %+v", method, args, reply)
-
-	// Add this command's result to the response cache if this is a
-	// read/write method. This must be done as part of the execution of
-	// raft commands so that every replica maintains the same responses
-	// to continue request idempotence when leadership changes.
-	if proto.IsReadWrite(method) {
-		if putErr := r.respCache.PutResponse(args.Header().CmdID, reply); putErr != nil {
-			log.Errorf("unable to write result of %+v: %+v to the response cache: %s",
-				args, reply, putErr)
-		}
-	}
-
-	// Return the error (if any) set in the reply.
-	return reply.Header().GoError()
+	return nil
 }
 
 // Contains verifies the existence of a key in the key value store.
 func (r *Range) Contains(batch engine.Engine, args *proto.ContainsRequest, reply *proto.ContainsResponse) {
-	val, err := engine.MVCCGet(batch, args.Key, args.Timestamp, args.Txn)
+	val, err := r.get(batch, &args.RequestHeader)
 	if err != nil {
 		reply.SetGoError(err)
 		return
@@ -796,14 +1388,44 @@ func (r *Range) Contains(batch engine.Engine, args *proto.ContainsRequest, reply
 
 // Get returns the value for a specified key.
 func (r *Range) Get(batch engine.Engine, args *proto.GetRequest, reply *proto.GetResponse) {
-	val, err := engine.MVCCGet(batch, args.Key, args.Timestamp, args.Txn)
+	val, err := r.get(batch, &args.RequestHeader)
 	reply.Value = val
 	reply.SetGoError(err)
 }
 
+// get reads the value of the key specified in header with the
+// requested read consistency.
+func (r *Range) get(batch engine.Engine, header *proto.RequestHeader) (*proto.Value, error) {
+	if header.ReadConsistency == proto.INCONSISTENT {
+		return engine.MVCCGetInconsistent(batch, header.Key, header.Timestamp)
+	}
+	return engine.MVCCGet(batch, header.Key, header.Timestamp, header.Txn)
+}
+
 // Put sets the value for a specified key.
+// If an expiration is specified, the key is deleted by the scan queue
+// once it has passed.
 func (r *Range) Put(batch engine.Engine, ms *engine.MVCCStats, args *proto.PutRequest, reply *proto.PutResponse) {
-	err := engine.MVCCPut(batch, ms, args.Key, args.Timestamp, args.Value, args.Txn)
+	if args.Inline {
+		if args.Expiration != nil {
+			reply.SetGoError(util.Errorf("inline value at key %q may not expire", args.Key))
+			return
+		}
+		ts, err := inlineTimestamp(&args.RequestHeader)
+		if err == nil {
+			err = engine.MVCCPut(batch, ms, args.Key, ts, args.Value, nil)
+		}
+		reply.SetGoError(err)
+		return
+	}
+	if args.Expiration == nil {
+		reply.SetGoError(engine.MVCCPut(batch, ms, args.Key, args.Timestamp, args.Value, args.Txn))
+		return
+	}
+	err := engine.MVCCPutExpiring(batch, ms, args.Key, args.Timestamp, args.Value, args.Txn, *args.Expiration)
+	if err == nil {
+		r.noteExpiration(args.Expiration.WallTime)
+	}
 	reply.SetGoError(err)
 }
 
@@ -812,13 +1434,64 @@ func (r *Range) Put(batch engine.Engine, ms *engine.MVCCStats, args *proto.PutRe
 // the actual value.
 func (r *Range) ConditionalPut(batch engine.Engine, ms *engine.MVCCStats, args *proto.ConditionalPutRequest, reply *proto.ConditionalPutResponse) {
 	err := engine.MVCCConditionalPut(batch, ms, args.Key, args.Timestamp, args.Value, args.ExpValue, args.Txn)
+	if err == nil {
+		reply.NumWritten = 1
+	}
 	reply.SetGoError(err)
 }
 
+// CompareAndSet sets the values of the specified keys only if the
+// values of the keys of all conditions match their expected values.
+// Otherwise, nothing is written and the returned ConditionFailedError
+// contains the actual value of the first failed condition.
+func (r *Range) CompareAndSet(batch engine.Engine, ms *engine.MVCCStats, args *proto.CompareAndSetRequest, reply *proto.CompareAndSetResponse) {
+	for _, cond := range args.Conditions {
+		if !inRequestSpan(&args.RequestHeader, cond.Key) {
+			reply.SetGoError(util.Errorf("condition key %q outside of request span", cond.Key))
+			return
+		}
+		// As for ConditionalPut, read at the max timestamp to detect
+		// newer values and write intents.
+		val, err := engine.MVCCGet(batch, cond.Key, proto.MaxTimestamp, args.Txn)
+		if err == nil {
+			err = engine.CheckCondition(cond.ExpValue, val)
+		}
+		if err != nil {
+			reply.SetGoError(err)
+			return
+		}
+	}
+	for _, kv := range args.Puts {
+		if !inRequestSpan(&args.RequestHeader, kv.Key) {
+			reply.SetGoError(util.Errorf("put key %q outside of request span", kv.Key))
+			return
+		}
+		if err := engine.MVCCPut(batch, ms, kv.Key, args.Timestamp, kv.Value, args.Txn); err != nil {
+			reply.SetGoError(err)
+			return
+		}
+	}
+	reply.NumWritten = int64(len(args.Puts))
+}
+
+// inRequestSpan returns true if key lies between the key and end key
+// of the request header.
+func inRequestSpan(header *proto.RequestHeader, key proto.Key) bool {
+	return !key.Less(header.Key) && key.Less(header.EndKey)
+}
+
 // Increment increments the value (interpreted as varint64 encoded) and
 // returns the newly incremented value (encoded as varint64). If no value
 // exists for the key, zero is incremented.
 func (r *Range) Increment(batch engine.Engine, ms *engine.MVCCStats, args *proto.IncrementRequest, reply *proto.IncrementResponse) {
+	if args.Inline {
+		ts, err := inlineTimestamp(&args.RequestHeader)
+		if err == nil {
+			reply.NewValue, err = engine.MVCCIncrement(batch, ms, args.Key, ts, nil, args.Increment)
+		}
+		reply.SetGoError(err)
+		return
+	}
 	val, err := engine.MVCCIncrement(batch, ms, args.Key, args.Timestamp, args.Txn, args.Increment)
 	reply.NewValue = val
 	reply.SetGoError(err)
@@ -826,23 +1499,53 @@ func (r *Range) Increment(batch engine.Engine, ms *engine.MVCCStats, args *proto
 
 // Delete deletes the key and value specified by key.
 func (r *Range) Delete(batch engine.Engine, ms *engine.MVCCStats, args *proto.DeleteRequest, reply *proto.DeleteResponse) {
+	if args.Inline {
+		ts, err := inlineTimestamp(&args.RequestHeader)
+		if err == nil {
+			err = engine.MVCCDelete(batch, ms, args.Key, ts, nil)
+		}
+		reply.SetGoError(err)
+		return
+	}
 	reply.SetGoError(engine.MVCCDelete(batch, ms, args.Key, args.Timestamp, args.Txn))
 }
 
+// inlineTimestamp returns the timestamp at which an inline write
+// described by the supplied header is performed. Inline values have
+// no versions and so can't hold intents; transactional inline writes
+// are rejected.
+func inlineTimestamp(header *proto.RequestHeader) (proto.Timestamp, error) {
+	if header.Txn != nil {
+		return proto.ZeroTimestamp, util.Errorf("inline write to key %q may not be transactional", header.Key)
+	}
+	return proto.ZeroTimestamp, nil
+}
+
 // DeleteRange deletes the range of key/value pairs specified by
 // start and end keys.
 func (r *Range) DeleteRange(batch engine.Engine, ms *engine.MVCCStats, args *proto.DeleteRangeRequest, reply *proto.DeleteRangeResponse) {
-	num, err := engine.MVCCDeleteRange(batch, ms, args.Key, args.EndKey, args.MaxEntriesToDelete, args.Timestamp, args.Txn)
+	num, deleted, err := engine.MVCCDeleteRangeKeys(batch, ms, args.Key, args.EndKey,
+		args.MaxEntriesToDelete, args.MaxReturnedKeys, args.Timestamp, args.Txn)
 	reply.NumDeleted = num
+	reply.DeletedKeys = deleted
 	reply.SetGoError(err)
 }
 
 // Scan scans the key range specified by start key through end key up
 // to some maximum number of results. The last key of the iteration is
-// returned with the reply.
+// returned with the reply. Keys are prefix-compressed if requested.
 func (r *Range) Scan(batch engine.Engine, args *proto.ScanRequest, reply *proto.ScanResponse) {
-	kvs, err := engine.MVCCScan(batch, args.Key, args.EndKey, args.MaxResults, args.Timestamp, args.Txn)
+	var kvs []proto.KeyValue
+	var err error
+	if args.ReadConsistency == proto.INCONSISTENT {
+		kvs, err = engine.MVCCScanInconsistent(batch, args.Key, args.EndKey, args.MaxResults, args.Timestamp)
+	} else {
+		kvs, err = engine.MVCCScan(batch, args.Key, args.EndKey, args.MaxResults, args.Timestamp, args.Txn)
+	}
 	reply.Rows = kvs
+	if args.CompressKeys {
+		reply.CompressKeys()
+	}
 	reply.SetGoError(err)
 }
 
@@ -909,6 +1612,12 @@ func (r *Range) EndTransaction(batch engine.Engine, args *proto.EndTransactionRe
 	// Set transaction status to COMMITTED or ABORTED as per the
 	// args.Commit parameter.
 	if args.Commit {
+		// The commit is refused, rather than the transaction aborted,
+		// so the client learns why; it then aborts the transaction.
+		if args.Deadline != nil && args.Deadline.Less(reply.Txn.Timestamp) {
+			reply.SetGoError(proto.NewTransactionDeadlineExceededError(reply.Txn, *args.Deadline))
+			return
+		}
 		// If the isolation level is SERIALIZABLE, return a transaction
 		// retry error if the commit timestamp isn't equal to the txn
 		// timestamp.
@@ -1222,12 +1931,39 @@ func (r *Range) InternalResolveIntent(batch engine.Engine, ms *engine.MVCCStats,
 		reply.SetGoError(util.Errorf("no transaction specified to InternalResolveIntent"))
 		return
 	}
+	var err error
 	if len(args.EndKey) == 0 || bytes.Equal(args.Key, args.EndKey) {
-		reply.SetGoError(engine.MVCCResolveWriteIntent(batch, ms, args.Key, args.Txn))
+		err = engine.MVCCResolveWriteIntent(batch, ms, args.Key, args.Txn)
 	} else {
-		_, err := engine.MVCCResolveWriteIntentRange(batch, ms, args.Key, args.EndKey, 0, args.Txn)
+		_, err = engine.MVCCResolveWriteIntentRange(batch, ms, args.Key, args.EndKey, 0, args.Txn)
+	}
+	// Intents of a committed or aborted transaction are removed; those
+	// of a pending transaction are merely pushed and still conflict.
+	if err == nil && args.Txn.Status != proto.PENDING {
+		r.locks.resolve(args.Key, args.EndKey, args.Txn.ID)
+	}
+	reply.SetGoError(err)
+}
+
+// InternalQueryIntent verifies whether an intent written by the
+// transaction in the request header exists at the key, without
+// resolving it. If args.ErrorIfMissing is set, a missing intent is
+// returned as an error instead.
+func (r *Range) InternalQueryIntent(batch engine.Engine, args *proto.InternalQueryIntentRequest, reply *proto.InternalQueryIntentResponse) {
+	if args.Txn == nil {
+		reply.SetGoError(util.Errorf("no transaction specified to InternalQueryIntent"))
+		return
+	}
+	found, err := engine.MVCCQueryIntent(batch, args.Key, args.Txn)
+	if err != nil {
 		reply.SetGoError(err)
+		return
+	}
+	if !found && args.ErrorIfMissing {
+		reply.SetGoError(util.Errorf("intent of txn %s missing at key %q", args.Txn, args.Key))
+		return
 	}
+	reply.FoundIntent = found
 }
 
 // InternalMerge is used to merge a value into an existing key. Merge is an
@@ -1240,10 +1976,33 @@ func (r *Range) InternalMerge(batch engine.Engine, ms *engine.MVCCStats, args *p
 	reply.SetGoError(err)
 }
 
+// InternalScanChanges returns the most recent versions of the keys in
+// the request's span changed since args.Since, including deletions.
+func (r *Range) InternalScanChanges(batch engine.Engine, args *proto.InternalScanChangesRequest, reply *proto.InternalScanChangesResponse) {
+	changes, err := engine.MVCCScanChanges(batch, args.Key, args.EndKey, args.MaxResults, args.Since, args.Timestamp)
+	reply.Changes = changes
+	reply.SetGoError(err)
+}
+
+// InternalSetFrozen records the range as frozen as of the command's
+// timestamp, or removes the record. It is applied by every replica of
+// the range, each of which updates its frozen state to match once the
+// record is committed; see executeCmd.
+func (r *Range) InternalSetFrozen(batch engine.Engine, args *proto.InternalSetFrozenRequest, reply *proto.InternalSetFrozenResponse) {
+	key := engine.RangeFrozenKey(r.Desc.RaftID)
+	var err error
+	if args.Frozen {
+		err = engine.MVCCPutProto(batch, nil, key, proto.ZeroTimestamp, nil, &args.Timestamp)
+	} else {
+		err = engine.MVCCDelete(batch, nil, key, proto.ZeroTimestamp, nil)
+	}
+	reply.SetGoError(err)
+}
+
 // splitTrigger is called on a successful commit of an AdminSplit
-// transaction. It copies the response cache for the new range and
-// recomputes stats for both the existing, updated range and the new
-// range.
+// transaction. It copies the response cache and frozen state for the
+// new range and recomputes stats for both the existing, updated range
+// and the new range.
 func (r *Range) splitTrigger(batch engine.Engine, split *proto.SplitTrigger) error {
 	if !bytes.Equal(r.Desc.StartKey, split.UpdatedDesc.StartKey) ||
 		!bytes.Equal(r.Desc.EndKey, split.NewDesc.EndKey) {
@@ -1273,6 +2032,19 @@ func (r *Range) splitTrigger(batch engine.Engine, split *proto.SplitTrigger) err
 	}
 	ms.SetStats(batch, r.Desc.RaftID, 0)
 
+	// Copy the frozen marker, so that both halves of a frozen range
+	// remain frozen.
+	var frozenAt proto.Timestamp
+	frozen, err := engine.MVCCGetProto(batch, engine.RangeFrozenKey(r.Desc.RaftID), proto.ZeroTimestamp, nil, &frozenAt)
+	if err != nil {
+		return util.Errorf("unable to read frozen state: %s", err)
+	}
+	if frozen {
+		if err := engine.MVCCPutProto(batch, nil, engine.RangeFrozenKey(split.NewDesc.RaftID), proto.ZeroTimestamp, nil, &frozenAt); err != nil {
+			return util.Errorf("unable to copy frozen state: %s", err)
+		}
+	}
+
 	// Initialize the new range's response cache by copying the original's.
 	if err = r.respCache.CopyInto(batch, split.NewDesc.RaftID); err != nil {
 		return util.Errorf("unable to copy response cache to new split range: %s", err)
@@ -1285,6 +2057,12 @@ func (r *Range) splitTrigger(batch engine.Engine, split *proto.SplitTrigger) err
 	if err != nil {
 		return err
 	}
+	// The copied scan metadata is not yet committed, so carry over the
+	// GC thresholds explicitly.
+	newRng.advanceGCThresholds(r.gcThresholds())
+	if frozen {
+		newRng.setFrozen(true)
+	}
 	// Write-lock the mutex to protect Desc, as SplitRange will modify
 	// Desc.EndKey.
 	r.Lock()
@@ -1319,6 +2097,12 @@ func (r *Range) AdminSplit(args *proto.AdminSplitRequest, reply *proto.AdminSpli
 			reply.SetGoError(util.Errorf("unable to determine split key: %s", err))
 			return
 		}
+		// Adjust the split key, unless that would leave nothing to split off.
+		if adjusted, err := r.rm.AdjustSplitKey(splitKey); err != nil {
+			log.Warningf("unable to adjust split key %q of range %d: %s", splitKey, r.Desc.RaftID, err)
+		} else if r.Desc.StartKey.Less(adjusted) && adjusted.Less(r.Desc.EndKey) && engine.IsValidSplitKey(adjusted) {
+			splitKey = adjusted
+		}
 	}
 
 	// Verify some properties of split key.
@@ -1382,6 +2166,67 @@ func (r *Range) AdminSplit(args *proto.AdminSplitRequest, reply *proto.AdminSpli
 	}
 }
 
+// AdminFreeze stops the range from accepting read-write commands and
+// waits for those already underway to complete. New read-write
+// commands block until AdminUnfreeze is invoked. The frozen state is
+// proposed through Raft as an InternalSetFrozen command, which each
+// replica records in its local data so that it survives restarts.
+func (r *Range) AdminFreeze(args *proto.AdminFreezeRequest, reply *proto.AdminFreezeResponse) {
+	if err := r.proposeFrozen(true); err != nil {
+		reply.SetGoError(err)
+		return
+	}
+	// Wait for all commands underway, including those on range-local
+	// keys such as transaction records.
+	var wg sync.WaitGroup
+	r.Lock()
+	r.cmdQ.GetWait(engine.KeyMin, engine.KeyMax, false, &wg)
+	r.Unlock()
+	wg.Wait()
+}
+
+// AdminUnfreeze resumes read-write commands on a frozen range,
+// including those blocked while it was frozen. Unfreezing a range
+// which isn't frozen is a no-op.
+func (r *Range) AdminUnfreeze(args *proto.AdminUnfreezeRequest, reply *proto.AdminUnfreezeResponse) {
+	reply.SetGoError(r.proposeFrozen(false))
+}
+
+// proposeFrozen proposes an InternalSetFrozen command which freezes or
+// unfreezes the range and waits for it to be applied.
+func (r *Range) proposeFrozen(frozen bool) error {
+	args := &proto.InternalSetFrozenRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:       r.Desc.StartKey,
+			Timestamp: r.rm.Clock().Now(),
+		},
+		Frozen: frozen,
+	}
+	return r.addReadWriteCmd(proto.InternalSetFrozen, args, &proto.InternalSetFrozenResponse{}, true)
+}
+
+// setFrozen updates the replica's frozen state. Unfreezing the replica
+// resumes the read-write commands blocked while it was frozen.
+func (r *Range) setFrozen(frozen bool) {
+	r.Lock()
+	defer r.Unlock()
+	if frozen && r.unfrozen == nil {
+		r.unfrozen = make(chan struct{})
+		log.Infof("range %d frozen", r.Desc.RaftID)
+	} else if !frozen && r.unfrozen != nil {
+		close(r.unfrozen)
+		r.unfrozen = nil
+		log.Infof("range %d unfrozen", r.Desc.RaftID)
+	}
+}
+
+// IsFrozen returns true if the range is frozen.
+func (r *Range) IsFrozen() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.unfrozen != nil
+}
+
 // InitialState implements the raft.Storage interface.
 func (r *Range) InitialState() (raftpb.HardState, raftpb.ConfState, error) {
 	// Set up the defaults if there is no stored HardState.
@@ -1493,6 +2338,7 @@ func (r *Range) Snapshot() (raftpb.Snapshot, error) {
 func (r *Range) Append(entries []raftpb.Entry) error {
 	batch := r.rm.Engine().NewBatch()
 	for _, ent := range entries {
+		r.rm.RaftMetrics().entrySize.Record(float64(len(ent.Data)))
 		err := engine.MVCCPutProto(batch, nil, engine.RaftLogKey(r.Desc.RaftID, ent.Index),
 			proto.ZeroTimestamp, nil, &ent)
 		if err != nil {
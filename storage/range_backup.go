@@ -0,0 +1,375 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/cloud"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/coreos/etcd/raft/raftpb"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// rangeBackupName returns the name of the file in external storage
+// holding the most recent backup of the range with the given Raft ID
+// taken from the replica on the given store.
+func rangeBackupName(storeID int32, raftID int64) string {
+	return fmt.Sprintf("store-%d-range-%d.backup", storeID, raftID)
+}
+
+// BackupRange returns a backup of the data of this store's replica of
+// rng, taken from a consistent snapshot. The replica's Raft log and
+// Raft state are left out. Splits of the range are refused while the
+// snapshot is taken, so that the backup's descriptor matches its data.
+func (s *Store) BackupRange(rng *Range) (*proto.RangeBackup, error) {
+	if !atomic.CompareAndSwapInt32(&rng.splitting, int32(0), int32(1)) {
+		return nil, util.Errorf("range %d is being split", rng.Desc.RaftID)
+	}
+	rng.RLock()
+	desc := *rng.Desc
+	rng.RUnlock()
+	snap := engine.NewBackgroundSnapshot(s.engine)
+	iter := newRangeDataIterator(rng, snap)
+	atomic.StoreInt32(&rng.splitting, int32(0))
+	defer snap.Stop()
+	defer iter.Close()
+
+	logPrefix := engine.RaftLogPrefix(desc.RaftID)
+	logStart, logEnd := engine.MVCCEncodeKey(logPrefix), engine.MVCCEncodeKey(logPrefix.PrefixEnd())
+	stateKey := engine.MVCCEncodeKey(engine.RaftStateKey(desc.RaftID))
+	backup := &proto.RangeBackup{Desc: desc, WallTime: s.clock.PhysicalNow()}
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if bytes.Equal(key, stateKey) || (!key.Less(logStart) && key.Less(logEnd)) {
+			continue
+		}
+		backup.Data = append(backup.Data, proto.RawKeyValue{
+			Key:   append(proto.EncodedKey(nil), key...),
+			Value: append([]byte(nil), iter.Value()...),
+		})
+	}
+	return backup, iter.Error()
+}
+
+// BackupRanges writes a backup of each range of the store to es,
+// replacing the ranges' earlier backups, and returns the number of
+// ranges backed up. Ranges being split are skipped.
+func (s *Store) BackupRanges(es cloud.ExternalStorage) (int, error) {
+	var count int
+	iter := newStoreRangeIterator(s)
+	for rng := iter.Next(); rng != nil; rng = iter.Next() {
+		backup, err := s.BackupRange(rng)
+		if err != nil {
+			log.Warningf("unable to back up range %d of store %d: %s", rng.Desc.RaftID, s.StoreID(), err)
+			continue
+		}
+		b, err := gogoproto.Marshal(backup)
+		if err != nil {
+			return count, err
+		}
+		if err := es.WriteFile(rangeBackupName(s.StoreID(), backup.Desc.RaftID), b); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// SetRelocationBackups sets the external storage holding the range
+// backups from which replicas relocated to the store from another
+// store on its node, and replicas added to the store on a new node,
+// are seeded. See BackupRanges, RelocateRange and SeedReplica.
+func (s *Store) SetRelocationBackups(es cloud.ExternalStorage) {
+	s.relocationBackups = es
+}
+
+// seedRange writes the data of the most recent backup of source's
+// replica of the range described by desc to this store, along with a
+// relocation marker, so that a relocation from source only needs to
+// copy the commands applied since the backup was taken. Returns false
+// if no relocation backups are set or no matching backup is found.
+func (s *Store) seedRange(source *Store, desc *proto.RangeDescriptor) bool {
+	if s.relocationBackups == nil {
+		return false
+	}
+	backup, err := s.readRangeBackup(source.StoreID(), desc.RaftID)
+	if err != nil {
+		log.V(1).Infof("no backup of range %d to seed store %d from: %s", desc.RaftID, s.StoreID(), err)
+		return false
+	}
+	if err := s.seedFromBackup(backup, desc); err != nil {
+		log.Warningf("unable to seed range %d on store %d: %s", desc.RaftID, s.StoreID(), err)
+		return false
+	}
+	log.Infof("seeded range %d on store %d from backup taken at %s", desc.RaftID, s.StoreID(),
+		time.Unix(0, backup.WallTime).UTC())
+	return true
+}
+
+// readRangeBackup reads the most recent backup of the replica of the
+// range with the given Raft ID on the store with ID storeID from the
+// store's relocation backups.
+func (s *Store) readRangeBackup(storeID int32, raftID int64) (*proto.RangeBackup, error) {
+	r, err := s.relocationBackups.ReadFile(rangeBackupName(storeID, raftID))
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, util.Errorf("unable to read backup of range %d: %s", raftID, err)
+	}
+	backup := &proto.RangeBackup{}
+	if err := gogoproto.Unmarshal(b, backup); err != nil {
+		return nil, util.Errorf("unable to decode backup of range %d: %s", raftID, err)
+	}
+	return backup, nil
+}
+
+// checkBackup returns an error unless backup is a backup of the range
+// described by desc, with the same bounds.
+func checkBackup(backup *proto.RangeBackup, desc *proto.RangeDescriptor) error {
+	if backup.Desc.RaftID != desc.RaftID || !backup.Desc.StartKey.Equal(desc.StartKey) ||
+		!backup.Desc.EndKey.Equal(desc.EndKey) {
+		return util.Errorf("backup of range %d %q-%q doesn't match range %d %q-%q", backup.Desc.RaftID,
+			backup.Desc.StartKey, backup.Desc.EndKey, desc.RaftID, desc.StartKey, desc.EndKey)
+	}
+	return nil
+}
+
+// seedFromBackup writes the data of backup, which must be of the range
+// described by desc, to this store along with a relocation marker. A
+// restart before the relocation finishes discards the seed; see
+// ResolveRelocations.
+func (s *Store) seedFromBackup(backup *proto.RangeBackup, desc *proto.RangeDescriptor) error {
+	if err := checkBackup(backup, desc); err != nil {
+		return err
+	}
+	batch := s.engine.NewBatch()
+	for _, kv := range backup.Data {
+		if err := batch.Put(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	if err := engine.MVCCPutProto(batch, nil, engine.StoreRelocationKey(desc.RaftID), proto.ZeroTimestamp, nil, &backup.Desc); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if _, ok := s.relocating[desc.RaftID]; ok {
+		s.mu.Unlock()
+		return util.Errorf("range %d is already being relocated to store %d", desc.RaftID, s.StoreID())
+	}
+	s.relocating[desc.RaftID] = &backup.Desc
+	s.mu.Unlock()
+	if err := batch.Commit(); err != nil {
+		s.mu.Lock()
+		delete(s.relocating, desc.RaftID)
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// A seedRangeManager is the RangeManager of a seeded replica while the
+// commands applied since its backup are replayed. It has no gossip, so
+// the replica neither gossips nor splits, and no store ID, so the
+// replayed commands don't update the store stats; the replica is
+// accounted for once its relocation is loaded.
+type seedRangeManager struct {
+	*Store
+}
+
+// Gossip implements the RangeManager interface.
+func (seedRangeManager) Gossip() *gossip.Gossip {
+	return nil
+}
+
+// StoreID implements the RangeManager interface.
+func (seedRangeManager) StoreID() int32 {
+	return 0
+}
+
+// catchUpSeed applies to the seed of rng on target the commands of
+// this store's replica which were applied after the backup the seed
+// was taken from, reading them from snap, a snapshot of this store
+// taken while commands to the range are blocked. Returns false if the
+// caught-up seed doesn't match the replica: its lease applied index
+// must equal the replica's and their live data must have the same
+// size.
+func (s *Store) catchUpSeed(rng *Range, snap engine.Engine, target *Store) (bool, error) {
+	desc := *rng.Desc
+	seed, err := NewRange(&desc, seedRangeManager{target})
+	if err != nil {
+		return false, err
+	}
+	seed.RLock()
+	seedIndex := seed.leaseAppliedIndex
+	seed.RUnlock()
+	index, err := leaseAppliedIndex(snap, desc.RaftID)
+	if err != nil {
+		return false, err
+	}
+	if seedIndex > index {
+		return false, nil
+	}
+	entries, err := seedEntries(snap, desc.RaftID, seedIndex, index)
+	if err != nil {
+		return false, err
+	}
+	if seedIndex, err = replaySeed(seed, entries); err != nil {
+		return false, err
+	}
+	// Only live data is compared: garbage collection isn't replicated
+	// through Raft, so the seed may hold versions the replica doesn't.
+	ms, err := engine.MVCCGetRangeStats(snap, desc.RaftID)
+	if err != nil {
+		return false, err
+	}
+	seedMS, err := engine.MVCCGetRangeStats(target.engine, desc.RaftID)
+	if err != nil {
+		return false, err
+	}
+	if !seedMatches(desc.RaftID, seedIndex, index, seedMS, ms) {
+		return false, nil
+	}
+	log.Infof("caught up seed of range %d on store %d with %d command(s)", desc.RaftID, target.StoreID(), len(entries))
+	return true, nil
+}
+
+// leaseAppliedIndex returns the lease applied index of the replica of
+// the range with the given Raft ID in eng.
+func leaseAppliedIndex(eng engine.Engine, raftID int64) (uint64, error) {
+	applied, err := engine.MVCCGet(eng, engine.RangeLeaseAppliedIndexKey(raftID), proto.ZeroTimestamp, nil)
+	if err != nil || applied == nil {
+		return 0, err
+	}
+	i, err := applied.GetInt()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(i), nil
+}
+
+// seedEntries returns the encoded Raft log entries in snap of the
+// commands to the range with the given Raft ID whose lease indexes lie
+// in (from, to], in the order of their lease indexes.
+func seedEntries(snap engine.Engine, raftID int64, from, to uint64) ([][]byte, error) {
+	var entries [][]byte
+	logPrefix := engine.RaftLogPrefix(raftID)
+	if err := engine.MVCCIterateCommitted(snap, logPrefix, logPrefix.PrefixEnd(), func(kv proto.KeyValue) (bool, error) {
+		cmd, ok, err := decodeSeedEntry(kv.Value.GetBytes())
+		if err != nil {
+			return false, err
+		}
+		if ok && cmd.cmd.MaxLeaseIndex > from && cmd.cmd.MaxLeaseIndex <= to {
+			entries = append(entries, kv.Value.GetBytes())
+		}
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	// The log is stored newest first.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// decodeSeedEntry decodes the command held by an encoded Raft log
+// entry. Returns false if the entry holds no command.
+func decodeSeedEntry(b []byte) (committedCommand, bool, error) {
+	var ent raftpb.Entry
+	if err := gogoproto.Unmarshal(b, &ent); err != nil {
+		return committedCommand{}, false, err
+	}
+	id, data, ok := multiraft.DecodeCommand(ent.Data)
+	if !ok || ent.Type != raftpb.EntryNormal || len(data) == 0 {
+		return committedCommand{}, false, nil
+	}
+	var cmd proto.InternalRaftCommand
+	if err := decodeRaftCommand(data, &cmd); err != nil {
+		return committedCommand{}, false, err
+	}
+	return committedCommand{cmdIDKey: cmdIDKey(id), cmd: cmd}, true, nil
+}
+
+// replaySeed applies the commands held by entries, encoded Raft log
+// entries in the order of their lease indexes, to seed. Returns the
+// seed's lease applied index once they are applied.
+func replaySeed(seed *Range, entries [][]byte) (uint64, error) {
+	for _, b := range entries {
+		cmd, ok, err := decodeSeedEntry(b)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			seed.processRaftCommand(cmd.cmdIDKey, cmd.cmd)
+		}
+	}
+	seed.RLock()
+	defer seed.RUnlock()
+	return seed.leaseAppliedIndex, nil
+}
+
+// seedMatches returns whether a caught-up seed of the range with the
+// given Raft ID, with lease applied index seedIndex and stats seedMS,
+// matches the replica it was caught up with, with lease applied index
+// index and stats ms. The lease applied indexes must be equal and the
+// live data must have the same size.
+func seedMatches(raftID int64, seedIndex, index uint64, seedMS, ms *engine.MVCCStats) bool {
+	if seedIndex != index {
+		log.Infof("seed of range %d reached lease index %d; replica is at %d", raftID, seedIndex, index)
+		return false
+	}
+	if ms.LiveBytes != seedMS.LiveBytes || ms.LiveCount != seedMS.LiveCount ||
+		ms.IntentBytes != seedMS.IntentBytes || ms.IntentCount != seedMS.IntentCount {
+		log.Infof("seed of range %d has live stats %+v; replica has %+v", raftID, seedMS, ms)
+		return false
+	}
+	return true
+}
+
+// copyReplicaState copies the Raft log, Raft state and scan metadata
+// of rng from snap to batch. They belong to the replica and aren't
+// part of its backups.
+func copyReplicaState(rng *Range, snap engine.Engine, batch engine.Engine) error {
+	logPrefix := engine.RaftLogPrefix(rng.Desc.RaftID)
+	spans := []keyRange{
+		{start: engine.MVCCEncodeKey(logPrefix), end: engine.MVCCEncodeKey(logPrefix.PrefixEnd())},
+		{start: engine.MVCCEncodeKey(engine.RaftStateKey(rng.Desc.RaftID)),
+			end: engine.MVCCEncodeKey(engine.RaftStateKey(rng.Desc.RaftID).Next())},
+		{start: engine.MVCCEncodeKey(engine.RangeScanMetadataKey(rng.Desc.StartKey)),
+			end: engine.MVCCEncodeKey(engine.RangeScanMetadataKey(rng.Desc.StartKey).Next())},
+	}
+	for _, span := range spans {
+		if err := snap.Iterate(span.start, span.end, func(kv proto.RawKeyValue) (bool, error) {
+			return false, batch.Put(kv.Key, kv.Value)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -33,8 +33,8 @@ type keyRange struct {
 // The ranges keyRange slice specifies the key ranges which comprise
 // all of the range's data.
 //
-// A rangeDataIterator provides the same API as an Engine iterator
-// with the exception of the Seek() method.
+// A rangeDataIterator provides the same API as an Engine iterator,
+// though Seek() only moves forward.
 type rangeDataIterator struct {
 	curIndex int
 	ranges   []keyRange
@@ -42,25 +42,13 @@ type rangeDataIterator struct {
 }
 
 func newRangeDataIterator(r *Range, e engine.Engine) *rangeDataIterator {
-	startKey := r.Desc.StartKey
-	if startKey.Equal(engine.KeyMin) {
-		startKey = engine.KeyLocalMax
-	}
 	ri := &rangeDataIterator{
-		ranges: []keyRange{
+		ranges: append([]keyRange{
 			{
 				start: engine.MVCCEncodeKey(engine.MakeKey(engine.KeyLocalRangeIDPrefix, encoding.EncodeInt(nil, r.Desc.RaftID))),
 				end:   engine.MVCCEncodeKey(engine.MakeKey(engine.KeyLocalRangeIDPrefix, encoding.EncodeInt(nil, r.Desc.RaftID+1))),
 			},
-			{
-				start: engine.MVCCEncodeKey(engine.MakeKey(engine.KeyLocalRangeKeyPrefix, encoding.EncodeBinary(nil, r.Desc.StartKey))),
-				end:   engine.MVCCEncodeKey(engine.MakeKey(engine.KeyLocalRangeKeyPrefix, encoding.EncodeBinary(nil, r.Desc.EndKey))),
-			},
-			{
-				start: engine.MVCCEncodeKey(startKey),
-				end:   engine.MVCCEncodeKey(r.Desc.EndKey),
-			},
-		},
+		}, rangeKeyRanges(r.Desc)...),
 		iter: e.NewIterator(),
 	}
 	ri.iter.Seek(ri.ranges[ri.curIndex].start)
@@ -68,6 +56,43 @@ func newRangeDataIterator(r *Range, e engine.Engine) *rangeDataIterator {
 	return ri
 }
 
+// rangeKeyRanges returns the key ranges of the range-local data and
+// the user data of the range described by desc, which, unlike the
+// range's metadata indexed by Raft ID, are addressed by key.
+func rangeKeyRanges(desc *proto.RangeDescriptor) []keyRange {
+	startKey := desc.StartKey
+	if startKey.Equal(engine.KeyMin) {
+		startKey = engine.KeyLocalMax
+	}
+	return []keyRange{
+		{
+			start: engine.MVCCEncodeKey(engine.MakeKey(engine.KeyLocalRangeKeyPrefix, encoding.EncodeBinary(nil, desc.StartKey))),
+			end:   engine.MVCCEncodeKey(engine.MakeKey(engine.KeyLocalRangeKeyPrefix, encoding.EncodeBinary(nil, desc.EndKey))),
+		},
+		{
+			start: engine.MVCCEncodeKey(startKey),
+			end:   engine.MVCCEncodeKey(desc.EndKey),
+		},
+	}
+}
+
+// Seek advances the iterator to the first key at or after key, which
+// must not precede the current key.
+func (ri *rangeDataIterator) Seek(key proto.EncodedKey) {
+	for ri.curIndex < len(ri.ranges) && !key.Less(ri.ranges[ri.curIndex].end) {
+		ri.curIndex++
+	}
+	if ri.curIndex == len(ri.ranges) {
+		ri.iter.Seek(engine.MVCCEncodeKey(engine.KeyMax))
+		return
+	}
+	if key.Less(ri.ranges[ri.curIndex].start) {
+		key = ri.ranges[ri.curIndex].start
+	}
+	ri.iter.Seek(key)
+	ri.advance()
+}
+
 // Close closes the underlying iterator.
 func (ri *rangeDataIterator) Close() {
 	ri.curIndex = len(ri.ranges)
@@ -0,0 +1,140 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// loadHalfLife is the half life of the exponentially decaying rates
+// used to track range load. Shorter half lives react faster to load
+// changes but are noisier.
+const loadHalfLife = 30 * time.Second
+
+// A decayingRate tracks an exponentially weighted per-second rate of
+// events. The weight of an event halves every halfLife.
+type decayingRate struct {
+	halfLife time.Duration
+	sum      float64 // Decayed sum of events as of last
+	last     int64   // Time of last update in nanoseconds
+}
+
+// decay decays the accumulated sum to time now.
+func (d *decayingRate) decay(now int64) {
+	if now > d.last {
+		d.sum *= math.Exp(-math.Ln2 * float64(now-d.last) / float64(d.halfLife))
+		d.last = now
+	}
+}
+
+// add records n events at time now.
+func (d *decayingRate) add(now int64, n float64) {
+	d.decay(now)
+	d.sum += n
+}
+
+// rate returns the per-second rate at time now. Under a steady rate
+// r, the decayed sum converges to r*halfLife/ln(2).
+func (d *decayingRate) rate(now int64) float64 {
+	d.decay(now)
+	return d.sum * math.Ln2 / d.halfLife.Seconds()
+}
+
+// rangeLoad tracks the request rate and request/response throughput
+// of a range. It is safe for concurrent use.
+type rangeLoad struct {
+	sync.Mutex
+	qps   decayingRate
+	bytes decayingRate
+}
+
+func newRangeLoad() *rangeLoad {
+	return &rangeLoad{
+		qps:   decayingRate{halfLife: loadHalfLife},
+		bytes: decayingRate{halfLife: loadHalfLife},
+	}
+}
+
+// record records a request of the specified size at time now.
+func (rl *rangeLoad) record(now int64, bytes int) {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.qps.add(now, 1)
+	rl.bytes.add(now, float64(bytes))
+}
+
+// rates returns the requests and bytes per second at time now.
+func (rl *rangeLoad) rates(now int64) (qps, bytesPerSec float64) {
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.qps.rate(now), rl.bytes.rate(now)
+}
+
+// A HotRange describes the load on a range.
+type HotRange struct {
+	RaftID      int64
+	StartKey    proto.Key
+	EndKey      proto.Key
+	QPS         float64
+	BytesPerSec float64
+}
+
+// Load returns the range's decaying requests and bytes per second.
+func (r *Range) Load() (qps, bytesPerSec float64) {
+	return r.load.rates(r.rm.Clock().PhysicalNow())
+}
+
+type hotRanges []HotRange
+
+func (hr hotRanges) Len() int      { return len(hr) }
+func (hr hotRanges) Swap(i, j int) { hr[i], hr[j] = hr[j], hr[i] }
+func (hr hotRanges) Less(i, j int) bool {
+	if hr[i].QPS != hr[j].QPS {
+		return hr[i].QPS > hr[j].QPS
+	}
+	return hr[i].BytesPerSec > hr[j].BytesPerSec
+}
+
+// HotRanges returns up to n of the store's ranges with the highest
+// request rates, in descending order. If n is non-positive, all ranges
+// are returned.
+func (s *Store) HotRanges(n int) []HotRange {
+	s.mu.RLock()
+	var result hotRanges
+	for _, rng := range s.ranges {
+		qps, bytesPerSec := rng.Load()
+		rng.RLock()
+		result = append(result, HotRange{
+			RaftID:      rng.Desc.RaftID,
+			StartKey:    rng.Desc.StartKey,
+			EndKey:      rng.Desc.EndKey,
+			QPS:         qps,
+			BytesPerSec: bytesPerSec,
+		})
+		rng.RUnlock()
+	}
+	s.mu.RUnlock()
+	sort.Sort(result)
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// TestDecayingRate verifies that a steady rate converges and that the
+// rate halves every half life once events stop.
+func TestDecayingRate(t *testing.T) {
+	d := decayingRate{halfLife: time.Second}
+	var now int64
+	// Add 100 events per second for 20 half lives.
+	for i := 0; i < 2000; i++ {
+		now += (10 * time.Millisecond).Nanoseconds()
+		d.add(now, 1)
+	}
+	if r := d.rate(now); math.Abs(r-100) > 5 {
+		t.Errorf("expected rate ~100; got %f", r)
+	}
+	before := d.rate(now)
+	now += time.Second.Nanoseconds()
+	if r := d.rate(now); math.Abs(r-before/2) > 0.01 {
+		t.Errorf("expected rate to halve to %f; got %f", before/2, r)
+	}
+}
+
+// TestStoreHotRanges verifies that requests are reflected in the
+// load of the range which served them.
+func TestStoreHotRanges(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	if hot := store.HotRanges(0); len(hot) != 1 || hot[0].QPS != 0 {
+		t.Fatalf("expected a single idle range; got %+v", hot)
+	}
+	for i := 0; i < 10; i++ {
+		pArgs, pReply := putArgs([]byte("a"), []byte("value"), 1, store.StoreID())
+		if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hot := store.HotRanges(1)
+	if len(hot) != 1 || hot[0].RaftID != 1 {
+		t.Fatalf("expected range 1; got %+v", hot)
+	}
+	if hot[0].QPS <= 0 || hot[0].BytesPerSec <= 0 {
+		t.Errorf("expected non-zero load; got %+v", hot[0])
+	}
+}
+
+// TestHotRangesOrder verifies hot ranges sort by descending request
+// rate, then bytes.
+func TestHotRangesOrder(t *testing.T) {
+	hr := hotRanges{
+		{RaftID: 1, QPS: 1, BytesPerSec: 10},
+		{RaftID: 2, QPS: 5, BytesPerSec: 1},
+		{RaftID: 3, QPS: 1, BytesPerSec: 20},
+	}
+	sort.Sort(hr)
+	for i, expID := range []int64{2, 3, 1} {
+		if hr[i].RaftID != expID {
+			t.Errorf("%d: expected range %d; got %d", i, expID, hr[i].RaftID)
+		}
+	}
+}
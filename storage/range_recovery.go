@@ -0,0 +1,146 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A RangeResurrection describes the rewrite of a range's descriptor
+// by ResurrectRange.
+type RangeResurrection struct {
+	Old, New *proto.RangeDescriptor
+	StoreID  int32       // Store holding the surviving replica
+	Updated  []proto.Key // Addressing records rewritten
+	Skipped  []proto.Key // Addressing records with no local replica
+}
+
+// ResurrectRange rewrites the descriptor of the range with the
+// specified Raft ID so that its replica in one of the supplied
+// engines becomes the range's only replica. This makes the data of a
+// range which has permanently lost quorum accessible again, at the
+// cost of losing any writes which the surviving replica did not see.
+// It must only be run against the engines of a stopped node and is
+// inherently unsafe: the other replicas must never be brought back.
+//
+// The range's addressing records are rewritten in those engines which
+// hold a replica of the range containing them; the rest are reported
+// as skipped and must be rebuilt on the nodes holding them, for
+// example with RecoverMetaAddressing. If dryRun is true, nothing is
+// written.
+func ResurrectRange(engines []engine.Engine, raftID int64, now proto.Timestamp, dryRun bool) (*RangeResurrection, error) {
+	var res *RangeResurrection
+	var survivor localReplica
+	descs := map[engine.Engine][]*proto.RangeDescriptor{}
+	idents := map[engine.Engine]proto.StoreIdent{}
+	for i, e := range engines {
+		var ident proto.StoreIdent
+		ok, err := engine.MVCCGetProto(e, engine.StoreIdentKey(), proto.ZeroTimestamp, nil, &ident)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, util.Errorf("engine %d is not bootstrapped", i)
+		}
+		if descs[e], err = ReadRangeDescriptors(e); err != nil {
+			return nil, util.Errorf("unable to read range descriptors of store %d: %s", ident.StoreID, err)
+		}
+		idents[e] = ident
+		for _, desc := range descs[e] {
+			if desc.RaftID != raftID {
+				continue
+			}
+			if res != nil {
+				return nil, util.Errorf("range %d has replicas on stores %d and %d; remove all but one",
+					raftID, res.StoreID, ident.StoreID)
+			}
+			res = &RangeResurrection{Old: desc, StoreID: ident.StoreID}
+			survivor = localReplica{engine: e, storeID: ident.StoreID}
+		}
+	}
+	if res == nil {
+		return nil, util.Errorf("no replica of range %d found", raftID)
+	}
+
+	newDesc := *res.Old
+	replica := res.Old.FindReplica(res.StoreID)
+	if replica == nil {
+		replica = &proto.Replica{NodeID: idents[survivor.engine].NodeID, StoreID: res.StoreID}
+	}
+	newDesc.Replicas = []proto.Replica{*replica}
+	res.New = &newDesc
+
+	// Batch the writes to each local replica; the first batch holds the
+	// surviving replica's new descriptor.
+	type replicaBatch struct {
+		replica localReplica
+		raftID  int64
+		batch   engine.Engine
+		ms      *engine.MVCCStats
+	}
+	var batches []*replicaBatch
+	getBatch := func(r localReplica, raftID int64) *replicaBatch {
+		for _, b := range batches {
+			if b.replica == r && b.raftID == raftID {
+				return b
+			}
+		}
+		b := &replicaBatch{replica: r, raftID: raftID, batch: r.engine.NewBatch(), ms: &engine.MVCCStats{}}
+		batches = append(batches, b)
+		return b
+	}
+	getBatch(survivor, raftID)
+	if err := engine.MVCCPutProto(batches[0].batch, batches[0].ms, engine.RangeDescriptorKey(newDesc.StartKey), now, nil, res.New); err != nil {
+		return nil, util.Errorf("unable to rewrite descriptor of range %d: %s", raftID, err)
+	}
+
+	keys, err := rangeAddressingKeys(res.New)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		var found bool
+		for _, e := range engines {
+			for _, desc := range descs[e] {
+				if !desc.ContainsKey(key) {
+					continue
+				}
+				b := getBatch(localReplica{engine: e, storeID: idents[e].StoreID}, desc.RaftID)
+				if err := engine.MVCCPutProto(b.batch, b.ms, key, now, nil, res.New); err != nil {
+					return nil, util.Errorf("unable to rewrite addressing record %q on store %d: %s",
+						key, idents[e].StoreID, err)
+				}
+				found = true
+			}
+		}
+		if found {
+			res.Updated = append(res.Updated, key)
+		} else {
+			res.Skipped = append(res.Skipped, key)
+		}
+	}
+	if dryRun {
+		return res, nil
+	}
+	for _, b := range batches {
+		b.ms.MergeStats(b.batch, b.raftID, b.replica.storeID)
+		if err := b.batch.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
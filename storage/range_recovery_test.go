@@ -0,0 +1,75 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestResurrectRange verifies that a range which lost quorum is
+// rewritten to a single replica on the surviving store, along with
+// its addressing records.
+func TestResurrectRange(t *testing.T) {
+	store, _ := createTestStore(t)
+	desc := *store.LookupRange(engine.KeyMin, nil).Desc
+	store.Stop()
+	eng := store.Engine()
+
+	// Add two replicas on other nodes to the first range.
+	desc.Replicas = append(desc.Replicas,
+		proto.Replica{NodeID: 2, StoreID: 2},
+		proto.Replica{NodeID: 3, StoreID: 3})
+	metaKeys := []proto.Key{
+		engine.RangeDescriptorKey(engine.KeyMin),
+		engine.MakeKey(engine.KeyMeta2Prefix, engine.KeyMax),
+		engine.MakeKey(engine.KeyMeta1Prefix, engine.KeyMax),
+	}
+	now := store.clock.Now()
+	for _, key := range metaKeys {
+		if err := engine.MVCCPutProto(eng, nil, key, now, nil, &desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ResurrectRange([]engine.Engine{eng}, 2, store.clock.Now(), false); err == nil {
+		t.Error("expected error resurrecting unknown range")
+	}
+	now = store.clock.Now()
+	res, err := ResurrectRange([]engine.Engine{eng}, 1, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expReplicas := []proto.Replica{{NodeID: 1, StoreID: 1}}
+	if res.StoreID != 1 || !reflect.DeepEqual(res.New.Replicas, expReplicas) {
+		t.Errorf("expected single replica on store 1; got %+v", res)
+	}
+	if !reflect.DeepEqual(res.Updated, metaKeys[1:]) || len(res.Skipped) != 0 {
+		t.Errorf("expected addressing records %q updated; got %q, skipped %q", metaKeys[1:], res.Updated, res.Skipped)
+	}
+	for _, key := range metaKeys {
+		readDesc := &proto.RangeDescriptor{}
+		if ok, err := engine.MVCCGetProto(eng, key, now, nil, readDesc); !ok || err != nil {
+			t.Fatalf("unable to read %q: %t, %v", key, ok, err)
+		}
+		if !reflect.DeepEqual(readDesc.Replicas, expReplicas) {
+			t.Errorf("expected %q to have replicas %+v; got %+v", key, expReplicas, readDesc.Replicas)
+		}
+	}
+}
@@ -77,6 +77,8 @@ type testContext struct {
 	engine      engine.Engine
 	manualClock *hlc.ManualClock
 	clock       *hlc.Clock
+	// raftIntercept, if not nil, intercepts committed Raft commands.
+	raftIntercept raftInterceptor
 }
 
 // testContext.Start initializes the test context with a single range covering the
@@ -98,6 +100,7 @@ func (tc *testContext) Start(t *testing.T) {
 
 	if tc.store == nil {
 		tc.store = NewStore(tc.clock, tc.engine, nil, tc.gossip)
+		tc.store.raftIntercept = tc.raftIntercept
 		if err := tc.store.Bootstrap(proto.StoreIdent{StoreID: 1}); err != nil {
 			t.Fatal(err)
 		}
@@ -249,7 +252,7 @@ func TestRangeGossipConfigWithMultipleKeyPrefixes(t *testing.T) {
 	}
 	reply := &proto.PutResponse{}
 
-	if err := tc.rng.executeCmd(proto.Put, req, reply); err != nil {
+	if err := tc.rng.executeCmd(proto.Put, req, reply, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -290,7 +293,7 @@ func TestRangeGossipConfigUpdates(t *testing.T) {
 	}
 	reply := &proto.PutResponse{}
 
-	if err := tc.rng.executeCmd(proto.Put, req, reply); err != nil {
+	if err := tc.rng.executeCmd(proto.Put, req, reply, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -592,6 +595,40 @@ func TestRangeUpdateTSCache(t *testing.T) {
 	}
 }
 
+// TestRangeLeadershipAdvancesTSCache verifies that a replica taking up
+// leadership pushes writes beneath the start of its leadership, as
+// the previous leader may have served reads up to then.
+func TestRangeLeadershipAdvancesTSCache(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+	// Simulate a replica which deferred to another leader until 2s.
+	tc.rng.Lock()
+	tc.rng.leading = false
+	tc.rng.Unlock()
+	t0 := 2 * time.Second
+	tc.manualClock.Set(t0.Nanoseconds())
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("1"), 1, tc.store.StoreID())
+	pArgs.Timestamp = proto.Timestamp{WallTime: time.Second.Nanoseconds()}
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if pReply.Timestamp.WallTime < t0.Nanoseconds() {
+		t.Errorf("expected write timestamp to advance past 2s; got %s", pReply.Timestamp)
+	}
+
+	// Once leading, writes at earlier timestamps aren't pushed.
+	pArgs, pReply = putArgs([]byte("b"), []byte("1"), 1, tc.store.StoreID())
+	pArgs.Timestamp = proto.Timestamp{WallTime: t0.Nanoseconds() + 1}
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if !pReply.Timestamp.Equal(pArgs.Timestamp) {
+		t.Errorf("expected timestamp not to advance %s != %s", pReply.Timestamp, pArgs.Timestamp)
+	}
+}
+
 // TestRangeCommandQueue verifies that reads/writes must wait for
 // pending commands to complete through Raft before being executed on
 // range.
@@ -882,6 +919,34 @@ func TestEndTransactionBeforeHeartbeat(t *testing.T) {
 	}
 }
 
+// TestEndTransactionDeadline verifies that a transaction can't commit
+// at a timestamp exceeding the deadline of the commit.
+func TestEndTransactionDeadline(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	for i, exceeded := range []bool{true, false} {
+		key := proto.Key(fmt.Sprintf("a%d", i))
+		txn := newTransaction("test", key, 1, proto.SERIALIZABLE, tc.clock)
+		args, reply := endTxnArgs(txn, true, 1, tc.store.StoreID())
+		args.Timestamp = txn.Timestamp
+		deadline := txn.Timestamp
+		if exceeded {
+			deadline.WallTime--
+		}
+		args.Deadline = &deadline
+		err := tc.rng.AddCmd(proto.EndTransaction, args, reply, true)
+		if exceeded {
+			if _, ok := err.(*proto.TransactionStatusError); !ok {
+				t.Errorf("%d: expected TransactionStatusError; got %v", i, err)
+			}
+		} else if err != nil || reply.Txn.Status != proto.COMMITTED {
+			t.Errorf("%d: expected commit at the deadline; got %v, %+v", i, err, reply.Txn)
+		}
+	}
+}
+
 // TestEndTransactionAfterHeartbeat verifies that a transaction
 // can be committed/aborted after being heartbeat.
 func TestEndTransactionAfterHeartbeat(t *testing.T) {
@@ -1459,6 +1524,51 @@ func TestRangeStats(t *testing.T) {
 	verifyRangeStats(tc.engine, tc.rng.Desc.RaftID, expMS, t)
 }
 
+// TestRangeResponseStats verifies that execution statistics are
+// returned only if requested and count the keys, bytes and intents
+// read by a command.
+func TestRangeResponseStats(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	// Put a value and an intent.
+	pArgs, pReply := putArgs([]byte("a"), []byte("value1"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	pArgs.ReturnStats = true
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if pReply.Stats == nil {
+		t.Error("expected stats for put")
+	}
+	pArgs, pReply = putArgs([]byte("b"), []byte("value2"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	pArgs.Txn = &proto.Transaction{ID: []byte("txn1"), Timestamp: pArgs.Timestamp}
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if pReply.Stats != nil {
+		t.Errorf("expected no stats unless requested; got %+v", pReply.Stats)
+	}
+
+	sArgs, sReply := scanArgs([]byte("a"), []byte("c"), 1, tc.store.StoreID())
+	sArgs.Timestamp = pArgs.Timestamp
+	sArgs.Txn = pArgs.Txn
+	sArgs.ReturnStats = true
+	if err := tc.rng.AddCmd(proto.Scan, sArgs, sReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(sReply.Rows) != 2 {
+		t.Fatalf("expected 2 rows; got %d", len(sReply.Rows))
+	}
+	// Each key has a metadata record and a single version.
+	stats := sReply.Stats
+	if stats == nil || stats.KeysScanned < 4 || stats.BytesRead == 0 || stats.IntentsEncountered != 1 || stats.RaftNanos != 0 {
+		t.Errorf("expected at least 4 keys scanned and 1 intent encountered; got %+v", stats)
+	}
+}
+
 // TestInternalMerge verifies that the InternalMerge command is behaving as
 // expected. Merge semantics for different data types are tested more robustly
 // at the engine level; this test is intended only to show that values passed to
@@ -1515,7 +1625,7 @@ func TestConditionFailedError(t *testing.T) {
 	key := []byte("k")
 	value := []byte("quack")
 	pArgs, pReply := putArgs(key, value, 1, tc.store.StoreID())
-	if err := tc.rng.executeCmd(proto.Put, pArgs, pReply); err != nil {
+	if err := tc.rng.executeCmd(proto.Put, pArgs, pReply, nil); err != nil {
 		t.Fatal(err)
 	}
 	args := &proto.ConditionalPutRequest{
@@ -1533,7 +1643,7 @@ func TestConditionFailedError(t *testing.T) {
 		},
 	}
 	reply := &proto.ConditionalPutResponse{}
-	err := tc.rng.executeCmd(proto.ConditionalPut, args, reply)
+	err := tc.rng.executeCmd(proto.ConditionalPut, args, reply, nil)
 	if cErr, ok := err.(*proto.ConditionFailedError); err == nil || !ok {
 		t.Fatalf("expected ConditionFailedError, got %T with content %+v",
 			err, err)
@@ -1542,3 +1652,763 @@ func TestConditionFailedError(t *testing.T) {
 			value, v)
 	}
 }
+
+// TestRangeRaftIntercept verifies that committed Raft commands are
+// passed to the test context's interceptor before being applied.
+func TestRangeRaftIntercept(t *testing.T) {
+	var mu sync.Mutex
+	var puts int
+	tc := testContext{
+		raftIntercept: func(cc committedCommand) bool {
+			if _, ok := cc.cmd.Cmd.GetValue().(*proto.PutRequest); ok {
+				mu.Lock()
+				puts++
+				mu.Unlock()
+			}
+			return true
+		},
+	}
+	tc.Start(t)
+	defer tc.Stop()
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if puts != 1 {
+		t.Errorf("expected interceptor to see 1 put; got %d", puts)
+	}
+}
+
+// TestRangeRaftInterceptDrop verifies that a command dropped by the
+// test context's interceptor fails its waiting request rather than
+// blocking it, and is not applied.
+func TestRangeRaftInterceptDrop(t *testing.T) {
+	tc := testContext{
+		raftIntercept: func(cc committedCommand) bool {
+			put, ok := cc.cmd.Cmd.GetValue().(*proto.PutRequest)
+			return !ok || string(put.Key) != "drop"
+		},
+	}
+	tc.Start(t)
+	defer tc.Stop()
+
+	pArgs, pReply := putArgs([]byte("drop"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err == nil {
+		t.Fatal("expected dropped command to fail")
+	}
+
+	gArgs, gReply := getArgs([]byte("drop"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value != nil {
+		t.Errorf("expected dropped put not to be applied; got %+v", gReply.Value)
+	}
+}
+
+// TestRangeCommandChecksum verifies that a command altered between
+// proposal and application fails its result checksum with a
+// ReplicaCorruptionError and is not applied.
+func TestRangeCommandChecksum(t *testing.T) {
+	tc := testContext{
+		raftIntercept: func(cc committedCommand) bool {
+			if put, ok := cc.cmd.Cmd.GetValue().(*proto.PutRequest); ok && string(put.Key) == "b" {
+				put.Value.Bytes = []byte("corrupt")
+			}
+			return true
+		},
+	}
+	tc.Start(t)
+	defer tc.Stop()
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+
+	pArgs, pReply = putArgs([]byte("b"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true)
+	if _, ok := err.(*proto.ReplicaCorruptionError); !ok {
+		t.Fatalf("expected replica corruption error; got %v", err)
+	}
+
+	gArgs, gReply := getArgs([]byte("b"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value != nil {
+		t.Errorf("expected corrupted put not to be applied; got %+v", gReply.Value)
+	}
+}
+
+// TestRangeResultChecksumDivergence verifies that a command whose
+// result on the applying replica differs from its result when it was
+// proposed, as when the replica's state has diverged, fails with a
+// ReplicaCorruptionError and is not applied.
+func TestRangeResultChecksumDivergence(t *testing.T) {
+	var tc testContext
+	tc.raftIntercept = func(cc committedCommand) bool {
+		if cput, ok := cc.cmd.Cmd.GetValue().(*proto.ConditionalPutRequest); ok {
+			// Diverge the replica's state behind the command's back.
+			if err := engine.MVCCPut(tc.engine, nil, cput.Key, cput.Timestamp.Prev(),
+				proto.Value{Bytes: []byte("diverged")}, nil); err != nil {
+				t.Error(err)
+			}
+		}
+		return true
+	}
+	tc.Start(t)
+	defer tc.Stop()
+
+	args := &proto.ConditionalPutRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:       proto.Key("a"),
+			Timestamp: tc.clock.Now(),
+			RaftID:    1,
+			Replica:   proto.Replica{StoreID: tc.store.StoreID()},
+		},
+		Value: proto.Value{Bytes: []byte("value")},
+	}
+	err := tc.rng.AddCmd(proto.ConditionalPut, args, &proto.ConditionalPutResponse{}, true)
+	if _, ok := err.(*proto.ReplicaCorruptionError); !ok {
+		t.Fatalf("expected replica corruption error; got %v", err)
+	}
+
+	gArgs, gReply := getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || string(gReply.Value.Bytes) != "diverged" {
+		t.Errorf("expected the conditional put not to be applied; got %+v", gReply.Value)
+	}
+}
+
+// TestRangeResultChecksumStats verifies that the result checksum of a
+// command which returns stats covers its writes, so that the command
+// is applied.
+func TestRangeResultChecksumStats(t *testing.T) {
+	var checksum uint32
+	tc := testContext{
+		raftIntercept: func(cc committedCommand) bool {
+			if _, ok := cc.cmd.Cmd.GetValue().(*proto.ConditionalPutRequest); ok {
+				checksum = cc.cmd.Checksum
+			}
+			return true
+		},
+	}
+	tc.Start(t)
+	defer tc.Stop()
+
+	args := &proto.ConditionalPutRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:         proto.Key("a"),
+			Timestamp:   tc.clock.Now(),
+			RaftID:      1,
+			Replica:     proto.Replica{StoreID: tc.store.StoreID()},
+			ReturnStats: true,
+		},
+		Value: proto.Value{Bytes: []byte("value")},
+	}
+	reply := &proto.ConditionalPutResponse{}
+	if err := tc.rng.AddCmd(proto.ConditionalPut, args, reply, true); err != nil {
+		t.Fatal(err)
+	}
+	if checksum == 0 {
+		t.Error("expected the conditional put to be proposed with a checksum")
+	}
+	if reply.Stats == nil {
+		t.Error("expected stats for the conditional put")
+	}
+
+	gArgs, gReply := getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || string(gReply.Value.Bytes) != "value" {
+		t.Errorf("expected the conditional put to be applied; got %+v", gReply.Value)
+	}
+}
+
+// TestRangeReproposalReplay verifies that a command proposed again
+// after it has been applied is skipped rather than applied twice.
+func TestRangeReproposalReplay(t *testing.T) {
+	var mu sync.Mutex
+	var incs []committedCommand
+	tc := testContext{
+		raftIntercept: func(cc committedCommand) bool {
+			if _, ok := cc.cmd.Cmd.GetValue().(*proto.IncrementRequest); ok {
+				mu.Lock()
+				incs = append(incs, cc)
+				mu.Unlock()
+			}
+			return true
+		},
+	}
+	tc.Start(t)
+	defer tc.Stop()
+
+	iArgs, iReply := incrementArgs([]byte("a"), 1, 1, tc.store.StoreID())
+	iArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Increment, iArgs, iReply, true); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	replay := incs[0]
+	mu.Unlock()
+	if replay.cmd.MaxLeaseIndex == 0 {
+		t.Fatal("expected command to be assigned a lease index")
+	}
+	tc.store.ProposeRaftCommand(replay.cmdIDKey, replay.cmd)
+
+	// The replay is committed before this increment, which is
+	// proposed after it.
+	iArgs, iReply = incrementArgs([]byte("a"), 1, 1, tc.store.StoreID())
+	iArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Increment, iArgs, iReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if iReply.NewValue != 2 {
+		t.Errorf("expected replayed increment to be skipped; got value %d", iReply.NewValue)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(incs) != 3 {
+		t.Errorf("expected 3 committed increments; got %d", len(incs))
+	}
+}
+
+// TestRangeInlineValues verifies that inline puts and increments
+// replace the value in place rather than adding versions, that inline
+// values are readable at any timestamp and that transactional inline
+// writes are rejected.
+func TestRangeInlineValues(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	key := proto.Key("a")
+	for i := 0; i < 3; i++ {
+		pArgs, pReply := putArgs(key, []byte(fmt.Sprintf("value%d", i)), 1, tc.store.StoreID())
+		pArgs.Timestamp = tc.clock.Now()
+		pArgs.Inline = true
+		if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := engine.MVCCGetVersions(tc.engine, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || !versions[0].Timestamp.Equal(proto.ZeroTimestamp) {
+		t.Fatalf("expected a single inline version; got %+v", versions)
+	}
+	gArgs, gReply := getArgs(key, 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || !bytes.Equal(gReply.Value.Bytes, []byte("value2")) {
+		t.Errorf("expected value2; got %+v", gReply.Value)
+	}
+
+	// A versioned write to an inline key fails.
+	pArgs, pReply := putArgs(key, []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err == nil {
+		t.Error("expected versioned put to inline key to fail")
+	}
+
+	// Inline increments.
+	for i := int64(1); i <= 2; i++ {
+		iArgs, iReply := incrementArgs([]byte("b"), 1, 1, tc.store.StoreID())
+		iArgs.Timestamp = tc.clock.Now()
+		iArgs.Inline = true
+		if err := tc.rng.AddCmd(proto.Increment, iArgs, iReply, true); err != nil {
+			t.Fatal(err)
+		}
+		if iReply.NewValue != i {
+			t.Errorf("expected %d; got %d", i, iReply.NewValue)
+		}
+	}
+	if versions, err = engine.MVCCGetVersions(tc.engine, proto.Key("b")); err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 1 {
+		t.Errorf("expected a single inline version; got %+v", versions)
+	}
+
+	// Transactional inline writes are rejected.
+	pArgs, pReply = putArgs(proto.Key("c"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Txn = newTransaction("test", proto.Key("c"), 1, proto.SERIALIZABLE, tc.clock)
+	pArgs.Timestamp = pArgs.Txn.Timestamp
+	pArgs.Inline = true
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err == nil {
+		t.Error("expected transactional inline put to fail")
+	}
+
+	// An inline delete clears the value.
+	dArgs, dReply := deleteArgs(key, 1, tc.store.StoreID())
+	dArgs.Timestamp = tc.clock.Now()
+	dArgs.Inline = true
+	if err := tc.rng.AddCmd(proto.Delete, dArgs, dReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err = engine.MVCCGetVersions(tc.engine, key); err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 0 {
+		t.Errorf("expected inline value to be cleared; got %+v", versions)
+	}
+}
+
+// TestRangeLeaseAppliedIndexPersisted verifies that the lease applied
+// index is persisted along with each applied command, including
+// commands which fail.
+func TestRangeLeaseAppliedIndexPersisted(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	persisted := func() uint64 {
+		v, err := engine.MVCCGet(tc.engine, engine.RangeLeaseAppliedIndexKey(tc.rng.Desc.RaftID), proto.ZeroTimestamp, nil)
+		if err != nil || v == nil {
+			t.Fatalf("unable to read lease applied index: %v, %v", v, err)
+		}
+		return uint64(v.GetInteger())
+	}
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	index := persisted()
+	if index == 0 {
+		t.Fatal("expected a lease applied index to be persisted")
+	}
+
+	// Incrementing a non-integer value fails.
+	iArgs, iReply := incrementArgs([]byte("a"), 1, 1, tc.store.StoreID())
+	iArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Increment, iArgs, iReply, true); err == nil {
+		t.Fatal("expected increment of a non-integer value to fail")
+	}
+	if next := persisted(); next != index+1 {
+		t.Errorf("expected lease applied index %d after the failed command; got %d", index+1, next)
+	}
+}
+
+// TestRangeInconsistentReads verifies that inconsistent reads skip
+// write intents and return the most recent committed values, and
+// that they are rejected by read/write commands and transactions.
+func TestRangeInconsistentReads(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	// Put a committed value at "a", and intents at "a" and "b".
+	pArgs, pReply := putArgs([]byte("a"), []byte("value1"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	txn := newTransaction("test", proto.Key("a"), 1, proto.SERIALIZABLE, tc.clock)
+	for _, key := range []string{"a", "b"} {
+		pArgs, pReply = putArgs([]byte(key), []byte("value2"), 1, tc.store.StoreID())
+		pArgs.Timestamp = txn.Timestamp
+		pArgs.Txn = txn
+		if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gArgs, gReply := getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err == nil {
+		t.Error("expected write intent error on consistent read")
+	}
+	gArgs, gReply = getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	gArgs.ReadConsistency = proto.INCONSISTENT
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || !bytes.Equal(gReply.Value.Bytes, []byte("value1")) {
+		t.Errorf("expected committed value1; got %+v", gReply.Value)
+	}
+
+	sArgs, sReply := scanArgs([]byte("a"), []byte("c"), 1, tc.store.StoreID())
+	sArgs.Timestamp = tc.clock.Now()
+	sArgs.ReadConsistency = proto.INCONSISTENT
+	if err := tc.rng.AddCmd(proto.Scan, sArgs, sReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(sReply.Rows) != 1 || !bytes.Equal(sReply.Rows[0].Value.Bytes, []byte("value1")) {
+		t.Errorf("expected only committed value1; got %+v", sReply.Rows)
+	}
+
+	// Inconsistent writes and transactional reads are rejected.
+	pArgs, pReply = putArgs([]byte("c"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	pArgs.ReadConsistency = proto.INCONSISTENT
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err == nil {
+		t.Error("expected error on inconsistent put")
+	}
+	gArgs, gReply = getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = txn.Timestamp
+	gArgs.Txn = txn
+	gArgs.ReadConsistency = proto.INCONSISTENT
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err == nil {
+		t.Error("expected error on inconsistent read within a transaction")
+	}
+}
+
+// TestRangeNonVoterReads verifies that non-voting replicas serve
+// inconsistent reads and reject all other commands.
+func TestRangeNonVoterReads(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	// Copy the descriptor, which is shared by tests.
+	tc.rng.Lock()
+	desc := *tc.rng.Desc
+	desc.Replicas = append([]proto.Replica(nil), desc.Replicas...)
+	desc.Replicas[0].NonVoter = true
+	tc.rng.Desc = &desc
+	tc.rng.Unlock()
+	if !tc.rng.IsNonVoter() {
+		t.Fatal("expected range replica to be a non-voter")
+	}
+
+	gArgs, gReply := getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err == nil {
+		t.Error("expected error on consistent read from non-voter")
+	} else if _, ok := err.(*proto.NotLeaderError); !ok {
+		t.Errorf("expected not leader error; got %s", err)
+	}
+	pArgs, pReply = putArgs([]byte("b"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err == nil {
+		t.Error("expected error on write to non-voter")
+	}
+	gArgs, gReply = getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	gArgs.ReadConsistency = proto.INCONSISTENT
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || !bytes.Equal(gReply.Value.Bytes, []byte("value")) {
+		t.Errorf("expected value; got %+v", gReply.Value)
+	}
+}
+
+// TestRangeBoundedStalenessReads verifies that bounded staleness
+// reads are served just below conflicting write intents if within
+// the maximum staleness, return the chosen timestamp and otherwise
+// fail with the write intent error at the request timestamp.
+func TestRangeBoundedStalenessReads(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	// Put a committed value at "a" at 1s and an intent at 3s.
+	pArgs, pReply := putArgs([]byte("a"), []byte("value1"), 1, tc.store.StoreID())
+	pArgs.Timestamp = proto.Timestamp{WallTime: 1e9}
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+	tc.manualClock.Set(3e9)
+	txn := newTransaction("test", proto.Key("a"), 1, proto.SERIALIZABLE, tc.clock)
+	pArgs, pReply = putArgs([]byte("a"), []byte("value2"), 1, tc.store.StoreID())
+	pArgs.Timestamp = txn.Timestamp
+	pArgs.Txn = txn
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+
+	gArgs, gReply := getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = proto.Timestamp{WallTime: 5e9}
+	gArgs.ReadConsistency = proto.BOUNDED_STALENESS
+	gArgs.MaxStaleness = 4e9
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || !bytes.Equal(gReply.Value.Bytes, []byte("value1")) {
+		t.Errorf("expected committed value1; got %+v", gReply.Value)
+	}
+	if expTS := txn.Timestamp.Prev(); !gReply.Timestamp.Equal(expTS) {
+		t.Errorf("expected read at %s; got %s", expTS, gReply.Timestamp)
+	}
+
+	// The intent is older than the maximum staleness permits.
+	gArgs, gReply = getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = proto.Timestamp{WallTime: 5e9}
+	gArgs.ReadConsistency = proto.BOUNDED_STALENESS
+	gArgs.MaxStaleness = 1e9
+	err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true)
+	if _, ok := err.(*proto.WriteIntentError); !ok {
+		t.Errorf("expected write intent error; got %v", err)
+	}
+	if !gArgs.Timestamp.Equal(proto.Timestamp{WallTime: 5e9}) {
+		t.Errorf("expected request timestamp to be restored; got %s", gArgs.Timestamp)
+	}
+
+	// Bounded staleness writes are rejected.
+	pArgs, pReply = putArgs([]byte("b"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	pArgs.ReadConsistency = proto.BOUNDED_STALENESS
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err == nil {
+		t.Error("expected error on bounded staleness put")
+	}
+}
+
+// TestRangeCompareAndSet verifies that a compare-and-set writes all
+// of its puts if all conditions hold and nothing otherwise, and that
+// keys outside of the request span are rejected.
+func TestRangeCompareAndSet(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("1"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+
+	casArgs := func(expA []byte, puts ...string) (*proto.CompareAndSetRequest, *proto.CompareAndSetResponse) {
+		conds := []proto.CompareAndSetCondition{
+			{Key: proto.Key("a"), ExpValue: &proto.Value{Bytes: expA}},
+			{Key: proto.Key("b")}, // "b" must not exist
+		}
+		var kvs []proto.KeyValue
+		for _, key := range puts {
+			kvs = append(kvs, proto.KeyValue{Key: proto.Key(key), Value: proto.Value{Bytes: []byte("2")}})
+		}
+		args := proto.CompareAndSetArgs(conds, kvs)
+		args.RaftID = 1
+		args.Replica = proto.Replica{StoreID: tc.store.StoreID()}
+		args.Timestamp = tc.clock.Now()
+		return args, &proto.CompareAndSetResponse{}
+	}
+	getValue := func(key string) *proto.Value {
+		gArgs, gReply := getArgs([]byte(key), 1, tc.store.StoreID())
+		gArgs.Timestamp = tc.clock.Now()
+		if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+			t.Fatal(err)
+		}
+		return gReply.Value
+	}
+
+	// A failed condition writes nothing.
+	args, reply := casArgs([]byte("0"), "a", "c")
+	err := tc.rng.AddCmd(proto.CompareAndSet, args, reply, true)
+	if cfErr, ok := err.(*proto.ConditionFailedError); !ok || !bytes.Equal(cfErr.ActualValue.Bytes, []byte("1")) {
+		t.Errorf("expected condition failed error with actual value 1; got %v", err)
+	}
+	if val := getValue("c"); val != nil {
+		t.Errorf("expected no value written to c; got %+v", val)
+	}
+
+	args, reply = casArgs([]byte("1"), "a", "c")
+	if err := tc.rng.AddCmd(proto.CompareAndSet, args, reply, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if val := getValue(key); val == nil || !bytes.Equal(val.Bytes, []byte("2")) {
+			t.Errorf("expected value 2 written to %s; got %+v", key, val)
+		}
+	}
+
+	// Keys outside of the request span are rejected.
+	args, reply = casArgs([]byte("2"), "c")
+	args.Puts = append(args.Puts, proto.KeyValue{Key: proto.Key("d"), Value: proto.Value{Bytes: []byte("3")}})
+	if err := tc.rng.AddCmd(proto.CompareAndSet, args, reply, true); err == nil {
+		t.Error("expected error writing key outside of request span")
+	}
+}
+
+// TestRangeFreeze verifies that a frozen range serves reads but
+// blocks writes until unfrozen, that freezing and unfreezing are
+// proposed through Raft, and that the frozen state is reloaded with
+// the range.
+func TestRangeFreeze(t *testing.T) {
+	var mu sync.Mutex
+	var proposals int
+	tc := testContext{
+		raftIntercept: func(cc committedCommand) bool {
+			if _, ok := cc.cmd.Cmd.GetValue().(*proto.InternalSetFrozenRequest); ok {
+				mu.Lock()
+				proposals++
+				mu.Unlock()
+			}
+			return true
+		},
+	}
+	tc.Start(t)
+	defer tc.Stop()
+
+	header := proto.RequestHeader{Key: proto.Key("a"), RaftID: 1, Replica: proto.Replica{StoreID: tc.store.StoreID()}}
+	if err := tc.rng.AddCmd(proto.AdminFreeze, &proto.AdminFreezeRequest{RequestHeader: header}, &proto.AdminFreezeResponse{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if !tc.rng.IsFrozen() {
+		t.Fatal("expected range to be frozen")
+	}
+	if rng, err := NewRange(tc.rng.Desc, tc.store); err != nil {
+		t.Fatal(err)
+	} else if !rng.IsFrozen() {
+		t.Error("expected frozen state to be reloaded")
+	}
+
+	gArgs, gReply := getArgs([]byte("a"), 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Fatalf("expected read from frozen range to succeed: %s", err)
+	}
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = tc.clock.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.rng.AddCmd(proto.Put, pArgs, pReply, true)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected write to block while range is frozen; got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := tc.rng.AddCmd(proto.AdminUnfreeze, &proto.AdminUnfreezeRequest{RequestHeader: header}, &proto.AdminUnfreezeResponse{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected write to succeed once unfrozen: %s", err)
+	}
+	if rng, err := NewRange(tc.rng.Desc, tc.store); err != nil {
+		t.Fatal(err)
+	} else if rng.IsFrozen() {
+		t.Error("expected unfrozen state to be reloaded")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if proposals != 2 {
+		t.Errorf("expected freeze and unfreeze to be proposed through Raft; got %d proposals", proposals)
+	}
+}
+
+// TestRangeFreezeSplit verifies that both halves of a frozen range
+// are frozen after a split.
+func TestRangeFreezeSplit(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	header := proto.RequestHeader{Key: proto.Key("a"), RaftID: 1, Replica: proto.Replica{StoreID: tc.store.StoreID()}}
+	if err := tc.rng.AddCmd(proto.AdminFreeze, &proto.AdminFreezeRequest{RequestHeader: header}, &proto.AdminFreezeResponse{}, true); err != nil {
+		t.Fatal(err)
+	}
+	newDesc, err := tc.store.NewRangeDescriptor(proto.Key("m"), tc.rng.Desc.EndKey, tc.rng.Desc.Replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatedDesc := *tc.rng.Desc
+	updatedDesc.EndKey = proto.Key("m")
+	batch := tc.engine.NewBatch()
+	if err := tc.rng.splitTrigger(batch, &proto.SplitTrigger{UpdatedDesc: updatedDesc, NewDesc: *newDesc}); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	newRng, err := tc.store.GetRange(newDesc.RaftID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tc.rng.IsFrozen() || !newRng.IsFrozen() {
+		t.Errorf("expected both halves to be frozen; got %t, %t", tc.rng.IsFrozen(), newRng.IsFrozen())
+	}
+	if rng, err := NewRange(newDesc, tc.store); err != nil {
+		t.Fatal(err)
+	} else if !rng.IsFrozen() {
+		t.Error("expected frozen state of the new range to be reloaded")
+	}
+}
+
+// TestRangeQueryIntent verifies that InternalQueryIntent finds the
+// intents of the queried txn without resolving them, and returns an
+// error for missing intents if requested.
+func TestRangeQueryIntent(t *testing.T) {
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	key := proto.Key("a")
+	txn := newTransaction("test", key, 1, proto.SERIALIZABLE, tc.clock)
+	pArgs, pReply := putArgs(key, []byte("value"), 1, tc.store.StoreID())
+	pArgs.Timestamp = txn.Timestamp
+	pArgs.Txn = txn
+	if err := tc.rng.AddCmd(proto.Put, pArgs, pReply, true); err != nil {
+		t.Fatal(err)
+	}
+
+	otherTxn := newTransaction("other", key, 1, proto.SERIALIZABLE, tc.clock)
+	testCases := []struct {
+		key            proto.Key
+		txn            *proto.Transaction
+		errorIfMissing bool
+		expFound       bool
+		expErr         bool
+	}{
+		{key, txn, false, true, false},
+		{key, txn, true, true, false},
+		{key, otherTxn, false, false, false},
+		{key, otherTxn, true, false, true},
+		{proto.Key("b"), txn, false, false, false},
+		{proto.Key("b"), txn, true, false, true},
+	}
+	for i, test := range testCases {
+		qArgs := &proto.InternalQueryIntentRequest{
+			RequestHeader: proto.RequestHeader{
+				Timestamp: test.txn.Timestamp,
+				Key:       test.key,
+				RaftID:    1,
+				Replica:   proto.Replica{StoreID: tc.store.StoreID()},
+				Txn:       test.txn,
+			},
+			ErrorIfMissing: test.errorIfMissing,
+		}
+		qReply := &proto.InternalQueryIntentResponse{}
+		err := tc.rng.AddCmd(proto.InternalQueryIntent, qArgs, qReply, true)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+		if qReply.FoundIntent != test.expFound {
+			t.Errorf("%d: expected found %t; got %t", i, test.expFound, qReply.FoundIntent)
+		}
+	}
+
+	// The intent remains unresolved.
+	gArgs, gReply := getArgs(key, 1, tc.store.StoreID())
+	gArgs.Timestamp = tc.clock.Now()
+	if err := tc.rng.AddCmd(proto.Get, gArgs, gReply, true); err == nil {
+		t.Error("expected write intent error reading queried intent")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/settings"
+)
+
+// rebalanceQueueMaxSize is the max size of the rebalance queue.
+var rebalanceQueueMaxSize = settings.RegisterIntSetting("storage.rebalance_queue.max_size",
+	"maximum number of ranges queued for rebalancing", 100).WithValidation(settings.PositiveInt)
+
+const (
+	// intraNodeRebalanceThreshold is the minimum difference in the
+	// fraction of available capacity between two stores on the same
+	// node for ranges to be moved from the fuller to the emptier.
+	intraNodeRebalanceThreshold = 0.05
+	// misplacedPriority is the priority of ranges on stores which no
+	// longer satisfy their zone's attributes. It exceeds the priority
+	// of any capacity rebalancing, which is at most 1.
+	misplacedPriority = 2
+)
+
+// A StoreVisitor invokes the supplied function on each of a node's
+// stores, stopping on the first error.
+type StoreVisitor func(func(*Store) error) error
+
+// rebalanceQueue manages a queue of ranges to be moved to other
+// stores. Currently, it only balances the stores of a single node:
+// when a node has multiple stores with unequal fill, ranges are moved
+// from the store being processed to the store on the same node with
+// the most available capacity. Moving a range between stores on the
+// same node is cheap, as range data is copied directly between the
+// stores' engines rather than sent as a Raft snapshot.
+type rebalanceQueue struct {
+	*baseQueue
+	store *Store
+}
+
+// newRebalanceQueue returns a new instance of rebalanceQueue for the
+// specified store.
+func newRebalanceQueue(store *Store) *rebalanceQueue {
+	rq := &rebalanceQueue{store: store}
+	rq.baseQueue = newBaseQueue("rebalance", rq.shouldQueue, rq.process, int(rebalanceQueueMaxSize.Get()))
+	rq.maxSizeS = rebalanceQueueMaxSize
+	return rq
+}
+
+// shouldQueue returns true if this store no longer satisfies the
+// attributes or lease preferences of the range's zone and another
+// store on the node satisfies them better, or if another store on the
+// node has sufficiently more available capacity than this store. Misplaced ranges are queued at
+// misplacedPriority; otherwise, the priority is the difference in the
+// fraction of available capacity. The first range is never moved.
+func (rq *rebalanceQueue) shouldQueue(now time.Time, rng *Range) (shouldQ bool, priority float64) {
+	if rng.IsFirstRange() {
+		return
+	}
+	if rq.findZoneTarget(rng) != nil {
+		return true, misplacedPriority
+	}
+	target, spread := rq.findTarget()
+	if target == nil {
+		return
+	}
+	return true, spread
+}
+
+// process moves a misplaced range to a store on the node satisfying
+// its zone's attributes or, otherwise, moves the range to the store on
+// the node with the most available capacity, if it is still
+// sufficiently emptier.
+func (rq *rebalanceQueue) process(now time.Time, rng *Range) error {
+	if target := rq.findZoneTarget(rng); target != nil {
+		return rq.store.RelocateRange(rng, target)
+	}
+	target, _ := rq.findTarget()
+	if target == nil {
+		return nil
+	}
+	return rq.store.RelocateRange(rng, target)
+}
+
+// findTarget returns the store on the node with the most available
+// capacity and the difference between its fraction of available
+// capacity and this store's. Only stores with all of this store's
+// attributes are considered, so that moved ranges continue to satisfy
+// their zone's constraints; stalled stores and stores with unhealthy
+// LSM trees are skipped. Returns nil if no store has at least
+// intraNodeRebalanceThreshold more available capacity.
+func (rq *rebalanceQueue) findTarget() (*Store, float64) {
+	if rq.store.nodeStores == nil {
+		return nil, 0
+	}
+	capacity, err := rq.store.Capacity()
+	if err != nil {
+		log.Errorf("unable to fetch capacity of store %d: %s", rq.store.StoreID(), err)
+		return nil, 0
+	}
+	avail := capacity.PercentAvail()
+	var target *Store
+	var spread float64
+	if err := rq.store.nodeStores(func(s *Store) error {
+		if s == rq.store || s.Stalled() || !rq.store.Attrs().IsSubset(s.Attrs()) {
+			return nil
+		}
+		c, err := s.Capacity()
+		if err != nil {
+			log.Errorf("unable to fetch capacity of store %d: %s", s.StoreID(), err)
+			return nil
+		}
+		if !lsmHealthy(c) {
+			return nil
+		}
+		if diff := c.PercentAvail() - avail; diff > spread {
+			target, spread = s, diff
+		}
+		return nil
+	}); err != nil {
+		log.Errorf("unable to visit stores of node %d: %s", rq.store.Ident.NodeID, err)
+		return nil, 0
+	}
+	if spread < intraNodeRebalanceThreshold {
+		return nil, 0
+	}
+	return target, spread
+}
+
+// satisfiesZone returns whether a store with attrs may hold a replica
+// of a range in zone: whether any of the zone's replica attributes
+// is a subset of attrs. Zones without replica attributes are
+// satisfied by any store.
+func satisfiesZone(zone *proto.ZoneConfig, attrs proto.Attributes) bool {
+	if len(zone.ReplicaAttrs) == 0 {
+		return true
+	}
+	for _, required := range zone.ReplicaAttrs {
+		if required.IsSubset(attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// findZoneTarget returns the store on the node with the most available
+// capacity satisfying the attributes required by the zone of rng, if
+// this store does not satisfy them, as happens after its attributes
+// are changed. As this store's replica holds the range lease, the
+// range is also moved to a store satisfying a more preferred of the
+// zone's lease preferences; of the candidate stores, those satisfying
+// the most preferred lease preference are chosen. Stalled stores and
+// stores with unhealthy LSM trees are skipped. Returns nil if no
+// other store satisfies the zone better than this one or the zone is
+// unknown.
+func (rq *rebalanceQueue) findZoneTarget(rng *Range) *Store {
+	if rq.store.nodeStores == nil {
+		return nil
+	}
+	zone, err := lookupZoneConfig(rng)
+	if err != nil {
+		return nil
+	}
+	satisfied := satisfiesZone(zone, rq.store.Attrs())
+	rank := leasePreferenceRank(zone, rq.store.Attrs())
+	if satisfied && rank == 0 {
+		return nil
+	}
+	var target *Store
+	var avail float64
+	var targetRank int
+	if err := rq.store.nodeStores(func(s *Store) error {
+		if s == rq.store || s.Stalled() || !satisfiesZone(zone, s.Attrs()) {
+			return nil
+		}
+		sRank := leasePreferenceRank(zone, s.Attrs())
+		if satisfied && sRank >= rank {
+			return nil
+		}
+		c, err := s.Capacity()
+		if err != nil {
+			log.Errorf("unable to fetch capacity of store %d: %s", s.StoreID(), err)
+			return nil
+		}
+		if !lsmHealthy(c) {
+			return nil
+		}
+		if target == nil || sRank < targetRank || sRank == targetRank && c.PercentAvail() > avail {
+			target, avail, targetRank = s, c.PercentAvail(), sRank
+		}
+		return nil
+	}); err != nil {
+		log.Errorf("unable to visit stores of node %d: %s", rq.store.Ident.NodeID, err)
+		return nil
+	}
+	return target
+}
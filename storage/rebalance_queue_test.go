@@ -0,0 +1,88 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestRebalanceQueueFindTarget verifies that a store on the same node
+// is chosen as a rebalance target only once it has sufficiently more
+// available capacity, and that the first range is never queued.
+func TestRebalanceQueueFindTarget(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	other := NewStore(store.clock, engine.NewInMem(proto.Attributes{}, 1<<20), nil, nil)
+	store.SetNodeStores(func(visit func(*Store) error) error {
+		for _, s := range []*Store{store, other} {
+			if err := visit(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if target, _ := store.rebalanceQueue.findTarget(); target != nil {
+		t.Fatalf("expected no target before writing data; got store %d", target.StoreID())
+	}
+	value := make([]byte, 10<<10)
+	for i := 0; i < 10; i++ {
+		pArgs, pReply := putArgs([]byte(fmt.Sprintf("key%d", i)), value, 1, store.StoreID())
+		if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if target, spread := store.rebalanceQueue.findTarget(); target != other || spread < intraNodeRebalanceThreshold {
+		t.Errorf("expected other store as target with spread >= %f; got %v, %f", intraNodeRebalanceThreshold, target, spread)
+	}
+	rng := store.LookupRange(proto.KeyMin, nil)
+	if shouldQ, _ := store.rebalanceQueue.shouldQueue(time.Now(), rng); shouldQ {
+		t.Errorf("expected first range not to be queued for rebalancing")
+	}
+}
+
+// TestSatisfiesZone verifies that a store satisfies a zone if its
+// attributes include any of the zone's replica attributes.
+func TestSatisfiesZone(t *testing.T) {
+	zone := &proto.ZoneConfig{
+		ReplicaAttrs: []proto.Attributes{
+			{Attrs: []string{"dc1", "ssd"}},
+			{Attrs: []string{"dc2"}},
+		},
+	}
+	testCases := []struct {
+		zone   *proto.ZoneConfig
+		attrs  []string
+		expect bool
+	}{
+		{&proto.ZoneConfig{}, nil, true},
+		{zone, nil, false},
+		{zone, []string{"dc1"}, false},
+		{zone, []string{"ssd", "dc1"}, true},
+		{zone, []string{"dc2", "hdd"}, true},
+		{zone, []string{"dc3", "ssd"}, false},
+	}
+	for i, test := range testCases {
+		if s := satisfiesZone(test.zone, proto.Attributes{Attrs: test.attrs}); s != test.expect {
+			t.Errorf("%d: expected %t; got %t", i, test.expect, s)
+		}
+	}
+}
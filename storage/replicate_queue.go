@@ -0,0 +1,223 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/settings"
+)
+
+// replicateQueueMaxSize is the max size of the replicate queue.
+var replicateQueueMaxSize = settings.RegisterIntSetting("storage.replicate_queue.max_size",
+	"maximum number of ranges queued for replica changes", 100).WithValidation(settings.PositiveInt)
+
+const (
+	// underReplicatedPriority is the priority of ranges missing
+	// replicas required by their zone, increased by the number of
+	// missing replicas. It exceeds the priority of over-replicated
+	// ranges.
+	underReplicatedPriority = 1
+	// overReplicatedPriority is the priority of ranges with replicas
+	// required by none of their zone's replica attributes.
+	overReplicatedPriority = 0.5
+)
+
+// replicateQueue manages a queue of ranges led by the store whose
+// replicas don't match those required by their zone, as happens when
+// the zone's replication factor is changed. Each time a range is
+// processed, one missing replica is added on a store chosen by the
+// allocator or, if none is missing, one replica required by none of
+// the zone's replica attributes is removed. The store's own replica
+// is never removed. Ranges are queued by the zone config gossip
+// callback as well as by the range scanner, which retries ranges for
+// which no store was available.
+type replicateQueue struct {
+	*baseQueue
+	store *Store
+}
+
+// newReplicateQueue returns a new instance of replicateQueue for the
+// specified store.
+func newReplicateQueue(store *Store) *replicateQueue {
+	rq := &replicateQueue{store: store}
+	rq.baseQueue = newBaseQueue("replicate", rq.shouldQueue, rq.process, int(replicateQueueMaxSize.Get()))
+	rq.maxSizeS = replicateQueueMaxSize
+	return rq
+}
+
+// shouldQueue returns true if the store leads rng and the range's
+// replicas don't match those required by its zone.
+func (rq *replicateQueue) shouldQueue(now time.Time, rng *Range) (shouldQ bool, priority float64) {
+	if !rng.IsLeader() {
+		return
+	}
+	zone, err := lookupZoneConfig(rng)
+	if err != nil {
+		return
+	}
+	rng.RLock()
+	replicas := rng.Desc.Replicas
+	rng.RUnlock()
+	if missing, _ := matchReplicaAttrs(zone, replicas); len(missing) > 0 {
+		return true, underReplicatedPriority + float64(len(missing))
+	}
+	if _, ok := rq.removalTarget(zone, replicas); ok {
+		return true, overReplicatedPriority
+	}
+	return
+}
+
+// process adds a replica to rng if it is missing one required by its
+// zone, initializing it from a snapshot, and otherwise removes one
+// required by none.
+func (rq *replicateQueue) process(now time.Time, rng *Range) error {
+	if !rng.IsLeader() {
+		return nil
+	}
+	zone, err := lookupZoneConfig(rng)
+	if err != nil {
+		return err
+	}
+	rng.RLock()
+	replicas := rng.Desc.Replicas
+	rng.RUnlock()
+	if missing, _ := matchReplicaAttrs(zone, replicas); len(missing) > 0 {
+		target, nonVoter, err := rq.store.allocator.allocateReplica(zone, replicas)
+		if err != nil {
+			log.V(1).Infof("unable to add replica to range %d: %s", rng.Desc.RaftID, err)
+			return nil
+		}
+		added := proto.Replica{
+			NodeID:   target.Node.NodeID,
+			StoreID:  target.StoreID,
+			Attrs:    *target.CombinedAttrs(),
+			NonVoter: nonVoter,
+		}
+		log.Infof("adding replica on store %d to range %d", added.StoreID, rng.Desc.RaftID)
+		if err := rq.store.changeReplicas(rng, func(replicas []proto.Replica) []proto.Replica {
+			return append(replicas, added)
+		}); err != nil {
+			return err
+		}
+		return rq.store.SendSnapshot(rng, added)
+	}
+	removed, ok := rq.removalTarget(zone, replicas)
+	if !ok {
+		return nil
+	}
+	log.Infof("removing replica on store %d from range %d", removed.StoreID, rng.Desc.RaftID)
+	if err := rq.store.changeReplicas(rng, func(replicas []proto.Replica) []proto.Replica {
+		var kept []proto.Replica
+		for _, replica := range replicas {
+			if replica.StoreID != removed.StoreID {
+				kept = append(kept, replica)
+			}
+		}
+		return kept
+	}); err != nil {
+		return err
+	}
+	return rq.store.destroyLocalReplica(rng.Desc.RaftID, removed.StoreID)
+}
+
+// removalTarget returns a replica of a range in zone, other than the
+// store's own, which satisfies none of the zone's replica attributes.
+// Returns false if there is none.
+func (rq *replicateQueue) removalTarget(zone *proto.ZoneConfig, replicas []proto.Replica) (proto.Replica, bool) {
+	_, used := matchReplicaAttrs(zone, replicas)
+	for i, replica := range replicas {
+		if !used[i] && replica.StoreID != rq.store.StoreID() {
+			return replica, true
+		}
+	}
+	return proto.Replica{}, false
+}
+
+// changeReplicas replaces the replicas listed by the descriptor of rng
+// with the result of change, updating the descriptor and its
+// addressing records in a transaction.
+func (s *Store) changeReplicas(rng *Range, change func([]proto.Replica) []proto.Replica) error {
+	// Prevent concurrent splits and relocations, which would modify
+	// the descriptor.
+	if !atomic.CompareAndSwapInt32(&rng.splitting, int32(0), int32(1)) {
+		return util.Errorf("range %d is being split", rng.Desc.RaftID)
+	}
+	defer func() { atomic.StoreInt32(&rng.splitting, int32(0)) }()
+
+	rng.RLock()
+	newDesc := *rng.Desc
+	rng.RUnlock()
+	newDesc.Replicas = change(append([]proto.Replica(nil), newDesc.Replicas...))
+	txnOpts := &client.TransactionOptions{
+		Name: fmt.Sprintf("change replicas of range %d", newDesc.RaftID),
+	}
+	if err := s.db.RunTransaction(txnOpts, func(txn *client.KV) error {
+		if err := txn.PreparePutProto(engine.RangeDescriptorKey(newDesc.StartKey), &newDesc); err != nil {
+			return err
+		}
+		return UpdateRangeAddressing(txn, &newDesc)
+	}); err != nil {
+		return util.Errorf("unable to update descriptor of range %d: %s", newDesc.RaftID, err)
+	}
+	rng.Lock()
+	rng.Desc.Replicas = newDesc.Replicas
+	rng.Unlock()
+	return nil
+}
+
+// destroyLocalReplica removes the replica of the range with the given
+// Raft ID from the store with ID storeID and destroys its data, if the
+// store is on this store's node and holds the replica.
+func (s *Store) destroyLocalReplica(raftID int64, storeID int32) error {
+	target := s.localStore(storeID)
+	if target == nil {
+		return nil
+	}
+	rng, err := target.GetRange(raftID)
+	if err != nil {
+		return nil
+	}
+	ms, err := engine.MVCCGetRangeStats(target.engine, raftID)
+	if err != nil {
+		return util.Errorf("unable to fetch stats for range %d: %s", raftID, err)
+	}
+	if err := target.RemoveRange(rng); err != nil {
+		return err
+	}
+	if err := rng.Destroy(); err != nil {
+		return err
+	}
+	negMS := engine.MVCCStats{
+		LiveBytes:   -ms.LiveBytes,
+		KeyBytes:    -ms.KeyBytes,
+		ValBytes:    -ms.ValBytes,
+		IntentBytes: -ms.IntentBytes,
+		LiveCount:   -ms.LiveCount,
+		KeyCount:    -ms.KeyCount,
+		ValCount:    -ms.ValCount,
+		IntentCount: -ms.IntentCount,
+	}
+	negMS.MergeStats(target.engine, 0, storeID)
+	return nil
+}
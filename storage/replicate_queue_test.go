@@ -0,0 +1,183 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestReplicateQueueShouldQueue verifies that ranges missing replicas
+// required by their zone are queued ahead of ranges with replicas
+// required by none, that the store's own replica is never chosen for
+// removal, and that zone config changes queue misreplicated ranges.
+func TestReplicateQueueShouldQueue(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	// Keep the store's queue goroutine from processing queued ranges.
+	if err := store.SetQueueState("replicate", QueuePaused); err != nil {
+		t.Fatal(err)
+	}
+	rng := store.LookupRange(proto.Key("a"), nil)
+	setZone := func(replicas int) PrefixConfigMap {
+		zone := &proto.ZoneConfig{}
+		for i := 0; i < replicas; i++ {
+			zone.ReplicaAttrs = append(zone.ReplicaAttrs, proto.Attributes{})
+		}
+		configMap, err := NewPrefixConfigMap([]*PrefixConfig{{engine.KeyMin, nil, zone}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Gossip().AddInfo(gossip.KeyConfigZone, configMap, 0*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		return configMap
+	}
+
+	setZone(1)
+	if shouldQ, _ := store.replicateQueue.shouldQueue(time.Now(), rng); shouldQ {
+		t.Error("expected a range matching its zone not to be queued")
+	}
+
+	configMap := setZone(3)
+	if shouldQ, priority := store.replicateQueue.shouldQueue(time.Now(), rng); !shouldQ || priority != underReplicatedPriority+2 {
+		t.Errorf("expected range missing 2 replicas to be queued at priority %f; got %t, %f",
+			float64(underReplicatedPriority+2), shouldQ, priority)
+	}
+	store.queueMu.Lock()
+	store.replicateQueue.Clear()
+	store.queueMu.Unlock()
+	store.checkReplicationByConfigs(configMap)
+	store.queueMu.Lock()
+	l := store.replicateQueue.Length()
+	store.queueMu.Unlock()
+	if l != 1 {
+		t.Errorf("expected the misreplicated range to be queued; got %d range(s)", l)
+	}
+
+	setZone(1)
+	rng.Lock()
+	rng.Desc.Replicas = append(rng.Desc.Replicas, proto.Replica{NodeID: 2, StoreID: 2})
+	rng.Unlock()
+	if shouldQ, priority := store.replicateQueue.shouldQueue(time.Now(), rng); !shouldQ || priority != overReplicatedPriority {
+		t.Errorf("expected over-replicated range to be queued at priority %f; got %t, %f",
+			overReplicatedPriority, shouldQ, priority)
+	}
+	zone, err := lookupZoneConfig(rng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed, ok := store.replicateQueue.removalTarget(zone, rng.Desc.Replicas); !ok || removed.StoreID != 2 {
+		t.Errorf("expected the replica on store 2 to be removed; got %+v, %t", removed, ok)
+	}
+}
+
+// testSnapshotTransport records the recipients of the snapshots sent
+// through it.
+type testSnapshotTransport struct {
+	sent []proto.Replica
+}
+
+func (st *testSnapshotTransport) RequestSnapshot(delegate, recipient proto.Replica, desc *proto.RangeDescriptor) error {
+	return util.Errorf("unexpected request to store %d", delegate.StoreID)
+}
+
+func (st *testSnapshotTransport) SendSnapshot(recipient proto.Replica, snap *proto.RangeBackup) error {
+	st.sent = append(st.sent, recipient)
+	return nil
+}
+
+func (st *testSnapshotTransport) SeedReplica(recipient proto.Replica, source int32, desc *proto.RangeDescriptor) (uint64, error) {
+	return 0, util.Errorf("unexpected seed of store %d", recipient.StoreID)
+}
+
+func (st *testSnapshotTransport) CatchUpReplica(recipient proto.Replica, catchUp *proto.RangeCatchUp) error {
+	return util.Errorf("unexpected catch-up of store %d", recipient.StoreID)
+}
+
+// TestReplicateQueueConvergesToZone verifies that after the zone's
+// replication factor is raised, the range queued by the zone config
+// gossip callback gains a replica on a store chosen by the allocator,
+// which is sent a snapshot of the range, and that it loses the replica again once the factor is lowered.
+func TestReplicateQueueConvergesToZone(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	if err := store.SetQueueState("replicate", QueuePaused); err != nil {
+		t.Fatal(err)
+	}
+	store.allocator.storeFinder = func(proto.Attributes) ([]*StoreDescriptor, error) {
+		return []*StoreDescriptor{{
+			StoreID:  2,
+			Node:     NodeDescriptor{NodeID: 2},
+			Capacity: engine.StoreCapacity{Capacity: 100, Available: 100},
+		}}, nil
+	}
+	snapshots := &testSnapshotTransport{}
+	store.SetSnapshotTransport(snapshots)
+	rng := store.LookupRange(proto.Key("a"), nil)
+	// converge sets the zone's replication factor, which queues the
+	// range via the gossip callback, and processes the queued range.
+	converge := func(replicas int) int {
+		zone := &proto.ZoneConfig{}
+		for i := 0; i < replicas; i++ {
+			zone.ReplicaAttrs = append(zone.ReplicaAttrs, proto.Attributes{})
+		}
+		configMap, err := NewPrefixConfigMap([]*PrefixConfig{{engine.KeyMin, nil, zone}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Gossip().AddInfo(gossip.KeyConfigZone, configMap, 0*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := util.IsTrueWithin(func() bool {
+			store.queueMu.Lock()
+			defer store.queueMu.Unlock()
+			return store.replicateQueue.Length() == 1
+		}, 1*time.Second); err != nil {
+			t.Fatalf("expected the range to be queued: %s", err)
+		}
+		store.queueMu.Lock()
+		store.replicateQueue.Clear()
+		store.queueMu.Unlock()
+		if err := store.replicateQueue.process(time.Now(), rng); err != nil {
+			t.Fatal(err)
+		}
+		rng.RLock()
+		defer rng.RUnlock()
+		return len(rng.Desc.Replicas)
+	}
+
+	if n := converge(2); n != 2 {
+		t.Errorf("expected 2 replicas after raising the replication factor; got %d", n)
+	}
+	if replica := rng.Desc.Replicas[1]; replica.StoreID != 2 || replica.NodeID != 2 {
+		t.Errorf("expected the added replica on store 2; got %+v", replica)
+	}
+	if len(snapshots.sent) != 1 || snapshots.sent[0].StoreID != 2 {
+		t.Errorf("expected a snapshot to be sent to the added replica; got %+v", snapshots.sent)
+	}
+	if n := converge(1); n != 1 {
+		t.Errorf("expected 1 replica after lowering the replication factor; got %d", n)
+	}
+	if replica := rng.Desc.Replicas[0]; replica.StoreID != store.StoreID() {
+		t.Errorf("expected the store's own replica to be kept; got %+v", replica)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// A statsEngine wraps the engine a command executes against and
+// records the key/value pairs read by the command in the stats
+// returned to the client. All other operations are passed through to
+// the wrapped engine.
+type statsEngine struct {
+	engine.Engine
+	stats *proto.ResponseStats
+}
+
+// newStatsEngine returns a statsEngine wrapping e which records reads
+// in stats.
+func newStatsEngine(e engine.Engine, stats *proto.ResponseStats) *statsEngine {
+	return &statsEngine{Engine: e, stats: stats}
+}
+
+// Get implements the engine.Engine interface.
+func (se *statsEngine) Get(key proto.EncodedKey) ([]byte, error) {
+	value, err := se.Engine.Get(key)
+	if value != nil {
+		se.record(key, value)
+	}
+	return value, err
+}
+
+// Iterate implements the engine.Engine interface.
+func (se *statsEngine) Iterate(start, end proto.EncodedKey, f func(proto.RawKeyValue) (bool, error)) error {
+	return se.Engine.Iterate(start, end, func(kv proto.RawKeyValue) (bool, error) {
+		se.record(kv.Key, kv.Value)
+		return f(kv)
+	})
+}
+
+// NewIterator implements the engine.Engine interface.
+func (se *statsEngine) NewIterator() engine.Iterator {
+	return &statsIterator{Iterator: se.Engine.NewIterator(), se: se}
+}
+
+// record counts the key/value pair as read. An MVCC metadata record
+// holding a transaction is counted as an encountered intent.
+func (se *statsEngine) record(key proto.EncodedKey, value []byte) {
+	se.stats.KeysScanned++
+	se.stats.BytesRead += int64(len(key) + len(value))
+	if _, _, isValue := engine.MVCCDecodeKey(key); !isValue {
+		meta := &proto.MVCCMetadata{}
+		if err := gogoproto.Unmarshal(value, meta); err == nil && meta.Txn != nil {
+			se.stats.IntentsEncountered++
+		}
+	}
+}
+
+// A statsIterator records the key/value pairs an iterator is
+// positioned at in the stats of its statsEngine.
+type statsIterator struct {
+	engine.Iterator
+	se *statsEngine
+}
+
+// Seek implements the engine.Iterator interface.
+func (si *statsIterator) Seek(key []byte) {
+	si.Iterator.Seek(key)
+	si.recordCurrent()
+}
+
+// Next implements the engine.Iterator interface.
+func (si *statsIterator) Next() {
+	si.Iterator.Next()
+	si.recordCurrent()
+}
+
+func (si *statsIterator) recordCurrent() {
+	if si.Iterator.Valid() {
+		si.se.record(si.Iterator.Key(), si.Iterator.Value())
+	}
+}
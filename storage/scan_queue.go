@@ -18,15 +18,31 @@
 package storage
 
 import (
+	"bytes"
+	"math"
+	"sort"
 	"time"
 
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/settings"
+	gogoproto "github.com/gogo/protobuf/proto"
 )
 
+// scanQueueMaxSize is the max size of the scan queue.
+var scanQueueMaxSize = settings.RegisterIntSetting("storage.scan_queue.max_size",
+	"maximum number of ranges queued for scanning", 100).WithValidation(settings.PositiveInt)
+
+// scanCheckpointKeys is the number of keys scanned between commits of
+// a scan's work, each of which checkpoints the key from which the
+// scan resumes if interrupted, e.g. by a restart of the node.
+var scanCheckpointKeys = settings.RegisterIntSetting("storage.scan_queue.checkpoint_keys",
+	"number of keys scanned between checkpoints of a range scan's progress", 10000).WithValidation(settings.PositiveInt)
+
 const (
-	// scanQueueMaxSize is the max size of the scan queue.
-	scanQueueMaxSize = 100
 	// gcByteCountNormalization is the count of GC'able bytes which
 	// amount to a score of "1" added to total range priority.
 	gcByteCountNormalization = 1 << 20 // 1 MB
@@ -43,12 +59,51 @@ const (
 	verificationInterval = 30 * 24 * time.Hour // 30 days
 )
 
+// GCScoreInputs are the inputs from which a GCScorer scores a
+// range's need for garbage collection.
+type GCScoreInputs struct {
+	ElapsedNanos int64            // Time since the range's last scan
+	NonLiveBytes int64            // Current non-live bytes of the range
+	GC           proto.GCMetadata // GC metadata as of the range's last scan
+}
+
+// A GCScore is a GCScorer's assessment of a range's need for garbage
+// collection.
+type GCScore struct {
+	EstimatedBytes int64   // Estimated bytes a scan of the range would GC
+	Score          float64 // Added to the range's scan priority if positive
+}
+
+// A GCScorer scores ranges' need for garbage collection for the scan
+// queue. A range with a positive score is queued for scanning, at a
+// priority which combines the score with those of the intent sweep
+// and verification. Implementations must be thread safe.
+type GCScorer interface {
+	GCScore(in GCScoreInputs) GCScore
+}
+
+// DefaultGCScorer scores ranges by the bytes a scan is estimated to
+// garbage collect (see proto.GCMetadata.EstimatedBytes), adding 1 to
+// the score per gcByteCountNormalization bytes.
+var DefaultGCScorer GCScorer = defaultGCScorer{}
+
+type defaultGCScorer struct{}
+
+func (defaultGCScorer) GCScore(in GCScoreInputs) GCScore {
+	estGCBytes := in.GC.EstimatedBytes(in.ElapsedNanos, in.NonLiveBytes)
+	return GCScore{
+		EstimatedBytes: estGCBytes,
+		Score:          float64(estGCBytes) / float64(gcByteCountNormalization),
+	}
+}
+
 // scanQueue manages a queue of ranges slated to be scanned in their
 // entirety using the MVCC versions iterator. Currently, range scans
 // manage the following tasks:
 //
 //  - GC of version data via TTL expiration (and more complex schemes
 //    as implemented going forward).
+//  - Deletion of keys whose per-key expiration has passed.
 //  - Resolve extant write intents and determine oldest non-resolvable
 //    intent.
 //  - Periodic verification of on-disk checksums to identify bit-rot
@@ -58,30 +113,52 @@ const (
 // a single priority. If any task is overdue, shouldQueue returns true.
 type scanQueue struct {
 	*baseQueue
+	scorer GCScorer // Scores ranges' need for GC
 }
 
 // newScanQueue returns a new instance of scanQueue.
 func newScanQueue() *scanQueue {
-	sq := &scanQueue{}
-	sq.baseQueue = newBaseQueue("scan", sq.shouldQueue, sq.process, scanQueueMaxSize)
+	sq := &scanQueue{scorer: DefaultGCScorer}
+	sq.baseQueue = newBaseQueue("scan", sq.shouldQueue, sq.process, int(scanQueueMaxSize.Get()))
+	sq.maxSizeS = scanQueueMaxSize
 	return sq
 }
 
 // shouldQueue determines whether a range should be queued for
 // scanning, and if so, at what priority. Returns true for shouldQ in
-// the event that there are GC'able bytes, or it's been longer since
-// the last scan than the intent sweep or verification
-// intervals. Priority is derived from the addition of priority from
-// GC'able bytes and how many multiples of intent or verification
-// intervals have elapsed since the last scan.
+// the event that the range's GC score is positive, or it's been
+// longer since the last scan than the intent sweep or verification
+// intervals. Priority is derived from the addition of the GC score
+// and how many multiples of intent or verification intervals have
+// elapsed since the last scan.
 func (sq *scanQueue) shouldQueue(now time.Time, rng *Range) (shouldQ bool, priority float64) {
 	scanMeta, err := rng.GetScanMetadata()
 	if err != nil {
 		log.Errorf("unable to fetch scan metadata: %s", err)
 		return
 	}
-	elapsedNanos := now.UnixNano() - scanMeta.LastScanNanos
+	in := gcScoreInputs(now, rng, scanMeta)
+
+	intentBytes, err := engine.GetRangeStat(rng.rm.Engine(), rng.Desc.RaftID, engine.StatIntentBytes)
+	if err != nil {
+		log.Errorf("unable to fetch intent bytes stat: %s", err)
+	}
+
+	verifyElapsedNanos := now.UnixNano() - scanMeta.LastVerifyNanos
+	priority = scanQueuePriority(in.ElapsedNanos, verifyElapsedNanos, sq.scorer.GCScore(in).Score, intentBytes)
+	// Keys known to have expired add to the priority. Ranges which
+	// haven't been scanned since they were loaded are not queued on
+	// that account alone.
+	if next := rng.NextExpiration(); next > 0 && next <= now.UnixNano() {
+		priority++
+	}
+	shouldQ = priority > 0
+	return
+}
 
+// gcScoreInputs returns the inputs to the GC score of rng at now,
+// given its scan metadata.
+func gcScoreInputs(now time.Time, rng *Range, scanMeta *proto.ScanMetadata) GCScoreInputs {
 	// Compute non-live bytes.
 	bytes, err := engine.GetRangeSize(rng.rm.Engine(), rng.Desc.RaftID)
 	if err != nil {
@@ -91,27 +168,31 @@ func (sq *scanQueue) shouldQueue(now time.Time, rng *Range) (shouldQ bool, prior
 	if err != nil {
 		log.Errorf("unable to fetch live bytes stat: %s", err)
 	}
-	nonLiveBytes := bytes - liveBytes
-
-	// GC score.
-	estGCBytes := scanMeta.GC.EstimatedBytes(elapsedNanos, nonLiveBytes)
-	gcScore := float64(estGCBytes) / float64(gcByteCountNormalization)
-
-	// Intent sweep score. First check for intents. We only compute an
-	// intent score if there are any outstanding intents.
-	intentBytes, err := engine.GetRangeStat(rng.rm.Engine(), rng.Desc.RaftID, engine.StatIntentBytes)
-	if err != nil {
-		log.Errorf("unable to fetch intent bytes stat: %s", err)
+	return GCScoreInputs{
+		ElapsedNanos: now.UnixNano() - scanMeta.LastScanNanos,
+		NonLiveBytes: bytes - liveBytes,
+		GC:           scanMeta.GC,
 	}
+}
+
+// scanQueuePriority combines the GC, intent sweep and verification
+// scores into a single scan queue priority. elapsedNanos is the time
+// since the last scan and verifyElapsedNanos the time since the last
+// full scan. It is split out from shouldQueue so that the scoring can
+// be driven by synthetic range stats (see Simulation).
+func scanQueuePriority(elapsedNanos, verifyElapsedNanos int64, gcScore float64, intentBytes int64) float64 {
+	// Intent sweep score. We only compute an intent score if there are
+	// any outstanding intents.
 	intentScore := float64(0)
 	if intentBytes > 0 {
 		intentScore = float64(elapsedNanos) / float64(intentSweepInterval.Nanoseconds())
 	}
 
 	// Verify score.
-	verifyScore := float64(elapsedNanos) / float64(verificationInterval.Nanoseconds())
+	verifyScore := float64(verifyElapsedNanos) / float64(verificationInterval.Nanoseconds())
 
 	// Compute priority.
+	var priority float64
 	if gcScore > 0 {
 		priority += gcScore
 	}
@@ -121,8 +202,64 @@ func (sq *scanQueue) shouldQueue(now time.Time, rng *Range) (shouldQ bool, prior
 	if verifyScore > 1 {
 		priority += (verifyScore - 1)
 	}
-	shouldQ = priority > 0
-	return
+	return priority
+}
+
+// A RangeGCScore is the GC score of a range by its store's scan queue,
+// along with the inputs it was computed from.
+type RangeGCScore struct {
+	RaftID   int64
+	StartKey proto.Key
+	EndKey   proto.Key
+	Inputs   GCScoreInputs
+	GCScore
+}
+
+type rangeGCScores []RangeGCScore
+
+func (rs rangeGCScores) Len() int           { return len(rs) }
+func (rs rangeGCScores) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs rangeGCScores) Less(i, j int) bool { return rs[i].Score > rs[j].Score }
+
+// SetGCScorer sets the scorer of ranges' need for garbage collection
+// used by the store's scan queue. It must be called before Start.
+func (s *Store) SetGCScorer(scorer GCScorer) {
+	s.scanQueue.scorer = scorer
+}
+
+// GCScores returns up to n of the store's ranges with the highest GC
+// scores, in descending order, along with the inputs of the scores.
+// If n is non-positive, all ranges are returned.
+func (s *Store) GCScores(n int) ([]RangeGCScore, error) {
+	now := s.scanQueue.now()
+	s.mu.RLock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.RUnlock()
+	var result rangeGCScores
+	for _, rng := range ranges {
+		scanMeta, err := rng.GetScanMetadata()
+		if err != nil {
+			return nil, err
+		}
+		in := gcScoreInputs(now, rng, scanMeta)
+		rng.RLock()
+		result = append(result, RangeGCScore{
+			RaftID:   rng.Desc.RaftID,
+			StartKey: rng.Desc.StartKey,
+			EndKey:   rng.Desc.EndKey,
+			Inputs:   in,
+			GCScore:  s.scanQueue.scorer.GCScore(in),
+		})
+		rng.RUnlock()
+	}
+	sort.Sort(result)
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result, nil
 }
 
 // process iterates through all keys in a range, calling the garbage
@@ -130,16 +267,321 @@ func (sq *scanQueue) shouldQueue(now time.Time, rng *Range) (shouldQ bool, prior
 // batched into InternalGC calls. Extant intents are resolved if
 // intents are older than intentAgeThreshold. The very act of scanning
 // keys verifies on-disk checksums, as each block checksum is checked
-// on load.
-func (sq *scanQueue) process(now time.Time, rng *Range) error {
-	snap := rng.rm.Engine().NewSnapshot()
+// on load. Keys are read through a background snapshot so that the
+// scan does not evict the working set from the block cache, and at a
+// pace which yields to foreground reads (see
+// storage.background_read_rate), so that the periodic verification
+// pass doesn't add to their tail latency.
+//
+// If any versions are garbage collected, the range's GC threshold is
+// advanced to now less the zone's GC TTL and persisted with the scan
+// metadata, so that subsequent reads at or below the threshold are
+// rejected instead of returning incomplete data. Versions collected
+// because they exceed the zone's maximum number of versions may be
+// more recent, in which case a threshold just below the oldest
+// surviving version is recorded for their key alone, leaving reads of
+// other keys unaffected.
+//
+// Keys whose expiration has passed are deleted along with all of
+// their versions, regardless of the GC TTL. Historical reads of an
+// expired key no longer find it once it has been deleted.
+//
+// Every scanCheckpointKeys keys, the work done so far is committed
+// along with a checkpoint of the key at which the scan resumes if
+// interrupted. A resumed scan doesn't learn the expirations of the
+// keys it skips, so the scan following it can't be skipped.
+//
+// The full scan is skipped if verification is not yet due, no key is
+// due to expire and the engine can show that the range holds no
+// version old enough to be garbage collected; see canSkipScan.
+func (sq *scanQueue) process(now time.Time, rng *Range) (err error) {
+	zone, err := lookupZoneConfig(rng)
+	if err != nil {
+		return err
+	}
+	scanMeta, err := rng.GetScanMetadata()
+	if err != nil {
+		return util.Errorf("unable to fetch scan metadata: %s", err)
+	}
+	if skip, err := canSkipScan(now, rng, zone, scanMeta); err != nil {
+		return err
+	} else if skip {
+		scanMeta.LastScanNanos = now.UnixNano()
+		scanMeta.GC.TTLSeconds = zone.GC.TTLSeconds
+		if log.V(1) {
+			log.Infof("skipping scan of range %d; no versions older than GC TTL", rng.Desc.RaftID)
+		}
+		return engine.MVCCPutProto(rng.rm.Engine(), nil, engine.RangeScanMetadataKey(rng.Desc.StartKey), proto.ZeroTimestamp, nil, scanMeta)
+	}
+
+	// Track the earliest expiration of the keys scanned. Expirations
+	// noted by writes during the scan are retained. If the scan fails,
+	// the next expiration is unknown and the next scan can't be skipped.
+	rng.setNextExpiration(math.MaxInt64)
+	nextExpiration := int64(math.MaxInt64)
+	var resumed bool
+	defer func() {
+		if err != nil || resumed {
+			nextExpiration = 0
+		}
+		rng.noteExpiration(nextExpiration)
+	}()
+
+	snap := engine.NewBackgroundSnapshot(rng.rm.Engine())
 	iter := newRangeDataIterator(rng, snap)
 	defer iter.Close()
 	defer snap.Stop()
+	if key := sq.resumeKey(rng); key != nil {
+		iter.Seek(key)
+		resumed = true
+		log.Infof("resuming scan of range %d at %q", rng.Desc.RaftID, key)
+	}
+	timestamp := proto.Timestamp{WallTime: now.UnixNano()}
+	gc := engine.NewGarbageCollector(timestamp, func(key proto.Key) *proto.GCPolicy {
+		// Local keys are never garbage collected by policy.
+		if key.Less(engine.KeyLocalMax) {
+			return nil
+		}
+		return zone.GC
+	})
+
+	batch := rng.rm.Engine().NewBatch()
+	ms := engine.MVCCStats{}
+	var gcCount, expiredCount int
+	// expiration is the timestamp at or below which versions may be
+	// garbage collected by the zone's GC TTL. Reads at or below it are
+	// rejected range-wide.
+	var expiration proto.Timestamp
+	if zone.GC != nil && zone.GC.TTLSeconds > 0 {
+		expiration = timestamp
+		expiration.WallTime -= int64(zone.GC.TTLSeconds) * 1e9
+	}
+	// keyThresholds are the timestamps above expiration at or below
+	// which reads of individual keys could observe a version cleared
+	// beyond the zone's maximum number of versions.
+	var keyThresholds []proto.KeyGCThreshold
+
+	// processKey runs the garbage collector over the versions of a
+	// single key, clearing those which are to be deleted and
+	// accumulating the resulting stats deltas.
+	var keys []proto.EncodedKey
+	var vals [][]byte
+
+	// expireKey clears the metadata and all versions of an expired key,
+	// unless the key was written since the snapshot was taken.
+	expireKey := func(meta *proto.MVCCMetadata) error {
+		cur, err := rng.rm.Engine().Get(keys[0])
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(cur, vals[0]) {
+			return nil
+		}
+		for i := range keys {
+			if err := batch.Clear(keys[i]); err != nil {
+				return err
+			}
+			ms.KeyBytes -= int64(len(keys[i]))
+			ms.ValBytes -= int64(len(vals[i]))
+		}
+		ms.KeyCount--
+		ms.ValCount -= int64(len(keys) - 1)
+		if !meta.Deleted {
+			ms.LiveBytes -= meta.KeyBytes + meta.ValBytes + int64(len(keys[0])+len(vals[0]))
+			ms.LiveCount--
+		}
+		expiredCount++
+		return nil
+	}
+
+	processKey := func() error {
+		// Inline values are stored in the metadata row alone; they are
+		// replaced in place and leave nothing to collect.
+		if len(keys) < 2 {
+			return nil
+		}
+		meta := &proto.MVCCMetadata{}
+		if err := gogoproto.Unmarshal(vals[0], meta); err != nil {
+			return util.Errorf("unable to unmarshal MVCC metadata %q: %s", keys[0], err)
+		}
+		if exp := meta.Expiration; exp != nil {
+			if meta.Txn == nil && !timestamp.Less(*exp) {
+				return expireKey(meta)
+			}
+			if exp.WallTime < nextExpiration {
+				nextExpiration = exp.WallTime
+			}
+		}
+		// Keys with extant intents are left to intent resolution.
+		if meta.Txn != nil {
+			return nil
+		}
+		// newest is the index of the newest version cleared.
+		var newest int
+		for i, del := range gc.Filter(keys, vals) {
+			if !del {
+				continue
+			}
+			if i == 0 {
+				// Don't clear the metadata of a key which was written
+				// since the snapshot was taken.
+				cur, err := rng.rm.Engine().Get(keys[0])
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(cur, vals[0]) {
+					continue
+				}
+			}
+			if err := batch.Clear(keys[i]); err != nil {
+				return err
+			}
+			ms.KeyBytes -= int64(len(keys[i]))
+			ms.ValBytes -= int64(len(vals[i]))
+			if i == 0 {
+				ms.KeyCount--
+			} else {
+				ms.ValCount--
+				gcCount++
+				if newest == 0 {
+					newest = i
+				}
+			}
+		}
+		if newest > 0 {
+			// Reads below the oldest surviving version would observe a
+			// cleared version. If all versions were cleared, the newest
+			// was a deletion tombstone which reads above it observe.
+			var threshold proto.Timestamp
+			if newest == 1 {
+				_, threshold, _ = engine.MVCCDecodeKey(keys[newest])
+			} else {
+				_, ts, _ := engine.MVCCDecodeKey(keys[newest-1])
+				threshold = ts.Prev()
+			}
+			if expiration.Less(threshold) {
+				key, _, _ := engine.MVCCDecodeKey(keys[0])
+				keyThresholds = append(keyThresholds, proto.KeyGCThreshold{Key: key, Threshold: threshold})
+			}
+		}
+		return nil
+	}
 
+	// advanceGCThreshold advances the range's GC threshold to now less
+	// the zone's GC TTL and the GC thresholds of the keys whose versions
+	// were cleared beyond the zone's maximum number of versions. Keys
+	// which weren't trimmed remain readable below the latter. It must be
+	// called before deletions are committed so that no read can observe
+	// the partial result.
+	advanceGCThreshold := func() {
+		scanMeta.GC.Threshold, scanMeta.GC.KeyThresholds = rng.advanceGCThresholds(expiration, keyThresholds)
+		keyThresholds = nil
+	}
+
+	// checkpoint commits the work done so far along with the key from
+	// which the scan resumes.
+	checkpoint := func(resume proto.EncodedKey) error {
+		if gcCount > 0 {
+			advanceGCThreshold()
+			if err := engine.MVCCPutProto(batch, nil, engine.RangeScanMetadataKey(rng.Desc.StartKey), proto.ZeroTimestamp, nil, scanMeta); err != nil {
+				return util.Errorf("unable to write scan metadata: %s", err)
+			}
+		}
+		sq.setResumeKey(batch, rng, resume)
+		ms.MergeStats(batch, rng.Desc.RaftID, rng.rm.StoreID())
+		if err := batch.Commit(); err != nil {
+			return err
+		}
+		batch, ms = rng.rm.Engine().NewBatch(), engine.MVCCStats{}
+		return nil
+	}
+
+	var scanned int64
 	for ; iter.Valid(); iter.Next() {
-		// TODO(spencer): implement processing.
+		key := append(proto.EncodedKey(nil), iter.Key()...)
+		if _, _, isValue := engine.MVCCDecodeKey(key); !isValue {
+			if err := processKey(); err != nil {
+				return err
+			}
+			keys, vals = keys[:0], vals[:0]
+			if scanned++; scanned%scanCheckpointKeys.Get() == 0 {
+				if err := checkpoint(key); err != nil {
+					return err
+				}
+			}
+		}
+		keys = append(keys, key)
+		vals = append(vals, append([]byte(nil), iter.Value()...))
+	}
+	if err := processKey(); err != nil {
+		return err
 	}
 
+	// Update the scan metadata and, if any versions were garbage
+	// collected, advance the GC threshold.
+	scanMeta.LastScanNanos = now.UnixNano()
+	scanMeta.LastVerifyNanos = now.UnixNano()
+	if zone.GC != nil {
+		scanMeta.GC.TTLSeconds = zone.GC.TTLSeconds
+	}
+	if gcCount > 0 {
+		advanceGCThreshold()
+	}
+	if err := engine.MVCCPutProto(batch, nil, engine.RangeScanMetadataKey(rng.Desc.StartKey), proto.ZeroTimestamp, nil, scanMeta); err != nil {
+		return util.Errorf("unable to write scan metadata: %s", err)
+	}
+	// The scan is complete; clear the checkpointed resume key.
+	sq.setResumeKey(batch, rng, nil)
+	ms.MergeStats(batch, rng.Desc.RaftID, rng.rm.StoreID())
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	if gcCount > 0 && log.V(1) {
+		log.Infof("garbage collected %d version(s) from range %d; GC threshold now %s",
+			gcCount, rng.Desc.RaftID, scanMeta.GC.Threshold)
+	}
+	if expiredCount > 0 && log.V(1) {
+		log.Infof("deleted %d expired key(s) from range %d", expiredCount, rng.Desc.RaftID)
+	}
 	return nil
 }
+
+// canSkipScan returns true if a full scan of the range can be skipped
+// because it would neither verify checksums which are due for
+// verification, delete expired keys nor find any version older than
+// the zone's GC TTL. The latter requires an engine which can bound the
+// timestamps of the range's versions without iterating over them,
+// such as RocksDB from the timestamps recorded for each SSTable, and
+// a zone which doesn't limit the number of versions per key. Versions
+// the engine's bounds don't yet cover, such as those in RocksDB's
+// memtable, are garbage collected by a later scan.
+func canSkipScan(now time.Time, rng *Range, zone *proto.ZoneConfig, scanMeta *proto.ScanMetadata) (bool, error) {
+	if zone.GC == nil || zone.GC.MaxVersions > 0 ||
+		now.UnixNano()-scanMeta.LastVerifyNanos >= verificationInterval.Nanoseconds() ||
+		rng.NextExpiration() <= now.UnixNano() {
+		return false, nil
+	}
+	tb, ok := rng.rm.Engine().(engine.TimestampBounder)
+	if !ok {
+		return false, nil
+	}
+	minWallTime, _, ok, err := tb.TimestampBounds(engine.MVCCEncodeKey(rng.Desc.StartKey), engine.MVCCEncodeKey(rng.Desc.EndKey))
+	if err != nil || !ok {
+		return false, err
+	}
+	return minWallTime > now.UnixNano()-int64(zone.GC.TTLSeconds)*1e9, nil
+}
+
+// lookupZoneConfig returns the zone config which applies to the
+// range's start key.
+func lookupZoneConfig(rng *Range) (*proto.ZoneConfig, error) {
+	if rng.rm.Gossip() == nil {
+		return nil, util.Errorf("gossip is not enabled")
+	}
+	zoneMap, err := rng.rm.Gossip().GetInfo(gossip.KeyConfigZone)
+	if err != nil || zoneMap == nil {
+		return nil, util.Errorf("unable to fetch zone config from gossip: %s", err)
+	}
+	prefixConfig := zoneMap.(PrefixConfigMap).MatchByPrefix(rng.Desc.StartKey)
+	return prefixConfig.Config.(*proto.ZoneConfig), nil
+}
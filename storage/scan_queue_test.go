@@ -18,13 +18,17 @@
 package storage
 
 import (
+	"bytes"
 	"log"
 	"math"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/settings"
+	gogoproto "github.com/gogo/protobuf/proto"
 )
 
 // TestScanQueueShouldQueue verifies conditions which inform priority
@@ -126,3 +130,395 @@ func TestScanQueueShouldQueue(t *testing.T) {
 		}
 	}
 }
+
+// fixedGCScorer scores all ranges the same, recording the inputs
+// of the last range it scored.
+type fixedGCScorer struct {
+	score GCScore
+	in    GCScoreInputs
+}
+
+func (fs *fixedGCScorer) GCScore(in GCScoreInputs) GCScore {
+	fs.in = in
+	return fs.score
+}
+
+// TestScanQueueGCScorer verifies that a store's scan queue scores
+// ranges' need for GC with the scorer set on the store, and that the
+// store reports the scores along with their inputs.
+func TestScanQueueGCScorer(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	scorer := &fixedGCScorer{score: GCScore{EstimatedBytes: 1 << 20, Score: 2}}
+	store.SetGCScorer(scorer)
+	rng := store.LookupRange(engine.KeyMin, nil)
+	now := time.Unix(0, 0)
+	if shouldQ, priority := store.scanQueue.shouldQueue(now, rng); !shouldQ || priority != 2 {
+		t.Errorf("expected the range to be queued at the scorer's priority 2; got %t, %f", shouldQ, priority)
+	}
+
+	scanMeta, err := rng.GetScanMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, err := store.GCScores(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 1 || scores[0].RaftID != rng.Desc.RaftID || scores[0].GCScore != scorer.score {
+		t.Fatalf("expected the scorer's score of range %d; got %+v", rng.Desc.RaftID, scores)
+	}
+	if !reflect.DeepEqual(scores[0].Inputs.GC, scanMeta.GC) || !reflect.DeepEqual(scores[0].Inputs, scorer.in) {
+		t.Errorf("expected the inputs passed to the scorer; got %+v", scores[0].Inputs)
+	}
+
+	store.SetGCScorer(DefaultGCScorer)
+	if shouldQ, _ := store.scanQueue.shouldQueue(now, rng); shouldQ {
+		t.Error("expected a fresh range not to be queued by the default scorer")
+	}
+}
+
+// TestScanQueueProcessGC verifies that processing a range garbage
+// collects versions older than the zone's GC TTL, persists the GC
+// threshold, keeps stats accurate and that reads at or below the
+// threshold are rejected with a BatchTimestampBeforeGCError.
+func TestScanQueueProcessGC(t *testing.T) {
+	store, manual := createTestStore(t)
+	defer store.Stop()
+
+	key := proto.Key("a")
+	for _, wallTime := range []int64{1e9, 2e9} {
+		pArgs, pReply := putArgs(key, []byte("value"), 1, store.StoreID())
+		pArgs.Timestamp = proto.Timestamp{WallTime: wallTime}
+		if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Advance the clock past the default zone's GC TTL of one day.
+	manual.Set((24*time.Hour + 3*time.Second).Nanoseconds())
+	rng := store.LookupRange(key, nil)
+	if err := store.scanQueue.process(time.Unix(0, manual.UnixNano()), rng); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := engine.MVCCGetVersions(store.Engine(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Timestamp.WallTime != 2e9 {
+		t.Errorf("expected only the newest version to survive; got %+v", versions)
+	}
+	expThreshold := proto.Timestamp{WallTime: 3e9}
+	scanMeta, err := rng.GetScanMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scanMeta.GC.Threshold.Equal(expThreshold) || !rng.GCThreshold().Equal(expThreshold) {
+		t.Errorf("expected GC threshold %s; got %s (in memory %s)", expThreshold, scanMeta.GC.Threshold, rng.GCThreshold())
+	}
+
+	// Verify stats were adjusted for the deleted version.
+	ms, err := engine.MVCCGetRangeStats(store.Engine(), rng.Desc.RaftID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expMS, err := engine.MVCCComputeStats(store.Engine(), rng.Desc.StartKey, rng.Desc.EndKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*ms, expMS) {
+		t.Errorf("expected stats %+v; got %+v", expMS, *ms)
+	}
+
+	// Reads at or below the threshold are rejected.
+	for _, wallTime := range []int64{2e9, 3e9} {
+		gArgs, gReply := getArgs(key, 1, store.StoreID())
+		gArgs.Timestamp = proto.Timestamp{WallTime: wallTime}
+		err := store.ExecuteCmd(proto.Get, gArgs, gReply)
+		if _, ok := err.(*proto.BatchTimestampBeforeGCError); !ok {
+			t.Errorf("expected BatchTimestampBeforeGCError at %d; got %v", wallTime, err)
+		}
+	}
+	gArgs, gReply := getArgs(key, 1, store.StoreID())
+	gArgs.Timestamp = proto.Timestamp{WallTime: 4e9}
+	if err := store.ExecuteCmd(proto.Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || !bytes.Equal(gReply.Value.Bytes, []byte("value")) {
+		t.Errorf("expected value; got %+v", gReply.Value)
+	}
+}
+
+// TestScanQueueProcessMaxVersions verifies that processing a range
+// garbage collects versions beyond the zone's maximum number of
+// versions regardless of their age, and advances the GC threshold of
+// the trimmed key alone to just below its oldest surviving version,
+// leaving older reads of a cold key unaffected.
+func TestScanQueueProcessMaxVersions(t *testing.T) {
+	store, manual := createTestStore(t)
+	defer store.Stop()
+
+	manual.Set(5e9)
+	zone := &proto.ZoneConfig{
+		ReplicaAttrs: []proto.Attributes{proto.Attributes{}},
+		GC:           &proto.GCPolicy{TTLSeconds: 24 * 60 * 60, MaxVersions: 2},
+	}
+	data, err := gogoproto.Marshal(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zArgs, zReply := putArgs(engine.KeyConfigZonePrefix, data, 1, store.StoreID())
+	zArgs.Timestamp = proto.Timestamp{WallTime: 5e9}
+	if err := store.ExecuteCmd(proto.Put, zArgs, zReply); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hot key with more versions than the zone allows and a cold key
+	// written once, before all but the oldest of them.
+	key, coldKey := proto.Key("a"), proto.Key("b")
+	for _, wallTime := range []int64{1e9, 2e9, 3e9, 4e9} {
+		pArgs, pReply := putArgs(key, []byte("value"), 1, store.StoreID())
+		pArgs.Timestamp = proto.Timestamp{WallTime: wallTime}
+		if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pArgs, pReply := putArgs(coldKey, []byte("cold"), 1, store.StoreID())
+	pArgs.Timestamp = proto.Timestamp{WallTime: 1e9}
+	if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+
+	rng := store.LookupRange(key, nil)
+	if err := store.scanQueue.process(time.Unix(0, manual.UnixNano()), rng); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := engine.MVCCGetVersions(store.Engine(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Timestamp.WallTime != 4e9 || versions[1].Timestamp.WallTime != 3e9 {
+		t.Errorf("expected the two newest versions to survive; got %+v", versions)
+	}
+	if threshold := rng.GCThreshold(); !threshold.Equal(proto.ZeroTimestamp) {
+		t.Errorf("expected no range-wide GC threshold; got %s", threshold)
+	}
+	expKeyThresholds := []proto.KeyGCThreshold{{Key: key, Threshold: proto.Timestamp{WallTime: 3e9}.Prev()}}
+	scanMeta, err := rng.GetScanMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(scanMeta.GC.KeyThresholds, expKeyThresholds) {
+		t.Errorf("expected key GC thresholds %+v; got %+v", expKeyThresholds, scanMeta.GC.KeyThresholds)
+	}
+
+	// Reads observing a surviving version succeed; earlier reads are
+	// rejected.
+	gArgs, gReply := getArgs(key, 1, store.StoreID())
+	gArgs.Timestamp = proto.Timestamp{WallTime: 3e9}
+	if err := store.ExecuteCmd(proto.Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	gArgs, gReply = getArgs(key, 1, store.StoreID())
+	gArgs.Timestamp = proto.Timestamp{WallTime: 2e9}
+	if err := store.ExecuteCmd(proto.Get, gArgs, gReply); err == nil {
+		t.Error("expected read below the oldest surviving version to be rejected")
+	}
+	sArgs, sReply := scanArgs(key, coldKey.Next(), 1, store.StoreID())
+	sArgs.Timestamp = proto.Timestamp{WallTime: 2e9}
+	if err := store.ExecuteCmd(proto.Scan, sArgs, sReply); err == nil {
+		t.Error("expected scan spanning the trimmed key below its threshold to be rejected")
+	}
+
+	// The cold key remains readable at the same and older timestamps.
+	for _, wallTime := range []int64{1e9, 2e9} {
+		gArgs, gReply = getArgs(coldKey, 1, store.StoreID())
+		gArgs.Timestamp = proto.Timestamp{WallTime: wallTime}
+		if err := store.ExecuteCmd(proto.Get, gArgs, gReply); err != nil {
+			t.Errorf("expected read of cold key at %d to succeed; got %s", wallTime, err)
+		} else if gReply.Value == nil || !bytes.Equal(gReply.Value.Bytes, []byte("cold")) {
+			t.Errorf("expected cold value at %d; got %+v", wallTime, gReply.Value)
+		}
+	}
+}
+
+// timestampBoundedEngine wraps an engine to report fixed bounds for
+// the timestamps of versions in any span of keys.
+type timestampBoundedEngine struct {
+	engine.Engine
+	minWallTime, maxWallTime int64
+}
+
+func (e *timestampBoundedEngine) TimestampBounds(start, end proto.EncodedKey) (int64, int64, bool, error) {
+	return e.minWallTime, e.maxWallTime, true, nil
+}
+
+// TestScanQueueProcessSkip verifies that a full scan is skipped if the
+// engine shows no version is older than the GC TTL, unless checksum
+// verification is due.
+func TestScanQueueProcessSkip(t *testing.T) {
+	store, manual := createTestStore(t)
+	defer store.Stop()
+
+	key := proto.Key("a")
+	for _, wallTime := range []int64{1e9, 2e9} {
+		pArgs, pReply := putArgs(key, []byte("value"), 1, store.StoreID())
+		pArgs.Timestamp = proto.Timestamp{WallTime: wallTime}
+		if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Claim that all versions are recent, although the first is older
+	// than the GC TTL once the clock is advanced.
+	store.engine = &timestampBoundedEngine{Engine: store.engine, minWallTime: 24 * time.Hour.Nanoseconds(), maxWallTime: 2e9}
+	rng := store.LookupRange(key, nil)
+	// The range is known to hold no expiring keys.
+	rng.setNextExpiration(math.MaxInt64)
+
+	testCases := []struct {
+		now         time.Duration
+		expVersions int
+		expVerify   time.Duration
+	}{
+		// Verification is not due; the scan is skipped.
+		{24*time.Hour + 3*time.Second, 2, 0},
+		// Verification is due; the scan garbage collects the old version.
+		{verificationInterval + time.Second, 1, verificationInterval + time.Second},
+	}
+	for i, test := range testCases {
+		manual.Set(test.now.Nanoseconds())
+		if err := store.scanQueue.process(time.Unix(0, manual.UnixNano()), rng); err != nil {
+			t.Fatal(err)
+		}
+		versions, err := engine.MVCCGetVersions(store.Engine(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != test.expVersions {
+			t.Errorf("%d: expected %d versions; got %d", i, test.expVersions, len(versions))
+		}
+		scanMeta, err := rng.GetScanMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanMeta.LastScanNanos != test.now.Nanoseconds() || scanMeta.LastVerifyNanos != test.expVerify.Nanoseconds() {
+			t.Errorf("%d: expected last scan %d and last verification %d; got %+v",
+				i, test.now.Nanoseconds(), test.expVerify.Nanoseconds(), scanMeta)
+		}
+	}
+}
+
+// TestScanQueueProcessExpiration verifies that a scan deletes all
+// versions of keys whose expiration has passed, keeps the others and
+// records the next expiration.
+func TestScanQueueProcessExpiration(t *testing.T) {
+	store, manual := createTestStore(t)
+	defer store.Stop()
+
+	testCases := []struct {
+		key        proto.Key
+		expiration *proto.Timestamp
+		expExists  bool
+	}{
+		{proto.Key("a"), &proto.Timestamp{WallTime: 5e9}, false},
+		{proto.Key("b"), nil, true},
+		{proto.Key("c"), &proto.Timestamp{WallTime: 100e9}, true},
+	}
+	for _, test := range testCases {
+		for _, wallTime := range []int64{1e9, 2e9} {
+			pArgs, pReply := putArgs(test.key, []byte("value"), 1, store.StoreID())
+			pArgs.Timestamp = proto.Timestamp{WallTime: wallTime}
+			pArgs.Expiration = test.expiration
+			if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	rng := store.LookupRange(proto.Key("a"), nil)
+	liveCount, err := engine.GetRangeStat(store.Engine(), rng.Desc.RaftID, engine.StatLiveCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manual.Set(10e9)
+	if err := store.scanQueue.process(time.Unix(0, manual.UnixNano()), rng); err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range testCases {
+		versions, err := engine.MVCCGetVersions(store.Engine(), test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists := len(versions) > 0; exists != test.expExists {
+			t.Errorf("%d: expected key %q to exist? %t; got %d versions", i, test.key, test.expExists, len(versions))
+		}
+	}
+	if next := rng.NextExpiration(); next != 100e9 {
+		t.Errorf("expected next expiration at 100s; got %d", next)
+	}
+	if count, err := engine.GetRangeStat(store.Engine(), rng.Desc.RaftID, engine.StatLiveCount); err != nil {
+		t.Fatal(err)
+	} else if count != liveCount-1 {
+		t.Errorf("expected live count to drop from %d to %d; got %d", liveCount, liveCount-1, count)
+	}
+}
+
+// TestScanQueueProcessResume verifies that a scan resumes from its
+// checkpointed resume key, commits its work at checkpoints without
+// skewing stats and clears the resume key once complete.
+func TestScanQueueProcessResume(t *testing.T) {
+	defer settings.Update(nil)
+	settings.Update(map[string]string{scanCheckpointKeys.Key(): "1"})
+	store, manual := createTestStore(t)
+	defer store.Stop()
+
+	keys := []proto.Key{proto.Key("a"), proto.Key("b"), proto.Key("c")}
+	for _, key := range keys {
+		for _, wallTime := range []int64{1e9, 2e9} {
+			pArgs, pReply := putArgs(key, []byte("value"), 1, store.StoreID())
+			pArgs.Timestamp = proto.Timestamp{WallTime: wallTime}
+			if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Advance the clock past the default zone's GC TTL of one day and
+	// checkpoint a scan interrupted before "b".
+	manual.Set((24*time.Hour + 3*time.Second).Nanoseconds())
+	rng := store.LookupRange(keys[0], nil)
+	store.scanQueue.setResumeKey(store.Engine(), rng, engine.MVCCEncodeKey(keys[1]))
+	if err := store.scanQueue.process(time.Unix(0, manual.UnixNano()), rng); err != nil {
+		t.Fatal(err)
+	}
+	for i, expVersions := range []int{2, 1, 1} {
+		versions, err := engine.MVCCGetVersions(store.Engine(), keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != expVersions {
+			t.Errorf("expected %d version(s) of %q; got %d", expVersions, keys[i], len(versions))
+		}
+	}
+	if key := store.scanQueue.resumeKey(rng); key != nil {
+		t.Errorf("expected resume key to be cleared; got %q", key)
+	}
+	if next := rng.NextExpiration(); next != 0 {
+		t.Errorf("expected unknown next expiration after resumed scan; got %d", next)
+	}
+
+	ms, err := engine.MVCCGetRangeStats(store.Engine(), rng.Desc.RaftID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expMS, err := engine.MVCCComputeStats(store.Engine(), rng.Desc.StartKey, rng.Desc.EndKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*ms, expMS) {
+		t.Errorf("expected stats %+v; got %+v", expMS, *ms)
+	}
+}
@@ -31,8 +31,9 @@ import (
 // or busy stores, a recovery queue for ranges with dead replicas,
 // etc.
 type rangeQueue interface {
-	// Next returns the highest priority range from the queue. If the
-	// queue is empty, returns nil.
+	// Next dequeues the highest priority range from the queue,
+	// processing it if the queue does its own processing, and returns
+	// it. If the queue is empty, returns nil.
 	Next() *Range
 	// MaybeAdd adds the range to the queue if the range meets
 	// the queue's inclusion criteria and the queue is not already
@@ -84,7 +85,7 @@ func newRangeScanner(interval time.Duration, iter rangeIterator, queues []rangeQ
 
 // Start spins up the scanning loop. Call Stop() to exit the loop.
 func (rs *rangeScanner) Start() {
-	go rs.scanLoop()
+	go util.RunLabeled("scanner", rs.scanLoop)
 }
 
 // Stop stops the scanning loop.
@@ -103,9 +104,29 @@ func (rs *rangeScanner) Count() int64 {
 
 // RemoveRange removes a range from any range queues the scanner may
 // have placed it in. This method should be called by the Store
-// when a range is removed (e.g. rebalanced or merged).
+// when a range is removed (e.g. rebalanced or merged). It doesn't
+// block; if the scanner is backed up, the range stays queued until
+// its turn comes, when it's skipped as the range has been stopped.
 func (rs *rangeScanner) RemoveRange(rng *Range) {
-	rs.removed <- rng
+	select {
+	case rs.removed <- rng:
+	default:
+		log.Warningf("range scanner is backed up; leaving removed range %d queued", rng.Desc.RaftID)
+	}
+}
+
+// scanOnce synchronously offers every range from the iterator to
+// each queue and then resets the iterator, incrementing the scan
+// count. It must not be used while the scan loop is running; tests
+// use it in place of Start to avoid timing dependencies.
+func (rs *rangeScanner) scanOnce() {
+	for rng := rs.iter.Next(); rng != nil; rng = rs.iter.Next() {
+		for _, q := range rs.queues {
+			q.MaybeAdd(rng)
+		}
+	}
+	rs.iter.Reset()
+	atomic.AddInt64(&rs.count, 1)
 }
 
 // scanLoop loops endlessly, scanning through ranges available via
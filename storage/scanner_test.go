@@ -22,6 +22,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
@@ -217,3 +218,43 @@ func TestScannerEmptyIterator(t *testing.T) {
 		t.Errorf("expected three loops; got %d", count)
 	}
 }
+
+// TestScannerRemoveRangeBackedUp verifies that removing ranges doesn't
+// block once the scanner's channel of removed ranges is full.
+func TestScannerRemoveRangeBackedUp(t *testing.T) {
+	s := newRangeScanner(time.Hour, newTestIterator(0), nil)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i <= 2*cap(s.removed); i++ {
+			s.RemoveRange(&Range{Desc: &proto.RangeDescriptor{RaftID: int64(i + 1)}})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("removing ranges blocked on a full channel")
+	}
+	if n := len(s.removed); n != cap(s.removed) {
+		t.Errorf("expected %d removed ranges to be passed on; got %d", cap(s.removed), n)
+	}
+}
+
+// TestScannerScanOnce verifies that a synchronous scan adds all
+// ranges to the queues without starting the scan loop.
+func TestScannerScanOnce(t *testing.T) {
+	const count = 3
+	iter := newTestIterator(count)
+	q1, q2 := &testQueue{}, &testQueue{}
+	s := newRangeScanner(time.Hour, iter, []rangeQueue{q1, q2})
+	s.scanOnce()
+	if q1.count() != count || q2.count() != count {
+		t.Errorf("expected %d ranges in each queue; got %d, %d", count, q1.count(), q2.count())
+	}
+	if c := s.Count(); c != 1 {
+		t.Errorf("expected scan count 1; got %d", c)
+	}
+	if iter.EstimatedCount() != count {
+		t.Errorf("expected iterator to be reset; %d remaining", iter.EstimatedCount())
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// SimulationWorkload describes the synthetic load applied to each
+// range of a Simulation on every tick.
+type SimulationWorkload struct {
+	RangeBytes       int64   // Live bytes in a newly created range
+	OverwriteBytes   int64   // Non-live bytes added to each range per tick
+	IntentBytes      int64   // Intent bytes written to a range per intent
+	IntentFraction   float64 // Fraction of ranges receiving an intent per tick
+	NewRangesPerTick int     // Number of new ranges allocated per tick
+	GCTTLSeconds     int32   // GC TTL for all ranges
+}
+
+// SimulationRange is a range with synthetic stats. It stands in for a
+// Range when computing scan queue priorities.
+type SimulationRange struct {
+	RaftID       int64
+	Replicas     []proto.Replica
+	LiveBytes    int64
+	NonLiveBytes int64
+	IntentBytes  int64
+	ScanMeta     proto.ScanMetadata
+
+	gcableNanos int64 // Time at which bytes first became GC'able; 0 if none
+	queuedNanos int64 // Time at which the range first wanted a scan; 0 if not
+}
+
+// SimulationStore is a store with a fixed capacity whose available
+// bytes are derived from the replicas it holds.
+type SimulationStore struct {
+	Desc StoreDescriptor
+}
+
+// SimulationReport summarizes a Simulation run.
+type SimulationReport struct {
+	Ticks int
+	// GC latency is the delay between a range first having GC'able bytes
+	// and the scan queue processing it.
+	GCCount       int
+	MeanGCLatency time.Duration
+	MaxGCLatency  time.Duration
+	// Queue wait is the delay between a range first being eligible for
+	// the scan queue and being processed.
+	MaxQueueWait time.Duration
+	// Starved is the largest number of ranges observed on any tick
+	// which had gone without a scan for longer than the verification
+	// interval, or the intent sweep interval if they had intents.
+	Starved int
+	// RebalanceTicks is the number of ticks after which the spread of
+	// available capacity across stores stayed within the rebalance
+	// threshold; -1 if it never converged.
+	RebalanceTicks int
+	CapacitySpread float64 // Spread of available capacity at end of run
+}
+
+// String formats the report for display.
+func (r SimulationReport) String() string {
+	return fmt.Sprintf("ticks=%d gc-count=%d gc-latency(mean/max)=%s/%s max-queue-wait=%s "+
+		"starved=%d rebalance-ticks=%d capacity-spread=%.3f",
+		r.Ticks, r.GCCount, r.MeanGCLatency, r.MaxGCLatency, r.MaxQueueWait,
+		r.Starved, r.RebalanceTicks, r.CapacitySpread)
+}
+
+// Simulation models a cluster of stores holding ranges with synthetic
+// stats over simulated time. Each tick applies the workload, runs the
+// scan queue prioritization over every range, processes up to
+// ScansPerTick ranges per store and makes allocator-driven rebalancing
+// decisions. Nothing is written to disk; the simulation exists to
+// evaluate queue and allocator heuristics under different workloads.
+type Simulation struct {
+	Stores   []*SimulationStore
+	Ranges   []*SimulationRange
+	Workload SimulationWorkload
+	Replicas int // Replicas per range
+
+	TickInterval       time.Duration // Simulated time per tick
+	ScansPerTick       int           // Ranges processed per store per tick
+	RebalancesPerTick  int           // Replica moves per tick
+	RebalanceThreshold float64       // Acceptable spread in available capacity
+	GCScorer           GCScorer      // Scores ranges' need for GC
+
+	nowNanos       int64
+	ticks          int
+	nextRaftID     int64
+	alloc          allocator
+	rand           *rand.Rand
+	report         SimulationReport
+	gcLatencyTotal time.Duration
+}
+
+// NewSimulation creates a simulation of storeCount stores, each with
+// the specified capacity in bytes. All randomness, including the
+// allocator's, is derived from seed so runs are reproducible.
+func NewSimulation(storeCount int, capacity int64, workload SimulationWorkload, seed int64) *Simulation {
+	s := &Simulation{
+		Workload:           workload,
+		Replicas:           3,
+		TickInterval:       time.Hour,
+		ScansPerTick:       10,
+		RebalancesPerTick:  1,
+		RebalanceThreshold: 0.05,
+		GCScorer:           DefaultGCScorer,
+		nextRaftID:         1,
+		rand:               rand.New(rand.NewSource(seed)),
+	}
+	s.alloc = allocator{
+		storeFinder: s.findStores,
+		rand:        *rand.New(rand.NewSource(seed)),
+	}
+	for i := 0; i < storeCount; i++ {
+		s.AddStore(capacity)
+	}
+	s.report.RebalanceTicks = -1
+	return s
+}
+
+// AddStore adds an empty store with the specified capacity, as when a
+// node joins the cluster.
+func (s *Simulation) AddStore(capacity int64) *SimulationStore {
+	id := int32(len(s.Stores) + 1)
+	store := &SimulationStore{
+		Desc: StoreDescriptor{
+			StoreID:  id,
+			Node:     NodeDescriptor{NodeID: id},
+			Capacity: engine.StoreCapacity{Capacity: capacity, Available: capacity},
+		},
+	}
+	s.Stores = append(s.Stores, store)
+	return store
+}
+
+// Now returns the current simulated time.
+func (s *Simulation) Now() time.Time {
+	return time.Unix(0, s.nowNanos)
+}
+
+// findStores is the allocator's FindStoreFunc; the simulation has no
+// attributes, so every store matches.
+func (s *Simulation) findStores(required proto.Attributes) ([]*StoreDescriptor, error) {
+	s.updateCapacities()
+	stores := make([]*StoreDescriptor, len(s.Stores))
+	for i, store := range s.Stores {
+		desc := store.Desc
+		stores[i] = &desc
+	}
+	return stores, nil
+}
+
+// updateCapacities recomputes available bytes on each store from the
+// replicas it holds.
+func (s *Simulation) updateCapacities() {
+	used := map[int32]int64{}
+	for _, rng := range s.Ranges {
+		for _, replica := range rng.Replicas {
+			used[replica.StoreID] += rng.LiveBytes + rng.NonLiveBytes + rng.IntentBytes
+		}
+	}
+	for _, store := range s.Stores {
+		store.Desc.Capacity.Available = store.Desc.Capacity.Capacity - used[store.Desc.StoreID]
+	}
+}
+
+// addRange allocates replicas for a new range.
+func (s *Simulation) addRange() error {
+	rng := &SimulationRange{
+		RaftID:    s.nextRaftID,
+		LiveBytes: s.Workload.RangeBytes,
+		ScanMeta:  *proto.NewScanMetadata(s.nowNanos),
+	}
+	rng.ScanMeta.GC.TTLSeconds = s.Workload.GCTTLSeconds
+	s.nextRaftID++
+	for i := 0; i < s.Replicas; i++ {
+		store, err := s.alloc.allocate(proto.Attributes{}, rng.Replicas)
+		if err != nil {
+			return err
+		}
+		rng.Replicas = append(rng.Replicas, proto.Replica{
+			NodeID:  store.Node.NodeID,
+			StoreID: store.StoreID,
+		})
+	}
+	s.Ranges = append(s.Ranges, rng)
+	return nil
+}
+
+// Tick advances the simulation by one TickInterval.
+func (s *Simulation) Tick() error {
+	s.nowNanos += s.TickInterval.Nanoseconds()
+	s.ticks++
+
+	for i := 0; i < s.Workload.NewRangesPerTick; i++ {
+		if err := s.addRange(); err != nil {
+			return err
+		}
+	}
+	for _, rng := range s.Ranges {
+		rng.NonLiveBytes += s.Workload.OverwriteBytes
+		if s.rand.Float64() < s.Workload.IntentFraction {
+			rng.IntentBytes += s.Workload.IntentBytes
+		}
+	}
+
+	s.scan()
+	s.rebalance()
+	s.updateCapacities()
+
+	spread := s.capacitySpread()
+	if spread <= s.RebalanceThreshold {
+		if s.report.RebalanceTicks == -1 {
+			s.report.RebalanceTicks = s.ticks
+		}
+	} else {
+		s.report.RebalanceTicks = -1
+	}
+	return nil
+}
+
+// Run runs the simulation for the specified number of ticks and
+// returns the report.
+func (s *Simulation) Run(ticks int) (SimulationReport, error) {
+	for i := 0; i < ticks; i++ {
+		if err := s.Tick(); err != nil {
+			return s.Report(), err
+		}
+	}
+	return s.Report(), nil
+}
+
+// Report returns a summary of the simulation so far.
+func (s *Simulation) Report() SimulationReport {
+	r := s.report
+	r.Ticks = s.ticks
+	r.CapacitySpread = s.capacitySpread()
+	if r.GCCount > 0 {
+		r.MeanGCLatency = s.gcLatencyTotal / time.Duration(r.GCCount)
+	}
+	return r
+}
+
+// simRangeItem pairs a range with its scan queue priority.
+type simRangeItem struct {
+	rng      *SimulationRange
+	priority float64
+}
+
+type simRangeItems []simRangeItem
+
+func (si simRangeItems) Len() int           { return len(si) }
+func (si simRangeItems) Less(i, j int) bool { return si[i].priority > si[j].priority }
+func (si simRangeItems) Swap(i, j int)      { si[i], si[j] = si[j], si[i] }
+
+// scan computes scan queue priorities for all ranges and processes
+// the highest priority ranges, up to ScansPerTick per store. As with
+// the real scan queue, a range is processed by the store holding its
+// first replica.
+func (s *Simulation) scan() {
+	var items simRangeItems
+	starved := 0
+	for _, rng := range s.Ranges {
+		elapsedNanos := s.nowNanos - rng.ScanMeta.LastScanNanos
+		gc := s.GCScorer.GCScore(GCScoreInputs{
+			ElapsedNanos: elapsedNanos,
+			NonLiveBytes: rng.NonLiveBytes,
+			GC:           rng.ScanMeta.GC,
+		})
+		if rng.gcableNanos == 0 && gc.EstimatedBytes > 0 {
+			rng.gcableNanos = s.nowNanos
+		}
+		if elapsedNanos > verificationInterval.Nanoseconds() ||
+			(rng.IntentBytes > 0 && elapsedNanos > intentSweepInterval.Nanoseconds()) {
+			starved++
+		}
+		if priority := scanQueuePriority(elapsedNanos, elapsedNanos, gc.Score, rng.IntentBytes); priority > 0 {
+			if rng.queuedNanos == 0 {
+				rng.queuedNanos = s.nowNanos
+			}
+			items = append(items, simRangeItem{rng, priority})
+		}
+	}
+	if starved > s.report.Starved {
+		s.report.Starved = starved
+	}
+
+	sort.Sort(items)
+	processed := map[int32]int{}
+	for _, item := range items {
+		storeID := item.rng.Replicas[0].StoreID
+		if processed[storeID] >= s.ScansPerTick {
+			continue
+		}
+		processed[storeID]++
+		s.process(item.rng)
+	}
+}
+
+// process simulates a scan of the range: GC'able bytes are removed,
+// intents are resolved and the scan metadata reset.
+func (s *Simulation) process(rng *SimulationRange) {
+	elapsedNanos := s.nowNanos - rng.ScanMeta.LastScanNanos
+	if gcBytes := rng.ScanMeta.GC.EstimatedBytes(elapsedNanos, rng.NonLiveBytes); gcBytes > 0 {
+		if gcBytes > rng.NonLiveBytes {
+			gcBytes = rng.NonLiveBytes
+		}
+		rng.NonLiveBytes -= gcBytes
+	}
+	if rng.gcableNanos != 0 {
+		latency := time.Duration(s.nowNanos - rng.gcableNanos)
+		s.report.GCCount++
+		s.gcLatencyTotal += latency
+		if latency > s.report.MaxGCLatency {
+			s.report.MaxGCLatency = latency
+		}
+	}
+	if wait := time.Duration(s.nowNanos - rng.queuedNanos); wait > s.report.MaxQueueWait {
+		s.report.MaxQueueWait = wait
+	}
+	rng.IntentBytes = 0
+	rng.gcableNanos, rng.queuedNanos = 0, 0
+
+	// All remaining non-live bytes are younger than the TTL.
+	rng.ScanMeta.LastScanNanos = s.nowNanos
+	for i := range rng.ScanMeta.GC.ByteCounts {
+		rng.ScanMeta.GC.ByteCounts[i] = 0
+	}
+	rng.ScanMeta.GC.ByteCounts[0] = rng.NonLiveBytes
+}
+
+// rebalance moves up to RebalancesPerTick replicas off the fullest
+// store to a store chosen by the allocator, provided the target has
+// more available capacity.
+func (s *Simulation) rebalance() {
+	for i := 0; i < s.RebalancesPerTick; i++ {
+		s.updateCapacities()
+		if len(s.Stores) == 0 || s.capacitySpread() <= s.RebalanceThreshold {
+			return
+		}
+		fullest := s.Stores[0]
+		for _, store := range s.Stores[1:] {
+			if store.Desc.Capacity.PercentAvail() < fullest.Desc.Capacity.PercentAvail() {
+				fullest = store
+			}
+		}
+		// Pick a random range with a replica on the fullest store.
+		var candidates []*SimulationRange
+		for _, rng := range s.Ranges {
+			for _, replica := range rng.Replicas {
+				if replica.StoreID == fullest.Desc.StoreID {
+					candidates = append(candidates, rng)
+				}
+			}
+		}
+		if len(candidates) == 0 {
+			return
+		}
+		rng := candidates[s.rand.Intn(len(candidates))]
+		target, err := s.alloc.allocate(proto.Attributes{}, rng.Replicas)
+		if err != nil || target.Capacity.PercentAvail() <= fullest.Desc.Capacity.PercentAvail() {
+			continue
+		}
+		for j := range rng.Replicas {
+			if rng.Replicas[j].StoreID == fullest.Desc.StoreID {
+				rng.Replicas[j] = proto.Replica{NodeID: target.Node.NodeID, StoreID: target.StoreID}
+				break
+			}
+		}
+	}
+}
+
+// capacitySpread returns the difference between the largest and
+// smallest fraction of available capacity across stores.
+func (s *Simulation) capacitySpread() float64 {
+	if len(s.Stores) == 0 {
+		return 0
+	}
+	min, max := math.MaxFloat64, -math.MaxFloat64
+	for _, store := range s.Stores {
+		pct := store.Desc.Capacity.PercentAvail()
+		min = math.Min(min, pct)
+		max = math.Max(max, pct)
+	}
+	return max - min
+}
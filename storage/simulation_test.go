@@ -0,0 +1,116 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const simMB = int64(1 << 20)
+
+func newTestSimulation(t *testing.T, ranges int, workload SimulationWorkload) *Simulation {
+	s := NewSimulation(3, 1<<30, workload, 0)
+	for i := 0; i < ranges; i++ {
+		if err := s.addRange(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// TestSimulationGC verifies that ranges accumulating non-live bytes
+// are GC'd by the simulated scan queue once bytes outlive the TTL.
+func TestSimulationGC(t *testing.T) {
+	s := newTestSimulation(t, 10, SimulationWorkload{
+		RangeBytes:     64 * simMB,
+		OverwriteBytes: simMB,
+		GCTTLSeconds:   24 * 60 * 60,
+	})
+	report, err := s.Run(72)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.GCCount == 0 {
+		t.Errorf("expected ranges to be GC'd: %s", report)
+	}
+	if report.MaxGCLatency > s.TickInterval {
+		t.Errorf("expected GC latency within one tick with idle queue: %s", report)
+	}
+	for _, rng := range s.Ranges {
+		if rng.NonLiveBytes >= 72*simMB {
+			t.Errorf("range %d: expected non-live bytes to be reduced; got %d", rng.RaftID, rng.NonLiveBytes)
+		}
+	}
+}
+
+// TestSimulationStarvation verifies that ranges which are never
+// processed are reported as starved once the verification interval
+// has elapsed.
+func TestSimulationStarvation(t *testing.T) {
+	s := newTestSimulation(t, 5, SimulationWorkload{RangeBytes: simMB})
+	s.ScansPerTick = 0
+	report, err := s.Run(int(verificationInterval/s.TickInterval) + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Starved != 5 {
+		t.Errorf("expected 5 starved ranges: %s", report)
+	}
+	if report.GCCount != 0 {
+		t.Errorf("expected no GC: %s", report)
+	}
+}
+
+// TestSimulationRebalance verifies that adding an empty store causes
+// replicas to be moved until available capacity converges.
+func TestSimulationRebalance(t *testing.T) {
+	s := newTestSimulation(t, 10, SimulationWorkload{RangeBytes: 64 * simMB})
+	s.AddStore(1 << 30)
+	s.RebalanceThreshold = 0.1
+	report, err := s.Run(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.RebalanceTicks == -1 || report.CapacitySpread > s.RebalanceThreshold {
+		t.Errorf("expected rebalancing to converge: %s", report)
+	}
+}
+
+// TestSimulationDeterministic verifies that simulations with the same
+// seed yield identical reports.
+func TestSimulationDeterministic(t *testing.T) {
+	workload := SimulationWorkload{
+		RangeBytes:       64 * simMB,
+		OverwriteBytes:   simMB,
+		IntentBytes:      1024,
+		IntentFraction:   0.1,
+		NewRangesPerTick: 1,
+		GCTTLSeconds:     int32(time.Hour.Seconds() * 12),
+	}
+	var reports []SimulationReport
+	for i := 0; i < 2; i++ {
+		report, err := NewSimulation(5, 1<<32, workload, 1).Run(48)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, report)
+	}
+	if !reflect.DeepEqual(reports[0], reports[1]) {
+		t.Errorf("expected identical reports: %s != %s", reports[0], reports[1])
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// A SnapshotTransport carries snapshots of ranges between nodes.
+type SnapshotTransport interface {
+	// RequestSnapshot asks the node of delegate to send a snapshot of
+	// its replica of the range described by desc to recipient.
+	RequestSnapshot(delegate, recipient proto.Replica, desc *proto.RangeDescriptor) error
+	// SendSnapshot delivers snap to the store of recipient.
+	SendSnapshot(recipient proto.Replica, snap *proto.RangeBackup) error
+	// SeedReplica asks the store of recipient to seed its replica of
+	// the range described by desc from the backup of the replica on the
+	// store with ID source, and returns the seed's lease applied index.
+	SeedReplica(recipient proto.Replica, source int32, desc *proto.RangeDescriptor) (uint64, error)
+	// CatchUpReplica delivers catchUp to the store of recipient.
+	CatchUpReplica(recipient proto.Replica, catchUp *proto.RangeCatchUp) error
+}
+
+// SetSnapshotTransport sets the transport used to request and send
+// snapshots of ranges to replicas on other nodes. Without one, only
+// replicas on this store's node can be initialized from snapshots.
+func (s *Store) SetSnapshotTransport(st SnapshotTransport) {
+	s.snapshots = st
+}
+
+// localStore returns the store with ID storeID on this store's node,
+// or nil if there is none.
+func (s *Store) localStore(storeID int32) *Store {
+	if s.StoreID() == storeID {
+		return s
+	}
+	if s.nodeStores == nil {
+		return nil
+	}
+	var target *Store
+	s.nodeStores(func(o *Store) error {
+		if o.StoreID() == storeID {
+			target = o
+		}
+		return nil
+	})
+	return target
+}
+
+// nodeRTT returns the gossiped round-trip time in nanoseconds between
+// the nodes with IDs a and b, as measured by either. Returns false if
+// neither has gossiped a measurement.
+func (s *Store) nodeRTT(a, b int32) (int64, bool) {
+	if a == b {
+		return 0, true
+	}
+	if s.gossip == nil {
+		return 0, false
+	}
+	for _, pair := range [][2]int32{{a, b}, {b, a}} {
+		info, err := s.gossip.GetInfo(gossip.MakeLatencyGossipKey(pair[0]))
+		if err != nil {
+			continue
+		}
+		if rtts, ok := info.(map[int32]int64); ok {
+			if rtt, ok := rtts[pair[1]]; ok {
+				return rtt, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// snapshotDelegate returns the replica of the range described by desc
+// which should send a snapshot to recipient: of the replicas other
+// than the recipient, the one whose node has the lowest gossiped
+// round-trip time to the recipient's node. This keeps snapshots for
+// new replicas in a remote locality within that locality rather than
+// sending them across the WAN from the leader. The store's own
+// replica is returned if no other replica is known to be closer.
+func (s *Store) snapshotDelegate(desc *proto.RangeDescriptor, recipient proto.Replica) proto.Replica {
+	delegate := *desc.FindReplica(s.StoreID())
+	best, ok := s.nodeRTT(delegate.NodeID, recipient.NodeID)
+	for _, replica := range desc.Replicas {
+		if replica.StoreID == recipient.StoreID || replica.StoreID == delegate.StoreID {
+			continue
+		}
+		rtt, known := s.nodeRTT(replica.NodeID, recipient.NodeID)
+		if known && (!ok || rtt < best) {
+			delegate, best, ok = replica, rtt, true
+		}
+	}
+	return delegate
+}
+
+// SendSnapshot initializes the replica of rng on recipient from a
+// snapshot. The snapshot is generated and sent by the replica chosen
+// by snapshotDelegate; if that replica fails to send it, this store
+// sends its own.
+func (s *Store) SendSnapshot(rng *Range, recipient proto.Replica) error {
+	rng.RLock()
+	desc := *rng.Desc
+	rng.RUnlock()
+	delegate := s.snapshotDelegate(&desc, recipient)
+	if delegate.StoreID != s.StoreID() {
+		log.Infof("delegating snapshot of range %d for store %d to store %d", desc.RaftID, recipient.StoreID, delegate.StoreID)
+		var err error
+		if source := s.localStore(delegate.StoreID); source != nil {
+			err = source.SnapshotReplica(&desc, recipient)
+		} else if s.snapshots != nil {
+			err = s.snapshots.RequestSnapshot(delegate, recipient, &desc)
+		} else {
+			err = util.Errorf("no snapshot transport")
+		}
+		if err == nil {
+			return nil
+		}
+		log.Warningf("store %d failed to send snapshot of range %d: %s", delegate.StoreID, desc.RaftID, err)
+	}
+	return s.SnapshotReplica(&desc, recipient)
+}
+
+// SnapshotReplica sends a snapshot of this store's replica of the
+// range described by desc to recipient. desc is the leader's
+// descriptor of the range, which lists the recipient, and replaces the
+// replica's own in the snapshot. With relocation backups, the
+// recipient is seeded from the replica's most recent backup instead,
+// and only sent the commands applied since; the full snapshot is sent
+// if that fails.
+func (s *Store) SnapshotReplica(desc *proto.RangeDescriptor, recipient proto.Replica) error {
+	rng, err := s.GetRange(desc.RaftID)
+	if err != nil {
+		return err
+	}
+	if s.relocationBackups != nil {
+		err := s.seedReplica(desc, recipient)
+		if err == nil {
+			return nil
+		}
+		log.Warningf("unable to seed range %d on store %d; sending a snapshot: %s", desc.RaftID, recipient.StoreID, err)
+	}
+	snap, err := s.BackupRange(rng)
+	if err != nil {
+		return err
+	}
+	snap.Desc = *desc
+	if target := s.localStore(recipient.StoreID); target != nil {
+		return target.ApplySnapshot(snap)
+	}
+	if s.snapshots == nil {
+		return util.Errorf("no snapshot transport to send range %d to store %d", desc.RaftID, recipient.StoreID)
+	}
+	return s.snapshots.SendSnapshot(recipient, snap)
+}
+
+// seedReplica initializes the replica on recipient of the range
+// described by desc by seeding it from the most recent backup of this
+// store's replica and catching up the seed with the commands the
+// replica has applied since, read from a consistent snapshot.
+func (s *Store) seedReplica(desc *proto.RangeDescriptor, recipient proto.Replica) error {
+	target := s.localStore(recipient.StoreID)
+	if target == nil && s.snapshots == nil {
+		return util.Errorf("no snapshot transport")
+	}
+	var seedIndex uint64
+	var err error
+	if target != nil {
+		seedIndex, err = target.SeedReplica(desc, s.StoreID())
+	} else {
+		seedIndex, err = s.snapshots.SeedReplica(recipient, s.StoreID(), desc)
+	}
+	if err != nil {
+		return err
+	}
+
+	snap := engine.NewBackgroundSnapshot(s.engine)
+	defer snap.Stop()
+	index, err := leaseAppliedIndex(snap, desc.RaftID)
+	if err != nil {
+		return err
+	}
+	if seedIndex > index {
+		return util.Errorf("backup of range %d is at lease index %d; replica is at %d", desc.RaftID, seedIndex, index)
+	}
+	entries, err := seedEntries(snap, desc.RaftID, seedIndex, index)
+	if err != nil {
+		return err
+	}
+	ms, err := engine.MVCCGetRangeStats(snap, desc.RaftID)
+	if err != nil {
+		return err
+	}
+	catchUp := &proto.RangeCatchUp{
+		Desc:              *desc,
+		Entries:           entries,
+		LeaseAppliedIndex: index,
+		LiveBytes:         ms.LiveBytes,
+		LiveCount:         ms.LiveCount,
+		IntentBytes:       ms.IntentBytes,
+		IntentCount:       ms.IntentCount,
+	}
+	if target != nil {
+		return target.CatchUpReplica(catchUp)
+	}
+	return s.snapshots.CatchUpReplica(recipient, catchUp)
+}
+
+// checkNewReplica returns an error unless a new replica of the range
+// described by desc may be initialized on this store: desc must list
+// the store, which must neither hold the range nor be relocating it.
+func (s *Store) checkNewReplica(desc *proto.RangeDescriptor) error {
+	if desc.FindReplica(s.StoreID()) == nil {
+		return util.Errorf("store %d is not a replica of range %d", s.StoreID(), desc.RaftID)
+	}
+	if _, err := s.GetRange(desc.RaftID); err == nil {
+		return util.Errorf("store %d already holds range %d", s.StoreID(), desc.RaftID)
+	}
+	s.mu.Lock()
+	_, relocating := s.relocating[desc.RaftID]
+	s.mu.Unlock()
+	if relocating {
+		return util.Errorf("store %d is relocating range %d", s.StoreID(), desc.RaftID)
+	}
+	return nil
+}
+
+// clearSeed destroys the data of the range described by desc left on
+// this store by an earlier seed which wasn't caught up.
+func (s *Store) clearSeed(desc *proto.RangeDescriptor) error {
+	seed, err := NewRange(desc, seedRangeManager{s})
+	if err != nil {
+		return err
+	}
+	return seed.Destroy()
+}
+
+// SeedReplica seeds a new replica on this store of the range described
+// by desc, which lists the store, from the most recent backup in the
+// store's relocation backups of the replica on the store with ID
+// source. Returns the seed's lease applied index. The seed is started
+// once CatchUpReplica has caught it up with the source replica. The
+// backup's range descriptor isn't written, so a seed left behind by a
+// restart isn't loaded; it is cleared by the next seed or snapshot of
+// the range.
+func (s *Store) SeedReplica(desc *proto.RangeDescriptor, source int32) (uint64, error) {
+	if err := s.checkNewReplica(desc); err != nil {
+		return 0, err
+	}
+	if s.relocationBackups == nil {
+		return 0, util.Errorf("store %d has no relocation backups", s.StoreID())
+	}
+	backup, err := s.readRangeBackup(source, desc.RaftID)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkBackup(backup, desc); err != nil {
+		return 0, err
+	}
+	if err := s.clearSeed(desc); err != nil {
+		return 0, err
+	}
+	descKey := engine.RangeDescriptorKey(desc.StartKey)
+	batch := s.engine.NewBatch()
+	for _, kv := range backup.Data {
+		if key, _, _ := engine.MVCCDecodeKey(kv.Key); key.Equal(descKey) {
+			continue
+		}
+		if err := batch.Put(kv.Key, kv.Value); err != nil {
+			return 0, err
+		}
+	}
+	if err := batch.Commit(); err != nil {
+		return 0, err
+	}
+	seed, err := NewRange(desc, seedRangeManager{s})
+	if err != nil {
+		return 0, err
+	}
+	seed.RLock()
+	defer seed.RUnlock()
+	log.Infof("seeded range %d on store %d from backup of store %d taken at %s", desc.RaftID, s.StoreID(), source,
+		time.Unix(0, backup.WallTime).UTC())
+	return seed.leaseAppliedIndex, nil
+}
+
+// CatchUpReplica catches up the seed of a new replica on this store,
+// written by SeedReplica, by applying the commands of catchUp, and
+// starts the replica. If the caught-up seed doesn't match the replica
+// which sent the commands, the seed is destroyed and an error
+// returned.
+func (s *Store) CatchUpReplica(catchUp *proto.RangeCatchUp) error {
+	desc := catchUp.Desc
+	if err := s.checkNewReplica(&desc); err != nil {
+		return err
+	}
+	seed, err := NewRange(&desc, seedRangeManager{s})
+	if err != nil {
+		return err
+	}
+	index, err := replaySeed(seed, catchUp.Entries)
+	if err != nil {
+		return s.discardSeed(&desc, err)
+	}
+	seedMS, err := engine.MVCCGetRangeStats(s.engine, desc.RaftID)
+	if err != nil {
+		return s.discardSeed(&desc, err)
+	}
+	ms := &engine.MVCCStats{
+		LiveBytes:   catchUp.LiveBytes,
+		LiveCount:   catchUp.LiveCount,
+		IntentBytes: catchUp.IntentBytes,
+		IntentCount: catchUp.IntentCount,
+	}
+	if !seedMatches(desc.RaftID, index, catchUp.LeaseAppliedIndex, seedMS, ms) {
+		return s.discardSeed(&desc, util.Errorf("caught-up seed of range %d doesn't match its replica", desc.RaftID))
+	}
+	if err := engine.MVCCPutProto(s.engine, nil, engine.RangeDescriptorKey(desc.StartKey), s.clock.Now(), nil, &desc); err != nil {
+		return s.discardSeed(&desc, err)
+	}
+	if err := s.addNewReplica(&desc); err != nil {
+		return err
+	}
+	log.Infof("store %d: caught up seed of range %d with %d command(s)", s.StoreID(), desc.RaftID, len(catchUp.Entries))
+	return nil
+}
+
+// discardSeed destroys the seed of the range described by desc and
+// returns err, the reason it was discarded.
+func (s *Store) discardSeed(desc *proto.RangeDescriptor, err error) error {
+	if cErr := s.clearSeed(desc); cErr != nil {
+		log.Errorf("unable to destroy seed of range %d: %s", desc.RaftID, cErr)
+	}
+	return err
+}
+
+// ApplySnapshot initializes a replica on this store from snap, a
+// snapshot of a range which lists this store among its replicas.
+// Snapshots of ranges the store already holds are refused.
+func (s *Store) ApplySnapshot(snap *proto.RangeBackup) error {
+	desc := snap.Desc
+	if err := s.checkNewReplica(&desc); err != nil {
+		return err
+	}
+	if err := s.clearSeed(&desc); err != nil {
+		return err
+	}
+
+	batch := s.engine.NewBatch()
+	for _, kv := range snap.Data {
+		if err := batch.Put(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	if err := engine.MVCCPutProto(batch, nil, engine.RangeDescriptorKey(desc.StartKey), s.clock.Now(), nil, &desc); err != nil {
+		return err
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	if err := s.addNewReplica(&desc); err != nil {
+		return err
+	}
+	log.Infof("store %d: applied snapshot of range %d", s.StoreID(), desc.RaftID)
+	return nil
+}
+
+// addNewReplica starts a new replica of the range described by desc,
+// whose data has been written to the store, and accounts for it in
+// the store stats. The data is destroyed if the replica can't be
+// added.
+func (s *Store) addNewReplica(desc *proto.RangeDescriptor) error {
+	rng, err := NewRange(desc, s)
+	if err != nil {
+		return err
+	}
+	if err := s.AddRange(rng); err != nil {
+		if dErr := rng.Destroy(); dErr != nil {
+			log.Errorf("unable to destroy new replica of range %d: %s", desc.RaftID, dErr)
+		}
+		return err
+	}
+	ms, err := engine.MVCCGetRangeStats(s.engine, desc.RaftID)
+	if err != nil {
+		return util.Errorf("unable to fetch stats for range %d: %s", desc.RaftID, err)
+	}
+	ms.MergeStats(s.engine, 0, s.StoreID())
+	return nil
+}
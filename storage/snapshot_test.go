@@ -0,0 +1,262 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/cloud"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestSnapshotDelegate verifies that the replica whose node is nearest
+// to the recipient's is chosen to send a snapshot, and that the
+// store's own replica is chosen without gossiped round-trip times.
+func TestSnapshotDelegate(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	desc := &proto.RangeDescriptor{
+		RaftID: 1,
+		Replicas: []proto.Replica{
+			{NodeID: 1, StoreID: store.StoreID()},
+			{NodeID: 2, StoreID: 2},
+			{NodeID: 3, StoreID: 3},
+			{NodeID: 4, StoreID: 4},
+		},
+	}
+	recipient := desc.Replicas[3]
+
+	if d := store.snapshotDelegate(desc, recipient); d.StoreID != store.StoreID() {
+		t.Errorf("expected store's own replica without round-trip times; got store %d", d.StoreID)
+	}
+	rtts := map[int32]int64{1: int64(100 * time.Millisecond), 2: int64(5 * time.Millisecond), 3: int64(50 * time.Millisecond)}
+	if err := store.Gossip().AddInfo(gossip.MakeLatencyGossipKey(4), rtts, 0*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := store.snapshotDelegate(desc, recipient); d.StoreID != 2 {
+		t.Errorf("expected replica on store 2 nearest to the recipient; got store %d", d.StoreID)
+	}
+}
+
+// TestStoreSendSnapshot verifies that a replica added on another store
+// of the node is initialized from a snapshot holding the range's data,
+// and that a second snapshot of the range is refused.
+func TestStoreSendSnapshot(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	other := NewStore(store.clock, engine.NewInMem(proto.Attributes{}, 1<<20), store.db, nil)
+	if err := other.Bootstrap(proto.StoreIdent{NodeID: store.Ident.NodeID, StoreID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+	visit := func(visit func(*Store) error) error {
+		for _, s := range []*Store{store, other} {
+			if err := visit(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	store.SetNodeStores(visit)
+	other.SetNodeStores(visit)
+
+	value := proto.Value{Bytes: []byte("value")}
+	if err := engine.MVCCPut(store.Engine(), nil, proto.Key("a"), store.clock.Now(), value, nil); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := proto.Replica{NodeID: store.Ident.NodeID, StoreID: other.StoreID()}
+	rng.Lock()
+	rng.Desc.Replicas = append(rng.Desc.Replicas, recipient)
+	rng.Unlock()
+
+	if err := store.SendSnapshot(rng, recipient); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetRange(1); err != nil {
+		t.Fatalf("expected replica of range 1 on store 2: %s", err)
+	}
+	if v, err := engine.MVCCGet(other.Engine(), proto.Key("a"), store.clock.Now(), nil); err != nil || v == nil || string(v.Bytes) != "value" {
+		t.Errorf("expected value to be copied by the snapshot; got %v, %v", v, err)
+	}
+	if err := store.SendSnapshot(rng, recipient); err == nil {
+		t.Error("expected a snapshot of a range held by the recipient to be refused")
+	}
+}
+
+// loopbackSnapshotTransport delivers the snapshots, seeds and
+// catch-ups sent through it to its stores in-process, and counts the
+// snapshots.
+type loopbackSnapshotTransport struct {
+	stores    map[int32]*Store
+	snapshots int
+}
+
+func (st *loopbackSnapshotTransport) store(storeID int32) (*Store, error) {
+	s, ok := st.stores[storeID]
+	if !ok {
+		return nil, util.Errorf("unknown store %d", storeID)
+	}
+	return s, nil
+}
+
+func (st *loopbackSnapshotTransport) RequestSnapshot(delegate, recipient proto.Replica, desc *proto.RangeDescriptor) error {
+	s, err := st.store(delegate.StoreID)
+	if err != nil {
+		return err
+	}
+	return s.SnapshotReplica(desc, recipient)
+}
+
+func (st *loopbackSnapshotTransport) SendSnapshot(recipient proto.Replica, snap *proto.RangeBackup) error {
+	s, err := st.store(recipient.StoreID)
+	if err != nil {
+		return err
+	}
+	st.snapshots++
+	return s.ApplySnapshot(snap)
+}
+
+func (st *loopbackSnapshotTransport) SeedReplica(recipient proto.Replica, source int32, desc *proto.RangeDescriptor) (uint64, error) {
+	s, err := st.store(recipient.StoreID)
+	if err != nil {
+		return 0, err
+	}
+	return s.SeedReplica(desc, source)
+}
+
+func (st *loopbackSnapshotTransport) CatchUpReplica(recipient proto.Replica, catchUp *proto.RangeCatchUp) error {
+	s, err := st.store(recipient.StoreID)
+	if err != nil {
+		return err
+	}
+	return s.CatchUpReplica(catchUp)
+}
+
+// TestStoreSeedReplicaFromBackup verifies that a replica added on a
+// new node is seeded from the most recent backup of the sending
+// replica and caught up by replaying the commands applied since,
+// rather than sent a full snapshot, and that a seed which doesn't
+// match the replica once caught up is discarded.
+func TestStoreSeedReplicaFromBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relocation-backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	es, err := cloud.FromURI(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	other := NewStore(store.clock, engine.NewInMem(proto.Attributes{}, 1<<20), store.db, nil)
+	if err := other.Bootstrap(proto.StoreIdent{NodeID: 2, StoreID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+	store.SetRelocationBackups(es)
+	other.SetRelocationBackups(es)
+	snapshots := &loopbackSnapshotTransport{stores: map[int32]*Store{other.StoreID(): other}}
+	store.SetSnapshotTransport(snapshots)
+
+	put := func(key, value string) {
+		pArgs, pReply := putArgs([]byte(key), []byte(value), 1, store.StoreID())
+		if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("b", "value")
+	if _, err := store.BackupRanges(es); err != nil {
+		t.Fatal(err)
+	}
+	put("b", "value2")
+	put("c", "value")
+	// A value written outside of Raft, without updating the stats, is
+	// only carried by a full snapshot.
+	if err := engine.MVCCPut(store.Engine(), nil, proto.Key("x"), store.clock.Now(), proto.Value{Bytes: []byte("value")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rng, err := store.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := proto.Replica{NodeID: 2, StoreID: other.StoreID()}
+	rng.Lock()
+	rng.Desc.Replicas = append(append([]proto.Replica(nil), rng.Desc.Replicas...), recipient)
+	desc := *rng.Desc
+	rng.Unlock()
+
+	if err := store.SendSnapshot(rng, recipient); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots.snapshots != 0 {
+		t.Errorf("expected the replica to be seeded rather than sent %d snapshot(s)", snapshots.snapshots)
+	}
+	if _, err := other.GetRange(1); err != nil {
+		t.Fatalf("expected replica of range 1 on store 2: %s", err)
+	}
+	for key, want := range map[string]string{"b": "value2", "c": "value"} {
+		if v, err := engine.MVCCGet(other.Engine(), proto.Key(key), store.clock.Now(), nil); err != nil || v == nil || string(v.Bytes) != want {
+			t.Errorf("expected %q to be caught up to %q; got %v, %v", key, want, v, err)
+		}
+	}
+	if v, err := engine.MVCCGet(other.Engine(), proto.Key("x"), store.clock.Now(), nil); err != nil || v != nil {
+		t.Errorf("expected seeded replica to lack the value written outside of Raft; got %v, %v", v, err)
+	}
+
+	// A seed whose live stats don't match the replica's once caught up
+	// is discarded.
+	third := NewStore(store.clock, engine.NewInMem(proto.Attributes{}, 1<<20), store.db, nil)
+	if err := third.Bootstrap(proto.StoreIdent{NodeID: 3, StoreID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := third.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer third.Stop()
+	third.SetRelocationBackups(es)
+	desc.Replicas = append(desc.Replicas, proto.Replica{NodeID: 3, StoreID: third.StoreID()})
+	index, err := third.SeedReplica(&desc, store.StoreID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := third.CatchUpReplica(&proto.RangeCatchUp{Desc: desc, LeaseAppliedIndex: index, LiveCount: -1}); err == nil {
+		t.Error("expected a seed not matching the replica to be refused")
+	}
+	if _, err := third.GetRange(1); err == nil {
+		t.Error("expected no replica of range 1 on store 3")
+	}
+	if v, err := engine.MVCCGet(third.Engine(), proto.Key("b"), store.clock.Now(), nil); err != nil || v != nil {
+		t.Errorf("expected the discarded seed to be destroyed; got %v, %v", v, err)
+	}
+}
@@ -22,19 +22,23 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/client"
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/multiraft"
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/cloud"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/encoding"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 	gogoproto "github.com/gogo/protobuf/proto"
 )
 
@@ -49,6 +53,9 @@ const (
 	// defaultScanInterval is the default value for the scan interval
 	// command line flag.
 	defaultScanInterval = 10 * time.Minute
+	// queueProcessInterval is the pause between attempts to process
+	// ranges from a store's queues while all of them are idle.
+	queueProcessInterval = 1 * time.Second
 )
 
 var (
@@ -64,6 +71,19 @@ var (
 		"--scan_interval to adjust the target for the duration of a single scan "+
 		"through a store's ranges. The scan is slowed as necessary to approximately"+
 		"achieve this duration.")
+
+	// storeCmdLatency records the latency in nanoseconds of commands
+	// executed by the node's stores, including retries.
+	storeCmdLatency = metrics.DefaultRegistry.Histogram("store.cmd.latency", metrics.DefaultWindow)
+	// storeCmdErrors counts the commands which failed.
+	storeCmdErrors = metrics.DefaultRegistry.Counter("store.cmd.errors")
+	// storeMethodMetrics record the latency of the commands of each
+	// method, and the retries, transaction pushes and waits on known
+	// write intents they incurred.
+	storeMethodMetrics = metrics.DefaultRegistry.MethodMetrics("store.cmd.", "retries", "pushes", "lock_waits")
+	// storeSyncLatency records the latency in nanoseconds of the WAL
+	// syncs of the node's stores' heartbeats.
+	storeSyncLatency = metrics.DefaultRegistry.Histogram("store.wal.sync_latency", metrics.DefaultWindow)
 )
 
 // verifyKeyLength verifies key length. Extra key length is allowed for
@@ -153,10 +173,12 @@ type NodeDescriptor struct {
 // StoreDescriptor holds store information including store attributes,
 // node descriptor and store capacity.
 type StoreDescriptor struct {
-	StoreID  int32
-	Attrs    proto.Attributes // store specific attributes (e.g. ssd, hdd, mem)
-	Node     NodeDescriptor
-	Capacity engine.StoreCapacity
+	StoreID   int32
+	Attrs     proto.Attributes // store specific attributes (e.g. ssd, hdd, mem)
+	Node      NodeDescriptor
+	Capacity  engine.StoreCapacity
+	Suspect   bool // true if the store's disk syncs are persistently slow
+	WarmingUp bool // true while the store warms up after a restart
 }
 
 // CombinedAttrs returns the full list of attributes for the store,
@@ -185,11 +207,11 @@ func newStoreRangeIterator(store *Store) *storeRangeIterator {
 	r := &storeRangeIterator{
 		store: store,
 	}
-	r.reset()
+	r.Reset()
 	return r
 }
 
-func (si *storeRangeIterator) next() *Range {
+func (si *storeRangeIterator) Next() *Range {
 	si.store.mu.Lock()
 	defer si.store.mu.Unlock()
 	if index, remaining := si.index, len(si.store.rangesByKey)-si.index; remaining > 0 {
@@ -200,17 +222,55 @@ func (si *storeRangeIterator) next() *Range {
 	return nil
 }
 
-func (si *storeRangeIterator) estimatedCount() int {
+func (si *storeRangeIterator) EstimatedCount() int {
 	return si.remaining
 }
 
-func (si *storeRangeIterator) reset() {
+func (si *storeRangeIterator) Reset() {
 	si.store.mu.Lock()
 	defer si.store.mu.Unlock()
 	si.remaining = len(si.store.rangesByKey)
 	si.index = 0
 }
 
+// A storeQueue adapts one of a store's queues, which are not thread
+// safe, to the rangeQueue interface by serializing all access to it
+// on the store's queueMu. Next processes the highest priority range.
+type storeQueue struct {
+	mu *sync.Mutex
+	bq *baseQueue
+}
+
+func (sq *storeQueue) Next() *Range {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	return sq.bq.Pop()
+}
+
+func (sq *storeQueue) MaybeAdd(rng *Range) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	sq.bq.MaybeAdd(rng)
+}
+
+func (sq *storeQueue) MaybeRemove(rng *Range) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	sq.bq.MaybeRemove(rng)
+}
+
+func (sq *storeQueue) Clear() {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	sq.bq.Clear()
+}
+
+// A SplitKeyFunc adjusts a key at which a range is to be split, so
+// that data which is accessed together, such as the rows of tables
+// interleaved in a parent row, isn't divided between ranges. It
+// returns the key at which to split instead, which may be key itself.
+type SplitKeyFunc func(key proto.Key) (proto.Key, error)
+
 // A Store maintains a map of ranges by start key. A Store corresponds
 // to one physical device.
 type Store struct {
@@ -225,11 +285,49 @@ type Store struct {
 	raftIDAlloc *IDAllocator   // Raft ID allocator
 	configMu    sync.Mutex     // Limit config update processing
 	raft        raftInterface
+	raftMetrics *raftMetrics // Replication health of the store's ranges
 	closer      chan struct{}
 
+	// raftIntercept, if set before Start, is passed to the raft
+	// implementation to intercept committed commands. For testing.
+	raftIntercept raftInterceptor
+
+	// txnStatuses caches the final status of recently pushed
+	// transactions so their remaining intents are resolved without
+	// pushing again.
+	txnStatuses *txnStatusCache
+
+	scanQueue      *scanQueue      // Scan (GC, intent sweep and verification) queue
+	rebalanceQueue *rebalanceQueue // Moves ranges between the node's stores
+	replicateQueue *replicateQueue // Adds and removes replicas to match zones
+	queues         []*baseQueue    // Queues registered for runtime state switches
+	queueMu        sync.Mutex      // Serializes access to queues
+	queueStopper   *util.Stopper   // Stops processing of queues
+	scanner        *rangeScanner   // Scans ranges into queues; protected by mu
+	nodeStores     StoreVisitor    // Visits all stores on this store's node
+	splitKeyFunc   SplitKeyFunc    // Adjusts split keys chosen by size
+	warmup         storeWarmup     // Ramps up work after a restart
+
+	// relocationBackups, if set, holds the range backups from which
+	// ranges relocated to the store are seeded.
+	relocationBackups cloud.ExternalStorage
+	// snapshots, if set, carries snapshots of ranges to and from
+	// replicas on other nodes.
+	snapshots SnapshotTransport
+
+	// heartbeatStarted is the wall time in nanoseconds at which the
+	// outstanding disk heartbeat began, or zero. Accessed atomically.
+	heartbeatStarted int64
+	// slowSyncs counts consecutive heartbeats whose WAL sync exceeded
+	// SlowSyncThreshold. Accessed atomically.
+	slowSyncs int32
+
 	mu          sync.RWMutex     // Protects variables below...
 	ranges      map[int64]*Range // Map of ranges by Raft ID
 	rangesByKey RangeSlice       // Sorted slice of ranges by StartKey
+	// relocating holds the descriptors of ranges copied to the store by
+	// relocations which have yet to finish, by Raft ID.
+	relocating map[int64]*proto.RangeDescriptor
 }
 
 var _ multiraft.Storage = &Store{}
@@ -246,13 +344,102 @@ func NewStore(clock *hlc.Clock, eng engine.Engine, db *client.KV, gossip *gossip
 		gossip:    gossip,
 		closer:    make(chan struct{}),
 		ranges:    map[int64]*Range{},
+
+		txnStatuses: newTxnStatusCache(defaultTxnStatusCacheSize),
+		raftMetrics: newRaftMetrics(),
 	}
-	s.allocator.storeFinder = s.findStores
+	s.allocator.storeFinder = s.FindStores
+	s.scanQueue = newScanQueue()
+	s.registerQueue(s.scanQueue.baseQueue)
+	s.rebalanceQueue = newRebalanceQueue(s)
+	s.registerQueue(s.rebalanceQueue.baseQueue)
+	s.replicateQueue = newReplicateQueue(s)
+	s.registerQueue(s.replicateQueue.baseQueue)
 	return s
 }
 
-// Stop calls Range.Stop() on all active ranges.
+// SetNodeStores sets the visitor used to find the other stores on
+// this store's node, between which ranges are rebalanced.
+func (s *Store) SetNodeStores(visit StoreVisitor) {
+	s.nodeStores = visit
+}
+
+// SetSplitKeyFunc sets the function used to adjust the keys at which
+// ranges are split when the split key is chosen by size.
+func (s *Store) SetSplitKeyFunc(fn SplitKeyFunc) {
+	s.splitKeyFunc = fn
+}
+
+// AdjustSplitKey returns the key at which to split a range instead
+// of key, a split key chosen by size.
+func (s *Store) AdjustSplitKey(key proto.Key) (proto.Key, error) {
+	if s.splitKeyFunc == nil {
+		return key, nil
+	}
+	return s.splitKeyFunc(key)
+}
+
+// MayLead returns whether the store's replica of rng may lead the
+// range, which it may not for some ranges while the store warms up
+// after a restart.
+func (s *Store) MayLead(rng *Range) bool {
+	return s.warmup.mayLead(time.Unix(0, s.clock.PhysicalNow()), rng, s.hasWarmVoter)
+}
+
+// registerQueue makes the queue's state controllable via
+// SetQueueState and sets its initial state from QueueStatesEnvVar.
+func (s *Store) registerQueue(bq *baseQueue) {
+	s.queues = append(s.queues, bq)
+	bq.stalled = s.Stalled
+	bq.warmup = &s.warmup
+	bq.setClock(s.clock)
+	states, err := parseQueueStates(os.Getenv(QueueStatesEnvVar))
+	if err != nil {
+		log.Errorf("ignoring %s: %s", QueueStatesEnvVar, err)
+		return
+	}
+	if state, ok := states[bq.name]; ok {
+		bq.SetState(state)
+	}
+}
+
+// SetQueueState pauses, disables or re-enables the named queue (e.g.
+// "scan") on this store. The change takes effect without a restart.
+func (s *Store) SetQueueState(name string, state QueueState) error {
+	for _, bq := range s.queues {
+		if bq.name == name {
+			bq.SetState(state)
+			return nil
+		}
+	}
+	return util.Errorf("store %d has no queue named %q", s.StoreID(), name)
+}
+
+// QueueStates returns the state of each of the store's queues by name.
+func (s *Store) QueueStates() map[string]QueueState {
+	states := map[string]QueueState{}
+	for _, bq := range s.queues {
+		states[bq.name] = bq.State()
+	}
+	return states
+}
+
+// Stop stops the store's queues and calls Range.Stop() on all active
+// ranges.
 func (s *Store) Stop() {
+	s.mu.Lock()
+	scanner, queueStopper := s.scanner, s.queueStopper
+	s.scanner, s.queueStopper = nil, nil
+	s.mu.Unlock()
+	// Wait for the range being processed, if any, before stopping
+	// ranges; the queues' checkpoints are kept for the restart.
+	if queueStopper != nil {
+		queueStopper.Stop()
+	}
+	if scanner != nil {
+		scanner.Stop()
+	}
+
 	s.mu.Lock()
 	for _, rng := range s.ranges {
 		rng.stop()
@@ -304,13 +491,52 @@ func (s *Store) Start() error {
 		return &NotBootstrappedError{}
 	}
 
+	// Bring the store's on-disk format up to date before reading any
+	// other data.
+	if _, err := MigrateStore(s.engine, false); err != nil {
+		return err
+	}
+
+	// A store which has written a disk heartbeat before is restarting;
+	// it warms up rather than taking on its full load at once.
+	var lastHeartbeat proto.Timestamp
+	if ok, err := engine.MVCCGetProto(s.engine, engine.StoreHeartbeatKey(), proto.ZeroTimestamp, nil, &lastHeartbeat); err != nil {
+		return err
+	} else if ok && storeWarmupDuration.Get() > 0 {
+		s.warmup.begin(time.Unix(0, s.clock.PhysicalNow()))
+		log.Infof("store %d: restarting; warming up over %s", s.StoreID(), storeWarmupDuration.Get())
+	}
+
 	// Iterator over all range-local key-based data.
 	start := engine.RangeDescriptorKey(engine.KeyMin)
 	end := engine.RangeDescriptorKey(engine.KeyMax)
 
-	s.raft = newSingleNodeRaft(s)
+	snr := newSingleNodeRaft(s, s.raftIntercept, s.raftMetrics)
+	s.registerRaftMetrics(snr.mr)
+	s.raft = snr
 	// Start Raft processing goroutine.
-	go s.processRaft(s.raft, s.closer)
+	go util.RunLabeled("raft", func() { s.processRaft(s.raft, s.closer) })
+	// Start disk heartbeat goroutine.
+	closer := s.closer
+	go util.RunLabeled("heartbeat", func() { s.startHeartbeat(closer) })
+
+	// Ranges copied to the store by unfinished relocations aren't
+	// loaded until ResolveRelocations decides their fate.
+	relocating := map[int64]*proto.RangeDescriptor{}
+	relocStart := engine.MakeStoreKey(engine.KeyLocalStoreRelocationSuffix, proto.Key{})
+	if err := engine.MVCCIterateCommitted(s.engine, relocStart, relocStart.PrefixEnd(), func(kv proto.KeyValue) (bool, error) {
+		desc := &proto.RangeDescriptor{}
+		if err := gogoproto.Unmarshal(kv.Value.Bytes, desc); err != nil {
+			return false, err
+		}
+		relocating[desc.RaftID] = desc
+		return false, nil
+	}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.relocating = relocating
+	s.mu.Unlock()
 
 	// Iterate over all range descriptors, using just committed
 	// versions. Uncommitted intents which have been abandoned due to a
@@ -326,6 +552,9 @@ func (s *Store) Start() error {
 		if err := gogoproto.Unmarshal(kv.Value.Bytes, &desc); err != nil {
 			return false, err
 		}
+		if _, ok := relocating[desc.RaftID]; ok {
+			return false, nil
+		}
 		rng, err := NewRange(&desc, s)
 		if err != nil {
 			return false, err
@@ -346,6 +575,21 @@ func (s *Store) Start() error {
 	// Sort the rangesByKey slice after they've all been added.
 	sort.Sort(s.rangesByKey)
 
+	// Validate store-local invariants before serving any commands.
+	if err := s.checkConsistency(); err != nil {
+		return err
+	}
+	if err := s.recordAttrs(); err != nil {
+		return err
+	}
+	// Resume the work of the store's queues from before the restart.
+	for _, bq := range s.queues {
+		if err := bq.loadCheckpoint(s.engine, s.GetRange); err != nil {
+			return err
+		}
+	}
+	s.startQueues()
+
 	// Register callbacks for any changes to accounting and zone
 	// configurations; we split ranges along prefix boundaries.
 	// Gossip is only ever nil for unittests.
@@ -360,8 +604,55 @@ func (s *Store) Start() error {
 	return nil
 }
 
+// startQueues starts a range scanner which offers the store's ranges
+// to its queues over the course of each scan interval, and a goroutine
+// processing the queued ranges.
+func (s *Store) startQueues() {
+	queues := make([]rangeQueue, len(s.queues))
+	for i, bq := range s.queues {
+		queues[i] = &storeQueue{mu: &s.queueMu, bq: bq}
+	}
+	scanner := newRangeScanner(*scanInterval, newStoreRangeIterator(s), queues)
+	stopper := util.NewStopper(1)
+	s.mu.Lock()
+	s.scanner, s.queueStopper = scanner, stopper
+	s.mu.Unlock()
+	scanner.Start()
+	go util.RunLabeled("queues", func() { processQueues(queues, stopper) })
+}
+
+// processQueues processes ranges from each of queues in turn, pausing
+// for queueProcessInterval whenever none has a range to process, until
+// stopper is stopped.
+func processQueues(queues []rangeQueue, stopper *util.Stopper) {
+	for {
+		var processed bool
+		for _, q := range queues {
+			select {
+			case <-stopper.ShouldStop():
+				stopper.SetStopped()
+				return
+			default:
+			}
+			if q.Next() != nil {
+				processed = true
+			}
+		}
+		if processed {
+			continue
+		}
+		select {
+		case <-time.After(queueProcessInterval):
+		case <-stopper.ShouldStop():
+			stopper.SetStopped()
+			return
+		}
+	}
+}
+
 // configGossipUpdate is a callback for gossip updates to
-// configuration maps which affect range split boundaries.
+// configuration maps which affect range split boundaries and, for
+// zone configs, range replication.
 func (s *Store) configGossipUpdate(key string, contentsChanged bool) {
 	s.configMu.Lock()
 	defer s.configMu.Unlock()
@@ -382,6 +673,9 @@ func (s *Store) configGossipUpdate(key string, contentsChanged bool) {
 			return
 		}
 		s.maybeSplitRangesByConfigs(configMap)
+		if key == gossip.KeyConfigZone {
+			s.checkReplicationByConfigs(configMap)
+		}
 	default:
 		log.Warningf("unhandled gossip update to key %s", key)
 		return
@@ -438,6 +732,47 @@ func (s *Store) maybeSplitRangesByConfigs(configMap PrefixConfigMap) {
 	}
 }
 
+// checkReplicationByConfigs returns the ranges led by this store
+// whose number of replicas differs from that specified by the zone
+// config of the zone containing them, and offers them to the
+// replicate queue, which converges them to their zone's replication
+// factor. It's invoked once per change to the zone configs.
+func (s *Store) checkReplicationByConfigs(configMap PrefixConfigMap) []*Range {
+	misreplicated := s.findMisreplicated(configMap)
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	for _, rng := range misreplicated {
+		s.replicateQueue.MaybeAdd(rng)
+	}
+	return misreplicated
+}
+
+// findMisreplicated returns the ranges led by this store whose number
+// of replicas differs from that specified by the zone config of the
+// zone containing them, logging each at verbosity level 1.
+func (s *Store) findMisreplicated(configMap PrefixConfigMap) []*Range {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var misreplicated []*Range
+	for _, rng := range s.rangesByKey {
+		if !rng.IsLeader() {
+			continue
+		}
+		zone, ok := configMap.MatchByPrefix(rng.Desc.StartKey).Config.(*proto.ZoneConfig)
+		if !ok {
+			continue
+		}
+		if want, have := len(zone.ReplicaAttrs), len(rng.Desc.Replicas); want != have {
+			if log.V(1) {
+				log.Infof("range %d [%q, %q) has %d replica(s); its zone config specifies %d",
+					rng.Desc.RaftID, rng.Desc.StartKey, rng.Desc.EndKey, have, want)
+			}
+			misreplicated = append(misreplicated, rng)
+		}
+	}
+	return misreplicated
+}
+
 // Bootstrap writes a new store ident to the underlying engine. To
 // ensure that no crufty data already exists in the engine, it scans
 // the engine contents before writing the new store ident. The engine
@@ -454,8 +789,14 @@ func (s *Store) Bootstrap(ident proto.StoreIdent) error {
 	} else if len(kvs) > 0 {
 		return util.Errorf("non-empty engine %s (first key: %q)", s.engine, kvs[0].Key)
 	}
-	err = engine.MVCCPutProto(s.engine, nil, engine.StoreIdentKey(), proto.ZeroTimestamp, nil, &s.Ident)
-	return err
+	if err := engine.MVCCPutProto(s.engine, nil, engine.StoreIdentKey(), proto.ZeroTimestamp, nil, &s.Ident); err != nil {
+		return err
+	}
+	if err := s.recordAttrs(); err != nil {
+		return err
+	}
+	// New stores are written in the current format.
+	return writeStoreVersion(s.engine, StoreVersion())
 }
 
 // GetRange fetches a range by Raft ID. Returns an error if no range is found.
@@ -665,8 +1006,8 @@ func (s *Store) addRangeInternal(rng *Range, resort bool) error {
 	return nil
 }
 
-// RemoveRange removes the range from the store's range map and from
-// the sorted rangesByKey slice.
+// RemoveRange removes the range from the store's range map, from the
+// sorted rangesByKey slice and from the store's queues.
 func (s *Store) RemoveRange(rng *Range) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -684,6 +1025,285 @@ func (s *Store) RemoveRange(rng *Range) error {
 		return util.Errorf("couldn't find range in rangesByKey slice")
 	}
 	s.rangesByKey = append(s.rangesByKey[:n], s.rangesByKey[n+1:]...)
+	if s.scanner != nil {
+		s.scanner.RemoveRange(rng)
+	}
+	return nil
+}
+
+// RelocateRange moves this store's replica of rng to target, which
+// must be another store on the same node. While the range is moved,
+// commands to its keys are blocked; commands which were waiting
+// return a RangeNotFoundError once the range is removed from this
+// store, so that clients retry against the updated range addressing.
+//
+// If a backup of the replica is found in the target's relocation
+// backups, the target is first seeded from it while commands proceed;
+// only the commands applied since the backup was taken are then
+// replayed on the seed while commands are blocked. Otherwise, or if the caught-up seed
+// doesn't match the replica, all range data is copied. The copy is
+// written to the target's engine along with the updated range
+// descriptor and a relocation marker, and synced.
+// Only then are the range descriptor and its addressing records
+// switched to refer to target, after which the range is destroyed here
+// and started there. A relocation interrupted by a restart is either
+// finished or undone by ResolveRelocations, depending on whether the
+// switch committed. The first range is never relocated.
+func (s *Store) RelocateRange(rng *Range, target *Store) error {
+	if target == s || target.Ident.NodeID != s.Ident.NodeID {
+		return util.Errorf("store %d is not another store on node %d", target.StoreID(), s.Ident.NodeID)
+	}
+	if rng.IsFirstRange() {
+		return util.Errorf("the first range cannot be relocated")
+	}
+	if rng.IsFrozen() {
+		return util.Errorf("range %d is frozen", rng.Desc.RaftID)
+	}
+	// Prevent concurrent splits, which would modify the descriptor.
+	if !atomic.CompareAndSwapInt32(&rng.splitting, int32(0), int32(1)) {
+		return util.Errorf("range %d is being split", rng.Desc.RaftID)
+	}
+	defer func() { atomic.StoreInt32(&rng.splitting, int32(0)) }()
+
+	rng.RLock()
+	newDesc := *rng.Desc
+	rng.RUnlock()
+	newDesc.Replicas = append([]proto.Replica(nil), newDesc.Replicas...)
+	var found bool
+	for i := range newDesc.Replicas {
+		if newDesc.Replicas[i].StoreID == s.StoreID() {
+			newDesc.Replicas[i].StoreID = target.StoreID()
+			newDesc.Replicas[i].Attrs = target.Attrs()
+			found = true
+		}
+	}
+	if !found {
+		return util.Errorf("range %d has no replica on store %d", rng.Desc.RaftID, s.StoreID())
+	}
+	seeded := target.seedRange(s, &newDesc)
+
+	// Block all commands to the range's keys until the move is done.
+	cmdKey := rng.beginCmd(newDesc.StartKey, newDesc.EndKey, false, false)
+	defer func() {
+		rng.Lock()
+		rng.cmdQ.Remove(cmdKey)
+		rng.Unlock()
+	}()
+
+	log.Infof("relocating range %d %q-%q from store %d to store %d", newDesc.RaftID,
+		newDesc.StartKey, newDesc.EndKey, s.StoreID(), target.StoreID())
+	if err := s.copyRange(rng, target, &newDesc, seeded); err != nil {
+		if dErr := target.discardRelocation(&newDesc); dErr != nil {
+			log.Errorf("unable to discard copy of range %d on store %d: %s", newDesc.RaftID, target.StoreID(), dErr)
+		}
+		return util.Errorf("unable to copy range %d to store %d: %s", newDesc.RaftID, target.StoreID(), err)
+	}
+
+	txnOpts := &client.TransactionOptions{
+		Name: fmt.Sprintf("relocate range %d to store %d", newDesc.RaftID, target.StoreID()),
+	}
+	if err := s.db.RunTransaction(txnOpts, func(txn *client.KV) error {
+		if err := txn.PreparePutProto(engine.RangeDescriptorKey(newDesc.StartKey), &newDesc); err != nil {
+			return err
+		}
+		return UpdateRangeAddressing(txn, &newDesc)
+	}); err != nil {
+		if dErr := target.discardRelocation(&newDesc); dErr != nil {
+			log.Errorf("unable to discard copy of range %d on store %d: %s", newDesc.RaftID, target.StoreID(), dErr)
+		}
+		return util.Errorf("unable to update descriptor of range %d: %s", newDesc.RaftID, err)
+	}
+	return s.finishRelocation(rng, target, &newDesc)
+}
+
+// copyRange copies all data of rng to target, along with desc, the
+// descriptor listing target in place of this store, and a relocation
+// marker holding desc. If target was seeded from a backup of the
+// range, the seed is caught up instead and only the replica's Raft log
+// and state are copied; a seed which can't be caught up is discarded
+// in favor of a full copy. The copy is synced to disk before returning
+// if the target's engine supports it.
+func (s *Store) copyRange(rng *Range, target *Store, desc *proto.RangeDescriptor, seeded bool) error {
+	snap := engine.NewBackgroundSnapshot(s.engine)
+	defer snap.Stop()
+	if seeded {
+		ok, err := s.catchUpSeed(rng, snap, target)
+		if err != nil {
+			log.Warningf("unable to catch up seed of range %d on store %d: %s", desc.RaftID, target.StoreID(), err)
+		}
+		if !ok || err != nil {
+			if err := target.discardRelocation(desc); err != nil {
+				return err
+			}
+			seeded = false
+		}
+	}
+	batch := target.engine.NewBatch()
+	if seeded {
+		if err := copyReplicaState(rng, snap, batch); err != nil {
+			return err
+		}
+	} else {
+		iter := newRangeDataIterator(rng, snap)
+		for ; iter.Valid(); iter.Next() {
+			if err := batch.Put(iter.Key(), iter.Value()); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		iter.Close()
+	}
+	// The copy's descriptor lists target already; the switch on this
+	// store writes a later version of the same descriptor.
+	if err := engine.MVCCPutProto(batch, nil, engine.RangeDescriptorKey(desc.StartKey), s.clock.Now(), nil, desc); err != nil {
+		return err
+	}
+	if err := engine.MVCCPutProto(batch, nil, engine.StoreRelocationKey(desc.RaftID), proto.ZeroTimestamp, nil, desc); err != nil {
+		return err
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	if syncer, ok := target.engine.(engine.Syncer); ok {
+		return syncer.SyncWAL()
+	}
+	return nil
+}
+
+// finishRelocation completes the relocation of rng to target once the
+// range descriptor lists target in place of this store: the range is
+// removed from this store and its data destroyed, and the copy of the
+// range on target is started.
+func (s *Store) finishRelocation(rng *Range, target *Store, desc *proto.RangeDescriptor) error {
+	ms, err := engine.MVCCGetRangeStats(s.engine, desc.RaftID)
+	if err != nil {
+		return util.Errorf("unable to fetch stats for range %d: %s", desc.RaftID, err)
+	}
+	gcThreshold, keyThresholds := rng.gcThresholds()
+	if err := s.RemoveRange(rng); err != nil {
+		return err
+	}
+	if err := rng.Destroy(); err != nil {
+		return util.Errorf("unable to destroy data of relocated range %d: %s", desc.RaftID, err)
+	}
+	negMS := engine.MVCCStats{
+		LiveBytes:   -ms.LiveBytes,
+		KeyBytes:    -ms.KeyBytes,
+		ValBytes:    -ms.ValBytes,
+		IntentBytes: -ms.IntentBytes,
+		LiveCount:   -ms.LiveCount,
+		KeyCount:    -ms.KeyCount,
+		ValCount:    -ms.ValCount,
+		IntentCount: -ms.IntentCount,
+	}
+	negMS.MergeStats(s.engine, 0, s.StoreID())
+	return target.loadRelocation(desc, gcThreshold, keyThresholds)
+}
+
+// loadRelocation starts this store's copy of the range described by
+// desc, relocated from a store whose replica has been destroyed. The
+// copy is accounted for in the store stats and its relocation marker
+// is deleted.
+func (s *Store) loadRelocation(desc *proto.RangeDescriptor, gcThreshold proto.Timestamp,
+	keyThresholds []proto.KeyGCThreshold) error {
+	ms, err := engine.MVCCGetRangeStats(s.engine, desc.RaftID)
+	if err != nil {
+		return util.Errorf("unable to fetch stats for range %d: %s", desc.RaftID, err)
+	}
+	batch := s.engine.NewBatch()
+	if err := engine.MVCCDelete(batch, nil, engine.StoreRelocationKey(desc.RaftID), proto.ZeroTimestamp, nil); err != nil {
+		return err
+	}
+	ms.MergeStats(batch, 0, s.StoreID())
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.relocating, desc.RaftID)
+	s.mu.Unlock()
+	rng, err := NewRange(desc, s)
+	if err != nil {
+		return err
+	}
+	rng.advanceGCThresholds(gcThreshold, keyThresholds)
+	return s.AddRange(rng)
+}
+
+// discardRelocation destroys the copy of the range described by desc
+// made by a relocation to this store whose descriptor switch didn't
+// commit, along with its relocation marker.
+func (s *Store) discardRelocation(desc *proto.RangeDescriptor) error {
+	rng, err := NewRange(desc, s)
+	if err != nil {
+		return err
+	}
+	if err := rng.Destroy(); err != nil {
+		return err
+	}
+	if err := engine.MVCCDelete(s.engine, nil, engine.StoreRelocationKey(desc.RaftID), proto.ZeroTimestamp, nil); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.relocating, desc.RaftID)
+	s.mu.Unlock()
+	return nil
+}
+
+// ResolveRelocations finishes or undoes the relocations of ranges to
+// this store which were interrupted by a restart. It must be called
+// once all stores of the node have started. If the source store still
+// holds the range, the relocation is finished if the committed range
+// descriptor lists this store, and undone otherwise. If no store does,
+// its replica was destroyed after the switch and this store's copy is
+// started. Relocations whose descriptor switch is still in flight are
+// left for a later call.
+func (s *Store) ResolveRelocations() error {
+	s.mu.Lock()
+	pending := make([]*proto.RangeDescriptor, 0, len(s.relocating))
+	for _, desc := range s.relocating {
+		pending = append(pending, desc)
+	}
+	s.mu.Unlock()
+
+	for _, desc := range pending {
+		var source *Store
+		var rng *Range
+		if s.nodeStores != nil {
+			if err := s.nodeStores(func(o *Store) error {
+				if o != s {
+					if r, err := o.GetRange(desc.RaftID); err == nil {
+						source, rng = o, r
+					}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		if source == nil {
+			log.Infof("store %d: finishing relocation of range %d", s.StoreID(), desc.RaftID)
+			if err := s.loadRelocation(desc, proto.ZeroTimestamp, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		var cur proto.RangeDescriptor
+		if _, err := engine.MVCCGetProto(source.engine, engine.RangeDescriptorKey(desc.StartKey), s.clock.Now(), nil, &cur); err != nil {
+			log.Warningf("store %d: unable to read descriptor of relocated range %d: %s", s.StoreID(), desc.RaftID, err)
+			continue
+		}
+		var err error
+		if cur.FindReplica(s.StoreID()) != nil {
+			log.Infof("store %d: finishing relocation of range %d from store %d", s.StoreID(), desc.RaftID, source.StoreID())
+			err = source.finishRelocation(rng, s, desc)
+		} else {
+			log.Infof("store %d: undoing relocation of range %d from store %d", s.StoreID(), desc.RaftID, source.StoreID())
+			err = s.discardRelocation(desc)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -711,10 +1331,12 @@ func (s *Store) Descriptor(nodeDesc *NodeDescriptor) (*StoreDescriptor, error) {
 	}
 	// Initialize the store descriptor.
 	return &StoreDescriptor{
-		StoreID:  s.Ident.StoreID,
-		Attrs:    s.Attrs(),
-		Node:     *nodeDesc,
-		Capacity: capacity,
+		StoreID:   s.Ident.StoreID,
+		Attrs:     s.Attrs(),
+		Node:      *nodeDesc,
+		Capacity:  capacity,
+		Suspect:   s.Suspect(),
+		WarmingUp: s.warmup.progress(time.Unix(0, s.clock.PhysicalNow())) < 1,
 	}, nil
 }
 
@@ -741,6 +1363,12 @@ func (s *Store) ExecuteCmd(method string, args proto.Request, reply proto.Respon
 		}
 	}
 
+	defer func(start time.Time) {
+		latency := time.Since(start)
+		storeCmdLatency.RecordDuration(latency)
+		storeMethodMetrics.RecordLatency(method, latency)
+	}(time.Now())
+
 	// Get range and add command to the range for execution.
 	rng, err := s.GetRange(header.RaftID)
 	if err != nil {
@@ -751,28 +1379,31 @@ func (s *Store) ExecuteCmd(method string, args proto.Request, reply proto.Respon
 	retryOpts := RangeRetryOptions
 	retryOpts.Tag = method
 	err = util.RetryWithBackoff(retryOpts, func() (util.RetryStatus, error) {
-		// Add the command to the range for execution; exit retry loop on success.
 		reply.Reset()
-		err := rng.AddCmd(method, args, reply, true)
+		err := s.waitForLocks(rng, method, args, reply)
 		if err == nil {
-			return util.RetryBreak, nil
+			// Add the command to the range for execution; exit retry loop on success.
+			if err = rng.AddCmd(method, args, reply, true); err == nil {
+				return util.RetryBreak, nil
+			}
+			// Maybe resolve a potential write intent error. We do this here
+			// because this is the code path with the requesting client
+			// waiting. We don't want every replica to attempt to resolve the
+			// intent independently, so we can't do it in Range.executeCmd.
+			err = s.maybeResolveWriteIntentError(rng, method, args, reply)
 		}
 
-		// Maybe resolve a potential write intent error. We do this here
-		// because this is the code path with the requesting client
-		// waiting. We don't want every replica to attempt to resolve the
-		// intent independently, so we can't do it in Range.executeCmd.
-		err = s.maybeResolveWriteIntentError(rng, method, args, reply)
-
 		switch t := err.(type) {
 		case *proto.WriteTooOldError:
 			// Update request timestamp and retry immediately.
 			header.Timestamp = t.ExistingTimestamp
 			header.Timestamp.Logical++
+			storeMethodMetrics.Inc(method, "retries")
 			return util.RetryReset, nil
 		case *proto.WriteIntentError:
 			// If write intent error is resolved, exit retry/backoff loop to
 			// immediately retry.
+			storeMethodMetrics.Inc(method, "retries")
 			if t.Resolved {
 				return util.RetryReset, nil
 			}
@@ -785,6 +1416,7 @@ func (s *Store) ExecuteCmd(method string, args proto.Request, reply proto.Respon
 		}
 		return util.RetryBreak, nil
 	})
+	rng.load.record(s.clock.PhysicalNow(), gogoproto.Size(args)+gogoproto.Size(reply))
 
 	// By default, retries are indefinite. However, some unittests set a
 	// maximum retry count; return txn retry error for transactional cases
@@ -792,17 +1424,73 @@ func (s *Store) ExecuteCmd(method string, args proto.Request, reply proto.Respon
 	if _, ok := err.(*util.RetryMaxAttemptsError); ok && header.Txn != nil {
 		reply.Header().SetGoError(proto.NewTransactionRetryError(header.Txn))
 	}
-	return reply.Header().GoError()
+	if err := reply.Header().GoError(); err != nil {
+		storeCmdErrors.Inc(1)
+		return err
+	}
+	return nil
+}
+
+// waitForLocks waits for the command's turn on the known write
+// intents conflicting with it in the range's lock table, if any. On
+// its turn, the command pushes the intents' transaction on behalf of
+// the commands waiting behind it and resolves the intents, as for a
+// WriteIntentError returned by the range; if the push fails, the turn
+// passes on to the next command in line and the error is returned as
+// by maybeResolveWriteIntentError. Inconsistent and bounded staleness
+// reads don't wait, as they read beneath intents, and neither do
+// internal commands, which resolve them.
+func (s *Store) waitForLocks(rng *Range, method string, args proto.Request, reply proto.Response) error {
+	header := args.Header()
+	if !UsesTimestampCache(method) || proto.IsInternal(method) || header.ReadConsistency != proto.CONSISTENT {
+		return nil
+	}
+	for {
+		lock, w := rng.locks.enqueue(header, proto.IsReadOnly(method))
+		if lock == nil {
+			return nil
+		}
+		storeMethodMetrics.Inc(method, "lock_waits")
+		select {
+		case <-lock.released:
+			rng.locks.dequeue(lock, w)
+			continue
+		case <-rng.closer:
+			rng.locks.dequeue(lock, w)
+			err := util.Errorf("range %d was stopped while waiting on write intents", rng.Desc.RaftID)
+			reply.Header().SetGoError(err)
+			return err
+		case <-w.turn:
+		}
+		wiErr := rng.locks.intentError(lock)
+		if wiErr == nil {
+			rng.locks.dequeue(lock, w)
+			continue
+		}
+		reply.Header().SetGoError(wiErr)
+		err := s.maybeResolveWriteIntentError(rng, method, args, reply)
+		rng.locks.dequeue(lock, w)
+		if t, ok := err.(*proto.WriteIntentError); !ok || !t.Resolved {
+			return err
+		}
+		reply.Reset()
+	}
 }
 
 // maybeResolveWriteIntentError checks the reply's error. If the error
 // is a writeIntentError, it tries to push the conflicting
 // transaction: either move its timestamp forward on a read/write
 // conflict, or abort it on a write/write conflict. If the push
-// succeeds, we immediately issue a resolve intent command and set the
-// error's Resolved flag to true so the client retries the command
-// immediately. If the push fails, we set the error's Resolved flag to
-// false so that the client backs off before reissuing the command.
+// succeeds, we immediately issue resolve intent commands for the
+// intent and any additional intents of the same transaction reported
+// with it, and set the error's Resolved flag to true so the client
+// retries the command immediately. If the push fails, we set the
+// error's Resolved flag to false so that the client backs off before
+// reissuing the command.
+//
+// Transactions found to be committed or aborted are remembered in
+// the store's txnStatusCache; intents of such transactions are
+// resolved without pushing them again.
 func (s *Store) maybeResolveWriteIntentError(rng *Range, method string, args proto.Request, reply proto.Response) error {
 	err := reply.Header().GoError()
 	wiErr, ok := err.(*proto.WriteIntentError)
@@ -811,55 +1499,66 @@ func (s *Store) maybeResolveWriteIntentError(rng *Range, method string, args pro
 	}
 
 	log.V(1).Infof("resolving write intent on %s %q: %s", method, args.Header().Key, wiErr)
-
-	// Attempt to push the transaction which created the conflicting intent.
-	pushArgs := &proto.InternalPushTxnRequest{
-		RequestHeader: proto.RequestHeader{
-			Timestamp:    args.Header().Timestamp,
-			Key:          wiErr.Txn.Key,
-			User:         args.Header().User,
-			UserPriority: args.Header().UserPriority,
-			Txn:          args.Header().Txn,
-		},
-		PusheeTxn: wiErr.Txn,
-		Abort:     proto.IsReadWrite(method), // abort if cmd is read/write
-	}
-	pushReply := &proto.InternalPushTxnResponse{}
-	s.db.Call(proto.InternalPushTxn, pushArgs, pushReply)
-	if pushErr := pushReply.GoError(); pushErr != nil {
-		log.V(1).Infof("push %q failed: %s", pushArgs.Header().Key, pushErr)
-
-		// For write/write conflicts within a transaction, propagate the
-		// push failure, not the original write intent error. The push
-		// failure will instruct the client to restart the transaction
-		// with a backoff.
-		if args.Header().Txn != nil && proto.IsReadWrite(method) {
-			reply.Header().SetGoError(pushErr)
-			return pushErr
+	rng.locks.add(wiErr)
+
+	pushee := s.txnStatuses.get(wiErr.Txn.ID)
+	if pushee == nil {
+		// Attempt to push the transaction which created the conflicting intent.
+		pushArgs := &proto.InternalPushTxnRequest{
+			RequestHeader: proto.RequestHeader{
+				Timestamp:    args.Header().Timestamp,
+				Key:          wiErr.Txn.Key,
+				User:         args.Header().User,
+				UserPriority: args.Header().UserPriority,
+				Txn:          args.Header().Txn,
+			},
+			PusheeTxn: wiErr.Txn,
+			Abort:     proto.IsReadWrite(method), // abort if cmd is read/write
 		}
-		// For read/write conflicts, return the write intent error which
-		// engages backoff/retry (with !Resolved). We don't need to
-		// restart the txn, only resend the read with a backoff.
-		return err
+		pushReply := &proto.InternalPushTxnResponse{}
+		storeMethodMetrics.Inc(method, "pushes")
+		s.db.Call(proto.InternalPushTxn, pushArgs, pushReply)
+		if pushErr := pushReply.GoError(); pushErr != nil {
+			log.V(1).Infof("push %q failed: %s", pushArgs.Header().Key, pushErr)
+
+			// For write/write conflicts within a transaction, propagate the
+			// push failure, not the original write intent error. The push
+			// failure will instruct the client to restart the transaction
+			// with a backoff.
+			if args.Header().Txn != nil && proto.IsReadWrite(method) {
+				reply.Header().SetGoError(pushErr)
+				return pushErr
+			}
+			// For read/write conflicts, return the write intent error which
+			// engages backoff/retry (with !Resolved). We don't need to
+			// restart the txn, only resend the read with a backoff.
+			return err
+		}
+		pushee = pushReply.PusheeTxn
+		s.txnStatuses.add(pushee)
 	}
 	wiErr.Resolved = true // success!
-
-	// We pushed the transaction successfully, so resolve the intent.
-	resolveArgs := &proto.InternalResolveIntentRequest{
-		RequestHeader: proto.RequestHeader{
-			// Use the pushee's timestamp, which might be lower than the
-			// pusher's request timestamp. No need to push the intent higher
-			// than the pushee's txn!
-			Timestamp: pushReply.PusheeTxn.Timestamp,
-			Key:       wiErr.Key,
-			User:      UserRoot,
-			Txn:       pushReply.PusheeTxn,
-		},
-	}
-	resolveReply := &proto.InternalResolveIntentResponse{}
-	// Add resolve command with wait=false to add to Raft but not wait for completion.
-	if resolveErr := rng.AddCmd(proto.InternalResolveIntent, resolveArgs, resolveReply, false); resolveErr != nil {
-		log.Warningf("resolve %+v failed: +v", resolveArgs, resolveErr)
+	// Commands waiting on the intents retry along with this one.
+	rng.locks.release(wiErr.Txn.ID)
+
+	// We pushed the transaction successfully, so resolve the intents.
+	for _, key := range append([]proto.Key{wiErr.Key}, wiErr.AdditionalKeys...) {
+		resolveArgs := &proto.InternalResolveIntentRequest{
+			RequestHeader: proto.RequestHeader{
+				// Use the pushee's timestamp, which might be lower than the
+				// pusher's request timestamp. No need to push the intent higher
+				// than the pushee's txn!
+				Timestamp: pushee.Timestamp,
+				Key:       key,
+				User:      UserRoot,
+				Txn:       pushee,
+			},
+		}
+		resolveReply := &proto.InternalResolveIntentResponse{}
+		// Add resolve command with wait=false to add to Raft but not wait for completion.
+		if resolveErr := rng.AddCmd(proto.InternalResolveIntent, resolveArgs, resolveReply, false); resolveErr != nil {
+			log.Warningf("resolve %+v failed: %s", resolveArgs, resolveErr)
+		}
 	}
 
 	return wiErr
@@ -876,6 +1575,7 @@ func (s *Store) ProposeRaftCommand(idKey cmdIDKey, cmd proto.InternalRaftCommand
 		log.Error("ignoring raft command proposed after shutdown")
 		return
 	}
+	s.raftMetrics.proposals.Inc(1)
 	s.raft.propose(idKey, cmd)
 }
 
@@ -911,6 +1611,8 @@ func (s *Store) processRaft(r raftInterface, closer chan struct{}) {
 			if !ok {
 				log.Errorf("got committed raft command for %d but have no range with that ID",
 					raftCmd.cmd.RaftID)
+			} else if raftCmd.dropped {
+				r.dropRaftCommand(raftCmd.cmdIDKey)
 			} else {
 				r.processRaftCommand(raftCmd.cmdIDKey, raftCmd.cmd)
 			}
@@ -0,0 +1,123 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// recordAttrs persists the store's attributes, logging if they differ
+// from those with which the store was last started. A store's
+// attributes are specified anew on each start and may change across
+// restarts; the new attributes are gossiped with the store's
+// descriptor and reconciled with the range descriptors of its
+// replicas by UpdateReplicaAttrs.
+func (s *Store) recordAttrs() error {
+	var prev proto.Attributes
+	ok, err := engine.MVCCGetProto(s.engine, engine.StoreAttrsKey(), proto.ZeroTimestamp, nil, &prev)
+	if err != nil {
+		return err
+	}
+	attrs := s.Attrs()
+	if ok && prev.SortedString() == attrs.SortedString() {
+		return nil
+	}
+	if ok {
+		log.Infof("store %d attributes changed from %q to %q", s.StoreID(), prev.SortedString(), attrs.SortedString())
+	}
+	return engine.MVCCPutProto(s.engine, nil, engine.StoreAttrsKey(), proto.ZeroTimestamp, nil, &attrs)
+}
+
+// UpdateReplicaAttrs rewrites the descriptors of the ranges led by
+// this store whose replica on this store lists attributes other than
+// the store's current attributes, as happens after the store is
+// restarted with changed attributes. Returns the number of updated
+// range descriptors. Ranges which are being split or relocated are
+// skipped and updated by a later invocation.
+func (s *Store) UpdateReplicaAttrs() (int, error) {
+	attrs := s.Attrs()
+	s.mu.RLock()
+	var ranges []*Range
+	for _, rng := range s.rangesByKey {
+		ranges = append(ranges, rng)
+	}
+	s.mu.RUnlock()
+
+	var updated int
+	for _, rng := range ranges {
+		if !rng.IsLeader() {
+			continue
+		}
+		ok, err := s.updateReplicaAttrs(rng, attrs)
+		if err != nil {
+			return updated, err
+		}
+		if ok {
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+// updateReplicaAttrs updates the attributes of this store's replica in
+// the descriptor of rng and its addressing records if they differ from
+// attrs. Returns whether the descriptor was updated.
+func (s *Store) updateReplicaAttrs(rng *Range, attrs proto.Attributes) (bool, error) {
+	// Prevent concurrent splits and relocations, which would modify
+	// the descriptor.
+	if !atomic.CompareAndSwapInt32(&rng.splitting, int32(0), int32(1)) {
+		return false, nil
+	}
+	defer func() { atomic.StoreInt32(&rng.splitting, int32(0)) }()
+
+	rng.RLock()
+	newDesc := *rng.Desc
+	rng.RUnlock()
+	newDesc.Replicas = append([]proto.Replica(nil), newDesc.Replicas...)
+	var changed bool
+	for i := range newDesc.Replicas {
+		r := &newDesc.Replicas[i]
+		if r.StoreID == s.StoreID() && r.Attrs.SortedString() != attrs.SortedString() {
+			r.Attrs = attrs
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	txnOpts := &client.TransactionOptions{
+		Name: fmt.Sprintf("update replica attributes of range %d", newDesc.RaftID),
+	}
+	if err := s.db.RunTransaction(txnOpts, func(txn *client.KV) error {
+		if err := txn.PreparePutProto(engine.RangeDescriptorKey(newDesc.StartKey), &newDesc); err != nil {
+			return err
+		}
+		return UpdateRangeAddressing(txn, &newDesc)
+	}); err != nil {
+		return false, util.Errorf("unable to update descriptor of range %d: %s", newDesc.RaftID, err)
+	}
+	rng.Lock()
+	rng.Desc.Replicas = newDesc.Replicas
+	rng.Unlock()
+	return true, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// checkConsistency validates invariants of the ranges loaded by
+// Start, so that divergence is discovered when the store is opened
+// rather than later during queue processing:
+//
+//  - Replicas do not overlap.
+//  - A replica's Raft HardState does not commit beyond the last
+//    index of its Raft log.
+//  - All range-local data belongs to one of the store's replicas.
+//
+// Orphaned range-local data, as is left behind if the store crashes
+// while removing a replica, is deleted. The remaining invariants
+// cannot be repaired locally; violations are returned as an error.
+func (s *Store) checkConsistency() error {
+	var errs []string
+	for i, rng := range s.rangesByKey {
+		if i > 0 {
+			if prev := s.rangesByKey[i-1]; rng.Desc.StartKey.Less(prev.Desc.EndKey) {
+				errs = append(errs, fmt.Sprintf("range %d [%q, %q) overlaps range %d [%q, %q)",
+					rng.Desc.RaftID, rng.Desc.StartKey, rng.Desc.EndKey,
+					prev.Desc.RaftID, prev.Desc.StartKey, prev.Desc.EndKey))
+			}
+		}
+		var hs raftpb.HardState
+		ok, err := engine.MVCCGetProto(s.engine, engine.RaftStateKey(rng.Desc.RaftID), proto.ZeroTimestamp, nil, &hs)
+		if err != nil {
+			return err
+		}
+		if lastIndex, _ := rng.LastIndex(); ok && hs.Commit > lastIndex {
+			errs = append(errs, fmt.Sprintf("range %d has Raft commit index %d beyond last log index %d",
+				rng.Desc.RaftID, hs.Commit, lastIndex))
+		}
+	}
+
+	orphans, err := s.findOrphanedKeys()
+	if err != nil {
+		return err
+	}
+	if len(orphans) > 0 {
+		log.Warningf("store %d: deleting %d orphaned range-local key(s)", s.StoreID(), len(orphans))
+		var deletes []interface{}
+		for _, key := range orphans {
+			deletes = append(deletes, engine.BatchDelete{proto.RawKeyValue{Key: key}})
+		}
+		if err := s.engine.WriteBatch(deletes); err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		return util.Errorf("store %d failed consistency check:\n%s", s.StoreID(), strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// findOrphanedKeys returns the encoded range-local keys which belong
+// to none of the store's replicas: keys by Raft ID for which no
+// replica exists and keys by range key which no replica contains.
+// Keys of ranges copied to the store by unfinished relocations are
+// not orphaned.
+func (s *Store) findOrphanedKeys() ([]proto.EncodedKey, error) {
+	var orphans []proto.EncodedKey
+	start := engine.MVCCEncodeKey(engine.KeyLocalRangeIDPrefix)
+	end := engine.MVCCEncodeKey(engine.KeyLocalRangeIDPrefix.PrefixEnd())
+	if err := s.engine.Iterate(start, end, func(kv proto.RawKeyValue) (bool, error) {
+		key, _, _ := engine.MVCCDecodeKey(kv.Key)
+		raftID, _, _ := engine.DecodeRangeIDKey(key)
+		if _, ok := s.relocating[raftID]; ok {
+			return false, nil
+		}
+		if _, err := s.GetRange(raftID); err != nil {
+			orphans = append(orphans, kv.Key)
+		}
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	start = engine.MVCCEncodeKey(engine.KeyLocalRangeKeyPrefix)
+	end = engine.MVCCEncodeKey(engine.KeyLocalRangeKeyPrefix.PrefixEnd())
+	if err := s.engine.Iterate(start, end, func(kv proto.RawKeyValue) (bool, error) {
+		key, _, _ := engine.MVCCDecodeKey(kv.Key)
+		rangeKey, _, _ := engine.DecodeRangeKey(key)
+		if s.LookupRange(rangeKey, nil) == nil && !s.isRelocating(rangeKey) {
+			orphans = append(orphans, kv.Key)
+		}
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// isRelocating returns whether key falls within a range copied to the
+// store by an unfinished relocation.
+func (s *Store) isRelocating(key proto.Key) bool {
+	addr := engine.KeyAddress(key)
+	for _, desc := range s.relocating {
+		if desc.ContainsKey(addr) {
+			return true
+		}
+	}
+	return false
+}
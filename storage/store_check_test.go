@@ -0,0 +1,89 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/coreos/etcd/raft/raftpb"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// TestStoreCheckOrphanedKeys verifies that range-local keys belonging
+// to no replica are deleted when the store is started.
+func TestStoreCheckOrphanedKeys(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	orphans := []proto.Key{
+		engine.RaftStateKey(99),
+		engine.RangeScanMetadataKey(engine.KeyMax),
+	}
+	for _, key := range orphans {
+		if err := engine.MVCCPutProto(store.Engine(), nil, key, proto.ZeroTimestamp, nil, &raftpb.HardState{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range orphans {
+		if ok, err := engine.MVCCGetProto(store.Engine(), key, proto.ZeroTimestamp, nil, &raftpb.HardState{}); ok || err != nil {
+			t.Errorf("expected orphaned key %q to be deleted; got %t, %v", key, ok, err)
+		}
+	}
+	if store.LookupRange(engine.KeyMin, nil) == nil {
+		t.Error("expected first range to be loaded")
+	}
+}
+
+// TestStoreCheckInvariants verifies that the store refuses to start
+// if its replicas overlap or a replica's Raft state is ahead of its
+// log.
+func TestStoreCheckInvariants(t *testing.T) {
+	testCases := []struct {
+		key    proto.Key
+		ts     proto.Timestamp
+		msg    gogoproto.Message
+		expErr string
+	}{
+		{
+			engine.RangeDescriptorKey(proto.Key("a")),
+			proto.Timestamp{WallTime: 1},
+			&proto.RangeDescriptor{RaftID: 2, StartKey: proto.Key("a"), EndKey: proto.Key("b")},
+			"overlaps",
+		},
+		{
+			engine.RaftStateKey(1),
+			proto.ZeroTimestamp,
+			&raftpb.HardState{Term: raftInitialLogTerm, Commit: raftInitialLogIndex + 100},
+			"beyond last log index",
+		},
+	}
+	for i, test := range testCases {
+		store, _ := createTestStore(t)
+		if err := engine.MVCCPutProto(store.Engine(), nil, test.key, test.ts, nil, test.msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Start(); err == nil || !strings.Contains(err.Error(), test.expErr) {
+			t.Errorf("%d: expected error containing %q; got %v", i, test.expErr, err)
+		}
+		store.Stop()
+	}
+}
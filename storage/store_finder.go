@@ -51,7 +51,7 @@ func (sf *StoreFinder) capacityGossipUpdate(key string, contentsChanged bool) {
 	sf.capacityKeys[key] = struct{}{}
 }
 
-// findStores is the Store's implementation of a StoreFinder. It returns a list
+// FindStores is the Store's implementation of a StoreFinder. It returns a list
 // of stores with attributes that are a superset of the required attributes. It
 // never returns an error.
 //
@@ -61,7 +61,7 @@ func (sf *StoreFinder) capacityGossipUpdate(key string, contentsChanged bool) {
 // TODO(embark, spencer): consider using a reverse index map from Attr->stores,
 // for efficiency.  Ensure that entries in this map still have an opportunity
 // to be garbage collected.
-func (sf *StoreFinder) findStores(required proto.Attributes) ([]*StoreDescriptor, error) {
+func (sf *StoreFinder) FindStores(required proto.Attributes) ([]*StoreDescriptor, error) {
 	sf.finderMu.Lock()
 	defer sf.finderMu.Unlock()
 	var stores []*StoreDescriptor
@@ -49,7 +49,7 @@ func TestStoreFinder(t *testing.T) {
 	defer s.Stop()
 	required := []string{"ssd", "dc"}
 	// Nothing yet.
-	if stores, _ := s.findStores(proto.Attributes{Attrs: required}); stores != nil {
+	if stores, _ := s.FindStores(proto.Attributes{Attrs: required}); stores != nil {
 		t.Errorf("expected no stores, instead %+v", stores)
 	}
 
@@ -78,7 +78,7 @@ func TestStoreFinder(t *testing.T) {
 	s.gossip.AddInfo("k4", emptyStore, time.Hour)
 
 	expected := []string{matchingStore.Attrs.SortedString(), supersetStore.Attrs.SortedString()}
-	stores, err := s.findStores(proto.Attributes{Attrs: required})
+	stores, err := s.FindStores(proto.Attributes{Attrs: required})
 	if err != nil {
 		t.Errorf("expected no err, got %s", err)
 	}
@@ -106,7 +106,7 @@ func TestStoreFinderGarbageCollection(t *testing.T) {
 	required := []string{}
 
 	// No gossip added for either key, so they should be removed.
-	stores, err := s.findStores(proto.Attributes{Attrs: required})
+	stores, err := s.FindStores(proto.Attributes{Attrs: required})
 	if err != nil {
 		t.Errorf("unexpected error retrieving stores %s", err)
 	} else if len(stores) != 0 {
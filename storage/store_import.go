@@ -0,0 +1,162 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"hash/crc32"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// A RangeManifest describes the data of one range in a StoreManifest.
+type RangeManifest struct {
+	Desc     *proto.RangeDescriptor `json:"desc"`
+	Keys     int64                  `json:"keys"`
+	Checksum uint32                 `json:"checksum"` // CRC-32 (IEEE) of the range's keys and values
+}
+
+// A StoreManifest describes the ranges of a store, so that a copy of
+// the store can be verified before it's imported by ImportStore.
+type StoreManifest struct {
+	Ident  proto.StoreIdent `json:"ident"`
+	Ranges []RangeManifest  `json:"ranges"`
+}
+
+// A StoreImport describes the store written by ImportStore.
+type StoreImport struct {
+	StoreRewrite
+	Ranges        int     // Ranges imported
+	DroppedRanges []int64 // Raft IDs of ranges in the source missing from the manifest
+}
+
+// NewStoreManifest reads the store ident and range descriptors of the
+// store in e and checksums the data of each range.
+func NewStoreManifest(e engine.Engine) (*StoreManifest, error) {
+	manifest := &StoreManifest{}
+	ok, err := engine.MVCCGetProto(e, engine.StoreIdentKey(), proto.ZeroTimestamp, nil, &manifest.Ident)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, util.Errorf("engine %s is not bootstrapped", e)
+	}
+	descs, err := ReadRangeDescriptors(e)
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range descs {
+		keys, checksum, err := checksumRange(e, desc)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Ranges = append(manifest.Ranges, RangeManifest{Desc: desc, Keys: keys, Checksum: checksum})
+	}
+	return manifest, nil
+}
+
+// ImportStore verifies the store in src against manifest and copies
+// it to the empty engine dst, bootstrapping dst as the store
+// identified by the manifest. The store in src must have the ident of
+// the manifest, and each range of the manifest must have a replica in
+// src with the same descriptor and data of the same checksum.
+// Replicas in src of ranges missing from the manifest, such as those
+// created after the manifest was written, are dropped along with all
+// of their data. Neither engine may be in use by a store.
+func ImportStore(src, dst engine.Engine, manifest *StoreManifest) (*StoreImport, error) {
+	var ident proto.StoreIdent
+	ok, err := engine.MVCCGetProto(src, engine.StoreIdentKey(), proto.ZeroTimestamp, nil, &ident)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, util.Errorf("engine %s is not bootstrapped", src)
+	} else if !gogoproto.Equal(&ident, &manifest.Ident) {
+		return nil, util.Errorf("store ident %+v does not match manifest ident %+v", ident, manifest.Ident)
+	}
+
+	descs, err := ReadRangeDescriptors(src)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int64]*proto.RangeDescriptor{}
+	for _, desc := range descs {
+		byID[desc.RaftID] = desc
+	}
+	imp := &StoreImport{}
+	var imported []*proto.RangeDescriptor
+	for _, rm := range manifest.Ranges {
+		desc, ok := byID[rm.Desc.RaftID]
+		if !ok {
+			return nil, util.Errorf("range %d of the manifest has no replica in %s", rm.Desc.RaftID, src)
+		}
+		delete(byID, rm.Desc.RaftID)
+		if !gogoproto.Equal(desc, rm.Desc) {
+			return nil, util.Errorf("descriptor of range %d does not match the manifest: %+v != %+v",
+				desc.RaftID, desc, rm.Desc)
+		}
+		keys, checksum, err := checksumRange(src, desc)
+		if err != nil {
+			return nil, err
+		} else if keys != rm.Keys || checksum != rm.Checksum {
+			return nil, util.Errorf("data of range %d does not match the manifest: %d key(s) with "+
+				"checksum %08x; expected %d key(s) with checksum %08x", desc.RaftID, keys, checksum, rm.Keys, rm.Checksum)
+		}
+		imported = append(imported, desc)
+	}
+	for _, desc := range descs {
+		if _, ok := byID[desc.RaftID]; ok {
+			imp.DroppedRanges = append(imp.DroppedRanges, desc.RaftID)
+		}
+	}
+
+	// Besides their range-local data, the user data of dropped ranges
+	// is omitted: it's reachable only through a replica.
+	isOrphanedLocal := orphanedKeyFunc(imported)
+	rewrite, err := copyStore(src, dst, func(encKey proto.EncodedKey) bool {
+		key, _, _ := engine.MVCCDecodeKey(encKey)
+		if key.Less(engine.KeyLocalMax) {
+			return isOrphanedLocal(encKey)
+		}
+		for _, desc := range imported {
+			if desc.ContainsKey(key) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	imp.StoreRewrite = *rewrite
+	imp.Ranges = len(imported)
+	return imp, nil
+}
+
+// checksumRange returns the number of keys and the CRC-32 checksum of
+// the keys and values of the range described by desc in e.
+func checksumRange(e engine.Engine, desc *proto.RangeDescriptor) (int64, uint32, error) {
+	crc := crc32.NewIEEE()
+	var keys int64
+	iter := newRangeDataIterator(&Range{Desc: desc}, e)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		crc.Write(iter.Key())
+		crc.Write(iter.Value())
+		keys++
+	}
+	return keys, crc.Sum32(), iter.Error()
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// TestImportStore verifies that ImportStore copies a store which
+// matches its manifest and refuses to import one which doesn't.
+func TestImportStore(t *testing.T) {
+	store, _ := createTestStore(t)
+	store.Stop()
+
+	ts := proto.Timestamp{WallTime: 1}
+	if err := engine.MVCCPut(store.Engine(), nil, proto.Key("a"), ts, proto.Value{Bytes: []byte("a")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := NewStoreManifest(store.Engine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Ranges) != 1 || manifest.Ranges[0].Keys == 0 {
+		t.Fatalf("expected manifest of one non-empty range; got %+v", manifest.Ranges)
+	}
+
+	dst := engine.NewInMem(proto.Attributes{}, 1<<20)
+	imp, err := ImportStore(store.Engine(), dst, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Ranges != 1 || len(imp.DroppedRanges) != 0 || imp.DroppedKeys != 0 {
+		t.Errorf("expected one range imported and nothing dropped; got %+v", imp)
+	}
+	if imported, err := NewStoreManifest(dst); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(imported, manifest) {
+		t.Errorf("expected imported store to match manifest:\n%+v\n%+v", imported, manifest)
+	}
+
+	// A range missing from the manifest is dropped along with its data.
+	dst = engine.NewInMem(proto.Attributes{}, 1<<20)
+	if imp, err = ImportStore(store.Engine(), dst, &StoreManifest{Ident: manifest.Ident}); err != nil {
+		t.Fatal(err)
+	}
+	if imp.Ranges != 0 || !reflect.DeepEqual(imp.DroppedRanges, []int64{1}) {
+		t.Errorf("expected range 1 to be dropped; got %+v", imp)
+	}
+	if val, err := engine.MVCCGet(dst, proto.Key("a"), ts, nil); val != nil || err != nil {
+		t.Errorf("expected data of dropped range to be omitted; got %+v, %v", val, err)
+	}
+
+	// Mismatched idents, descriptors and data are refused.
+	badIdent := *manifest
+	badIdent.Ident.StoreID = 2
+	badDesc := *manifest
+	desc := gogoproto.Clone(manifest.Ranges[0].Desc).(*proto.RangeDescriptor)
+	desc.EndKey = proto.Key("z")
+	badDesc.Ranges = []RangeManifest{{Desc: desc, Keys: manifest.Ranges[0].Keys, Checksum: manifest.Ranges[0].Checksum}}
+	for i, m := range []*StoreManifest{&badIdent, &badDesc} {
+		if _, err := ImportStore(store.Engine(), engine.NewInMem(proto.Attributes{}, 1<<20), m); err == nil {
+			t.Errorf("%d: expected error importing store with mismatched manifest", i)
+		}
+	}
+	if err := engine.MVCCPut(store.Engine(), nil, proto.Key("b"), ts, proto.Value{Bytes: []byte("b")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportStore(store.Engine(), engine.NewInMem(proto.Attributes{}, 1<<20), manifest); err == nil {
+		t.Error("expected error importing store with data not matching manifest checksum")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/cloud"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestStoreRelocateRange verifies that a range is moved along with its
+// data to another store on the node, and that the relocation leaves
+// no marker behind.
+func TestStoreRelocateRange(t *testing.T) {
+	store := createTestStore(t)
+	defer store.Stop()
+	other := storage.NewStore(store.Clock(), engine.NewInMem(proto.Attributes{}, 1<<20), store.DB(), nil)
+	if err := other.Bootstrap(proto.StoreIdent{NodeID: store.Ident.NodeID, StoreID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+
+	args, reply := adminSplitArgs(engine.KeyMin, []byte("a"), 1, store.StoreID())
+	if err := store.ExecuteCmd(proto.AdminSplit, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	rng := store.LookupRange(proto.Key("b"), nil)
+	pArgs, pReply := putArgs([]byte("b"), []byte("value"), rng.Desc.RaftID, store.StoreID())
+	if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RelocateRange(rng, other); err != nil {
+		t.Fatal(err)
+	}
+	if r := store.LookupRange(proto.Key("b"), nil); r != nil {
+		t.Errorf("expected range %d to be removed from store %d", r.Desc.RaftID, store.StoreID())
+	}
+	newRng := other.LookupRange(proto.Key("b"), nil)
+	if newRng == nil || newRng.Desc.FindReplica(other.StoreID()) == nil {
+		t.Fatalf("expected range listing store %d on store %d; got %+v", other.StoreID(), other.StoreID(), newRng)
+	}
+	gArgs, gReply := getArgs([]byte("b"), newRng.Desc.RaftID, other.StoreID())
+	if err := other.ExecuteCmd(proto.Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || string(gReply.Value.Bytes) != "value" {
+		t.Errorf("expected relocated value; got %+v", gReply.Value)
+	}
+	if val, err := engine.MVCCGet(other.Engine(), engine.StoreRelocationKey(newRng.Desc.RaftID), proto.ZeroTimestamp, nil); val != nil || err != nil {
+		t.Errorf("expected relocation marker to be deleted; got %+v, %v", val, err)
+	}
+}
+
+// TestStoreRelocateRangeFromBackup verifies that a relocated range is
+// seeded from its backup and caught up by replaying the commands
+// applied since, and that a seed which doesn't match the replica once
+// caught up is replaced by a full copy.
+func TestStoreRelocateRangeFromBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relocation-backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	es, err := cloud.FromURI(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := createTestStore(t)
+	defer store.Stop()
+	other := storage.NewStore(store.Clock(), engine.NewInMem(proto.Attributes{}, 1<<20), store.DB(), nil)
+	if err := other.Bootstrap(proto.StoreIdent{NodeID: store.Ident.NodeID, StoreID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+	store.SetRelocationBackups(es)
+	other.SetRelocationBackups(es)
+
+	args, reply := adminSplitArgs(engine.KeyMin, []byte("a"), 1, store.StoreID())
+	if err := store.ExecuteCmd(proto.AdminSplit, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	rng := store.LookupRange(proto.Key("b"), nil)
+	put := func(s *storage.Store, raftID int64, key, value string) {
+		pArgs, pReply := putArgs([]byte(key), []byte(value), raftID, s.StoreID())
+		if err := s.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(s *storage.Store, raftID int64, key string) *proto.Value {
+		gArgs, gReply := getArgs([]byte(key), raftID, s.StoreID())
+		if err := s.ExecuteCmd(proto.Get, gArgs, gReply); err != nil {
+			t.Fatal(err)
+		}
+		return gReply.Value
+	}
+	put(store, rng.Desc.RaftID, "b", "value")
+	if n, err := store.BackupRanges(es); err != nil || n != 2 {
+		t.Fatalf("expected both ranges to be backed up; got %d, %v", n, err)
+	}
+	put(store, rng.Desc.RaftID, "b", "value2")
+	put(store, rng.Desc.RaftID, "c", "value")
+	// A value written outside of Raft, without updating the stats, is
+	// only carried by a full copy.
+	if err := engine.MVCCPut(store.Engine(), nil, proto.Key("x"), store.Clock().Now(), proto.Value{Bytes: []byte("value")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RelocateRange(rng, other); err != nil {
+		t.Fatal(err)
+	}
+	newRng := other.LookupRange(proto.Key("b"), nil)
+	if newRng == nil {
+		t.Fatalf("expected range on store %d", other.StoreID())
+	}
+	if val := get(other, newRng.Desc.RaftID, "b"); val == nil || string(val.Bytes) != "value2" {
+		t.Errorf("expected value written after the backup; got %+v", val)
+	}
+	if val := get(other, newRng.Desc.RaftID, "c"); val == nil || string(val.Bytes) != "value" {
+		t.Errorf("expected value written after the backup; got %+v", val)
+	}
+	if val := get(other, newRng.Desc.RaftID, "x"); val != nil {
+		t.Errorf("expected seeded range to lack the value written outside of Raft; got %+v", val)
+	}
+
+	// Move the range back from a backup whose live stats no longer
+	// match once caught up.
+	if _, err := other.BackupRanges(es); err != nil {
+		t.Fatal(err)
+	}
+	ms := &engine.MVCCStats{}
+	if err := engine.MVCCPut(other.Engine(), ms, proto.Key("y"), store.Clock().Now(), proto.Value{Bytes: []byte("value")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ms.MergeStats(other.Engine(), newRng.Desc.RaftID, other.StoreID())
+	if err := other.RelocateRange(newRng, store); err != nil {
+		t.Fatal(err)
+	}
+	if val := get(store, newRng.Desc.RaftID, "y"); val == nil || string(val.Bytes) != "value" {
+		t.Errorf("expected a full copy of the range; got %+v", val)
+	}
+	if val, err := engine.MVCCGet(store.Engine(), engine.StoreRelocationKey(newRng.Desc.RaftID), proto.ZeroTimestamp, nil); val != nil || err != nil {
+		t.Errorf("expected relocation marker to be deleted; got %+v, %v", val, err)
+	}
+}
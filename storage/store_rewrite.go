@@ -0,0 +1,120 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// rewriteBatchSize is the approximate number of bytes of key/value
+// pairs written per batch by RewriteStore.
+const rewriteBatchSize = 1 << 20 // 1MB
+
+// A StoreRewrite describes the copy of a store made by RewriteStore.
+type StoreRewrite struct {
+	Keys        int64 // Key/value pairs copied
+	Bytes       int64 // Bytes of keys and values copied
+	DroppedKeys int64 // Orphaned range-local keys not copied
+}
+
+// RewriteStore copies every key/value pair of the store in src to the
+// empty engine dst. Unlike a checkpoint, which shares the files of
+// src, the copy is written afresh using the options of dst and omits
+// the overwritten and deleted data still held by the files of src. If
+// dropOrphans is true, range-local keys which belong to none of the
+// ranges with descriptors in src are not copied; see
+// Store.findOrphanedKeys. Neither engine may be in use by a store.
+func RewriteStore(src, dst engine.Engine, dropOrphans bool) (*StoreRewrite, error) {
+	isOrphan := func(proto.EncodedKey) bool { return false }
+	if dropOrphans {
+		descs, err := ReadRangeDescriptors(src)
+		if err != nil {
+			return nil, err
+		}
+		isOrphan = orphanedKeyFunc(descs)
+	}
+	return copyStore(src, dst, isOrphan)
+}
+
+// copyStore copies the key/value pairs of src for which isOrphan
+// returns false to the empty engine dst.
+func copyStore(src, dst engine.Engine, isOrphan func(proto.EncodedKey) bool) (*StoreRewrite, error) {
+	kvs, err := engine.Scan(dst, proto.EncodedKey(engine.KeyMin), proto.EncodedKey(engine.KeyMax), 1)
+	if err != nil {
+		return nil, util.Errorf("unable to scan engine to verify empty: %s", err)
+	} else if len(kvs) > 0 {
+		return nil, util.Errorf("non-empty engine %s (first key: %q)", dst, kvs[0].Key)
+	}
+
+	rewrite := &StoreRewrite{}
+	var batch []interface{}
+	var batchBytes int
+	if err := src.Iterate(proto.EncodedKey(engine.KeyMin), proto.EncodedKey(engine.KeyMax), func(kv proto.RawKeyValue) (bool, error) {
+		if isOrphan(kv.Key) {
+			rewrite.DroppedKeys++
+			return false, nil
+		}
+		batch = append(batch, engine.BatchPut{RawKeyValue: kv})
+		batchBytes += len(kv.Key) + len(kv.Value)
+		rewrite.Keys++
+		rewrite.Bytes += int64(len(kv.Key) + len(kv.Value))
+		if batchBytes >= rewriteBatchSize {
+			err := dst.WriteBatch(batch)
+			batch, batchBytes = nil, 0
+			return false, err
+		}
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := dst.WriteBatch(batch); err != nil {
+		return nil, err
+	}
+	return rewrite, nil
+}
+
+// orphanedKeyFunc returns a function which returns true for encoded
+// range-local keys belonging to none of the ranges described by
+// descs: keys by Raft ID of other ranges and keys by range key which
+// none of the ranges contains.
+func orphanedKeyFunc(descs []*proto.RangeDescriptor) func(proto.EncodedKey) bool {
+	raftIDs := map[int64]struct{}{}
+	for _, desc := range descs {
+		raftIDs[desc.RaftID] = struct{}{}
+	}
+	return func(encKey proto.EncodedKey) bool {
+		key, _, _ := engine.MVCCDecodeKey(encKey)
+		switch {
+		case bytes.HasPrefix(key, engine.KeyLocalRangeIDPrefix):
+			raftID, _, _ := engine.DecodeRangeIDKey(key)
+			_, ok := raftIDs[raftID]
+			return !ok
+		case bytes.HasPrefix(key, engine.KeyLocalRangeKeyPrefix):
+			rangeKey, _, _ := engine.DecodeRangeKey(key)
+			for _, desc := range descs {
+				if desc.ContainsKey(rangeKey) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// TestRewriteStore verifies that RewriteStore copies every key of a
+// store, optionally dropping orphaned range-local keys, and refuses
+// to write to a non-empty engine.
+func TestRewriteStore(t *testing.T) {
+	store, _ := createTestStore(t)
+	store.Stop()
+
+	orphans := []proto.Key{
+		engine.RaftStateKey(99),
+		engine.RangeScanMetadataKey(engine.KeyMax),
+	}
+	for _, key := range orphans {
+		if err := engine.MVCCPutProto(store.Engine(), nil, key, proto.ZeroTimestamp, nil, &raftpb.HardState{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcKVs, err := engine.Scan(store.Engine(), proto.EncodedKey(engine.KeyMin), proto.EncodedKey(engine.KeyMax), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A full copy holds exactly the keys of the original.
+	dst := engine.NewInMem(proto.Attributes{}, 1<<20)
+	rewrite, err := RewriteStore(store.Engine(), dst, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstKVs, err := engine.Scan(dst, proto.EncodedKey(engine.KeyMin), proto.EncodedKey(engine.KeyMax), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(srcKVs, dstKVs) {
+		t.Errorf("expected copy to match original:\n%+v\n%+v", srcKVs, dstKVs)
+	}
+	if rewrite.Keys != int64(len(srcKVs)) || rewrite.DroppedKeys != 0 {
+		t.Errorf("expected %d keys copied and none dropped; got %+v", len(srcKVs), rewrite)
+	}
+
+	// The destination is no longer empty.
+	if _, err := RewriteStore(store.Engine(), dst, false); err == nil {
+		t.Error("expected error rewriting to a non-empty engine")
+	}
+
+	// Dropping orphans omits the orphaned keys but nothing else.
+	dst = engine.NewInMem(proto.Attributes{}, 1<<20)
+	if rewrite, err = RewriteStore(store.Engine(), dst, true); err != nil {
+		t.Fatal(err)
+	}
+	if rewrite.DroppedKeys != int64(len(orphans)) || rewrite.Keys != int64(len(srcKVs)-len(orphans)) {
+		t.Errorf("expected %d keys dropped; got %+v", len(orphans), rewrite)
+	}
+	for _, key := range orphans {
+		if ok, err := engine.MVCCGetProto(dst, key, proto.ZeroTimestamp, nil, &raftpb.HardState{}); ok || err != nil {
+			t.Errorf("expected orphaned key %q to be dropped; got %t, %v", key, ok, err)
+		}
+	}
+	if ok, err := engine.MVCCGetProto(dst, engine.RangeDescriptorKey(engine.KeyMin), proto.MaxTimestamp, nil, &proto.RangeDescriptor{}); !ok || err != nil {
+		t.Errorf("expected range descriptor to be copied; got %t, %v", ok, err)
+	}
+}
@@ -19,6 +19,7 @@ package storage_test
 
 import (
 	"bytes"
+	"fmt"
 	"math/rand"
 	"reflect"
 	"regexp"
@@ -325,6 +326,56 @@ func TestStoreRangeSplitStats(t *testing.T) {
 	}
 }
 
+// TestStoreRangeSplitAdjustsSplitKey verifies that split keys chosen
+// by size are adjusted by the store's SplitKeyFunc, unless the
+// adjusted key would leave nothing to split off.
+func TestStoreRangeSplitAdjustsSplitKey(t *testing.T) {
+	store := createTestStore(t)
+	defer store.Stop()
+
+	args, reply := adminSplitArgs(engine.KeyMin, proto.Key("\x01"), 1, store.StoreID())
+	if err := store.ExecuteCmd(proto.AdminSplit, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	rng := store.LookupRange(proto.Key("\x01"), nil)
+	// Write families of keys sharing their first byte.
+	for _, family := range []string{"a", "b", "c", "d"} {
+		for i := 0; i < 10; i++ {
+			key := proto.Key(fmt.Sprintf("%s/%02d", family, i))
+			pArgs, pReply := putArgs(key, bytes.Repeat([]byte("v"), 100), rng.Desc.RaftID, store.StoreID())
+			pArgs.Timestamp = store.Clock().Now()
+			if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Split keys within a family are moved to the family's first key.
+	store.SetSplitKeyFunc(func(key proto.Key) (proto.Key, error) {
+		return key[:1], nil
+	})
+	args, reply = adminSplitArgs(proto.Key("\x01"), nil, rng.Desc.RaftID, store.StoreID())
+	if err := store.ExecuteCmd(proto.AdminSplit, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	newRng := store.LookupRange(proto.Key("d/09"), nil)
+	if len(newRng.Desc.StartKey) != 1 {
+		t.Errorf("expected split at the first key of a family; got %q", newRng.Desc.StartKey)
+	}
+
+	// An adjustment to the start of the range is ignored.
+	store.SetSplitKeyFunc(func(key proto.Key) (proto.Key, error) {
+		return newRng.Desc.StartKey, nil
+	})
+	args, reply = adminSplitArgs(newRng.Desc.StartKey, nil, newRng.Desc.RaftID, store.StoreID())
+	if err := store.ExecuteCmd(proto.AdminSplit, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if splitRng := store.LookupRange(proto.Key("d/09"), nil); len(splitRng.Desc.StartKey) == 1 {
+		t.Errorf("expected split key chosen by size; got %q", splitRng.Desc.StartKey)
+	}
+}
+
 // fillRange writes keys with the given prefix and associated values
 // until bytes bytes have been written.
 func fillRange(store *storage.Store, raftID int64, prefix proto.Key, bytes int64, t *testing.T) {
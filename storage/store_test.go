@@ -36,6 +36,7 @@ import (
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/metrics"
 	gogoproto "github.com/gogo/protobuf/proto"
 )
 
@@ -295,17 +296,17 @@ func TestStoreRangeIterator(t *testing.T) {
 	// Verify two passes of the iteration.
 	iter := newStoreRangeIterator(store)
 	for pass := 0; pass < 2; pass++ {
-		for i := 1; iter.estimatedCount() > 0; i++ {
-			if rng := iter.next(); rng == nil || rng.Desc.RaftID != int64(i) {
+		for i := 1; iter.EstimatedCount() > 0; i++ {
+			if rng := iter.Next(); rng == nil || rng.Desc.RaftID != int64(i) {
 				t.Errorf("expected range with Raft ID %d; got %s", i, rng)
 			}
 		}
-		iter.reset()
+		iter.Reset()
 	}
 
 	// Try iterating with an addition.
-	iter.next()
-	if ec := iter.estimatedCount(); ec != 9 {
+	iter.Next()
+	if ec := iter.EstimatedCount(); ec != 9 {
 		t.Errorf("expected 9 remaining; got %d", ec)
 	}
 	// Insert range as second range.
@@ -313,14 +314,14 @@ func TestStoreRangeIterator(t *testing.T) {
 	if err := store.AddRange(rng); err != nil {
 		t.Fatal(err)
 	}
-	// Estimated count will still be 9, as it's cached, but next() will refresh.
-	if ec := iter.estimatedCount(); ec != 9 {
+	// Estimated count will still be 9, as it's cached, but Next() will refresh.
+	if ec := iter.EstimatedCount(); ec != 9 {
 		t.Errorf("expected 9 remaining; got %d", ec)
 	}
-	if r := iter.next(); r == nil || r != rng {
+	if r := iter.Next(); r == nil || r != rng {
 		t.Errorf("expected r==rng; got %d", r.Desc.RaftID)
 	}
-	if ec := iter.estimatedCount(); ec != 9 {
+	if ec := iter.EstimatedCount(); ec != 9 {
 		t.Errorf("expected 9 remaining; got %d", ec)
 	}
 
@@ -333,14 +334,14 @@ func TestStoreRangeIterator(t *testing.T) {
 	if err := store.RemoveRange(rng); err != nil {
 		t.Error(err)
 	}
-	if ec := iter.estimatedCount(); ec != 9 {
+	if ec := iter.EstimatedCount(); ec != 9 {
 		t.Errorf("expected 9 remaining; got %d", ec)
 	}
 	// Verify we skip removed range (id=2).
-	if r := iter.next(); r.Desc.RaftID != 3 {
+	if r := iter.Next(); r.Desc.RaftID != 3 {
 		t.Errorf("expected raftID=3; got %d", r.Desc.RaftID)
 	}
-	if ec := iter.estimatedCount(); ec != 7 {
+	if ec := iter.EstimatedCount(); ec != 7 {
 		t.Errorf("expected 7 remaining; got %d", ec)
 	}
 }
@@ -912,3 +913,422 @@ func TestStoreResolveWriteIntentNoTxn(t *testing.T) {
 		t.Errorf("expected transaction aborted error; got %s", err)
 	}
 }
+
+// TestStoreSetQueueState verifies that store queues can be paused and
+// resumed by name.
+func TestStoreSetQueueState(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	if err := store.SetQueueState("scan", QueuePaused); err != nil {
+		t.Fatal(err)
+	}
+	if state := store.QueueStates()["scan"]; state != QueuePaused {
+		t.Errorf("expected scan queue paused; got %s", state)
+	}
+	if store.scanQueue.State() != QueuePaused {
+		t.Errorf("expected scan queue paused; got %s", store.scanQueue.State())
+	}
+	if err := store.SetQueueState("unknown", QueueDisabled); err == nil {
+		t.Error("expected error setting state of unknown queue")
+	}
+}
+
+// TestStoreScansQueues verifies that a started store scans its ranges
+// into its queues and processes them.
+func TestStoreScansQueues(t *testing.T) {
+	defer func(interval time.Duration) { *scanInterval = interval }(*scanInterval)
+	*scanInterval = 10 * time.Millisecond
+	store, manual := createTestStore(t)
+	defer store.Stop()
+
+	// Advance the clock so that the range is due for verification.
+	now := verificationInterval.Nanoseconds() + 1
+	manual.Set(now)
+	rng := store.LookupRange(engine.KeyMin, nil)
+	if err := util.IsTrueWithin(func() bool {
+		scanMeta, err := rng.GetScanMetadata()
+		return err == nil && scanMeta.LastScanNanos == now
+	}, 5*time.Second); err != nil {
+		t.Fatalf("expected range to be scanned by the scan queue: %s", err)
+	}
+}
+
+// TestStoreResolveRelocations verifies that a relocation interrupted
+// by a restart is undone if the range descriptor wasn't switched to
+// the target store, and finished otherwise.
+func TestStoreResolveRelocations(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	other := NewStore(store.clock, engine.NewInMem(proto.Attributes{}, 1<<20), store.db, nil)
+	if err := other.Bootstrap(proto.StoreIdent{NodeID: store.Ident.NodeID, StoreID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+	visit := func(visit func(*Store) error) error {
+		for _, s := range []*Store{store, other} {
+			if err := visit(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	store.SetNodeStores(visit)
+	other.SetNodeStores(visit)
+
+	// Replace the first range with a range from "a" to "c" holding a
+	// value at "b".
+	rng1, err := store.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveRange(rng1); err != nil {
+		t.Fatal(err)
+	}
+	desc := &proto.RangeDescriptor{
+		RaftID:   2,
+		StartKey: proto.Key("a"),
+		EndKey:   proto.Key("c"),
+		Replicas: []proto.Replica{{StoreID: store.StoreID()}},
+	}
+	if err := engine.MVCCPutProto(store.Engine(), nil, engine.RangeDescriptorKey(desc.StartKey), store.clock.Now(), nil, desc); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := NewRange(desc, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddRange(rng); err != nil {
+		t.Fatal(err)
+	}
+	value := proto.Value{Bytes: []byte("value")}
+	if err := engine.MVCCPut(store.Engine(), nil, proto.Key("b"), store.clock.Now(), value, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	newDesc := *desc
+	newDesc.Replicas = []proto.Replica{{StoreID: other.StoreID()}}
+	relocate := func(switchDesc bool) {
+		if err := store.copyRange(rng, other, &newDesc, false); err != nil {
+			t.Fatal(err)
+		}
+		if switchDesc {
+			if err := engine.MVCCPutProto(store.Engine(), nil, engine.RangeDescriptorKey(desc.StartKey), store.clock.Now(), nil, &newDesc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The copy survives the target's restart without being loaded.
+		if err := other.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if r := other.LookupRange(proto.Key("b"), nil); r != nil {
+			t.Fatalf("expected copy of range %d not to be loaded before resolution", r.Desc.RaftID)
+		}
+		if err := other.ResolveRelocations(); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := engine.MVCCGet(other.Engine(), engine.StoreRelocationKey(desc.RaftID), proto.ZeroTimestamp, nil); val != nil || err != nil {
+			t.Errorf("expected relocation marker to be deleted; got %+v, %v", val, err)
+		}
+	}
+
+	relocate(false)
+	if r := store.LookupRange(proto.Key("b"), nil); r != rng {
+		t.Errorf("expected range to remain on store %d", store.StoreID())
+	}
+	if r := other.LookupRange(proto.Key("b"), nil); r != nil {
+		t.Errorf("expected no range on store %d", other.StoreID())
+	}
+	if val, err := engine.MVCCGet(other.Engine(), proto.Key("b"), store.clock.Now(), nil); val != nil || err != nil {
+		t.Errorf("expected discarded copy to be destroyed; got %+v, %v", val, err)
+	}
+
+	relocate(true)
+	if r := store.LookupRange(proto.Key("b"), nil); r != nil {
+		t.Errorf("expected range to be removed from store %d", store.StoreID())
+	}
+	if r := other.LookupRange(proto.Key("b"), nil); r == nil || r.Desc.FindReplica(other.StoreID()) == nil {
+		t.Errorf("expected range listing store %d on store %d; got %+v", other.StoreID(), other.StoreID(), r)
+	}
+	if val, err := engine.MVCCGet(other.Engine(), proto.Key("b"), store.clock.Now(), nil); err != nil || val == nil || !bytes.Equal(val.Bytes, value.Bytes) {
+		t.Errorf("expected relocated value; got %+v, %v", val, err)
+	}
+}
+
+// TestStoreDiskHeartbeat verifies that the store's disk heartbeat is
+// written and that an outstanding heartbeat marks the store stalled
+// once it exceeds StoreStallThreshold.
+func TestStoreDiskHeartbeat(t *testing.T) {
+	store, manual := createTestStore(t)
+	// Stop the store's heartbeat goroutine so it doesn't race with the
+	// simulated outstanding heartbeat below.
+	store.Stop()
+
+	manual.Set(10)
+	if err := store.heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	var ts proto.Timestamp
+	if ok, err := engine.MVCCGetProto(store.Engine(), engine.StoreHeartbeatKey(), proto.ZeroTimestamp, nil, &ts); !ok || err != nil {
+		t.Fatalf("expected heartbeat to be written: %t, %v", ok, err)
+	}
+	if ts.WallTime != 10 {
+		t.Errorf("expected heartbeat wall time 10; got %d", ts.WallTime)
+	}
+	if d := store.StallDuration(); d != 0 {
+		t.Errorf("expected no stall with completed heartbeat; got %s", d)
+	}
+
+	// Simulate a heartbeat write which doesn't complete.
+	store.heartbeatStarted = manual.UnixNano()
+	manual.Increment(StoreStallThreshold.Nanoseconds())
+	if store.Stalled() {
+		t.Error("expected store not to be stalled at threshold")
+	}
+	manual.Increment(1)
+	if !store.Stalled() {
+		t.Error("expected store to be stalled beyond threshold")
+	}
+}
+
+// TestStoreSlowSyncs verifies that a store becomes suspect after
+// SlowSyncIntervals consecutive slow WAL syncs, is advertised as such
+// in its descriptor, and recovers after a fast sync.
+func TestStoreSlowSyncs(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	for i := 0; i < SlowSyncIntervals; i++ {
+		if store.Suspect() {
+			t.Fatalf("expected store not to be suspect after %d slow syncs", i)
+		}
+		store.recordSyncLatency(2 * SlowSyncThreshold)
+	}
+	if !store.Suspect() {
+		t.Fatalf("expected store to be suspect after %d slow syncs", SlowSyncIntervals)
+	}
+	desc, err := store.Descriptor(&NodeDescriptor{NodeID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !desc.Suspect {
+		t.Error("expected store descriptor to be suspect")
+	}
+	store.recordSyncLatency(SlowSyncThreshold / 2)
+	if store.Suspect() {
+		t.Error("expected store not to be suspect after a fast sync")
+	}
+}
+
+// TestStoreRaftMetrics verifies that proposals, commit latencies,
+// entry sizes and leader elections are recorded in the store's Raft
+// metrics, which are registered under the store's ID.
+func TestStoreRaftMetrics(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("aaa"), 1, store.StoreID())
+	if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	rm := store.RaftMetrics()
+	if n := rm.proposals.Count(); n < 1 {
+		t.Errorf("expected at least 1 proposal; got %d", n)
+	}
+	if n := rm.commitLatency.Count(); n < 1 {
+		t.Errorf("expected at least 1 commit latency; got %d", n)
+	}
+	if n := rm.entrySize.Count(); n < 1 {
+		t.Errorf("expected at least 1 entry size; got %d", n)
+	}
+	if n := rm.leaderChanges.Count(); n < 1 {
+		t.Errorf("expected at least 1 leader change; got %d", n)
+	}
+	for _, name := range []string{"proposals", "commit_latency", "send.dropped", "recv.dropped"} {
+		if _, ok := metrics.DefaultRegistry.Get(raftMetricsPrefix(store.StoreID()) + name); !ok {
+			t.Errorf("expected raft metric %s to be registered", name)
+		}
+	}
+}
+
+// TestStoreMethodMetrics verifies that the latency of commands is
+// recorded per method.
+func TestStoreMethodMetrics(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	count := func() uint64 {
+		if m, ok := metrics.DefaultRegistry.Get("store.cmd.put.latency"); ok {
+			return m.(*metrics.Histogram).Count()
+		}
+		return 0
+	}
+	before := count()
+	pArgs, pReply := putArgs([]byte("a"), []byte("aaa"), 1, store.StoreID())
+	if err := store.ExecuteCmd(proto.Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	if after := count(); after != before+1 {
+		t.Errorf("expected one more put latency; got %d -> %d", before, after)
+	}
+	if _, ok := metrics.DefaultRegistry.Get("store.cmd.put.pushes"); !ok {
+		t.Error("expected put pushes to be registered")
+	}
+}
+
+// TestStoreCheckReplicationByConfigs verifies that ranges whose
+// replica count differs from their zone config are reported.
+func TestStoreCheckReplicationByConfigs(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	for i, test := range []struct {
+		replicas      int
+		misreplicated bool
+	}{
+		{1, false},
+		{3, true},
+	} {
+		zone := &proto.ZoneConfig{}
+		for j := 0; j < test.replicas; j++ {
+			zone.ReplicaAttrs = append(zone.ReplicaAttrs, proto.Attributes{})
+		}
+		configMap, err := NewPrefixConfigMap([]*PrefixConfig{{engine.KeyMin, nil, zone}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if misreplicated := store.checkReplicationByConfigs(configMap); (len(misreplicated) > 0) != test.misreplicated {
+			t.Errorf("%d: expected misreplicated %t; got %d range(s)", i, test.misreplicated, len(misreplicated))
+		}
+	}
+}
+
+// TestStoreFreezeRanges verifies that FreezeRanges freezes and
+// unfreezes the ranges overlapping a key span.
+func TestStoreFreezeRanges(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	descs, err := FreezeRanges(store.db, engine.KeyMin, engine.KeyMax, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := store.LookupRange(proto.Key("a"), nil)
+	if len(descs) != 1 || descs[0].RaftID != rng.Desc.RaftID {
+		t.Fatalf("expected range %d to be frozen; got %+v", rng.Desc.RaftID, descs)
+	}
+	if !rng.IsFrozen() {
+		t.Error("expected range to be frozen")
+	}
+	if _, err := FreezeRanges(store.db, engine.KeyMin, engine.KeyMax, false); err != nil {
+		t.Fatal(err)
+	}
+	if rng.IsFrozen() {
+		t.Error("expected range to be unfrozen")
+	}
+}
+
+// pushCountingSender counts the InternalPushTxn calls it forwards to
+// the wrapped sender.
+type pushCountingSender struct {
+	client.KVSender
+	pushes int
+}
+
+// Send implements the client.KVSender interface.
+func (pcs *pushCountingSender) Send(call *client.Call) {
+	if call.Method == proto.InternalPushTxn {
+		pcs.pushes++
+	}
+	pcs.KVSender.Send(call)
+}
+
+// TestStoreResolveWriteIntentsSinglePush verifies that all intents of
+// a transaction encountered by a scan are resolved after a single
+// push, and that intents of a transaction already found to be aborted
+// are resolved without pushing it again.
+func TestStoreResolveWriteIntentsSinglePush(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	sender := &pushCountingSender{KVSender: store.db.Sender()}
+	store.db = client.NewKV(sender, nil)
+
+	pushee := newTransaction("test", proto.Key("a"), 1, proto.SERIALIZABLE, store.clock)
+	pushee.Priority = 0 // pushee should lose all conflicts
+	for _, key := range []string{"a", "b", "c"} {
+		args, reply := putArgs(proto.Key(key), []byte("value"), 1, store.StoreID())
+		args.Timestamp = pushee.Timestamp
+		args.Txn = pushee
+		if err := store.ExecuteCmd(proto.Put, args, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Scan outside a transaction; all three intents are pushed at once.
+	sArgs, sReply := scanArgs([]byte("a"), []byte("d"), 1, store.StoreID())
+	sArgs.Timestamp = store.clock.Now()
+	sArgs.UserPriority = gogoproto.Int32(math.MaxInt32)
+	if err := store.ExecuteCmd(proto.Scan, sArgs, sReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(sReply.Rows) != 0 {
+		t.Errorf("expected no rows; got %+v", sReply.Rows)
+	}
+	if sender.pushes != 1 {
+		t.Errorf("expected scan to push once; got %d pushes", sender.pushes)
+	}
+
+	// Write outside of a transaction, aborting the pushee. Further
+	// writes to its intents need not push it again.
+	for i, key := range []string{"a", "b", "c"} {
+		args, reply := putArgs(proto.Key(key), []byte("value2"), 1, store.StoreID())
+		args.Timestamp = store.clock.Now()
+		args.UserPriority = gogoproto.Int32(math.MaxInt32)
+		if err := store.ExecuteCmd(proto.Put, args, reply); err != nil {
+			t.Fatalf("%d: expected success aborting pushee's txn; got %s", i, err)
+		}
+	}
+	if sender.pushes != 2 {
+		t.Errorf("expected a single push to abort pushee; got %d pushes in total", sender.pushes)
+	}
+	if txn := store.txnStatuses.get(pushee.ID); txn == nil || txn.Status != proto.ABORTED {
+		t.Errorf("expected pushee to be cached as aborted; got %+v", txn)
+	}
+}
+
+// TestStoreUpdateReplicaAttrs verifies that store attributes are
+// persisted and that the descriptor of a range is rewritten with
+// changed attributes for the store's replica.
+func TestStoreUpdateReplicaAttrs(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+
+	var recorded proto.Attributes
+	if ok, err := engine.MVCCGetProto(store.engine, engine.StoreAttrsKey(), proto.ZeroTimestamp, nil, &recorded); !ok || err != nil {
+		t.Fatalf("expected recorded store attributes; got %t, %v", ok, err)
+	}
+	if recorded.SortedString() != store.Attrs().SortedString() {
+		t.Errorf("expected recorded attributes %q; got %q", store.Attrs().SortedString(), recorded.SortedString())
+	}
+
+	rng := store.LookupRange(proto.KeyMin, nil)
+	if ok, err := store.updateReplicaAttrs(rng, store.Attrs()); ok || err != nil {
+		t.Fatalf("expected no update with unchanged attributes; got %t, %v", ok, err)
+	}
+	attrs := proto.Attributes{Attrs: []string{"ssd"}}
+	if ok, err := store.updateReplicaAttrs(rng, attrs); !ok || err != nil {
+		t.Fatalf("expected update with changed attributes; got %t, %v", ok, err)
+	}
+	var desc proto.RangeDescriptor
+	if ok, err := engine.MVCCGetProto(store.engine, engine.RangeDescriptorKey(proto.KeyMin), store.clock.Now(), nil, &desc); !ok || err != nil {
+		t.Fatalf("unable to read range descriptor: %t, %v", ok, err)
+	}
+	for _, desc := range []*proto.RangeDescriptor{&desc, rng.Desc} {
+		if a := desc.Replicas[0].Attrs.SortedString(); a != attrs.SortedString() {
+			t.Errorf("expected replica attributes %q; got %q", attrs.SortedString(), a)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+	gogoproto "github.com/gogo/protobuf/proto"
+)
+
+// defaultTxnStatusCacheSize is the maximum number of transactions
+// whose final status is remembered by a store.
+const defaultTxnStatusCacheSize = 1024
+
+// A txnStatusCache remembers the most recently pushed transactions
+// which were found to be committed or aborted. Since a transaction's
+// final status never changes, a store which encounters further intents
+// of such a transaction can resolve them without pushing it again.
+// The cache is bounded in size, evicting the least recently used
+// transactions first. It is safe for concurrent use.
+type txnStatusCache struct {
+	sync.Mutex
+	cache *util.UnorderedCache
+}
+
+// newTxnStatusCache returns a txnStatusCache holding up to maxSize
+// transactions.
+func newTxnStatusCache(maxSize int) *txnStatusCache {
+	return &txnStatusCache{
+		cache: util.NewUnorderedCache(util.CacheConfig{
+			Policy: util.CacheLRU,
+			ShouldEvict: func(size int, key, value interface{}) bool {
+				return size > maxSize
+			},
+		}),
+	}
+}
+
+// add records the status of txn if it is committed or aborted;
+// pending transactions are ignored.
+func (tsc *txnStatusCache) add(txn *proto.Transaction) {
+	if txn == nil || txn.Status == proto.PENDING {
+		return
+	}
+	tsc.Lock()
+	defer tsc.Unlock()
+	tsc.cache.Add(string(txn.ID), gogoproto.Clone(txn))
+}
+
+// get returns a copy of the committed or aborted transaction with
+// the specified ID, or nil if its status is not known.
+func (tsc *txnStatusCache) get(txnID []byte) *proto.Transaction {
+	tsc.Lock()
+	defer tsc.Unlock()
+	if txn, ok := tsc.cache.Get(string(txnID)); ok {
+		return gogoproto.Clone(txn.(*proto.Transaction)).(*proto.Transaction)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/settings"
+)
+
+var (
+	storeWarmupDuration = settings.RegisterDurationSetting("storage.warmup.duration",
+		"period after a store restarts over which it ramps up the leadership of its ranges "+
+			"and the processing of its queues; 0 to disable", 2*time.Minute)
+	storeWarmupQueueDelay = settings.RegisterDurationSetting("storage.warmup.queue_delay",
+		"delay between ranges processed by each queue of a store at the start of its warm-up, "+
+			"decreasing to none by its end", 10*time.Second)
+)
+
+// A storeWarmup ramps up the work taken on by a store after it
+// restarts, so that a returning node doesn't absorb its full load with
+// a cold block cache. Over the warm-up period, the store's ranges
+// take up leadership progressively and its queues process ranges at
+// an increasing rate. System ranges, which the whole cluster depends
+// on, are exempt: they lead from the start and are processed first.
+//
+// storeWarmup is thread safe.
+type storeWarmup struct {
+	start    int64 // Wall time in nanoseconds at which the warm-up began; accessed atomically
+	duration int64 // Duration of the warm-up in nanoseconds; accessed atomically
+}
+
+// begin starts the warm-up at now for the duration of the
+// storage.warmup.duration setting.
+func (w *storeWarmup) begin(now time.Time) {
+	atomic.StoreInt64(&w.duration, int64(storeWarmupDuration.Get()))
+	atomic.StoreInt64(&w.start, now.UnixNano())
+}
+
+// progress returns the fraction of the warm-up elapsed at now, or 1 if
+// the store isn't warming up.
+func (w *storeWarmup) progress(now time.Time) float64 {
+	start, duration := atomic.LoadInt64(&w.start), atomic.LoadInt64(&w.duration)
+	if start == 0 || duration <= 0 {
+		return 1
+	}
+	elapsed := now.UnixNano() - start
+	if elapsed >= duration {
+		return 1
+	} else if elapsed < 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(duration)
+}
+
+// mayLead returns whether rng may lead its range at now. Ranges
+// without a voting replica on another store known to be warm, as
+// reported by hasWarmVoter, always may: after a restart of the whole
+// cluster, no replica could lead instead. Others are admitted in an
+// order fixed by their Raft IDs, spread over the warm-up period.
+func (w *storeWarmup) mayLead(now time.Time, rng *Range, hasWarmVoter func(*Range) bool) bool {
+	p := w.progress(now)
+	if p >= 1 || isSystemRange(rng) || !hasWarmVoter(rng) {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strconv.FormatInt(rng.Desc.RaftID, 10)))
+	return float64(h.Sum32()%1000)/1000 < p
+}
+
+// hasWarmVoter returns whether rng has a voting replica on a store
+// other than this one whose gossiped descriptor reports that it isn't
+// warming up. Replicas added to a range are initialized from a
+// snapshot (see Store.SendSnapshot), so such a replica can serve the
+// range in this one's stead. Stores which haven't gossiped since they
+// started aren't known to be warm.
+func (s *Store) hasWarmVoter(rng *Range) bool {
+	if s.gossip == nil {
+		return false
+	}
+	rng.RLock()
+	replicas := rng.Desc.Replicas
+	rng.RUnlock()
+	for _, replica := range replicas {
+		if replica.StoreID == s.StoreID() || replica.NonVoter {
+			continue
+		}
+		info, err := s.gossip.GetInfo(gossip.MakeCapacityGossipKey(replica.NodeID, replica.StoreID))
+		if err != nil {
+			continue
+		}
+		if desc, ok := info.(StoreDescriptor); ok && !desc.WarmingUp {
+			return true
+		}
+	}
+	return false
+}
+
+// queueDelay returns the minimum delay at now between ranges other
+// than system ranges processed by each of the store's queues.
+func (w *storeWarmup) queueDelay(now time.Time) time.Duration {
+	return time.Duration((1 - w.progress(now)) * float64(storeWarmupQueueDelay.Get()))
+}
+
+// isSystemRange returns whether rng holds system keys, such as the
+// meta ranges' range addressing records.
+func isSystemRange(rng *Range) bool {
+	return rng.Desc.StartKey.Less(engine.KeySystemMax)
+}
@@ -0,0 +1,201 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// TestStoreWarmupProgress verifies that the queue delay decreases to
+// none over the course of a store's warm-up.
+func TestStoreWarmupProgress(t *testing.T) {
+	start := time.Unix(100, 0)
+	w := &storeWarmup{}
+	if p := w.progress(start); p != 1 {
+		t.Errorf("expected no warm-up before it begins; got progress %f", p)
+	}
+	if d := w.queueDelay(start); d != 0 {
+		t.Errorf("expected no queue delay before the warm-up begins; got %s", d)
+	}
+	w.begin(start)
+	duration := storeWarmupDuration.Get()
+	if d := w.queueDelay(start); d != storeWarmupQueueDelay.Get() {
+		t.Errorf("expected the full queue delay at the start of the warm-up; got %s", d)
+	}
+	if p := w.progress(start.Add(duration / 4)); p != 0.25 {
+		t.Errorf("expected progress 0.25; got %f", p)
+	}
+	if d := w.queueDelay(start.Add(duration / 2)); d != storeWarmupQueueDelay.Get()/2 {
+		t.Errorf("expected half the queue delay halfway through the warm-up; got %s", d)
+	}
+	if d := w.queueDelay(start.Add(duration)); d != 0 {
+		t.Errorf("expected no queue delay after the warm-up; got %s", d)
+	}
+}
+
+// TestStoreWarmupMayLead verifies that while a store warms up, system
+// ranges and ranges without other warm voters may lead at once and the
+// other ranges are admitted progressively.
+func TestStoreWarmupMayLead(t *testing.T) {
+	start := time.Unix(100, 0)
+	w := &storeWarmup{}
+	w.begin(start)
+	duration := storeWarmupDuration.Get()
+
+	replicas := []proto.Replica{{StoreID: 1}, {StoreID: 2}}
+	system := &Range{Desc: &proto.RangeDescriptor{RaftID: 1, StartKey: engine.KeyMin, Replicas: replicas}}
+	cold := &Range{Desc: &proto.RangeDescriptor{RaftID: 2, StartKey: proto.Key("a"), Replicas: replicas}}
+	warm := func(rng *Range) bool { return rng != cold }
+	if !w.mayLead(start, system, warm) || !w.mayLead(start, cold, warm) {
+		t.Error("expected system ranges and ranges without other warm voters to lead at once")
+	}
+
+	var ranges []*Range
+	for id := int64(3); id < 103; id++ {
+		ranges = append(ranges, &Range{Desc: &proto.RangeDescriptor{RaftID: id, StartKey: proto.Key("a"), Replicas: replicas}})
+	}
+	leaders := func(now time.Time) int {
+		var n int
+		for _, rng := range ranges {
+			if w.mayLead(now, rng, warm) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := leaders(start); n != 0 {
+		t.Errorf("expected no range to lead at the start of the warm-up; got %d", n)
+	}
+	if n := leaders(start.Add(duration / 2)); n == 0 || n == len(ranges) {
+		t.Errorf("expected some ranges to lead halfway through the warm-up; got %d", n)
+	}
+	if n := leaders(start.Add(duration)); n != len(ranges) {
+		t.Errorf("expected all ranges to lead after the warm-up; got %d", n)
+	}
+}
+
+// TestStoreHasWarmVoter verifies that a voting replica on another
+// store is known to be warm only once its store gossips a descriptor
+// which reports that it isn't warming up.
+func TestStoreHasWarmVoter(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Stop()
+	rng := &Range{Desc: &proto.RangeDescriptor{RaftID: 2, Replicas: []proto.Replica{
+		{NodeID: 1, StoreID: store.StoreID()},
+		{NodeID: 2, StoreID: 2},
+		{NodeID: 3, StoreID: 3, NonVoter: true},
+	}}}
+	if store.hasWarmVoter(rng) {
+		t.Error("expected no warm voter without gossiped descriptors")
+	}
+	for _, sd := range []StoreDescriptor{
+		{StoreID: 2, Node: NodeDescriptor{NodeID: 2}, WarmingUp: true},
+		{StoreID: 3, Node: NodeDescriptor{NodeID: 3}},
+	} {
+		if err := store.Gossip().AddInfo(gossip.MakeCapacityGossipKey(sd.Node.NodeID, sd.StoreID), sd, 0*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.hasWarmVoter(rng) {
+		t.Error("expected voters warming up and warm non-voters not to count")
+	}
+	warm := StoreDescriptor{StoreID: 2, Node: NodeDescriptor{NodeID: 2}}
+	if err := store.Gossip().AddInfo(gossip.MakeCapacityGossipKey(2, 2), warm, 0*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !store.hasWarmVoter(rng) {
+		t.Error("expected warm voter once its store gossips that it's warm")
+	}
+}
+
+// TestBaseQueueWarmup verifies that while a store warms up, its
+// queues process system ranges first and pace other ranges.
+func TestBaseQueueWarmup(t *testing.T) {
+	manual := hlc.NewManualClock(time.Unix(100, 0).UnixNano())
+	clock := hlc.NewClock(manual.UnixNano)
+	system := &Range{Desc: &proto.RangeDescriptor{RaftID: 1, StartKey: engine.KeyMin}}
+	r1 := &Range{Desc: &proto.RangeDescriptor{RaftID: 2, StartKey: proto.Key("a")}}
+	r2 := &Range{Desc: &proto.RangeDescriptor{RaftID: 3, StartKey: proto.Key("b")}}
+	priorities := map[*Range]float64{system: 1, r1: 3, r2: 2}
+	shouldQ := func(now time.Time, r *Range) (bool, float64) { return true, priorities[r] }
+	process := func(now time.Time, r *Range) error { return nil }
+	bq := newBaseQueue("test", shouldQ, process, 10)
+	bq.setClock(clock)
+	bq.warmup = &storeWarmup{}
+	bq.warmup.begin(time.Unix(0, clock.PhysicalNow()))
+	for _, rng := range []*Range{system, r1, r2} {
+		bq.MaybeAdd(rng)
+	}
+
+	if rng := bq.Pop(); rng != system {
+		t.Errorf("expected the system range first; got %+v", rng)
+	}
+	if rng := bq.Pop(); rng != nil {
+		t.Errorf("expected processing to be paced; got %+v", rng)
+	}
+	manual.Increment(int64(storeWarmupQueueDelay.Get()))
+	if rng := bq.Pop(); rng != r1 {
+		t.Errorf("expected r1 after the queue delay; got %+v", rng)
+	}
+	manual.Increment(int64(storeWarmupDuration.Get()))
+	if rng := bq.Pop(); rng != r2 {
+		t.Errorf("expected r2 without delay after the warm-up; got %+v", rng)
+	}
+}
+
+// TestStoreWarmupLeadership verifies that a range on a restarting
+// store with a warm voter elsewhere rejects commands with a
+// NotLeaderError until the warm-up admits it, and that the warm-up
+// doesn't affect a range without other voters.
+func TestStoreWarmupLeadership(t *testing.T) {
+	store, manual := createTestStore(t)
+	defer store.Stop()
+	manual.Set(time.Unix(100, 0).UnixNano())
+	rng := splitTestRange(store, engine.KeyMin, proto.Key("a"), t)
+
+	store.warmup.begin(time.Unix(0, store.clock.PhysicalNow()))
+	if !rng.IsLeader() {
+		t.Error("expected a range without other voters to lead while warming up")
+	}
+	warm := StoreDescriptor{StoreID: 2, Node: NodeDescriptor{NodeID: 2}}
+	if err := store.Gossip().AddInfo(gossip.MakeCapacityGossipKey(2, 2), warm, 0*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	rng.Lock()
+	rng.Desc.Replicas = append(append([]proto.Replica(nil), rng.Desc.Replicas...), proto.Replica{NodeID: 2, StoreID: 2})
+	rng.Unlock()
+
+	gArgs, gReply := getArgs([]byte("a"), rng.Desc.RaftID, store.StoreID())
+	gArgs.Timestamp = store.clock.Now()
+	if err := rng.AddCmd(proto.Get, gArgs, gReply, true); err == nil {
+		t.Error("expected a warming range with a warm voter elsewhere to defer leadership")
+	} else if _, ok := err.(*proto.NotLeaderError); !ok {
+		t.Errorf("expected not leader error; got %s", err)
+	}
+
+	manual.Increment(int64(storeWarmupDuration.Get()))
+	gArgs, gReply = getArgs([]byte("a"), rng.Desc.RaftID, store.StoreID())
+	gArgs.Timestamp = store.clock.Now()
+	if err := rng.AddCmd(proto.Get, gArgs, gReply, true); err != nil {
+		t.Errorf("expected the range to lead after the warm-up; got %s", err)
+	}
+}
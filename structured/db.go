@@ -19,6 +19,8 @@
 package structured
 
 import (
+	"fmt"
+
 	"github.com/cockroachdb/cockroach/client"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage/engine"
@@ -30,6 +32,9 @@ type DB interface {
 	PutSchema(*Schema) error
 	DeleteSchema(*Schema) error
 	GetSchema(string) (*Schema, error)
+	AcquireSchemaLease(key string, nodeID int32) (*Schema, *SchemaLease, error)
+	ReleaseSchemaLease(*SchemaLease) error
+	CheckSchemaLeases(key string) error
 }
 
 // A structuredDB satisfies the DB interface using the
@@ -46,13 +51,39 @@ func NewDB(kvDB *client.KV) DB {
 }
 
 // PutSchema inserts s into the kv store for subsequent
-// usage by clients.
+// usage by clients, incrementing its version. If s.Version is
+// non-zero, it must be the version of the stored schema. The update
+// fails with a SchemaLeaseError while leases are held on versions
+// preceding the stored one.
 func (db *structuredDB) PutSchema(s *Schema) error {
 	if err := s.Validate(); err != nil {
 		return err
 	}
-	k := engine.MakeKey(engine.KeySchemaPrefix, proto.Key(s.Key))
-	return db.kvDB.PutI(k, s)
+	txnOpts := &client.TransactionOptions{Name: fmt.Sprintf("put schema %q", s.Key)}
+	var version int64
+	if err := db.kvDB.RunTransaction(txnOpts, func(txn *client.KV) error {
+		existing, err := getSchema(txn, s.Key)
+		if err != nil {
+			return err
+		}
+		version = 1
+		if existing != nil {
+			if s.Version != 0 && s.Version != existing.Version {
+				return fmt.Errorf("schema %q is at version %d; update is of version %d", s.Key, existing.Version, s.Version)
+			}
+			if err := checkSchemaLeases(txn, s.Key, existing.Version); err != nil {
+				return err
+			}
+			version = existing.Version + 1
+		}
+		updated := *s
+		updated.Version = version
+		return txn.PutI(engine.MakeKey(engine.KeySchemaPrefix, proto.Key(s.Key)), &updated)
+	}); err != nil {
+		return err
+	}
+	s.Version = version
+	return nil
 }
 
 // DeleteSchema removes s from the kv store.
@@ -68,9 +99,14 @@ func (db *structuredDB) DeleteSchema(s *Schema) error {
 // one does not exist. A nil error is returned when a schema
 // with the given key cannot be found.
 func (db *structuredDB) GetSchema(key string) (*Schema, error) {
+	return getSchema(db.kvDB, key)
+}
+
+// getSchema reads the Schema with the given key using kv.
+func getSchema(kv *client.KV, key string) (*Schema, error) {
 	s := &Schema{}
 	k := engine.MakeKey(engine.KeySchemaPrefix, proto.Key(key))
-	found, _, err := db.kvDB.GetI(k, s)
+	found, _, err := kv.GetI(k, s)
 	if err != nil || !found {
 		s = nil
 	}
@@ -377,6 +377,13 @@ look like:
   pdb/us/<E(600)>: <data for user 600>
   ...
 
+Ranges aren't split between a row and the rows interleaved in it.
+When a range is split at a key chosen by size which falls among the
+interleaved rows of a user, the range is split at the user's key
+instead, so that joins of a user with its addresses, and the cascading
+delete of its addresses, stay within a single range. Only if a user's
+data exceeds a range on its own is it split where the size requires.
+
 Indexes
 
 Indexes provide efficient access to rows in the database by columnar
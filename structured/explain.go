@@ -0,0 +1,192 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// Index names reported by a Plan besides those of index tables.
+const (
+	// PlanIndexPrimary is the index of plans which read rows by their
+	// primary key.
+	PlanIndexPrimary = "primary"
+	// PlanIndexNone is the index of plans which scan the whole table.
+	PlanIndexNone = "none"
+)
+
+// A Span is a range of keys [Start, End) read by a Plan.
+type Span struct {
+	Start proto.Key `json:"start"`
+	End   proto.Key `json:"end"`
+}
+
+// A Plan describes how a read of the rows of a table matching values
+// of some of its columns is executed.
+type Plan struct {
+	Table string `json:"table"`
+	// Index is PlanIndexPrimary, the key of the index table read (e.g.
+	// "us:em") or PlanIndexNone.
+	Index string `json:"index"`
+	// Spans are the spans of keys read. When reading an index table,
+	// rows are then read by the primary keys found.
+	Spans []Span `json:"spans"`
+	// Filter lists the columns whose values are matched against rows
+	// after they're read, as they don't narrow the spans.
+	Filter []string `json:"filter,omitempty"`
+	// EstimatedRows is the estimated number of rows read, from the
+	// RowCounter supplied to Explain.
+	EstimatedRows int64 `json:"estimated_rows"`
+}
+
+// A RowCounter estimates the number of rows in a span, typically from
+// the stats of the ranges which the span overlaps.
+type RowCounter func(span Span) (int64, error)
+
+// Explain returns the plan of a read of the rows of the named table of
+// s with the given column values, keyed by column name. The primary
+// key is used if values are given for a prefix of it (all of it, if
+// it's scattered), and otherwise a secondary or unique index on one of
+// the columns, preferring unique ones. Failing both, the whole table
+// is scanned. Rows of interleaved tables are read from within the
+// rows of their parent. Reads of all of a primary key or of a unique
+// index are estimated to match at most one row; others are estimated
+// by count.
+func Explain(s *Schema, table string, values map[string]string, count RowCounter) (*Plan, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	t, ok := s.byName[table]
+	if !ok {
+		return nil, fmt.Errorf("schema %q: table %q not found", s.Key, table)
+	}
+	filter := map[string]struct{}{}
+	for name := range values {
+		c, ok := t.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("table %q: column %q not found", table, name)
+		}
+		if c.State != "" {
+			return nil, fmt.Errorf("table %q: column %q is not public", table, name)
+		}
+		filter[name] = struct{}{}
+	}
+	plan := &Plan{Table: table}
+
+	// Use the longest prefix of the primary key with values.
+	prefix, pkColumns, used, err := rowKeyPrefix(s, t, values)
+	if err != nil {
+		return nil, err
+	}
+	var pk []byte
+	var n int
+	for _, c := range pkColumns {
+		v, ok := values[c.Name]
+		if !ok {
+			break
+		}
+		if pk, err = encodeColumnValue(pk, c, v); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	point := len(pkColumns) > 0 && n == len(pkColumns)
+	if n > 0 && !point && pkColumns[0].Scatter {
+		// Rows are scattered by the hash of their whole primary key.
+		n, pk = 0, nil
+	}
+	if n > 0 || len(used) > 0 {
+		plan.Index = PlanIndexPrimary
+		for _, c := range append(used, pkColumns[:n]...) {
+			delete(filter, c.Name)
+		}
+		key := append(proto.Key(nil), prefix...)
+		if point && pkColumns[0].Scatter {
+			key = append(key, scatterPrefix(pk)...)
+		}
+		key = append(key, pk...)
+		if point {
+			plan.Spans = []Span{{Start: key, End: key.Next()}}
+		} else {
+			plan.Spans = []Span{{Start: key, End: key.PrefixEnd()}}
+		}
+	} else if c := chooseIndex(t, values); c != nil {
+		plan.Index = t.Key + ":" + c.Key
+		point = c.Index == indexTypeUnique
+		delete(filter, c.Name)
+		b, err := encodeColumnValue(indexKeyPrefix(s, t, c), c, values[c.Name])
+		if err != nil {
+			return nil, err
+		}
+		key := proto.Key(b)
+		plan.Spans = []Span{{Start: key, End: key.PrefixEnd()}}
+	} else {
+		plan.Index = PlanIndexNone
+		plan.Spans = []Span{{Start: prefix, End: prefix.PrefixEnd()}}
+	}
+	for name := range filter {
+		plan.Filter = append(plan.Filter, name)
+	}
+	sort.Strings(plan.Filter)
+
+	if point {
+		plan.EstimatedRows = 1
+		return plan, nil
+	}
+	for _, span := range plan.Spans {
+		n, err := count(span)
+		if err != nil {
+			return nil, err
+		}
+		plan.EstimatedRows += n
+	}
+	return plan, nil
+}
+
+// chooseIndex returns the column of t with a value whose secondary or
+// unique index is used to read the rows with values, or nil if there
+// is none. Unique indexes are preferred. Foreign keys are indexed.
+func chooseIndex(t *Table, values map[string]string) *Column {
+	var chosen *Column
+	for _, c := range t.Columns {
+		if _, ok := values[c.Name]; !ok {
+			continue
+		}
+		if c.Index == indexTypeUnique {
+			return c
+		}
+		if hasTermIndex(c) && chosen == nil {
+			chosen = c
+		}
+	}
+	return chosen
+}
+
+// hasTermIndex returns whether column c has a secondary or unique
+// index, whose terms are the column's values. Foreign keys have a
+// secondary index unless another index is specified.
+func hasTermIndex(c *Column) bool {
+	switch c.Index {
+	case indexTypeSecondary, indexTypeUnique:
+		return true
+	case "":
+		return c.ForeignKey != ""
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/encoding"
+)
+
+// TestExplain verifies the index, spans, filtered columns and row
+// estimates of the plans of reads of the test schema.
+func TestExplain(t *testing.T) {
+	s, err := createTestSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func(span Span) (int64, error) { return 42, nil }
+
+	userKey, err := rowKey(s, s.byName["User"], map[string]string{"ID": "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamKey, err := rowKey(s, s.byName["PhotoStream"], map[string]string{"ID": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments := proto.MakeKey(streamKey, proto.Key("/co/"))
+	identities := proto.Key("pdb/id:ui/" + string(encoding.EncodeInt(nil, 3)))
+	testCases := []struct {
+		table  string
+		values map[string]string
+		expect Plan
+	}{
+		// Full scattered primary key.
+		{"User", map[string]string{"ID": "5"}, Plan{
+			Index: PlanIndexPrimary, Spans: []Span{{userKey, userKey.Next()}}, EstimatedRows: 1,
+		}},
+		// Unindexed column.
+		{"User", map[string]string{"Name": "spencer"}, Plan{
+			Index: PlanIndexNone, Spans: []Span{{proto.Key("pdb/us/"), proto.Key("pdb/us0")}},
+			Filter: []string{"Name"}, EstimatedRows: 42,
+		}},
+		// Foreign keys are indexed.
+		{"Identity", map[string]string{"UserID": "3"}, Plan{
+			Index: "id:ui", Spans: []Span{{identities, identities.PrefixEnd()}}, EstimatedRows: 42,
+		}},
+		// Interleaved rows follow their parent's.
+		{"Comment", map[string]string{"PhotoStreamID": "7", "Timestamp": "1"}, Plan{
+			Index: PlanIndexPrimary, Spans: []Span{{comments, comments.PrefixEnd()}},
+			Filter: []string{"Timestamp"}, EstimatedRows: 42,
+		}},
+		// Without the parent, all of the parent's rows are scanned.
+		{"Comment", map[string]string{"ID": "1"}, Plan{
+			Index: PlanIndexNone, Spans: []Span{{proto.Key("pdb/ps/"), proto.Key("pdb/ps0")}},
+			Filter: []string{"ID"}, EstimatedRows: 42,
+		}},
+	}
+	for i, test := range testCases {
+		plan, err := Explain(s, test.table, test.values, count)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		test.expect.Table = test.table
+		if !reflect.DeepEqual(*plan, test.expect) {
+			t.Errorf("%d: expected plan %+v; got %+v", i, test.expect, *plan)
+		}
+	}
+
+	for i, values := range []map[string]string{
+		{"Email": "a@b.com"}, // unknown column
+		{"ID": "five"},       // invalid integer
+	} {
+		if _, err := Explain(s, "User", values, count); err == nil {
+			t.Errorf("%d: expected error explaining read of %v", i, values)
+		}
+	}
+	if _, err := Explain(s, "Album", nil, count); err == nil {
+		t.Error("expected error explaining read of unknown table")
+	}
+}
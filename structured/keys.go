@@ -0,0 +1,197 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/encoding"
+)
+
+// rootRowKeyPrefix returns the prefix of the keys of the rows of
+// table t of schema s, which must not be interleaved.
+func rootRowKeyPrefix(s *Schema, t *Table) proto.Key {
+	return proto.Key(s.Key + "/" + t.Key + "/")
+}
+
+// rowKeyPrefix returns the prefix of the keys of the rows of table t
+// of validated schema s with the given column values, keyed by column
+// name, followed by the columns of t's primary key which complete the
+// keys and the columns whose values are used in the prefix. The rows
+// of a table are keyed by <schema key>/<table key>/<primary key>,
+// unless the table is interleaved, in which case they follow the row
+// they reference: <parent row key>/<table key>/<rest of primary key>.
+// If values are missing for the interleaving foreign key, the prefix
+// is that of the parent's rows and no columns complete it.
+func rowKeyPrefix(s *Schema, t *Table, values map[string]string) (proto.Key, []*Column, []*Column, error) {
+	parent, fk := interleavedParent(s, t)
+	if parent == nil {
+		return rootRowKeyPrefix(s, t), t.primaryKey, nil, nil
+	}
+	parentValues := map[string]string{}
+	var used []*Column
+	for _, pc := range parent.primaryKey {
+		c := fk[pc.Name]
+		v, ok := values[c.Name]
+		if !ok {
+			prefix, _, _, err := rowKeyPrefix(s, parent, nil)
+			return prefix, nil, nil, err
+		}
+		parentValues[pc.Name] = v
+		used = append(used, c)
+	}
+	key, err := rowKey(s, parent, parentValues)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return append(key, "/"+t.Key+"/"...), keyColumns(s, t), used, nil
+}
+
+// keyColumns returns the columns of the primary key of table t of
+// validated schema s which are encoded in the keys of its rows
+// following the prefix of the table's rows; those of the foreign key
+// of an interleaved table are encoded in its parent's row key.
+func keyColumns(s *Schema, t *Table) []*Column {
+	if parent, _ := interleavedParent(s, t); parent == nil {
+		return t.primaryKey
+	}
+	var columns []*Column
+	for _, c := range t.primaryKey {
+		if !c.Interleave {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// rowKey returns the key of the row of table t of validated schema s
+// with the given values of all of the columns of its primary key.
+func rowKey(s *Schema, t *Table, values map[string]string) (proto.Key, error) {
+	prefix, pkColumns, _, err := rowKeyPrefix(s, t, values)
+	if err != nil {
+		return nil, err
+	}
+	var pk []byte
+	for _, c := range pkColumns {
+		v, ok := values[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("table %q: no value for primary key column %q", t.Name, c.Name)
+		}
+		if pk, err = encodeColumnValue(pk, c, v); err != nil {
+			return nil, err
+		}
+	}
+	key := append(proto.Key(nil), prefix...)
+	if len(pkColumns) > 0 && pkColumns[0].Scatter {
+		key = append(key, scatterPrefix(pk)...)
+	}
+	return append(key, pk...), nil
+}
+
+// interleavedParent returns the table in which the rows of t are
+// interleaved, along with the foreign key which references it, keyed
+// by the name of the referenced column, or nil if t isn't interleaved.
+func interleavedParent(s *Schema, t *Table) (*Table, map[string]*Column) {
+	for name, fk := range t.foreignKeys {
+		for _, c := range fk {
+			if c.Interleave {
+				return s.byName[name], fk
+			}
+			break
+		}
+	}
+	return nil, nil
+}
+
+// indexKeyPrefix returns the prefix of the keys of the index on
+// column c of table t of schema s: <schema key>/<table key>:<column
+// key>/.
+func indexKeyPrefix(s *Schema, t *Table, c *Column) proto.Key {
+	return proto.Key(s.Key + "/" + t.Key + ":" + c.Key + "/")
+}
+
+// scatterPrefix returns the two-byte hash of the encoded primary key
+// which precedes it in the keys of rows of tables with scattered
+// primary keys.
+func scatterPrefix(pk []byte) []byte {
+	h := fnv.New32a()
+	h.Write(pk)
+	sum := h.Sum32()
+	return []byte{byte(sum >> 8), byte(sum)}
+}
+
+// encodeColumnValue appends the order-preserving key encoding of v,
+// the textual form of a value of column c, to b. Times are given in
+// RFC 3339 format and encoded as nanoseconds since the Unix epoch.
+// Only values of scalar types can be encoded.
+func encodeColumnValue(b []byte, c *Column, v string) ([]byte, error) {
+	switch c.Type {
+	case columnTypeInteger:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: invalid integer %q", c.Name, v)
+		}
+		return encoding.EncodeInt(b, i), nil
+	case columnTypeFloat:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: invalid float %q", c.Name, v)
+		}
+		return encoding.EncodeFloat(b, f), nil
+	case columnTypeString:
+		return encoding.EncodeString(b, v), nil
+	case columnTypeBlob:
+		return encoding.EncodeBinary(b, []byte(v)), nil
+	case columnTypeTime:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: invalid time %q", c.Name, v)
+		}
+		return encoding.EncodeInt(b, t.UnixNano()), nil
+	}
+	return nil, fmt.Errorf("column %q: values of type %q can't be used in keys", c.Name, c.Type)
+}
+
+// skipColumnValue returns the remainder of b following the key
+// encoding of a value of column c.
+func skipColumnValue(b []byte, c *Column) (rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("column %q: missing value", c.Name)
+	}
+	switch c.Type {
+	case columnTypeInteger, columnTypeTime:
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("column %q: invalid integer encoding: %v", c.Name, r)
+			}
+		}()
+		rest, _ = encoding.DecodeInt(b)
+		return rest, nil
+	case columnTypeString, columnTypeBlob:
+		// Neither encoding contains 0x00 bytes but for its terminator.
+		i := bytes.IndexByte(b[1:], 0)
+		if i < 0 {
+			return nil, fmt.Errorf("column %q: unterminated value", c.Name)
+		}
+		return b[i+2:], nil
+	}
+	return nil, fmt.Errorf("column %q: values of type %q can't be decoded from keys", c.Name, c.Type)
+}
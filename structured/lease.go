@@ -0,0 +1,217 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/encoding"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// SchemaLeaseDuration is the time for which a schema lease is held
+// unless it's released or renewed by acquiring it again.
+var SchemaLeaseDuration = 5 * time.Minute
+
+// A SchemaLease is held by a node on the version of a schema it uses.
+// While any node holds an unexpired lease on a version of a schema,
+// the schema may not be updated beyond the version which follows it.
+// This bounds the versions in use across the cluster to two adjacent
+// ones, which is what allows schema changes to proceed online.
+type SchemaLease struct {
+	SchemaKey       string
+	Version         int64
+	NodeID          int32
+	ExpirationNanos int64
+}
+
+// Deadline returns the timestamp by which transactions using the
+// leased version of the schema must commit, as the schema may move
+// past that version once the lease expires; see client.KV.UpdateDeadline.
+func (l *SchemaLease) Deadline() proto.Timestamp {
+	return proto.Timestamp{WallTime: l.ExpirationNanos}
+}
+
+// A SchemaLeaseError is returned on an attempt to update a schema
+// while nodes still hold leases on a version preceding its current
+// one. The update may be retried once the leases are released or
+// have expired.
+type SchemaLeaseError struct {
+	SchemaKey string
+	Version   int64 // Version of the oldest lease
+	NodeID    int32 // Node holding the oldest lease
+}
+
+// Error implements the error interface.
+func (e *SchemaLeaseError) Error() string {
+	return fmt.Sprintf("node %d holds a lease on version %d of schema %q", e.NodeID, e.Version, e.SchemaKey)
+}
+
+// AcquireSchemaLease returns the current version of the schema with
+// the given key and a lease on it held by the given node. Acquiring
+// a lease again renews it. As with GetSchema, nil is returned without
+// error if the schema doesn't exist.
+func (db *structuredDB) AcquireSchemaLease(key string, nodeID int32) (*Schema, *SchemaLease, error) {
+	var s *Schema
+	var lease *SchemaLease
+	txnOpts := &client.TransactionOptions{Name: fmt.Sprintf("acquire lease on schema %q", key)}
+	if err := db.kvDB.RunTransaction(txnOpts, func(txn *client.KV) error {
+		var err error
+		if s, err = getSchema(txn, key); err != nil || s == nil {
+			return err
+		}
+		lease = &SchemaLease{
+			SchemaKey:       key,
+			Version:         s.Version,
+			NodeID:          nodeID,
+			ExpirationNanos: time.Now().Add(SchemaLeaseDuration).UnixNano(),
+		}
+		return txn.PutI(engine.SchemaLeaseKey(key, lease.Version, nodeID), lease)
+	}); err != nil {
+		return nil, nil, err
+	}
+	return s, lease, nil
+}
+
+// ReleaseSchemaLease releases the lease.
+func (db *structuredDB) ReleaseSchemaLease(lease *SchemaLease) error {
+	return db.kvDB.Call(proto.Delete, &proto.DeleteRequest{
+		RequestHeader: proto.RequestHeader{
+			Key: engine.SchemaLeaseKey(lease.SchemaKey, lease.Version, lease.NodeID),
+		},
+	}, &proto.DeleteResponse{})
+}
+
+// CheckSchemaLeases returns a SchemaLeaseError if any unexpired
+// lease is held on a version of the schema with the given key
+// preceding its current one.
+func (db *structuredDB) CheckSchemaLeases(key string) error {
+	txnOpts := &client.TransactionOptions{Name: fmt.Sprintf("check leases on schema %q", key)}
+	return db.kvDB.RunTransaction(txnOpts, func(txn *client.KV) error {
+		s, err := getSchema(txn, key)
+		if err != nil {
+			return err
+		} else if s == nil {
+			return fmt.Errorf("schema %q not found", key)
+		}
+		return checkSchemaLeases(txn, key, s.Version)
+	})
+}
+
+// checkSchemaLeases returns a SchemaLeaseError if any unexpired lease
+// is held on a version of the schema with the given key preceding
+// version.
+func checkSchemaLeases(txn *client.KV, key string, version int64) error {
+	// Leases sort by version, so those on preceding versions lie
+	// before the first lease on version.
+	reply := &proto.ScanResponse{}
+	if err := txn.Call(proto.Scan, &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.SchemaLeasePrefix(key),
+			EndKey: engine.MakeKey(engine.SchemaLeasePrefix(key), encoding.EncodeUint64(nil, uint64(version))),
+		},
+	}, reply); err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	for _, kv := range reply.Rows {
+		lease := &SchemaLease{}
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(lease); err != nil {
+			return err
+		}
+		if lease.ExpirationNanos > now {
+			return &SchemaLeaseError{SchemaKey: key, Version: lease.Version, NodeID: lease.NodeID}
+		}
+	}
+	return nil
+}
+
+// SchemaLeases holds a node's leases on the schemas it uses, along
+// with the leased versions of the schemas. A lease is renewed when
+// the schema is used once half of its duration has passed, at which
+// point the lease moves to the schema's current version; leases
+// unused for the full duration expire.
+type SchemaLeases struct {
+	db     DB
+	mu     sync.Mutex
+	nodeID int32
+	leased map[string]*leasedSchema
+}
+
+// A leasedSchema is the gob encoding of the version of a schema on
+// which a node holds lease. Each use decodes a copy, as validating a
+// schema modifies it.
+type leasedSchema struct {
+	encoded []byte
+	lease   *SchemaLease
+}
+
+// NewSchemaLeases returns a new SchemaLeases acquiring leases through
+// db for the node with the given ID.
+func NewSchemaLeases(db DB, nodeID int32) *SchemaLeases {
+	return &SchemaLeases{db: db, nodeID: nodeID, leased: map[string]*leasedSchema{}}
+}
+
+// Acquire returns the leased version of the schema with the given key
+// along with the node's lease on it, acquiring or renewing the lease
+// as needed. Transactions using the schema must commit by the lease's
+// deadline. Returns nil without error if the schema doesn't exist.
+func (sl *SchemaLeases) Acquire(key string) (*Schema, *SchemaLease, error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	ls, ok := sl.leased[key]
+	if !ok || time.Now().Add(SchemaLeaseDuration/2).UnixNano() >= ls.lease.ExpirationNanos {
+		s, lease, err := sl.db.AcquireSchemaLease(key, sl.nodeID)
+		if err != nil || s == nil {
+			return nil, nil, err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+			return nil, nil, err
+		}
+		if ok && ls.lease.Version != lease.Version {
+			if err := sl.db.ReleaseSchemaLease(ls.lease); err != nil {
+				log.Warningf("unable to release lease on version %d of schema %q: %s", ls.lease.Version, key, err)
+			}
+		}
+		ls = &leasedSchema{encoded: buf.Bytes(), lease: lease}
+		sl.leased[key] = ls
+	}
+	s := &Schema{}
+	if err := gob.NewDecoder(bytes.NewBuffer(ls.encoded)).Decode(s); err != nil {
+		return nil, nil, err
+	}
+	return s, ls.lease, nil
+}
+
+// ReleaseAll releases all of the node's leases.
+func (sl *SchemaLeases) ReleaseAll() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	for key, ls := range sl.leased {
+		if err := sl.db.ReleaseSchemaLease(ls.lease); err != nil {
+			log.Warningf("unable to release lease on version %d of schema %q: %s", ls.lease.Version, key, err)
+		}
+		delete(sl.leased, key)
+	}
+}
@@ -63,6 +63,19 @@ func (db *testDB) GetSchema(key string) (*Schema, error) {
 	return nil, nil
 }
 
+func (db *testDB) AcquireSchemaLease(key string, nodeID int32) (*Schema, *SchemaLease, error) {
+	s, err := db.GetSchema(key)
+	return s, nil, err
+}
+
+func (db *testDB) ReleaseSchemaLease(*SchemaLease) error {
+	return nil
+}
+
+func (db *testDB) CheckSchemaLeases(key string) error {
+	return nil
+}
+
 func newTestDB() *testDB {
 	return &testDB{kv: map[string]interface{}{}}
 }
@@ -0,0 +1,241 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// restoreBatchSize is the number of keys written per batch by
+// RestoreTable.
+const restoreBatchSize = 100
+
+// A TableRestore describes the restore of a table by RestoreTable.
+type TableRestore struct {
+	Rows      int64 // Rows of the table restored
+	IndexKeys int64 // Keys of the table's indexes restored
+	Bytes     int64 // Bytes of keys and values written
+}
+
+// RestoreTable restores the named table of the schema with key
+// schemaKey from a full-cluster backup into the cluster reached
+// through kv, as a new table of the cluster's schema of the same key
+// with the name newName and the table key newKey. The backup is given
+// as copies of all of the backed-up cluster's stores, such as clones
+// of their checkpoints; of each key, the most recently committed
+// value among the copies is restored. The keys of the table's rows
+// and indexes are rewritten to the new table key as they're written,
+// after which the table is added to the schema in one update. If the
+// update fails, the written keys are removed again.
+//
+// A table interleaved in another can't be restored on its own, and
+// the rows of tables interleaved in the restored table are skipped.
+// Foreign keys of the table referencing itself are rewritten to its
+// new name; its other foreign keys must reference tables of the
+// cluster's schema.
+func RestoreTable(kv *client.KV, backup []engine.Engine, schemaKey, table, newName, newKey string) (*TableRestore, error) {
+	bs, err := readBackupSchema(backup, schemaKey)
+	if err != nil {
+		return nil, err
+	}
+	t := bs.findTable(table)
+	if t == nil {
+		return nil, fmt.Errorf("backup of schema %q: table %q not found", schemaKey, table)
+	}
+	if parent, _ := interleavedParent(bs, t); parent != nil {
+		return nil, fmt.Errorf("table %q is interleaved in table %q and can't be restored on its own", t.Name, parent.Name)
+	}
+
+	db := NewDB(kv)
+	s, err := db.GetSchema(schemaKey)
+	if err != nil {
+		return nil, err
+	} else if s == nil {
+		return nil, fmt.Errorf("schema %q not found", schemaKey)
+	}
+	s.Tables = append(s.Tables, renameTable(t, newName, newKey))
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	spans := tableSpans(schemaKey, newKey)
+	for _, span := range spans {
+		reply := &proto.ScanResponse{}
+		if err := kv.Call(proto.Scan, &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{Key: span.Start, EndKey: span.End},
+			MaxResults:    1,
+		}, reply); err != nil {
+			return nil, err
+		}
+		if len(reply.Rows) > 0 {
+			return nil, fmt.Errorf("schema %q: keys of table key %q exist at %q", schemaKey, newKey, reply.Rows[0].Key)
+		}
+	}
+
+	res := &TableRestore{}
+	err = restoreTableKeys(kv, backup, bs, t, newKey, res)
+	if err == nil {
+		// The update is conditional on the version read, so it fails if
+		// the schema was changed during the restore.
+		err = db.PutSchema(s)
+	}
+	if err != nil {
+		for _, span := range spans {
+			if derr := kv.Call(proto.DeleteRange, &proto.DeleteRangeRequest{
+				RequestHeader: proto.RequestHeader{Key: span.Start, EndKey: span.End},
+			}, &proto.DeleteRangeResponse{}); derr != nil {
+				log.Warningf("unable to remove keys %q-%q of failed restore: %s", span.Start, span.End, derr)
+			}
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// readBackupSchema returns the most recently committed version of the
+// validated schema with the given key among the store copies of
+// backup.
+func readBackupSchema(backup []engine.Engine, schemaKey string) (*Schema, error) {
+	key := engine.MakeKey(engine.KeySchemaPrefix, proto.Key(schemaKey))
+	values, err := readBackupKeys(backup, key, key.Next())
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("schema %q not found in backup", schemaKey)
+	}
+	s := &Schema{}
+	if err := gob.NewDecoder(bytes.NewBuffer(values[0].Value.Bytes)).Decode(s); err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readBackupKeys returns the keys from start to end of the store
+// copies of backup, sorted, with the most recently committed value of
+// each among the copies.
+func readBackupKeys(backup []engine.Engine, start, end proto.Key) ([]proto.KeyValue, error) {
+	latest := map[string]proto.KeyValue{}
+	for _, e := range backup {
+		if err := engine.MVCCIterateCommitted(e, start, end, func(kv proto.KeyValue) (bool, error) {
+			// Inline values have no timestamp; the first copy's is kept.
+			if prev, ok := latest[string(kv.Key)]; !ok || (prev.Value.Timestamp != nil &&
+				kv.Value.Timestamp != nil && prev.Value.Timestamp.Less(*kv.Value.Timestamp)) {
+				latest[string(kv.Key)] = kv
+			}
+			return false, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	kvs := make([]proto.KeyValue, 0, len(latest))
+	for _, kv := range latest {
+		kvs = append(kvs, kv)
+	}
+	sort.Sort(keyValues(kvs))
+	return kvs, nil
+}
+
+// keyValues sorts key/value pairs by key.
+type keyValues []proto.KeyValue
+
+func (kvs keyValues) Len() int           { return len(kvs) }
+func (kvs keyValues) Swap(i, j int)      { kvs[i], kvs[j] = kvs[j], kvs[i] }
+func (kvs keyValues) Less(i, j int) bool { return kvs[i].Key.Less(kvs[j].Key) }
+
+// tableSpans returns the spans of the keys of the rows and of the
+// indexes of the table with key tableKey of the schema with key
+// schemaKey.
+func tableSpans(schemaKey, tableKey string) []Span {
+	var spans []Span
+	for _, prefix := range []string{"/", ":"} {
+		start := proto.Key(schemaKey + "/" + tableKey + prefix)
+		spans = append(spans, Span{start, start.PrefixEnd()})
+	}
+	return spans
+}
+
+// renameTable returns a copy of table t with the given name and key.
+func renameTable(t *Table, name, key string) *Table {
+	renamed := &Table{Name: name, Key: key}
+	for _, c := range t.Columns {
+		rc := *c
+		if rc.ForeignKey == t.Name || strings.HasPrefix(rc.ForeignKey, t.Name+".") {
+			rc.ForeignKey = name + rc.ForeignKey[len(t.Name):]
+		}
+		renamed.Columns = append(renamed.Columns, &rc)
+	}
+	return renamed
+}
+
+// restoreTableKeys writes the keys of the rows and indexes of table t
+// of backup schema bs, rewritten to the table key newKey, through kv.
+func restoreTableKeys(kv *client.KV, backup []engine.Engine, bs *Schema, t *Table, newKey string, res *TableRestore) error {
+	children := interleavedTables(bs)
+	oldPrefix := len(bs.Key) + 1 + len(t.Key)
+	newPrefix := proto.Key(bs.Key + "/" + newKey)
+	rowPrefix := rootRowKeyPrefix(bs, t)
+	for i, span := range tableSpans(bs.Key, t.Key) {
+		kvs, err := readBackupKeys(backup, span.Start, span.End)
+		if err != nil {
+			return err
+		}
+		var batch int
+		for _, row := range kvs {
+			if i == 0 {
+				rowTable, err := decodeRowTable(bs, t, row.Key[len(rowPrefix):], children)
+				if err != nil || rowTable != t {
+					continue
+				}
+				res.Rows++
+			} else {
+				res.IndexKeys++
+			}
+			key := append(append(proto.Key(nil), newPrefix...), row.Key[oldPrefix:]...)
+			// Copy the value as-is so typed values keep their encoding; only
+			// the key-dependent checksum and the old timestamp are dropped.
+			value := row.Value
+			value.Checksum, value.Timestamp = nil, nil
+			value.InitChecksum(key)
+			kv.Prepare(proto.Put, &proto.PutRequest{
+				RequestHeader: proto.RequestHeader{Key: key},
+				Value:         value,
+			}, &proto.PutResponse{})
+			res.Bytes += int64(len(key) + len(value.Bytes))
+			if batch++; batch == restoreBatchSize {
+				if err := kv.Flush(); err != nil {
+					return err
+				}
+				batch = 0
+			}
+		}
+		if err := kv.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
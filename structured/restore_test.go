@@ -0,0 +1,113 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured_test
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/server"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/structured"
+	"github.com/cockroachdb/cockroach/util/encoding"
+)
+
+// TestRestoreTable verifies that RestoreTable restores the rows and
+// index keys of a table from store copies under a new table key,
+// preferring the most recent value of each key, and adds the table
+// to the schema.
+func TestRestoreTable(t *testing.T) {
+	newSchema := func() *structured.Schema {
+		s, err := structured.NewGoSchema("MusicDB", "mdb", map[string]interface{}{"al": Album{}, "tr": Track{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	backup := engine.NewInMem(proto.Attributes{}, 1<<20)
+	backupKV, err := server.BootstrapCluster("backup-cluster", backup)
+	if err != nil {
+		t.Fatalf("unable to boostrap cluster: %v", err)
+	}
+	if err := structured.NewDB(backupKV).PutSchema(newSchema()); err != nil {
+		t.Fatal(err)
+	}
+	album := func(table string, id int64) string {
+		return "mdb/" + table + "/" + string(encoding.EncodeInt(nil, id))
+	}
+	genre := func(table, g string, id int64) string {
+		return "mdb/" + table + ":ge/" + string(encoding.EncodeString(nil, g)) + string(encoding.EncodeInt(nil, id))
+	}
+	for _, key := range []string{
+		album("al", 1), album("al", 2), album("al", 1) + "/tr/" + string(encoding.EncodeInt(nil, 1)),
+		genre("al", "rock", 1), genre("al", "jazz", 2),
+	} {
+		if err := backupKV.PutI(proto.Key(key), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A stale replica of album 2 in a second store copy.
+	stale := engine.NewInMem(proto.Attributes{}, 1<<20)
+	if err := engine.MVCCPut(stale, nil, proto.Key(album("al", 2)), proto.Timestamp{WallTime: 1},
+		proto.Value{Bytes: []byte("stale")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := server.BootstrapCluster("test-cluster", engine.NewInMem(proto.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatalf("unable to boostrap cluster: %v", err)
+	}
+	db := structured.NewDB(kv)
+	if err := db.PutSchema(newSchema()); err != nil {
+		t.Fatal(err)
+	}
+	res, err := structured.RestoreTable(kv, []engine.Engine{backup, stale}, "mdb", "Album", "OldAlbum", "oa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rows != 2 || res.IndexKeys != 2 {
+		t.Errorf("expected 2 rows and 2 index keys restored; got %+v", res)
+	}
+	for key, expect := range map[string]string{
+		album("oa", 1):         album("al", 1),
+		album("oa", 2):         album("al", 2),
+		genre("oa", "jazz", 2): genre("al", "jazz", 2),
+		// Interleaved rows aren't restored.
+		album("oa", 1) + "/tr/" + string(encoding.EncodeInt(nil, 1)): "",
+	} {
+		var value string
+		if ok, _, err := kv.GetI(proto.Key(key), &value); err != nil {
+			t.Fatal(err)
+		} else if ok != (expect != "") || value != expect {
+			t.Errorf("expected %q at key %q; got %t, %q", expect, key, ok, value)
+		}
+	}
+	s, err := db.GetSchema("mdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findColumn(s, "OldAlbum", "Genre") == nil {
+		t.Errorf("expected restored table in schema; got %+v", s.Tables)
+	}
+
+	// Tables can't be restored over existing ones, nor can
+	// interleaved tables be restored on their own.
+	for i, args := range [][]string{{"Album", "Album", "ab"}, {"Album", "Copy", "oa"}, {"Track", "OldTrack", "ot"}} {
+		if _, err := structured.RestoreTable(kv, []engine.Engine{backup}, "mdb", args[0], args[1], args[2]); err == nil {
+			t.Errorf("%d: expected restore of %v to fail", i, args)
+		}
+	}
+}
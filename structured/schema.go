@@ -115,6 +115,22 @@ type Column struct {
 	// a monotonically-increasing sequence starting at this field's
 	// value. If Auto is nil, the column does not auto-increment.
 	Auto *int64 `yaml:"auto_increment,omitempty"`
+
+	// Default is the value, in the textual form of the column's type,
+	// of the column in rows written before it was added by a schema
+	// change. If the column has a secondary index, such rows are
+	// indexed under it by the schema change's backfill.
+	Default string `yaml:"default,omitempty"`
+
+	// State is the state of a column, along with its index, while it's
+	// added by an online schema change; see AddColumn. It is
+	// "delete_only" or "write_only" until the column becomes public,
+	// when it's cleared. Delete-only columns are removed along with
+	// rows but are not written; write-only columns are also written,
+	// but neither are read until public. Each state is in effect on all
+	// nodes before the next begins, so no node writes a value which a
+	// node unaware of the column fails to delete.
+	State string `yaml:"state,omitempty"`
 }
 
 // Table contains the schema for a table. The Key should be a
@@ -165,6 +181,10 @@ type Schema struct {
 	Name   string     `yaml:"db" json:"db"`
 	Key    string     `yaml:"db_key" json:"db_key"`
 	Tables TableSlice `yaml:",omitempty" json:"tables,omitempty"`
+	// Version is incremented by each update of the schema. An update
+	// specifying a non-zero version fails unless it's the version of
+	// the stored schema.
+	Version int64 `yaml:"version,omitempty" json:"version,omitempty"`
 
 	// byName is a map from table name to *Table.
 	byName map[string]*Table
@@ -207,6 +227,12 @@ var validTypes = map[string]struct{}{
 	columnTypeStringMap:  struct{}{},
 }
 
+// States of columns being added by a schema change.
+const (
+	columnStateDeleteOnly = "delete_only"
+	columnStateWriteOnly  = "write_only"
+)
+
 // Valid index types.
 const (
 	indexTypeFullText  = "fulltext"
@@ -375,6 +401,29 @@ func (s *Schema) validateColumn(c *Column, t *Table) error {
 		return fmt.Errorf("invalid type %q", c.Type)
 	}
 
+	switch c.State {
+	case "":
+	case columnStateDeleteOnly, columnStateWriteOnly:
+		if c.PrimaryKey {
+			return fmt.Errorf("primary key column may not be in state %q", c.State)
+		}
+	default:
+		return fmt.Errorf("invalid state %q", c.State)
+	}
+
+	// Rows predating the column would share its default, so it can't
+	// be unique; defaults of indexed columns must be encodable.
+	if c.Default != "" {
+		if c.PrimaryKey || c.Index == indexTypeUnique {
+			return fmt.Errorf("primary key and unique columns may not have defaults")
+		}
+		if hasTermIndex(c) {
+			if _, err := encodeColumnValue(nil, c, c.Default); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Verify primary key options. Scatter is only valid on first
 	// component of primary key.
 	if c.Scatter {
@@ -0,0 +1,196 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// backfillBatchSize is the number of index keys written per
+// transaction by the Backfiller returned by NewBackfiller.
+const backfillBatchSize = 100
+
+// A Backfiller writes the values of a column, and of its index if
+// any, for the existing rows of a table. It's invoked once the column
+// is write-only on all nodes, so rows written concurrently already
+// include it.
+type Backfiller func(s *Schema, t *Table, c *Column) error
+
+// NewBackfiller returns a Backfiller which writes the entries of the
+// index of an added column through kv. Rows written before the column
+// was added take its default value, under which they're indexed if
+// the column has a secondary index; without a default, they have no
+// value to index. The values of rows aren't encoded by column, so the
+// rows themselves are left unchanged. Each index key is the column's
+// term followed by the row's key less the prefix of the rows of its
+// top-level table, and its value is the row's key.
+func NewBackfiller(kv *client.KV) Backfiller {
+	return func(s *Schema, t *Table, c *Column) error {
+		if c.Default == "" || !hasTermIndex(c) {
+			return nil
+		}
+		if err := s.Validate(); err != nil {
+			return err
+		}
+		term, err := encodeColumnValue(indexKeyPrefix(s, t, c), c, c.Default)
+		if err != nil {
+			return err
+		}
+		root := t
+		for parent, _ := interleavedParent(s, root); parent != nil; parent, _ = interleavedParent(s, root) {
+			root = parent
+		}
+		children := interleavedTables(s)
+		prefix := rootRowKeyPrefix(s, root)
+		var rows []proto.Key
+		write := func() error {
+			txnOpts := &client.TransactionOptions{Name: fmt.Sprintf("backfill column %q of table %q", c.Name, t.Name)}
+			err := kv.RunTransaction(txnOpts, func(txn *client.KV) error {
+				for _, row := range rows {
+					key := append(append(proto.Key(nil), term...), row[len(prefix):]...)
+					value := proto.Value{Bytes: row}
+					value.InitChecksum(key)
+					txn.Prepare(proto.Put, &proto.PutRequest{
+						RequestHeader: proto.RequestHeader{Key: key},
+						Value:         value,
+					}, &proto.PutResponse{})
+				}
+				return txn.Flush()
+			})
+			rows = nil
+			return err
+		}
+		sc := kv.NewScanner(prefix, prefix.PrefixEnd(), 0)
+		for sc.Next() {
+			row := sc.Row().Key
+			if rowTable, err := decodeRowTable(s, root, row[len(prefix):], children); err != nil || rowTable != t {
+				continue
+			}
+			if rows = append(rows, row); len(rows) == backfillBatchSize {
+				if err := write(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return write()
+	}
+}
+
+// AddColumn adds c to the table of the schema with the given key in
+// the delete-only state. The column, along with its index, becomes
+// public through successive calls to AdvanceSchemaChange.
+func AddColumn(db DB, schemaKey, tableName string, c *Column) error {
+	if c.PrimaryKey {
+		return fmt.Errorf("column %q: primary key columns may not be added", c.Name)
+	}
+	s, err := db.GetSchema(schemaKey)
+	if err != nil {
+		return err
+	} else if s == nil {
+		return fmt.Errorf("schema %q not found", schemaKey)
+	}
+	t := s.findTable(tableName)
+	if t == nil {
+		return fmt.Errorf("schema %q: table %q not found", schemaKey, tableName)
+	}
+	added := *c
+	added.State = columnStateDeleteOnly
+	t.Columns = append(t.Columns, &added)
+	// The update is conditional on the version read.
+	return db.PutSchema(s)
+}
+
+// AdvanceSchemaChange moves each column of the schema with the given
+// key which isn't yet public to its next state: delete-only columns
+// become write-only, and write-only columns are backfilled and become
+// public. Each step is one update of the schema, so it's in effect on
+// all nodes before the next may begin. A SchemaLeaseError is returned
+// while nodes still hold leases on the schema's preceding version.
+// Returns true once all columns are public.
+func AdvanceSchemaChange(db DB, schemaKey string, backfill Backfiller) (bool, error) {
+	s, err := db.GetSchema(schemaKey)
+	if err != nil {
+		return false, err
+	} else if s == nil {
+		return false, fmt.Errorf("schema %q not found", schemaKey)
+	}
+	var pending bool
+	for _, t := range s.Tables {
+		for _, c := range t.Columns {
+			if c.State == columnStateWriteOnly {
+				pending = true
+			}
+		}
+	}
+	if pending {
+		// The backfill may only begin once no node writes rows
+		// without the write-only columns.
+		if err := db.CheckSchemaLeases(schemaKey); err != nil {
+			return false, err
+		}
+	}
+
+	var changed bool
+	for _, t := range s.Tables {
+		for _, c := range t.Columns {
+			switch c.State {
+			case columnStateDeleteOnly:
+				c.State = columnStateWriteOnly
+				changed = true
+			case columnStateWriteOnly:
+				if err := backfill(s, t, c); err != nil {
+					return false, fmt.Errorf("table %q, column %q: backfill failed: %v", t.Name, c.Name, err)
+				}
+				c.State = ""
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return true, nil
+	}
+	if err := db.PutSchema(s); err != nil {
+		return false, err
+	}
+	for _, t := range s.Tables {
+		for _, c := range t.Columns {
+			if c.State != "" {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// findTable returns the table with the given name, or nil if the
+// schema has none.
+func (s *Schema) findTable(name string) *Table {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/server"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/structured"
+	"github.com/cockroachdb/cockroach/util/encoding"
+)
+
+// createTestDB bootstraps a cluster and registers the test schema.
+func createTestDB(t *testing.T) (structured.DB, *structured.Schema) {
+	s, err := createTestSchema()
+	if err != nil {
+		t.Fatalf("could not create test schema: %v", err)
+	}
+	localDB, err := server.BootstrapCluster("test-cluster", engine.NewInMem(proto.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatalf("unable to boostrap cluster: %v", err)
+	}
+	db := structured.NewDB(localDB)
+	if err := db.PutSchema(s); err != nil {
+		t.Fatalf("could not register schema: %v", err)
+	}
+	return db, s
+}
+
+// findColumn returns the named column of the named table of s.
+func findColumn(s *structured.Schema, table, column string) *structured.Column {
+	for _, t := range s.Tables {
+		if t.Name != table {
+			continue
+		}
+		for _, c := range t.Columns {
+			if c.Name == column {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// TestPutSchemaVersion verifies that each update of a schema increments
+// its version and that updates of stale versions are refused.
+func TestPutSchemaVersion(t *testing.T) {
+	db, s := createTestDB(t)
+	if s.Version != 1 {
+		t.Errorf("expected version 1; got %d", s.Version)
+	}
+	stale, err := db.GetSchema(s.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != 2 {
+		t.Errorf("expected version 2; got %d", s.Version)
+	}
+	if err := db.PutSchema(stale); err == nil {
+		t.Error("expected update of stale version to fail")
+	}
+	// Version 0 overwrites unconditionally.
+	stale.Version = 0
+	if err := db.PutSchema(stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale.Version != 3 {
+		t.Errorf("expected version 3; got %d", stale.Version)
+	}
+}
+
+// TestAddColumn verifies that an added column advances through the
+// delete-only and write-only states to public, waiting for leases on
+// preceding versions of the schema, and is backfilled once.
+func TestAddColumn(t *testing.T) {
+	db, s := createTestDB(t)
+	if err := structured.AddColumn(db, s.Key, "User", &structured.Column{
+		Name: "Email", Key: "em", Type: "string", Index: "unique",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := structured.AddColumn(db, s.Key, "User", &structured.Column{
+		Name: "Handle", Key: "ha", Type: "string", PrimaryKey: true,
+	}); err == nil {
+		t.Error("expected primary key column to be refused")
+	}
+
+	// A node leases the version adding the column.
+	leased, lease, err := db.AcquireSchemaLease(s.Key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := findColumn(leased, "User", "Email"); c == nil || c.State != "delete_only" {
+		t.Fatalf("expected delete-only column; got %+v", c)
+	}
+
+	var backfills int
+	backfill := func(s *structured.Schema, t *structured.Table, c *structured.Column) error {
+		backfills++
+		return nil
+	}
+	if done, err := structured.AdvanceSchemaChange(db, s.Key, backfill); done || err != nil {
+		t.Fatalf("expected column to become write-only; got %t, %v", done, err)
+	}
+	// The lease on the delete-only version blocks the backfill.
+	if _, err := structured.AdvanceSchemaChange(db, s.Key, backfill); err == nil {
+		t.Fatal("expected schema change to wait for lease")
+	} else if _, ok := err.(*structured.SchemaLeaseError); !ok {
+		t.Fatalf("expected SchemaLeaseError; got %v", err)
+	}
+	if backfills != 0 {
+		t.Errorf("expected no backfill while leased; got %d", backfills)
+	}
+	if err := db.ReleaseSchemaLease(lease); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := structured.AdvanceSchemaChange(db, s.Key, backfill); !done || err != nil {
+		t.Fatalf("expected column to become public; got %t, %v", done, err)
+	}
+	if backfills != 1 {
+		t.Errorf("expected one backfill; got %d", backfills)
+	}
+	if s, err = db.GetSchema(s.Key); err != nil {
+		t.Fatal(err)
+	}
+	if c := findColumn(s, "User", "Email"); c == nil || c.State != "" {
+		t.Errorf("expected public column; got %+v", c)
+	}
+	if s.Version != 4 {
+		t.Errorf("expected version 4; got %d", s.Version)
+	}
+}
+
+// TestBackfillColumn verifies that the rows of a table predating an
+// indexed column with a default are indexed under the default, and
+// that the rows of tables interleaved in it are not.
+func TestBackfillColumn(t *testing.T) {
+	s, err := structured.NewGoSchema("MusicDB", "mdb", map[string]interface{}{"al": Album{}, "tr": Track{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := server.BootstrapCluster("test-cluster", engine.NewInMem(proto.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatalf("unable to boostrap cluster: %v", err)
+	}
+	db := structured.NewDB(kv)
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	album := func(id int64) string {
+		return "mdb/al/" + string(encoding.EncodeInt(nil, id))
+	}
+	for _, key := range []string{album(1), album(2), album(1) + "/tr/" + string(encoding.EncodeInt(nil, 1))} {
+		if err := kv.PutI(proto.Key(key), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := structured.AddColumn(db, s.Key, "Album", &structured.Column{
+		Name: "Label", Key: "lb", Type: "string", Index: "unique", Default: "indie",
+	}); err == nil {
+		t.Error("expected unique column with a default to be refused")
+	}
+	if err := structured.AddColumn(db, s.Key, "Album", &structured.Column{
+		Name: "Label", Key: "lb", Type: "string", Index: "secondary", Default: "indie",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	backfill := structured.NewBackfiller(kv)
+	for i := 0; i < 2; i++ {
+		if _, err := structured.AdvanceSchemaChange(db, s.Key, backfill); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix := proto.Key("mdb/al:lb/" + string(encoding.EncodeString(nil, "indie")))
+	var keys []string
+	sc := kv.NewScanner(prefix, prefix.PrefixEnd(), 0)
+	for sc.Next() {
+		keys = append(keys, string(sc.Row().Key[len(prefix):]))
+		if string(sc.Row().Value.Bytes) != album(int64(len(keys))) {
+			t.Errorf("expected index key %q to reference its row; got %q", sc.Row().Key, sc.Row().Value.Bytes)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{string(encoding.EncodeInt(nil, 1)), string(encoding.EncodeInt(nil, 2))}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected index keys of albums 1 and 2; got %q", keys)
+	}
+}
+
+// TestSchemaLeases verifies that a node's lease on a schema is reused
+// until half of its duration has passed, and that its renewal moves
+// it to the schema's current version, releasing the preceding one.
+func TestSchemaLeases(t *testing.T) {
+	db, s := createTestDB(t)
+	leases := structured.NewSchemaLeases(db, 1)
+	if leased, _, err := leases.Acquire("missing"); leased != nil || err != nil {
+		t.Errorf("expected no schema; got %+v, %v", leased, err)
+	}
+	leased, lease, err := leases.Acquire(s.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased.Version != 1 || lease.Version != 1 {
+		t.Fatalf("expected lease on version 1; got %d, %d", leased.Version, lease.Version)
+	}
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	if leased, _, err = leases.Acquire(s.Key); err != nil || leased.Version != 1 {
+		t.Fatalf("expected leased version 1 to be reused; got %+v, %v", leased, err)
+	}
+	if _, ok := db.CheckSchemaLeases(s.Key).(*structured.SchemaLeaseError); !ok {
+		t.Error("expected lease on version 1 to block schema changes")
+	}
+
+	// Lengthening leases puts the held one past half of its duration.
+	defer func(d time.Duration) { structured.SchemaLeaseDuration = d }(structured.SchemaLeaseDuration)
+	structured.SchemaLeaseDuration *= 4
+	if leased, _, err = leases.Acquire(s.Key); err != nil || leased.Version != 2 {
+		t.Fatalf("expected renewed lease on version 2; got %+v, %v", leased, err)
+	}
+	if err := db.CheckSchemaLeases(s.Key); err != nil {
+		t.Errorf("expected lease on version 1 to be released; got %v", err)
+	}
+	leases.ReleaseAll()
+}
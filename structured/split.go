@@ -0,0 +1,96 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// NewSplitKeyFunc returns a function which adjusts the keys at which
+// ranges are split so that the rows of tables interleaved in a row
+// stay in the range of that row: a key among the rows interleaved in
+// a top-level row is moved to the key of the top-level row. This
+// keeps joins of a row with its interleaved rows, and the cascading
+// deletes of them, within a single range. Other keys are returned
+// unchanged. The schemas of the keys are read through kv.
+func NewSplitKeyFunc(kv *client.KV) func(key proto.Key) (proto.Key, error) {
+	return func(key proto.Key) (proto.Key, error) {
+		i := bytes.IndexByte(key, '/')
+		if i <= 0 {
+			return key, nil
+		}
+		s, err := getSchema(kv, string(key[:i]))
+		if err != nil || s == nil {
+			return key, err
+		}
+		if err := s.Validate(); err != nil {
+			log.Warningf("not adjusting split key %q of invalid schema %q: %s", key, s.Key, err)
+			return key, nil
+		}
+		return rowFamilyStart(s, key), nil
+	}
+}
+
+// rowFamilyStart returns the key of the row of a table of validated
+// schema s which isn't interleaved and which key, or the rows
+// interleaved in which key, belongs to. If key isn't the key of a row
+// of a table with interleaved tables, key is returned.
+func rowFamilyStart(s *Schema, key proto.Key) proto.Key {
+	rest := key[len(s.Key)+1:]
+	i := bytes.IndexByte(rest, '/')
+	if i < 0 {
+		return key
+	}
+	// The table keys of index keys are followed by a column key.
+	t, ok := s.byKey[string(rest[:i])]
+	if !ok || len(interleavedTables(s)[t]) == 0 {
+		return key
+	}
+	if parent, _ := interleavedParent(s, t); parent != nil {
+		return key
+	}
+	row := rest[i+1:]
+	columns := keyColumns(s, t)
+	if len(columns) > 0 && columns[0].Scatter {
+		if len(row) < 2 {
+			return key
+		}
+		row = row[2:]
+	}
+	for _, c := range columns {
+		var err error
+		if row, err = skipColumnValue(row, c); err != nil {
+			return key
+		}
+	}
+	return key[:len(key)-len(row)]
+}
+
+// interleavedTables returns the tables of validated schema s keyed by
+// the table they are interleaved in.
+func interleavedTables(s *Schema) map[*Table][]*Table {
+	children := map[*Table][]*Table{}
+	for _, t := range s.Tables {
+		if parent, _ := interleavedParent(s, t); parent != nil {
+			children[parent] = append(children[parent], t)
+		}
+	}
+	return children
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/encoding"
+)
+
+// TestRowFamilyStart verifies that keys of rows interleaved in a row
+// are moved to the key of that row and that other keys are unchanged.
+func TestRowFamilyStart(t *testing.T) {
+	s, err := createTestSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamKey, err := rowKey(s, s.byName["PhotoStream"], map[string]string{"ID": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentKey, err := rowKey(s, s.byName["Comment"], map[string]string{"PhotoStreamID": "7", "ID": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey, err := rowKey(s, s.byName["User"], map[string]string{"ID": "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexKey := proto.Key("pdb/ps:ui/" + string(encoding.EncodeInt(nil, 5)))
+	testCases := []struct {
+		key, expect proto.Key
+	}{
+		{streamKey, streamKey},
+		{commentKey, streamKey},
+		{commentKey[:len(commentKey)-1], streamKey},
+		// Tables without interleaved tables.
+		{userKey, userKey},
+		// Keys other than those of complete rows.
+		{indexKey, indexKey},
+		{streamKey[:len(streamKey)-1], streamKey[:len(streamKey)-1]},
+		{proto.Key("pdb/ps"), proto.Key("pdb/ps")},
+	}
+	for i, test := range testCases {
+		if key := rowFamilyStart(s, test.key); !key.Equal(test.expect) {
+			t.Errorf("%d: expected %q; got %q", i, test.expect, key)
+		}
+	}
+}
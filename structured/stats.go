@@ -0,0 +1,282 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// distinctSketchSize is the number of hashes retained by a
+// distinctSketch. The standard error of its estimates is about
+// 1/sqrt(distinctSketchSize).
+const distinctSketchSize = 1024
+
+// TableStats are statistics of the rows of a table, collected by
+// CollectStats for use in planning reads.
+type TableStats struct {
+	SchemaKey string
+	Table     string
+	Rows      int64 // Number of rows
+	// DistinctValues estimates the number of distinct values of each
+	// column with a secondary or unique index, keyed by column name.
+	DistinctValues map[string]int64
+	CollectedNanos int64 // Time of collection in nanoseconds since the Unix epoch
+}
+
+// GetTableStats returns the most recently collected stats of the
+// named table of the schema with the given key, or nil if none have
+// been collected.
+func GetTableStats(kv *client.KV, schemaKey, table string) (*TableStats, error) {
+	stats := &TableStats{}
+	ok, _, err := kv.GetI(engine.TableStatsKey(schemaKey, table), stats)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CollectStats collects the stats of the tables of all schemas and
+// stores them for retrieval by GetTableStats. The rows of each table
+// are counted by scanning the keys of the table, together with those
+// of the tables interleaved in it. Distinct values of indexed columns
+// are estimated by scanning the keys of their indexes. Keys which
+// aren't those of rows of the schema are skipped.
+//
+// After the tables of each schema not interleaved in another have
+// been collected, pace is invoked with the number of such tables done
+// and the total; collection stops if it returns an error. The caller
+// uses it to spread collection over time and to stop it.
+func CollectStats(kv *client.KV, pace func(done, total int) error) error {
+	schemas, err := listSchemas(kv)
+	if err != nil {
+		return err
+	}
+	type root struct {
+		s *Schema
+		t *Table
+	}
+	var roots []root
+	for _, s := range schemas {
+		if err := s.Validate(); err != nil {
+			log.Warningf("skipping stats of invalid schema %q: %s", s.Key, err)
+			continue
+		}
+		for _, t := range s.Tables {
+			if parent, _ := interleavedParent(s, t); parent == nil {
+				roots = append(roots, root{s, t})
+			}
+		}
+	}
+	for i, r := range roots {
+		if err := collectStats(kv, r.s, r.t); err != nil {
+			return err
+		}
+		if err := pace(i+1, len(roots)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listSchemas returns all schemas.
+func listSchemas(kv *client.KV) ([]*Schema, error) {
+	var schemas []*Schema
+	sc := kv.NewScanner(engine.KeySchemaPrefix, engine.KeySchemaPrefix.PrefixEnd(), 0)
+	for sc.Next() {
+		s := &Schema{}
+		if err := gob.NewDecoder(bytes.NewBuffer(sc.Row().Value.Bytes)).Decode(s); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, sc.Err()
+}
+
+// collectStats collects and stores the stats of table t of schema s,
+// which isn't interleaved, and those of the tables interleaved in it.
+func collectStats(kv *client.KV, s *Schema, t *Table) error {
+	children := interleavedTables(s)
+	now := time.Now().UnixNano()
+	stats := map[*Table]*TableStats{}
+	var addStats func(t *Table)
+	addStats = func(t *Table) {
+		stats[t] = &TableStats{SchemaKey: s.Key, Table: t.Name, DistinctValues: map[string]int64{}, CollectedNanos: now}
+		for _, c := range children[t] {
+			addStats(c)
+		}
+	}
+	addStats(t)
+
+	prefix := rootRowKeyPrefix(s, t)
+	sc := kv.NewScanner(prefix, prefix.PrefixEnd(), 0)
+	for sc.Next() {
+		key := sc.Row().Key
+		rowTable, err := decodeRowTable(s, t, key[len(prefix):], children)
+		if err != nil {
+			log.V(1).Infof("skipping key %q in stats of table %q: %s", key, t.Name, err)
+			continue
+		}
+		if rowTable != nil {
+			stats[rowTable].Rows++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	for st, ts := range stats {
+		for _, c := range st.Columns {
+			if c.State != "" || !hasTermIndex(c) {
+				continue
+			}
+			distinct, err := countDistinctTerms(kv, s, st, c)
+			if err != nil {
+				return err
+			}
+			ts.DistinctValues[c.Name] = distinct
+		}
+		if err := kv.PutI(engine.TableStatsKey(s.Key, st.Name), ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeRowTable returns the table of the row with the given key,
+// less the prefix of the rows of table t, or nil if it isn't the key
+// of a row. The rows of tables
+// interleaved in t follow the primary keys of t's rows; children maps
+// tables to those interleaved in them.
+func decodeRowTable(s *Schema, t *Table, key []byte, children map[*Table][]*Table) (*Table, error) {
+	columns := keyColumns(s, t)
+	if len(columns) > 0 && columns[0].Scatter {
+		if len(key) < 2 {
+			return nil, fmt.Errorf("missing scatter prefix")
+		}
+		key = key[2:]
+	}
+	for _, c := range columns {
+		var err error
+		if key, err = skipColumnValue(key, c); err != nil {
+			return nil, err
+		}
+	}
+	if len(key) == 0 {
+		return t, nil
+	}
+	for _, c := range children[t] {
+		p := []byte("/" + c.Key + "/")
+		if bytes.HasPrefix(key, p) {
+			return decodeRowTable(s, c, key[len(p):], children)
+		}
+	}
+	return nil, nil
+}
+
+// countDistinctTerms estimates the number of distinct terms of the
+// index on column c of table t of schema s.
+func countDistinctTerms(kv *client.KV, s *Schema, t *Table, c *Column) (int64, error) {
+	sketch := newDistinctSketch(distinctSketchSize)
+	prefix := indexKeyPrefix(s, t, c)
+	sc := kv.NewScanner(prefix, prefix.PrefixEnd(), 0)
+	for sc.Next() {
+		term := sc.Row().Key[len(prefix):]
+		rest, err := skipColumnValue(term, c)
+		if err != nil {
+			log.V(1).Infof("skipping key %q in stats of table %q: %s", sc.Row().Key, t.Name, err)
+			continue
+		}
+		sketch.add(term[:len(term)-len(rest)])
+	}
+	return sketch.estimate(), sc.Err()
+}
+
+// A distinctSketch estimates the number of distinct values added to
+// it from the k smallest of their 64-bit hashes (a "k minimum values"
+// sketch). Until k distinct values are added, the count is exact.
+type distinctSketch struct {
+	k      int
+	hashes uint64Heap          // Max-heap of the k smallest hashes
+	seen   map[uint64]struct{} // Hashes in the heap
+}
+
+// newDistinctSketch returns a sketch retaining k hashes.
+func newDistinctSketch(k int) *distinctSketch {
+	return &distinctSketch{k: k, seen: map[uint64]struct{}{}}
+}
+
+// add adds a value to the sketch.
+func (ds *distinctSketch) add(value []byte) {
+	h := fnv.New64a()
+	h.Write(value)
+	// FNV hashes of similar values aren't uniformly distributed, as
+	// the estimate presumes; mix the bits with the finalizer of
+	// MurmurHash3.
+	sum := h.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	if _, ok := ds.seen[sum]; ok {
+		return
+	}
+	if len(ds.hashes) < ds.k {
+		heap.Push(&ds.hashes, sum)
+		ds.seen[sum] = struct{}{}
+		return
+	}
+	if max := ds.hashes[0]; sum < max {
+		delete(ds.seen, max)
+		ds.hashes[0] = sum
+		heap.Fix(&ds.hashes, 0)
+		ds.seen[sum] = struct{}{}
+	}
+}
+
+// estimate returns the estimated number of distinct values added.
+func (ds *distinctSketch) estimate() int64 {
+	if len(ds.hashes) < ds.k {
+		return int64(len(ds.hashes))
+	}
+	// The k-th smallest of n uniformly distributed hashes is expected
+	// at k/n of the hash space.
+	return int64(float64(ds.k-1) / (float64(ds.hashes[0]) / math.MaxUint64))
+}
+
+// uint64Heap implements heap.Interface as a max-heap of uint64s.
+type uint64Heap []uint64
+
+func (h uint64Heap) Len() int            { return len(h) }
+func (h uint64Heap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h uint64Heap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *uint64Heap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *uint64Heap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
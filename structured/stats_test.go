@@ -0,0 +1,103 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package structured_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/server"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/structured"
+	"github.com/cockroachdb/cockroach/util/encoding"
+)
+
+// Album is a top-level table with an index on genre.
+type Album struct {
+	ID    int64  `roach:"id,pk"`
+	Genre string `roach:"ge,secondaryindex"`
+}
+
+// Track is interleaved in Album.
+type Track struct {
+	AlbumID int64 `roach:"ai,pk,fk=Album.ID,interleave"`
+	ID      int64 `roach:"id,pk"`
+}
+
+// TestCollectStats verifies that CollectStats counts the rows of
+// tables, including interleaved ones, and the distinct values of
+// indexed columns.
+func TestCollectStats(t *testing.T) {
+	s, err := structured.NewGoSchema("MusicDB", "mdb", map[string]interface{}{"al": Album{}, "tr": Track{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := server.BootstrapCluster("test-cluster", engine.NewInMem(proto.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatalf("unable to boostrap cluster: %v", err)
+	}
+	if err := structured.NewDB(kv).PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+
+	album := func(id int64) string {
+		return "mdb/al/" + string(encoding.EncodeInt(nil, id))
+	}
+	genre := func(g string, id int64) string {
+		return "mdb/al:ge/" + string(encoding.EncodeString(nil, g)) + string(encoding.EncodeInt(nil, id))
+	}
+	track := func(albumID, id int64) string {
+		return album(albumID) + "/tr/" + string(encoding.EncodeInt(nil, id))
+	}
+	for _, key := range []string{
+		album(1), album(2), album(3),
+		track(1, 1), track(1, 2), track(2, 1),
+		album(1) + "/xx", // not a row
+		genre("rock", 1), genre("rock", 2), genre("jazz", 3),
+	} {
+		if err := kv.PutI(proto.Key(key), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var paced []int
+	if err := structured.CollectStats(kv, func(done, total int) error {
+		paced = append(paced, done, total)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paced, []int{1, 1}) {
+		t.Errorf("expected pacing after the one top-level table; got %v", paced)
+	}
+	for _, expect := range []structured.TableStats{
+		{SchemaKey: "mdb", Table: "Album", Rows: 3, DistinctValues: map[string]int64{"Genre": 2}},
+		{SchemaKey: "mdb", Table: "Track", Rows: 3, DistinctValues: map[string]int64{"AlbumID": 0}},
+	} {
+		stats, err := structured.GetTableStats(kv, "mdb", expect.Table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats == nil || stats.CollectedNanos == 0 {
+			t.Fatalf("expected stats of table %q; got %+v", expect.Table, stats)
+		}
+		stats.CollectedNanos = 0
+		if !reflect.DeepEqual(*stats, expect) {
+			t.Errorf("expected stats %+v; got %+v", expect, *stats)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+var crApp = angular.module('cockroach');
+crApp.controller('LatencyCtrl', ['$scope', '$http', '$interval',
+    function(scope, http, interval) {
+  // Round-trip times above this many milliseconds are highlighted.
+  scope.slowMillis = 50;
+  scope.matrix = null;
+  scope.error = null;
+  var refresh = function() {
+    http.get('/_status/latency').success(function(data) {
+      scope.matrix = data;
+      scope.error = null;
+    }).error(function(data, status) {
+      scope.error = status + ': ' + data;
+    });
+  };
+  // millis formats a round-trip time in nanoseconds as milliseconds.
+  scope.millis = function(nanos) {
+    if (nanos < 0) {
+      return '-';
+    }
+    return (nanos / 1e6).toFixed(2);
+  };
+  scope.isSlow = function(nanos) {
+    return nanos / 1e6 > scope.slowMillis;
+  };
+  refresh();
+  var timer = interval(refresh, 10000);
+  scope.$on('$destroy', function() {
+    interval.cancel(timer);
+  });
+}]);
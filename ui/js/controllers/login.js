@@ -0,0 +1,37 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+var crApp = angular.module('cockroach');
+crApp.controller('LoginCtrl', ['$scope', '$http', '$location',
+    function(scope, http, location) {
+  scope.token = '';
+  scope.error = null;
+  scope.message = null;
+  scope.login = function() {
+    http.post('/_admin/login', {token: scope.token}).success(function() {
+      scope.error = null;
+      location.path('/');
+    }).error(function(data, status) {
+      scope.error = status + ': ' + data;
+    });
+  };
+  scope.logout = function() {
+    http.post('/_admin/logout').success(function() {
+      scope.error = null;
+      scope.message = 'Logged out.';
+    }).error(function(data, status) {
+      scope.error = status + ': ' + data;
+    });
+  };
+}]);
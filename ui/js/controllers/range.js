@@ -0,0 +1,50 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+var crApp = angular.module('cockroach');
+crApp.controller('RangeCtrl', ['$scope', '$http', '$routeParams', '$location',
+    function(scope, http, routeParams, location) {
+  scope.raftID = routeParams.raftID || '';
+  scope.lo = '';
+  scope.hi = '';
+  scope.logs = null;
+  scope.error = null;
+  scope.show = function() {
+    location.path('/range/' + scope.raftID);
+  };
+  scope.load = function() {
+    var params = {};
+    if (scope.lo !== '') {
+      params.lo = scope.lo;
+    }
+    if (scope.hi !== '') {
+      params.hi = scope.hi;
+    }
+    http.get('/_admin/raft-log/' + scope.raftID, {params: params}).success(function(data) {
+      scope.logs = data;
+      scope.error = null;
+    }).error(function(data, status) {
+      scope.logs = null;
+      scope.error = status + ': ' + data;
+    });
+  };
+  // key formats a base64-encoded key for display.
+  scope.key = function(k) {
+    return k ? JSON.stringify(atob(k)) : '';
+  };
+  if (scope.raftID !== '') {
+    scope.load();
+  }
+}]);
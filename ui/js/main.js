@@ -20,6 +20,15 @@ crApp.config(['$routeProvider', function(routeProvider) {
   routeProvider.when('/rest-explorer', {
     controller:'RestExplorerCtrl',
     templateUrl:'/templates/rest_explorer.html'
+  }).when('/latency', {
+    controller:'LatencyCtrl',
+    templateUrl:'/templates/latency.html'
+  }).when('/range/:raftID?', {
+    controller:'RangeCtrl',
+    templateUrl:'/templates/range.html'
+  }).when('/login', {
+    controller:'LoginCtrl',
+    templateUrl:'/templates/login.html'
   }).otherwise({
     redirectTo:'/'
   });
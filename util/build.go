@@ -0,0 +1,42 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import "runtime"
+
+// These variables are set at link time by the Makefile using the
+// linker's -X flag.
+var (
+	buildTag  string // Output of "git describe"
+	buildTime string // UTC time of the build
+)
+
+// BuildInfo describes how the running binary was built.
+type BuildInfo struct {
+	GoVersion string `json:"go_version"`
+	Tag       string `json:"tag"`
+	Time      string `json:"time"`
+}
+
+// GetBuildInfo returns the build information of the running binary.
+// Tag and Time are empty if the binary was not built by the Makefile.
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		GoVersion: runtime.Version(),
+		Tag:       buildTag,
+		Time:      buildTime,
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// crashReportTimeout bounds the time spent uploading a crash report
+// before the panic is allowed to terminate the process.
+const crashReportTimeout = 5 * time.Second
+
+// A CrashReport describes a panic which terminated the process. It
+// is redacted so that it can be shared without revealing keys,
+// values or other user data: the panic value is only included for
+// runtime errors and the arguments of the stack's function calls are
+// elided.
+type CrashReport struct {
+	Time      time.Time `json:"time"`
+	Subsystem string    `json:"subsystem"`
+	PanicType string    `json:"panic_type"`
+	// Panic is the message of the panic if it is a runtime error,
+	// which can't contain user data, and empty otherwise.
+	Panic  string    `json:"panic,omitempty"`
+	Stack  string    `json:"stack"`
+	Build  BuildInfo `json:"build"`
+	GOOS   string    `json:"goos"`
+	GOARCH string    `json:"goarch"`
+}
+
+var crashReports struct {
+	sync.Mutex
+	dir string // Directory to which reports are written; empty if disabled
+	url string // HTTPS endpoint to which reports are posted; may be empty
+}
+
+// EnableCrashReports opts in to crash reporting: panics in goroutines
+// started via RunLabeled, or in functions deferring ReportPanic, are
+// recorded in dir before the process exits. If uploadURL is not
+// empty, reports are also posted to it, which requires HTTPS. Crash
+// reports are disabled if dir is empty.
+func EnableCrashReports(dir, uploadURL string) error {
+	if uploadURL != "" {
+		u, err := url.Parse(uploadURL)
+		if err != nil {
+			return Errorf("invalid crash report URL %q: %s", uploadURL, err)
+		}
+		if u.Scheme != "https" {
+			return Errorf("crash reports may only be uploaded via https: %q", uploadURL)
+		}
+		if dir == "" {
+			return Errorf("uploading crash reports requires a crash report directory")
+		}
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return Errorf("unable to create crash report directory: %s", err)
+		}
+	}
+	crashReports.Lock()
+	defer crashReports.Unlock()
+	crashReports.dir, crashReports.url = dir, uploadURL
+	return nil
+}
+
+// ReportPanic records a crash report for a panic in progress, if
+// crash reports are enabled, and then continues the panic. It must be
+// deferred directly by the function whose panics are to be reported,
+// e.g. defer util.ReportPanic("raft").
+func ReportPanic(subsystem string) {
+	crashReports.Lock()
+	dir, uploadURL := crashReports.dir, crashReports.url
+	crashReports.Unlock()
+	// Unless reports are enabled, don't recover, so that the panic
+	// proceeds untouched.
+	if dir == "" {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	report := newCrashReport(subsystem, r, debug.Stack())
+	if path, err := writeCrashReport(dir, report); err != nil {
+		log.Errorf("unable to write crash report: %s", err)
+	} else {
+		log.Errorf("wrote crash report to %s", path)
+		if uploadURL != "" {
+			if err := uploadCrashReport(uploadURL, path); err != nil {
+				log.Errorf("unable to upload crash report: %s", err)
+			}
+		}
+	}
+	panic(r)
+}
+
+// stackArgsRE matches the argument values of the function calls in a
+// goroutine stack trace, e.g. "(0xc208032000, 0x3)".
+var stackArgsRE = regexp.MustCompile(`\([0-9a-fx{}., ]+\)$`)
+
+// newCrashReport returns a redacted report of the panic value r which
+// occurred with the supplied stack.
+func newCrashReport(subsystem string, r interface{}, stack []byte) *CrashReport {
+	report := &CrashReport{
+		Time:      time.Now().UTC(),
+		Subsystem: subsystem,
+		PanicType: fmt.Sprintf("%T", r),
+		Build:     GetBuildInfo(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+	}
+	if err, ok := r.(runtime.Error); ok {
+		report.Panic = err.Error()
+	}
+	lines := strings.Split(string(stack), "\n")
+	for i, line := range lines {
+		lines[i] = stackArgsRE.ReplaceAllString(line, "(...)")
+	}
+	report.Stack = strings.Join(lines, "\n")
+	return report
+}
+
+// writeCrashReport writes report to a new file in dir, returning its
+// path.
+func writeCrashReport(dir string, report *CrashReport) (string, error) {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("crash-%d.json", report.Time.UnixNano()))
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// uploadCrashReport posts the crash report written to path to
+// uploadURL.
+func uploadCrashReport(uploadURL, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: crashReportTimeout}
+	resp, err := client.Post(uploadURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Errorf("crash report upload to %s failed: %s", uploadURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// crashingFunc panics with a value which must not appear in crash
+// reports.
+func crashingFunc(secret string) {
+	panic(secret)
+}
+
+// runAndRecover runs f via RunLabeled and returns the value with
+// which it panicked.
+func runAndRecover(f func()) (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+	RunLabeled("test", f)
+	return nil
+}
+
+// TestCrashReports verifies that panics in goroutines run via
+// RunLabeled are recorded with redacted stacks once crash reports are
+// enabled, and that the panic continues.
+func TestCrashReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_crash_reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Reports are not written unless enabled.
+	if r := runAndRecover(func() { crashingFunc("secret-value") }); r != "secret-value" {
+		t.Fatalf("expected panic to continue; got %v", r)
+	}
+	if err := EnableCrashReports(dir, "http://example.com"); err == nil {
+		t.Error("expected error enabling crash report uploads without https")
+	}
+	if err := EnableCrashReports(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer EnableCrashReports("", "")
+
+	if r := runAndRecover(func() { crashingFunc("secret-value") }); r != "secret-value" {
+		t.Fatalf("expected panic to continue; got %v", r)
+	}
+	if r := runAndRecover(func() {
+		var m map[string]int
+		m["a"] = 1
+	}); r == nil {
+		t.Fatal("expected panic to continue")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 crash reports; got %d", len(files))
+	}
+	var reports []CrashReport
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "secret-value") {
+			t.Errorf("crash report %s contains the panic value: %s", f.Name(), b)
+		}
+		var report CrashReport
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, report)
+	}
+	for _, report := range reports {
+		if report.Subsystem != "test" || report.Build.GoVersion == "" {
+			t.Errorf("unexpected crash report: %+v", report)
+		}
+	}
+	if reports[0].PanicType != "string" || reports[0].Panic != "" ||
+		!strings.Contains(reports[0].Stack, "crashingFunc(...)") {
+		t.Errorf("unexpected crash report for string panic: %+v", reports[0])
+	}
+	if reports[1].PanicType == "string" || !strings.Contains(reports[1].Panic, "nil map") {
+		t.Errorf("expected runtime error message in crash report; got %+v", reports[1])
+	}
+}
+
+// TestUploadCrashReport verifies that crash reports are posted to
+// the upload URL.
+func TestUploadCrashReport(t *testing.T) {
+	var received []byte
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "test_upload_crash_report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := writeCrashReport(dir, newCrashReport("test", "secret-value", []byte("main.main()")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadCrashReport(s.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	var report CrashReport
+	if err := json.Unmarshal(received, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Subsystem != "test" || report.Stack != "main.main()" {
+		t.Errorf("unexpected uploaded crash report: %+v", report)
+	}
+}
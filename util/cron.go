@@ -0,0 +1,161 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronDescriptors maps the supported cron shorthands to their
+// equivalent expressions.
+var cronDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// cronFields lists the minimum and maximum values of each field of a
+// cron expression: minute, hour, day of month, month and day of week.
+var cronFields = [5]struct{ min, max uint }{
+	{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7},
+}
+
+// A CronSchedule is a parsed cron expression. Times are matched in
+// UTC.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64 // Bitmasks of matching values
+	domStar, dowStar              bool   // Day fields were "*"
+}
+
+// ParseCron parses a standard five field cron expression ("minute
+// hour day-of-month month day-of-week"). Each field is "*", a value,
+// a range "a-b" or a comma-separated list of these, optionally
+// followed by a step "/n". Day of week 7 is Sunday, as is 0. The
+// shorthands @hourly, @daily, @weekly, @monthly and @yearly are also
+// accepted.
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if d, ok := cronDescriptors[expr]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, Errorf("cron expression %q must have %d fields", expr, len(cronFields))
+	}
+	var masks [5]uint64
+	for i, f := range fields {
+		var err error
+		if masks[i], err = parseCronField(f, cronFields[i].min, cronFields[i].max); err != nil {
+			return nil, Errorf("cron expression %q: %s", expr, err)
+		}
+	}
+	// Fold Sunday as 7 into Sunday as 0.
+	if masks[4]&(1<<7) != 0 {
+		masks[4] = (masks[4] | 1) &^ (1 << 7)
+	}
+	return &CronSchedule{
+		minute:  masks[0],
+		hour:    masks[1],
+		dom:     masks[2],
+		month:   masks[3],
+		dow:     masks[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField returns the bitmask of values matched by the field.
+func parseCronField(field string, min, max uint) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		step := uint(1)
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.ParseUint(part[i+1:], 10, 8)
+			if err != nil || s == 0 {
+				return 0, Errorf("invalid step in %q", part)
+			}
+			step, part = uint(s), part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			v, err := strconv.ParseUint(bounds[0], 10, 8)
+			if err != nil {
+				return 0, Errorf("invalid value %q", bounds[0])
+			}
+			lo, hi = uint(v), uint(v)
+			if len(bounds) == 2 {
+				if v, err = strconv.ParseUint(bounds[1], 10, 8); err != nil {
+					return 0, Errorf("invalid value %q", bounds[1])
+				}
+				hi = uint(v)
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, Errorf("%q out of range [%d, %d]", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// matchesDay returns whether the schedule matches the day of t. As in
+// cron, if both the day of month and day of week are restricted, a
+// day matching either suffices.
+func (cs *CronSchedule) matchesDay(t time.Time) bool {
+	dom := cs.dom&(1<<uint(t.Day())) != 0
+	dow := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time matching the schedule strictly after
+// t, in UTC. Returns the zero time if the schedule never matches,
+// such as for February 30th.
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !cs.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
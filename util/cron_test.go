@@ -0,0 +1,80 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseCronErrors verifies that malformed cron expressions are
+// rejected.
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@sometimes",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
+
+// TestCronNext verifies the computation of the next matching time of
+// a variety of cron expressions.
+func TestCronNext(t *testing.T) {
+	// Wednesday, January 14, 2015.
+	now := time.Date(2015, 1, 14, 10, 30, 15, 0, time.UTC)
+	testCases := []struct {
+		expr    string
+		expNext time.Time
+	}{
+		{"* * * * *", time.Date(2015, 1, 14, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, 1, 14, 10, 45, 0, 0, time.UTC)},
+		{"30 * * * *", time.Date(2015, 1, 14, 11, 30, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2015, 1, 14, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2015, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2015, 1, 15, 2, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2015, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2015, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * * 1-5", time.Date(2015, 1, 14, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2015, 1, 15, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week, as both are restricted.
+		{"0 0 20 * 5", time.Date(2015, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for i, c := range testCases {
+		cs, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if next := cs.Next(now); !next.Equal(c.expNext) {
+			t.Errorf("%d: %q: expected next %s; got %s", i, c.expr, c.expNext, next)
+		}
+	}
+}
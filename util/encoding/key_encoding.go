@@ -154,22 +154,30 @@ func EncodeBinary(b []byte, i []byte) []byte {
 // for more details). The first return argument is the remainder of
 // the input buffer, after decoding the binary value.
 func DecodeBinary(buf []byte) ([]byte, []byte) {
+	return DecodeBinaryAppend(buf, nil)
+}
+
+// DecodeBinaryAppend is like DecodeBinary, but appends the unencoded
+// value to out and returns the extended slice, allowing callers to
+// decode many values into a single reused buffer. The unencoded value
+// is never longer than its encoding, so out is not reallocated if it
+// has at least len(buf) bytes of spare capacity.
+func DecodeBinaryAppend(buf, out []byte) ([]byte, []byte) {
 	if buf[0] != orderedEncodingBinary {
 		panic(fmt.Sprintf("%q doesn't begin with binary encoding byte", buf))
 	}
-	out := new(bytes.Buffer)
 	s := uint(6)
 	i := int(1)
 	if buf[i] == orderedEncodingTerminator {
-		return buf[2:], out.Bytes()
+		return buf[2:], out
 	}
 	t := (buf[i] << 1) & 0xff
 	for i = 2; buf[i] != orderedEncodingTerminator; i++ {
 		if s == 7 {
-			out.WriteByte(t | (buf[i] & 0x7f))
+			out = append(out, t|(buf[i]&0x7f))
 			i++
 		} else {
-			out.WriteByte(t | ((buf[i] & 0x7f) >> s))
+			out = append(out, t|((buf[i]&0x7f)>>s))
 		}
 
 		t = (buf[i] << (8 - s)) & 0xff
@@ -187,7 +195,7 @@ func DecodeBinary(buf []byte) ([]byte, []byte) {
 	if t != 0 {
 		panic("unexpected bits remaining after decoding blob")
 	}
-	return buf[i+1:], out.Bytes()
+	return buf[i+1:], out
 }
 
 // DecodeBinaryFinal decodes a byte slice and returns the
@@ -146,6 +146,11 @@ func TestEncodeBinary(t *testing.T) {
 		if !bytes.Equal(d, c.blob) {
 			t.Errorf("unexpected mismatch of decoded value: expected %s, got %s", prettyBytes(c.blob), prettyBytes(d))
 		}
+		prefix := []byte("prefix")
+		_, d = DecodeBinaryAppend(c.encoded, append([]byte(nil), prefix...))
+		if !bytes.Equal(d, append(prefix, c.blob...)) {
+			t.Errorf("unexpected mismatch of appended value: expected %s, got %s", prettyBytes(c.blob), prettyBytes(d))
+		}
 	}
 	blobs := make(byteSlice, len(testCases))
 	encodedBlobs := make(byteSlice, len(testCases))
@@ -0,0 +1,231 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package fault provides hooks for injecting faults (errors, delays
+// and dropped messages) at named points in the engine, RPC and Raft
+// layers. Faults are disabled unless an Injector is installed, either
+// by tests via SetInjector or by a node started with the hidden
+// -faults flag. The hooks are cheap no-ops when no Injector is
+// installed.
+package fault
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// Fault injection points.
+const (
+	// EngineWrite is consulted before each engine mutation.
+	EngineWrite = "engine.write"
+	// EngineSync is consulted when an engine batch is committed,
+	// standing in for the fsync of the write-ahead log.
+	EngineSync = "engine.sync"
+	// RPCSend is consulted before each RPC sent via rpc.Send.
+	RPCSend = "rpc.send"
+	// RaftMessage is consulted before each Raft message is sent to
+	// another node.
+	RaftMessage = "raft.message"
+)
+
+// An Injector decides which faults to inject at a named point.
+// Implementations must be safe for concurrent use.
+type Injector interface {
+	// Error returns a non-nil error if the operation at point should fail.
+	Error(point string) error
+	// Delay returns the duration by which the operation at point
+	// should be delayed, or zero.
+	Delay(point string) time.Duration
+	// Drop returns true if the message at point should be dropped.
+	Drop(point string) bool
+}
+
+var (
+	mu       sync.Mutex   // Serializes SetInjector
+	injector atomic.Value // Holds an injectorBox
+)
+
+// injectorBox wraps the installed Injector, as an atomic.Value can
+// hold neither nil nor values of differing concrete types.
+type injectorBox struct {
+	Injector
+}
+
+// SetInjector installs inj as the process-wide Injector and returns
+// the previously installed Injector. Specify nil to disable faults.
+func SetInjector(inj Injector) Injector {
+	mu.Lock()
+	defer mu.Unlock()
+	prev := current()
+	injector.Store(injectorBox{inj})
+	return prev
+}
+
+// current returns the installed Injector, or nil. It's consulted by
+// every hooked operation, so it doesn't lock.
+func current() Injector {
+	box, _ := injector.Load().(injectorBox)
+	return box.Injector
+}
+
+// MaybeError returns an injected error for point, if any.
+func MaybeError(point string) error {
+	if inj := current(); inj != nil {
+		return inj.Error(point)
+	}
+	return nil
+}
+
+// MaybeDelay sleeps for the injected delay for point, if any.
+func MaybeDelay(point string) {
+	if inj := current(); inj != nil {
+		if d := inj.Delay(point); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+// MaybeDrop returns true if the message at point should be dropped.
+func MaybeDrop(point string) bool {
+	if inj := current(); inj != nil {
+		return inj.Drop(point)
+	}
+	return false
+}
+
+// InjectedError is returned by a RandomInjector for injected errors.
+type InjectedError struct {
+	Point string
+}
+
+// Error implements the error interface.
+func (e *InjectedError) Error() string {
+	return fmt.Sprintf("injected fault at %s", e.Point)
+}
+
+// A Spec describes the faults injected at a single point.
+type Spec struct {
+	ErrorProbability float64       // Probability an operation fails
+	DropProbability  float64       // Probability a message is dropped
+	DelayProbability float64       // Probability an operation is delayed
+	Delay            time.Duration // Duration of injected delays
+}
+
+// A RandomInjector injects faults at random according to a Spec for
+// each point.
+type RandomInjector struct {
+	mu    sync.Mutex
+	rand  *rand.Rand
+	specs map[string]Spec
+}
+
+// NewRandomInjector returns an Injector which injects faults
+// according to specs, with randomness derived from seed.
+func NewRandomInjector(seed int64, specs map[string]Spec) *RandomInjector {
+	return &RandomInjector{
+		rand:  rand.New(rand.NewSource(seed)),
+		specs: specs,
+	}
+}
+
+// chance returns true with probability p.
+func (ri *RandomInjector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	return ri.rand.Float64() < p
+}
+
+// Error implements the Injector interface.
+func (ri *RandomInjector) Error(point string) error {
+	if ri.chance(ri.specs[point].ErrorProbability) {
+		return &InjectedError{Point: point}
+	}
+	return nil
+}
+
+// Delay implements the Injector interface.
+func (ri *RandomInjector) Delay(point string) time.Duration {
+	spec := ri.specs[point]
+	if ri.chance(spec.DelayProbability) {
+		return spec.Delay
+	}
+	return 0
+}
+
+// Drop implements the Injector interface.
+func (ri *RandomInjector) Drop(point string) bool {
+	return ri.chance(ri.specs[point].DropProbability)
+}
+
+// ParseSpecs parses a comma-separated list of fault specifications
+// of the form point:kind=value[:kind=value...], where kind is one of
+// "error", "drop" or "delay". Error and drop values are
+// probabilities; delay values are a probability and duration
+// separated by a slash. For example:
+//
+//   engine.write:error=0.001,engine.sync:delay=0.01/100ms,raft.message:drop=0.05
+func ParseSpecs(s string) (map[string]Spec, error) {
+	specs := map[string]Spec{}
+	for _, pointStr := range strings.Split(s, ",") {
+		if len(pointStr) == 0 {
+			continue
+		}
+		parts := strings.Split(pointStr, ":")
+		point := parts[0]
+		spec := specs[point]
+		if len(parts) < 2 {
+			return nil, util.Errorf("no faults specified for %q", point)
+		}
+		for _, kv := range parts[1:] {
+			idx := strings.Index(kv, "=")
+			if idx == -1 {
+				return nil, util.Errorf("invalid fault %q for %q; expected kind=value", kv, point)
+			}
+			kind, value := kv[:idx], kv[idx+1:]
+			var err error
+			switch kind {
+			case "error":
+				spec.ErrorProbability, err = strconv.ParseFloat(value, 64)
+			case "drop":
+				spec.DropProbability, err = strconv.ParseFloat(value, 64)
+			case "delay":
+				slash := strings.Index(value, "/")
+				if slash == -1 {
+					return nil, util.Errorf("invalid delay %q for %q; expected probability/duration", value, point)
+				}
+				if spec.DelayProbability, err = strconv.ParseFloat(value[:slash], 64); err == nil {
+					spec.Delay, err = time.ParseDuration(value[slash+1:])
+				}
+			default:
+				return nil, util.Errorf("unknown fault kind %q for %q", kind, point)
+			}
+			if err != nil {
+				return nil, util.Errorf("invalid fault %q for %q: %s", kv, point, err)
+			}
+		}
+		specs[point] = spec
+	}
+	return specs, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package fault
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSpecs(t *testing.T) {
+	testCases := []struct {
+		s      string
+		expErr bool
+		specs  map[string]Spec
+	}{
+		{"", false, map[string]Spec{}},
+		{"engine.write:error=0.5", false, map[string]Spec{
+			EngineWrite: {ErrorProbability: 0.5},
+		}},
+		{"rpc.send:error=0.1:delay=0.2/50ms,raft.message:drop=1", false, map[string]Spec{
+			RPCSend:     {ErrorProbability: 0.1, DelayProbability: 0.2, Delay: 50 * time.Millisecond},
+			RaftMessage: {DropProbability: 1},
+		}},
+		{"engine.sync", true, nil},
+		{"engine.sync:delay=0.5", true, nil},
+		{"engine.sync:delay=0.5/xyz", true, nil},
+		{"engine.write:boom=0.5", true, nil},
+		{"engine.write:error", true, nil},
+	}
+	for i, test := range testCases {
+		specs, err := ParseSpecs(test.s)
+		if test.expErr != (err != nil) {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+			continue
+		}
+		if !test.expErr && !reflect.DeepEqual(specs, test.specs) {
+			t.Errorf("%d: expected %+v; got %+v", i, test.specs, specs)
+		}
+	}
+}
+
+func TestRandomInjector(t *testing.T) {
+	defer SetInjector(nil)
+	if err := MaybeError(EngineWrite); err != nil {
+		t.Errorf("expected no error without injector; got %s", err)
+	}
+	inj := NewRandomInjector(0, map[string]Spec{
+		EngineWrite: {ErrorProbability: 1},
+		RaftMessage: {DropProbability: 1},
+	})
+	if prev := SetInjector(inj); prev != nil {
+		t.Errorf("expected no previous injector; got %v", prev)
+	}
+	if err := MaybeError(EngineWrite); err == nil {
+		t.Error("expected injected error")
+	} else if ie, ok := err.(*InjectedError); !ok || ie.Point != EngineWrite {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := MaybeError(RPCSend); err != nil {
+		t.Errorf("expected no error for unspecified point; got %s", err)
+	}
+	if !MaybeDrop(RaftMessage) {
+		t.Error("expected message to be dropped")
+	}
+	if MaybeDrop(EngineWrite) {
+		t.Error("expected no drop for engine write")
+	}
+	if prev := SetInjector(nil); prev != inj {
+		t.Errorf("expected the installed injector; got %v", prev)
+	}
+	if err := MaybeError(EngineWrite); err != nil {
+		t.Errorf("expected no error once the injector is removed; got %s", err)
+	}
+}
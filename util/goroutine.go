@@ -0,0 +1,134 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SubsystemLabel is the runtime profiler label key under which
+// long-running goroutines record the subsystem they belong to.
+const SubsystemLabel = "subsystem"
+
+// unlabeledSubsystem groups goroutines without a subsystem label.
+const unlabeledSubsystem = "unlabeled"
+
+// RunLabeled runs f on the calling goroutine, labeled as belonging to
+// the specified subsystem (e.g. "gossip", "raft", "scanner"). The label
+// is visible in goroutine and CPU profiles and is inherited by
+// goroutines started from f. Long-running goroutines should be
+// started as go util.RunLabeled("gossip", g.manage). If crash reports
+// are enabled, a panic in f is reported under the subsystem. Once f
+// returns, the calling goroutine's labels are reset to none, the labels
+// of a goroutine started outside any labeled one.
+func RunLabeled(subsystem string, f func()) {
+	ctx := context.Background()
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(SubsystemLabel, subsystem)))
+	defer pprof.SetGoroutineLabels(ctx)
+	defer ReportPanic(subsystem)
+	f()
+}
+
+// A GoroutineGroup is the set of goroutines belonging to a subsystem.
+// Stacks contains one entry per distinct stack, prefixed with the
+// number of goroutines sharing it.
+type GoroutineGroup struct {
+	Subsystem string
+	Count     int
+	Stacks    []string
+}
+
+// GoroutinesBySubsystem returns the stacks of all goroutines grouped
+// by subsystem label, sorted by subsystem name with unlabeled
+// goroutines last.
+func GoroutinesBySubsystem() ([]*GoroutineGroup, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil, err
+	}
+	return parseGoroutineProfile(buf.String())
+}
+
+// parseGoroutineProfile parses the text (debug=1) form of a goroutine
+// profile. Each record begins with "<count> @ <pcs>", optionally
+// followed by a "# labels: {...}" line and the symbolized stack, and
+// is separated from the next by a blank line.
+func parseGoroutineProfile(profile string) ([]*GoroutineGroup, error) {
+	groups := map[string]*GoroutineGroup{}
+	for _, record := range strings.Split(profile, "\n\n") {
+		record = strings.TrimSpace(record)
+		// The profile's header line directly precedes the first record.
+		if strings.HasPrefix(record, "goroutine profile:") {
+			if i := strings.Index(record, "\n"); i >= 0 {
+				record = record[i+1:]
+			} else {
+				record = ""
+			}
+		}
+		if record == "" {
+			continue
+		}
+		fields := strings.SplitN(record, " ", 2)
+		count, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, Errorf("unable to parse goroutine count in %q: %s", record, err)
+		}
+		subsystem := unlabeledSubsystem
+		for _, line := range strings.Split(record, "\n") {
+			if !strings.HasPrefix(line, "# labels: ") {
+				continue
+			}
+			var labels map[string]string
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "# labels: ")), &labels); err != nil {
+				return nil, Errorf("unable to parse goroutine labels %q: %s", line, err)
+			}
+			if s, ok := labels[SubsystemLabel]; ok {
+				subsystem = s
+			}
+		}
+		g, ok := groups[subsystem]
+		if !ok {
+			g = &GoroutineGroup{Subsystem: subsystem}
+			groups[subsystem] = g
+		}
+		g.Count += count
+		g.Stacks = append(g.Stacks, record)
+	}
+
+	var result []*GoroutineGroup
+	for _, g := range groups {
+		result = append(result, g)
+	}
+	sort.Sort(goroutineGroups(result))
+	return result, nil
+}
+
+type goroutineGroups []*GoroutineGroup
+
+func (gg goroutineGroups) Len() int      { return len(gg) }
+func (gg goroutineGroups) Swap(i, j int) { gg[i], gg[j] = gg[j], gg[i] }
+func (gg goroutineGroups) Less(i, j int) bool {
+	if (gg[i].Subsystem == unlabeledSubsystem) != (gg[j].Subsystem == unlabeledSubsystem) {
+		return gg[j].Subsystem == unlabeledSubsystem
+	}
+	return gg[i].Subsystem < gg[j].Subsystem
+}
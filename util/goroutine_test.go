@@ -0,0 +1,118 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestGoroutinesBySubsystem verifies that a goroutine started with
+// RunLabeled is grouped under its subsystem.
+func TestGoroutinesBySubsystem(t *testing.T) {
+	stopper := NewStopper(1)
+	started := make(chan struct{})
+	go RunLabeled("test-subsystem", func() {
+		close(started)
+		<-stopper.ShouldStop()
+		stopper.SetStopped()
+	})
+	<-started
+	defer stopper.Stop()
+
+	groups, err := GoroutinesBySubsystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, g := range groups {
+		if g.Subsystem == "test-subsystem" {
+			found = true
+			if g.Count != 1 {
+				t.Errorf("expected 1 goroutine; got %d", g.Count)
+			}
+			if !strings.Contains(strings.Join(g.Stacks, "\n"), "TestGoroutinesBySubsystem") {
+				t.Errorf("expected test function in stacks: %s", g.Stacks)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("test-subsystem not found in %+v", groups)
+	}
+	if last := groups[len(groups)-1]; last.Subsystem != unlabeledSubsystem {
+		t.Errorf("expected unlabeled goroutines last; got %s", last.Subsystem)
+	}
+}
+
+// TestRunLabeledResetsLabels verifies that the subsystem label set by
+// RunLabeled doesn't outlive f on the calling goroutine.
+func TestRunLabeledResetsLabels(t *testing.T) {
+	labeled := func() bool {
+		groups, err := GoroutinesBySubsystem()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, g := range groups {
+			if g.Subsystem == "test-reset" {
+				return true
+			}
+		}
+		return false
+	}
+	var during bool
+	RunLabeled("test-reset", func() {
+		during = labeled()
+	})
+	if !during {
+		t.Error("expected the calling goroutine to be labeled while running f")
+	}
+	if labeled() {
+		t.Error("expected the label to be reset once f returned")
+	}
+}
+
+// TestParseGoroutineProfile verifies parsing of the text goroutine
+// profile format.
+func TestParseGoroutineProfile(t *testing.T) {
+	profile := `goroutine profile: total 4
+2 @ 0x1 0x2
+# labels: {"subsystem":"raft"}
+#	0x1	main.a+0x1	a.go:1
+
+1 @ 0x3
+#	0x3	main.b+0x1	b.go:1
+
+1 @ 0x4
+# labels: {"subsystem":"gossip"}
+#	0x4	main.c+0x1	c.go:1
+`
+	groups, err := parseGoroutineProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		subsystem string
+		count     int
+	}{{"gossip", 1}, {"raft", 2}, {unlabeledSubsystem, 1}}
+	if len(groups) != len(expected) {
+		t.Fatalf("expected %d groups; got %d", len(expected), len(groups))
+	}
+	for i, e := range expected {
+		if groups[i].Subsystem != e.subsystem || groups[i].Count != e.count {
+			t.Errorf("%d: expected %s=%d; got %s=%d", i, e.subsystem, e.count, groups[i].Subsystem, groups[i].Count)
+		}
+	}
+}
@@ -73,11 +73,11 @@ func isAllowed(encType EncodingType, allowed []EncodingType) bool {
 
 var yamlXXXUnrecognizedRE = regexp.MustCompile(` *xxx_unrecognized: \[\]\n?`)
 
-// sanitizeYAML filters lines in the input which match xxx_unrecognized, a
+// SanitizeYAML filters lines in the input which match xxx_unrecognized, a
 // truly-annoying public member of proto Message structs, which we
 // cannot specify yaml output tags for.
 // TODO(spencer): there's got to be a better way to do this.
-func sanitizeYAML(b []byte) []byte {
+func SanitizeYAML(b []byte) []byte {
 	return yamlXXXUnrecognizedRE.ReplaceAll(b, []byte{})
 }
 
@@ -191,7 +191,7 @@ func MarshalResponse(r *http.Request, value interface{}, allowed []EncodingType)
 		if body, err = yaml.Marshal(value); err != nil {
 			err = Errorf("unable to marshal %+v to yaml: %s", value, err)
 		} else {
-			body = sanitizeYAML(body)
+			body = SanitizeYAML(body)
 		}
 	} else {
 		// Always fall back to JSON-encode the config.
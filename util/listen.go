@@ -0,0 +1,33 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"net"
+	"strings"
+)
+
+// Listen announces on the local network address. If reusePort is
+// true and the network is TCP, the socket is bound with SO_REUSEPORT,
+// so that a new process may bind the same address while the current
+// one drains its connections; the kernel balances new connections
+// between the processes bound to the address.
+func Listen(network, address string, reusePort bool) (net.Listener, error) {
+	if !reusePort || !strings.HasPrefix(network, "tcp") {
+		return net.Listen(network, address)
+	}
+	return listenReusePort(network, address)
+}
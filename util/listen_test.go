@@ -0,0 +1,54 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+// TestListenReusePort verifies that two listeners may be bound to the
+// same address with SO_REUSEPORT.
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("SO_REUSEPORT is not supported on %s", runtime.GOOS)
+	}
+	ln1, err := Listen("tcp", "127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	addr := ln1.Addr().String()
+	ln2, err := Listen("tcp", addr, true)
+	if err != nil {
+		t.Fatalf("unable to bind %s a second time: %s", addr, err)
+	}
+	defer ln2.Close()
+
+	// Without SO_REUSEPORT, the address is in use.
+	if ln3, err := Listen("tcp", addr, false); err == nil {
+		ln3.Close()
+		t.Errorf("expected binding %s without SO_REUSEPORT to fail", addr)
+	}
+
+	// A connection is accepted by one of the listeners.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,193 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package log
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// defaultMaxFileSize is glog's size at which log files are rotated.
+var defaultMaxFileSize = glog.MaxSize
+
+// A FileConfig controls the rotation and retention of log files. A
+// zero value for any field disables the corresponding limit.
+type FileConfig struct {
+	// MaxFileSize is the size in bytes at which a log file is rotated.
+	// If zero, glog's default of 1.8GB is used.
+	MaxFileSize uint64
+	// MaxTotalSize is the total size in bytes which the files of each
+	// severity may occupy before the oldest of them are deleted.
+	MaxTotalSize int64
+	// MaxAge is the time since it was last written after which a log
+	// file is deleted.
+	MaxAge time.Duration
+}
+
+var (
+	fileConfigMu sync.Mutex
+	fileConfig   FileConfig
+)
+
+// SetFileConfig sets the rotation and retention of log files. The
+// rotation size applies to subsequent writes; retention is applied by
+// the next call to GCFiles.
+func SetFileConfig(cfg FileConfig) {
+	fileConfigMu.Lock()
+	defer fileConfigMu.Unlock()
+	if cfg.MaxFileSize != fileConfig.MaxFileSize {
+		maxSize := cfg.MaxFileSize
+		if maxSize == 0 {
+			maxSize = defaultMaxFileSize
+		}
+		// glog reads the rotation size as it writes, holding a lock of
+		// its own which isn't exported.
+		atomic.StoreUint64(&glog.MaxSize, maxSize)
+	}
+	fileConfig = cfg
+}
+
+// GetFileConfig returns the rotation and retention of log files.
+func GetFileConfig() FileConfig {
+	fileConfigMu.Lock()
+	defer fileConfigMu.Unlock()
+	return fileConfig
+}
+
+// A FileInfo describes a log file written by glog.
+type FileInfo struct {
+	Name     string
+	Severity string
+	Size     int64
+	ModTime  time.Time
+}
+
+// Dir returns the directory holding log files: glog's -log_dir if it
+// is set and the temporary directory otherwise.
+func Dir() string {
+	if f := flag.Lookup("log_dir"); f != nil && f.Value.String() != "" {
+		return f.Value.String()
+	}
+	return os.TempDir()
+}
+
+// ListFiles returns the log files in Dir, sorted by name. Log files
+// are named by glog after the program, host, user and severity, and
+// the time at which the file was created.
+func ListFiles() ([]FileInfo, error) {
+	return listFiles(Dir(), filepath.Base(os.Args[0]))
+}
+
+// listFiles returns the log files of program in dir, sorted by name.
+func listFiles(dir, program string) ([]FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasPrefix(name, program+".") {
+			continue
+		}
+		i := strings.Index(name, ".log.")
+		if i == -1 {
+			continue
+		}
+		severity := name[i+len(".log."):]
+		if j := strings.Index(severity, "."); j != -1 {
+			severity = severity[:j]
+		}
+		files = append(files, FileInfo{
+			Name:     name,
+			Severity: severity,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		})
+	}
+	// ReadDir sorts by name.
+	return files, nil
+}
+
+// GCFiles deletes the log files in Dir which are retained beyond the
+// limits of the current FileConfig, returning the number of files
+// deleted.
+func GCFiles(now time.Time) (int, error) {
+	dir := Dir()
+	files, err := listFiles(dir, filepath.Base(os.Args[0]))
+	if err != nil {
+		return 0, err
+	}
+	return gcFiles(dir, files, GetFileConfig(), now)
+}
+
+// gcFiles deletes those of files in dir which exceed the age or total
+// size limits of cfg. glog writes a separate file for each severity,
+// holding the messages of that and all higher severities. Limits
+// apply to the files of each severity separately, so that verbose
+// INFO logs don't displace the files of higher severities. The newest
+// file of each severity, to which glog may still be writing, is never
+// deleted.
+func gcFiles(dir string, files []FileInfo, cfg FileConfig, now time.Time) (int, error) {
+	if cfg.MaxTotalSize <= 0 && cfg.MaxAge <= 0 {
+		return 0, nil
+	}
+	bySeverity := map[string][]FileInfo{}
+	for _, f := range files {
+		bySeverity[f.Severity] = append(bySeverity[f.Severity], f)
+	}
+	var deleted int
+	for _, sevFiles := range bySeverity {
+		sort.Sort(sort.Reverse(byModTime(sevFiles)))
+		total := sevFiles[0].Size
+		for _, f := range sevFiles[1:] {
+			total += f.Size
+			if (cfg.MaxTotalSize <= 0 || total <= cfg.MaxTotalSize) &&
+				(cfg.MaxAge <= 0 || now.Sub(f.ModTime) <= cfg.MaxAge) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, f.Name)); err != nil && !os.IsNotExist(err) {
+				return deleted, fmt.Errorf("unable to delete log file %s: %s", f.Name, err)
+			}
+			total -= f.Size
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// byModTime sorts log files by the time of their last write, with
+// ties broken by name, as glog includes the creation time in it.
+type byModTime []FileInfo
+
+func (f byModTime) Len() int      { return len(f) }
+func (f byModTime) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f byModTime) Less(i, j int) bool {
+	if !f[i].ModTime.Equal(f[j].ModTime) {
+		return f[i].ModTime.Before(f[j].ModTime)
+	}
+	return f[i].Name < f[j].Name
+}
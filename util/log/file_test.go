@@ -0,0 +1,96 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestGCFiles verifies that log files beyond the age and total size
+// limits are deleted separately for each severity, and that the
+// newest file of each severity is retained.
+func TestGCFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_gc_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	testFiles := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"cockroach.host.user.log.INFO.20150101-000000.1", 10, 72 * time.Hour},
+		{"cockroach.host.user.log.INFO.20150102-000000.1", 10, 48 * time.Hour},
+		{"cockroach.host.user.log.INFO.20150103-000000.1", 10, 1 * time.Hour},
+		{"cockroach.host.user.log.INFO.20150104-000000.1", 10, 0},
+		{"cockroach.host.user.log.ERROR.20150101-000000.1", 10, 96 * time.Hour},
+		{"cockroach.host.user.log.ERROR.20150102-000000.1", 10, 1 * time.Hour},
+		{"cockroach.host.user.log.WARNING.20150101-000000.1", 10, 96 * time.Hour},
+		{"other.host.user.log.INFO.20150101-000000.1", 10, 96 * time.Hour},
+	}
+	for _, f := range testFiles {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, make([]byte, f.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-f.age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := listFiles(dir, "cockroach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 7 {
+		t.Fatalf("expected 7 log files; got %+v", files)
+	}
+
+	// Files older than a day are deleted, as are INFO files beyond
+	// 25 bytes. The newest file of each severity is kept regardless.
+	cfg := FileConfig{MaxTotalSize: 25, MaxAge: 24 * time.Hour}
+	deleted, err := gcFiles(dir, files, cfg, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3 {
+		t.Errorf("expected 3 files deleted; got %d", deleted)
+	}
+	if files, err = listFiles(dir, "cockroach"); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	expected := []string{
+		"cockroach.host.user.log.ERROR.20150102-000000.1",
+		"cockroach.host.user.log.INFO.20150103-000000.1",
+		"cockroach.host.user.log.INFO.20150104-000000.1",
+		"cockroach.host.user.log.WARNING.20150101-000000.1",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected remaining files %s; got %s", expected, names)
+	}
+}
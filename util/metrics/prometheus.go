@@ -0,0 +1,64 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PrometheusContentType is the content type of the Prometheus text
+// exposition format written by WritePrometheus.
+const PrometheusContentType = "text/plain; version=0.0.4"
+
+// prometheusQuantiles are the quantiles exported for histograms.
+var prometheusQuantiles = []float64{0.5, 0.9, 0.99}
+
+// prometheusName returns the Prometheus name of the metric registered
+// under name, e.g. "cockroach_kv_readcache_hits" for
+// "kv.readcache.hits".
+func prometheusName(name string) string {
+	return "cockroach_" + strings.Replace(name, ".", "_", -1)
+}
+
+// WritePrometheus writes the registered metrics to w in the
+// Prometheus text exposition format. Histograms are written as
+// summaries of the quantiles of the values recorded within their
+// windows.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	r.Each(func(name string, m Metric) {
+		pName := prometheusName(name)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", pName, m.Type())
+		switch t := m.(type) {
+		case *Counter:
+			fmt.Fprintf(bw, "%s %d\n", pName, t.Count())
+		case *Gauge:
+			fmt.Fprintf(bw, "%s %d\n", pName, t.Value())
+		case *Rate:
+			fmt.Fprintf(bw, "%s %g\n", pName, t.Value())
+		case *Histogram:
+			for i, v := range t.Quantiles(prometheusQuantiles...) {
+				fmt.Fprintf(bw, "%s{quantile=\"%g\"} %g\n", pName, prometheusQuantiles[i], v)
+			}
+			fmt.Fprintf(bw, "%s_sum %g\n", pName, t.Sum())
+			fmt.Fprintf(bw, "%s_count %d\n", pName, t.Count())
+		}
+	})
+	return bw.Flush()
+}
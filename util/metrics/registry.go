@@ -0,0 +1,447 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+const (
+	// DefaultWindow is the period over which histograms and rates are
+	// usually computed.
+	DefaultWindow = time.Minute
+	// windowSlots is the number of intervals into which the window of
+	// a histogram or rate is divided. The oldest interval is discarded
+	// as the window slides, so the window covers between
+	// (windowSlots-1)/windowSlots of its period and the full period.
+	windowSlots = 6
+)
+
+// A Metric is a value registered with a Registry: a *Counter, *Gauge,
+// *Histogram or *Rate.
+type Metric interface {
+	// Type returns the type of the metric as known to Prometheus:
+	// "counter", "gauge" or "summary".
+	Type() string
+}
+
+// A Counter is a monotonically increasing count, e.g. of requests
+// served. It is safe for concurrent use.
+type Counter struct {
+	count int64 // Accessed atomically
+}
+
+// NewCounter returns a new, unregistered counter.
+func NewCounter() *Counter {
+	return &Counter{}
+}
+
+// Inc increments the counter by n.
+func (c *Counter) Inc(n int64) {
+	atomic.AddInt64(&c.count, n)
+}
+
+// Count returns the current count.
+func (c *Counter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+// Type implements the Metric interface.
+func (c *Counter) Type() string { return "counter" }
+
+// A Gauge is a value which may rise and fall, e.g. the number of
+// requests in flight. It is safe for concurrent use.
+type Gauge struct {
+	value int64 // Accessed atomically
+}
+
+// NewGauge returns a new, unregistered gauge.
+func NewGauge() *Gauge {
+	return &Gauge{}
+}
+
+// Update sets the gauge to v.
+func (g *Gauge) Update(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+// Inc adds n, which may be negative, to the gauge.
+func (g *Gauge) Inc(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// Type implements the Metric interface.
+func (g *Gauge) Type() string { return "gauge" }
+
+// slidingWindow divides a window of time into windowSlots intervals,
+// which are reused in turn as the window slides forward.
+type slidingWindow struct {
+	now      func() time.Time
+	interval time.Duration // Duration of each slot
+	cur      int           // Index of the slot of the current interval
+	curStart time.Time     // Start of the current interval
+}
+
+func newSlidingWindow(window time.Duration) slidingWindow {
+	return slidingWindow{
+		now:      time.Now,
+		interval: window / windowSlots,
+		curStart: time.Now(),
+	}
+}
+
+// advance slides the window forward to the current time, invoking
+// reset with the index of each slot which is reused, and returns the
+// index of the current slot.
+func (w *slidingWindow) advance(reset func(slot int)) int {
+	now := w.now()
+	for i := 0; i < windowSlots && now.Sub(w.curStart) >= w.interval; i++ {
+		w.cur = (w.cur + 1) % windowSlots
+		w.curStart = w.curStart.Add(w.interval)
+		reset(w.cur)
+	}
+	// After an idle period longer than the window, all slots have been
+	// reset; start the current interval afresh.
+	if now.Sub(w.curStart) >= w.interval {
+		w.curStart = now
+	}
+	return w.cur
+}
+
+// A Histogram records the distribution of values, e.g. latencies,
+// over a sliding window of time, as well as the count and sum of all
+// values ever recorded. Values are bucketed to within 1% of their true
+// value. It is safe for concurrent use.
+type Histogram struct {
+	sync.Mutex
+	window slidingWindow
+	slots  [windowSlots]map[int16]uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram returns a new, unregistered histogram of the values
+// recorded over the specified window.
+func NewHistogram(window time.Duration) *Histogram {
+	h := &Histogram{window: newSlidingWindow(window)}
+	for i := range h.slots {
+		h.slots[i] = map[int16]uint64{}
+	}
+	return h
+}
+
+func (h *Histogram) resetSlot(slot int) {
+	h.slots[slot] = map[int16]uint64{}
+}
+
+// Record records the value v.
+func (h *Histogram) Record(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	h.slots[h.window.advance(h.resetSlot)][compress(v)]++
+	h.count++
+	h.sum += v
+}
+
+// RecordDuration records the duration d in nanoseconds.
+func (h *Histogram) RecordDuration(d time.Duration) {
+	h.Record(float64(d.Nanoseconds()))
+}
+
+// Quantiles returns the values below which the fractions qs, each
+// between 0 and 1, of the values recorded within the window fall.
+// Quantiles are zero if no values were recorded within the window.
+func (h *Histogram) Quantiles(qs ...float64) []float64 {
+	h.Lock()
+	h.window.advance(h.resetSlot)
+	merged := map[int16]uint64{}
+	total := uint64(0)
+	for _, slot := range h.slots {
+		for v, n := range slot {
+			merged[v] += n
+			total += n
+		}
+	}
+	h.Unlock()
+
+	results := make([]float64, len(qs))
+	if total == 0 {
+		return results
+	}
+	proportions := make(proportionArray, 0, len(merged))
+	for v, n := range merged {
+		proportions = append(proportions, proportion{Value: decompress(v), Count: n})
+	}
+	for i, q := range qs {
+		results[i], _ = percentile(total, proportions, q)
+	}
+	return results
+}
+
+// Count returns the number of values ever recorded.
+func (h *Histogram) Count() uint64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.count
+}
+
+// Sum returns the sum of the values ever recorded.
+func (h *Histogram) Sum() float64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.sum
+}
+
+// Type implements the Metric interface.
+func (h *Histogram) Type() string { return "summary" }
+
+// A Rate measures the rate per second of events, e.g. bytes written,
+// averaged over a sliding window of time. It is safe for concurrent
+// use.
+type Rate struct {
+	sync.Mutex
+	window slidingWindow
+	slots  [windowSlots]int64
+}
+
+// NewRate returns a new, unregistered rate averaged over the
+// specified window.
+func NewRate(window time.Duration) *Rate {
+	return &Rate{window: newSlidingWindow(window)}
+}
+
+func (r *Rate) resetSlot(slot int) {
+	r.slots[slot] = 0
+}
+
+// Add records n events.
+func (r *Rate) Add(n int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.slots[r.window.advance(r.resetSlot)] += n
+}
+
+// Value returns the rate per second of the events recorded within the
+// window.
+func (r *Rate) Value() float64 {
+	r.Lock()
+	defer r.Unlock()
+	r.window.advance(r.resetSlot)
+	var total int64
+	for _, n := range r.slots {
+		total += n
+	}
+	return float64(total) / (r.window.interval * windowSlots).Seconds()
+}
+
+// Type implements the Metric interface.
+func (r *Rate) Type() string { return "gauge" }
+
+// metricNameRE matches valid metric names: lower case words separated
+// by periods, e.g. "kv.readcache.hits".
+var metricNameRE = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z0-9_]+)*$`)
+
+// A Registry holds metrics by name so that they can be listed, e.g.
+// for export to Prometheus.
+type Registry struct {
+	sync.Mutex
+	metrics map[string]Metric
+}
+
+// NewRegistry returns a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]Metric{}}
+}
+
+// DefaultRegistry holds the metrics of the node, which are exported
+// by the status server.
+var DefaultRegistry = NewRegistry()
+
+// Register registers m under name, replacing any metric previously
+// registered under it, e.g. by an instance of a component which has
+// since been stopped. Panics if name is invalid.
+func (r *Registry) Register(name string, m Metric) {
+	if !metricNameRE.MatchString(name) {
+		panic(fmt.Sprintf("invalid metric name %q", name))
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.metrics[name] = m
+}
+
+// getOrRegister returns the metric registered under name, registering
+// the metric returned by newMetric if there is none.
+func (r *Registry) getOrRegister(name string, newMetric func() Metric) Metric {
+	if !metricNameRE.MatchString(name) {
+		panic(fmt.Sprintf("invalid metric name %q", name))
+	}
+	r.Lock()
+	defer r.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		return m
+	}
+	m := newMetric()
+	r.metrics[name] = m
+	return m
+}
+
+// Counter returns the counter registered under name, registering a
+// new one if necessary. Like the other accessors, it panics if a
+// different kind of metric is registered under name.
+func (r *Registry) Counter(name string) *Counter {
+	return r.getOrRegister(name, func() Metric { return NewCounter() }).(*Counter)
+}
+
+// Gauge returns the gauge registered under name, registering a new
+// one if necessary.
+func (r *Registry) Gauge(name string) *Gauge {
+	return r.getOrRegister(name, func() Metric { return NewGauge() }).(*Gauge)
+}
+
+// Histogram returns the histogram registered under name, registering
+// a new one over the specified window if necessary.
+func (r *Registry) Histogram(name string, window time.Duration) *Histogram {
+	return r.getOrRegister(name, func() Metric { return NewHistogram(window) }).(*Histogram)
+}
+
+// Rate returns the rate registered under name, registering a new one
+// over the specified window if necessary.
+func (r *Registry) Rate(name string, window time.Duration) *Rate {
+	return r.getOrRegister(name, func() Metric { return NewRate(window) }).(*Rate)
+}
+
+// Get returns the metric registered under name, if any.
+func (r *Registry) Get(name string) (Metric, bool) {
+	r.Lock()
+	defer r.Unlock()
+	m, ok := r.metrics[name]
+	return m, ok
+}
+
+// Each invokes f with each registered metric, in order of name.
+func (r *Registry) Each(f func(name string, m Metric)) {
+	r.Lock()
+	names := make([]string, 0, len(r.metrics))
+	metrics := make(map[string]Metric, len(r.metrics))
+	for name, m := range r.metrics {
+		names = append(names, name)
+		metrics[name] = m
+	}
+	r.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		f(name, metrics[name])
+	}
+}
+
+// NameComponent converts a CamelCase identifier, such as a method or
+// type name, into a component of a metric name, e.g.
+// "end_transaction" for "EndTransaction" or "internal_gc" for
+// "InternalGC". Characters not allowed in metric names are dropped.
+func NameComponent(s string) string {
+	runes := []rune(s)
+	var buf bytes.Buffer
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// Start a new word unless continuing an acronym.
+			if i > 0 && (unicode.IsLower(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				buf.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			buf.WriteRune(r)
+		}
+	}
+	if buf.Len() == 0 {
+		return "unknown"
+	}
+	return buf.String()
+}
+
+// MethodMetrics record the latency of each method of an API and
+// counts of named events, e.g. retries, incurred executing it. The
+// metrics of a method are registered as <prefix><method>.latency and
+// <prefix><method>.<event> when the method is first seen, with the
+// method's name converted by NameComponent.
+type MethodMetrics struct {
+	sync.Mutex
+	registry *Registry
+	prefix   string
+	events   []string
+	methods  map[string]*methodMetrics
+}
+
+type methodMetrics struct {
+	latency *Histogram
+	events  map[string]*Counter
+}
+
+// MethodMetrics returns a new MethodMetrics registering its metrics
+// under prefix, e.g. "store.cmd.", counting the specified events.
+func (r *Registry) MethodMetrics(prefix string, events ...string) *MethodMetrics {
+	return &MethodMetrics{
+		registry: r,
+		prefix:   prefix,
+		events:   events,
+		methods:  map[string]*methodMetrics{},
+	}
+}
+
+// get returns the metrics of method, registering them if necessary.
+func (mm *MethodMetrics) get(method string) *methodMetrics {
+	mm.Lock()
+	defer mm.Unlock()
+	m, ok := mm.methods[method]
+	if !ok {
+		name := mm.prefix + NameComponent(method) + "."
+		m = &methodMetrics{
+			latency: mm.registry.Histogram(name+"latency", DefaultWindow),
+			events:  map[string]*Counter{},
+		}
+		for _, event := range mm.events {
+			m.events[event] = mm.registry.Counter(name + event)
+		}
+		mm.methods[method] = m
+	}
+	return m
+}
+
+// RecordLatency records the latency of an invocation of method.
+func (mm *MethodMetrics) RecordLatency(method string, latency time.Duration) {
+	mm.get(method).latency.RecordDuration(latency)
+}
+
+// Inc counts an occurrence of event while executing method. Events
+// other than those specified on creation are ignored.
+func (mm *MethodMetrics) Inc(method, event string) {
+	if c, ok := mm.get(method).events[event]; ok {
+		c.Inc(1)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// manualClock returns a clock function returning *now.
+func manualClock(now *time.Time) func() time.Time {
+	return func() time.Time { return *now }
+}
+
+// TestHistogramWindow verifies that histogram quantiles cover only
+// the values recorded within the window, while the count and sum
+// cover all values.
+func TestHistogramWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	h := NewHistogram(time.Minute)
+	h.window.now, h.window.curStart = manualClock(&now), now
+
+	for i := 1; i <= 100; i++ {
+		h.Record(float64(i))
+	}
+	qs := h.Quantiles(0.5, 0.99)
+	if math.Abs(qs[0]-50) > 1 || math.Abs(qs[1]-99) > 1 {
+		t.Errorf("expected quantiles near 50 and 99; got %v", qs)
+	}
+
+	// Values recorded 30s later are merged with the earlier ones.
+	now = now.Add(30 * time.Second)
+	for i := 0; i < 100; i++ {
+		h.Record(1000)
+	}
+	if qs = h.Quantiles(0.25, 0.75); math.Abs(qs[0]-50) > 1 || math.Abs(qs[1]-1000) > 10 {
+		t.Errorf("expected quantiles near 50 and 1000; got %v", qs)
+	}
+
+	// Once the earlier values leave the window, only the later ones
+	// remain.
+	now = now.Add(50 * time.Second)
+	if qs = h.Quantiles(0.25); math.Abs(qs[0]-1000) > 10 {
+		t.Errorf("expected quantile near 1000; got %v", qs)
+	}
+	now = now.Add(time.Hour)
+	if qs = h.Quantiles(0.5); qs[0] != 0 {
+		t.Errorf("expected zero quantile for empty window; got %v", qs)
+	}
+	if h.Count() != 200 || h.Sum() != 5050+100*1000 {
+		t.Errorf("unexpected count %d and sum %f", h.Count(), h.Sum())
+	}
+}
+
+// TestRateWindow verifies that rates are averaged over their window.
+func TestRateWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewRate(time.Minute)
+	r.window.now, r.window.curStart = manualClock(&now), now
+
+	r.Add(60)
+	if v := r.Value(); v != 1 {
+		t.Errorf("expected rate of 1/s; got %f", v)
+	}
+	now = now.Add(30 * time.Second)
+	r.Add(120)
+	if v := r.Value(); v != 3 {
+		t.Errorf("expected rate of 3/s; got %f", v)
+	}
+	now = now.Add(45 * time.Second)
+	if v := r.Value(); v != 2 {
+		t.Errorf("expected rate of 2/s; got %f", v)
+	}
+	now = now.Add(time.Minute)
+	if v := r.Value(); v != 0 {
+		t.Errorf("expected rate of 0/s; got %f", v)
+	}
+}
+
+// TestRegistry verifies that metrics are registered once by name,
+// listed in order and written in the Prometheus format.
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test.requests").Inc(2)
+	r.Counter("test.requests").Inc(1)
+	r.Gauge("test.inflight").Update(5)
+	r.Histogram("test.latency", time.Minute).Record(10)
+	r.Register("test.replaced", NewCounter())
+	replacement := NewCounter()
+	r.Register("test.replaced", replacement)
+
+	if m, ok := r.Get("test.replaced"); !ok || m != replacement {
+		t.Errorf("expected replacement counter; got %v", m)
+	}
+	var names []string
+	r.Each(func(name string, m Metric) {
+		names = append(names, name)
+	})
+	expected := []string{"test.inflight", "test.latency", "test.replaced", "test.requests"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected metrics %s; got %s", expected, names)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE cockroach_test_requests counter\ncockroach_test_requests 3\n",
+		"# TYPE cockroach_test_inflight gauge\ncockroach_test_inflight 5\n",
+		"# TYPE cockroach_test_latency summary\n",
+		"cockroach_test_latency_count 1\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q in output:\n%s", line, buf.String())
+		}
+	}
+
+	for _, f := range []func(){
+		func() { r.Gauge("test.requests") },
+		func() { r.Counter("Invalid Name") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+// TestNameComponent verifies the conversion of CamelCase identifiers
+// into metric name components.
+func TestNameComponent(t *testing.T) {
+	for s, expected := range map[string]string{
+		"Get":              "get",
+		"EndTransaction":   "end_transaction",
+		"InternalGC":       "internal_gc",
+		"HTTPServer":       "http_server",
+		"errorString":      "error_string",
+		"WriteIntentError": "write_intent_error",
+		"":                 "unknown",
+	} {
+		if name := NameComponent(s); name != expected {
+			t.Errorf("expected %q for %q; got %q", expected, s, name)
+		}
+	}
+}
+
+// TestMethodMetrics verifies that the latency and event counts of
+// methods are registered as methods are first seen.
+func TestMethodMetrics(t *testing.T) {
+	r := NewRegistry()
+	mm := r.MethodMetrics("test.", "retries")
+	mm.RecordLatency("EndTransaction", time.Millisecond)
+	mm.Inc("EndTransaction", "retries")
+	mm.Inc("EndTransaction", "retries")
+	mm.Inc("EndTransaction", "pushes")
+
+	if m, ok := r.Get("test.end_transaction.latency"); !ok || m.(*Histogram).Count() != 1 {
+		t.Errorf("expected one latency of end_transaction; got %v", m)
+	}
+	if m, ok := r.Get("test.end_transaction.retries"); !ok || m.(*Counter).Count() != 2 {
+		t.Errorf("expected two retries of end_transaction; got %v", m)
+	}
+	if _, ok := r.Get("test.end_transaction.pushes"); ok {
+		t.Error("expected unspecified event not to be registered")
+	}
+}
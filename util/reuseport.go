@@ -0,0 +1,78 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// +build linux darwin
+
+package util
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenReusePort creates, binds and listens on a TCP socket with
+// SO_REUSEADDR and SO_REUSEPORT set.
+func listenReusePort(network, address string) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := addr.IP.To4(); addr.IP == nil || ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	if err := setupReusePort(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// FileListener duplicates the descriptor, so the file is closed
+	// regardless of the outcome.
+	f := os.NewFile(uintptr(fd), "reuseport:"+address)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// setupReusePort sets the reuse options on the socket fd, binds it to
+// sa and starts listening.
+func setupReusePort(fd int, sa syscall.Sockaddr) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return os.NewSyscallError("listen", err)
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package settings provides a registry of typed cluster settings.
+// Settings are registered with defaults by the packages which use
+// them, stored in the system keyspace and distributed via gossip so
+// that they may be changed at runtime.
+package settings
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// A Setting is a named, typed value which may be changed at runtime.
+// Values are encoded as strings for storage and transport.
+type Setting interface {
+	// Key returns the setting's name, e.g. "storage.scan_queue.max_size".
+	Key() string
+	// Description returns a description of the setting.
+	Description() string
+	// Type returns the name of the setting's type.
+	Type() string
+	// String returns the encoding of the current value.
+	String() string
+	// Default returns the encoding of the default value.
+	Default() string
+	// Validate returns an error if value is not a valid encoding of
+	// the setting.
+	Validate(value string) error
+
+	set(value string) error
+	reset()
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]Setting{}
+)
+
+// register adds s to the registry. Keys must be unique.
+func register(s Setting) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[s.Key()]; ok {
+		panic(fmt.Sprintf("setting %q registered twice", s.Key()))
+	}
+	registry[s.Key()] = s
+}
+
+// Lookup returns the setting with the given key.
+func Lookup(key string) (Setting, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	s, ok := registry[key]
+	return s, ok
+}
+
+// Keys returns the keys of all registered settings, sorted.
+func Keys() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	keys := make([]string, 0, len(registry))
+	for k := range registry {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate returns an error if key is not a registered setting or
+// value is not a valid encoding of it.
+func Validate(key, value string) error {
+	s, ok := Lookup(key)
+	if !ok {
+		return util.Errorf("unknown setting %q", key)
+	}
+	return s.Validate(value)
+}
+
+// Overrides returns the encoded values of the settings which differ
+// from their defaults, keyed by setting.
+func Overrides() map[string]string {
+	overrides := map[string]string{}
+	for _, key := range Keys() {
+		s, _ := Lookup(key)
+		if v := s.String(); v != s.Default() {
+			overrides[key] = v
+		}
+	}
+	return overrides
+}
+
+// Update sets each registered setting to its value in values, as
+// stored in the system keyspace, and resets the rest to their
+// defaults. Unknown keys and invalid values are logged and ignored,
+// leaving the setting at its default.
+func Update(values map[string]string) {
+	for _, key := range Keys() {
+		s, _ := Lookup(key)
+		value, ok := values[key]
+		if !ok {
+			s.reset()
+			continue
+		}
+		if err := s.set(value); err != nil {
+			log.Warningf("ignoring invalid value %q for setting %q: %s", value, key, err)
+			s.reset()
+		}
+	}
+	for key := range values {
+		if _, ok := Lookup(key); !ok {
+			log.Warningf("ignoring unknown setting %q", key)
+		}
+	}
+}
+
+// A DurationSetting is a time.Duration setting.
+type DurationSetting struct {
+	key, desc  string
+	defaultVal time.Duration
+	v          int64
+	validateFn func(time.Duration) error
+}
+
+// RegisterDurationSetting registers and returns a duration setting.
+// Values are encoded as for time.ParseDuration and must not be
+// negative.
+func RegisterDurationSetting(key, desc string, defaultVal time.Duration) *DurationSetting {
+	s := &DurationSetting{key: key, desc: desc, defaultVal: defaultVal, v: int64(defaultVal)}
+	register(s)
+	return s
+}
+
+// WithValidation sets an additional validation of values and returns s.
+func (s *DurationSetting) WithValidation(fn func(time.Duration) error) *DurationSetting {
+	s.validateFn = fn
+	return s
+}
+
+// Get returns the current value.
+func (s *DurationSetting) Get() time.Duration { return time.Duration(atomic.LoadInt64(&s.v)) }
+
+// Key implements Setting.
+func (s *DurationSetting) Key() string { return s.key }
+
+// Description implements Setting.
+func (s *DurationSetting) Description() string { return s.desc }
+
+// Type implements Setting.
+func (s *DurationSetting) Type() string { return "duration" }
+
+// String implements Setting.
+func (s *DurationSetting) String() string { return s.Get().String() }
+
+// Default implements Setting.
+func (s *DurationSetting) Default() string { return s.defaultVal.String() }
+
+// Validate implements Setting.
+func (s *DurationSetting) Validate(value string) error {
+	_, err := s.parse(value)
+	return err
+}
+
+func (s *DurationSetting) parse(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, util.Errorf("duration %s must not be negative", d)
+	}
+	if s.validateFn != nil {
+		if err := s.validateFn(d); err != nil {
+			return 0, err
+		}
+	}
+	return d, nil
+}
+
+func (s *DurationSetting) set(value string) error {
+	d, err := s.parse(value)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&s.v, int64(d))
+	return nil
+}
+
+func (s *DurationSetting) reset() { atomic.StoreInt64(&s.v, int64(s.defaultVal)) }
+
+// PositiveDuration validates that a duration setting is positive.
+func PositiveDuration(d time.Duration) error {
+	if d <= 0 {
+		return util.Errorf("%s must be positive", d)
+	}
+	return nil
+}
+
+// An IntSetting is an integer setting.
+type IntSetting struct {
+	key, desc  string
+	defaultVal int64
+	v          int64
+	validateFn func(int64) error
+}
+
+// RegisterIntSetting registers and returns an integer setting.
+func RegisterIntSetting(key, desc string, defaultVal int64) *IntSetting {
+	s := &IntSetting{key: key, desc: desc, defaultVal: defaultVal, v: defaultVal}
+	register(s)
+	return s
+}
+
+// WithValidation sets a validation of values and returns s.
+func (s *IntSetting) WithValidation(fn func(int64) error) *IntSetting {
+	s.validateFn = fn
+	return s
+}
+
+// Get returns the current value.
+func (s *IntSetting) Get() int64 { return atomic.LoadInt64(&s.v) }
+
+// Key implements Setting.
+func (s *IntSetting) Key() string { return s.key }
+
+// Description implements Setting.
+func (s *IntSetting) Description() string { return s.desc }
+
+// Type implements Setting.
+func (s *IntSetting) Type() string { return "integer" }
+
+// String implements Setting.
+func (s *IntSetting) String() string { return strconv.FormatInt(s.Get(), 10) }
+
+// Default implements Setting.
+func (s *IntSetting) Default() string { return strconv.FormatInt(s.defaultVal, 10) }
+
+// Validate implements Setting.
+func (s *IntSetting) Validate(value string) error {
+	_, err := s.parse(value)
+	return err
+}
+
+func (s *IntSetting) parse(value string) (int64, error) {
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if s.validateFn != nil {
+		if err := s.validateFn(i); err != nil {
+			return 0, err
+		}
+	}
+	return i, nil
+}
+
+func (s *IntSetting) set(value string) error {
+	i, err := s.parse(value)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&s.v, i)
+	return nil
+}
+
+func (s *IntSetting) reset() { atomic.StoreInt64(&s.v, s.defaultVal) }
+
+// PositiveInt validates that an integer setting is positive.
+func PositiveInt(i int64) error {
+	if i <= 0 {
+		return util.Errorf("%d must be positive", i)
+	}
+	return nil
+}
+
+// A ByteSizeSetting is a size in bytes.
+type ByteSizeSetting struct {
+	IntSetting
+}
+
+// RegisterByteSizeSetting registers and returns a byte size setting.
+// Values are encoded as an integer optionally followed by a unit, one
+// of B, KB, MB, GB and TB (powers of 1000) or KiB, MiB, GiB and TiB
+// (powers of 1024), and must not be negative.
+func RegisterByteSizeSetting(key, desc string, defaultVal int64) *ByteSizeSetting {
+	s := &ByteSizeSetting{IntSetting{key: key, desc: desc, defaultVal: defaultVal, v: defaultVal}}
+	register(s)
+	return s
+}
+
+// byteSizeUnits lists byte size units, longest suffixes first.
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12}, {"B", 1},
+}
+
+// ParseByteSize parses a byte size such as "64MiB" or "1000".
+func ParseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	mult := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, mult = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, util.Errorf("invalid byte size %q", value)
+	}
+	if n < 0 {
+		return 0, util.Errorf("byte size %d must not be negative", n)
+	}
+	return n * mult, nil
+}
+
+// Type implements Setting.
+func (s *ByteSizeSetting) Type() string { return "byte size" }
+
+// Validate implements Setting.
+func (s *ByteSizeSetting) Validate(value string) error {
+	_, err := s.parse(value)
+	return err
+}
+
+func (s *ByteSizeSetting) parse(value string) (int64, error) {
+	n, err := ParseByteSize(value)
+	if err != nil {
+		return 0, err
+	}
+	if s.validateFn != nil {
+		if err := s.validateFn(n); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (s *ByteSizeSetting) set(value string) error {
+	n, err := s.parse(value)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&s.v, n)
+	return nil
+}
+
+// A BoolSetting is a boolean setting.
+type BoolSetting struct {
+	key, desc  string
+	defaultVal bool
+	v          int32
+}
+
+// RegisterBoolSetting registers and returns a boolean setting. Values
+// are encoded as for strconv.ParseBool.
+func RegisterBoolSetting(key, desc string, defaultVal bool) *BoolSetting {
+	s := &BoolSetting{key: key, desc: desc, defaultVal: defaultVal}
+	s.reset()
+	register(s)
+	return s
+}
+
+// Get returns the current value.
+func (s *BoolSetting) Get() bool { return atomic.LoadInt32(&s.v) != 0 }
+
+// Key implements Setting.
+func (s *BoolSetting) Key() string { return s.key }
+
+// Description implements Setting.
+func (s *BoolSetting) Description() string { return s.desc }
+
+// Type implements Setting.
+func (s *BoolSetting) Type() string { return "boolean" }
+
+// String implements Setting.
+func (s *BoolSetting) String() string { return strconv.FormatBool(s.Get()) }
+
+// Default implements Setting.
+func (s *BoolSetting) Default() string { return strconv.FormatBool(s.defaultVal) }
+
+// Validate implements Setting.
+func (s *BoolSetting) Validate(value string) error {
+	_, err := strconv.ParseBool(value)
+	return err
+}
+
+func (s *BoolSetting) set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	s.store(b)
+	return nil
+}
+
+func (s *BoolSetting) reset() { s.store(s.defaultVal) }
+
+func (s *BoolSetting) store(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&s.v, v)
+}
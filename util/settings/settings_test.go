@@ -0,0 +1,128 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package settings
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	testDuration = RegisterDurationSetting("test.duration", "a duration", time.Second)
+	testInt      = RegisterIntSetting("test.int", "an integer", 10).WithValidation(PositiveInt)
+	testBytes    = RegisterByteSizeSetting("test.bytes", "a byte size", 1<<20)
+	testBool     = RegisterBoolSetting("test.bool", "a boolean", true)
+)
+
+// TestParseByteSize verifies parsing of byte sizes with units.
+func TestParseByteSize(t *testing.T) {
+	testCases := []struct {
+		value  string
+		expN   int64
+		expErr bool
+	}{
+		{"0", 0, false},
+		{"100", 100, false},
+		{"100B", 100, false},
+		{"16KiB", 16 << 10, false},
+		{"16 KB", 16000, false},
+		{"64MiB", 64 << 20, false},
+		{"2GB", 2e9, false},
+		{"1TiB", 1 << 40, false},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"1.5MiB", 0, true},
+		{"10XB", 0, true},
+	}
+	for i, c := range testCases {
+		n, err := ParseByteSize(c.value)
+		if c.expErr != (err != nil) {
+			t.Errorf("%d: %q: expected error %t; got %v", i, c.value, c.expErr, err)
+		} else if n != c.expN {
+			t.Errorf("%d: %q: expected %d; got %d", i, c.value, c.expN, n)
+		}
+	}
+}
+
+// TestValidate verifies validation of values by setting type.
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		key, value string
+		expErr     bool
+	}{
+		{"test.duration", "5m", false},
+		{"test.duration", "-5m", true},
+		{"test.duration", "5", true},
+		{"test.int", "5", false},
+		{"test.int", "0", true},
+		{"test.int", "five", true},
+		{"test.bytes", "64MiB", false},
+		{"test.bytes", "lots", true},
+		{"test.bool", "false", false},
+		{"test.bool", "maybe", true},
+		{"test.unknown", "1", true},
+	}
+	for i, c := range testCases {
+		if err := Validate(c.key, c.value); c.expErr != (err != nil) {
+			t.Errorf("%d: %s=%q: expected error %t; got %v", i, c.key, c.value, c.expErr, err)
+		}
+	}
+}
+
+// TestUpdate verifies that updates set the specified settings, ignore
+// invalid values and reset unspecified settings to their defaults.
+func TestUpdate(t *testing.T) {
+	defer Update(nil)
+	Update(map[string]string{
+		"test.duration": "1m",
+		"test.int":      "20",
+		"test.bytes":    "2MiB",
+		"test.bool":     "false",
+		"test.unknown":  "1",
+	})
+	if d := testDuration.Get(); d != time.Minute {
+		t.Errorf("expected duration 1m; got %s", d)
+	}
+	if i := testInt.Get(); i != 20 {
+		t.Errorf("expected integer 20; got %d", i)
+	}
+	if n := testBytes.Get(); n != 2<<20 {
+		t.Errorf("expected byte size 2MiB; got %d", n)
+	}
+	if testBool.Get() {
+		t.Error("expected boolean false")
+	}
+	if o := Overrides(); len(o) != 4 || o["test.bytes"] != "2097152" {
+		t.Errorf("expected overrides of all four settings; got %v", o)
+	}
+
+	Update(map[string]string{"test.int": "-1"})
+	if d := testDuration.Get(); d != time.Second {
+		t.Errorf("expected duration reset to 1s; got %s", d)
+	}
+	if i := testInt.Get(); i != 10 {
+		t.Errorf("expected invalid integer to leave default 10; got %d", i)
+	}
+	if !testBool.Get() {
+		t.Error("expected boolean reset to true")
+	}
+	if s, ok := Lookup("test.bytes"); !ok || s.String() != s.Default() {
+		t.Errorf("expected byte size reset to default; got %v", s)
+	}
+	if o := Overrides(); len(o) != 0 {
+		t.Errorf("expected no overrides; got %v", o)
+	}
+}